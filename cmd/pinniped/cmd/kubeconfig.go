@@ -139,7 +139,7 @@ func kubeconfigCommand(deps kubeconfigDeps) *cobra.Command {
 	f.StringVar(&flags.oidc.requestAudience, "oidc-request-audience", "", "Request a token with an alternate audience using RFC8693 token exchange")
 	f.StringVar(&flags.oidc.upstreamIDPName, "upstream-identity-provider-name", "", "The name of the upstream identity provider used during login with a Supervisor")
 	f.StringVar(&flags.oidc.upstreamIDPType, "upstream-identity-provider-type", "", fmt.Sprintf("The type of the upstream identity provider used during login with a Supervisor (e.g. '%s', '%s', '%s')", idpdiscoveryv1alpha1.IDPTypeOIDC, idpdiscoveryv1alpha1.IDPTypeLDAP, idpdiscoveryv1alpha1.IDPTypeActiveDirectory))
-	f.StringVar(&flags.oidc.upstreamIDPFlow, "upstream-identity-provider-flow", "", fmt.Sprintf("The type of client flow to use with the upstream identity provider during login with a Supervisor (e.g. '%s', '%s')", idpdiscoveryv1alpha1.IDPFlowCLIPassword, idpdiscoveryv1alpha1.IDPFlowBrowserAuthcode))
+	f.StringVar(&flags.oidc.upstreamIDPFlow, "upstream-identity-provider-flow", "", fmt.Sprintf("The type of client flow to use with the upstream identity provider during login with a Supervisor (e.g. '%s', '%s', '%s')", idpdiscoveryv1alpha1.IDPFlowCLIPassword, idpdiscoveryv1alpha1.IDPFlowBrowserAuthcode, idpdiscoveryv1alpha1.IDPFlowDevice))
 	f.StringVar(&flags.kubeconfigPath, "kubeconfig", os.Getenv("KUBECONFIG"), "Path to kubeconfig file")
 	f.StringVar(&flags.kubeconfigContextOverride, "kubeconfig-context", "", "Kubeconfig context name (default: current active context)")
 	f.BoolVar(&flags.skipValidate, "skip-validation", false, "Skip final validation of the kubeconfig (default: false)")
@@ -908,7 +908,8 @@ func selectUpstreamIDPFlow(discoveredIDPFlows []idpdiscoveryv1alpha1.IDPFlow, se
 		return idpdiscoveryv1alpha1.IDPFlow(specifiedFlow), nil
 	case specifiedFlow != "":
 		// The user specified a flow, so validate that it is available for the selected IDP.
-		for _, flow := range discoveredIDPFlows {
+		availableFlows := append(unlistedIDPFlows(selectedIDPType), discoveredIDPFlows...)
+		for _, flow := range availableFlows {
 			if flow.Equals(specifiedFlow) {
 				// Found it, so use it as specified by the user.
 				return flow, nil
@@ -930,3 +931,17 @@ func selectUpstreamIDPFlow(discoveredIDPFlows []idpdiscoveryv1alpha1.IDPFlow, se
 			selectedIDPName, selectedIDPType, discoveredIDPFlows)
 	}
 }
+
+// unlistedIDPFlows returns the flows which are available for every IDP of the given type, but which are not listed
+// by discovery. Listing them would make older CLIs require the --upstream-identity-provider-flow flag, since they
+// cannot choose between several flows.
+func unlistedIDPFlows(idpType idpdiscoveryv1alpha1.IDPType) []idpdiscoveryv1alpha1.IDPFlow {
+	switch idpType {
+	case idpdiscoveryv1alpha1.IDPTypeOIDC:
+		return []idpdiscoveryv1alpha1.IDPFlow{idpdiscoveryv1alpha1.IDPFlowDevice}
+	case idpdiscoveryv1alpha1.IDPTypeLDAP, idpdiscoveryv1alpha1.IDPTypeActiveDirectory:
+		return []idpdiscoveryv1alpha1.IDPFlow{idpdiscoveryv1alpha1.IDPFlowBrowserAuthcode, idpdiscoveryv1alpha1.IDPFlowDevice}
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/spf13/cobra"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	"go.pinniped.dev/internal/execcredcache"
+	"go.pinniped.dev/internal/net/phttp"
+	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/pkg/oidcclient/filesession"
+)
+
+//nolint: gochecknoinits
+func init() {
+	rootCmd.AddCommand(logoutCommand(logoutCommandRealDeps()))
+}
+
+type logoutCommandDeps struct {
+	lookupEnv  func(string) (string, bool)
+	endSession func(ctx context.Context, client *http.Client, issuer string, clientID string, idToken string) error
+}
+
+func logoutCommandRealDeps() logoutCommandDeps {
+	return logoutCommandDeps{
+		lookupEnv:  os.LookupEnv,
+		endSession: endSession,
+	}
+}
+
+type logoutFlags struct {
+	issuer              string
+	clientID            string
+	sessionCachePath    string
+	credentialCachePath string
+	caBundlePaths       []string
+	caBundleData        []string
+}
+
+func logoutCommand(deps logoutCommandDeps) *cobra.Command {
+	var (
+		cmd = &cobra.Command{
+			Args:         cobra.NoArgs,
+			Use:          "logout --issuer ISSUER",
+			Short:        "Log out of a Pinniped Supervisor",
+			Long:         "Ends your sessions with a Pinniped Supervisor FederationDomain and removes them from the local session cache",
+			SilenceUsage: true,
+		}
+		flags logoutFlags
+	)
+	cmd.Flags().StringVar(&flags.issuer, "issuer", "", "OpenID Connect issuer URL")
+	cmd.Flags().StringVar(&flags.clientID, "client-id", "pinniped-cli", "OpenID Connect client ID")
+	cmd.Flags().StringVar(&flags.sessionCachePath, "session-cache", filepath.Join(mustGetConfigDir(), "sessions.yaml"), "Path to session cache file")
+	cmd.Flags().StringVar(&flags.credentialCachePath, "credential-cache", filepath.Join(mustGetConfigDir(), "credentials.yaml"), "Path to cluster-specific credentials cache, whose credentials for the issuer are also removed (\"\" skips the cache)")
+	cmd.Flags().StringSliceVar(&flags.caBundlePaths, "ca-bundle", nil, "Path to TLS certificate authority bundle (PEM format, optional, can be repeated)")
+	cmd.Flags().StringSliceVar(&flags.caBundleData, "ca-bundle-data", nil, "Base64 encoded TLS certificate authority bundle (base64 encoded PEM format, optional, can be repeated)")
+	mustMarkRequired(cmd, "issuer")
+	cmd.RunE = func(cmd *cobra.Command, args []string) error { return runLogout(cmd, deps, flags) }
+	return cmd
+}
+
+func runLogout(cmd *cobra.Command, deps logoutCommandDeps, flags logoutFlags) error {
+	pLogger, err := SetLogLevel(deps.lookupEnv)
+	if err != nil {
+		plog.WarningErr("Received error while setting log level", err)
+	}
+
+	client := phttp.Default(nil)
+	if len(flags.caBundlePaths) > 0 || len(flags.caBundleData) > 0 {
+		client, err = makeClient(flags.caBundlePaths, flags.caBundleData)
+		if err != nil {
+			return err
+		}
+	}
+
+	sessionCache := filesession.New(flags.sessionCachePath)
+	tokens := sessionCache.GetTokens(flags.issuer, flags.clientID)
+
+	ctx, cancel := context.WithTimeout(cmd.Context(), 30*time.Second)
+	defer cancel()
+
+	// End the sessions at the Supervisor first, so the local sessions are kept when it cannot be reached and the
+	// logout can be retried.
+	var errs []error
+	for _, token := range tokens {
+		if token.IDToken == nil || token.IDToken.Token == "" {
+			continue
+		}
+		if err := deps.endSession(ctx, client, flags.issuer, flags.clientID, token.IDToken.Token); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("could not end session at the Supervisor, so the local session was kept: %w", utilerrors.NewAggregate(errs))
+	}
+
+	removed := sessionCache.RemoveTokens(flags.issuer, flags.clientID)
+	pLogger.Debug("removed sessions from the session cache", "issuer", flags.issuer, "client id", flags.clientID, "count", len(removed))
+
+	// Cached cluster credentials were issued based on the sessions, so remove the ones of this issuer too.
+	if flags.credentialCachePath != "" {
+		removedCredentials := execcredcache.New(flags.credentialCachePath).RemoveIssuer(flags.issuer)
+		pLogger.Debug("removed cluster credentials from the credential cache", "issuer", flags.issuer, "count", removedCredentials)
+	}
+
+	if len(tokens) == 0 {
+		_, _ = fmt.Fprintf(cmd.OutOrStdout(), "No sessions found for issuer %q.\n", flags.issuer)
+		return nil
+	}
+	_, _ = fmt.Fprintf(cmd.OutOrStdout(), "Logged out of issuer %q.\n", flags.issuer)
+	return nil
+}
+
+// endSession ends the session of the ID token using the issuer's OIDC RP-Initiated Logout end session endpoint.
+func endSession(ctx context.Context, client *http.Client, issuer string, clientID string, idToken string) error {
+	provider, err := oidc.NewProvider(oidc.ClientContext(ctx, client), issuer)
+	if err != nil {
+		return fmt.Errorf("could not perform OIDC discovery for %q: %w", issuer, err)
+	}
+	var discoveryClaims struct {
+		EndSessionEndpoint string `json:"end_session_endpoint"`
+	}
+	if err := provider.Claims(&discoveryClaims); err != nil {
+		return fmt.Errorf("could not decode end_session_endpoint in OIDC discovery from %q: %w", issuer, err)
+	}
+	if discoveryClaims.EndSessionEndpoint == "" {
+		return fmt.Errorf("issuer %q does not support logout", issuer)
+	}
+
+	form := url.Values{"id_token_hint": {idToken}, "client_id": {clientID}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discoveryClaims.EndSessionEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("could not build end session request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// The end session endpoint may redirect a browser elsewhere, e.g. to the upstream identity provider's own
+	// end session endpoint. The session has already ended by then, so do not follow the redirect.
+	noRedirectClient := *client
+	noRedirectClient.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	resp, err := noRedirectClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not end session: %w", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("could not end session: unexpected response status %q", resp.Status)
+	}
+	return nil
+}
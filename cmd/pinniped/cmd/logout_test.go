@@ -0,0 +1,282 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientauthv1beta1 "k8s.io/client-go/pkg/apis/clientauthentication/v1beta1"
+
+	"go.pinniped.dev/internal/execcredcache"
+	"go.pinniped.dev/internal/here"
+	"go.pinniped.dev/internal/testutil"
+	"go.pinniped.dev/pkg/oidcclient"
+	"go.pinniped.dev/pkg/oidcclient/filesession"
+	"go.pinniped.dev/pkg/oidcclient/oidctypes"
+)
+
+func TestLogoutCommand(t *testing.T) {
+	cfgDir := mustGetConfigDir()
+
+	type cachedSession struct {
+		key   oidcclient.SessionCacheKey
+		token *oidctypes.Token
+	}
+
+	cachedCredential := func(token string) *clientauthv1beta1.ExecCredential {
+		expiry := metav1.NewTime(time.Now().Add(time.Hour))
+		return &clientauthv1beta1.ExecCredential{Status: &clientauthv1beta1.ExecCredentialStatus{Token: token, ExpirationTimestamp: &expiry}}
+	}
+
+	cachedToken := func(idToken string) *oidctypes.Token {
+		return &oidctypes.Token{
+			IDToken:      &oidctypes.IDToken{Token: idToken, Expiry: metav1.NewTime(time.Now().Add(time.Hour))},
+			RefreshToken: &oidctypes.RefreshToken{Token: "some-refresh-token"},
+		}
+	}
+
+	tests := []struct {
+		name            string
+		args            []string
+		cachedSessions  []cachedSession
+		endSessionErr   error
+		wantError       string
+		wantStdout      string
+		wantEndSessions []string
+		// wantCredentialsKept is whether the cached credentials of the issuer remain in the credential cache.
+		wantCredentialsKept bool
+		// wantSessionsKept is whether the sessions of the issuer remain in the session cache.
+		wantSessionsKept bool
+	}{
+		{
+			name: "help flag passed",
+			args: []string{"--help"},
+			wantStdout: here.Doc(`
+				Ends your sessions with a Pinniped Supervisor FederationDomain and removes them from the local session cache
+
+				Usage:
+				  logout --issuer ISSUER [flags]
+
+				Flags:
+				      --ca-bundle strings         Path to TLS certificate authority bundle (PEM format, optional, can be repeated)
+				      --ca-bundle-data strings    Base64 encoded TLS certificate authority bundle (base64 encoded PEM format, optional, can be repeated)
+				      --client-id string          OpenID Connect client ID (default "pinniped-cli")
+				      --credential-cache string   Path to cluster-specific credentials cache, whose credentials for the issuer are also removed ("" skips the cache) (default "` + cfgDir + `/credentials.yaml")
+				  -h, --help                      help for logout
+				      --issuer string             OpenID Connect issuer URL
+				      --session-cache string      Path to session cache file (default "` + cfgDir + `/sessions.yaml")
+			`),
+			wantCredentialsKept: true,
+		},
+		{
+			name:                "missing required flags",
+			args:                []string{},
+			wantError:           `required flag(s) "issuer" not set`,
+			wantCredentialsKept: true,
+		},
+		{
+			name: "invalid CA bundle path",
+			args: []string{
+				"--issuer", "test-issuer",
+				"--ca-bundle", "./does/not/exist",
+			},
+			wantError:           "could not read --ca-bundle: open ./does/not/exist: no such file or directory",
+			wantCredentialsKept: true,
+		},
+		{
+			name:       "no cached sessions",
+			args:       []string{"--issuer", "test-issuer"},
+			wantStdout: "No sessions found for issuer \"test-issuer\".\n",
+		},
+		{
+			name: "ends all cached sessions of the issuer and client",
+			args: []string{"--issuer", "test-issuer"},
+			cachedSessions: []cachedSession{
+				{key: oidcclient.SessionCacheKey{Issuer: "test-issuer", ClientID: "pinniped-cli", Scopes: []string{"openid"}}, token: cachedToken("test-id-token-1")},
+				{key: oidcclient.SessionCacheKey{Issuer: "test-issuer", ClientID: "pinniped-cli", Scopes: []string{"openid", "pinniped:request-audience"}}, token: cachedToken("test-id-token-2")},
+				{key: oidcclient.SessionCacheKey{Issuer: "other-issuer", ClientID: "pinniped-cli", Scopes: []string{"openid"}}, token: cachedToken("other-id-token")},
+			},
+			wantStdout:      "Logged out of issuer \"test-issuer\".\n",
+			wantEndSessions: []string{"test-id-token-1", "test-id-token-2"},
+		},
+		{
+			name: "cached session without an ID token",
+			args: []string{"--issuer", "test-issuer", "--client-id", "test-client-id"},
+			cachedSessions: []cachedSession{
+				{key: oidcclient.SessionCacheKey{Issuer: "test-issuer", ClientID: "test-client-id"}, token: &oidctypes.Token{RefreshToken: &oidctypes.RefreshToken{Token: "some-refresh-token"}}},
+			},
+			wantStdout: "Logged out of issuer \"test-issuer\".\n",
+		},
+		{
+			name: "does not remove the credential cache when its path is empty",
+			args: []string{"--issuer", "test-issuer", "--credential-cache", ""},
+			cachedSessions: []cachedSession{
+				{key: oidcclient.SessionCacheKey{Issuer: "test-issuer", ClientID: "pinniped-cli"}, token: cachedToken("test-id-token")},
+			},
+			wantStdout:          "Logged out of issuer \"test-issuer\".\n",
+			wantEndSessions:     []string{"test-id-token"},
+			wantCredentialsKept: true,
+		},
+		{
+			name: "error ending the session",
+			args: []string{"--issuer", "test-issuer"},
+			cachedSessions: []cachedSession{
+				{key: oidcclient.SessionCacheKey{Issuer: "test-issuer", ClientID: "pinniped-cli"}, token: cachedToken("test-id-token")},
+			},
+			endSessionErr:       fmt.Errorf("some end session error"),
+			wantError:           "could not end session at the Supervisor, so the local session was kept: some end session error",
+			wantEndSessions:     []string{"test-id-token"},
+			wantCredentialsKept: true,
+			wantSessionsKept:    true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tmpdir := testutil.TempDir(t)
+			sessionCachePath := filepath.Join(tmpdir, "sessions.yaml")
+			credCachePath := filepath.Join(tmpdir, "credentials.yaml")
+			credCache := execcredcache.New(credCachePath)
+			credCache.PutForIssuer("test-key", "test-issuer", cachedCredential("test-credential"))
+			credCache.PutForIssuer("other-key", "other-issuer", cachedCredential("other-credential"))
+
+			sessionCache := filesession.New(sessionCachePath)
+			sessionCache.PutToken(oidcclient.SessionCacheKey{Issuer: "other-issuer", ClientID: "pinniped-cli"}, cachedToken("other-issuer-id-token"))
+			for _, session := range tt.cachedSessions {
+				sessionCache.PutToken(session.key, session.token)
+			}
+
+			var gotEndSessions []string
+			cmd := logoutCommand(logoutCommandDeps{
+				lookupEnv: func(s string) (string, bool) { return "", false },
+				endSession: func(ctx context.Context, client *http.Client, issuer string, clientID string, idToken string) error {
+					require.Equal(t, "test-issuer", issuer)
+					require.NotNil(t, client)
+					gotEndSessions = append(gotEndSessions, idToken)
+					return tt.endSessionErr
+				},
+			})
+			require.NotNil(t, cmd)
+
+			// The test case's args come last, so they can override these flags.
+			args := append([]string{"--session-cache", sessionCachePath, "--credential-cache", credCachePath}, tt.args...)
+
+			var stdout, stderr bytes.Buffer
+			cmd.SetOut(&stdout)
+			cmd.SetErr(&stderr)
+			cmd.SetArgs(args)
+			err := cmd.Execute()
+			if tt.wantError != "" {
+				require.EqualError(t, err, tt.wantError)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.wantStdout, stdout.String(), "unexpected stdout")
+			require.ElementsMatch(t, tt.wantEndSessions, gotEndSessions)
+
+			require.Equal(t, tt.wantCredentialsKept, credCache.Get("test-key") != nil, "unexpected credential of the issuer in the credential cache")
+			require.NotNil(t, credCache.Get("other-key"), "credential of another issuer was removed from the credential cache")
+
+			sessionsOfIssuer := len(sessionCache.GetTokens("test-issuer", "pinniped-cli")) + len(sessionCache.GetTokens("test-issuer", "test-client-id"))
+			require.Equal(t, tt.wantSessionsKept, sessionsOfIssuer > 0, "unexpected sessions of the issuer in the session cache")
+			require.NotEmpty(t, sessionCache.GetTokens("other-issuer", "pinniped-cli"), "session of another issuer was removed from the session cache")
+		})
+	}
+}
+
+func TestEndSession(t *testing.T) {
+	tests := []struct {
+		name              string
+		discoveryStatus   int
+		noEndSession      bool
+		endSessionStatus  int
+		wantError         string
+		wantEndSessionReq bool
+	}{
+		{
+			name:              "success with a logged out page",
+			endSessionStatus:  http.StatusOK,
+			wantEndSessionReq: true,
+		},
+		{
+			name:              "success with a redirect, which is not followed",
+			endSessionStatus:  http.StatusSeeOther,
+			wantEndSessionReq: true,
+		},
+		{
+			name:            "discovery fails",
+			discoveryStatus: http.StatusNotFound,
+			wantError:       "could not perform OIDC discovery for \"ISSUER\": 404 Not Found: not found\n",
+		},
+		{
+			name:         "issuer does not advertise an end session endpoint",
+			noEndSession: true,
+			wantError:    `issuer "ISSUER" does not support logout`,
+		},
+		{
+			name:              "end session endpoint returns an error",
+			endSessionStatus:  http.StatusBadRequest,
+			wantError:         `could not end session: unexpected response status "400 Bad Request"`,
+			wantEndSessionReq: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var issuer string
+			var gotEndSessionReq bool
+			caBundle, serverURL := testutil.TLSTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/.well-known/openid-configuration":
+					if tt.discoveryStatus != 0 {
+						http.Error(w, "not found", tt.discoveryStatus)
+						return
+					}
+					discovery := map[string]string{"issuer": issuer}
+					if !tt.noEndSession {
+						discovery["end_session_endpoint"] = issuer + "/oauth2/logout"
+					}
+					w.Header().Set("Content-Type", "application/json")
+					require.NoError(t, json.NewEncoder(w).Encode(discovery))
+				case "/oauth2/logout":
+					gotEndSessionReq = true
+					require.Equal(t, http.MethodPost, r.Method)
+					require.NoError(t, r.ParseForm())
+					require.Equal(t, "test-id-token", r.PostForm.Get("id_token_hint"))
+					require.Equal(t, "test-client-id", r.PostForm.Get("client_id"))
+					if tt.endSessionStatus == http.StatusSeeOther {
+						http.Redirect(w, r, "/some-other-page", http.StatusSeeOther)
+						return
+					}
+					w.WriteHeader(tt.endSessionStatus)
+				default:
+					t.Errorf("unexpected request to %s", r.URL.Path)
+				}
+			})
+			issuer = serverURL
+
+			client, err := makeClient(nil, []string{base64.StdEncoding.EncodeToString([]byte(caBundle))})
+			require.NoError(t, err)
+
+			err = endSession(context.Background(), client, issuer, "test-client-id", "test-id-token")
+			if tt.wantError != "" {
+				require.EqualError(t, err, strings.ReplaceAll(tt.wantError, "ISSUER", issuer))
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.wantEndSessionReq, gotEndSessionReq)
+		})
+	}
+}
@@ -1,4 +1,4 @@
-// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2021-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package v1alpha1
@@ -18,6 +18,10 @@ const (
 
 	IDPFlowCLIPassword     IDPFlow = "cli_password"
 	IDPFlowBrowserAuthcode IDPFlow = "browser_authcode"
+
+	// IDPFlowDevice is the device authorization grant, which is not returned by the identity provider discovery
+	// endpoint, but which clients may choose for identity providers of type "oidc" when they cannot open a browser.
+	IDPFlowDevice IDPFlow = "device"
 )
 
 // Equals is a convenience function for comparing an IDPType to a string.
@@ -0,0 +1,131 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type OIDCClientPhase string
+
+const (
+	// PhasePending is the default phase for newly-created OIDCClient resources.
+	PhasePending OIDCClientPhase = "Pending"
+
+	// PhaseReady is the phase for an OIDCClient resource in a healthy state.
+	PhaseReady OIDCClientPhase = "Ready"
+
+	// PhaseError is the phase for an OIDCClient in an unhealthy state.
+	PhaseError OIDCClientPhase = "Error"
+)
+
+// RedirectURI is a URI to which the Supervisor may redirect the user's browser at the end of an authorization request.
+// It must use the https scheme, unless its host is the IPv4 or IPv6 loopback interface, in which case it may use the
+// http scheme.
+// +kubebuilder:validation:Pattern=`^https://.+|^http://(127\.0\.0\.1|\[::1\])(:\d+)?/`
+type RedirectURI string
+
+// GrantType is an OAuth 2.0 grant type which a client may use at the Supervisor's token endpoint.
+// +kubebuilder:validation:Enum="authorization_code";"refresh_token";"urn:ietf:params:oauth:grant-type:token-exchange"
+type GrantType string
+
+// Scope is an OAuth 2.0 scope which a client may request.
+// +kubebuilder:validation:Enum="openid";"offline_access";"profile";"email";"pinniped:request-audience"
+type Scope string
+
+// TokenEndpointAuthMethod is the method which a confidential client uses to authenticate itself to the
+// Supervisor's token endpoint.
+// +kubebuilder:validation:Enum=client_secret_basic;client_secret_post
+type TokenEndpointAuthMethod string
+
+const (
+	// ClientSecretBasic means that the client sends its credentials using HTTP basic authentication.
+	ClientSecretBasic TokenEndpointAuthMethod = "client_secret_basic"
+
+	// ClientSecretPost means that the client sends its credentials as client_id and client_secret form parameters.
+	ClientSecretPost TokenEndpointAuthMethod = "client_secret_post"
+)
+
+// OIDCClientSecret refers to the Secret which holds the client secret of an OIDCClient.
+type OIDCClientSecret struct {
+	// SecretName is the name of a Secret in the same namespace as the OIDCClient. The Secret must be of type
+	// "secrets.pinniped.dev/oidc-client-secret" and must have a key named "clientSecretHash" whose value is the
+	// bcrypt hash of the client secret. The plaintext client secret is never stored by the Supervisor.
+	// +kubebuilder:validation:MinLength=1
+	SecretName string `json:"secretName"`
+}
+
+// OIDCClientSpec is a struct that describes an OIDCClient.
+type OIDCClientSpec struct {
+	// AllowedRedirectURIs is the list of redirect_uri values which this client may use in authorization requests.
+	// Any other redirect_uri will be rejected.
+	// +kubebuilder:validation:MinItems=1
+	// +listType=set
+	AllowedRedirectURIs []RedirectURI `json:"allowedRedirectURIs"`
+
+	// AllowedGrantTypes is the list of grant types which this client may use. It must include "authorization_code".
+	// When it includes "refresh_token", then AllowedScopes must include "offline_access". When it includes
+	// "urn:ietf:params:oauth:grant-type:token-exchange", then AllowedScopes must include "pinniped:request-audience".
+	// +kubebuilder:validation:MinItems=1
+	// +listType=set
+	AllowedGrantTypes []GrantType `json:"allowedGrantTypes"`
+
+	// AllowedScopes is the list of scopes which this client may request. It must include "openid".
+	// +kubebuilder:validation:MinItems=1
+	// +listType=set
+	AllowedScopes []Scope `json:"allowedScopes"`
+
+	// ClientSecret refers to the Secret which holds the client secret of this confidential client.
+	ClientSecret OIDCClientSecret `json:"clientSecret"`
+
+	// TokenEndpointAuthMethod is the method which this client uses to authenticate to the token endpoint.
+	// Defaults to "client_secret_basic".
+	// +kubebuilder:default=client_secret_basic
+	// +optional
+	TokenEndpointAuthMethod TokenEndpointAuthMethod `json:"tokenEndpointAuthMethod,omitempty"`
+}
+
+// OIDCClientStatus is a struct that describes the actual state of an OIDCClient.
+type OIDCClientStatus struct {
+	// Phase summarizes the overall status of the OIDCClient.
+	// +kubebuilder:default=Pending
+	// +kubebuilder:validation:Enum=Pending;Ready;Error
+	Phase OIDCClientPhase `json:"phase,omitempty"`
+
+	// Represents the observations of an OIDCClient's current state.
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	Conditions []Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+}
+
+// OIDCClient describes the configuration of an OIDC client which may use the Supervisor's FederationDomains.
+// The name of the OIDCClient is used as its client_id, and must begin with "client.oauth.pinniped.dev-".
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +kubebuilder:resource:categories=pinniped
+// +kubebuilder:printcolumn:name="Privileged Scopes",type=string,JSONPath=`.spec.allowedScopes[?(@ == "pinniped:request-audience")]`
+// +kubebuilder:printcolumn:name="Status",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+// +kubebuilder:subresource:status
+type OIDCClient struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	// Spec of the OIDC client.
+	Spec OIDCClientSpec `json:"spec"`
+
+	// Status of the OIDC client.
+	Status OIDCClientStatus `json:"status,omitempty"`
+}
+
+// OIDCClientList is a list of OIDCClient objects.
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+type OIDCClientList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []OIDCClient `json:"items"`
+}
@@ -119,6 +119,35 @@ type LDAPIdentityProviderGroupSearch struct {
 	// the result of the group search.
 	// +optional
 	Attributes LDAPIdentityProviderGroupSearchAttributes `json:"attributes,omitempty"`
+
+	// SkipGroupRefresh, when true, keeps the groups of a user from their initial login when their session is refreshed,
+	// instead of searching for the groups of the user again during each refresh. The group search can be expensive for
+	// some directories, but when it is skipped, a change of the group memberships of a user only takes effect in their
+	// session when they log in again.
+	// Optional. Defaults to false, which refreshes the groups of the user during each refresh.
+	// +optional
+	SkipGroupRefresh bool `json:"skipGroupRefresh,omitempty"`
+
+	// NestedGroups, when specified, also searches for the groups of which the groups of the user are members, and so on,
+	// for LDAP servers which only find the groups of which the user is a direct member, e.g. OpenLDAP, 389 Directory
+	// Server or FreeIPA. Each of these searches uses the same Base and Filter, with the dn (distinguished name) of a
+	// group in place of the dn of the user. Note that this performs one more search for each of the groups of the user,
+	// although the results are cached for a few minutes.
+	// Optional. When not specified, only the groups of which the user is a direct member are found.
+	// +optional
+	NestedGroups *LDAPIdentityProviderNestedGroups `json:"nestedGroups,omitempty"`
+}
+
+// LDAPIdentityProviderNestedGroups configures the search for nested groups.
+type LDAPIdentityProviderNestedGroups struct {
+	// MaxDepth is the maximum number of levels of nested groups which are searched above the groups of which the user
+	// is a direct member. E.g. 1 only finds the groups of which those groups are direct members. Each group is only
+	// searched once, so groups which are members of each other do not cause an endless search.
+	// Optional. Defaults to 5.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=10
+	// +optional
+	MaxDepth int32 `json:"maxDepth,omitempty"`
 }
 
 // Spec for configuring an LDAP identity provider.
@@ -127,6 +156,30 @@ type LDAPIdentityProviderSpec struct {
 	// +kubebuilder:validation:MinLength=1
 	Host string `json:"host"`
 
+	// AdditionalHosts are the hostnames of other servers of this LDAP identity provider, e.g. replicas of the server of
+	// the Host, in the same format as the Host. When a server cannot be reached, the next server is used, in order: the
+	// Host, then the AdditionalHosts, then the servers which were discovered using the SRVLookupDomain. A server which
+	// cannot be reached is only used after the other servers for a while. The Host still identifies this identity
+	// provider in the subject of its users, so changing the Host changes the subjects, but changing the AdditionalHosts
+	// does not.
+	// +kubebuilder:validation:MaxItems=16
+	// +optional
+	AdditionalHosts []string `json:"additionalHosts,omitempty"`
+
+	// SRVLookupDomain is the DNS domain whose "_ldap._tcp" SRV records are looked up to discover other servers of this
+	// LDAP identity provider, e.g. "example.com" to look up "_ldap._tcp.example.com". The discovered servers are
+	// used after the Host and the AdditionalHosts, in the order of the priorities and the weights of the records. The
+	// ports of the records are only used with StartTLS, since they are the ports of plain LDAP, so the port 636 is used
+	// with TLS. The records are looked up again every 5 minutes.
+	// +optional
+	SRVLookupDomain string `json:"srvLookupDomain,omitempty"`
+
+	// LoadBalancing determines how the connections are spread across the servers of this LDAP identity provider.
+	// "Failover" always connects to the first server which can be reached, in order. "RoundRobin" connects to each
+	// server which can be reached in turn. Defaults to "Failover".
+	// +optional
+	LoadBalancing LoadBalancing `json:"loadBalancing,omitempty"`
+
 	// TLS contains the connection settings for how to establish the connection to the Host.
 	TLS *TLSSpec `json:"tls,omitempty"`
 
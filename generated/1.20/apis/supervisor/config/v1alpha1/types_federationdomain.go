@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package v1alpha1
@@ -41,6 +41,258 @@ type FederationDomainTLSSpec struct {
 	SecretName string `json:"secretName,omitempty"`
 }
 
+// +kubebuilder:validation:Enum=OIDCIdentityProvider;LDAPIdentityProvider;ActiveDirectoryIdentityProvider
+type FederationDomainIdentityProviderKind string
+
+const (
+	OIDCIdentityProviderKind            = FederationDomainIdentityProviderKind("OIDCIdentityProvider")
+	LDAPIdentityProviderKind            = FederationDomainIdentityProviderKind("LDAPIdentityProvider")
+	ActiveDirectoryIdentityProviderKind = FederationDomainIdentityProviderKind("ActiveDirectoryIdentityProvider")
+)
+
+// FederationDomainIdentityProvider is a reference to an identity provider resource which may be used by a FederationDomain.
+type FederationDomainIdentityProvider struct {
+	// Kind is the kind of the identity provider resource, e.g. OIDCIdentityProvider.
+	Kind FederationDomainIdentityProviderKind `json:"kind"`
+
+	// Name is the name of the identity provider resource, which must be in the same namespace as the FederationDomain.
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+
+	// Transforms is an ordered list of transformations and policies which are applied to the username and groups
+	// of each user who authenticates using this identity provider, before the downstream identity is issued by the
+	// FederationDomain. They are applied during the initial login and again during every refresh of the session.
+	// Each transform is applied to the output of the previous transform. When any policy rejects the user, then
+	// the remaining transforms are skipped and the authentication is denied.
+	// +optional
+	Transforms []FederationDomainTransform `json:"transforms,omitempty"`
+}
+
+// FederationDomainTransform describes a single transformation or policy step. Exactly one of its fields must be set.
+type FederationDomainTransform struct {
+	// UsernamePrefix adds a prefix to the username.
+	// +optional
+	UsernamePrefix *FederationDomainUsernamePrefixTransform `json:"usernamePrefix,omitempty"`
+
+	// UsernameRename rewrites the username using a regular expression.
+	// +optional
+	UsernameRename *FederationDomainUsernameRenameTransform `json:"usernameRename,omitempty"`
+
+	// GroupsMap renames groups using an explicit mapping.
+	// +optional
+	GroupsMap *FederationDomainGroupsMapTransform `json:"groupsMap,omitempty"`
+
+	// GroupsFilter keeps or removes groups which match a regular expression.
+	// +optional
+	GroupsFilter *FederationDomainGroupsFilterTransform `json:"groupsFilter,omitempty"`
+
+	// Reject denies authentication to users whose username or groups match a regular expression.
+	// +optional
+	Reject *FederationDomainRejectPolicy `json:"reject,omitempty"`
+}
+
+// FederationDomainUsernamePrefixTransform prepends a string to the username.
+type FederationDomainUsernamePrefixTransform struct {
+	// Prefix is prepended to the username, e.g. "ldap:".
+	// +kubebuilder:validation:MinLength=1
+	Prefix string `json:"prefix"`
+}
+
+// FederationDomainUsernameRenameTransform rewrites the username using a regular expression.
+type FederationDomainUsernameRenameTransform struct {
+	// Regex is an RE2 regular expression which is matched against the username.
+	// +kubebuilder:validation:MinLength=1
+	Regex string `json:"regex"`
+
+	// Replacement replaces every match of Regex in the username. It may refer to capture groups of Regex
+	// using $1 or ${name} syntax. When the username does not match Regex, then the username is unchanged.
+	// +optional
+	Replacement string `json:"replacement"`
+}
+
+// FederationDomainGroupsMapTransform renames groups using an explicit mapping.
+type FederationDomainGroupsMapTransform struct {
+	// Mappings is the list of group renames. Groups which are not mentioned here are unchanged.
+	// +kubebuilder:validation:MinItems=1
+	Mappings []FederationDomainGroupMapping `json:"mappings"`
+}
+
+// FederationDomainGroupMapping renames a single group.
+type FederationDomainGroupMapping struct {
+	// From is the name of the group to be renamed.
+	// +kubebuilder:validation:MinLength=1
+	From string `json:"from"`
+
+	// To is the new name of the group.
+	// +kubebuilder:validation:MinLength=1
+	To string `json:"to"`
+}
+
+// FederationDomainGroupsFilterTransform keeps or removes groups which match a regular expression.
+type FederationDomainGroupsFilterTransform struct {
+	// Regex is an RE2 regular expression which is matched against each group name.
+	// +kubebuilder:validation:MinLength=1
+	Regex string `json:"regex"`
+
+	// Exclude controls what happens to the matching groups. When false, only the groups which match Regex are kept.
+	// When true, the groups which match Regex are removed.
+	// +optional
+	Exclude bool `json:"exclude,omitempty"`
+}
+
+// FederationDomainRejectPolicy denies authentication to users whose username or groups match a regular expression.
+// At least one of UsernameRegex or GroupsRegex must be specified. When both are specified, then the user is rejected
+// when either one matches.
+type FederationDomainRejectPolicy struct {
+	// UsernameRegex is an RE2 regular expression. Users whose username matches it are rejected.
+	// +optional
+	UsernameRegex string `json:"usernameRegex,omitempty"`
+
+	// GroupsRegex is an RE2 regular expression. Users who belong to any group which matches it are rejected.
+	// +optional
+	GroupsRegex string `json:"groupsRegex,omitempty"`
+
+	// Message is the error message which is shown to the user when they are rejected.
+	// Defaults to "authentication was rejected by a configured policy".
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// FederationDomainSigningAlgorithm is a JWS algorithm which may be used to sign the tokens issued by a FederationDomain.
+// +kubebuilder:validation:Enum=RS256;RS384;PS256;ES256;ES384;EdDSA
+type FederationDomainSigningAlgorithm string
+
+const (
+	RS256FederationDomainSigningAlgorithm = FederationDomainSigningAlgorithm("RS256")
+	RS384FederationDomainSigningAlgorithm = FederationDomainSigningAlgorithm("RS384")
+	PS256FederationDomainSigningAlgorithm = FederationDomainSigningAlgorithm("PS256")
+	ES256FederationDomainSigningAlgorithm = FederationDomainSigningAlgorithm("ES256")
+	ES384FederationDomainSigningAlgorithm = FederationDomainSigningAlgorithm("ES384")
+	EdDSAFederationDomainSigningAlgorithm = FederationDomainSigningAlgorithm("EdDSA")
+)
+
+// FederationDomainSigningKeysSpec configures the keys which sign the tokens issued by a FederationDomain.
+type FederationDomainSigningKeysSpec struct {
+	// Algorithm is the JWS algorithm which is used to sign tokens, and therefore also determines the type of the
+	// signing keys: RS256, RS384 and PS256 use RSA keys, ES256 uses ECDSA P-256 keys, ES384 uses ECDSA P-384 keys,
+	// and EdDSA uses Ed25519 keys. Defaults to ES256.
+	//
+	// When the algorithm is changed, then the next signing key is immediately replaced by a key of the new type,
+	// so the JWKS publishes keys for both the old and the new algorithm. The key of the new type becomes active,
+	// and tokens start to be signed with the new algorithm, at the next rotation. Request a rotation using
+	// RotationRequest when clients have had enough time to fetch the updated JWKS. The key of the old type then
+	// remains published as a retired key until all the tokens which it signed have expired.
+	//
+	// When the Supervisor signs tokens with an external signer, the algorithm must be ES256, otherwise the
+	// FederationDomain is invalid.
+	// +optional
+	Algorithm FederationDomainSigningAlgorithm `json:"algorithm,omitempty"`
+
+	// RSAKeySize is the size in bits of the RSA keys which are used by the RS256, RS384 and PS256 algorithms.
+	// It is ignored for the other algorithms. Changing it is handled like a change of the algorithm.
+	// Defaults to 2048.
+	// +kubebuilder:validation:Enum=2048;3072;4096
+	// +optional
+	RSAKeySize int32 `json:"rsaKeySize,omitempty"`
+
+	// RotationInterval is how often the signing key is rotated automatically, e.g. "720h". When it is omitted,
+	// then the signing key is only rotated on demand using RotationRequest. Intervals shorter than one hour
+	// are treated as one hour.
+	// +optional
+	RotationInterval *metav1.Duration `json:"rotationInterval,omitempty"`
+
+	// RotationRequest requests an immediate rotation of the signing key whenever it is changed to a new non-empty
+	// value, e.g. the current time. The value itself is not otherwise interpreted.
+	// +optional
+	RotationRequest string `json:"rotationRequest,omitempty"`
+}
+
+// FederationDomainSessionEncryptionSpec configures the keys which encrypt the stored sessions of a FederationDomain.
+type FederationDomainSessionEncryptionSpec struct {
+	// RotationRequest requests an immediate rotation of the session encryption key whenever it is changed to a new
+	// non-empty value, e.g. the current time. The value itself is not otherwise interpreted. After a rotation, new
+	// sessions are encrypted with the new key, and the existing sessions are re-encrypted with the new key in the
+	// background. The old key is deleted once no session is encrypted with it anymore.
+	// +optional
+	RotationRequest string `json:"rotationRequest,omitempty"`
+}
+
+// FederationDomainConcurrentSessionLimitAction is what a FederationDomain does when a login would exceed the maximum
+// number of concurrent sessions of a user.
+// +kubebuilder:validation:Enum=RevokeOldestSession;RejectNewLogin
+type FederationDomainConcurrentSessionLimitAction string
+
+const (
+	RevokeOldestSessionFederationDomainConcurrentSessionLimitAction = FederationDomainConcurrentSessionLimitAction("RevokeOldestSession")
+	RejectNewLoginFederationDomainConcurrentSessionLimitAction      = FederationDomainConcurrentSessionLimitAction("RejectNewLogin")
+)
+
+// FederationDomainTokensSpec configures the lifespans of the tokens issued by a FederationDomain, and thereby
+// the lifespans of the user sessions which they represent. Changes only apply to tokens which are issued after
+// the change.
+type FederationDomainTokensSpec struct {
+	// AccessTokenLifespan is how long the access tokens issued by the token endpoint are valid, e.g. "5m".
+	// Access tokens should generally be short-lived. Must be between one minute and one hour. Defaults to
+	// two minutes.
+	// +optional
+	AccessTokenLifespan *metav1.Duration `json:"accessTokenLifespan,omitempty"`
+
+	// IDTokenLifespan is how long the ID tokens issued by the token endpoint, and the cluster-scoped ID tokens
+	// issued by token exchanges, are valid, e.g. "5m". Must be between one minute and one hour. Defaults to the
+	// AccessTokenLifespan.
+	// +optional
+	IDTokenLifespan *metav1.Duration `json:"idTokenLifespan,omitempty"`
+
+	// RefreshTokenLifespan is how long the refresh tokens issued by the token endpoint are valid, e.g. "24h".
+	// Once the refresh token expires, the user's session is over and they will need to log in again.
+	// Must be between one hour and 720 hours (30 days). Defaults to nine hours.
+	// +optional
+	RefreshTokenLifespan *metav1.Duration `json:"refreshTokenLifespan,omitempty"`
+
+	// UpstreamStateLifespan is how long a user may take to finish logging in with the upstream identity provider
+	// during a browser-based login, e.g. "30m". Must be between five minutes and 24 hours. Defaults to 90 minutes.
+	// +optional
+	UpstreamStateLifespan *metav1.Duration `json:"upstreamStateLifespan,omitempty"`
+
+	// SessionIdleTimeout ends a user's session when it has not been refreshed for this long since the user logged in
+	// or last refreshed their tokens, e.g. "2h". The user will then need to log in again. Must be between five minutes
+	// and 720 hours (30 days). When it is omitted, then a session may be idle for as long as its refresh token is valid.
+	// +optional
+	SessionIdleTimeout *metav1.Duration `json:"sessionIdleTimeout,omitempty"`
+
+	// MaxSessionLength ends a user's session this long after the user logged in, e.g. "168h", no matter how recently
+	// its tokens were refreshed. The user will then need to log in again. Must be between one hour and 8760 hours
+	// (365 days). When it is omitted, then a session may be refreshed indefinitely.
+	// +optional
+	MaxSessionLength *metav1.Duration `json:"maxSessionLength,omitempty"`
+
+	// MaxConcurrentSessions is the maximum number of sessions which each user may have at the same time. Only the
+	// sessions which can be refreshed, i.e. those which were granted the offline_access scope, are counted. When a
+	// login would exceed this limit, then the ConcurrentSessionLimitAction is taken. When it is omitted, then there
+	// is no limit.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxConcurrentSessions *int32 `json:"maxConcurrentSessions,omitempty"`
+
+	// ConcurrentSessionLimitAction is what happens when a login would exceed MaxConcurrentSessions.
+	// RevokeOldestSession ends the user's oldest sessions, including revoking the upstream tokens which they hold,
+	// so the new login succeeds. RejectNewLogin refuses the new login until one of the user's other sessions has
+	// ended. Defaults to RevokeOldestSession.
+	// +optional
+	ConcurrentSessionLimitAction FederationDomainConcurrentSessionLimitAction `json:"concurrentSessionLimitAction,omitempty"`
+}
+
+// FederationDomainUserInfoSpec configures the UserInfo endpoint of a FederationDomain.
+type FederationDomainUserInfoSpec struct {
+	// PassthroughClaims are the names of claims of the upstream ID token which the UserInfo endpoint returns in
+	// addition to the sub, username and groups claims. The claims are copied from the upstream ID token when the
+	// user logs in using an OIDCIdentityProvider, and are not included in the downstream ID tokens. The claims
+	// which the Supervisor sets itself, e.g. sub, username, groups, iss and aud, cannot be passed through.
+	// When it is omitted, then no upstream claims are returned.
+	// +optional
+	PassthroughClaims []string `json:"passthroughClaims,omitempty"`
+}
+
 // FederationDomainSpec is a struct that describes an OIDC Provider.
 type FederationDomainSpec struct {
 	// Issuer is the OIDC Provider's issuer, per the OIDC Discovery Metadata document, as well as the
@@ -57,6 +309,38 @@ type FederationDomainSpec struct {
 	// TLS configures how this FederationDomain is served over Transport Layer Security (TLS).
 	// +optional
 	TLS *FederationDomainTLSSpec `json:"tls,omitempty"`
+
+	// IdentityProviders is the list of identity providers which may be used to log in to this FederationDomain.
+	// Users of this FederationDomain can only authenticate using the identity providers listed here, and only
+	// these identity providers will be advertised by this FederationDomain's identity provider discovery endpoint.
+	// When this list is empty or omitted, then all identity providers configured in the Supervisor's namespace
+	// may be used by this FederationDomain.
+	// +optional
+	IdentityProviders []FederationDomainIdentityProvider `json:"identityProviders,omitempty"`
+
+	// SigningKeys configures the algorithm and the rotation of the keys which sign the tokens issued by this
+	// FederationDomain.
+	// The next signing key is always published in the JWKS before it becomes active, and retired signing keys
+	// remain published until all the tokens which they signed have expired, so rotations do not interrupt clients
+	// which verify tokens using the JWKS. These settings are ignored when the Supervisor is configured to sign
+	// tokens with an external signer, since its key cannot be rotated by the Supervisor.
+	// +optional
+	SigningKeys FederationDomainSigningKeysSpec `json:"signingKeys,omitempty"`
+
+	// Tokens configures the lifespans of the tokens issued by this FederationDomain. The storage of the sessions
+	// which belong to the tokens is garbage collected according to these lifespans. When the settings are invalid,
+	// then the FederationDomain is not served.
+	// +optional
+	Tokens FederationDomainTokensSpec `json:"tokens,omitempty"`
+
+	// SessionEncryption configures the rotation of the keys which encrypt the sessions of this FederationDomain
+	// when they are stored in Secrets.
+	// +optional
+	SessionEncryption FederationDomainSessionEncryptionSpec `json:"sessionEncryption,omitempty"`
+
+	// UserInfo configures the claims which are returned by the UserInfo endpoint of this FederationDomain.
+	// +optional
+	UserInfo FederationDomainUserInfoSpec `json:"userInfo,omitempty"`
 }
 
 // FederationDomainSecrets holds information about this OIDC Provider's secrets.
@@ -81,6 +365,92 @@ type FederationDomainSecrets struct {
 	// encrypting state parameters is stored.
 	// +optional
 	StateEncryptionKey corev1.LocalObjectReference `json:"stateEncryptionKey,omitempty"`
+
+	// SessionEncryptionKeys holds the name of the corev1.Secret in which this OIDC Provider's keys for
+	// encrypting stored sessions are stored.
+	// +optional
+	SessionEncryptionKeys corev1.LocalObjectReference `json:"sessionEncryptionKeys,omitempty"`
+}
+
+// +kubebuilder:validation:Enum=Scheduled;Requested
+type FederationDomainSigningKeyRotationReason string
+
+const (
+	ScheduledFederationDomainSigningKeyRotationReason = FederationDomainSigningKeyRotationReason("Scheduled")
+	RequestedFederationDomainSigningKeyRotationReason = FederationDomainSigningKeyRotationReason("Requested")
+)
+
+// FederationDomainRetiredSigningKey describes a signing key which is no longer used to sign tokens, but which is
+// still published in the JWKS because tokens which it signed may not have expired yet.
+type FederationDomainRetiredSigningKey struct {
+	// KeyID is the key ID (kid) of the retired key.
+	KeyID string `json:"keyID"`
+
+	// RetiredAt is the time at which the key stopped being used to sign tokens.
+	RetiredAt metav1.Time `json:"retiredAt"`
+
+	// PublishedUntil is the time after which the key will be removed from the JWKS.
+	PublishedUntil metav1.Time `json:"publishedUntil"`
+}
+
+// FederationDomainSigningKeyRotation describes a past rotation of the signing key.
+type FederationDomainSigningKeyRotation struct {
+	// Time is the time at which the rotation happened.
+	Time metav1.Time `json:"time"`
+
+	// Reason is why the rotation happened.
+	Reason FederationDomainSigningKeyRotationReason `json:"reason"`
+
+	// ActivatedKeyID is the key ID (kid) of the key which became active.
+	ActivatedKeyID string `json:"activatedKeyID"`
+
+	// RetiredKeyID is the key ID (kid) of the key which was retired.
+	RetiredKeyID string `json:"retiredKeyID"`
+}
+
+// FederationDomainSigningKeysStatus describes the keys which are published in the JWKS of a FederationDomain.
+type FederationDomainSigningKeysStatus struct {
+	// ActiveKeyID is the key ID (kid) of the key which is currently used to sign tokens.
+	// +optional
+	ActiveKeyID string `json:"activeKeyID,omitempty"`
+
+	// ActiveKeyAlgorithm is the JWS algorithm which the active key uses to sign tokens.
+	// +optional
+	ActiveKeyAlgorithm string `json:"activeKeyAlgorithm,omitempty"`
+
+	// ActiveSince is the time at which the active key started to be used to sign tokens.
+	// +optional
+	ActiveSince *metav1.Time `json:"activeSince,omitempty"`
+
+	// NextKeyID is the key ID (kid) of the key which will become active at the next rotation.
+	// It is already published in the JWKS.
+	// +optional
+	NextKeyID string `json:"nextKeyID,omitempty"`
+
+	// NextKeyAlgorithm is the JWS algorithm which the next key will use to sign tokens.
+	// +optional
+	NextKeyAlgorithm string `json:"nextKeyAlgorithm,omitempty"`
+
+	// RetiredKeys lists the keys which are no longer used to sign tokens, but which are still published in the JWKS.
+	// +optional
+	RetiredKeys []FederationDomainRetiredSigningKey `json:"retiredKeys,omitempty"`
+
+	// RotationHistory lists the most recent rotations of the signing key, newest first.
+	// +optional
+	RotationHistory []FederationDomainSigningKeyRotation `json:"rotationHistory,omitempty"`
+}
+
+// FederationDomainSessionEncryptionStatus describes the keys which encrypt the stored sessions of a FederationDomain.
+type FederationDomainSessionEncryptionStatus struct {
+	// ActiveKeyID is the ID of the key which encrypts new sessions. Each session storage Secret records the ID of
+	// the key which encrypted it in its storage.pinniped.dev/encryption-key-id label.
+	// +optional
+	ActiveKeyID string `json:"activeKeyID,omitempty"`
+
+	// RetiredKeyIDs lists the keys which were rotated out, but which may still encrypt some sessions, because
+	// those sessions have not been re-encrypted with the active key yet.
+	// +optional
+	RetiredKeyIDs []string `json:"retiredKeyIDs,omitempty"`
 }
 
 // FederationDomainStatus is a struct that describes the actual state of an OIDC Provider.
@@ -103,6 +473,14 @@ type FederationDomainStatus struct {
 	// Secrets contains information about this OIDC Provider's secrets.
 	// +optional
 	Secrets FederationDomainSecrets `json:"secrets,omitempty"`
+
+	// SigningKeys describes the keys which are published in this OIDC Provider's JWKS.
+	// +optional
+	SigningKeys FederationDomainSigningKeysStatus `json:"signingKeys,omitempty"`
+
+	// SessionEncryption describes the keys which encrypt this OIDC Provider's stored sessions.
+	// +optional
+	SessionEncryption FederationDomainSessionEncryptionStatus `json:"sessionEncryption,omitempty"`
 }
 
 // FederationDomain describes the configuration of an OIDC provider.
@@ -8,9 +8,27 @@
 package v1alpha1
 
 import (
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Condition) DeepCopyInto(out *Condition) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Condition.
+func (in *Condition) DeepCopy() *Condition {
+	if in == nil {
+		return nil
+	}
+	out := new(Condition)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *FederationDomain) DeepCopyInto(out *FederationDomain) {
 	*out = *in
@@ -39,6 +57,82 @@ func (in *FederationDomain) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainGroupMapping) DeepCopyInto(out *FederationDomainGroupMapping) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainGroupMapping.
+func (in *FederationDomainGroupMapping) DeepCopy() *FederationDomainGroupMapping {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainGroupMapping)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainGroupsFilterTransform) DeepCopyInto(out *FederationDomainGroupsFilterTransform) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainGroupsFilterTransform.
+func (in *FederationDomainGroupsFilterTransform) DeepCopy() *FederationDomainGroupsFilterTransform {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainGroupsFilterTransform)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainGroupsMapTransform) DeepCopyInto(out *FederationDomainGroupsMapTransform) {
+	*out = *in
+	if in.Mappings != nil {
+		in, out := &in.Mappings, &out.Mappings
+		*out = make([]FederationDomainGroupMapping, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainGroupsMapTransform.
+func (in *FederationDomainGroupsMapTransform) DeepCopy() *FederationDomainGroupsMapTransform {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainGroupsMapTransform)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainIdentityProvider) DeepCopyInto(out *FederationDomainIdentityProvider) {
+	*out = *in
+	if in.Transforms != nil {
+		in, out := &in.Transforms, &out.Transforms
+		*out = make([]FederationDomainTransform, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainIdentityProvider.
+func (in *FederationDomainIdentityProvider) DeepCopy() *FederationDomainIdentityProvider {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainIdentityProvider)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *FederationDomainList) DeepCopyInto(out *FederationDomainList) {
 	*out = *in
@@ -72,6 +166,40 @@ func (in *FederationDomainList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainRejectPolicy) DeepCopyInto(out *FederationDomainRejectPolicy) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainRejectPolicy.
+func (in *FederationDomainRejectPolicy) DeepCopy() *FederationDomainRejectPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainRejectPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainRetiredSigningKey) DeepCopyInto(out *FederationDomainRetiredSigningKey) {
+	*out = *in
+	in.RetiredAt.DeepCopyInto(&out.RetiredAt)
+	in.PublishedUntil.DeepCopyInto(&out.PublishedUntil)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainRetiredSigningKey.
+func (in *FederationDomainRetiredSigningKey) DeepCopy() *FederationDomainRetiredSigningKey {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainRetiredSigningKey)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *FederationDomainSecrets) DeepCopyInto(out *FederationDomainSecrets) {
 	*out = *in
@@ -79,6 +207,7 @@ func (in *FederationDomainSecrets) DeepCopyInto(out *FederationDomainSecrets) {
 	out.TokenSigningKey = in.TokenSigningKey
 	out.StateSigningKey = in.StateSigningKey
 	out.StateEncryptionKey = in.StateEncryptionKey
+	out.SessionEncryptionKeys = in.SessionEncryptionKeys
 	return
 }
 
@@ -92,6 +221,115 @@ func (in *FederationDomainSecrets) DeepCopy() *FederationDomainSecrets {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainSessionEncryptionSpec) DeepCopyInto(out *FederationDomainSessionEncryptionSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainSessionEncryptionSpec.
+func (in *FederationDomainSessionEncryptionSpec) DeepCopy() *FederationDomainSessionEncryptionSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainSessionEncryptionSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainSessionEncryptionStatus) DeepCopyInto(out *FederationDomainSessionEncryptionStatus) {
+	*out = *in
+	if in.RetiredKeyIDs != nil {
+		in, out := &in.RetiredKeyIDs, &out.RetiredKeyIDs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainSessionEncryptionStatus.
+func (in *FederationDomainSessionEncryptionStatus) DeepCopy() *FederationDomainSessionEncryptionStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainSessionEncryptionStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainSigningKeyRotation) DeepCopyInto(out *FederationDomainSigningKeyRotation) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainSigningKeyRotation.
+func (in *FederationDomainSigningKeyRotation) DeepCopy() *FederationDomainSigningKeyRotation {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainSigningKeyRotation)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainSigningKeysSpec) DeepCopyInto(out *FederationDomainSigningKeysSpec) {
+	*out = *in
+	if in.RotationInterval != nil {
+		in, out := &in.RotationInterval, &out.RotationInterval
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainSigningKeysSpec.
+func (in *FederationDomainSigningKeysSpec) DeepCopy() *FederationDomainSigningKeysSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainSigningKeysSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainSigningKeysStatus) DeepCopyInto(out *FederationDomainSigningKeysStatus) {
+	*out = *in
+	if in.ActiveSince != nil {
+		in, out := &in.ActiveSince, &out.ActiveSince
+		*out = (*in).DeepCopy()
+	}
+	if in.RetiredKeys != nil {
+		in, out := &in.RetiredKeys, &out.RetiredKeys
+		*out = make([]FederationDomainRetiredSigningKey, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.RotationHistory != nil {
+		in, out := &in.RotationHistory, &out.RotationHistory
+		*out = make([]FederationDomainSigningKeyRotation, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainSigningKeysStatus.
+func (in *FederationDomainSigningKeysStatus) DeepCopy() *FederationDomainSigningKeysStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainSigningKeysStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *FederationDomainSpec) DeepCopyInto(out *FederationDomainSpec) {
 	*out = *in
@@ -100,6 +338,17 @@ func (in *FederationDomainSpec) DeepCopyInto(out *FederationDomainSpec) {
 		*out = new(FederationDomainTLSSpec)
 		**out = **in
 	}
+	if in.IdentityProviders != nil {
+		in, out := &in.IdentityProviders, &out.IdentityProviders
+		*out = make([]FederationDomainIdentityProvider, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	in.SigningKeys.DeepCopyInto(&out.SigningKeys)
+	in.Tokens.DeepCopyInto(&out.Tokens)
+	out.SessionEncryption = in.SessionEncryption
+	in.UserInfo.DeepCopyInto(&out.UserInfo)
 	return
 }
 
@@ -121,6 +370,8 @@ func (in *FederationDomainStatus) DeepCopyInto(out *FederationDomainStatus) {
 		*out = (*in).DeepCopy()
 	}
 	out.Secrets = in.Secrets
+	in.SigningKeys.DeepCopyInto(&out.SigningKeys)
+	in.SessionEncryption.DeepCopyInto(&out.SessionEncryption)
 	return
 }
 
@@ -149,3 +400,280 @@ func (in *FederationDomainTLSSpec) DeepCopy() *FederationDomainTLSSpec {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainTokensSpec) DeepCopyInto(out *FederationDomainTokensSpec) {
+	*out = *in
+	if in.AccessTokenLifespan != nil {
+		in, out := &in.AccessTokenLifespan, &out.AccessTokenLifespan
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.IDTokenLifespan != nil {
+		in, out := &in.IDTokenLifespan, &out.IDTokenLifespan
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.RefreshTokenLifespan != nil {
+		in, out := &in.RefreshTokenLifespan, &out.RefreshTokenLifespan
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.UpstreamStateLifespan != nil {
+		in, out := &in.UpstreamStateLifespan, &out.UpstreamStateLifespan
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.SessionIdleTimeout != nil {
+		in, out := &in.SessionIdleTimeout, &out.SessionIdleTimeout
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.MaxSessionLength != nil {
+		in, out := &in.MaxSessionLength, &out.MaxSessionLength
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.MaxConcurrentSessions != nil {
+		in, out := &in.MaxConcurrentSessions, &out.MaxConcurrentSessions
+		*out = new(int32)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainTokensSpec.
+func (in *FederationDomainTokensSpec) DeepCopy() *FederationDomainTokensSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainTokensSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainTransform) DeepCopyInto(out *FederationDomainTransform) {
+	*out = *in
+	if in.UsernamePrefix != nil {
+		in, out := &in.UsernamePrefix, &out.UsernamePrefix
+		*out = new(FederationDomainUsernamePrefixTransform)
+		**out = **in
+	}
+	if in.UsernameRename != nil {
+		in, out := &in.UsernameRename, &out.UsernameRename
+		*out = new(FederationDomainUsernameRenameTransform)
+		**out = **in
+	}
+	if in.GroupsMap != nil {
+		in, out := &in.GroupsMap, &out.GroupsMap
+		*out = new(FederationDomainGroupsMapTransform)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.GroupsFilter != nil {
+		in, out := &in.GroupsFilter, &out.GroupsFilter
+		*out = new(FederationDomainGroupsFilterTransform)
+		**out = **in
+	}
+	if in.Reject != nil {
+		in, out := &in.Reject, &out.Reject
+		*out = new(FederationDomainRejectPolicy)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainTransform.
+func (in *FederationDomainTransform) DeepCopy() *FederationDomainTransform {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainTransform)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainUserInfoSpec) DeepCopyInto(out *FederationDomainUserInfoSpec) {
+	*out = *in
+	if in.PassthroughClaims != nil {
+		in, out := &in.PassthroughClaims, &out.PassthroughClaims
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainUserInfoSpec.
+func (in *FederationDomainUserInfoSpec) DeepCopy() *FederationDomainUserInfoSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainUserInfoSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainUsernamePrefixTransform) DeepCopyInto(out *FederationDomainUsernamePrefixTransform) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainUsernamePrefixTransform.
+func (in *FederationDomainUsernamePrefixTransform) DeepCopy() *FederationDomainUsernamePrefixTransform {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainUsernamePrefixTransform)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainUsernameRenameTransform) DeepCopyInto(out *FederationDomainUsernameRenameTransform) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainUsernameRenameTransform.
+func (in *FederationDomainUsernameRenameTransform) DeepCopy() *FederationDomainUsernameRenameTransform {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainUsernameRenameTransform)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OIDCClient) DeepCopyInto(out *OIDCClient) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OIDCClient.
+func (in *OIDCClient) DeepCopy() *OIDCClient {
+	if in == nil {
+		return nil
+	}
+	out := new(OIDCClient)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *OIDCClient) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OIDCClientList) DeepCopyInto(out *OIDCClientList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]OIDCClient, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OIDCClientList.
+func (in *OIDCClientList) DeepCopy() *OIDCClientList {
+	if in == nil {
+		return nil
+	}
+	out := new(OIDCClientList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *OIDCClientList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OIDCClientSecret) DeepCopyInto(out *OIDCClientSecret) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OIDCClientSecret.
+func (in *OIDCClientSecret) DeepCopy() *OIDCClientSecret {
+	if in == nil {
+		return nil
+	}
+	out := new(OIDCClientSecret)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OIDCClientSpec) DeepCopyInto(out *OIDCClientSpec) {
+	*out = *in
+	if in.AllowedRedirectURIs != nil {
+		in, out := &in.AllowedRedirectURIs, &out.AllowedRedirectURIs
+		*out = make([]RedirectURI, len(*in))
+		copy(*out, *in)
+	}
+	if in.AllowedGrantTypes != nil {
+		in, out := &in.AllowedGrantTypes, &out.AllowedGrantTypes
+		*out = make([]GrantType, len(*in))
+		copy(*out, *in)
+	}
+	if in.AllowedScopes != nil {
+		in, out := &in.AllowedScopes, &out.AllowedScopes
+		*out = make([]Scope, len(*in))
+		copy(*out, *in)
+	}
+	out.ClientSecret = in.ClientSecret
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OIDCClientSpec.
+func (in *OIDCClientSpec) DeepCopy() *OIDCClientSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(OIDCClientSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OIDCClientStatus) DeepCopyInto(out *OIDCClientStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OIDCClientStatus.
+func (in *OIDCClientStatus) DeepCopy() *OIDCClientStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(OIDCClientStatus)
+	in.DeepCopyInto(out)
+	return out
+}
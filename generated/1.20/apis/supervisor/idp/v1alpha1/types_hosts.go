@@ -0,0 +1,16 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package v1alpha1
+
+// LoadBalancing determines how the connections to an identity provider with multiple hosts are spread across its hosts.
+// +kubebuilder:validation:Enum=Failover;RoundRobin
+type LoadBalancing string
+
+const (
+	// LoadBalancingFailover always connects to the first host which is healthy, in order.
+	LoadBalancingFailover LoadBalancing = "Failover"
+
+	// LoadBalancingRoundRobin connects to each healthy host in turn.
+	LoadBalancingRoundRobin LoadBalancing = "RoundRobin"
+)
@@ -150,6 +150,22 @@ type OIDCClient struct {
 	SecretName string `json:"secretName"`
 }
 
+// OIDCLogoutConfig describes how the Supervisor's end_session_endpoint interacts with an OIDC identity provider.
+type OIDCLogoutConfig struct {
+	// redirectToUpstreamEndSession, when true, causes the Supervisor's end_session_endpoint to redirect the user's
+	// browser to the end_session_endpoint of your OIDC provider after the user's Supervisor session has been ended, so
+	// that the user is also logged out of your OIDC provider. The end_session_endpoint is found using your OIDC
+	// provider's discovery document. The upstream ID token from the user's login is sent as the id_token_hint. When the
+	// downstream logout request has a post_logout_redirect_uri, then your OIDC provider is asked to redirect the user's
+	// browser back to the Supervisor's post logout endpoint, which is the FederationDomain's issuer followed by
+	// /oauth2/logout/callback, so that URL must be allowed by your OIDC provider's configuration of the Supervisor's
+	// client. The Supervisor then redirects the browser to the downstream post_logout_redirect_uri with the state
+	// parameter of the downstream logout request. When your OIDC provider does not advertise an end_session_endpoint,
+	// then this setting has no effect. redirectToUpstreamEndSession defaults to false.
+	// +optional
+	RedirectToUpstreamEndSession bool `json:"redirectToUpstreamEndSession,omitempty"`
+}
+
 // OIDCIdentityProviderSpec is the spec for configuring an OIDC identity provider.
 type OIDCIdentityProviderSpec struct {
 	// Issuer is the issuer URL of this OIDC identity provider, i.e., where to fetch
@@ -175,6 +191,11 @@ type OIDCIdentityProviderSpec struct {
 	// OIDCClient contains OIDC client information to be used used with this OIDC identity
 	// provider.
 	Client OIDCClient `json:"client"`
+
+	// LogoutConfig holds information about what happens at this OIDC identity provider when a user logs out of the
+	// Supervisor.
+	// +optional
+	LogoutConfig OIDCLogoutConfig `json:"logoutConfig,omitempty"`
 }
 
 // OIDCIdentityProvider describes the configuration of an upstream OpenID Connect identity provider.
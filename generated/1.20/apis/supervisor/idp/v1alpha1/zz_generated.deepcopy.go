@@ -124,6 +124,11 @@ func (in *ActiveDirectoryIdentityProviderList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ActiveDirectoryIdentityProviderSpec) DeepCopyInto(out *ActiveDirectoryIdentityProviderSpec) {
 	*out = *in
+	if in.AdditionalHosts != nil {
+		in, out := &in.AdditionalHosts, &out.AdditionalHosts
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 	if in.TLS != nil {
 		in, out := &in.TLS, &out.TLS
 		*out = new(TLSSpec)
@@ -266,6 +271,11 @@ func (in *LDAPIdentityProviderBind) DeepCopy() *LDAPIdentityProviderBind {
 func (in *LDAPIdentityProviderGroupSearch) DeepCopyInto(out *LDAPIdentityProviderGroupSearch) {
 	*out = *in
 	out.Attributes = in.Attributes
+	if in.NestedGroups != nil {
+		in, out := &in.NestedGroups, &out.NestedGroups
+		*out = new(LDAPIdentityProviderNestedGroups)
+		**out = **in
+	}
 	return
 }
 
@@ -328,9 +338,30 @@ func (in *LDAPIdentityProviderList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LDAPIdentityProviderNestedGroups) DeepCopyInto(out *LDAPIdentityProviderNestedGroups) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LDAPIdentityProviderNestedGroups.
+func (in *LDAPIdentityProviderNestedGroups) DeepCopy() *LDAPIdentityProviderNestedGroups {
+	if in == nil {
+		return nil
+	}
+	out := new(LDAPIdentityProviderNestedGroups)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *LDAPIdentityProviderSpec) DeepCopyInto(out *LDAPIdentityProviderSpec) {
 	*out = *in
+	if in.AdditionalHosts != nil {
+		in, out := &in.AdditionalHosts, &out.AdditionalHosts
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 	if in.TLS != nil {
 		in, out := &in.TLS, &out.TLS
 		*out = new(TLSSpec)
@@ -338,7 +369,7 @@ func (in *LDAPIdentityProviderSpec) DeepCopyInto(out *LDAPIdentityProviderSpec)
 	}
 	out.Bind = in.Bind
 	out.UserSearch = in.UserSearch
-	out.GroupSearch = in.GroupSearch
+	in.GroupSearch.DeepCopyInto(&out.GroupSearch)
 	return
 }
 
@@ -538,6 +569,7 @@ func (in *OIDCIdentityProviderSpec) DeepCopyInto(out *OIDCIdentityProviderSpec)
 	in.AuthorizationConfig.DeepCopyInto(&out.AuthorizationConfig)
 	out.Claims = in.Claims
 	out.Client = in.Client
+	out.LogoutConfig = in.LogoutConfig
 	return
 }
 
@@ -574,6 +606,22 @@ func (in *OIDCIdentityProviderStatus) DeepCopy() *OIDCIdentityProviderStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OIDCLogoutConfig) DeepCopyInto(out *OIDCLogoutConfig) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OIDCLogoutConfig.
+func (in *OIDCLogoutConfig) DeepCopy() *OIDCLogoutConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(OIDCLogoutConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Parameter) DeepCopyInto(out *Parameter) {
 	*out = *in
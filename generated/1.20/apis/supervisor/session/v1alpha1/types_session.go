@@ -0,0 +1,78 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Session is an active downstream session, which a user started by logging in to a FederationDomain.
+// The name of a Session is the ID of the session, which is shared by all the tokens which were issued to it.
+// Deleting a Session revokes all of its tokens, and revokes the tokens of the upstream OIDC identity provider.
+// +genclient
+// +genclient:nonNamespaced
+// +genclient:onlyVerbs=get,list,delete
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+type Session struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec SessionSpec `json:"spec"`
+}
+
+// SessionSpec describes the user and the client of a Session. Sessions can be filtered by user using the
+// spec.subject and spec.username field selectors.
+type SessionSpec struct {
+	// Subject is the downstream subject of the user, which is unique for each user of each identity provider.
+	Subject string `json:"subject"`
+
+	// Username is the downstream username of the user.
+	Username string `json:"username"`
+
+	// Groups are the downstream groups of the user, as of the login or the most recent refresh.
+	// +optional
+	Groups []string `json:"groups,omitempty"`
+
+	// IdentityProvider is the upstream identity provider which the user used to log in.
+	IdentityProvider IdentityProvider `json:"identityProvider"`
+
+	// ClientID is the ID of the downstream OIDC client which started the session.
+	ClientID string `json:"clientID"`
+
+	// Scopes are the scopes which were granted to the session.
+	// +optional
+	Scopes []string `json:"scopes,omitempty"`
+
+	// LoginTime is the time at which the user logged in. It is not set for sessions which were started by
+	// older versions of Pinniped.
+	// +optional
+	LoginTime *metav1.Time `json:"loginTime,omitempty"`
+
+	// LastRefreshTime is the time at which the session was most recently refreshed. It is not set when the
+	// session was never refreshed.
+	// +optional
+	LastRefreshTime *metav1.Time `json:"lastRefreshTime,omitempty"`
+}
+
+// IdentityProvider describes the upstream identity provider of a Session.
+type IdentityProvider struct {
+	// Name is the name of the identity provider resource.
+	Name string `json:"name"`
+
+	// Type is the type of the identity provider, i.e. oidc, ldap or activedirectory.
+	Type string `json:"type"`
+
+	// UID is the UID of the identity provider resource.
+	UID string `json:"uid"`
+}
+
+// SessionList is a list of Session objects.
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+type SessionList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	// Items is a list of Session
+	Items []Session `json:"items"`
+}
@@ -1,4 +1,4 @@
-// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2021-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package oidc
@@ -22,4 +22,9 @@ const (
 	// AuthorizeUpstreamIDPTypeParamName is the name of the HTTP request parameter which can be used to help select which
 	// identity provider should be used for authentication by sending the type of the desired identity provider.
 	AuthorizeUpstreamIDPTypeParamName = "pinniped_idp_type"
+
+	// SessionExpiredErrorDescription is the beginning of the error_description which is returned by the token endpoint
+	// when it rejects a refresh because the session has been idle for too long or has reached its maximum length.
+	// Clients may show the error_description to the user before starting a new login.
+	SessionExpiredErrorDescription = "Your session has expired."
 )
@@ -0,0 +1,56 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Session is an active downstream session, which a user started by logging in to a FederationDomain.
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+type Session struct {
+	metav1.TypeMeta
+	metav1.ObjectMeta
+
+	Spec SessionSpec
+}
+
+type SessionSpec struct {
+	// The downstream subject of the user.
+	Subject string
+
+	// The downstream username and groups of the user.
+	Username string
+	Groups   []string
+
+	// The upstream identity provider which the user used to log in.
+	IdentityProvider IdentityProvider
+
+	// The ID of the downstream OIDC client which started the session.
+	ClientID string
+
+	// The scopes which were granted to the session.
+	Scopes []string
+
+	// The time at which the user logged in, and the time at which the session was last refreshed.
+	LoginTime       *metav1.Time
+	LastRefreshTime *metav1.Time
+}
+
+type IdentityProvider struct {
+	// The name, type and resource UID of the identity provider.
+	Name string
+	Type string
+	UID  string
+}
+
+// SessionList is a list of Session objects.
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+type SessionList struct {
+	metav1.TypeMeta
+	metav1.ListMeta
+
+	// Items is a list of Session
+	Items []Session
+}
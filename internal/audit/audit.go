@@ -0,0 +1,231 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package audit implements the security audit log of the authentication events of the Supervisor and the Concierge.
+//
+// Unlike the logs of package plog, which are meant for humans and may change at any time, each audit event is a
+// single line of JSON which follows the stable schema of Event, so that the events can be consumed by SIEM
+// systems. Audit events never contain credentials, i.e. tokens, passwords, authcodes or client certificates.
+//
+// The events are written to the sinks which are configured in the static configuration of the server. When no sink
+// is configured, no events are recorded.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apiserver/pkg/endpoints/request"
+
+	"go.pinniped.dev/internal/plog"
+)
+
+const (
+	// APIVersion is the version of the schema of the audit events. Fields may be added to the schema without
+	// changing its version, but existing fields are never removed or changed.
+	APIVersion = "audit.pinniped.dev/v1alpha1"
+
+	// Kind is the kind of all audit events.
+	Kind = "AuthenticationEvent"
+)
+
+// Component is the server which recorded an audit event.
+type Component string
+
+const (
+	ComponentSupervisor Component = "supervisor"
+	ComponentConcierge  Component = "concierge"
+)
+
+// EventType is the type of the authentication event.
+type EventType string
+
+const (
+	// TypeAuthorize is a request to the authorization endpoint of a FederationDomain.
+	TypeAuthorize EventType = "authorize"
+	// TypeLogin is a submission of the login form of a FederationDomain, which is used by the browser flow of the
+	// LDAP and Active Directory identity providers.
+	TypeLogin EventType = "login"
+	// TypeCallback is a redirect from an OIDC identity provider back to the callback endpoint of the Supervisor.
+	TypeCallback EventType = "callback"
+	// TypeTokenExchange is a request to the token endpoint of a FederationDomain which redeems an authcode or a
+	// device code, or which exchanges an access token for a cluster-scoped ID token (RFC 8693).
+	TypeTokenExchange EventType = "tokenExchange"
+	// TypeRefresh is a refresh grant at the token endpoint of a FederationDomain.
+	TypeRefresh EventType = "refresh"
+	// TypeUpstreamRefresh is the check of the upstream session at the identity provider during a refresh grant.
+	TypeUpstreamRefresh EventType = "upstreamRefresh"
+	// TypeUpstreamTokenRevocation is the revocation of the upstream token of a downstream session which ended, e.g.
+	// by the garbage collector of the Supervisor.
+	TypeUpstreamTokenRevocation EventType = "upstreamTokenRevocation"
+	// TypeTokenCredentialRequest is a TokenCredentialRequest to the Concierge.
+	TypeTokenCredentialRequest EventType = "tokenCredentialRequest"
+	// TypeImpersonationProxyAuthentication is the authentication of a request to the impersonation proxy of the
+	// Concierge.
+	TypeImpersonationProxyAuthentication EventType = "impersonationProxyAuthentication"
+)
+
+// Outcome is the result of an authentication event.
+type Outcome string
+
+const (
+	OutcomeSuccess Outcome = "success"
+	OutcomeFailure Outcome = "failure"
+)
+
+// IdentityProvider identifies the upstream identity provider of an event.
+type IdentityProvider struct {
+	Name string `json:"name,omitempty"`
+	Type string `json:"type,omitempty"`
+	UID  string `json:"uid,omitempty"`
+}
+
+// Event is an authentication event. The fields which are not relevant to the event, or not known yet when the
+// event happened, are omitted.
+type Event struct {
+	APIVersion string    `json:"apiVersion"`
+	Kind       string    `json:"kind"`
+	Time       time.Time `json:"time"`
+	Component  Component `json:"component"`
+	Type       EventType `json:"type"`
+
+	// RequestID is the unique ID of the HTTP request which caused the event. It is also returned to the client in
+	// the Audit-ID response header and it is used by the audit log of Kubernetes.
+	RequestID string `json:"requestID,omitempty"`
+	// SessionID is the ID of the downstream session of the Supervisor, which is shared by all events of the session.
+	SessionID string `json:"sessionID,omitempty"`
+	SourceIP  string `json:"sourceIP,omitempty"`
+
+	// Issuer is the issuer of the FederationDomain of a Supervisor event.
+	Issuer    string `json:"issuer,omitempty"`
+	ClientID  string `json:"clientID,omitempty"`
+	GrantType string `json:"grantType,omitempty"`
+
+	IdentityProvider *IdentityProvider `json:"identityProvider,omitempty"`
+	// Authenticator is the Concierge authenticator of a Concierge event, e.g. "JWTAuthenticator/my-authenticator".
+	Authenticator string `json:"authenticator,omitempty"`
+
+	Subject  string   `json:"subject,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+
+	Outcome Outcome `json:"outcome"`
+	// Reason explains a failure. It never contains credentials.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Sink receives each recorded event as a single line of JSON, including the trailing newline.
+type Sink interface {
+	Write(line []byte)
+	Close() error
+}
+
+type recorder struct {
+	component Component
+	sinks     []Sink
+	now       func() time.Time
+}
+
+// The audit log is configured once per process, just like the logs of package plog.
+var (
+	globalRecorderLock sync.RWMutex //nolint:gochecknoglobals
+	globalRecorder     *recorder    //nolint:gochecknoglobals
+)
+
+// Record writes the event to all sinks of the global recorder. It fills the fields which are common to all events,
+// including the RequestID, which it reads from the context.
+func Record(ctx context.Context, event *Event) {
+	globalRecorderLock.RLock()
+	r := globalRecorder
+	globalRecorderLock.RUnlock()
+
+	if r == nil || len(r.sinks) == 0 {
+		return
+	}
+	r.record(ctx, event)
+}
+
+// RecordRequest is like Record, but it also fills the SourceIP of the event from the request.
+func RecordRequest(r *http.Request, event *Event) {
+	if event.SourceIP == "" {
+		if ip := utilnet.GetClientIP(r); ip != nil {
+			event.SourceIP = ip.String()
+		}
+	}
+	Record(r.Context(), event)
+}
+
+func (r *recorder) record(ctx context.Context, event *Event) {
+	event.APIVersion = APIVersion
+	event.Kind = Kind
+	event.Component = r.component
+	if event.Time.IsZero() {
+		event.Time = r.now().UTC()
+	}
+	if event.RequestID == "" {
+		if auditID, ok := request.AuditIDFrom(ctx); ok {
+			event.RequestID = string(auditID)
+		}
+	}
+	if event.Outcome == "" {
+		event.Outcome = OutcomeSuccess
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		plog.Error("could not encode audit event", err, "type", event.Type)
+		return
+	}
+	line = append(line, '\n')
+
+	for _, sink := range r.sinks {
+		sink.Write(line)
+	}
+}
+
+// SetGlobalSinks replaces the sinks of the global recorder, e.g. in tests, and returns a func which restores the
+// previous sinks. It does not close any sink.
+func SetGlobalSinks(component Component, sinks ...Sink) func() {
+	globalRecorderLock.Lock()
+	defer globalRecorderLock.Unlock()
+
+	previous := globalRecorder
+	globalRecorder = &recorder{component: component, sinks: sinks, now: time.Now}
+	return func() {
+		globalRecorderLock.Lock()
+		defer globalRecorderLock.Unlock()
+		globalRecorder = previous
+	}
+}
+
+// ConfigureGlobally creates the sinks of the config and makes them the sinks of the global recorder. The returned
+// func closes the sinks, e.g. to flush the events which are still being sent to a webhook, when the server stops.
+func ConfigureGlobally(component Component, config *Config) (func(), error) {
+	sinks, err := newSinks(config)
+	if err != nil {
+		return nil, err
+	}
+	restore := SetGlobalSinks(component, sinks...)
+	return func() {
+		restore()
+		for _, sink := range sinks {
+			if err := sink.Close(); err != nil {
+				plog.WarningErr("could not close audit sink", err)
+			}
+		}
+	}, nil
+}
+
+// Failure sets the outcome of the event to failure, with the error as its reason, when err is not nil. It returns
+// the event to allow chaining.
+func (e *Event) Failure(err error) *Event {
+	if err != nil {
+		e.Outcome = OutcomeFailure
+		e.Reason = err.Error()
+	}
+	return e
+}
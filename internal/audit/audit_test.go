@@ -0,0 +1,92 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package audit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+func TestRecord(t *testing.T) {
+	var buf bytes.Buffer
+	defer SetGlobalSinks(ComponentSupervisor, NewWriterSink(&buf))()
+	globalRecorder.now = func() time.Time { return time.Date(2022, 2, 3, 4, 5, 6, 7, time.UTC) }
+
+	ctx := request.WithAuditID(context.Background(), "some-request-id")
+	Record(ctx, &Event{
+		Type:             TypeRefresh,
+		SessionID:        "some-session-id",
+		Issuer:           "https://issuer.example.com",
+		ClientID:         "pinniped-cli",
+		GrantType:        "refresh_token",
+		IdentityProvider: &IdentityProvider{Name: "some-idp", Type: "oidc", UID: "some-uid"},
+		Subject:          "some-subject",
+		Username:         "some-username",
+		Groups:           []string{"group1", "group2"},
+	})
+	Record(context.Background(), (&Event{Type: TypeAuthorize}).Failure(errors.New("some error")))
+	Record(context.Background(), (&Event{Type: TypeAuthorize}).Failure(nil))
+
+	require.Equal(t, `{"apiVersion":"audit.pinniped.dev/v1alpha1","kind":"AuthenticationEvent","time":"2022-02-03T04:05:06.000000007Z",`+
+		`"component":"supervisor","type":"refresh","requestID":"some-request-id","sessionID":"some-session-id",`+
+		`"issuer":"https://issuer.example.com","clientID":"pinniped-cli","grantType":"refresh_token",`+
+		`"identityProvider":{"name":"some-idp","type":"oidc","uid":"some-uid"},"subject":"some-subject",`+
+		`"username":"some-username","groups":["group1","group2"],"outcome":"success"}`+"\n"+
+		`{"apiVersion":"audit.pinniped.dev/v1alpha1","kind":"AuthenticationEvent","time":"2022-02-03T04:05:06.000000007Z",`+
+		`"component":"supervisor","type":"authorize","outcome":"failure","reason":"some error"}`+"\n"+
+		`{"apiVersion":"audit.pinniped.dev/v1alpha1","kind":"AuthenticationEvent","time":"2022-02-03T04:05:06.000000007Z",`+
+		`"component":"supervisor","type":"authorize","outcome":"success"}`+"\n",
+		buf.String())
+}
+
+func TestRecordRequest(t *testing.T) {
+	var buf bytes.Buffer
+	defer SetGlobalSinks(ComponentConcierge, NewWriterSink(&buf))()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "1.2.3.4:5678"
+	RecordRequest(r, &Event{Type: TypeImpersonationProxyAuthentication})
+
+	require.Contains(t, buf.String(), `"component":"concierge","type":"impersonationProxyAuthentication","sourceIP":"1.2.3.4",`)
+}
+
+func TestRecordWithoutSinks(t *testing.T) {
+	defer SetGlobalSinks(ComponentSupervisor)()
+
+	event := &Event{Type: TypeAuthorize}
+	Record(context.Background(), event)
+
+	// The event was not even encoded.
+	require.Equal(t, &Event{Type: TypeAuthorize}, event)
+}
+
+func TestConfigureGlobally(t *testing.T) {
+	_, err := ConfigureGlobally(ComponentSupervisor, &Config{Sinks: []SinkConfig{
+		{Stdout: &StdoutSinkConfig{}},
+		{File: &FileSinkConfig{Path: "/this/directory/does/not/exist/audit.log"}},
+	}})
+	require.EqualError(t, err, "could not open audit log file: open /this/directory/does/not/exist/audit.log: no such file or directory")
+
+	path := t.TempDir() + "/audit.log"
+	closeSinks, err := ConfigureGlobally(ComponentSupervisor, &Config{Sinks: []SinkConfig{{File: &FileSinkConfig{Path: path}}}})
+	require.NoError(t, err)
+	Record(context.Background(), &Event{Type: TypeAuthorize})
+	closeSinks()
+
+	contents, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Contains(t, string(contents), `"type":"authorize"`)
+
+	// The sinks are not used anymore after they were closed.
+	require.Nil(t, globalRecorder)
+	Record(context.Background(), &Event{Type: TypeAuthorize})
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package audit
+
+import (
+	"fmt"
+	"net/url"
+
+	"go.pinniped.dev/internal/constable"
+)
+
+const (
+	errNoSinkType        = constable.Error("exactly one of stdout, file or webhook must be set")
+	errMissingPath       = constable.Error("file.path must be set")
+	errInvalidWebhookURL = constable.Error("webhook.url must be an https URL")
+	errInvalidTimeout    = constable.Error("webhook.timeoutSeconds must be positive")
+)
+
+// Config configures the audit log. It is part of the static configuration of both the Supervisor and the Concierge.
+type Config struct {
+	// Sinks are the destinations of the audit events. Each event is written to all sinks.
+	Sinks []SinkConfig `json:"sinks"`
+}
+
+// SinkConfig configures a destination of the audit events. Exactly one of its fields must be set.
+type SinkConfig struct {
+	Stdout  *StdoutSinkConfig  `json:"stdout,omitempty"`
+	File    *FileSinkConfig    `json:"file,omitempty"`
+	Webhook *WebhookSinkConfig `json:"webhook,omitempty"`
+}
+
+// StdoutSinkConfig writes the events to the standard output of the server, next to its logs, which go to the
+// standard error.
+type StdoutSinkConfig struct{}
+
+// FileSinkConfig appends the events to a file, e.g. on a volume which is shared with a log shipper.
+type FileSinkConfig struct {
+	// Path is the path to the file. It is created when it does not exist.
+	Path string `json:"path"`
+}
+
+// WebhookSinkConfig sends each event in the body of a POST request to an HTTPS endpoint.
+type WebhookSinkConfig struct {
+	// URL is the https URL of the endpoint.
+	URL string `json:"url"`
+	// CABundleFile is the path to a file which contains the PEM-encoded CA bundle which is used to verify the
+	// certificate of the endpoint. When it is not set, the CA bundle of the host is used.
+	CABundleFile string `json:"caBundleFile,omitempty"`
+	// TimeoutSeconds is the maximum duration, in seconds, of each request to the endpoint. Defaults to 10.
+	TimeoutSeconds *int64 `json:"timeoutSeconds,omitempty"`
+}
+
+// Validate returns an error when the config is invalid.
+func (c *Config) Validate() error {
+	for i, sink := range c.Sinks {
+		if err := sink.validate(); err != nil {
+			return fmt.Errorf("sinks[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (s *SinkConfig) validate() error {
+	count := 0
+	for _, isSet := range []bool{s.Stdout != nil, s.File != nil, s.Webhook != nil} {
+		if isSet {
+			count++
+		}
+	}
+	if count != 1 {
+		return errNoSinkType
+	}
+
+	switch {
+	case s.File != nil:
+		if s.File.Path == "" {
+			return errMissingPath
+		}
+	case s.Webhook != nil:
+		u, err := url.Parse(s.Webhook.URL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return errInvalidWebhookURL
+		}
+		if s.Webhook.TimeoutSeconds != nil && *s.Webhook.TimeoutSeconds <= 0 {
+			return errInvalidTimeout
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package audit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/utils/pointer"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr string
+	}{
+		{
+			name: "no sinks",
+		},
+		{
+			name: "all sink types",
+			config: Config{Sinks: []SinkConfig{
+				{Stdout: &StdoutSinkConfig{}},
+				{File: &FileSinkConfig{Path: "/var/log/pinniped/audit.log"}},
+				{Webhook: &WebhookSinkConfig{URL: "https://audit.example.com/events", TimeoutSeconds: pointer.Int64Ptr(5)}},
+			}},
+		},
+		{
+			name:    "a sink without a type",
+			config:  Config{Sinks: []SinkConfig{{Stdout: &StdoutSinkConfig{}}, {}}},
+			wantErr: "sinks[1]: exactly one of stdout, file or webhook must be set",
+		},
+		{
+			name:    "a sink with two types",
+			config:  Config{Sinks: []SinkConfig{{Stdout: &StdoutSinkConfig{}, File: &FileSinkConfig{Path: "audit.log"}}}},
+			wantErr: "sinks[0]: exactly one of stdout, file or webhook must be set",
+		},
+		{
+			name:    "a file sink without a path",
+			config:  Config{Sinks: []SinkConfig{{File: &FileSinkConfig{}}}},
+			wantErr: "sinks[0]: file.path must be set",
+		},
+		{
+			name:    "a webhook sink with an http URL",
+			config:  Config{Sinks: []SinkConfig{{Webhook: &WebhookSinkConfig{URL: "http://audit.example.com/events"}}}},
+			wantErr: "sinks[0]: webhook.url must be an https URL",
+		},
+		{
+			name:    "a webhook sink with an invalid URL",
+			config:  Config{Sinks: []SinkConfig{{Webhook: &WebhookSinkConfig{URL: "https://"}}}},
+			wantErr: "sinks[0]: webhook.url must be an https URL",
+		},
+		{
+			name:    "a webhook sink with an invalid timeout",
+			config:  Config{Sinks: []SinkConfig{{Webhook: &WebhookSinkConfig{URL: "https://audit.example.com", TimeoutSeconds: pointer.Int64Ptr(0)}}}},
+			wantErr: "sinks[0]: webhook.timeoutSeconds must be positive",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
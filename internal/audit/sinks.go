@@ -0,0 +1,194 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.pinniped.dev/internal/constable"
+	"go.pinniped.dev/internal/net/phttp"
+	"go.pinniped.dev/internal/plog"
+)
+
+const (
+	defaultWebhookTimeoutSeconds = 10
+
+	// webhookQueueSize is how many events may wait to be sent to a webhook. When the webhook is slower than the
+	// authentications, the events which do not fit into the queue are dropped, so that the authentications are
+	// never blocked by the audit log.
+	webhookQueueSize = 1000
+)
+
+func newSinks(config *Config) ([]Sink, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	sinks := make([]Sink, 0, len(config.Sinks))
+	for _, sinkConfig := range config.Sinks {
+		var sink Sink
+		var err error
+		switch {
+		case sinkConfig.Stdout != nil:
+			sink = NewWriterSink(os.Stdout)
+		case sinkConfig.File != nil:
+			sink, err = newFileSink(sinkConfig.File.Path)
+		case sinkConfig.Webhook != nil:
+			sink, err = newWebhookSink(sinkConfig.Webhook)
+		default:
+			err = errNoSinkType
+		}
+		if err != nil {
+			for _, sink := range sinks {
+				_ = sink.Close()
+			}
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+type writerSink struct {
+	lock   sync.Mutex
+	writer io.Writer
+	closer io.Closer
+}
+
+// NewWriterSink returns a Sink which writes the events to the writer, e.g. to a buffer in tests.
+func NewWriterSink(w io.Writer) Sink {
+	return &writerSink{writer: w}
+}
+
+func newFileSink(path string) (Sink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit log file: %w", err)
+	}
+	return &writerSink{writer: f, closer: f}, nil
+}
+
+func (s *writerSink) Write(line []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, err := s.writer.Write(line); err != nil {
+		plog.WarningErr("could not write audit event", err)
+	}
+}
+
+func (s *writerSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closer.Close()
+}
+
+type webhookSink struct {
+	url    string
+	client *http.Client
+
+	lock   sync.Mutex
+	closed bool
+	queue  chan []byte
+	done   chan struct{}
+}
+
+func newWebhookSink(config *WebhookSinkConfig) (Sink, error) {
+	var rootCAs *x509.CertPool
+	if config.CABundleFile != "" {
+		caBundle, err := ioutil.ReadFile(config.CABundleFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read audit webhook CA bundle: %w", err)
+		}
+		rootCAs = x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(caBundle) {
+			return nil, constable.Error("audit webhook CA bundle does not contain any certificate")
+		}
+	}
+
+	timeoutSeconds := int64(defaultWebhookTimeoutSeconds)
+	if config.TimeoutSeconds != nil {
+		timeoutSeconds = *config.TimeoutSeconds
+	}
+
+	client := phttp.Default(rootCAs)
+	client.Timeout = time.Duration(timeoutSeconds) * time.Second
+
+	s := &webhookSink{
+		url:    config.URL,
+		client: client,
+		queue:  make(chan []byte, webhookQueueSize),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *webhookSink) Write(line []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- line:
+	default:
+		plog.Warning("dropped audit event because the audit webhook is too slow", "url", s.url)
+	}
+}
+
+// Close sends the events which are still queued before it returns.
+func (s *webhookSink) Close() error {
+	s.lock.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.lock.Unlock()
+
+	<-s.done
+	return nil
+}
+
+func (s *webhookSink) run() {
+	defer close(s.done)
+	for line := range s.queue {
+		if err := s.send(line); err != nil {
+			plog.WarningErr("could not send audit event to webhook", err, "url", s.url)
+		}
+	}
+}
+
+func (s *webhookSink) send(line []byte) error {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, s.url, bytes.NewReader(line))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
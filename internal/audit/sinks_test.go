@@ -0,0 +1,77 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package audit
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/testutil/tlsserver"
+)
+
+func TestFileSinkAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	require.NoError(t, ioutil.WriteFile(path, []byte("existing line\n"), 0600))
+
+	sink, err := newFileSink(path)
+	require.NoError(t, err)
+	sink.Write([]byte("line 1\n"))
+	sink.Write([]byte("line 2\n"))
+	require.NoError(t, sink.Close())
+
+	contents, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "existing line\nline 1\nline 2\n", string(contents))
+}
+
+func TestWebhookSink(t *testing.T) {
+	var lock sync.Mutex
+	var received []string
+	server := tlsserver.TLSTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		lock.Lock()
+		defer lock.Unlock()
+		received = append(received, string(body))
+		if string(body) == "fail\n" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}), nil)
+
+	caBundleFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, ioutil.WriteFile(caBundleFile, tlsserver.TLSTestServerCA(server), 0600))
+
+	sink, err := newWebhookSink(&WebhookSinkConfig{URL: server.URL, CABundleFile: caBundleFile})
+	require.NoError(t, err)
+	sink.Write([]byte("event 1\n"))
+	sink.Write([]byte("fail\n"))
+	sink.Write([]byte("event 2\n"))
+
+	// Close waits until the queued events were sent, and the failures do not stop the other events from being sent.
+	require.NoError(t, sink.Close())
+	require.Equal(t, []string{"event 1\n", "fail\n", "event 2\n"}, received)
+
+	// Events which are written after the sink was closed are dropped.
+	sink.Write([]byte("event 3\n"))
+	require.NoError(t, sink.Close())
+	require.Len(t, received, 3)
+}
+
+func TestWebhookSinkInvalidCABundle(t *testing.T) {
+	_, err := newWebhookSink(&WebhookSinkConfig{URL: "https://audit.example.com", CABundleFile: "/does/not/exist"})
+	require.EqualError(t, err, "could not read audit webhook CA bundle: open /does/not/exist: no such file or directory")
+
+	caBundleFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, ioutil.WriteFile(caBundleFile, []byte("not a certificate"), 0600))
+	_, err = newWebhookSink(&WebhookSinkConfig{URL: "https://audit.example.com", CABundleFile: caBundleFile})
+	require.EqualError(t, err, "audit webhook CA bundle does not contain any certificate")
+}
@@ -29,13 +29,14 @@ type Config struct {
 }
 
 type ExtraConfig struct {
-	Authenticator                 credentialrequest.TokenCredentialRequestAuthenticator
-	Issuer                        issuer.ClientCertIssuer
-	BuildControllersPostStartHook controllerinit.RunnerBuilder
-	Scheme                        *runtime.Scheme
-	NegotiatedSerializer          runtime.NegotiatedSerializer
-	LoginConciergeGroupVersion    schema.GroupVersion
-	IdentityConciergeGroupVersion schema.GroupVersion
+	Authenticator                   credentialrequest.TokenCredentialRequestAuthenticator
+	Issuer                          issuer.ClientCertIssuer
+	AllowReservedUsernamesAndGroups bool
+	BuildControllersPostStartHook   controllerinit.RunnerBuilder
+	Scheme                          *runtime.Scheme
+	NegotiatedSerializer            runtime.NegotiatedSerializer
+	LoginConciergeGroupVersion      schema.GroupVersion
+	IdentityConciergeGroupVersion   schema.GroupVersion
 }
 
 type PinnipedServer struct {
@@ -80,7 +81,7 @@ func (c completedConfig) New() (*PinnipedServer, error) {
 	for _, f := range []func() (schema.GroupVersionResource, rest.Storage){
 		func() (schema.GroupVersionResource, rest.Storage) {
 			tokenCredReqGVR := c.ExtraConfig.LoginConciergeGroupVersion.WithResource("tokencredentialrequests")
-			tokenCredStorage := credentialrequest.NewREST(c.ExtraConfig.Authenticator, c.ExtraConfig.Issuer, tokenCredReqGVR.GroupResource())
+			tokenCredStorage := credentialrequest.NewREST(c.ExtraConfig.Authenticator, c.ExtraConfig.Issuer, tokenCredReqGVR.GroupResource(), c.ExtraConfig.AllowReservedUsernamesAndGroups)
 			return tokenCredReqGVR, tokenCredStorage
 		},
 		func() (schema.GroupVersionResource, rest.Storage) {
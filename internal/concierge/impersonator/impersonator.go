@@ -5,6 +5,7 @@ package impersonator
 
 import (
 	"context"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -49,12 +50,15 @@ import (
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/transport"
 
+	pinnipedaudit "go.pinniped.dev/internal/audit"
 	"go.pinniped.dev/internal/constable"
 	"go.pinniped.dev/internal/crypto/ptls"
 	"go.pinniped.dev/internal/dynamiccert"
 	"go.pinniped.dev/internal/httputil/securityheader"
 	"go.pinniped.dev/internal/kubeclient"
+	"go.pinniped.dev/internal/metrics"
 	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/reservednames"
 	"go.pinniped.dev/internal/valuelesscontext"
 )
 
@@ -69,18 +73,24 @@ type FactoryFunc func(
 	impersonationProxySignerCA dynamiccert.Public,
 ) (func(stopCh <-chan struct{}) error, error)
 
-func New(
-	port int,
-	dynamicCertProvider dynamiccert.Private,
-	impersonationProxySignerCA dynamiccert.Public,
-) (func(stopCh <-chan struct{}) error, error) {
-	return newInternal(port, dynamicCertProvider, impersonationProxySignerCA, kubeclient.Secure, nil, nil, nil)
+// NewFactory returns a FactoryFunc which creates impersonator servers. Unless allowReservedUsernamesAndGroups
+// is true, the servers will refuse to authenticate client certificates which were issued by the impersonation
+// proxy signer CA for a username or group that is reserved by Kubernetes.
+func NewFactory(allowReservedUsernamesAndGroups bool) FactoryFunc {
+	return func(
+		port int,
+		dynamicCertProvider dynamiccert.Private,
+		impersonationProxySignerCA dynamiccert.Public,
+	) (func(stopCh <-chan struct{}) error, error) {
+		return newInternal(port, dynamicCertProvider, impersonationProxySignerCA, allowReservedUsernamesAndGroups, kubeclient.Secure, nil, nil, nil)
+	}
 }
 
 func newInternal( //nolint:funlen // yeah, it's kind of long.
 	port int,
 	dynamicCertProvider dynamiccert.Private,
 	impersonationProxySignerCA dynamiccert.Public,
+	allowReservedUsernamesAndGroups bool,
 	restConfigFunc ptls.RestConfigFunc, // for unit testing, should always be kubeclient.Secure in production
 	clientOpts []kubeclient.Option, // for unit testing, should always be nil in production
 	recOpts func(*genericoptions.RecommendedOptions), // for unit testing, should always be nil in production
@@ -187,7 +197,7 @@ func newInternal( //nolint:funlen // yeah, it's kind of long.
 
 			// Impersonation proxy business logic with timing information.
 			impersonationProxyCompleted := filterlatency.TrackCompleted(doNotDelegate)
-			impersonationProxy := impersonationProxyFunc(c)
+			impersonationProxy := metrics.InstrumentImpersonationProxy(impersonationProxyFunc(c))
 			handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				defer impersonationProxyCompleted.ServeHTTP(w, r)
 				impersonationProxy.ServeHTTP(w, r)
@@ -230,6 +240,14 @@ func newInternal( //nolint:funlen // yeah, it's kind of long.
 			RequestFunc: func(req *http.Request) (*authenticator.Response, bool, error) {
 				resp, ok, err := delegatingAuthenticator.AuthenticateRequest(req)
 
+				// the TokenCredentialRequest API refuses to issue certs for reserved names, but reject any such certs anyway
+				if err == nil && ok && !allowReservedUsernamesAndGroups {
+					if reservedErr := validateImpersonationProxySignerClientCert(req, impersonationProxySignerCA); reservedErr != nil {
+						plog.Info("rejecting client certificate with reserved username or group", "reason", reservedErr.Error())
+						return nil, false, nil
+					}
+				}
+
 				// anonymous auth is enabled so no further check is necessary
 				if anonymousAuthEnabled {
 					return resp, ok, err
@@ -265,8 +283,16 @@ func newInternal( //nolint:funlen // yeah, it's kind of long.
 				return resp, ok, err
 			},
 		}
+		// Record the outcome of each authentication in the audit log.
+		auditingAuthenticator := &comparableAuthenticator{
+			RequestFunc: func(req *http.Request) (*authenticator.Response, bool, error) {
+				resp, ok, err := blockAnonymousAuthenticator.AuthenticateRequest(req)
+				recordAuthentication(req, resp, ok, err)
+				return resp, ok, err
+			},
+		}
 		// Set our custom authenticator before calling Compete(), which will use it.
-		serverConfig.Authentication.Authenticator = blockAnonymousAuthenticator
+		serverConfig.Authentication.Authenticator = auditingAuthenticator
 
 		delegatingAuthorizer := serverConfig.Authorization.Authorizer
 		customReasonAuthorizer := &comparableAuthorizer{
@@ -311,7 +337,7 @@ func newInternal( //nolint:funlen // yeah, it's kind of long.
 		preparedRun := impersonationProxyServer.PrepareRun()
 
 		// Sanity check. Make sure that our custom authenticator is still in place and did not get changed or wrapped.
-		if completedConfig.Authentication.Authenticator != blockAnonymousAuthenticator {
+		if completedConfig.Authentication.Authenticator != auditingAuthenticator {
 			return nil, fmt.Errorf("invalid mutation of anonymous authenticator detected: %#v", completedConfig.Authentication.Authenticator)
 		}
 
@@ -404,6 +430,35 @@ func isAnonymousAuthEnabled(config *rest.Config) (bool, error) {
 	}
 }
 
+// validateImpersonationProxySignerClientCert returns an error when the request's client certificate was issued by
+// the impersonation proxy signer CA and it asserts a username or group which is reserved by Kubernetes.
+// Client certificates issued by other CAs, such as the Kube API server's CA, are not checked.
+func validateImpersonationProxySignerClientCert(req *http.Request, impersonationProxySignerCA dynamiccert.Public) error {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(impersonationProxySignerCA.CurrentCABundleContent()) {
+		return nil
+	}
+	intermediates := x509.NewCertPool()
+	for _, intermediate := range req.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(intermediate)
+	}
+
+	clientCert := req.TLS.PeerCertificates[0]
+	if _, err := clientCert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return nil // not issued by the impersonation proxy signer CA
+	}
+
+	return reservednames.Validate(clientCert.Subject.CommonName, clientCert.Subject.Organization)
+}
+
 func isTokenCredReq(reqInfo *genericapirequest.RequestInfo) bool {
 	if reqInfo.Resource != "tokencredentialrequests" {
 		return false
@@ -423,6 +478,23 @@ type comparableAuthenticator struct {
 	authenticator.RequestFunc
 }
 
+const errNotAuthenticated = constable.Error("request was not authenticated")
+
+// recordAuthentication records the audit event of the authentication of a request to the impersonation proxy.
+func recordAuthentication(req *http.Request, resp *authenticator.Response, ok bool, err error) {
+	event := &pinnipedaudit.Event{Type: pinnipedaudit.TypeImpersonationProxyAuthentication}
+	switch {
+	case err != nil:
+		event.Failure(err)
+	case !ok:
+		event.Failure(errNotAuthenticated)
+	default:
+		event.Username = resp.User.GetName()
+		event.Groups = resp.User.GetGroups()
+	}
+	pinnipedaudit.RecordRequest(req, event)
+}
+
 // No-op wrapping around AuthorizerFunc to allow for comparisons.
 type comparableAuthorizer struct {
 	authorizer.AuthorizerFunc
@@ -44,6 +44,7 @@ import (
 	"k8s.io/utils/pointer"
 
 	loginv1alpha1 "go.pinniped.dev/generated/latest/apis/concierge/login/v1alpha1"
+	pinnipedaudit "go.pinniped.dev/internal/audit"
 	"go.pinniped.dev/internal/certauthority"
 	"go.pinniped.dev/internal/constable"
 	"go.pinniped.dev/internal/crypto/ptls"
@@ -52,6 +53,7 @@ import (
 	"go.pinniped.dev/internal/here"
 	"go.pinniped.dev/internal/httputil/roundtripper"
 	"go.pinniped.dev/internal/kubeclient"
+	"go.pinniped.dev/internal/testutil"
 	"go.pinniped.dev/internal/testutil/tlsserver"
 )
 
@@ -86,6 +88,7 @@ func TestImpersonator(t *testing.T) {
 		kubeAPIServerStatusCode            int
 		kubeAPIServerHealthz               http.Handler
 		anonymousAuthDisabled              bool
+		allowReservedUsernamesAndGroups    bool
 		wantKubeAPIServerRequestHeaders    http.Header
 		wantError                          string
 		wantConstructionError              string
@@ -312,6 +315,41 @@ func TestImpersonator(t *testing.T) {
 			wantError:                          "Unauthorized",
 			wantAuthorizerAttributes:           nil,
 		},
+		{
+			name:                               "client cert issued by the signer CA for a reserved group",
+			clientCert:                         newClientCert(t, ca, "test-admin", []string{"system:masters", "test-group2"}),
+			kubeAPIServerClientBearerTokenFile: "required-to-be-set",
+			wantError:                          "Unauthorized",
+			wantAuthorizerAttributes:           nil,
+		},
+		{
+			name:                               "client cert issued by the signer CA for a reserved username",
+			clientCert:                         newClientCert(t, ca, "system:admin", []string{"test-group1"}),
+			kubeAPIServerClientBearerTokenFile: "required-to-be-set",
+			wantError:                          "Unauthorized",
+			wantAuthorizerAttributes:           nil,
+		},
+		{
+			name:                               "client cert issued by the signer CA for a reserved group when reserved names are allowed",
+			clientCert:                         newClientCert(t, ca, "test-username", []string{"system:masters"}),
+			allowReservedUsernamesAndGroups:    true,
+			kubeAPIServerClientBearerTokenFile: "required-to-be-set",
+			wantKubeAPIServerRequestHeaders: http.Header{
+				"Impersonate-User":  {"test-username"},
+				"Impersonate-Group": {"system:masters", "system:authenticated"},
+				"Authorization":     {"Bearer some-service-account-token"},
+				"User-Agent":        {"test-agent"},
+				"Accept":            {"application/vnd.kubernetes.protobuf,application/json"},
+				"Accept-Encoding":   {"gzip"},
+				"X-Forwarded-For":   {"127.0.0.1"},
+			},
+			wantAuthorizerAttributes: []authorizer.AttributesRecord{
+				{
+					User: &user.DefaultInfo{Name: "test-username", UID: "", Groups: []string{"system:masters", "system:authenticated"}, Extra: nil},
+					Verb: "list", Namespace: "", APIGroup: "", APIVersion: "v1", Resource: "namespaces", Subresource: "", Name: "", ResourceRequest: true, Path: "/api/v1/namespaces",
+				},
+			},
+		},
 		{
 			name:                               "nested impersonation by regular users calls delegating authorizer",
 			clientCert:                         newClientCert(t, ca, "test-username", []string{"test-group1", "test-group2"}),
@@ -329,8 +367,9 @@ func TestImpersonator(t *testing.T) {
 			},
 		},
 		{
-			name:       "nested impersonation by admin users calls delegating authorizer",
-			clientCert: newClientCert(t, ca, "test-admin", []string{"system:masters", "test-group2"}),
+			name:                            "nested impersonation by admin users calls delegating authorizer",
+			clientCert:                      newClientCert(t, ca, "test-admin", []string{"system:masters", "test-group2"}),
+			allowReservedUsernamesAndGroups: true, // the TokenCredentialRequest API only issues such certs when reserved names are allowed
 			clientImpersonateUser: rest.ImpersonationConfig{
 				UserName: "fire",
 				Groups:   []string{"elements"},
@@ -464,9 +503,10 @@ func TestImpersonator(t *testing.T) {
 			},
 		},
 		{
-			name:                  "nested impersonation by admin users cannot impersonate UID",
-			clientCert:            newClientCert(t, ca, "test-admin", []string{"system:masters", "test-group2"}),
-			clientImpersonateUser: rest.ImpersonationConfig{UserName: "some-other-username"},
+			name:                            "nested impersonation by admin users cannot impersonate UID",
+			clientCert:                      newClientCert(t, ca, "test-admin", []string{"system:masters", "test-group2"}),
+			allowReservedUsernamesAndGroups: true, // the TokenCredentialRequest API only issues such certs when reserved names are allowed
+			clientImpersonateUser:           rest.ImpersonationConfig{UserName: "some-other-username"},
 			clientMutateHeaders: func(header http.Header) {
 				header["Impersonate-Uid"] = []string{"root"}
 			},
@@ -488,9 +528,10 @@ func TestImpersonator(t *testing.T) {
 			},
 		},
 		{
-			name:                  "nested impersonation by admin users cannot impersonate UID header canonicalization",
-			clientCert:            newClientCert(t, ca, "test-admin", []string{"system:masters", "test-group2"}),
-			clientImpersonateUser: rest.ImpersonationConfig{UserName: "some-other-username"},
+			name:                            "nested impersonation by admin users cannot impersonate UID header canonicalization",
+			clientCert:                      newClientCert(t, ca, "test-admin", []string{"system:masters", "test-group2"}),
+			allowReservedUsernamesAndGroups: true, // the TokenCredentialRequest API only issues such certs when reserved names are allowed
+			clientImpersonateUser:           rest.ImpersonationConfig{UserName: "some-other-username"},
 			clientMutateHeaders: func(header http.Header) {
 				header["imPerSoNaTE-uid"] = []string{"magic"}
 			},
@@ -512,8 +553,9 @@ func TestImpersonator(t *testing.T) {
 			},
 		},
 		{
-			name:       "nested impersonation by admin users cannot use reserved key",
-			clientCert: newClientCert(t, ca, "test-admin", []string{"system:masters", "test-group2"}),
+			name:                            "nested impersonation by admin users cannot use reserved key",
+			clientCert:                      newClientCert(t, ca, "test-admin", []string{"system:masters", "test-group2"}),
+			allowReservedUsernamesAndGroups: true, // the TokenCredentialRequest API only issues such certs when reserved names are allowed
 			clientImpersonateUser: rest.ImpersonationConfig{
 				UserName: "other-user-to-impersonate",
 				Groups:   []string{"other-peeps"},
@@ -553,8 +595,9 @@ func TestImpersonator(t *testing.T) {
 			},
 		},
 		{
-			name:       "nested impersonation by admin users cannot use invalid key",
-			clientCert: newClientCert(t, ca, "test-admin", []string{"system:masters", "test-group2"}),
+			name:                            "nested impersonation by admin users cannot use invalid key",
+			clientCert:                      newClientCert(t, ca, "test-admin", []string{"system:masters", "test-group2"}),
+			allowReservedUsernamesAndGroups: true, // the TokenCredentialRequest API only issues such certs when reserved names are allowed
 			clientImpersonateUser: rest.ImpersonationConfig{
 				UserName: "panda",
 				Groups:   []string{"other-peeps"},
@@ -584,8 +627,9 @@ func TestImpersonator(t *testing.T) {
 			},
 		},
 		{
-			name:       "nested impersonation by admin users can use uppercase key because impersonation is lossy",
-			clientCert: newClientCert(t, ca, "test-admin", []string{"system:masters", "test-group2"}),
+			name:                            "nested impersonation by admin users can use uppercase key because impersonation is lossy",
+			clientCert:                      newClientCert(t, ca, "test-admin", []string{"system:masters", "test-group2"}),
+			allowReservedUsernamesAndGroups: true, // the TokenCredentialRequest API only issues such certs when reserved names are allowed
 			clientImpersonateUser: rest.ImpersonationConfig{
 				UserName: "panda",
 				Groups:   []string{"other-peeps"},
@@ -845,7 +889,7 @@ func TestImpersonator(t *testing.T) {
 			}
 
 			// Create an impersonator.  Use an invalid port number to make sure our listener override works.
-			runner, constructionErr := newInternal(-1000, certKeyContent, caContent, restConfigFunc, clientOpts, recOpts, recConfig)
+			runner, constructionErr := newInternal(-1000, certKeyContent, caContent, tt.allowReservedUsernamesAndGroups, restConfigFunc, clientOpts, recOpts, recConfig)
 			if len(tt.wantConstructionError) > 0 {
 				require.EqualError(t, constructionErr, tt.wantConstructionError)
 				require.Nil(t, runner)
@@ -2041,6 +2085,46 @@ func Test_withBearerTokenPreservation(t *testing.T) {
 	}
 }
 
+func Test_recordAuthentication(t *testing.T) {
+	auditEvents := testutil.RecordAuditEvents(t, pinnipedaudit.ComponentConcierge)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil)
+	req.RemoteAddr = "1.2.3.4:5678"
+	req = req.WithContext(request.WithAuditID(req.Context(), "some-request-id"))
+
+	recordAuthentication(req, &authenticator.Response{
+		User: &user.DefaultInfo{Name: "some-user", Groups: []string{"some-group", "system:authenticated"}},
+	}, true, nil)
+	recordAuthentication(req, nil, false, nil)
+	recordAuthentication(req, nil, false, constable.Error("some authentication error"))
+
+	events := auditEvents()
+	require.Len(t, events, 3)
+	for i := range events {
+		require.NotZero(t, events[i].Time)
+		events[i].Time = time.Time{}
+	}
+	base := pinnipedaudit.Event{
+		APIVersion: pinnipedaudit.APIVersion,
+		Kind:       pinnipedaudit.Kind,
+		Component:  pinnipedaudit.ComponentConcierge,
+		Type:       pinnipedaudit.TypeImpersonationProxyAuthentication,
+		RequestID:  "some-request-id",
+		SourceIP:   "1.2.3.4",
+	}
+	success := base
+	success.Username = "some-user"
+	success.Groups = []string{"some-group", "system:authenticated"}
+	success.Outcome = pinnipedaudit.OutcomeSuccess
+	notAuthenticated := base
+	notAuthenticated.Outcome = pinnipedaudit.OutcomeFailure
+	notAuthenticated.Reason = "request was not authenticated"
+	authenticationError := base
+	authenticationError.Outcome = pinnipedaudit.OutcomeFailure
+	authenticationError.Reason = "some authentication error"
+	require.Equal(t, []pinnipedaudit.Event{success, notAuthenticated, authenticationError}, events)
+}
+
 type attributeRecorder struct {
 	lock       sync.Mutex
 	attributes []authorizer.AttributesRecord
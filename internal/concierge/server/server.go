@@ -8,6 +8,8 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"os"
 	"time"
 
@@ -22,6 +24,7 @@ import (
 	"k8s.io/component-base/logs"
 	"k8s.io/klog/v2"
 
+	"go.pinniped.dev/internal/audit"
 	"go.pinniped.dev/internal/certauthority/dynamiccertauthority"
 	"go.pinniped.dev/internal/concierge/apiserver"
 	conciergescheme "go.pinniped.dev/internal/concierge/scheme"
@@ -35,6 +38,8 @@ import (
 	"go.pinniped.dev/internal/here"
 	"go.pinniped.dev/internal/issuer"
 	"go.pinniped.dev/internal/kubeclient"
+	"go.pinniped.dev/internal/metrics"
+	"go.pinniped.dev/internal/plog"
 	"go.pinniped.dev/internal/registry/credentialrequest"
 )
 
@@ -105,6 +110,20 @@ func (a *App) runServer(ctx context.Context) error {
 		return fmt.Errorf("could not load config: %w", err)
 	}
 
+	closeAuditSinks, err := audit.ConfigureGlobally(audit.ComponentConcierge, cfg.Audit)
+	if err != nil {
+		return fmt.Errorf("could not configure audit log: %w", err)
+	}
+	defer closeAuditSinks()
+
+	if cfg.Metrics != nil {
+		// Register the metrics before the controllers and the aggregated API server start, so that nothing is missed.
+		metrics.Register()
+		if err := startMetricsServer(ctx, cfg.Metrics.Address); err != nil {
+			return err
+		}
+	}
+
 	// Discover in which namespace we are installed.
 	podInfo, err := downward.Load(a.downwardAPIPath)
 	if err != nil {
@@ -150,7 +169,8 @@ func (a *App) runServer(ctx context.Context) error {
 			ServingCertRenewBefore:           time.Duration(*cfg.APIConfig.ServingCertificateConfig.RenewBeforeSeconds) * time.Second,
 			AuthenticatorCache:               authenticators,
 			// This port should be safe to cast because the config reader already validated it.
-			ImpersonationProxyServerPort: int(*cfg.ImpersonationProxyServerPort),
+			ImpersonationProxyServerPort:    int(*cfg.ImpersonationProxyServerPort),
+			AllowReservedUsernamesAndGroups: cfg.AllowReservedUsernamesAndGroups,
 		},
 	)
 	if err != nil {
@@ -167,6 +187,7 @@ func (a *App) runServer(ctx context.Context) error {
 		dynamicServingCertProvider,
 		authenticators,
 		certIssuer,
+		cfg.AllowReservedUsernamesAndGroups,
 		buildControllers,
 		*cfg.APIGroupSuffix,
 		*cfg.AggregatedAPIServerPort,
@@ -188,11 +209,36 @@ func (a *App) runServer(ctx context.Context) error {
 	return server.GenericAPIServer.PrepareRun().Run(ctx.Done())
 }
 
+// startMetricsServer serves the metrics over plain HTTP on address until ctx is done.
+func startMetricsServer(ctx context.Context, address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("could not create metrics listener with address %q: %w", address, err)
+	}
+
+	server := &http.Server{Handler: metrics.Handler()}
+
+	go func() {
+		err := server.Serve(l)
+		plog.Debug("metrics server exited", "err", err)
+	}()
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	return nil
+}
+
 // Create a configuration for the aggregated API server.
 func getAggregatedAPIServerConfig(
 	dynamicCertProvider dynamiccert.Private,
 	authenticator credentialrequest.TokenCredentialRequestAuthenticator,
 	issuer issuer.ClientCertIssuer,
+	allowReservedUsernamesAndGroups bool,
 	buildControllers controllerinit.RunnerBuilder,
 	apiGroupSuffix string,
 	aggregatedAPIServerPort int64,
@@ -238,13 +284,14 @@ func getAggregatedAPIServerConfig(
 	apiServerConfig := &apiserver.Config{
 		GenericConfig: serverConfig,
 		ExtraConfig: apiserver.ExtraConfig{
-			Authenticator:                 authenticator,
-			Issuer:                        issuer,
-			BuildControllersPostStartHook: buildControllers,
-			Scheme:                        scheme,
-			NegotiatedSerializer:          codecs,
-			LoginConciergeGroupVersion:    loginConciergeGroupVersion,
-			IdentityConciergeGroupVersion: identityConciergeGroupVersion,
+			Authenticator:                   authenticator,
+			Issuer:                          issuer,
+			AllowReservedUsernamesAndGroups: allowReservedUsernamesAndGroups,
+			BuildControllersPostStartHook:   buildControllers,
+			Scheme:                          scheme,
+			NegotiatedSerializer:            codecs,
+			LoginConciergeGroupVersion:      loginConciergeGroupVersion,
+			IdentityConciergeGroupVersion:   identityConciergeGroupVersion,
 		},
 	}
 	return apiServerConfig, nil
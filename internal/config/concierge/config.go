@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 // Package concierge contains functionality to load/store Config's from/to
@@ -82,6 +82,18 @@ func FromPath(path string) (*Config, error) {
 		return nil, fmt.Errorf("validate log level: %w", err)
 	}
 
+	if config.Audit != nil {
+		if err := config.Audit.Validate(); err != nil {
+			return nil, fmt.Errorf("validate audit: %w", err)
+		}
+	}
+
+	if config.Metrics != nil {
+		if err := config.Metrics.Validate(); err != nil {
+			return nil, fmt.Errorf("validate metrics: %w", err)
+		}
+	}
+
 	if config.Labels == nil {
 		config.Labels = make(map[string]string)
 	}
@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package concierge
@@ -11,7 +11,9 @@ import (
 	"github.com/stretchr/testify/require"
 	"k8s.io/utils/pointer"
 
+	"go.pinniped.dev/internal/audit"
 	"go.pinniped.dev/internal/here"
+	"go.pinniped.dev/internal/metrics"
 	"go.pinniped.dev/internal/plog"
 )
 
@@ -56,6 +58,12 @@ func TestFromPath(t *testing.T) {
 				  image: kube-cert-agent-image
 				  imagePullSecrets: [kube-cert-agent-image-pull-secret]
 				logLevel: debug
+				allowReservedUsernamesAndGroups: true
+				audit:
+				  sinks:
+				  - stdout: {}
+				metrics:
+				  address: :9090
 			`),
 			wantConfig: &Config{
 				DiscoveryInfo: DiscoveryInfoSpec{
@@ -90,7 +98,10 @@ func TestFromPath(t *testing.T) {
 					Image:            pointer.StringPtr("kube-cert-agent-image"),
 					ImagePullSecrets: []string{"kube-cert-agent-image-pull-secret"},
 				},
-				LogLevel: plog.LevelDebug,
+				LogLevel:                        plog.LevelDebug,
+				AllowReservedUsernamesAndGroups: true,
+				Audit:                           &audit.Config{Sinks: []audit.SinkConfig{{Stdout: &audit.StdoutSinkConfig{}}}},
+				Metrics:                         &metrics.Config{Address: ":9090"},
 			},
 		},
 		{
@@ -380,6 +391,46 @@ func TestFromPath(t *testing.T) {
 			`),
 			wantError: "validate api: renewBefore must be positive",
 		},
+		{
+			name: "InvalidAuditSink",
+			yaml: here.Doc(`
+				---
+				names:
+				  servingCertificateSecret: pinniped-concierge-api-tls-serving-certificate
+				  credentialIssuer: pinniped-config
+				  apiService: pinniped-api
+				  impersonationLoadBalancerService: impersonationLoadBalancerService-value
+				  impersonationClusterIPService: impersonationClusterIPService-value
+				  impersonationTLSCertificateSecret: impersonationTLSCertificateSecret-value
+				  impersonationCACertificateSecret: impersonationCACertificateSecret-value
+				  impersonationSignerSecret: impersonationSignerSecret-value
+				  agentServiceAccount: agentServiceAccount-value
+				audit:
+				  sinks:
+				  - webhook:
+				      url: http://audit.example.com/events
+			`),
+			wantError: "validate audit: sinks[0]: webhook.url must be an https URL",
+		},
+		{
+			name: "InvalidMetricsAddress",
+			yaml: here.Doc(`
+				---
+				names:
+				  servingCertificateSecret: pinniped-concierge-api-tls-serving-certificate
+				  credentialIssuer: pinniped-config
+				  apiService: pinniped-api
+				  impersonationLoadBalancerService: impersonationLoadBalancerService-value
+				  impersonationClusterIPService: impersonationClusterIPService-value
+				  impersonationTLSCertificateSecret: impersonationTLSCertificateSecret-value
+				  impersonationCACertificateSecret: impersonationCACertificateSecret-value
+				  impersonationSignerSecret: impersonationSignerSecret-value
+				  agentServiceAccount: agentServiceAccount-value
+				metrics:
+				  address: :99999
+			`),
+			wantError: "validate metrics: address must be a host and a port, e.g. :9090",
+		},
 		{
 			name: "InvalidAPIGroupSuffix",
 			yaml: here.Doc(`
@@ -1,9 +1,13 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package concierge
 
-import "go.pinniped.dev/internal/plog"
+import (
+	"go.pinniped.dev/internal/audit"
+	"go.pinniped.dev/internal/metrics"
+	"go.pinniped.dev/internal/plog"
+)
 
 // Config contains knobs to setup an instance of the Pinniped Concierge.
 type Config struct {
@@ -16,6 +20,18 @@ type Config struct {
 	KubeCertAgentConfig          KubeCertAgentSpec `json:"kubeCertAgent"`
 	Labels                       map[string]string `json:"labels"`
 	LogLevel                     plog.LogLevel     `json:"logLevel"`
+
+	// AllowReservedUsernamesAndGroups disables the safeguard which refuses to issue credentials when the
+	// username or any of the groups begin with a prefix which is reserved by Kubernetes, e.g. "system:".
+	AllowReservedUsernamesAndGroups bool `json:"allowReservedUsernamesAndGroups"`
+
+	// Audit configures the sinks of the audit log of the authentication events. When it is not set, no audit
+	// events are recorded.
+	Audit *audit.Config `json:"audit,omitempty"`
+
+	// Metrics configures the listener of the Prometheus metrics endpoint. When it is not set, the metrics are
+	// not served.
+	Metrics *metrics.Config `json:"metrics,omitempty"`
 }
 
 // DiscoveryInfoSpec contains configuration knobs specific to
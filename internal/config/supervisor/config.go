@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 // Package supervisor contains functionality to load/store Config's from/to
@@ -22,6 +22,13 @@ const (
 	NetworkDisabled = "disabled"
 	NetworkUnix     = "unix"
 	NetworkTCP      = "tcp"
+
+	defaultPluginSignerTimeoutSeconds = 3
+	defaultKMSTimeoutSeconds          = 3
+
+	// Use 10250 for the same reasons as the Concierge: some cluster types, e.g. GKE private clusters, only allow
+	// traffic from the control plane to a few ports, including the port on which the Kubelet listens.
+	aggregatedAPIServerPortDefault = 10250
 )
 
 // FromPath loads an Config from a provided local file path, inserts any
@@ -43,11 +50,16 @@ func FromPath(path string) (*Config, error) {
 	}
 
 	maybeSetAPIGroupSuffixDefault(&config.APIGroupSuffix)
+	maybeSetAggregatedAPIServerPortDefaults(&config.AggregatedAPIServerPort)
 
 	if err := validateAPIGroupSuffix(*config.APIGroupSuffix); err != nil {
 		return nil, fmt.Errorf("validate apiGroupSuffix: %w", err)
 	}
 
+	if err := validateServerPort(config.AggregatedAPIServerPort); err != nil {
+		return nil, fmt.Errorf("validate aggregatedAPIServerPort: %w", err)
+	}
+
 	if err := validateNames(&config.NamesConfig); err != nil {
 		return nil, fmt.Errorf("validate names: %w", err)
 	}
@@ -80,6 +92,44 @@ func FromPath(path string) (*Config, error) {
 		return nil, fmt.Errorf("validate endpoints: %w", err)
 	}
 
+	if config.TokenSigner != nil {
+		maybeSetPluginSignerDefaults(config.TokenSigner.Plugin)
+		if err := validateTokenSigner(config.TokenSigner); err != nil {
+			return nil, fmt.Errorf("validate tokenSigner: %w", err)
+		}
+	}
+
+	if config.SessionStorage != nil {
+		if err := validateSessionStorage(config.SessionStorage); err != nil {
+			return nil, fmt.Errorf("validate sessionStorage: %w", err)
+		}
+	}
+
+	if config.SessionEncryption != nil {
+		maybeSetKMSDefaults(config.SessionEncryption.KMS)
+		if err := validateSessionEncryption(config.SessionEncryption); err != nil {
+			return nil, fmt.Errorf("validate sessionEncryption: %w", err)
+		}
+	}
+
+	if config.Audit != nil {
+		if err := config.Audit.Validate(); err != nil {
+			return nil, fmt.Errorf("validate audit: %w", err)
+		}
+	}
+
+	if config.Metrics != nil {
+		if err := config.Metrics.Validate(); err != nil {
+			return nil, fmt.Errorf("validate metrics: %w", err)
+		}
+	}
+
+	if config.Tracing != nil {
+		if err := config.Tracing.Validate(); err != nil {
+			return nil, fmt.Errorf("validate tracing: %w", err)
+		}
+	}
+
 	return &config, nil
 }
 
@@ -96,15 +146,35 @@ func maybeSetAPIGroupSuffixDefault(apiGroupSuffix **string) {
 	}
 }
 
+func maybeSetAggregatedAPIServerPortDefaults(port **int64) {
+	if *port == nil {
+		*port = pointer.Int64Ptr(aggregatedAPIServerPortDefault)
+	}
+}
+
 func validateAPIGroupSuffix(apiGroupSuffix string) error {
 	return groupsuffix.Validate(apiGroupSuffix)
 }
 
+func validateServerPort(port *int64) error {
+	// It cannot be below 1024 because the container is not running as root.
+	if *port < 1024 || *port > 65535 {
+		return constable.Error("must be within range 1024 to 65535")
+	}
+	return nil
+}
+
 func validateNames(names *NamesConfigSpec) error {
 	missingNames := []string{}
 	if names.DefaultTLSCertificateSecret == "" {
 		missingNames = append(missingNames, "defaultTLSCertificateSecret")
 	}
+	if names.APIServingCertificateSecret == "" {
+		missingNames = append(missingNames, "apiServingCertificateSecret")
+	}
+	if names.APIService == "" {
+		missingNames = append(missingNames, "apiService")
+	}
 	if len(missingNames) > 0 {
 		return constable.Error("missing required names: " + strings.Join(missingNames, ", "))
 	}
@@ -136,3 +206,82 @@ func validateAtLeastOneEnabledEndpoint(endpoints ...Endpoint) error {
 	}
 	return constable.Error("all endpoints are disabled")
 }
+
+func maybeSetPluginSignerDefaults(plugin *PluginSignerSpec) {
+	if plugin != nil && plugin.TimeoutSeconds == nil {
+		plugin.TimeoutSeconds = pointer.Int64Ptr(defaultPluginSignerTimeoutSeconds)
+	}
+}
+
+func validateTokenSigner(tokenSigner *TokenSignerSpec) error {
+	switch {
+	case tokenSigner.PKCS11 != nil && tokenSigner.Plugin != nil:
+		return constable.Error("only one of pkcs11 or plugin may be set")
+	case tokenSigner.PKCS11 != nil:
+		missing := []string{}
+		if tokenSigner.PKCS11.ModulePath == "" {
+			missing = append(missing, "modulePath")
+		}
+		if tokenSigner.PKCS11.TokenLabel == "" {
+			missing = append(missing, "tokenLabel")
+		}
+		if tokenSigner.PKCS11.KeyLabel == "" {
+			missing = append(missing, "keyLabel")
+		}
+		if tokenSigner.PKCS11.PINFile == "" {
+			missing = append(missing, "pinFile")
+		}
+		if len(missing) > 0 {
+			return constable.Error("missing required pkcs11 fields: " + strings.Join(missing, ", "))
+		}
+		return nil
+	case tokenSigner.Plugin != nil:
+		if !strings.HasPrefix(tokenSigner.Plugin.Endpoint, "unix://") {
+			return fmt.Errorf("plugin endpoint %q must start with \"unix://\"", tokenSigner.Plugin.Endpoint)
+		}
+		if *tokenSigner.Plugin.TimeoutSeconds <= 0 {
+			return constable.Error("plugin timeoutSeconds must be positive")
+		}
+		return nil
+	default:
+		return constable.Error("one of pkcs11 or plugin must be set")
+	}
+}
+
+func validateSessionStorage(sessionStorage *SessionStorageSpec) error {
+	switch {
+	case sessionStorage.SQLite != nil && sessionStorage.Postgres != nil:
+		return constable.Error("only one of sqlite or postgres may be set")
+	case sessionStorage.SQLite != nil:
+		if sessionStorage.SQLite.Path == "" {
+			return constable.Error("sqlite path must be set")
+		}
+		return nil
+	case sessionStorage.Postgres != nil:
+		if sessionStorage.Postgres.ConnectionStringFile == "" {
+			return constable.Error("postgres connectionStringFile must be set")
+		}
+		return nil
+	default:
+		return constable.Error("one of sqlite or postgres must be set")
+	}
+}
+
+func maybeSetKMSDefaults(kms *KMSSessionEncryptionSpec) {
+	if kms != nil && kms.TimeoutSeconds == nil {
+		kms.TimeoutSeconds = pointer.Int64Ptr(defaultKMSTimeoutSeconds)
+	}
+}
+
+func validateSessionEncryption(sessionEncryption *SessionEncryptionSpec) error {
+	if sessionEncryption.KMS == nil {
+		return constable.Error("kms must be set")
+	}
+	if !strings.HasPrefix(sessionEncryption.KMS.Endpoint, "unix://") {
+		return fmt.Errorf("kms endpoint %q must start with \"unix://\"", sessionEncryption.KMS.Endpoint)
+	}
+	if *sessionEncryption.KMS.TimeoutSeconds <= 0 {
+		return constable.Error("kms timeoutSeconds must be positive")
+	}
+	return nil
+}
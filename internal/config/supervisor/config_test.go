@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package supervisor
@@ -12,7 +12,10 @@ import (
 
 	"github.com/stretchr/testify/require"
 
+	"go.pinniped.dev/internal/audit"
 	"go.pinniped.dev/internal/here"
+	"go.pinniped.dev/internal/metrics"
+	"go.pinniped.dev/internal/tracing"
 )
 
 func TestFromPath(t *testing.T) {
@@ -32,21 +35,27 @@ func TestFromPath(t *testing.T) {
 				  myLabelKey2: myLabelValue2
 				names:
 				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
 				endpoints:
 				  https:
 				    network: unix
 				    address: :1234
 				  http:
 				    network: disabled
+				allowReservedUsernamesAndGroups: true
 			`),
 			wantConfig: &Config{
-				APIGroupSuffix: pointer.StringPtr("some.suffix.com"),
+				APIGroupSuffix:          pointer.StringPtr("some.suffix.com"),
+				AggregatedAPIServerPort: pointer.Int64Ptr(10250),
 				Labels: map[string]string{
 					"myLabelKey1": "myLabelValue1",
 					"myLabelKey2": "myLabelValue2",
 				},
 				NamesConfig: NamesConfigSpec{
 					DefaultTLSCertificateSecret: "my-secret-name",
+					APIServingCertificateSecret: "my-api-serving-cert-secret-name",
+					APIService:                  "my-api-service-name",
 				},
 				Endpoints: &Endpoints{
 					HTTPS: &Endpoint{
@@ -57,6 +66,7 @@ func TestFromPath(t *testing.T) {
 						Network: "disabled",
 					},
 				},
+				AllowReservedUsernamesAndGroups: true,
 			},
 		},
 		{
@@ -65,12 +75,17 @@ func TestFromPath(t *testing.T) {
 				---
 				names:
 				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
 			`),
 			wantConfig: &Config{
-				APIGroupSuffix: pointer.StringPtr("pinniped.dev"),
-				Labels:         map[string]string{},
+				APIGroupSuffix:          pointer.StringPtr("pinniped.dev"),
+				AggregatedAPIServerPort: pointer.Int64Ptr(10250),
+				Labels:                  map[string]string{},
 				NamesConfig: NamesConfigSpec{
 					DefaultTLSCertificateSecret: "my-secret-name",
+					APIServingCertificateSecret: "my-api-serving-cert-secret-name",
+					APIService:                  "my-api-service-name",
 				},
 				Endpoints: &Endpoints{
 					HTTPS: &Endpoint{
@@ -90,6 +105,8 @@ func TestFromPath(t *testing.T) {
 				---
 				names:
 				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
 				endpoints:
 				  https:
 				    network: disabled
@@ -104,6 +121,8 @@ func TestFromPath(t *testing.T) {
 				---
 				names:
 				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
 				endpoints:
 				  https:
 				    network: foo
@@ -118,6 +137,8 @@ func TestFromPath(t *testing.T) {
 				---
 				names:
 				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
 				endpoints:
 				  https:
 				    network: disabled
@@ -132,6 +153,8 @@ func TestFromPath(t *testing.T) {
 				---
 				names:
 				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
 				endpoints:
 				  https:
 				    network: disabled
@@ -145,6 +168,8 @@ func TestFromPath(t *testing.T) {
 				---
 				names:
 				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
 				endpoints:
 				  http:
 				    network: tcp
@@ -157,6 +182,8 @@ func TestFromPath(t *testing.T) {
 				---
 				names:
 				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
 				endpoints:
 				  https:
 				    network: unix
@@ -164,11 +191,66 @@ func TestFromPath(t *testing.T) {
 			wantError: `validate https endpoint: address must be set with "unix" network`,
 		},
 		{
-			name: "Missing defaultTLSCertificateSecret name",
+			name: "Missing names",
 			yaml: here.Doc(`
 				---
 			`),
-			wantError: "validate names: missing required names: defaultTLSCertificateSecret",
+			wantError: "validate names: missing required names: defaultTLSCertificateSecret, apiServingCertificateSecret, apiService",
+		},
+		{
+			name: "custom aggregated API server port",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
+				aggregatedAPIServerPort: 12345
+			`),
+			wantConfig: &Config{
+				APIGroupSuffix:          pointer.StringPtr("pinniped.dev"),
+				AggregatedAPIServerPort: pointer.Int64Ptr(12345),
+				Labels:                  map[string]string{},
+				NamesConfig: NamesConfigSpec{
+					DefaultTLSCertificateSecret: "my-secret-name",
+					APIServingCertificateSecret: "my-api-serving-cert-secret-name",
+					APIService:                  "my-api-service-name",
+				},
+				Endpoints: &Endpoints{
+					HTTPS: &Endpoint{
+						Network: "tcp",
+						Address: ":8443",
+					},
+					HTTP: &Endpoint{
+						Network: "tcp",
+						Address: ":8080",
+					},
+				},
+			},
+		},
+		{
+			name: "aggregated API server port is too small",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
+				aggregatedAPIServerPort: 1023
+			`),
+			wantError: "validate aggregatedAPIServerPort: must be within range 1024 to 65535",
+		},
+		{
+			name: "aggregated API server port is too large",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
+				aggregatedAPIServerPort: 65536
+			`),
+			wantError: "validate aggregatedAPIServerPort: must be within range 1024 to 65535",
 		},
 		{
 			name: "apiGroupSuffix is prefixed with '.'",
@@ -177,9 +259,538 @@ func TestFromPath(t *testing.T) {
 				apiGroupSuffix: .starts.with.dot
 				names:
 				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
 			`),
 			wantError: "validate apiGroupSuffix: a lowercase RFC 1123 subdomain must consist of lower case alphanumeric characters, '-' or '.', and must start and end with an alphanumeric character (e.g. 'example.com', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?(\\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*')",
 		},
+
+		{
+			name: "token signer using pkcs11",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
+				tokenSigner:
+				  pkcs11:
+				    modulePath: /usr/lib/softhsm/libsofthsm2.so
+				    tokenLabel: my-token
+				    keyLabel: my-key
+				    pinFile: /etc/pinniped/pkcs11/pin
+			`),
+			wantConfig: &Config{
+				APIGroupSuffix:          pointer.StringPtr("pinniped.dev"),
+				AggregatedAPIServerPort: pointer.Int64Ptr(10250),
+				Labels:                  map[string]string{},
+				NamesConfig: NamesConfigSpec{
+					DefaultTLSCertificateSecret: "my-secret-name",
+					APIServingCertificateSecret: "my-api-serving-cert-secret-name",
+					APIService:                  "my-api-service-name",
+				},
+				Endpoints: &Endpoints{
+					HTTPS: &Endpoint{
+						Network: "tcp",
+						Address: ":8443",
+					},
+					HTTP: &Endpoint{
+						Network: "tcp",
+						Address: ":8080",
+					},
+				},
+				TokenSigner: &TokenSignerSpec{
+					PKCS11: &PKCS11SignerSpec{
+						ModulePath: "/usr/lib/softhsm/libsofthsm2.so",
+						TokenLabel: "my-token",
+						KeyLabel:   "my-key",
+						PINFile:    "/etc/pinniped/pkcs11/pin",
+					},
+				},
+			},
+		},
+		{
+			name: "token signer using a plugin defaults the timeout",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
+				tokenSigner:
+				  plugin:
+				    endpoint: unix:///var/run/signer/socket.sock
+			`),
+			wantConfig: &Config{
+				APIGroupSuffix:          pointer.StringPtr("pinniped.dev"),
+				AggregatedAPIServerPort: pointer.Int64Ptr(10250),
+				Labels:                  map[string]string{},
+				NamesConfig: NamesConfigSpec{
+					DefaultTLSCertificateSecret: "my-secret-name",
+					APIServingCertificateSecret: "my-api-serving-cert-secret-name",
+					APIService:                  "my-api-service-name",
+				},
+				Endpoints: &Endpoints{
+					HTTPS: &Endpoint{
+						Network: "tcp",
+						Address: ":8443",
+					},
+					HTTP: &Endpoint{
+						Network: "tcp",
+						Address: ":8080",
+					},
+				},
+				TokenSigner: &TokenSignerSpec{
+					Plugin: &PluginSignerSpec{
+						Endpoint:       "unix:///var/run/signer/socket.sock",
+						TimeoutSeconds: pointer.Int64Ptr(3),
+					},
+				},
+			},
+		},
+		{
+			name: "token signer without pkcs11 or plugin",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
+				tokenSigner: {}
+			`),
+			wantError: "validate tokenSigner: one of pkcs11 or plugin must be set",
+		},
+		{
+			name: "token signer with both pkcs11 and plugin",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
+				tokenSigner:
+				  pkcs11:
+				    modulePath: /usr/lib/softhsm/libsofthsm2.so
+				    tokenLabel: my-token
+				    keyLabel: my-key
+				    pinFile: /etc/pinniped/pkcs11/pin
+				  plugin:
+				    endpoint: unix:///var/run/signer/socket.sock
+			`),
+			wantError: "validate tokenSigner: only one of pkcs11 or plugin may be set",
+		},
+		{
+			name: "token signer using pkcs11 with missing fields",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
+				tokenSigner:
+				  pkcs11:
+				    modulePath: /usr/lib/softhsm/libsofthsm2.so
+			`),
+			wantError: "validate tokenSigner: missing required pkcs11 fields: tokenLabel, keyLabel, pinFile",
+		},
+		{
+			name: "token signer using a plugin which does not listen on a unix socket",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
+				tokenSigner:
+				  plugin:
+				    endpoint: tcp://127.0.0.1:1234
+			`),
+			wantError: `validate tokenSigner: plugin endpoint "tcp://127.0.0.1:1234" must start with "unix://"`,
+		},
+		{
+			name: "token signer using a plugin with a negative timeout",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
+				tokenSigner:
+				  plugin:
+				    endpoint: unix:///var/run/signer/socket.sock
+				    timeoutSeconds: -1
+			`),
+			wantError: "validate tokenSigner: plugin timeoutSeconds must be positive",
+		},
+		{
+			name: "session storage using sqlite",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
+				sessionStorage:
+				  sqlite:
+				    path: /var/lib/pinniped/sessions.db
+			`),
+			wantConfig: &Config{
+				APIGroupSuffix:          pointer.StringPtr("pinniped.dev"),
+				AggregatedAPIServerPort: pointer.Int64Ptr(10250),
+				Labels:                  map[string]string{},
+				NamesConfig: NamesConfigSpec{
+					DefaultTLSCertificateSecret: "my-secret-name",
+					APIServingCertificateSecret: "my-api-serving-cert-secret-name",
+					APIService:                  "my-api-service-name",
+				},
+				Endpoints: &Endpoints{
+					HTTPS: &Endpoint{
+						Network: "tcp",
+						Address: ":8443",
+					},
+					HTTP: &Endpoint{
+						Network: "tcp",
+						Address: ":8080",
+					},
+				},
+				SessionStorage: &SessionStorageSpec{
+					SQLite: &SQLiteSessionStorageSpec{
+						Path: "/var/lib/pinniped/sessions.db",
+					},
+				},
+			},
+		},
+		{
+			name: "session storage using postgres",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
+				sessionStorage:
+				  postgres:
+				    connectionStringFile: /etc/pinniped/postgres/connection-string
+			`),
+			wantConfig: &Config{
+				APIGroupSuffix:          pointer.StringPtr("pinniped.dev"),
+				AggregatedAPIServerPort: pointer.Int64Ptr(10250),
+				Labels:                  map[string]string{},
+				NamesConfig: NamesConfigSpec{
+					DefaultTLSCertificateSecret: "my-secret-name",
+					APIServingCertificateSecret: "my-api-serving-cert-secret-name",
+					APIService:                  "my-api-service-name",
+				},
+				Endpoints: &Endpoints{
+					HTTPS: &Endpoint{
+						Network: "tcp",
+						Address: ":8443",
+					},
+					HTTP: &Endpoint{
+						Network: "tcp",
+						Address: ":8080",
+					},
+				},
+				SessionStorage: &SessionStorageSpec{
+					Postgres: &PostgresSessionStorageSpec{
+						ConnectionStringFile: "/etc/pinniped/postgres/connection-string",
+					},
+				},
+			},
+		},
+		{
+			name: "session storage without sqlite or postgres",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
+				sessionStorage: {}
+			`),
+			wantError: "validate sessionStorage: one of sqlite or postgres must be set",
+		},
+		{
+			name: "session storage with both sqlite and postgres",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
+				sessionStorage:
+				  sqlite:
+				    path: /var/lib/pinniped/sessions.db
+				  postgres:
+				    connectionStringFile: /etc/pinniped/postgres/connection-string
+			`),
+			wantError: "validate sessionStorage: only one of sqlite or postgres may be set",
+		},
+		{
+			name: "session storage using sqlite without a path",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
+				sessionStorage:
+				  sqlite: {}
+			`),
+			wantError: "validate sessionStorage: sqlite path must be set",
+		},
+		{
+			name: "session storage using postgres without a connection string file",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
+				sessionStorage:
+				  postgres: {}
+			`),
+			wantError: "validate sessionStorage: postgres connectionStringFile must be set",
+		},
+		{
+			name: "session encryption using a kms defaults the timeout",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
+				sessionEncryption:
+				  kms:
+				    endpoint: unix:///var/run/kms/socket.sock
+			`),
+			wantConfig: &Config{
+				APIGroupSuffix:          pointer.StringPtr("pinniped.dev"),
+				AggregatedAPIServerPort: pointer.Int64Ptr(10250),
+				Labels:                  map[string]string{},
+				NamesConfig: NamesConfigSpec{
+					DefaultTLSCertificateSecret: "my-secret-name",
+					APIServingCertificateSecret: "my-api-serving-cert-secret-name",
+					APIService:                  "my-api-service-name",
+				},
+				Endpoints: &Endpoints{
+					HTTPS: &Endpoint{
+						Network: "tcp",
+						Address: ":8443",
+					},
+					HTTP: &Endpoint{
+						Network: "tcp",
+						Address: ":8080",
+					},
+				},
+				SessionEncryption: &SessionEncryptionSpec{
+					KMS: &KMSSessionEncryptionSpec{
+						Endpoint:       "unix:///var/run/kms/socket.sock",
+						TimeoutSeconds: pointer.Int64Ptr(3),
+					},
+				},
+			},
+		},
+		{
+			name: "session encryption without a kms",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
+				sessionEncryption: {}
+			`),
+			wantError: "validate sessionEncryption: kms must be set",
+		},
+		{
+			name: "session encryption using a kms which does not listen on a unix socket",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
+				sessionEncryption:
+				  kms:
+				    endpoint: tcp://kms.example.com:443
+			`),
+			wantError: `validate sessionEncryption: kms endpoint "tcp://kms.example.com:443" must start with "unix://"`,
+		},
+		{
+			name: "session encryption using a kms with a zero timeout",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
+				sessionEncryption:
+				  kms:
+				    endpoint: unix:///var/run/kms/socket.sock
+				    timeoutSeconds: 0
+			`),
+			wantError: "validate sessionEncryption: kms timeoutSeconds must be positive",
+		},
+		{
+			name: "audit sinks",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
+				audit:
+				  sinks:
+				  - stdout: {}
+				  - file:
+				      path: /var/log/pinniped/audit.log
+				  - webhook:
+				      url: https://audit.example.com/events
+				      caBundleFile: /etc/audit/ca.pem
+			`),
+			wantConfig: &Config{
+				APIGroupSuffix:          pointer.StringPtr("pinniped.dev"),
+				AggregatedAPIServerPort: pointer.Int64Ptr(10250),
+				Labels:                  map[string]string{},
+				NamesConfig: NamesConfigSpec{
+					DefaultTLSCertificateSecret: "my-secret-name",
+					APIServingCertificateSecret: "my-api-serving-cert-secret-name",
+					APIService:                  "my-api-service-name",
+				},
+				Endpoints: &Endpoints{
+					HTTPS: &Endpoint{
+						Network: "tcp",
+						Address: ":8443",
+					},
+					HTTP: &Endpoint{
+						Network: "tcp",
+						Address: ":8080",
+					},
+				},
+				Audit: &audit.Config{
+					Sinks: []audit.SinkConfig{
+						{Stdout: &audit.StdoutSinkConfig{}},
+						{File: &audit.FileSinkConfig{Path: "/var/log/pinniped/audit.log"}},
+						{Webhook: &audit.WebhookSinkConfig{URL: "https://audit.example.com/events", CABundleFile: "/etc/audit/ca.pem"}},
+					},
+				},
+			},
+		},
+		{
+			name: "audit sink without a type",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
+				audit:
+				  sinks:
+				  - {}
+			`),
+			wantError: "validate audit: sinks[0]: exactly one of stdout, file or webhook must be set",
+		},
+		{
+			name: "metrics",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
+				metrics:
+				  address: :9090
+			`),
+			wantConfig: &Config{
+				APIGroupSuffix:          pointer.StringPtr("pinniped.dev"),
+				AggregatedAPIServerPort: pointer.Int64Ptr(10250),
+				Labels:                  map[string]string{},
+				NamesConfig: NamesConfigSpec{
+					DefaultTLSCertificateSecret: "my-secret-name",
+					APIServingCertificateSecret: "my-api-serving-cert-secret-name",
+					APIService:                  "my-api-service-name",
+				},
+				Endpoints: &Endpoints{
+					HTTPS: &Endpoint{
+						Network: "tcp",
+						Address: ":8443",
+					},
+					HTTP: &Endpoint{
+						Network: "tcp",
+						Address: ":8080",
+					},
+				},
+				Metrics: &metrics.Config{Address: ":9090"},
+			},
+		},
+		{
+			name: "metrics address without a port",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
+				metrics:
+				  address: 127.0.0.1
+			`),
+			wantError: "validate metrics: address must be a host and a port, e.g. :9090",
+		},
+		{
+			name: "tracing",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
+				tracing:
+				  endpoint: otel-collector.observability.svc:4317
+				  caBundleFile: /etc/pinniped/tracing/ca.crt
+				  samplingRatePerMillion: 10000
+			`),
+			wantConfig: &Config{
+				APIGroupSuffix:          pointer.StringPtr("pinniped.dev"),
+				AggregatedAPIServerPort: pointer.Int64Ptr(10250),
+				Labels:                  map[string]string{},
+				NamesConfig: NamesConfigSpec{
+					DefaultTLSCertificateSecret: "my-secret-name",
+					APIServingCertificateSecret: "my-api-serving-cert-secret-name",
+					APIService:                  "my-api-service-name",
+				},
+				Endpoints: &Endpoints{
+					HTTPS: &Endpoint{
+						Network: "tcp",
+						Address: ":8443",
+					},
+					HTTP: &Endpoint{
+						Network: "tcp",
+						Address: ":8080",
+					},
+				},
+				Tracing: &tracing.Config{
+					Endpoint:               "otel-collector.observability.svc:4317",
+					CABundleFile:           "/etc/pinniped/tracing/ca.crt",
+					SamplingRatePerMillion: pointer.Int32Ptr(10000),
+				},
+			},
+		},
+		{
+			name: "tracing with an invalid sampling rate",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				  apiServingCertificateSecret: my-api-serving-cert-secret-name
+				  apiService: my-api-service-name
+				tracing:
+				  endpoint: localhost:4317
+				  insecure: true
+				  samplingRatePerMillion: 1000001
+			`),
+			wantError: "validate tracing: samplingRatePerMillion must be between 0 and 1000000",
+		},
 	}
 	for _, test := range tests {
 		test := test
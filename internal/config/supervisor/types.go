@@ -1,9 +1,14 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package supervisor
 
-import "go.pinniped.dev/internal/plog"
+import (
+	"go.pinniped.dev/internal/audit"
+	"go.pinniped.dev/internal/metrics"
+	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/tracing"
+)
 
 // Config contains knobs to setup an instance of the Pinniped Supervisor.
 type Config struct {
@@ -12,11 +17,44 @@ type Config struct {
 	NamesConfig    NamesConfigSpec   `json:"names"`
 	LogLevel       plog.LogLevel     `json:"logLevel"`
 	Endpoints      *Endpoints        `json:"endpoints"`
+
+	// AggregatedAPIServerPort is the port on which the aggregated API server of the Supervisor listens.
+	AggregatedAPIServerPort *int64 `json:"aggregatedAPIServerPort"`
+
+	// AllowReservedUsernamesAndGroups disables the safeguard which rejects authentication when the downstream
+	// username or any of the downstream groups begin with a prefix which is reserved by Kubernetes, e.g. "system:".
+	AllowReservedUsernamesAndGroups bool `json:"allowReservedUsernamesAndGroups"`
+
+	// TokenSigner configures an external signer which holds the private key used to sign the tokens issued by all
+	// FederationDomains. When it is not set, each FederationDomain signs with private keys which are stored in a Secret.
+	TokenSigner *TokenSignerSpec `json:"tokenSigner,omitempty"`
+
+	// SessionStorage configures where the downstream sessions (authorization codes, access tokens, refresh tokens,
+	// etc.) are stored. When it is not set, each session is stored in a Secret in the Supervisor's namespace.
+	SessionStorage *SessionStorageSpec `json:"sessionStorage,omitempty"`
+
+	// SessionEncryption configures a KMS which encrypts the keys that encrypt the downstream sessions stored in
+	// Secrets. When it is not set, the keys are stored unencrypted in a Secret for each FederationDomain.
+	SessionEncryption *SessionEncryptionSpec `json:"sessionEncryption,omitempty"`
+
+	// Audit configures the sinks of the audit log of the authentication events. When it is not set, no audit
+	// events are recorded.
+	Audit *audit.Config `json:"audit,omitempty"`
+
+	// Metrics configures the listener of the Prometheus metrics endpoint. When it is not set, the metrics are
+	// not served.
+	Metrics *metrics.Config `json:"metrics,omitempty"`
+
+	// Tracing configures the export of the traces of the login flows to an OpenTelemetry collector. When it is not
+	// set, nothing is traced.
+	Tracing *tracing.Config `json:"tracing,omitempty"`
 }
 
 // NamesConfigSpec configures the names of some Kubernetes resources for the Supervisor.
 type NamesConfigSpec struct {
 	DefaultTLSCertificateSecret string `json:"defaultTLSCertificateSecret"`
+	APIServingCertificateSecret string `json:"apiServingCertificateSecret"`
+	APIService                  string `json:"apiService"`
 }
 
 type Endpoints struct {
@@ -28,3 +66,63 @@ type Endpoint struct {
 	Network string `json:"network"`
 	Address string `json:"address"`
 }
+
+// TokenSignerSpec configures an external signer. Exactly one of its fields must be set.
+type TokenSignerSpec struct {
+	PKCS11 *PKCS11SignerSpec `json:"pkcs11,omitempty"`
+	Plugin *PluginSignerSpec `json:"plugin,omitempty"`
+}
+
+// PKCS11SignerSpec configures a signer which uses an ECDSA P-256 private key held by a PKCS#11 token, e.g. an HSM.
+type PKCS11SignerSpec struct {
+	// ModulePath is the path to the PKCS#11 module (shared library) of the token's vendor.
+	ModulePath string `json:"modulePath"`
+	// TokenLabel is the label of the token which holds the key.
+	TokenLabel string `json:"tokenLabel"`
+	// KeyLabel is the label of the private key and of its public key.
+	KeyLabel string `json:"keyLabel"`
+	// PINFile is the path to a file which contains the user PIN of the token, e.g. a file mounted from a Secret.
+	PINFile string `json:"pinFile"`
+}
+
+// PluginSignerSpec configures a signer which sends signing requests to a gRPC plugin.
+type PluginSignerSpec struct {
+	// Endpoint is the unix domain socket on which the plugin listens, e.g. unix:///var/run/signer/socket.sock.
+	Endpoint string `json:"endpoint"`
+	// TimeoutSeconds is the maximum duration, in seconds, of each call to the plugin. Defaults to 3.
+	TimeoutSeconds *int64 `json:"timeoutSeconds,omitempty"`
+}
+
+// SessionStorageSpec configures a SQL database for the downstream sessions. Exactly one of its fields must be set.
+type SessionStorageSpec struct {
+	SQLite   *SQLiteSessionStorageSpec   `json:"sqlite,omitempty"`
+	Postgres *PostgresSessionStorageSpec `json:"postgres,omitempty"`
+}
+
+// SQLiteSessionStorageSpec configures a SQLite database file. It may only be used with a single Supervisor replica.
+type SQLiteSessionStorageSpec struct {
+	// Path is the path to the database file, e.g. on a persistent volume. It is created when it does not exist.
+	Path string `json:"path"`
+}
+
+// PostgresSessionStorageSpec configures a PostgreSQL (or PostgreSQL-compatible) database, which may be shared by
+// several Supervisor replicas.
+type PostgresSessionStorageSpec struct {
+	// ConnectionStringFile is the path to a file which contains the connection string of the database, e.g. a file
+	// mounted from a Secret, because the connection string usually contains a password.
+	ConnectionStringFile string `json:"connectionStringFile"`
+}
+
+// SessionEncryptionSpec configures how the session encryption keys of the FederationDomains are protected.
+type SessionEncryptionSpec struct {
+	KMS *KMSSessionEncryptionSpec `json:"kms,omitempty"`
+}
+
+// KMSSessionEncryptionSpec configures a KMS plugin which implements the Kubernetes KMS plugin API (v1beta1), so any
+// KMS plugin which can be used to encrypt Kubernetes Secrets can also be used by the Supervisor.
+type KMSSessionEncryptionSpec struct {
+	// Endpoint is the unix domain socket on which the plugin listens, e.g. unix:///var/run/kms/socket.sock.
+	Endpoint string `json:"endpoint"`
+	// TimeoutSeconds is the maximum duration, in seconds, of each call to the plugin. Defaults to 3.
+	TimeoutSeconds *int64 `json:"timeoutSeconds,omitempty"`
+}
@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 // Package authncache implements a cache of active authenticators.
@@ -15,6 +15,7 @@ import (
 
 	loginapi "go.pinniped.dev/generated/latest/apis/concierge/login"
 	"go.pinniped.dev/internal/constable"
+	"go.pinniped.dev/internal/metrics"
 	"go.pinniped.dev/internal/plog"
 	"go.pinniped.dev/internal/valuelesscontext"
 )
@@ -90,6 +91,7 @@ func (c *Cache) AuthenticateTokenCredentialRequest(ctx context.Context, req *log
 	}
 
 	val := c.Get(key)
+	metrics.RecordAuthenticatorCacheLookup(val != nil)
 	if val == nil {
 		plog.Debug(
 			"authenticator does not exist",
@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 // Package jwtcachefiller implements a controller for filling an authncache.Cache with each
@@ -48,6 +48,11 @@ func defaultSupportedSigningAlgos() []string {
 		// ES256 is what the Supervisor does, by default. We want integration with the JWTAuthenticator
 		// to be as seamless as possible, so we include this algorithm by default.
 		string(jose.ES256),
+		// These are the other algorithms which a FederationDomain may be configured to use, and which are also
+		// supported by the Kubernetes OIDC token authenticator. Note that EdDSA is not supported by it.
+		string(jose.RS384),
+		string(jose.PS256),
+		string(jose.ES384),
 	}
 }
 
@@ -609,11 +609,11 @@ func testTableForAuthenticateTokenTests(
 			name: "signing algo is unsupported",
 			jwtSignature: func(key *interface{}, algo *jose.SignatureAlgorithm, kid *string) {
 				var err error
-				*key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+				*key, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
 				require.NoError(t, err)
-				*algo = jose.ES384
+				*algo = jose.ES512
 			},
-			wantErrorRegexp: `oidc: verify token: oidc: id token signed with unsupported algorithm, expected \["RS256" "ES256"\] got "ES384"`,
+			wantErrorRegexp: `oidc: verify token: oidc: id token signed with unsupported algorithm, expected \["RS256" "ES256" "RS384" "PS256" "ES384"\] got "ES512"`,
 		},
 	}
 
@@ -227,6 +227,7 @@ type UpstreamActiveDirectoryIdentityProviderICache interface {
 type activeDirectoryWatcherController struct {
 	cache                                   UpstreamActiveDirectoryIdentityProviderICache
 	validatedSettingsCache                  upstreamwatchers.ValidatedSettingsCacheI
+	hostPools                               *upstreamldap.HostPools
 	ldapDialer                              upstreamldap.LDAPDialer
 	client                                  pinnipedclientset.Interface
 	activeDirectoryIdentityProviderInformer idpinformers.ActiveDirectoryIdentityProviderInformer
@@ -245,6 +246,8 @@ func New(
 		idpCache,
 		// start with an empty cache
 		upstreamwatchers.NewValidatedSettingsCache(),
+		// start with no known hosts, which are shared by all the providers created by this controller
+		upstreamldap.NewHostPools(),
 		// nil means to use a real production dialer when creating objects to add to the cache
 		nil,
 		client,
@@ -258,6 +261,7 @@ func New(
 func newInternal(
 	idpCache UpstreamActiveDirectoryIdentityProviderICache,
 	validatedSettingsCache upstreamwatchers.ValidatedSettingsCacheI,
+	hostPools *upstreamldap.HostPools,
 	ldapDialer upstreamldap.LDAPDialer,
 	client pinnipedclientset.Interface,
 	activeDirectoryIdentityProviderInformer idpinformers.ActiveDirectoryIdentityProviderInformer,
@@ -267,6 +271,7 @@ func newInternal(
 	c := activeDirectoryWatcherController{
 		cache:                                   idpCache,
 		validatedSettingsCache:                  validatedSettingsCache,
+		hostPools:                               hostPools,
 		ldapDialer:                              ldapDialer,
 		client:                                  client,
 		activeDirectoryIdentityProviderInformer: activeDirectoryIdentityProviderInformer,
@@ -320,9 +325,12 @@ func (c *activeDirectoryWatcherController) validateUpstream(ctx context.Context,
 	adUpstreamImpl := &activeDirectoryUpstreamGenericLDAPImpl{activeDirectoryIdentityProvider: *upstream}
 
 	config := &upstreamldap.ProviderConfig{
-		Name:        upstream.Name,
-		ResourceUID: upstream.UID,
-		Host:        spec.Host,
+		Name:            upstream.Name,
+		ResourceUID:     upstream.UID,
+		Host:            spec.Host,
+		AdditionalHosts: spec.AdditionalHosts,
+		SRVDomain:       spec.SRVLookupDomain,
+		LoadBalancing:   upstreamldap.LoadBalancing(spec.LoadBalancing),
 		UserSearch: upstreamldap.UserSearchConfig{
 			Base:              spec.UserSearch.Base,
 			Filter:            adUpstreamImpl.Spec().UserSearch().Filter(),
@@ -333,8 +341,10 @@ func (c *activeDirectoryWatcherController) validateUpstream(ctx context.Context,
 			Base:               spec.GroupSearch.Base,
 			Filter:             adUpstreamImpl.Spec().GroupSearch().Filter(),
 			GroupNameAttribute: adUpstreamImpl.Spec().GroupSearch().GroupNameAttribute(),
+			SkipGroupRefresh:   spec.GroupSearch.SkipGroupRefresh,
 		},
-		Dialer: c.ldapDialer,
+		HostPools: c.hostPools,
+		Dialer:    c.ldapDialer,
 		UIDAttributeParsingOverrides: map[string]func(*ldap.Entry) (string, error){
 			"objectGUID": microsoftUUIDFromBinaryAttr("objectGUID"),
 		},
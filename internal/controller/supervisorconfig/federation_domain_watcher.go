@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"net/url"
 	"strings"
+	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
@@ -21,8 +22,10 @@ import (
 	configinformers "go.pinniped.dev/generated/latest/client/supervisor/informers/externalversions/config/v1alpha1"
 	pinnipedcontroller "go.pinniped.dev/internal/controller"
 	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/idtransform"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/psession"
 )
 
 // ProvidersSetter can be notified of all known valid providers with its SetIssuer function.
@@ -34,6 +37,7 @@ type ProvidersSetter interface {
 
 type federationDomainWatcherController struct {
 	providerSetter           ProvidersSetter
+	usesExternalSigner       bool
 	clock                    clock.Clock
 	client                   pinnipedclientset.Interface
 	federationDomainInformer configinformers.FederationDomainInformer
@@ -41,8 +45,11 @@ type federationDomainWatcherController struct {
 
 // NewFederationDomainWatcherController creates a controllerlib.Controller that watches
 // FederationDomain objects and notifies a callback object of the collection of provider configs.
+// When usesExternalSigner is true, the FederationDomains which configure a signing algorithm that the external signer
+// cannot use are invalid.
 func NewFederationDomainWatcherController(
 	providerSetter ProvidersSetter,
+	usesExternalSigner bool,
 	clock clock.Clock,
 	client pinnipedclientset.Interface,
 	federationDomainInformer configinformers.FederationDomainInformer,
@@ -53,6 +60,7 @@ func NewFederationDomainWatcherController(
 			Name: "FederationDomainWatcherController",
 			Syncer: &federationDomainWatcherController{
 				providerSetter:           providerSetter,
+				usesExternalSigner:       usesExternalSigner,
 				clock:                    clock,
 				client:                   client,
 				federationDomainInformer: federationDomainInformer,
@@ -143,7 +151,19 @@ func (c *federationDomainWatcherController) Sync(ctx controllerlib.Context) erro
 			continue
 		}
 
-		federationDomainIssuer, err := provider.NewFederationDomainIssuer(federationDomain.Spec.Issuer) // This validates the Issuer URL.
+		var federationDomainIssuer *provider.FederationDomainIssuer
+		identityProviders, err := federationDomainIdentityProviders(federationDomain.Spec.IdentityProviders)
+		if err == nil && c.usesExternalSigner {
+			err = validateSigningAlgorithmForExternalSigner(federationDomain.Spec.SigningKeys)
+		}
+		if err == nil {
+			federationDomainIssuer, err = provider.NewFederationDomainIssuer(
+				federationDomain.Spec.Issuer, // This validates the Issuer URL.
+				identityProviders,
+				federationDomainTokenLifespans(federationDomain.Spec.Tokens), // This validates the lifespans.
+				federationDomain.Spec.UserInfo.PassthroughClaims,             // This validates the claim names.
+			)
+		}
 		if err != nil {
 			if err := c.updateStatus(
 				ctx.Context,
@@ -176,6 +196,115 @@ func (c *federationDomainWatcherController) Sync(ctx controllerlib.Context) erro
 	return errors.NewAggregate(errs)
 }
 
+// validateSigningAlgorithmForExternalSigner rejects the signing algorithms other than ES256, since the external
+// signer which signs the tokens of every FederationDomain always signs ES256 tokens.
+func validateSigningAlgorithmForExternalSigner(spec configv1alpha1.FederationDomainSigningKeysSpec) error {
+	if spec.Algorithm != "" && spec.Algorithm != configv1alpha1.ES256FederationDomainSigningAlgorithm {
+		return fmt.Errorf("signingKeys.algorithm must be ES256 when the Supervisor uses an external signer, but it is %s", spec.Algorithm)
+	}
+	return nil
+}
+
+// federationDomainIdentityProviders converts the identity providers from a FederationDomain's spec. It returns nil
+// when the spec does not list any, which allows the FederationDomain to use all identity providers.
+func federationDomainIdentityProviders(specIDPs []configv1alpha1.FederationDomainIdentityProvider) ([]provider.FederationDomainIdentityProvider, error) {
+	if len(specIDPs) == 0 {
+		return nil, nil
+	}
+	idps := make([]provider.FederationDomainIdentityProvider, 0, len(specIDPs))
+	for _, specIDP := range specIDPs {
+		var idpType psession.ProviderType
+		switch specIDP.Kind {
+		case configv1alpha1.OIDCIdentityProviderKind:
+			idpType = psession.ProviderTypeOIDC
+		case configv1alpha1.LDAPIdentityProviderKind:
+			idpType = psession.ProviderTypeLDAP
+		case configv1alpha1.ActiveDirectoryIdentityProviderKind:
+			idpType = psession.ProviderTypeActiveDirectory
+		default:
+			// The CRD's enum validation should prevent this, but skip unknown kinds just in case.
+			plog.Warning("ignoring identity provider with unknown kind", "kind", specIDP.Kind, "name", specIDP.Name)
+			continue
+		}
+		transforms, err := identityTransformationPipeline(specIDP.Transforms)
+		if err != nil {
+			return nil, fmt.Errorf("identity provider %q of kind %q has invalid transforms: %w", specIDP.Name, specIDP.Kind, err)
+		}
+		idps = append(idps, provider.FederationDomainIdentityProvider{Name: specIDP.Name, Type: idpType, Transforms: transforms})
+	}
+	return idps, nil
+}
+
+// federationDomainTokenLifespans converts the token lifespans and session limits from a FederationDomain's spec.
+// Omitted settings are left as zero, which means that the defaults will be used.
+func federationDomainTokenLifespans(spec configv1alpha1.FederationDomainTokensSpec) provider.TokenLifespans {
+	duration := func(d *metav1.Duration) time.Duration {
+		if d == nil {
+			return 0
+		}
+		return d.Duration
+	}
+	lifespans := provider.TokenLifespans{
+		AccessToken:   duration(spec.AccessTokenLifespan),
+		IDToken:       duration(spec.IDTokenLifespan),
+		RefreshToken:  duration(spec.RefreshTokenLifespan),
+		UpstreamState: duration(spec.UpstreamStateLifespan),
+
+		SessionIdleTimeout: duration(spec.SessionIdleTimeout),
+		MaxSessionLength:   duration(spec.MaxSessionLength),
+
+		RejectNewLoginOverSessionLimit: spec.ConcurrentSessionLimitAction == configv1alpha1.RejectNewLoginFederationDomainConcurrentSessionLimitAction,
+	}
+	if spec.MaxConcurrentSessions != nil {
+		lifespans.MaxConcurrentSessions = int(*spec.MaxConcurrentSessions)
+	}
+	return lifespans
+}
+
+// identityTransformationPipeline builds a pipeline from the transforms in a FederationDomain's spec.
+func identityTransformationPipeline(specTransforms []configv1alpha1.FederationDomainTransform) (*idtransform.TransformationPipeline, error) {
+	pipeline := idtransform.NewTransformationPipeline()
+	for i, specTransform := range specTransforms {
+		var transforms []idtransform.IdentityTransformation
+		if t := specTransform.UsernamePrefix; t != nil {
+			transforms = append(transforms, idtransform.NewUsernamePrefixTransformation(t.Prefix))
+		}
+		if t := specTransform.UsernameRename; t != nil {
+			transform, err := idtransform.NewUsernameRenameTransformation(t.Regex, t.Replacement)
+			if err != nil {
+				return nil, fmt.Errorf("transform at index %d: %w", i, err)
+			}
+			transforms = append(transforms, transform)
+		}
+		if t := specTransform.GroupsMap; t != nil {
+			mappings := make(map[string]string, len(t.Mappings))
+			for _, mapping := range t.Mappings {
+				mappings[mapping.From] = mapping.To
+			}
+			transforms = append(transforms, idtransform.NewGroupsMapTransformation(mappings))
+		}
+		if t := specTransform.GroupsFilter; t != nil {
+			transform, err := idtransform.NewGroupsFilterTransformation(t.Regex, t.Exclude)
+			if err != nil {
+				return nil, fmt.Errorf("transform at index %d: %w", i, err)
+			}
+			transforms = append(transforms, transform)
+		}
+		if t := specTransform.Reject; t != nil {
+			transform, err := idtransform.NewRejectPolicy(t.UsernameRegex, t.GroupsRegex, t.Message)
+			if err != nil {
+				return nil, fmt.Errorf("transform at index %d: %w", i, err)
+			}
+			transforms = append(transforms, transform)
+		}
+		if len(transforms) != 1 {
+			return nil, fmt.Errorf("transform at index %d must specify exactly one type of transform", i)
+		}
+		pipeline.AppendTransformation(transforms[0])
+	}
+	return pipeline, nil
+}
+
 func (c *federationDomainWatcherController) updateStatus(
 	ctx context.Context,
 	namespace, name string,
@@ -28,7 +28,9 @@ import (
 	pinnipedinformers "go.pinniped.dev/generated/latest/client/supervisor/informers/externalversions"
 	"go.pinniped.dev/internal/controllerlib"
 	"go.pinniped.dev/internal/here"
+	"go.pinniped.dev/internal/idtransform"
 	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/psession"
 	"go.pinniped.dev/internal/testutil"
 )
 
@@ -44,6 +46,7 @@ func TestInformerFilters(t *testing.T) {
 			federationDomainInformer := pinnipedinformers.NewSharedInformerFactoryWithOptions(nil, 0).Config().V1alpha1().FederationDomains()
 			_ = NewFederationDomainWatcherController(
 				nil,
+				false,
 				nil,
 				nil,
 				federationDomainInformer,
@@ -108,6 +111,7 @@ func TestSync(t *testing.T) {
 		var syncContext *controllerlib.Context
 		var frozenNow time.Time
 		var providersSetter *fakeProvidersSetter
+		var usesExternalSigner bool
 		var federationDomainGVR schema.GroupVersionResource
 
 		// Defer starting the informers until the last possible moment so that the
@@ -116,6 +120,7 @@ func TestSync(t *testing.T) {
 			// Set this at the last second to allow for injection of server override.
 			subject = NewFederationDomainWatcherController(
 				providersSetter,
+				usesExternalSigner,
 				clocktesting.NewFakeClock(frozenNow),
 				pinnipedAPIClient,
 				federationDomainInformers.Config().V1alpha1().FederationDomains(),
@@ -141,6 +146,7 @@ func TestSync(t *testing.T) {
 			r = require.New(t)
 
 			providersSetter = &fakeProvidersSetter{}
+			usesExternalSigner = false
 			frozenNow = time.Date(2020, time.September, 23, 7, 42, 0, 0, time.Local)
 
 			cancelContext, cancelContextCancelFunc = context.WithCancel(context.Background())
@@ -187,10 +193,10 @@ func TestSync(t *testing.T) {
 				err := controllerlib.TestSync(t, subject, *syncContext)
 				r.NoError(err)
 
-				provider1, err := provider.NewFederationDomainIssuer(federationDomain1.Spec.Issuer)
+				provider1, err := provider.NewFederationDomainIssuer(federationDomain1.Spec.Issuer, nil, provider.TokenLifespans{}, nil)
 				r.NoError(err)
 
-				provider2, err := provider.NewFederationDomainIssuer(federationDomain2.Spec.Issuer)
+				provider2, err := provider.NewFederationDomainIssuer(federationDomain2.Spec.Issuer, nil, provider.TokenLifespans{}, nil)
 				r.NoError(err)
 
 				r.True(providersSetter.SetProvidersWasCalled)
@@ -288,10 +294,10 @@ func TestSync(t *testing.T) {
 					err := controllerlib.TestSync(t, subject, *syncContext)
 					r.NoError(err)
 
-					provider1, err := provider.NewFederationDomainIssuer(federationDomain1.Spec.Issuer)
+					provider1, err := provider.NewFederationDomainIssuer(federationDomain1.Spec.Issuer, nil, provider.TokenLifespans{}, nil)
 					r.NoError(err)
 
-					provider2, err := provider.NewFederationDomainIssuer(federationDomain2.Spec.Issuer)
+					provider2, err := provider.NewFederationDomainIssuer(federationDomain2.Spec.Issuer, nil, provider.TokenLifespans{}, nil)
 					r.NoError(err)
 
 					r.True(providersSetter.SetProvidersWasCalled)
@@ -326,10 +332,10 @@ func TestSync(t *testing.T) {
 					err := controllerlib.TestSync(t, subject, *syncContext)
 					r.EqualError(err, "could not update status: some update error")
 
-					provider1, err := provider.NewFederationDomainIssuer(federationDomain1.Spec.Issuer)
+					provider1, err := provider.NewFederationDomainIssuer(federationDomain1.Spec.Issuer, nil, provider.TokenLifespans{}, nil)
 					r.NoError(err)
 
-					provider2, err := provider.NewFederationDomainIssuer(federationDomain2.Spec.Issuer)
+					provider2, err := provider.NewFederationDomainIssuer(federationDomain2.Spec.Issuer, nil, provider.TokenLifespans{}, nil)
 					r.NoError(err)
 
 					r.True(providersSetter.SetProvidersWasCalled)
@@ -545,7 +551,7 @@ func TestSync(t *testing.T) {
 				err := controllerlib.TestSync(t, subject, *syncContext)
 				r.NoError(err)
 
-				validProvider, err := provider.NewFederationDomainIssuer(validFederationDomain.Spec.Issuer)
+				validProvider, err := provider.NewFederationDomainIssuer(validFederationDomain.Spec.Issuer, nil, provider.TokenLifespans{}, nil)
 				r.NoError(err)
 
 				r.True(providersSetter.SetProvidersWasCalled)
@@ -619,7 +625,7 @@ func TestSync(t *testing.T) {
 					err := controllerlib.TestSync(t, subject, *syncContext)
 					r.EqualError(err, "could not update status: some update error")
 
-					validProvider, err := provider.NewFederationDomainIssuer(validFederationDomain.Spec.Issuer)
+					validProvider, err := provider.NewFederationDomainIssuer(validFederationDomain.Spec.Issuer, nil, provider.TokenLifespans{}, nil)
 					r.NoError(err)
 
 					r.True(providersSetter.SetProvidersWasCalled)
@@ -709,7 +715,7 @@ func TestSync(t *testing.T) {
 				err := controllerlib.TestSync(t, subject, *syncContext)
 				r.NoError(err)
 
-				nonDuplicateProvider, err := provider.NewFederationDomainIssuer(federationDomain.Spec.Issuer)
+				nonDuplicateProvider, err := provider.NewFederationDomainIssuer(federationDomain.Spec.Issuer, nil, provider.TokenLifespans{}, nil)
 				r.NoError(err)
 
 				r.True(providersSetter.SetProvidersWasCalled)
@@ -882,7 +888,7 @@ func TestSync(t *testing.T) {
 				err := controllerlib.TestSync(t, subject, *syncContext)
 				r.NoError(err)
 
-				nonDuplicateProvider, err := provider.NewFederationDomainIssuer(federationDomainDifferentIssuerAddress.Spec.Issuer)
+				nonDuplicateProvider, err := provider.NewFederationDomainIssuer(federationDomainDifferentIssuerAddress.Spec.Issuer, nil, provider.TokenLifespans{}, nil)
 				r.NoError(err)
 
 				r.True(providersSetter.SetProvidersWasCalled)
@@ -1014,6 +1020,319 @@ func TestSync(t *testing.T) {
 			})
 		})
 
+		when("there is a FederationDomain which lists its identity providers", func() {
+			var federationDomain *v1alpha1.FederationDomain
+
+			it.Before(func() {
+				federationDomain = &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: namespace},
+					Spec: v1alpha1.FederationDomainSpec{
+						Issuer: "https://issuer.com",
+						IdentityProviders: []v1alpha1.FederationDomainIdentityProvider{
+							{Kind: v1alpha1.OIDCIdentityProviderKind, Name: "some-oidc-idp"},
+							{Kind: v1alpha1.LDAPIdentityProviderKind, Name: "some-ldap-idp"},
+							{Kind: v1alpha1.ActiveDirectoryIdentityProviderKind, Name: "some-ad-idp"},
+							{Kind: "UnknownIdentityProvider", Name: "some-unknown-idp"},
+						},
+					},
+				}
+				r.NoError(pinnipedAPIClient.Tracker().Add(federationDomain))
+				r.NoError(federationDomainInformerClient.Tracker().Add(federationDomain))
+			})
+
+			it("calls the ProvidersSetter with the identity providers of known kinds", func() {
+				startInformersAndController()
+				err := controllerlib.TestSync(t, subject, *syncContext)
+				r.NoError(err)
+
+				expectedProvider, err := provider.NewFederationDomainIssuer(federationDomain.Spec.Issuer, []provider.FederationDomainIdentityProvider{
+					{Name: "some-oidc-idp", Type: psession.ProviderTypeOIDC, Transforms: idtransform.NewTransformationPipeline()},
+					{Name: "some-ldap-idp", Type: psession.ProviderTypeLDAP, Transforms: idtransform.NewTransformationPipeline()},
+					{Name: "some-ad-idp", Type: psession.ProviderTypeActiveDirectory, Transforms: idtransform.NewTransformationPipeline()},
+				}, provider.TokenLifespans{}, nil)
+				r.NoError(err)
+
+				r.True(providersSetter.SetProvidersWasCalled)
+				r.Equal([]*provider.FederationDomainIssuer{expectedProvider}, providersSetter.FederationDomainsReceived)
+			})
+		})
+
+		when("there is a FederationDomain which lists only identity providers of unknown kinds", func() {
+			it.Before(func() {
+				federationDomain := &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: namespace},
+					Spec: v1alpha1.FederationDomainSpec{
+						Issuer: "https://issuer.com",
+						IdentityProviders: []v1alpha1.FederationDomainIdentityProvider{
+							{Kind: "UnknownIdentityProvider", Name: "some-unknown-idp"},
+						},
+					},
+				}
+				r.NoError(pinnipedAPIClient.Tracker().Add(federationDomain))
+				r.NoError(federationDomainInformerClient.Tracker().Add(federationDomain))
+			})
+
+			it("does not allow the FederationDomain to use all identity providers", func() {
+				startInformersAndController()
+				err := controllerlib.TestSync(t, subject, *syncContext)
+				r.NoError(err)
+
+				r.True(providersSetter.SetProvidersWasCalled)
+				r.Len(providersSetter.FederationDomainsReceived, 1)
+				r.NotNil(providersSetter.FederationDomainsReceived[0].IdentityProviders())
+				r.Empty(providersSetter.FederationDomainsReceived[0].IdentityProviders())
+			})
+		})
+
+		when("there is a FederationDomain which configures identity transforms", func() {
+			it.Before(func() {
+				federationDomain := &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: namespace},
+					Spec: v1alpha1.FederationDomainSpec{
+						Issuer: "https://issuer.com",
+						IdentityProviders: []v1alpha1.FederationDomainIdentityProvider{
+							{
+								Kind: v1alpha1.LDAPIdentityProviderKind,
+								Name: "some-ldap-idp",
+								Transforms: []v1alpha1.FederationDomainTransform{
+									{UsernameRename: &v1alpha1.FederationDomainUsernameRenameTransform{Regex: `@example\.com$`}},
+									{UsernamePrefix: &v1alpha1.FederationDomainUsernamePrefixTransform{Prefix: "ldap:"}},
+									{GroupsMap: &v1alpha1.FederationDomainGroupsMapTransform{Mappings: []v1alpha1.FederationDomainGroupMapping{{From: "admins", To: "cluster-admins"}}}},
+									{GroupsFilter: &v1alpha1.FederationDomainGroupsFilterTransform{Regex: `^cluster-`}},
+									{Reject: &v1alpha1.FederationDomainRejectPolicy{UsernameRegex: `^ldap:blocked$`, Message: "blocked"}},
+								},
+							},
+						},
+					},
+				}
+				r.NoError(pinnipedAPIClient.Tracker().Add(federationDomain))
+				r.NoError(federationDomainInformerClient.Tracker().Add(federationDomain))
+			})
+
+			it("calls the ProvidersSetter with the transforms for the identity provider", func() {
+				startInformersAndController()
+				err := controllerlib.TestSync(t, subject, *syncContext)
+				r.NoError(err)
+
+				r.True(providersSetter.SetProvidersWasCalled)
+				r.Len(providersSetter.FederationDomainsReceived, 1)
+				transforms := providersSetter.FederationDomainsReceived[0].IdentityTransforms("some-ldap-idp", psession.ProviderTypeLDAP)
+
+				result, err := transforms.Evaluate("ryan@example.com", []string{"admins", "developers", "cluster-viewers"})
+				r.NoError(err)
+				r.Equal(&idtransform.TransformationResult{
+					Username:              "ldap:ryan",
+					Groups:                []string{"cluster-admins", "cluster-viewers"},
+					AuthenticationAllowed: true,
+				}, result)
+
+				result, err = transforms.Evaluate("blocked", nil)
+				r.NoError(err)
+				r.False(result.AuthenticationAllowed)
+				r.Equal("blocked", result.RejectedAuthenticationMessage)
+			})
+		})
+
+		when("there is a FederationDomain which configures invalid identity transforms", func() {
+			var federationDomain *v1alpha1.FederationDomain
+
+			it.Before(func() {
+				federationDomain = &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: namespace},
+					Spec: v1alpha1.FederationDomainSpec{
+						Issuer: "https://issuer.com",
+						IdentityProviders: []v1alpha1.FederationDomainIdentityProvider{
+							{
+								Kind: v1alpha1.OIDCIdentityProviderKind,
+								Name: "some-oidc-idp",
+								Transforms: []v1alpha1.FederationDomainTransform{
+									{UsernamePrefix: &v1alpha1.FederationDomainUsernamePrefixTransform{Prefix: "oidc:"}},
+									{
+										UsernamePrefix: &v1alpha1.FederationDomainUsernamePrefixTransform{Prefix: "oidc:"},
+										GroupsFilter:   &v1alpha1.FederationDomainGroupsFilterTransform{Regex: "^a"},
+									},
+								},
+							},
+						},
+					},
+				}
+				r.NoError(pinnipedAPIClient.Tracker().Add(federationDomain))
+				r.NoError(federationDomainInformerClient.Tracker().Add(federationDomain))
+			})
+
+			it("does not call the ProvidersSetter with the FederationDomain and updates its status to invalid", func() {
+				startInformersAndController()
+				err := controllerlib.TestSync(t, subject, *syncContext)
+				r.NoError(err)
+
+				r.True(providersSetter.SetProvidersWasCalled)
+				r.Empty(providersSetter.FederationDomainsReceived)
+
+				federationDomain.Status.Status = v1alpha1.InvalidFederationDomainStatusCondition
+				federationDomain.Status.Message = `Invalid: identity provider "some-oidc-idp" of kind "OIDCIdentityProvider" has invalid transforms: ` +
+					"transform at index 1 must specify exactly one type of transform"
+				federationDomain.Status.LastUpdateTime = timePtr(metav1.NewTime(frozenNow))
+
+				expectedActions := []coretesting.Action{
+					coretesting.NewGetAction(
+						federationDomainGVR,
+						federationDomain.Namespace,
+						federationDomain.Name,
+					),
+					coretesting.NewUpdateSubresourceAction(
+						federationDomainGVR,
+						"status",
+						federationDomain.Namespace,
+						federationDomain,
+					),
+				}
+				r.Equal(expectedActions, pinnipedAPIClient.Actions())
+			})
+		})
+
+		when("there is a FederationDomain which configures token lifespans", func() {
+			var federationDomain *v1alpha1.FederationDomain
+
+			it.Before(func() {
+				maxConcurrentSessions := int32(3)
+				federationDomain = &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: namespace},
+					Spec: v1alpha1.FederationDomainSpec{
+						Issuer: "https://issuer.com",
+						Tokens: v1alpha1.FederationDomainTokensSpec{
+							AccessTokenLifespan:          &metav1.Duration{Duration: 5 * time.Minute},
+							RefreshTokenLifespan:         &metav1.Duration{Duration: 24 * time.Hour},
+							UpstreamStateLifespan:        &metav1.Duration{Duration: 30 * time.Minute},
+							MaxConcurrentSessions:        &maxConcurrentSessions,
+							ConcurrentSessionLimitAction: v1alpha1.RejectNewLoginFederationDomainConcurrentSessionLimitAction,
+						},
+						UserInfo: v1alpha1.FederationDomainUserInfoSpec{
+							PassthroughClaims: []string{"email"},
+						},
+					},
+				}
+				r.NoError(pinnipedAPIClient.Tracker().Add(federationDomain))
+				r.NoError(federationDomainInformerClient.Tracker().Add(federationDomain))
+			})
+
+			it("calls the ProvidersSetter with the token lifespans, session limits and UserInfo passthrough claims", func() {
+				startInformersAndController()
+				err := controllerlib.TestSync(t, subject, *syncContext)
+				r.NoError(err)
+
+				expectedProvider, err := provider.NewFederationDomainIssuer(federationDomain.Spec.Issuer, nil, provider.TokenLifespans{
+					AccessToken:                    5 * time.Minute,
+					RefreshToken:                   24 * time.Hour,
+					UpstreamState:                  30 * time.Minute,
+					MaxConcurrentSessions:          3,
+					RejectNewLoginOverSessionLimit: true,
+				}, []string{"email"})
+				r.NoError(err)
+
+				r.True(providersSetter.SetProvidersWasCalled)
+				r.Equal([]*provider.FederationDomainIssuer{expectedProvider}, providersSetter.FederationDomainsReceived)
+			})
+		})
+
+		when("there is a FederationDomain which configures an invalid token lifespan", func() {
+			var federationDomain *v1alpha1.FederationDomain
+
+			it.Before(func() {
+				federationDomain = &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: namespace},
+					Spec: v1alpha1.FederationDomainSpec{
+						Issuer: "https://issuer.com",
+						Tokens: v1alpha1.FederationDomainTokensSpec{
+							RefreshTokenLifespan: &metav1.Duration{Duration: 10 * time.Minute},
+						},
+					},
+				}
+				r.NoError(pinnipedAPIClient.Tracker().Add(federationDomain))
+				r.NoError(federationDomainInformerClient.Tracker().Add(federationDomain))
+			})
+
+			it("does not call the ProvidersSetter with the FederationDomain and updates its status to invalid", func() {
+				startInformersAndController()
+				err := controllerlib.TestSync(t, subject, *syncContext)
+				r.NoError(err)
+
+				r.True(providersSetter.SetProvidersWasCalled)
+				r.Empty(providersSetter.FederationDomainsReceived)
+
+				federationDomain.Status.Status = v1alpha1.InvalidFederationDomainStatusCondition
+				federationDomain.Status.Message = "Invalid: tokens.refreshTokenLifespan must be between 1h0m0s and 720h0m0s"
+				federationDomain.Status.LastUpdateTime = timePtr(metav1.NewTime(frozenNow))
+
+				expectedActions := []coretesting.Action{
+					coretesting.NewGetAction(
+						federationDomainGVR,
+						federationDomain.Namespace,
+						federationDomain.Name,
+					),
+					coretesting.NewUpdateSubresourceAction(
+						federationDomainGVR,
+						"status",
+						federationDomain.Namespace,
+						federationDomain,
+					),
+				}
+				r.Equal(expectedActions, pinnipedAPIClient.Actions())
+			})
+		})
+
+		when("the Supervisor uses an external signer", func() {
+			var es256FederationDomain, rs256FederationDomain *v1alpha1.FederationDomain
+
+			it.Before(func() {
+				usesExternalSigner = true
+				es256FederationDomain = &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "es256", Namespace: namespace},
+					Spec: v1alpha1.FederationDomainSpec{
+						Issuer:      "https://issuer1.com",
+						SigningKeys: v1alpha1.FederationDomainSigningKeysSpec{Algorithm: v1alpha1.ES256FederationDomainSigningAlgorithm},
+					},
+				}
+				rs256FederationDomain = &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "rs256", Namespace: namespace},
+					Spec: v1alpha1.FederationDomainSpec{
+						Issuer:      "https://issuer2.com",
+						SigningKeys: v1alpha1.FederationDomainSigningKeysSpec{Algorithm: v1alpha1.RS256FederationDomainSigningAlgorithm},
+					},
+				}
+				for _, federationDomain := range []*v1alpha1.FederationDomain{es256FederationDomain, rs256FederationDomain} {
+					r.NoError(pinnipedAPIClient.Tracker().Add(federationDomain))
+					r.NoError(federationDomainInformerClient.Tracker().Add(federationDomain))
+				}
+			})
+
+			it("only calls the ProvidersSetter with the FederationDomain which uses ES256 and updates the status of the other to invalid", func() {
+				startInformersAndController()
+				err := controllerlib.TestSync(t, subject, *syncContext)
+				r.NoError(err)
+
+				expectedProvider, err := provider.NewFederationDomainIssuer(es256FederationDomain.Spec.Issuer, nil, provider.TokenLifespans{}, nil)
+				r.NoError(err)
+				r.True(providersSetter.SetProvidersWasCalled)
+				r.Equal([]*provider.FederationDomainIssuer{expectedProvider}, providersSetter.FederationDomainsReceived)
+
+				es256FederationDomain.Status.Status = v1alpha1.SuccessFederationDomainStatusCondition
+				es256FederationDomain.Status.Message = "Provider successfully created"
+				es256FederationDomain.Status.LastUpdateTime = timePtr(metav1.NewTime(frozenNow))
+
+				rs256FederationDomain.Status.Status = v1alpha1.InvalidFederationDomainStatusCondition
+				rs256FederationDomain.Status.Message = "Invalid: signingKeys.algorithm must be ES256 when the Supervisor uses an external signer, but it is RS256"
+				rs256FederationDomain.Status.LastUpdateTime = timePtr(metav1.NewTime(frozenNow))
+
+				expectedActions := []coretesting.Action{
+					coretesting.NewGetAction(federationDomainGVR, namespace, es256FederationDomain.Name),
+					coretesting.NewUpdateSubresourceAction(federationDomainGVR, "status", namespace, es256FederationDomain),
+					coretesting.NewGetAction(federationDomainGVR, namespace, rs256FederationDomain.Name),
+					coretesting.NewUpdateSubresourceAction(federationDomainGVR, "status", namespace, rs256FederationDomain),
+				}
+				r.ElementsMatch(expectedActions, pinnipedAPIClient.Actions())
+			})
+		})
+
 		when("there are no FederationDomains in the informer", func() {
 			it("keeps waiting for one", func() {
 				startInformersAndController()
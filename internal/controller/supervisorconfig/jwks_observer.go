@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package supervisorconfig
@@ -12,13 +12,16 @@ import (
 	corev1informers "k8s.io/client-go/informers/core/v1"
 
 	"go.pinniped.dev/generated/latest/client/supervisor/informers/externalversions/config/v1alpha1"
+	"go.pinniped.dev/internal/constable"
 	pinnipedcontroller "go.pinniped.dev/internal/controller"
 	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/oidc/signer"
 	"go.pinniped.dev/internal/plog"
 )
 
 type jwksObserverController struct {
 	issuerToJWKSSetter       IssuerToJWKSMapSetter
+	externalSigner           signer.Signer
 	federationDomainInformer v1alpha1.FederationDomainInformer
 	secretInformer           corev1informers.SecretInformer
 }
@@ -26,17 +29,21 @@ type jwksObserverController struct {
 type IssuerToJWKSMapSetter interface {
 	SetIssuerToJWKSMap(
 		issuerToJWKSMap map[string]*jose.JSONWebKeySet,
-		issuerToActiveJWKMap map[string]*jose.JSONWebKey,
+		issuerToActiveSignerMap map[string]signer.Signer,
 	)
 }
 
 // Returns a controller which watches all of the FederationDomains and their corresponding Secrets
-// and fills an in-memory cache of the JWKS info for each currently configured issuer.
+// and fills an in-memory cache of the JWKS info for each currently configured issuer. The cached JWKS
+// contains all the keys which are published in the Secret, including the next and retired keys,
+// while only the active JWK is used to sign tokens. When externalSigner is not nil, it signs the tokens
+// of every issuer whose Secret has the external signer's public key as its active JWK.
 // This controller assumes that the informers passed to it are already scoped down to the
 // appropriate namespace. It also assumes that the IssuerToJWKSMapSetter passed to it has an
 // underlying implementation which is thread-safe.
 func NewJWKSObserverController(
 	issuerToJWKSSetter IssuerToJWKSMapSetter,
+	externalSigner signer.Signer,
 	secretInformer corev1informers.SecretInformer,
 	federationDomainInformer v1alpha1.FederationDomainInformer,
 	withInformer pinnipedcontroller.WithInformerOptionFunc,
@@ -46,6 +53,7 @@ func NewJWKSObserverController(
 			Name: "jwks-observer-controller",
 			Syncer: &jwksObserverController{
 				issuerToJWKSSetter:       issuerToJWKSSetter,
+				externalSigner:           externalSigner,
 				federationDomainInformer: federationDomainInformer,
 				secretInformer:           secretInformer,
 			},
@@ -73,7 +81,7 @@ func (c *jwksObserverController) Sync(ctx controllerlib.Context) error {
 	// Rebuild the whole map on any change to any Secret or FederationDomain, because either can have changes that
 	// can cause the map to need to be updated.
 	issuerToJWKSMap := map[string]*jose.JSONWebKeySet{}
-	issuerToActiveJWKMap := map[string]*jose.JSONWebKey{}
+	issuerToActiveSignerMap := map[string]signer.Signer{}
 
 	for _, provider := range allProviders {
 		secretRef := provider.Status.Secrets.JWKS
@@ -98,17 +106,36 @@ func (c *jwksObserverController) Sync(ctx controllerlib.Context) error {
 		}
 
 		issuerToJWKSMap[provider.Spec.Issuer] = &jwksFromSecret
-		issuerToActiveJWKMap[provider.Spec.Issuer] = &activeJWKFromSecret
+
+		activeSigner, err := c.activeSigner(&activeJWKFromSecret)
+		if err != nil {
+			plog.Debug("jwksObserverController Sync cannot sign with the active JWK", "namespace", ns, "secretName", secretRef.Name, "error", err.Error())
+			continue
+		}
+		issuerToActiveSignerMap[provider.Spec.Issuer] = activeSigner
 	}
 
 	plog.Debug(
 		"jwksObserverController Sync updated the JWKS cache",
 		"issuerJWKSCount",
 		len(issuerToJWKSMap),
-		"issuerActiveJWKCount",
-		len(issuerToActiveJWKMap),
+		"issuerActiveSignerCount",
+		len(issuerToActiveSignerMap),
 	)
-	c.issuerToJWKSSetter.SetIssuerToJWKSMap(issuerToJWKSMap, issuerToActiveJWKMap)
+	c.issuerToJWKSSetter.SetIssuerToJWKSMap(issuerToJWKSMap, issuerToActiveSignerMap)
 
 	return nil
 }
+
+// activeSigner returns the Signer for the active JWK of a Secret. When the Supervisor uses an external signer, the
+// active JWK is only a public key, and it must be the external signer's key. Until the jwks writer controller has
+// updated the Secret to publish that key, there is no Signer, since its tokens could not be verified.
+func (c *jwksObserverController) activeSigner(activeJWK *jose.JSONWebKey) (signer.Signer, error) {
+	if c.externalSigner == nil {
+		return signer.NewJWKSigner(activeJWK)
+	}
+	if activeJWK.KeyID != c.externalSigner.Public().KeyID {
+		return nil, constable.Error("active JWK is not the key of the external signer")
+	}
+	return c.externalSigner, nil
+}
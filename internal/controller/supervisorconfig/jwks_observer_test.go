@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package supervisorconfig
@@ -21,6 +21,7 @@ import (
 	pinnipedfake "go.pinniped.dev/generated/latest/client/supervisor/clientset/versioned/fake"
 	pinnipedinformers "go.pinniped.dev/generated/latest/client/supervisor/informers/externalversions"
 	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/oidc/signer"
 	"go.pinniped.dev/internal/testutil"
 )
 
@@ -39,6 +40,7 @@ func TestJWKSObserverControllerInformerFilters(t *testing.T) {
 			secretsInformer := kubeinformers.NewSharedInformerFactory(nil, 0).Core().V1().Secrets()
 			federationDomainInformer := pinnipedinformers.NewSharedInformerFactory(nil, 0).Config().V1alpha1().FederationDomains()
 			_ = NewJWKSObserverController(
+				nil,
 				nil,
 				secretsInformer,
 				federationDomainInformer,
@@ -104,18 +106,18 @@ func TestJWKSObserverControllerInformerFilters(t *testing.T) {
 }
 
 type fakeIssuerToJWKSMapSetter struct {
-	setIssuerToJWKSMapWasCalled  bool
-	issuerToJWKSMapReceived      map[string]*jose.JSONWebKeySet
-	issuerToActiveJWKMapReceived map[string]*jose.JSONWebKey
+	setIssuerToJWKSMapWasCalled     bool
+	issuerToJWKSMapReceived         map[string]*jose.JSONWebKeySet
+	issuerToActiveSignerMapReceived map[string]signer.Signer
 }
 
 func (f *fakeIssuerToJWKSMapSetter) SetIssuerToJWKSMap(
 	issuerToJWKSMap map[string]*jose.JSONWebKeySet,
-	issuerToActiveJWKMap map[string]*jose.JSONWebKey,
+	issuerToActiveSignerMap map[string]signer.Signer,
 ) {
 	f.setIssuerToJWKSMapWasCalled = true
 	f.issuerToJWKSMapReceived = issuerToJWKSMap
-	f.issuerToActiveJWKMapReceived = issuerToActiveJWKMap
+	f.issuerToActiveSignerMapReceived = issuerToActiveSignerMap
 }
 
 func TestJWKSObserverControllerSync(t *testing.T) {
@@ -133,6 +135,7 @@ func TestJWKSObserverControllerSync(t *testing.T) {
 			cancelContextCancelFunc context.CancelFunc
 			syncContext             *controllerlib.Context
 			issuerToJWKSSetter      *fakeIssuerToJWKSMapSetter
+			externalSigner          signer.Signer
 		)
 
 		// Defer starting the informers until the last possible moment so that the
@@ -141,6 +144,7 @@ func TestJWKSObserverControllerSync(t *testing.T) {
 			// Set this at the last second to allow for injection of server override.
 			subject = NewJWKSObserverController(
 				issuerToJWKSSetter,
+				externalSigner,
 				kubeInformers.Core().V1().Secrets(),
 				pinnipedInformers.Config().V1alpha1().FederationDomains(),
 				controllerlib.WithInformer,
@@ -172,6 +176,7 @@ func TestJWKSObserverControllerSync(t *testing.T) {
 			pinnipedInformerClient = pinnipedfake.NewSimpleClientset()
 			pinnipedInformers = pinnipedinformers.NewSharedInformerFactory(pinnipedInformerClient, 0)
 			issuerToJWKSSetter = &fakeIssuerToJWKSMapSetter{}
+			externalSigner = nil
 
 			unrelatedSecret := &corev1.Secret{
 				ObjectMeta: metav1.ObjectMeta{
@@ -194,13 +199,14 @@ func TestJWKSObserverControllerSync(t *testing.T) {
 
 				r.True(issuerToJWKSSetter.setIssuerToJWKSMapWasCalled)
 				r.Empty(issuerToJWKSSetter.issuerToJWKSMapReceived)
-				r.Empty(issuerToJWKSSetter.issuerToActiveJWKMapReceived)
+				r.Empty(issuerToJWKSSetter.issuerToActiveSignerMapReceived)
 			})
 		})
 
 		when("there are FederationDomains where some have corresponding JWKS Secrets and some don't", func() {
 			var (
 				expectedJWK1, expectedJWK2 string
+				externalJWK                *jose.JSONWebKey
 			)
 
 			it.Before(func() {
@@ -280,17 +286,54 @@ func TestJWKSObserverControllerSync(t *testing.T) {
 						},
 					},
 				}
+				federationDomainWithExternalSignerSecret := &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "external-signer-secret-federationdomain",
+						Namespace: installedInNamespace,
+					},
+					Spec: v1alpha1.FederationDomainSpec{Issuer: "https://issuer-with-external-signer-secret.com"},
+					Status: v1alpha1.FederationDomainStatus{
+						Secrets: v1alpha1.FederationDomainSecrets{
+							JWKS: corev1.LocalObjectReference{Name: "external-signer-jwks-secret-name"},
+						},
+					},
+				}
+				federationDomainWithRotatedKeysSecret := &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "rotated-keys-secret-federationdomain",
+						Namespace: installedInNamespace,
+					},
+					Spec: v1alpha1.FederationDomainSpec{Issuer: "https://issuer-with-rotated-keys-secret.com"},
+					Status: v1alpha1.FederationDomainStatus{
+						Secrets: v1alpha1.FederationDomainSecrets{
+							JWKS: corev1.LocalObjectReference{Name: "rotated-keys-jwks-secret-name"},
+						},
+					},
+				}
 				expectedJWK1 = string(readJWKJSON(t, "testdata/public-jwk.json"))
 				r.NotEmpty(expectedJWK1)
 				expectedJWK2 = string(readJWKJSON(t, "testdata/public-jwk2.json"))
 				r.NotEmpty(expectedJWK2)
+				privateJWK1 := readJWKJSON(t, "testdata/good-jwk.json")
+				privateJWK2 := readJWKJSON(t, "testdata/good-jwk2.json")
+
+				// Any signer will do as the external signer, since the controller only uses its public key.
+				externalPrivateJWK := &jose.JSONWebKey{}
+				r.NoError(json.Unmarshal(privateJWK2, externalPrivateJWK))
+				externalPrivateJWK.KeyID = "some-external-key-id"
+				s, err := signer.NewJWKSigner(externalPrivateJWK)
+				r.NoError(err)
+				externalJWK = s.Public()
+				externalJWKJSON, err := json.Marshal(externalJWK)
+				r.NoError(err)
+				externalSigner = s
 				goodJWKSSecret1 := &corev1.Secret{
 					ObjectMeta: metav1.ObjectMeta{
 						Name:      "good-jwks-secret-name1",
 						Namespace: installedInNamespace,
 					},
 					Data: map[string][]byte{
-						"activeJWK": []byte(expectedJWK1),
+						"activeJWK": privateJWK1,
 						"jwks":      []byte(`{"keys": [` + expectedJWK1 + `]}`),
 					},
 				}
@@ -300,10 +343,30 @@ func TestJWKSObserverControllerSync(t *testing.T) {
 						Namespace: installedInNamespace,
 					},
 					Data: map[string][]byte{
-						"activeJWK": []byte(expectedJWK2),
+						"activeJWK": privateJWK2,
 						"jwks":      []byte(`{"keys": [` + expectedJWK2 + `]}`),
 					},
 				}
+				externalSignerJWKSSecret := &corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "external-signer-jwks-secret-name",
+						Namespace: installedInNamespace,
+					},
+					Data: map[string][]byte{
+						"activeJWK": externalJWKJSON,
+						"jwks":      []byte(`{"keys": [` + string(externalJWKJSON) + `,` + expectedJWK1 + `]}`),
+					},
+				}
+				rotatedKeysJWKSSecret := &corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "rotated-keys-jwks-secret-name",
+						Namespace: installedInNamespace,
+					},
+					Data: map[string][]byte{
+						"activeJWK": privateJWK2,
+						"jwks":      []byte(`{"keys": [` + expectedJWK2 + `,` + expectedJWK1 + `]}`),
+					},
+				}
 				badSecret := &corev1.Secret{
 					ObjectMeta: metav1.ObjectMeta{
 						Name:      "bad-secret-name",
@@ -340,40 +403,79 @@ func TestJWKSObserverControllerSync(t *testing.T) {
 				r.NoError(pinnipedInformerClient.Tracker().Add(federationDomainWithGoodSecret2))
 				r.NoError(kubeInformerClient.Tracker().Add(goodJWKSSecret1))
 				r.NoError(kubeInformerClient.Tracker().Add(goodJWKSSecret2))
+				r.NoError(pinnipedInformerClient.Tracker().Add(federationDomainWithRotatedKeysSecret))
+				r.NoError(kubeInformerClient.Tracker().Add(rotatedKeysJWKSSecret))
+				r.NoError(pinnipedInformerClient.Tracker().Add(federationDomainWithExternalSignerSecret))
+				r.NoError(kubeInformerClient.Tracker().Add(externalSignerJWKSSecret))
 				r.NoError(kubeInformerClient.Tracker().Add(badSecret))
 				r.NoError(kubeInformerClient.Tracker().Add(badJWKSSecret))
 				r.NoError(kubeInformerClient.Tracker().Add(badActiveJWKSecret))
 			})
 
-			requireJWKSJSON := func(expectedJWKJSON string, actualJWKS *jose.JSONWebKeySet) {
+			requireJWKSJSON := func(actualJWKS *jose.JSONWebKeySet, expectedJWKJSONs ...string) {
 				r.NotNil(actualJWKS)
-				r.Len(actualJWKS.Keys, 1)
-				actualJWK := actualJWKS.Keys[0]
-				actualJWKJSON, err := json.Marshal(actualJWK)
-				r.NoError(err)
-				r.JSONEq(expectedJWKJSON, string(actualJWKJSON))
+				r.Len(actualJWKS.Keys, len(expectedJWKJSONs))
+				for i, expectedJWKJSON := range expectedJWKJSONs {
+					actualJWKJSON, err := json.Marshal(actualJWKS.Keys[i])
+					r.NoError(err)
+					r.JSONEq(expectedJWKJSON, string(actualJWKJSON))
+				}
 			}
 
-			requireJWKJSON := func(expectedJWKJSON string, actualJWK *jose.JSONWebKey) {
-				r.NotNil(actualJWK)
-				actualJWKJSON, err := json.Marshal(actualJWK)
+			requireSignerJWKJSON := func(expectedJWKJSON string, actualSigner signer.Signer) {
+				r.NotNil(actualSigner)
+				actualJWKJSON, err := json.Marshal(actualSigner.Public())
 				r.NoError(err)
 				r.JSONEq(expectedJWKJSON, string(actualJWKJSON))
 			}
 
-			it("updates the issuerToJWKSSetter's map to include only the issuers that had valid JWKS", func() {
-				startInformersAndController()
-				r.NoError(controllerlib.TestSync(t, subject, *syncContext))
+			when("the Supervisor does not use an external signer", func() {
+				it.Before(func() {
+					externalSigner = nil
+				})
 
-				r.True(issuerToJWKSSetter.setIssuerToJWKSMapWasCalled)
-				r.Len(issuerToJWKSSetter.issuerToJWKSMapReceived, 2)
-				r.Len(issuerToJWKSSetter.issuerToActiveJWKMapReceived, 2)
-
-				// the actual JWK should match the one from the test fixture that was put into the secret
-				requireJWKSJSON(expectedJWK1, issuerToJWKSSetter.issuerToJWKSMapReceived["https://issuer-with-good-secret1.com"])
-				requireJWKJSON(expectedJWK1, issuerToJWKSSetter.issuerToActiveJWKMapReceived["https://issuer-with-good-secret1.com"])
-				requireJWKSJSON(expectedJWK2, issuerToJWKSSetter.issuerToJWKSMapReceived["https://issuer-with-good-secret2.com"])
-				requireJWKJSON(expectedJWK2, issuerToJWKSSetter.issuerToActiveJWKMapReceived["https://issuer-with-good-secret2.com"])
+				it("updates the issuerToJWKSSetter's map to include only the issuers that had valid JWKS", func() {
+					startInformersAndController()
+					r.NoError(controllerlib.TestSync(t, subject, *syncContext))
+
+					r.True(issuerToJWKSSetter.setIssuerToJWKSMapWasCalled)
+					r.Len(issuerToJWKSSetter.issuerToJWKSMapReceived, 4)
+					r.Len(issuerToJWKSSetter.issuerToActiveSignerMapReceived, 3)
+
+					// the public key of the signer should match the one from the test fixture that was put into the secret
+					requireJWKSJSON(issuerToJWKSSetter.issuerToJWKSMapReceived["https://issuer-with-good-secret1.com"], expectedJWK1)
+					requireSignerJWKJSON(expectedJWK1, issuerToJWKSSetter.issuerToActiveSignerMapReceived["https://issuer-with-good-secret1.com"])
+					requireJWKSJSON(issuerToJWKSSetter.issuerToJWKSMapReceived["https://issuer-with-good-secret2.com"], expectedJWK2)
+					requireSignerJWKJSON(expectedJWK2, issuerToJWKSSetter.issuerToActiveSignerMapReceived["https://issuer-with-good-secret2.com"])
+
+					// all the keys of a secret whose keys were rotated are published, while only one of them is active
+					requireJWKSJSON(issuerToJWKSSetter.issuerToJWKSMapReceived["https://issuer-with-rotated-keys-secret.com"], expectedJWK2, expectedJWK1)
+					requireSignerJWKJSON(expectedJWK2, issuerToJWKSSetter.issuerToActiveSignerMapReceived["https://issuer-with-rotated-keys-secret.com"])
+
+					// a secret which was written for an external signer is still published, but it cannot be used to sign
+					r.NotNil(issuerToJWKSSetter.issuerToJWKSMapReceived["https://issuer-with-external-signer-secret.com"])
+					r.NotContains(issuerToJWKSSetter.issuerToActiveSignerMapReceived, "https://issuer-with-external-signer-secret.com")
+				})
+			})
+
+			when("the Supervisor uses an external signer", func() {
+				it("uses the external signer only for the issuers whose active JWK is the external signer's key", func() {
+					startInformersAndController()
+					r.NoError(controllerlib.TestSync(t, subject, *syncContext))
+
+					r.True(issuerToJWKSSetter.setIssuerToJWKSMapWasCalled)
+					r.Len(issuerToJWKSSetter.issuerToJWKSMapReceived, 4)
+					r.Len(issuerToJWKSSetter.issuerToActiveSignerMapReceived, 1)
+
+					externalJWKJSON, err := json.Marshal(externalJWK)
+					r.NoError(err)
+					requireJWKSJSON(issuerToJWKSSetter.issuerToJWKSMapReceived["https://issuer-with-external-signer-secret.com"], string(externalJWKJSON), expectedJWK1)
+					r.Same(externalSigner, issuerToJWKSSetter.issuerToActiveSignerMapReceived["https://issuer-with-external-signer-secret.com"])
+
+					// the secrets which were not yet updated by the jwks writer controller are still published
+					requireJWKSJSON(issuerToJWKSSetter.issuerToJWKSMapReceived["https://issuer-with-good-secret1.com"], expectedJWK1)
+					requireJWKSJSON(issuerToJWKSSetter.issuerToJWKSMapReceived["https://issuer-with-good-secret2.com"], expectedJWK2)
+				})
 			})
 		})
 	}, spec.Parallel(), spec.Report(report.Terminal{}))
@@ -1,19 +1,25 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package supervisorconfig
 
 import (
 	"context"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"time"
 
 	"gopkg.in/square/go-jose.v2"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
@@ -21,6 +27,7 @@ import (
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/util/retry"
 	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
 
 	configv1alpha1 "go.pinniped.dev/generated/latest/apis/supervisor/config/v1alpha1"
 	pinnipedclientset "go.pinniped.dev/generated/latest/client/supervisor/clientset/versioned"
@@ -28,39 +35,126 @@ import (
 	pinnipedcontroller "go.pinniped.dev/internal/controller"
 	"go.pinniped.dev/internal/controller/supervisorconfig/generator"
 	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/signer"
 	"go.pinniped.dev/internal/plog"
 )
 
 // These constants are the keys in a FederationDomain's Secret's Data map.
 const (
-	// activeJWKKey points to the current private key used for signing tokens.
+	// activeJWKKey points to the current private key used for signing tokens. When the Supervisor uses an external
+	// signer, it points to the external signer's public key instead.
 	//
-	// Note! The value for this key will contain private key material!
+	// Note! The value for this key will contain private key material, unless an external signer is used!
 	activeJWKKey = "activeJWK"
-	// jwksKey points to the current JWKS used to verify tokens.
+	// nextJWKKey points to the private key which will become the active key at the next rotation. Its public key is
+	// already published in the JWKS, so clients which cache the JWKS can learn about it before it is used. There is
+	// no next key when the Supervisor uses an external signer.
+	//
+	// Note! The value for this key will contain private key material!
+	nextJWKKey = "nextJWK"
+	// jwksKey points to the current JWKS used to verify tokens. It contains the active key, the next key, and the
+	// retired keys which may still have signed unexpired tokens.
 	//
 	// Note! The value for this key will contain only public key material!
 	jwksKey = "jwks"
+	// rotationStateKey points to the bookkeeping which is needed to decide when to rotate the keys and when to stop
+	// publishing the retired keys.
+	rotationStateKey = "rotationState"
 
 	jwksSecretTypeValue corev1.SecretType = "secrets.pinniped.dev/federation-domain-jwks"
 )
 
 const (
 	federationDomainKind = "FederationDomain"
+
+	// minimumRotationInterval is the shortest allowed interval between scheduled rotations.
+	minimumRotationInterval = time.Hour
+	// retiredJWKGracePeriod is added to the lifetime of ID tokens when deciding how long to keep publishing a retired
+	// key, to allow for clock skew between the Supervisor and the clients which verify the tokens.
+	retiredJWKGracePeriod = 5 * time.Minute
+	// maxRotationHistory is the number of past rotations which are remembered.
+	maxRotationHistory = 10
+
+	// defaultSigningAlgorithm is used when a FederationDomain does not configure an algorithm.
+	defaultSigningAlgorithm = jose.ES256
+	// defaultRSAKeySize is used when a FederationDomain uses an RSA algorithm without configuring a key size.
+	defaultRSAKeySize = 2048
 )
 
-// generateKey is stubbed out for the purpose of testing. The default behavior is to generate an EC key.
+// generateKey is stubbed out for the purpose of testing. The default behavior is to generate a key of the type
+// which is used by the algorithm.
 //nolint:gochecknoglobals
-var generateKey func(r io.Reader) (interface{}, error) = generateECKey
+var generateKey func(r io.Reader, alg jose.SignatureAlgorithm, rsaKeySize int) (interface{}, error) = generatePrivateKey
+
+func generatePrivateKey(r io.Reader, alg jose.SignatureAlgorithm, rsaKeySize int) (interface{}, error) {
+	switch alg {
+	case jose.RS256, jose.RS384, jose.PS256:
+		return rsa.GenerateKey(r, rsaKeySize)
+	case jose.ES256:
+		return ecdsa.GenerateKey(elliptic.P256(), r)
+	case jose.ES384:
+		return ecdsa.GenerateKey(elliptic.P384(), r)
+	case jose.EdDSA:
+		_, key, err := ed25519.GenerateKey(r)
+		return key, err
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+}
+
+// signingAlgorithm returns the algorithm and RSA key size which a FederationDomain's keys should use.
+func signingAlgorithm(spec configv1alpha1.FederationDomainSigningKeysSpec) (jose.SignatureAlgorithm, int) {
+	alg := jose.SignatureAlgorithm(spec.Algorithm)
+	if alg == "" {
+		alg = defaultSigningAlgorithm
+	}
+	rsaKeySize := int(spec.RSAKeySize)
+	if rsaKeySize == 0 {
+		rsaKeySize = defaultRSAKeySize
+	}
+	return alg, rsaKeySize
+}
+
+// keyMatchesSpec returns whether a private key is of the type which a FederationDomain's keys should use.
+func keyMatchesSpec(jwk *jose.JSONWebKey, spec configv1alpha1.FederationDomainSigningKeysSpec) bool {
+	alg, rsaKeySize := signingAlgorithm(spec)
+	if jose.SignatureAlgorithm(jwk.Algorithm) != alg {
+		return false
+	}
+	if rsaKey, ok := jwk.Key.(*rsa.PrivateKey); ok && rsaKey.N.BitLen() != rsaKeySize {
+		return false
+	}
+	return true
+}
+
+// jwksRotationState is stored in a FederationDomain's Secret as JSON next to the keys.
+type jwksRotationState struct {
+	// ActiveSince is when the active key started to be used to sign tokens.
+	ActiveSince metav1.Time `json:"activeSince"`
+	// RetiredKeys are the keys which are still published in the JWKS after they were retired.
+	RetiredKeys []configv1alpha1.FederationDomainRetiredSigningKey `json:"retiredKeys,omitempty"`
+	// HandledRotationRequest is the value of the FederationDomain's spec.signingKeys.rotationRequest which was
+	// last handled, so each new value causes exactly one rotation.
+	HandledRotationRequest string `json:"handledRotationRequest,omitempty"`
+	// RotationHistory lists the most recent rotations, newest first.
+	RotationHistory []configv1alpha1.FederationDomainSigningKeyRotation `json:"rotationHistory,omitempty"`
+}
 
-func generateECKey(r io.Reader) (interface{}, error) {
-	return ecdsa.GenerateKey(elliptic.P256(), r)
+// jwksKeys is the parsed contents of a FederationDomain's Secret.
+type jwksKeys struct {
+	active  *jose.JSONWebKey   // only a public key when the Supervisor uses an external signer
+	next    *jose.JSONWebKey   // nil when the Secret does not contain a valid next key
+	retired []jose.JSONWebKey  // public keys only
+	state   *jwksRotationState // nil when the Secret was written by an older version of the Supervisor
 }
 
 // jwkController holds the fields necessary for the JWKS controller to communicate with FederationDomains and
 // secrets, both via a cache and via the API.
 type jwksWriterController struct {
 	jwksSecretLabels         map[string]string
+	externalSigner           signer.Signer
+	clock                    clock.Clock
 	pinnipedClient           pinnipedclientset.Interface
 	kubeClient               kubernetes.Interface
 	federationDomainInformer configinformers.FederationDomainInformer
@@ -68,9 +162,17 @@ type jwksWriterController struct {
 }
 
 // NewJWKSWriterController returns a controllerlib.Controller that ensures a FederationDomain has a corresponding
-// Secret that contains a valid active JWK and JWKS.
+// Secret that contains a valid active JWK and JWKS. It also rotates the keys, either on a schedule or on demand,
+// according to the FederationDomain's spec. Retired keys stay in the JWKS for the FederationDomain's ID token
+// lifespan after they are retired.
+//
+// When externalSigner is not nil, the Secret only contains public keys: the active JWK is the external signer's
+// public key, and the keys are never rotated by this controller. External signers always sign ES256 tokens, so the
+// FederationDomainWatcherController rejects the FederationDomains which configure another signing algorithm.
 func NewJWKSWriterController(
 	jwksSecretLabels map[string]string,
+	externalSigner signer.Signer,
+	clock clock.Clock,
 	kubeClient kubernetes.Interface,
 	pinnipedClient pinnipedclientset.Interface,
 	secretInformer corev1informers.SecretInformer,
@@ -86,6 +188,8 @@ func NewJWKSWriterController(
 			Name: "JWKSController",
 			Syncer: &jwksWriterController{
 				jwksSecretLabels:         jwksSecretLabels,
+				externalSigner:           externalSigner,
+				clock:                    clock,
 				kubeClient:               kubeClient,
 				pinnipedClient:           pinnipedClient,
 				secretInformer:           secretInformer,
@@ -132,102 +236,121 @@ func (c *jwksWriterController) Sync(ctx controllerlib.Context) error {
 		return nil
 	}
 
-	secretNeedsUpdate, err := c.secretNeedsUpdate(federationDomain)
+	secret, err := c.secretNeedingUpdate(federationDomain)
 	if err != nil {
 		return fmt.Errorf("cannot determine secret status: %w", err)
 	}
-	if !secretNeedsUpdate {
+	if secret == nil {
+		// If the FederationDomain does not have a secret associated with it, that secret does not exist, the secret
+		// is invalid, or its keys are due to be rotated, we will create or update the secret.
+		secret, err = c.createOrUpdateSecret(ctx.Context, federationDomain)
+		if err != nil {
+			return fmt.Errorf("cannot create or update secret: %w", err)
+		}
+		plog.Debug("created/updated secret", "secret", klog.KObj(secret))
+	} else {
 		// Secret is up to date - we are good to go.
 		plog.Debug(
 			"secret is up to date",
 			"federationdomain",
 			klog.KRef(ctx.Key.Namespace, ctx.Key.Name),
 		)
-		return nil
 	}
 
-	// If the FederationDomain does not have a secret associated with it, that secret does not exist, or the secret
-	// is invalid, we will generate a new secret (i.e., a JWKS).
-	secret, err := c.generateSecret(federationDomain)
+	keys, err := readKeys(secret)
 	if err != nil {
-		return fmt.Errorf("cannot generate secret: %w", err)
-	}
-
-	if err := c.createOrUpdateSecret(ctx.Context, secret); err != nil {
-		return fmt.Errorf("cannot create or update secret: %w", err)
+		return fmt.Errorf("cannot read keys from secret: %w", err)
 	}
-	plog.Debug("created/updated secret", "secret", klog.KObj(secret))
 
-	// Ensure that the FederationDomain points to the secret.
+	// Ensure that the FederationDomain points to the secret and describes its keys.
 	newFederationDomain := federationDomain.DeepCopy()
 	newFederationDomain.Status.Secrets.JWKS.Name = secret.Name
-	if err := c.updateFederationDomainStatus(ctx.Context, newFederationDomain); err != nil {
-		return fmt.Errorf("cannot update FederationDomain: %w", err)
+	newFederationDomain.Status.SigningKeys = signingKeysStatus(keys)
+	if !equality.Semantic.DeepEqual(federationDomain.Status, newFederationDomain.Status) {
+		if err := c.updateFederationDomainStatus(ctx.Context, newFederationDomain); err != nil {
+			return fmt.Errorf("cannot update FederationDomain: %w", err)
+		}
+		plog.Debug("updated FederationDomain", "federationdomain", klog.KObj(newFederationDomain))
+	}
+
+	// Sync again when the next scheduled rotation is due or when a retired key should stop being published.
+	if nextSync := c.nextSyncTime(keys, federationDomain); !nextSync.IsZero() {
+		ctx.Queue.AddAfter(ctx.Key, nextSync.Sub(c.clock.Now()))
 	}
-	plog.Debug("updated FederationDomain", "federationdomain", klog.KObj(newFederationDomain))
 
 	return nil
 }
 
-func (c *jwksWriterController) secretNeedsUpdate(federationDomain *configv1alpha1.FederationDomain) (bool, error) {
-	if federationDomain.Status.Secrets.JWKS.Name == "" {
-		// If the FederationDomain says it doesn't have a secret associated with it, then let's create one.
-		return true, nil
-	}
-
-	// This FederationDomain says it has a secret associated with it. Let's try to get it from the cache.
-	secret, err := c.secretInformer.Lister().Secrets(federationDomain.Namespace).Get(federationDomain.Status.Secrets.JWKS.Name)
+// secretNeedingUpdate returns the FederationDomain's secret from the cache, or nil when the secret needs to be
+// created or updated.
+func (c *jwksWriterController) secretNeedingUpdate(federationDomain *configv1alpha1.FederationDomain) (*corev1.Secret, error) {
+	// This FederationDomain may say it has a secret associated with it. Let's try to get it from the cache.
+	secret, err := c.secretInformer.Lister().Secrets(federationDomain.Namespace).Get(secretName(federationDomain))
 	notFound := k8serrors.IsNotFound(err)
 	if err != nil && !notFound {
-		return false, fmt.Errorf("cannot get secret: %w", err)
+		return nil, fmt.Errorf("cannot get secret: %w", err)
 	}
 	if notFound {
 		// If we can't find the secret, let's assume we need to create it.
-		return true, nil
+		return nil, nil
 	}
 
-	if !isValid(secret) {
+	if !c.isValid(secret) {
 		// If this secret is invalid, we need to generate a new one.
-		return true, nil
+		return nil, nil
+	}
+
+	keys, err := readKeys(secret)
+	if err != nil {
+		return nil, err
+	}
+	if c.keysNeedUpdate(keys, federationDomain) {
+		return nil, nil
 	}
 
-	return false, nil
+	return secret, nil
 }
 
-func (c *jwksWriterController) generateSecret(federationDomain *configv1alpha1.FederationDomain) (*corev1.Secret, error) {
-	// Note! This is where we could potentially add more handling of FederationDomain spec fields which tell us how
-	// this FederationDomain should sign and verify ID tokens (e.g., hardcoded token secret, gRPC
-	// connection to KMS, etc).
-	//
-	// For now, we just generate an new RSA keypair and put that in the secret.
+func secretName(federationDomain *configv1alpha1.FederationDomain) string {
+	if federationDomain.Status.Secrets.JWKS.Name != "" {
+		return federationDomain.Status.Secrets.JWKS.Name
+	}
+	return federationDomain.Name + "-jwks"
+}
 
-	key, err := generateKey(rand.Reader)
-	if err != nil {
-		return nil, fmt.Errorf("cannot generate key: %w", err)
+func (c *jwksWriterController) generateSecret(federationDomain *configv1alpha1.FederationDomain) (*corev1.Secret, error) {
+	// When the Supervisor uses an external signer, only its public key is put in the secret. Otherwise, we generate
+	// new keypairs of the configured type for the active and next keys and put them in the secret.
+	var active *jose.JSONWebKey
+	if c.externalSigner != nil {
+		active = c.externalSigner.Public()
+	} else {
+		var err error
+		if active, err = generateJWK(federationDomain.Spec.SigningKeys); err != nil {
+			return nil, err
+		}
 	}
 
-	jwk := jose.JSONWebKey{
-		Key:       key,
-		KeyID:     "pinniped-supervisor-key",
-		Algorithm: "ES256",
-		Use:       "sig",
+	keys := &jwksKeys{
+		active: active,
+		state: &jwksRotationState{
+			ActiveSince: metav1.NewTime(c.clock.Now()),
+			// A brand new key does not need to be rotated again because of a rotation request made before it existed.
+			HandledRotationRequest: federationDomain.Spec.SigningKeys.RotationRequest,
+		},
 	}
-	jwkData, err := json.Marshal(jwk)
-	if err != nil {
-		return nil, fmt.Errorf("cannot marshal jwk: %w", err)
+	if err := c.updateKeys(keys, federationDomain); err != nil {
+		return nil, err
 	}
 
-	jwks := jose.JSONWebKeySet{
-		Keys: []jose.JSONWebKey{jwk.Public()},
-	}
-	jwksData, err := json.Marshal(jwks)
+	data, err := keys.secretData()
 	if err != nil {
-		return nil, fmt.Errorf("cannot marshal jwks: %w", err)
+		return nil, err
 	}
 
 	s := corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      federationDomain.Name + "-jwks",
+			Name:      secretName(federationDomain),
 			Namespace: federationDomain.Namespace,
 			Labels:    c.jwksSecretLabels,
 			OwnerReferences: []metav1.OwnerReference{
@@ -238,49 +361,412 @@ func (c *jwksWriterController) generateSecret(federationDomain *configv1alpha1.F
 				}),
 			},
 		},
-		Data: map[string][]byte{
-			activeJWKKey: jwkData,
-			jwksKey:      jwksData,
-		},
+		Data: data,
 		Type: jwksSecretTypeValue,
 	}
 
 	return &s, nil
 }
 
+// keysNeedUpdate returns whether the keys of a valid secret need a new next key, a rotation, a switch to or from
+// the external signer, or the removal of expired retired keys.
+func (c *jwksWriterController) keysNeedUpdate(keys *jwksKeys, federationDomain *configv1alpha1.FederationDomain) bool {
+	if keys.state == nil {
+		return true
+	}
+	if c.externalSigner != nil {
+		if keys.next != nil || !keys.active.IsPublic() || keys.active.KeyID != c.externalSigner.Public().KeyID {
+			return true
+		}
+	} else {
+		if keys.next == nil || !keyMatchesSpec(keys.next, federationDomain.Spec.SigningKeys) ||
+			c.rotationReason(keys.state, federationDomain) != "" {
+			return true
+		}
+	}
+	now := c.clock.Now()
+	for _, retired := range keys.state.RetiredKeys {
+		if !now.Before(retired.PublishedUntil.Time) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateKeys adds a next key when there is none or when it is of the wrong type, rotates the keys when a rotation is due, switches to the external
+// signer's key when there is an external signer, and removes the retired keys which no longer need to be published.
+func (c *jwksWriterController) updateKeys(keys *jwksKeys, federationDomain *configv1alpha1.FederationDomain) error {
+	now := metav1.NewTime(c.clock.Now())
+
+	if keys.state == nil {
+		// This secret was written by an older version of the Supervisor, so we don't know when its key became active.
+		keys.state = &jwksRotationState{
+			ActiveSince:            now,
+			HandledRotationRequest: federationDomain.Spec.SigningKeys.RotationRequest,
+		}
+	}
+
+	if c.externalSigner != nil {
+		c.useExternalSignerKey(keys, federationDomain, now)
+	} else if err := c.rotateKeysIfNeeded(keys, federationDomain, now); err != nil {
+		return err
+	}
+
+	// Stop publishing the retired keys which can no longer have signed any unexpired tokens.
+	var stillPublished []configv1alpha1.FederationDomainRetiredSigningKey
+	var stillPublishedKeys []jose.JSONWebKey
+	for _, retired := range keys.state.RetiredKeys {
+		if !now.Before(&retired.PublishedUntil) || retired.KeyID == keys.active.KeyID {
+			continue
+		}
+		for _, key := range keys.retired {
+			if key.KeyID == retired.KeyID {
+				stillPublished = append(stillPublished, retired)
+				stillPublishedKeys = append(stillPublishedKeys, key)
+				break
+			}
+		}
+	}
+	keys.state.RetiredKeys = stillPublished
+	keys.retired = stillPublishedKeys
+
+	return nil
+}
+
+// rotateKeysIfNeeded adds a next key when there is none and rotates the keys when a rotation is due.
+//
+// When the FederationDomain's signing algorithm has changed, the next key is replaced by a key of the new type,
+// which is published next to the active key of the old type until the next rotation makes it active. This gives
+// clients which cache the JWKS time to learn about the new key before any tokens are signed with it.
+func (c *jwksWriterController) rotateKeysIfNeeded(
+	keys *jwksKeys,
+	federationDomain *configv1alpha1.FederationDomain,
+	now metav1.Time,
+) error {
+	spec := federationDomain.Spec.SigningKeys
+
+	if keys.next == nil || !keyMatchesSpec(keys.next, spec) {
+		next, err := generateJWK(spec)
+		if err != nil {
+			return err
+		}
+		if keys.next != nil {
+			plog.Info("replaced next FederationDomain signing key with a key for the configured algorithm",
+				"federationdomain", klog.KObj(federationDomain),
+				"algorithm", next.Algorithm,
+				"replacedKeyID", keys.next.KeyID,
+				"nextKeyID", next.KeyID,
+			)
+		}
+		keys.next = next
+	}
+
+	if reason := c.rotationReason(keys.state, federationDomain); reason != "" {
+		next, err := generateJWK(spec)
+		if err != nil {
+			return err
+		}
+
+		retired := c.retireActiveKey(keys, federationDomain, now)
+
+		keys.state.RotationHistory = append([]configv1alpha1.FederationDomainSigningKeyRotation{{
+			Time:           now,
+			Reason:         reason,
+			ActivatedKeyID: keys.next.KeyID,
+			RetiredKeyID:   retired.KeyID,
+		}}, keys.state.RotationHistory...)
+		if len(keys.state.RotationHistory) > maxRotationHistory {
+			keys.state.RotationHistory = keys.state.RotationHistory[:maxRotationHistory]
+		}
+
+		keys.active, keys.next = keys.next, next
+		keys.state.ActiveSince = now
+		keys.state.HandledRotationRequest = spec.RotationRequest
+
+		plog.Info("rotated FederationDomain signing key",
+			"federationdomain", klog.KObj(federationDomain),
+			"reason", reason,
+			"algorithm", keys.active.Algorithm,
+			"activatedKeyID", keys.active.KeyID,
+			"retiredKeyID", retired.KeyID,
+		)
+	}
+
+	return nil
+}
+
+// useExternalSignerKey makes the external signer's public key the active key. The previous active key is retired,
+// since it may have signed unexpired tokens, while the next key is dropped, since it never signed any tokens.
+func (c *jwksWriterController) useExternalSignerKey(
+	keys *jwksKeys,
+	federationDomain *configv1alpha1.FederationDomain,
+	now metav1.Time,
+) {
+	keys.next = nil
+
+	external := c.externalSigner.Public()
+	if keys.active.KeyID == external.KeyID {
+		keys.active = external
+		return
+	}
+
+	retired := c.retireActiveKey(keys, federationDomain, now)
+	keys.active = external
+	keys.state.ActiveSince = now
+
+	plog.Info("using external signer for FederationDomain",
+		"federationdomain", klog.KObj(federationDomain),
+		"activatedKeyID", keys.active.KeyID,
+		"retiredKeyID", retired.KeyID,
+	)
+}
+
+// retireActiveKey keeps publishing the public key of the active key for as long as it may have signed unexpired
+// tokens. The caller must replace the active key.
+func (c *jwksWriterController) retireActiveKey(
+	keys *jwksKeys,
+	federationDomain *configv1alpha1.FederationDomain,
+	now metav1.Time,
+) jose.JSONWebKey {
+	idTokenLifespan := oidc.NewTimeoutsConfiguration(federationDomainTokenLifespans(federationDomain.Spec.Tokens)).IDTokenLifespan
+	retired := keys.active.Public()
+	keys.retired = append([]jose.JSONWebKey{retired}, keys.retired...)
+	keys.state.RetiredKeys = append([]configv1alpha1.FederationDomainRetiredSigningKey{{
+		KeyID:          retired.KeyID,
+		RetiredAt:      now,
+		PublishedUntil: metav1.NewTime(now.Add(idTokenLifespan + retiredJWKGracePeriod)),
+	}}, keys.state.RetiredKeys...)
+	return retired
+}
+
+// rotationReason returns why the keys should be rotated now, or an empty string when they should not be rotated.
+func (c *jwksWriterController) rotationReason(
+	state *jwksRotationState,
+	federationDomain *configv1alpha1.FederationDomain,
+) configv1alpha1.FederationDomainSigningKeyRotationReason {
+	spec := federationDomain.Spec.SigningKeys
+
+	if spec.RotationRequest != "" && spec.RotationRequest != state.HandledRotationRequest {
+		return configv1alpha1.RequestedFederationDomainSigningKeyRotationReason
+	}
+
+	if interval := rotationInterval(spec); interval > 0 && !c.clock.Now().Before(state.ActiveSince.Add(interval)) {
+		return configv1alpha1.ScheduledFederationDomainSigningKeyRotationReason
+	}
+
+	return ""
+}
+
+// rotationInterval returns the interval between scheduled rotations, or zero when there are no scheduled rotations.
+func rotationInterval(spec configv1alpha1.FederationDomainSigningKeysSpec) time.Duration {
+	if spec.RotationInterval == nil || spec.RotationInterval.Duration <= 0 {
+		return 0
+	}
+	if spec.RotationInterval.Duration < minimumRotationInterval {
+		return minimumRotationInterval
+	}
+	return spec.RotationInterval.Duration
+}
+
+// nextSyncTime returns the next time at which the keys will need to be updated, or the zero time when they will
+// not need to be updated unless the FederationDomain changes.
+func (c *jwksWriterController) nextSyncTime(keys *jwksKeys, federationDomain *configv1alpha1.FederationDomain) time.Time {
+	var next time.Time
+	earliest := func(t time.Time) {
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	if interval := rotationInterval(federationDomain.Spec.SigningKeys); interval > 0 && c.externalSigner == nil {
+		earliest(keys.state.ActiveSince.Add(interval))
+	}
+	for _, retired := range keys.state.RetiredKeys {
+		earliest(retired.PublishedUntil.Time)
+	}
+	return next
+}
+
+func signingKeysStatus(keys *jwksKeys) configv1alpha1.FederationDomainSigningKeysStatus {
+	activeSince := keys.state.ActiveSince
+	status := configv1alpha1.FederationDomainSigningKeysStatus{
+		ActiveKeyID:        keys.active.KeyID,
+		ActiveKeyAlgorithm: keys.active.Algorithm,
+		ActiveSince:        &activeSince,
+		RetiredKeys:        keys.state.RetiredKeys,
+		RotationHistory:    keys.state.RotationHistory,
+	}
+	if keys.next != nil {
+		status.NextKeyID = keys.next.KeyID
+		status.NextKeyAlgorithm = keys.next.Algorithm
+	}
+	return status
+}
+
+// generateJWK generates a new private signing key for the configured algorithm. Its key ID is the key's thumbprint,
+// so that each key has a unique key ID.
+func generateJWK(spec configv1alpha1.FederationDomainSigningKeysSpec) (*jose.JSONWebKey, error) {
+	alg, rsaKeySize := signingAlgorithm(spec)
+	key, err := generateKey(rand.Reader, alg, rsaKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate key: %w", err)
+	}
+
+	jwk := jose.JSONWebKey{
+		Key:       key,
+		Algorithm: string(alg),
+		Use:       "sig",
+	}
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("cannot compute key thumbprint: %w", err)
+	}
+	jwk.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+
+	return &jwk, nil
+}
+
+// readKeys parses the keys of a secret which is known to be valid.
+func readKeys(secret *corev1.Secret) (*jwksKeys, error) {
+	var active jose.JSONWebKey
+	if err := json.Unmarshal(secret.Data[activeJWKKey], &active); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal active jwk: %w", err)
+	}
+
+	var jwks jose.JSONWebKeySet
+	if err := json.Unmarshal(secret.Data[jwksKey], &jwks); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal jwks: %w", err)
+	}
+
+	keys := &jwksKeys{active: &active}
+
+	var next jose.JSONWebKey
+	if err := json.Unmarshal(secret.Data[nextJWKKey], &next); err == nil && !next.IsPublic() && next.Valid() &&
+		next.KeyID != active.KeyID && containsKeyID(jwks, next.KeyID) {
+		keys.next = &next
+	}
+
+	var state jwksRotationState
+	if err := json.Unmarshal(secret.Data[rotationStateKey], &state); err == nil {
+		keys.state = &state
+		for _, key := range jwks.Keys {
+			if key.KeyID == active.KeyID || (keys.next != nil && key.KeyID == keys.next.KeyID) {
+				continue
+			}
+			keys.retired = append(keys.retired, key)
+		}
+	}
+
+	return keys, nil
+}
+
+func containsKeyID(jwks jose.JSONWebKeySet, keyID string) bool {
+	for _, key := range jwks.Keys {
+		if key.KeyID == keyID {
+			return true
+		}
+	}
+	return false
+}
+
+// secretData returns the Data for a secret which holds these keys.
+func (k *jwksKeys) secretData() (map[string][]byte, error) {
+	activeData, err := json.Marshal(k.active)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal jwk: %w", err)
+	}
+
+	jwks := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{k.active.Public()}}
+	if k.next != nil {
+		jwks.Keys = append(jwks.Keys, k.next.Public())
+	}
+	jwks.Keys = append(jwks.Keys, k.retired...)
+	jwksData, err := json.Marshal(jwks)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal jwks: %w", err)
+	}
+
+	stateData, err := json.Marshal(k.state)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal rotation state: %w", err)
+	}
+
+	data := map[string][]byte{
+		activeJWKKey:     activeData,
+		jwksKey:          jwksData,
+		rotationStateKey: stateData,
+	}
+	if k.next != nil {
+		nextData, err := json.Marshal(k.next)
+		if err != nil {
+			return nil, fmt.Errorf("cannot marshal jwk: %w", err)
+		}
+		data[nextJWKKey] = nextData
+	}
+	return data, nil
+}
+
 func (c *jwksWriterController) createOrUpdateSecret(
 	ctx context.Context,
-	newSecret *corev1.Secret,
-) error {
-	secretClient := c.kubeClient.CoreV1().Secrets(newSecret.Namespace)
-	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		oldSecret, err := secretClient.Get(ctx, newSecret.Name, metav1.GetOptions{})
+	federationDomain *configv1alpha1.FederationDomain,
+) (*corev1.Secret, error) {
+	secretClient := c.kubeClient.CoreV1().Secrets(federationDomain.Namespace)
+	var result *corev1.Secret
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		// Decide what to change based on the secret from the API instead of the cache, to avoid rotating twice
+		// when the cache has not seen our previous update yet.
+		oldSecret, err := secretClient.Get(ctx, secretName(federationDomain), metav1.GetOptions{})
 		notFound := k8serrors.IsNotFound(err)
 		if err != nil && !notFound {
 			return fmt.Errorf("cannot get secret: %w", err)
 		}
 
-		if notFound {
-			// New secret doesn't exist, so create it.
-			_, err := secretClient.Create(ctx, newSecret, metav1.CreateOptions{})
+		if notFound || !c.isValid(oldSecret) {
+			// If the FederationDomain does not have a secret associated with it, that secret does not exist, or the
+			// secret is invalid, we will generate a new secret (i.e., a JWKS).
+			newSecret, err := c.generateSecret(federationDomain)
 			if err != nil {
-				return fmt.Errorf("cannot create secret: %w", err)
+				return fmt.Errorf("cannot generate secret: %w", err)
+			}
+
+			if notFound {
+				// New secret doesn't exist, so create it.
+				result, err = secretClient.Create(ctx, newSecret, metav1.CreateOptions{})
+				if err != nil {
+					return fmt.Errorf("cannot create secret: %w", err)
+				}
+				return nil
 			}
-			return nil
-		}
 
-		// New secret already exists, so ensure it is up to date.
+			oldSecret.Data = newSecret.Data
+			oldSecret.Type = jwksSecretTypeValue
+			result, err = secretClient.Update(ctx, oldSecret, metav1.UpdateOptions{})
+			return err
+		}
 
-		if isValid(oldSecret) {
-			// If the secret already has valid JWK's, then we are good to go and we don't need an update.
+		// The secret already has valid JWKs, so it only needs an update when its keys need to change.
+		keys, err := readKeys(oldSecret)
+		if err != nil {
+			return err
+		}
+		if !c.keysNeedUpdate(keys, federationDomain) {
+			result = oldSecret
 			return nil
 		}
 
-		oldSecret.Data = newSecret.Data
-		oldSecret.Type = jwksSecretTypeValue
-		_, err = secretClient.Update(ctx, oldSecret, metav1.UpdateOptions{})
+		if err := c.updateKeys(keys, federationDomain); err != nil {
+			return fmt.Errorf("cannot update keys: %w", err)
+		}
+		oldSecret.Data, err = keys.secretData()
+		if err != nil {
+			return err
+		}
+		result, err = secretClient.Update(ctx, oldSecret, metav1.UpdateOptions{})
 		return err
 	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
 func (c *jwksWriterController) updateFederationDomainStatus(
@@ -294,19 +780,22 @@ func (c *jwksWriterController) updateFederationDomainStatus(
 			return fmt.Errorf("cannot get FederationDomain: %w", err)
 		}
 
-		if newFederationDomain.Status.Secrets.JWKS.Name == oldFederationDomain.Status.Secrets.JWKS.Name {
+		if newFederationDomain.Status.Secrets.JWKS.Name == oldFederationDomain.Status.Secrets.JWKS.Name &&
+			equality.Semantic.DeepEqual(newFederationDomain.Status.SigningKeys, oldFederationDomain.Status.SigningKeys) {
 			// If the existing FederationDomain is up to date, we don't need to update it.
 			return nil
 		}
 
 		oldFederationDomain.Status.Secrets.JWKS.Name = newFederationDomain.Status.Secrets.JWKS.Name
+		oldFederationDomain.Status.SigningKeys = newFederationDomain.Status.SigningKeys
 		_, err = federationDomainClient.UpdateStatus(ctx, oldFederationDomain, metav1.UpdateOptions{})
 		return err
 	})
 }
 
-// isValid returns whether the provided secret contains a valid active JWK and verification JWKS.
-func isValid(secret *corev1.Secret) bool {
+// isValid returns whether the provided secret contains a valid active JWK and verification JWKS. The active JWK
+// must be a private key, unless the Supervisor uses an external signer.
+func (c *jwksWriterController) isValid(secret *corev1.Secret) bool {
 	if secret.Type != jwksSecretTypeValue {
 		plog.Debug("secret does not have the expected type", "expectedType", jwksSecretTypeValue, "actualType", secret.Type)
 		return false
@@ -324,7 +813,7 @@ func isValid(secret *corev1.Secret) bool {
 		return false
 	}
 
-	if activeJWK.IsPublic() {
+	if activeJWK.IsPublic() && c.externalSigner == nil {
 		plog.Debug("active jwk is public", "keyid", activeJWK.KeyID)
 		return false
 	}
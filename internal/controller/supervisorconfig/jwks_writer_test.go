@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package supervisorconfig
@@ -6,14 +6,23 @@ package supervisorconfig
 import (
 	"bytes"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"io"
 	"io/ioutil"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -21,11 +30,13 @@ import (
 	kubeinformers "k8s.io/client-go/informers"
 	kubernetesfake "k8s.io/client-go/kubernetes/fake"
 	kubetesting "k8s.io/client-go/testing"
+	clocktesting "k8s.io/utils/clock/testing"
 
 	configv1alpha1 "go.pinniped.dev/generated/latest/apis/supervisor/config/v1alpha1"
 	pinnipedfake "go.pinniped.dev/generated/latest/client/supervisor/clientset/versioned/fake"
 	pinnipedinformers "go.pinniped.dev/generated/latest/client/supervisor/informers/externalversions"
 	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/oidc/signer"
 	"go.pinniped.dev/internal/testutil"
 )
 
@@ -182,6 +193,8 @@ func TestJWKSWriterControllerFilterSecret(t *testing.T) {
 			withInformer := testutil.NewObservableWithInformerOption()
 			_ = NewJWKSWriterController(
 				nil, // labels, not needed
+				nil, // externalSigner, not needed
+				nil, // clock, not needed
 				nil, // kubeClient, not needed
 				nil, // pinnipedClient, not needed
 				secretInformer,
@@ -236,6 +249,8 @@ func TestJWKSWriterControllerFilterFederationDomain(t *testing.T) {
 			withInformer := testutil.NewObservableWithInformerOption()
 			_ = NewJWKSWriterController(
 				nil, // labels, not needed
+				nil, // externalSigner, not needed
+				nil, // clock, not needed
 				nil, // kubeClient, not needed
 				nil, // pinnipedClient, not needed
 				secretInformer,
@@ -257,7 +272,13 @@ func TestJWKSWriterControllerFilterFederationDomain(t *testing.T) {
 func TestJWKSWriterControllerSync(t *testing.T) {
 	// We shouldn't run this test in parallel since it messes with a global function (generateKey).
 
-	const namespace = "tuna-namespace"
+	const (
+		namespace       = "tuna-namespace"
+		idTokenLifespan = 2 * time.Minute
+	)
+
+	now := time.Date(2022, 5, 12, 3, 4, 5, 0, time.Local)
+	retiredKeyPublishedUntil := metav1.NewTime(now.Add(idTokenLifespan + 5*time.Minute))
 
 	goodKeyPEM, err := ioutil.ReadFile("testdata/good-ec-key.pem")
 	require.NoError(t, err)
@@ -266,6 +287,52 @@ func TestJWKSWriterControllerSync(t *testing.T) {
 	goodKey, err := x509.ParseECPrivateKey(block.Bytes)
 	require.NoError(t, err)
 
+	// These keys are returned by generateKey in this order.
+	var generatedKeys []*ecdsa.PrivateKey
+	for i := 0; i < 3; i++ {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		generatedKeys = append(generatedKeys, key)
+	}
+
+	// These RSA keys are returned by generateKey in this order when it is asked for RSA keys of their size.
+	generatedRSAKeys := map[int][]*rsa.PrivateKey{}
+	for _, size := range []int{2048, 2048, 3072} {
+		key, err := rsa.GenerateKey(rand.Reader, size)
+		require.NoError(t, err)
+		generatedRSAKeys[size] = append(generatedRSAKeys[size], key)
+	}
+
+	jwkForKeyWithAlgorithm := func(key interface{}, alg string) *jose.JSONWebKey {
+		jwk := &jose.JSONWebKey{Key: key, Algorithm: alg, Use: "sig"}
+		thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+		require.NoError(t, err)
+		jwk.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+		return jwk
+	}
+	jwkForKey := func(key *ecdsa.PrivateKey) *jose.JSONWebKey {
+		return jwkForKeyWithAlgorithm(key, "ES256")
+	}
+	generatedJWK1 := jwkForKey(generatedKeys[0])
+	generatedJWK2 := jwkForKey(generatedKeys[1])
+	existingActiveJWK := jwkForKey(goodKey)
+	existingNextJWK := jwkForKey(generatedKeys[2])
+	generatedRSAJWK1 := jwkForKeyWithAlgorithm(generatedRSAKeys[2048][0], "RS256")
+	generatedRSAJWK2 := jwkForKeyWithAlgorithm(generatedRSAKeys[2048][1], "RS256")
+	generatedLargeRSAJWK := jwkForKeyWithAlgorithm(generatedRSAKeys[3072][0], "RS256")
+	legacyActiveJWK := &jose.JSONWebKey{}
+	require.NoError(t, json.Unmarshal(readJWKJSON(t, "testdata/good-jwk.json"), legacyActiveJWK))
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	retiredJWK := jwkForKey(otherKey)
+
+	externalKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	externalSigner, err := signer.NewJWKSigner(&jose.JSONWebKey{Key: externalKey, KeyID: "some-external-key-id"})
+	require.NoError(t, err)
+	externalJWK := externalSigner.Public()
+
 	federationDomainGVR := schema.GroupVersionResource{
 		Group:    configv1alpha1.SchemeGroupVersion.Group,
 		Version:  configv1alpha1.SchemeGroupVersion.Version,
@@ -285,6 +352,33 @@ func TestJWKSWriterControllerSync(t *testing.T) {
 	goodFederationDomainWithStatus := goodFederationDomain.DeepCopy()
 	goodFederationDomainWithStatus.Status.Secrets.JWKS.Name = goodFederationDomainWithStatus.Name + "-jwks"
 
+	withSpec := func(federationDomain *configv1alpha1.FederationDomain, spec configv1alpha1.FederationDomainSigningKeysSpec) *configv1alpha1.FederationDomain {
+		federationDomain = federationDomain.DeepCopy()
+		federationDomain.Spec.SigningKeys = spec
+		return federationDomain
+	}
+
+	withTokens := func(federationDomain *configv1alpha1.FederationDomain, tokens configv1alpha1.FederationDomainTokensSpec) *configv1alpha1.FederationDomain {
+		federationDomain = federationDomain.DeepCopy()
+		federationDomain.Spec.Tokens = tokens
+		return federationDomain
+	}
+
+	withSigningKeysStatus := func(
+		federationDomain *configv1alpha1.FederationDomain,
+		status configv1alpha1.FederationDomainSigningKeysStatus,
+	) *configv1alpha1.FederationDomain {
+		federationDomain = federationDomain.DeepCopy()
+		federationDomain.Status.Secrets.JWKS.Name = federationDomain.Name + "-jwks"
+		federationDomain.Status.SigningKeys = status
+		return federationDomain
+	}
+
+	timePtr := func(t time.Time) *metav1.Time {
+		mt := metav1.NewTime(t)
+		return &mt
+	}
+
 	secretGVR := schema.GroupVersionResource{
 		Group:    corev1.SchemeGroupVersion.Group,
 		Version:  corev1.SchemeGroupVersion.Version,
@@ -323,7 +417,108 @@ func TestJWKSWriterControllerSync(t *testing.T) {
 		return &s
 	}
 
-	goodSecret := newSecret("testdata/good-jwk.json", "testdata/good-jwks.json")
+	// newSecretWithKeys returns a secret in the format which is written by the controller.
+	newSecretWithKeys := func(active, next *jose.JSONWebKey, retired []*jose.JSONWebKey, state *jwksRotationState) *corev1.Secret {
+		s := newSecret("", "")
+
+		activeData, err := json.Marshal(active)
+		require.NoError(t, err)
+		s.Data["activeJWK"] = activeData
+
+		jwks := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{active.Public()}}
+		if next != nil {
+			nextData, err := json.Marshal(next)
+			require.NoError(t, err)
+			s.Data["nextJWK"] = nextData
+			jwks.Keys = append(jwks.Keys, next.Public())
+		}
+		for _, key := range retired {
+			jwks.Keys = append(jwks.Keys, key.Public())
+		}
+		jwksData, err := json.Marshal(jwks)
+		require.NoError(t, err)
+		s.Data["jwks"] = jwksData
+
+		stateData, err := json.Marshal(state)
+		require.NoError(t, err)
+		s.Data["rotationState"] = stateData
+
+		return s
+	}
+
+	// A secret which was written by the controller an hour ago while using the external signer.
+	upToDateExternalSecret := newSecretWithKeys(externalJWK, nil, nil, &jwksRotationState{
+		ActiveSince: metav1.NewTime(now.Add(-time.Hour)),
+	})
+	upToDateExternalSigningKeysStatus := configv1alpha1.FederationDomainSigningKeysStatus{
+		ActiveKeyID:        externalJWK.KeyID,
+		ActiveKeyAlgorithm: "ES256",
+		ActiveSince:        timePtr(now.Add(-time.Hour)),
+	}
+
+	// The secret which the controller writes for a brand new FederationDomain.
+	generatedSecret := newSecretWithKeys(generatedJWK1, generatedJWK2, nil, &jwksRotationState{
+		ActiveSince: metav1.NewTime(now),
+	})
+	generatedSigningKeysStatus := configv1alpha1.FederationDomainSigningKeysStatus{
+		ActiveKeyID:        generatedJWK1.KeyID,
+		ActiveKeyAlgorithm: "ES256",
+		ActiveSince:        timePtr(now),
+		NextKeyID:          generatedJWK2.KeyID,
+		NextKeyAlgorithm:   "ES256",
+	}
+
+	// A secret which was written by the controller an hour ago, whose keys do not need to change.
+	upToDateSecret := newSecretWithKeys(existingActiveJWK, existingNextJWK, nil, &jwksRotationState{
+		ActiveSince:            metav1.NewTime(now.Add(-time.Hour)),
+		HandledRotationRequest: "some-old-request",
+	})
+	upToDateSigningKeysStatus := configv1alpha1.FederationDomainSigningKeysStatus{
+		ActiveKeyID:        existingActiveJWK.KeyID,
+		ActiveKeyAlgorithm: "ES256",
+		ActiveSince:        timePtr(now.Add(-time.Hour)),
+		NextKeyID:          existingNextJWK.KeyID,
+		NextKeyAlgorithm:   "ES256",
+	}
+
+	// What happens to upToDateSecret when its keys are rotated now.
+	rotatedSecret := func(reason configv1alpha1.FederationDomainSigningKeyRotationReason, handledRequest string) *corev1.Secret {
+		return newSecretWithKeys(existingNextJWK, generatedJWK1, []*jose.JSONWebKey{existingActiveJWK}, &jwksRotationState{
+			ActiveSince: metav1.NewTime(now),
+			RetiredKeys: []configv1alpha1.FederationDomainRetiredSigningKey{
+				{KeyID: existingActiveJWK.KeyID, RetiredAt: metav1.NewTime(now), PublishedUntil: retiredKeyPublishedUntil},
+			},
+			HandledRotationRequest: handledRequest,
+			RotationHistory: []configv1alpha1.FederationDomainSigningKeyRotation{
+				{Time: metav1.NewTime(now), Reason: reason, ActivatedKeyID: existingNextJWK.KeyID, RetiredKeyID: existingActiveJWK.KeyID},
+			},
+		})
+	}
+	rotatedSigningKeysStatus := func(reason configv1alpha1.FederationDomainSigningKeyRotationReason) configv1alpha1.FederationDomainSigningKeysStatus {
+		return configv1alpha1.FederationDomainSigningKeysStatus{
+			ActiveKeyID:        existingNextJWK.KeyID,
+			ActiveKeyAlgorithm: "ES256",
+			ActiveSince:        timePtr(now),
+			NextKeyID:          generatedJWK1.KeyID,
+			NextKeyAlgorithm:   "ES256",
+			RetiredKeys: []configv1alpha1.FederationDomainRetiredSigningKey{
+				{KeyID: existingActiveJWK.KeyID, RetiredAt: metav1.NewTime(now), PublishedUntil: retiredKeyPublishedUntil},
+			},
+			RotationHistory: []configv1alpha1.FederationDomainSigningKeyRotation{
+				{Time: metav1.NewTime(now), Reason: reason, ActivatedKeyID: existingNextJWK.KeyID, RetiredKeyID: existingActiveJWK.KeyID},
+			},
+		}
+	}
+
+	longRotationHistory := make([]configv1alpha1.FederationDomainSigningKeyRotation, 10)
+	for i := range longRotationHistory {
+		longRotationHistory[i] = configv1alpha1.FederationDomainSigningKeyRotation{
+			Time:           metav1.NewTime(now.Add(-time.Duration(i+2) * time.Hour)),
+			Reason:         configv1alpha1.RequestedFederationDomainSigningKeyRotationReason,
+			ActivatedKeyID: "some-old-activated-key-id",
+			RetiredKeyID:   "some-old-retired-key-id",
+		}
+	}
 
 	secretWithWrongType := newSecret("testdata/good-jwk.json", "testdata/good-jwks.json")
 	secretWithWrongType.Type = "not-the-right-type"
@@ -335,10 +530,12 @@ func TestJWKSWriterControllerSync(t *testing.T) {
 		configKubeClient            func(*kubernetesfake.Clientset)
 		configPinnipedClient        func(*pinnipedfake.Clientset)
 		federationDomains           []*configv1alpha1.FederationDomain
+		externalSigner              signer.Signer
 		generateKeyErr              error
 		wantGenerateKeyCount        int
 		wantSecretActions           []kubetesting.Action
 		wantFederationDomainActions []kubetesting.Action
+		wantRequeueAfter            time.Duration
 		wantError                   string
 	}{
 		{
@@ -347,14 +544,29 @@ func TestJWKSWriterControllerSync(t *testing.T) {
 			federationDomains: []*configv1alpha1.FederationDomain{
 				goodFederationDomain,
 			},
-			wantGenerateKeyCount: 1,
+			wantGenerateKeyCount: 2,
 			wantSecretActions: []kubetesting.Action{
-				kubetesting.NewGetAction(secretGVR, namespace, goodSecret.Name),
-				kubetesting.NewCreateAction(secretGVR, namespace, goodSecret),
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewCreateAction(secretGVR, namespace, generatedSecret),
 			},
 			wantFederationDomainActions: []kubetesting.Action{
 				kubetesting.NewGetAction(federationDomainGVR, namespace, goodFederationDomain.Name),
-				kubetesting.NewUpdateSubresourceAction(federationDomainGVR, "status", namespace, goodFederationDomainWithStatus),
+				kubetesting.NewUpdateSubresourceAction(federationDomainGVR, "status", namespace, withSigningKeysStatus(goodFederationDomain, generatedSigningKeysStatus)),
+			},
+		},
+		{
+			name: "new federationDomain with a rotation request does not rotate the new keys",
+			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
+			federationDomains: []*configv1alpha1.FederationDomain{
+				withSpec(goodFederationDomain, configv1alpha1.FederationDomainSigningKeysSpec{RotationRequest: "some-request"}),
+			},
+			wantGenerateKeyCount: 2,
+			wantSecretActions: []kubetesting.Action{
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewCreateAction(secretGVR, namespace, newSecretWithKeys(generatedJWK1, generatedJWK2, nil, &jwksRotationState{
+					ActiveSince:            metav1.NewTime(now),
+					HandledRotationRequest: "some-request",
+				})),
 			},
 		},
 		{
@@ -364,40 +576,71 @@ func TestJWKSWriterControllerSync(t *testing.T) {
 				goodFederationDomain,
 			},
 			secrets: []*corev1.Secret{
-				goodSecret,
-			},
-			wantGenerateKeyCount: 1,
-			wantSecretActions: []kubetesting.Action{
-				kubetesting.NewGetAction(secretGVR, namespace, goodSecret.Name),
+				upToDateSecret,
 			},
+			wantSecretActions: []kubetesting.Action{},
 			wantFederationDomainActions: []kubetesting.Action{
 				kubetesting.NewGetAction(federationDomainGVR, namespace, goodFederationDomain.Name),
-				kubetesting.NewUpdateSubresourceAction(federationDomainGVR, "status", namespace, goodFederationDomainWithStatus),
+				kubetesting.NewUpdateSubresourceAction(federationDomainGVR, "status", namespace, withSigningKeysStatus(goodFederationDomain, upToDateSigningKeysStatus)),
 			},
 		},
 		{
 			name: "existing federationDomain with no secret",
 			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
 			federationDomains: []*configv1alpha1.FederationDomain{
-				goodFederationDomainWithStatus,
+				withSigningKeysStatus(goodFederationDomain, upToDateSigningKeysStatus),
 			},
-			wantGenerateKeyCount: 1,
+			wantGenerateKeyCount: 2,
 			wantSecretActions: []kubetesting.Action{
-				kubetesting.NewGetAction(secretGVR, namespace, goodSecret.Name),
-				kubetesting.NewCreateAction(secretGVR, namespace, goodSecret),
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewCreateAction(secretGVR, namespace, generatedSecret),
 			},
 			wantFederationDomainActions: []kubetesting.Action{
 				kubetesting.NewGetAction(federationDomainGVR, namespace, goodFederationDomain.Name),
+				kubetesting.NewUpdateSubresourceAction(federationDomainGVR, "status", namespace, withSigningKeysStatus(goodFederationDomain, generatedSigningKeysStatus)),
 			},
 		},
 		{
 			name: "existing federationDomain with existing secret",
 			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
 			federationDomains: []*configv1alpha1.FederationDomain{
-				goodFederationDomainWithStatus,
+				withSigningKeysStatus(goodFederationDomain, upToDateSigningKeysStatus),
+			},
+			secrets: []*corev1.Secret{
+				upToDateSecret,
+			},
+			wantSecretActions:           []kubetesting.Action{},
+			wantFederationDomainActions: []kubetesting.Action{},
+		},
+		{
+			name: "existing federationDomain with secret written by an older version of the Supervisor",
+			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
+			federationDomains: []*configv1alpha1.FederationDomain{
+				withSpec(goodFederationDomainWithStatus, configv1alpha1.FederationDomainSigningKeysSpec{RotationRequest: "some-request"}),
 			},
 			secrets: []*corev1.Secret{
-				goodSecret,
+				newSecret("testdata/good-jwk.json", "testdata/good-jwks.json"),
+			},
+			wantGenerateKeyCount: 1,
+			wantSecretActions: []kubetesting.Action{
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewUpdateAction(secretGVR, namespace, newSecretWithKeys(legacyActiveJWK, generatedJWK1, nil, &jwksRotationState{
+					ActiveSince:            metav1.NewTime(now),
+					HandledRotationRequest: "some-request",
+				})),
+			},
+			wantFederationDomainActions: []kubetesting.Action{
+				kubetesting.NewGetAction(federationDomainGVR, namespace, goodFederationDomain.Name),
+				kubetesting.NewUpdateSubresourceAction(federationDomainGVR, "status", namespace, withSigningKeysStatus(
+					withSpec(goodFederationDomain, configv1alpha1.FederationDomainSigningKeysSpec{RotationRequest: "some-request"}),
+					configv1alpha1.FederationDomainSigningKeysStatus{
+						ActiveKeyID:        "pinniped-supervisor-key",
+						ActiveKeyAlgorithm: "ES256",
+						ActiveSince:        timePtr(now),
+						NextKeyID:          generatedJWK1.KeyID,
+						NextKeyAlgorithm:   "ES256",
+					},
+				)),
 			},
 		},
 		{
@@ -409,180 +652,740 @@ func TestJWKSWriterControllerSync(t *testing.T) {
 			name: "missing jwk in secret",
 			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
 			federationDomains: []*configv1alpha1.FederationDomain{
-				goodFederationDomainWithStatus,
+				withSigningKeysStatus(goodFederationDomain, generatedSigningKeysStatus),
 			},
 			secrets: []*corev1.Secret{
 				newSecret("", "testdata/good-jwks.json"),
 			},
+			wantGenerateKeyCount: 2,
+			wantSecretActions: []kubetesting.Action{
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewUpdateAction(secretGVR, namespace, generatedSecret),
+			},
+			wantFederationDomainActions: []kubetesting.Action{},
+		},
+		{
+			name: "missing jwks in secret",
+			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
+			federationDomains: []*configv1alpha1.FederationDomain{
+				withSigningKeysStatus(goodFederationDomain, generatedSigningKeysStatus),
+			},
+			secrets: []*corev1.Secret{
+				newSecret("testdata/good-jwk.json", ""),
+			},
+			wantGenerateKeyCount: 2,
+			wantSecretActions: []kubetesting.Action{
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewUpdateAction(secretGVR, namespace, generatedSecret),
+			},
+			wantFederationDomainActions: []kubetesting.Action{},
+		},
+		{
+			name: "wrong type in secret",
+			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
+			federationDomains: []*configv1alpha1.FederationDomain{
+				withSigningKeysStatus(goodFederationDomain, generatedSigningKeysStatus),
+			},
+			secrets: []*corev1.Secret{
+				secretWithWrongType,
+			},
+			wantGenerateKeyCount: 2,
+			wantSecretActions: []kubetesting.Action{
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewUpdateAction(secretGVR, namespace, generatedSecret),
+			},
+			wantFederationDomainActions: []kubetesting.Action{},
+		},
+		{
+			name: "invalid jwk JSON in secret",
+			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
+			federationDomains: []*configv1alpha1.FederationDomain{
+				withSigningKeysStatus(goodFederationDomain, generatedSigningKeysStatus),
+			},
+			secrets: []*corev1.Secret{
+				newSecret("testdata/not-json.txt", "testdata/good-jwks.json"),
+			},
+			wantGenerateKeyCount: 2,
+			wantSecretActions: []kubetesting.Action{
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewUpdateAction(secretGVR, namespace, generatedSecret),
+			},
+			wantFederationDomainActions: []kubetesting.Action{},
+		},
+		{
+			name: "invalid jwks JSON in secret",
+			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
+			federationDomains: []*configv1alpha1.FederationDomain{
+				withSigningKeysStatus(goodFederationDomain, generatedSigningKeysStatus),
+			},
+			secrets: []*corev1.Secret{
+				newSecret("testdata/good-jwk.json", "testdata/not-json.txt"),
+			},
+			wantGenerateKeyCount: 2,
+			wantSecretActions: []kubetesting.Action{
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewUpdateAction(secretGVR, namespace, generatedSecret),
+			},
+			wantFederationDomainActions: []kubetesting.Action{},
+		},
+		{
+			name: "public jwk in secret",
+			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
+			federationDomains: []*configv1alpha1.FederationDomain{
+				withSigningKeysStatus(goodFederationDomain, generatedSigningKeysStatus),
+			},
+			secrets: []*corev1.Secret{
+				newSecret("testdata/public-jwk.json", "testdata/good-jwks.json"),
+			},
+			wantGenerateKeyCount: 2,
+			wantSecretActions: []kubetesting.Action{
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewUpdateAction(secretGVR, namespace, generatedSecret),
+			},
+			wantFederationDomainActions: []kubetesting.Action{},
+		},
+		{
+			name: "private jwks in secret",
+			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
+			federationDomains: []*configv1alpha1.FederationDomain{
+				withSigningKeysStatus(goodFederationDomain, generatedSigningKeysStatus),
+			},
+			secrets: []*corev1.Secret{
+				newSecret("testdata/good-jwk.json", "testdata/private-jwks.json"),
+			},
+			wantGenerateKeyCount: 2,
+			wantSecretActions: []kubetesting.Action{
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewUpdateAction(secretGVR, namespace, generatedSecret),
+			},
+			wantFederationDomainActions: []kubetesting.Action{},
+		},
+		{
+			name: "invalid jwk key in secret",
+			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
+			federationDomains: []*configv1alpha1.FederationDomain{
+				withSigningKeysStatus(goodFederationDomain, generatedSigningKeysStatus),
+			},
+			secrets: []*corev1.Secret{
+				newSecret("testdata/invalid-key-jwk.json", "testdata/good-jwks.json"),
+			},
+			wantGenerateKeyCount: 2,
+			wantSecretActions: []kubetesting.Action{
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewUpdateAction(secretGVR, namespace, generatedSecret),
+			},
+			wantFederationDomainActions: []kubetesting.Action{},
+		},
+		{
+			name: "invalid jwks key in secret",
+			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
+			federationDomains: []*configv1alpha1.FederationDomain{
+				withSigningKeysStatus(goodFederationDomain, generatedSigningKeysStatus),
+			},
+			secrets: []*corev1.Secret{
+				newSecret("testdata/good-jwk.json", "testdata/invalid-key-jwks.json"),
+			},
+			wantGenerateKeyCount: 2,
+			wantSecretActions: []kubetesting.Action{
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewUpdateAction(secretGVR, namespace, generatedSecret),
+			},
+			wantFederationDomainActions: []kubetesting.Action{},
+		},
+		{
+			name: "missing active jwks in secret",
+			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
+			federationDomains: []*configv1alpha1.FederationDomain{
+				withSigningKeysStatus(goodFederationDomain, generatedSigningKeysStatus),
+			},
+			secrets: []*corev1.Secret{
+				newSecret("testdata/good-jwk.json", "testdata/missing-active-jwks.json"),
+			},
+			wantGenerateKeyCount: 2,
+			wantSecretActions: []kubetesting.Action{
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewUpdateAction(secretGVR, namespace, generatedSecret),
+			},
+			wantFederationDomainActions: []kubetesting.Action{},
+		},
+		{
+			name: "invalid next jwk in secret is replaced without rotating",
+			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
+			federationDomains: []*configv1alpha1.FederationDomain{
+				withSigningKeysStatus(goodFederationDomain, upToDateSigningKeysStatus),
+			},
+			secrets: []*corev1.Secret{
+				func() *corev1.Secret {
+					s := upToDateSecret.DeepCopy()
+					s.Data["nextJWK"] = []byte("bad")
+					return s
+				}(),
+			},
 			wantGenerateKeyCount: 1,
 			wantSecretActions: []kubetesting.Action{
-				kubetesting.NewGetAction(secretGVR, namespace, goodSecret.Name),
-				kubetesting.NewUpdateAction(secretGVR, namespace, goodSecret),
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewUpdateAction(secretGVR, namespace, newSecretWithKeys(existingActiveJWK, generatedJWK1, nil, &jwksRotationState{
+					ActiveSince:            metav1.NewTime(now.Add(-time.Hour)),
+					HandledRotationRequest: "some-old-request",
+				})),
 			},
 			wantFederationDomainActions: []kubetesting.Action{
 				kubetesting.NewGetAction(federationDomainGVR, namespace, goodFederationDomain.Name),
+				kubetesting.NewUpdateSubresourceAction(federationDomainGVR, "status", namespace, withSigningKeysStatus(goodFederationDomain,
+					configv1alpha1.FederationDomainSigningKeysStatus{
+						ActiveKeyID:        existingActiveJWK.KeyID,
+						ActiveKeyAlgorithm: "ES256",
+						ActiveSince:        timePtr(now.Add(-time.Hour)),
+						NextKeyID:          generatedJWK1.KeyID,
+						NextKeyAlgorithm:   "ES256",
+					},
+				)),
 			},
 		},
 		{
-			name: "missing jwks in secret",
+			name: "new rotation request rotates the keys",
 			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
 			federationDomains: []*configv1alpha1.FederationDomain{
-				goodFederationDomainWithStatus,
+				withSigningKeysStatus(
+					withSpec(goodFederationDomain, configv1alpha1.FederationDomainSigningKeysSpec{RotationRequest: "some-new-request"}),
+					upToDateSigningKeysStatus,
+				),
 			},
 			secrets: []*corev1.Secret{
-				newSecret("testdata/good-jwk.json", ""),
+				upToDateSecret,
 			},
 			wantGenerateKeyCount: 1,
 			wantSecretActions: []kubetesting.Action{
-				kubetesting.NewGetAction(secretGVR, namespace, goodSecret.Name),
-				kubetesting.NewUpdateAction(secretGVR, namespace, goodSecret),
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewUpdateAction(secretGVR, namespace, rotatedSecret(configv1alpha1.RequestedFederationDomainSigningKeyRotationReason, "some-new-request")),
 			},
 			wantFederationDomainActions: []kubetesting.Action{
 				kubetesting.NewGetAction(federationDomainGVR, namespace, goodFederationDomain.Name),
+				kubetesting.NewUpdateSubresourceAction(federationDomainGVR, "status", namespace, withSigningKeysStatus(
+					withSpec(goodFederationDomain, configv1alpha1.FederationDomainSigningKeysSpec{RotationRequest: "some-new-request"}),
+					rotatedSigningKeysStatus(configv1alpha1.RequestedFederationDomainSigningKeyRotationReason),
+				)),
 			},
+			wantRequeueAfter: idTokenLifespan + 5*time.Minute,
 		},
 		{
-			name: "wrong type in secret",
+			name: "rotation request keeps the retired key published for the configured ID token lifespan",
 			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
 			federationDomains: []*configv1alpha1.FederationDomain{
-				goodFederationDomainWithStatus,
+				withSigningKeysStatus(
+					withTokens(
+						withSpec(goodFederationDomain, configv1alpha1.FederationDomainSigningKeysSpec{RotationRequest: "some-new-request"}),
+						configv1alpha1.FederationDomainTokensSpec{IDTokenLifespan: &metav1.Duration{Duration: 30 * time.Minute}},
+					),
+					upToDateSigningKeysStatus,
+				),
 			},
 			secrets: []*corev1.Secret{
-				secretWithWrongType,
+				upToDateSecret,
 			},
 			wantGenerateKeyCount: 1,
 			wantSecretActions: []kubetesting.Action{
-				kubetesting.NewGetAction(secretGVR, namespace, goodSecret.Name),
-				kubetesting.NewUpdateAction(secretGVR, namespace, goodSecret),
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewUpdateAction(secretGVR, namespace, newSecretWithKeys(existingNextJWK, generatedJWK1, []*jose.JSONWebKey{existingActiveJWK}, &jwksRotationState{
+					ActiveSince: metav1.NewTime(now),
+					RetiredKeys: []configv1alpha1.FederationDomainRetiredSigningKey{
+						{KeyID: existingActiveJWK.KeyID, RetiredAt: metav1.NewTime(now), PublishedUntil: metav1.NewTime(now.Add(35 * time.Minute))},
+					},
+					HandledRotationRequest: "some-new-request",
+					RotationHistory: []configv1alpha1.FederationDomainSigningKeyRotation{
+						{Time: metav1.NewTime(now), Reason: configv1alpha1.RequestedFederationDomainSigningKeyRotationReason, ActivatedKeyID: existingNextJWK.KeyID, RetiredKeyID: existingActiveJWK.KeyID},
+					},
+				})),
 			},
 			wantFederationDomainActions: []kubetesting.Action{
 				kubetesting.NewGetAction(federationDomainGVR, namespace, goodFederationDomain.Name),
+				kubetesting.NewUpdateSubresourceAction(federationDomainGVR, "status", namespace, withSigningKeysStatus(
+					withTokens(
+						withSpec(goodFederationDomain, configv1alpha1.FederationDomainSigningKeysSpec{RotationRequest: "some-new-request"}),
+						configv1alpha1.FederationDomainTokensSpec{IDTokenLifespan: &metav1.Duration{Duration: 30 * time.Minute}},
+					),
+					func() configv1alpha1.FederationDomainSigningKeysStatus {
+						status := rotatedSigningKeysStatus(configv1alpha1.RequestedFederationDomainSigningKeyRotationReason)
+						status.RetiredKeys[0].PublishedUntil = metav1.NewTime(now.Add(35 * time.Minute))
+						return status
+					}(),
+				)),
+			},
+			wantRequeueAfter: 35 * time.Minute,
+		},
+		{
+			name: "rotation request which was already handled does not rotate the keys",
+			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
+			federationDomains: []*configv1alpha1.FederationDomain{
+				withSigningKeysStatus(
+					withSpec(goodFederationDomain, configv1alpha1.FederationDomainSigningKeysSpec{RotationRequest: "some-old-request"}),
+					upToDateSigningKeysStatus,
+				),
+			},
+			secrets: []*corev1.Secret{
+				upToDateSecret,
 			},
+			wantSecretActions:           []kubetesting.Action{},
+			wantFederationDomainActions: []kubetesting.Action{},
 		},
 		{
-			name: "invalid jwk JSON in secret",
+			name: "rotation interval which has passed rotates the keys",
 			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
 			federationDomains: []*configv1alpha1.FederationDomain{
-				goodFederationDomainWithStatus,
+				withSigningKeysStatus(
+					withSpec(goodFederationDomain, configv1alpha1.FederationDomainSigningKeysSpec{
+						RotationInterval: &metav1.Duration{Duration: time.Hour},
+						RotationRequest:  "some-old-request",
+					}),
+					upToDateSigningKeysStatus,
+				),
 			},
 			secrets: []*corev1.Secret{
-				newSecret("testdata/not-json.txt", "testdata/good-jwks.json"),
+				upToDateSecret,
 			},
 			wantGenerateKeyCount: 1,
 			wantSecretActions: []kubetesting.Action{
-				kubetesting.NewGetAction(secretGVR, namespace, goodSecret.Name),
-				kubetesting.NewUpdateAction(secretGVR, namespace, goodSecret),
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewUpdateAction(secretGVR, namespace, rotatedSecret(configv1alpha1.ScheduledFederationDomainSigningKeyRotationReason, "some-old-request")),
 			},
 			wantFederationDomainActions: []kubetesting.Action{
 				kubetesting.NewGetAction(federationDomainGVR, namespace, goodFederationDomain.Name),
+				kubetesting.NewUpdateSubresourceAction(federationDomainGVR, "status", namespace, withSigningKeysStatus(
+					withSpec(goodFederationDomain, configv1alpha1.FederationDomainSigningKeysSpec{
+						RotationInterval: &metav1.Duration{Duration: time.Hour},
+						RotationRequest:  "some-old-request",
+					}),
+					rotatedSigningKeysStatus(configv1alpha1.ScheduledFederationDomainSigningKeyRotationReason),
+				)),
+			},
+			wantRequeueAfter: idTokenLifespan + 5*time.Minute,
+		},
+		{
+			name: "rotation interval which has not passed yet requeues for the next rotation",
+			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
+			federationDomains: []*configv1alpha1.FederationDomain{
+				withSigningKeysStatus(
+					withSpec(goodFederationDomain, configv1alpha1.FederationDomainSigningKeysSpec{RotationInterval: &metav1.Duration{Duration: 24 * time.Hour}}),
+					upToDateSigningKeysStatus,
+				),
 			},
+			secrets: []*corev1.Secret{
+				upToDateSecret,
+			},
+			wantSecretActions:           []kubetesting.Action{},
+			wantFederationDomainActions: []kubetesting.Action{},
+			wantRequeueAfter:            23 * time.Hour,
 		},
 		{
-			name: "invalid jwks JSON in secret",
+			name: "rotation interval which is shorter than the minimum is treated as the minimum",
 			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
 			federationDomains: []*configv1alpha1.FederationDomain{
-				goodFederationDomainWithStatus,
+				withSigningKeysStatus(
+					withSpec(goodFederationDomain, configv1alpha1.FederationDomainSigningKeysSpec{RotationInterval: &metav1.Duration{Duration: time.Second}}),
+					configv1alpha1.FederationDomainSigningKeysStatus{
+						ActiveKeyID:        existingActiveJWK.KeyID,
+						ActiveKeyAlgorithm: "ES256",
+						ActiveSince:        timePtr(now.Add(-30 * time.Minute)),
+						NextKeyID:          existingNextJWK.KeyID,
+						NextKeyAlgorithm:   "ES256",
+					},
+				),
 			},
 			secrets: []*corev1.Secret{
-				newSecret("testdata/good-jwk.json", "testdata/not-json.txt"),
+				newSecretWithKeys(existingActiveJWK, existingNextJWK, nil, &jwksRotationState{
+					ActiveSince: metav1.NewTime(now.Add(-30 * time.Minute)),
+				}),
+			},
+			wantSecretActions:           []kubetesting.Action{},
+			wantFederationDomainActions: []kubetesting.Action{},
+			wantRequeueAfter:            30 * time.Minute,
+		},
+		{
+			name: "retired key which may still have signed unexpired tokens stays published",
+			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
+			federationDomains: []*configv1alpha1.FederationDomain{
+				withSigningKeysStatus(goodFederationDomain, configv1alpha1.FederationDomainSigningKeysStatus{
+					ActiveKeyID:        existingActiveJWK.KeyID,
+					ActiveKeyAlgorithm: "ES256",
+					ActiveSince:        timePtr(now.Add(-time.Minute)),
+					NextKeyID:          existingNextJWK.KeyID,
+					NextKeyAlgorithm:   "ES256",
+					RetiredKeys: []configv1alpha1.FederationDomainRetiredSigningKey{
+						{KeyID: retiredJWK.KeyID, RetiredAt: metav1.NewTime(now.Add(-time.Minute)), PublishedUntil: metav1.NewTime(now.Add(time.Minute))},
+					},
+				}),
+			},
+			secrets: []*corev1.Secret{
+				newSecretWithKeys(existingActiveJWK, existingNextJWK, []*jose.JSONWebKey{retiredJWK}, &jwksRotationState{
+					ActiveSince: metav1.NewTime(now.Add(-time.Minute)),
+					RetiredKeys: []configv1alpha1.FederationDomainRetiredSigningKey{
+						{KeyID: retiredJWK.KeyID, RetiredAt: metav1.NewTime(now.Add(-time.Minute)), PublishedUntil: metav1.NewTime(now.Add(time.Minute))},
+					},
+				}),
+			},
+			wantSecretActions:           []kubetesting.Action{},
+			wantFederationDomainActions: []kubetesting.Action{},
+			wantRequeueAfter:            time.Minute,
+		},
+		{
+			name: "retired key which can no longer have signed unexpired tokens is removed",
+			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
+			federationDomains: []*configv1alpha1.FederationDomain{
+				withSigningKeysStatus(goodFederationDomain, configv1alpha1.FederationDomainSigningKeysStatus{
+					ActiveKeyID:        existingActiveJWK.KeyID,
+					ActiveKeyAlgorithm: "ES256",
+					ActiveSince:        timePtr(now.Add(-time.Hour)),
+					NextKeyID:          existingNextJWK.KeyID,
+					NextKeyAlgorithm:   "ES256",
+					RetiredKeys: []configv1alpha1.FederationDomainRetiredSigningKey{
+						{KeyID: retiredJWK.KeyID, RetiredAt: metav1.NewTime(now.Add(-time.Hour)), PublishedUntil: metav1.NewTime(now)},
+					},
+				}),
+			},
+			secrets: []*corev1.Secret{
+				newSecretWithKeys(existingActiveJWK, existingNextJWK, []*jose.JSONWebKey{retiredJWK}, &jwksRotationState{
+					ActiveSince: metav1.NewTime(now.Add(-time.Hour)),
+					RetiredKeys: []configv1alpha1.FederationDomainRetiredSigningKey{
+						{KeyID: retiredJWK.KeyID, RetiredAt: metav1.NewTime(now.Add(-time.Hour)), PublishedUntil: metav1.NewTime(now)},
+					},
+				}),
 			},
-			wantGenerateKeyCount: 1,
 			wantSecretActions: []kubetesting.Action{
-				kubetesting.NewGetAction(secretGVR, namespace, goodSecret.Name),
-				kubetesting.NewUpdateAction(secretGVR, namespace, goodSecret),
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewUpdateAction(secretGVR, namespace, newSecretWithKeys(existingActiveJWK, existingNextJWK, nil, &jwksRotationState{
+					ActiveSince: metav1.NewTime(now.Add(-time.Hour)),
+				})),
 			},
 			wantFederationDomainActions: []kubetesting.Action{
 				kubetesting.NewGetAction(federationDomainGVR, namespace, goodFederationDomain.Name),
+				kubetesting.NewUpdateSubresourceAction(federationDomainGVR, "status", namespace, withSigningKeysStatus(goodFederationDomain, configv1alpha1.FederationDomainSigningKeysStatus{
+					ActiveKeyID:        existingActiveJWK.KeyID,
+					ActiveKeyAlgorithm: "ES256",
+					ActiveSince:        timePtr(now.Add(-time.Hour)),
+					NextKeyID:          existingNextJWK.KeyID,
+					NextKeyAlgorithm:   "ES256",
+				})),
 			},
 		},
 		{
-			name: "public jwk in secret",
+			name: "rotation history is limited to the most recent rotations",
 			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
 			federationDomains: []*configv1alpha1.FederationDomain{
-				goodFederationDomainWithStatus,
+				withSigningKeysStatus(
+					withSpec(goodFederationDomain, configv1alpha1.FederationDomainSigningKeysSpec{RotationRequest: "some-new-request"}),
+					upToDateSigningKeysStatus,
+				),
 			},
 			secrets: []*corev1.Secret{
-				newSecret("testdata/public-jwk.json", "testdata/good-jwks.json"),
+				newSecretWithKeys(existingActiveJWK, existingNextJWK, nil, &jwksRotationState{
+					ActiveSince:            metav1.NewTime(now.Add(-time.Hour)),
+					HandledRotationRequest: "some-old-request",
+					RotationHistory:        longRotationHistory,
+				}),
 			},
 			wantGenerateKeyCount: 1,
 			wantSecretActions: []kubetesting.Action{
-				kubetesting.NewGetAction(secretGVR, namespace, goodSecret.Name),
-				kubetesting.NewUpdateAction(secretGVR, namespace, goodSecret),
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewUpdateAction(secretGVR, namespace, newSecretWithKeys(existingNextJWK, generatedJWK1, []*jose.JSONWebKey{existingActiveJWK}, &jwksRotationState{
+					ActiveSince: metav1.NewTime(now),
+					RetiredKeys: []configv1alpha1.FederationDomainRetiredSigningKey{
+						{KeyID: existingActiveJWK.KeyID, RetiredAt: metav1.NewTime(now), PublishedUntil: retiredKeyPublishedUntil},
+					},
+					HandledRotationRequest: "some-new-request",
+					RotationHistory: append([]configv1alpha1.FederationDomainSigningKeyRotation{
+						{
+							Time:           metav1.NewTime(now),
+							Reason:         configv1alpha1.RequestedFederationDomainSigningKeyRotationReason,
+							ActivatedKeyID: existingNextJWK.KeyID,
+							RetiredKeyID:   existingActiveJWK.KeyID,
+						},
+					}, longRotationHistory[:9]...),
+				})),
+			},
+			wantRequeueAfter: idTokenLifespan + 5*time.Minute,
+		},
+		{
+			name: "new federationDomain with the RS256 algorithm",
+			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
+			federationDomains: []*configv1alpha1.FederationDomain{
+				withSpec(goodFederationDomain, configv1alpha1.FederationDomainSigningKeysSpec{Algorithm: "RS256"}),
+			},
+			wantGenerateKeyCount: 2,
+			wantSecretActions: []kubetesting.Action{
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewCreateAction(secretGVR, namespace, newSecretWithKeys(generatedRSAJWK1, generatedRSAJWK2, nil, &jwksRotationState{
+					ActiveSince: metav1.NewTime(now),
+				})),
 			},
 			wantFederationDomainActions: []kubetesting.Action{
 				kubetesting.NewGetAction(federationDomainGVR, namespace, goodFederationDomain.Name),
+				kubetesting.NewUpdateSubresourceAction(federationDomainGVR, "status", namespace, withSigningKeysStatus(
+					withSpec(goodFederationDomain, configv1alpha1.FederationDomainSigningKeysSpec{Algorithm: "RS256"}),
+					configv1alpha1.FederationDomainSigningKeysStatus{
+						ActiveKeyID:        generatedRSAJWK1.KeyID,
+						ActiveKeyAlgorithm: "RS256",
+						ActiveSince:        timePtr(now),
+						NextKeyID:          generatedRSAJWK2.KeyID,
+						NextKeyAlgorithm:   "RS256",
+					},
+				)),
 			},
 		},
 		{
-			name: "private jwks in secret",
+			name: "existing secret whose keys match the RS256 algorithm is up to date",
 			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
 			federationDomains: []*configv1alpha1.FederationDomain{
-				goodFederationDomainWithStatus,
+				withSigningKeysStatus(
+					withSpec(goodFederationDomain, configv1alpha1.FederationDomainSigningKeysSpec{Algorithm: "RS256", RSAKeySize: 2048}),
+					configv1alpha1.FederationDomainSigningKeysStatus{
+						ActiveKeyID:        generatedRSAJWK1.KeyID,
+						ActiveKeyAlgorithm: "RS256",
+						ActiveSince:        timePtr(now.Add(-time.Hour)),
+						NextKeyID:          generatedRSAJWK2.KeyID,
+						NextKeyAlgorithm:   "RS256",
+					},
+				),
 			},
 			secrets: []*corev1.Secret{
-				newSecret("testdata/good-jwk.json", "testdata/private-jwks.json"),
+				newSecretWithKeys(generatedRSAJWK1, generatedRSAJWK2, nil, &jwksRotationState{
+					ActiveSince: metav1.NewTime(now.Add(-time.Hour)),
+				}),
+			},
+			wantSecretActions:           []kubetesting.Action{},
+			wantFederationDomainActions: []kubetesting.Action{},
+		},
+		{
+			name: "changed algorithm replaces the next key without rotating, so keys for both algorithms are published",
+			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
+			federationDomains: []*configv1alpha1.FederationDomain{
+				withSigningKeysStatus(
+					withSpec(goodFederationDomain, configv1alpha1.FederationDomainSigningKeysSpec{Algorithm: "RS256", RotationRequest: "some-old-request"}),
+					upToDateSigningKeysStatus,
+				),
+			},
+			secrets: []*corev1.Secret{
+				upToDateSecret,
 			},
 			wantGenerateKeyCount: 1,
 			wantSecretActions: []kubetesting.Action{
-				kubetesting.NewGetAction(secretGVR, namespace, goodSecret.Name),
-				kubetesting.NewUpdateAction(secretGVR, namespace, goodSecret),
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewUpdateAction(secretGVR, namespace, newSecretWithKeys(existingActiveJWK, generatedRSAJWK1, nil, &jwksRotationState{
+					ActiveSince:            metav1.NewTime(now.Add(-time.Hour)),
+					HandledRotationRequest: "some-old-request",
+				})),
 			},
 			wantFederationDomainActions: []kubetesting.Action{
 				kubetesting.NewGetAction(federationDomainGVR, namespace, goodFederationDomain.Name),
+				kubetesting.NewUpdateSubresourceAction(federationDomainGVR, "status", namespace, withSigningKeysStatus(
+					withSpec(goodFederationDomain, configv1alpha1.FederationDomainSigningKeysSpec{Algorithm: "RS256", RotationRequest: "some-old-request"}),
+					configv1alpha1.FederationDomainSigningKeysStatus{
+						ActiveKeyID:        existingActiveJWK.KeyID,
+						ActiveKeyAlgorithm: "ES256",
+						ActiveSince:        timePtr(now.Add(-time.Hour)),
+						NextKeyID:          generatedRSAJWK1.KeyID,
+						NextKeyAlgorithm:   "RS256",
+					},
+				)),
 			},
 		},
 		{
-			name: "invalid jwk key in secret",
+			name: "rotation request after an algorithm change activates the key of the new algorithm and retires the old key",
 			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
 			federationDomains: []*configv1alpha1.FederationDomain{
-				goodFederationDomainWithStatus,
+				withSpec(goodFederationDomainWithStatus, configv1alpha1.FederationDomainSigningKeysSpec{Algorithm: "RS256", RotationRequest: "some-new-request"}),
 			},
 			secrets: []*corev1.Secret{
-				newSecret("testdata/invalid-key-jwk.json", "testdata/good-jwks.json"),
+				newSecretWithKeys(existingActiveJWK, generatedRSAJWK2, nil, &jwksRotationState{
+					ActiveSince:            metav1.NewTime(now.Add(-time.Hour)),
+					HandledRotationRequest: "some-old-request",
+				}),
 			},
 			wantGenerateKeyCount: 1,
 			wantSecretActions: []kubetesting.Action{
-				kubetesting.NewGetAction(secretGVR, namespace, goodSecret.Name),
-				kubetesting.NewUpdateAction(secretGVR, namespace, goodSecret),
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewUpdateAction(secretGVR, namespace, newSecretWithKeys(generatedRSAJWK2, generatedRSAJWK1, []*jose.JSONWebKey{existingActiveJWK}, &jwksRotationState{
+					ActiveSince: metav1.NewTime(now),
+					RetiredKeys: []configv1alpha1.FederationDomainRetiredSigningKey{
+						{KeyID: existingActiveJWK.KeyID, RetiredAt: metav1.NewTime(now), PublishedUntil: retiredKeyPublishedUntil},
+					},
+					HandledRotationRequest: "some-new-request",
+					RotationHistory: []configv1alpha1.FederationDomainSigningKeyRotation{
+						{Time: metav1.NewTime(now), Reason: configv1alpha1.RequestedFederationDomainSigningKeyRotationReason, ActivatedKeyID: generatedRSAJWK2.KeyID, RetiredKeyID: existingActiveJWK.KeyID},
+					},
+				})),
 			},
 			wantFederationDomainActions: []kubetesting.Action{
 				kubetesting.NewGetAction(federationDomainGVR, namespace, goodFederationDomain.Name),
+				kubetesting.NewUpdateSubresourceAction(federationDomainGVR, "status", namespace, withSigningKeysStatus(
+					withSpec(goodFederationDomain, configv1alpha1.FederationDomainSigningKeysSpec{Algorithm: "RS256", RotationRequest: "some-new-request"}),
+					configv1alpha1.FederationDomainSigningKeysStatus{
+						ActiveKeyID:        generatedRSAJWK2.KeyID,
+						ActiveKeyAlgorithm: "RS256",
+						ActiveSince:        timePtr(now),
+						NextKeyID:          generatedRSAJWK1.KeyID,
+						NextKeyAlgorithm:   "RS256",
+						RetiredKeys: []configv1alpha1.FederationDomainRetiredSigningKey{
+							{KeyID: existingActiveJWK.KeyID, RetiredAt: metav1.NewTime(now), PublishedUntil: retiredKeyPublishedUntil},
+						},
+						RotationHistory: []configv1alpha1.FederationDomainSigningKeyRotation{
+							{Time: metav1.NewTime(now), Reason: configv1alpha1.RequestedFederationDomainSigningKeyRotationReason, ActivatedKeyID: generatedRSAJWK2.KeyID, RetiredKeyID: existingActiveJWK.KeyID},
+						},
+					},
+				)),
 			},
+			wantRequeueAfter: idTokenLifespan + 5*time.Minute,
 		},
 		{
-			name: "invalid jwks key in secret",
+			name: "changed algorithm and rotation request at the same time switches to the new algorithm immediately",
 			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
 			federationDomains: []*configv1alpha1.FederationDomain{
-				goodFederationDomainWithStatus,
+				withSpec(goodFederationDomainWithStatus, configv1alpha1.FederationDomainSigningKeysSpec{Algorithm: "RS256", RotationRequest: "some-new-request"}),
 			},
 			secrets: []*corev1.Secret{
-				newSecret("testdata/good-jwk.json", "testdata/invalid-key-jwks.json"),
+				upToDateSecret,
+			},
+			wantGenerateKeyCount: 2,
+			wantSecretActions: []kubetesting.Action{
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewUpdateAction(secretGVR, namespace, newSecretWithKeys(generatedRSAJWK1, generatedRSAJWK2, []*jose.JSONWebKey{existingActiveJWK}, &jwksRotationState{
+					ActiveSince: metav1.NewTime(now),
+					RetiredKeys: []configv1alpha1.FederationDomainRetiredSigningKey{
+						{KeyID: existingActiveJWK.KeyID, RetiredAt: metav1.NewTime(now), PublishedUntil: retiredKeyPublishedUntil},
+					},
+					HandledRotationRequest: "some-new-request",
+					RotationHistory: []configv1alpha1.FederationDomainSigningKeyRotation{
+						{Time: metav1.NewTime(now), Reason: configv1alpha1.RequestedFederationDomainSigningKeyRotationReason, ActivatedKeyID: generatedRSAJWK1.KeyID, RetiredKeyID: existingActiveJWK.KeyID},
+					},
+				})),
+			},
+			wantRequeueAfter: idTokenLifespan + 5*time.Minute,
+		},
+		{
+			name: "changed RSA key size replaces the next key",
+			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
+			federationDomains: []*configv1alpha1.FederationDomain{
+				withSpec(goodFederationDomainWithStatus, configv1alpha1.FederationDomainSigningKeysSpec{Algorithm: "RS256", RSAKeySize: 3072}),
+			},
+			secrets: []*corev1.Secret{
+				newSecretWithKeys(generatedRSAJWK1, generatedRSAJWK2, nil, &jwksRotationState{
+					ActiveSince: metav1.NewTime(now.Add(-time.Hour)),
+				}),
 			},
 			wantGenerateKeyCount: 1,
 			wantSecretActions: []kubetesting.Action{
-				kubetesting.NewGetAction(secretGVR, namespace, goodSecret.Name),
-				kubetesting.NewUpdateAction(secretGVR, namespace, goodSecret),
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewUpdateAction(secretGVR, namespace, newSecretWithKeys(generatedRSAJWK1, generatedLargeRSAJWK, nil, &jwksRotationState{
+					ActiveSince: metav1.NewTime(now.Add(-time.Hour)),
+				})),
+			},
+		},
+		{
+			name: "new federationDomain with no secret when using an external signer",
+			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
+			federationDomains: []*configv1alpha1.FederationDomain{
+				goodFederationDomain,
+			},
+			externalSigner: externalSigner,
+			wantSecretActions: []kubetesting.Action{
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewCreateAction(secretGVR, namespace, newSecretWithKeys(externalJWK, nil, nil, &jwksRotationState{
+					ActiveSince: metav1.NewTime(now),
+				})),
 			},
 			wantFederationDomainActions: []kubetesting.Action{
 				kubetesting.NewGetAction(federationDomainGVR, namespace, goodFederationDomain.Name),
+				kubetesting.NewUpdateSubresourceAction(federationDomainGVR, "status", namespace, withSigningKeysStatus(goodFederationDomain, configv1alpha1.FederationDomainSigningKeysStatus{
+					ActiveKeyID:        externalJWK.KeyID,
+					ActiveKeyAlgorithm: "ES256",
+					ActiveSince:        timePtr(now),
+				})),
 			},
 		},
 		{
-			name: "missing active jwks in secret",
+			name: "existing secret with local keys switches to the external signer and retires the active key",
 			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
 			federationDomains: []*configv1alpha1.FederationDomain{
-				goodFederationDomainWithStatus,
+				withSigningKeysStatus(goodFederationDomain, upToDateSigningKeysStatus),
 			},
 			secrets: []*corev1.Secret{
-				newSecret("testdata/good-jwk.json", "testdata/missing-active-jwks.json"),
+				upToDateSecret,
 			},
-			wantGenerateKeyCount: 1,
+			externalSigner: externalSigner,
+			wantSecretActions: []kubetesting.Action{
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewUpdateAction(secretGVR, namespace, newSecretWithKeys(externalJWK, nil, []*jose.JSONWebKey{existingActiveJWK}, &jwksRotationState{
+					ActiveSince: metav1.NewTime(now),
+					RetiredKeys: []configv1alpha1.FederationDomainRetiredSigningKey{
+						{KeyID: existingActiveJWK.KeyID, RetiredAt: metav1.NewTime(now), PublishedUntil: retiredKeyPublishedUntil},
+					},
+					HandledRotationRequest: "some-old-request",
+				})),
+			},
+			wantFederationDomainActions: []kubetesting.Action{
+				kubetesting.NewGetAction(federationDomainGVR, namespace, goodFederationDomain.Name),
+				kubetesting.NewUpdateSubresourceAction(federationDomainGVR, "status", namespace, withSigningKeysStatus(goodFederationDomain, configv1alpha1.FederationDomainSigningKeysStatus{
+					ActiveKeyID:        externalJWK.KeyID,
+					ActiveKeyAlgorithm: "ES256",
+					ActiveSince:        timePtr(now),
+					RetiredKeys: []configv1alpha1.FederationDomainRetiredSigningKey{
+						{KeyID: existingActiveJWK.KeyID, RetiredAt: metav1.NewTime(now), PublishedUntil: retiredKeyPublishedUntil},
+					},
+				})),
+			},
+			wantRequeueAfter: idTokenLifespan + 5*time.Minute,
+		},
+		{
+			name: "existing secret for the external signer ignores rotation requests and intervals",
+			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
+			federationDomains: []*configv1alpha1.FederationDomain{
+				withSigningKeysStatus(
+					withSpec(goodFederationDomain, configv1alpha1.FederationDomainSigningKeysSpec{
+						RotationInterval: &metav1.Duration{Duration: time.Hour},
+						RotationRequest:  "some-new-request",
+					}),
+					upToDateExternalSigningKeysStatus,
+				),
+			},
+			secrets: []*corev1.Secret{
+				upToDateExternalSecret,
+			},
+			externalSigner:              externalSigner,
+			wantSecretActions:           []kubetesting.Action{},
+			wantFederationDomainActions: []kubetesting.Action{},
+		},
+		{
+			name: "existing secret for the external signer ignores the algorithm",
+			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
+			federationDomains: []*configv1alpha1.FederationDomain{
+				withSigningKeysStatus(
+					withSpec(goodFederationDomain, configv1alpha1.FederationDomainSigningKeysSpec{Algorithm: "RS256"}),
+					upToDateExternalSigningKeysStatus,
+				),
+			},
+			secrets: []*corev1.Secret{
+				upToDateExternalSecret,
+			},
+			externalSigner:              externalSigner,
+			wantSecretActions:           []kubetesting.Action{},
+			wantFederationDomainActions: []kubetesting.Action{},
+		},
+		{
+			name: "existing secret for the external signer is regenerated when the external signer is no longer used",
+			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
+			federationDomains: []*configv1alpha1.FederationDomain{
+				withSigningKeysStatus(goodFederationDomain, upToDateExternalSigningKeysStatus),
+			},
+			secrets: []*corev1.Secret{
+				upToDateExternalSecret,
+			},
+			wantGenerateKeyCount: 2,
 			wantSecretActions: []kubetesting.Action{
-				kubetesting.NewGetAction(secretGVR, namespace, goodSecret.Name),
-				kubetesting.NewUpdateAction(secretGVR, namespace, goodSecret),
+				kubetesting.NewGetAction(secretGVR, namespace, generatedSecret.Name),
+				kubetesting.NewUpdateAction(secretGVR, namespace, generatedSecret),
 			},
 			wantFederationDomainActions: []kubetesting.Action{
 				kubetesting.NewGetAction(federationDomainGVR, namespace, goodFederationDomain.Name),
+				kubetesting.NewUpdateSubresourceAction(federationDomainGVR, "status", namespace, withSigningKeysStatus(goodFederationDomain, generatedSigningKeysStatus)),
 			},
 		},
 		{
@@ -592,7 +1395,19 @@ func TestJWKSWriterControllerSync(t *testing.T) {
 				goodFederationDomainWithStatus,
 			},
 			generateKeyErr: errors.New("some generate error"),
-			wantError:      "cannot generate secret: cannot generate key: some generate error",
+			wantError:      "cannot create or update secret: cannot generate secret: cannot generate key: some generate error",
+		},
+		{
+			name: "generate key fails during rotation",
+			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
+			federationDomains: []*configv1alpha1.FederationDomain{
+				withSpec(goodFederationDomainWithStatus, configv1alpha1.FederationDomainSigningKeysSpec{RotationRequest: "some-new-request"}),
+			},
+			secrets: []*corev1.Secret{
+				upToDateSecret,
+			},
+			generateKeyErr: errors.New("some generate error"),
+			wantError:      "cannot create or update secret: cannot update keys: cannot generate key: some generate error",
 		},
 		{
 			name: "get secret fails",
@@ -668,9 +1483,25 @@ func TestJWKSWriterControllerSync(t *testing.T) {
 		t.Run(test.name, func(t *testing.T) {
 			// We shouldn't run this test in parallel since it messes with a global function (generateKey).
 			generateKeyCount := 0
-			generateKey = func(_ io.Reader) (interface{}, error) {
+			generateECKeyCount := 0
+			generateRSAKeyCount := map[int]int{}
+			generateKey = func(_ io.Reader, alg jose.SignatureAlgorithm, rsaKeySize int) (interface{}, error) {
+				if test.generateKeyErr != nil {
+					return nil, test.generateKeyErr
+				}
+				if alg == jose.RS256 {
+					require.Less(t, generateRSAKeyCount[rsaKeySize], len(generatedRSAKeys[rsaKeySize]), "generated too many RSA keys")
+					key := generatedRSAKeys[rsaKeySize][generateRSAKeyCount[rsaKeySize]]
+					generateRSAKeyCount[rsaKeySize]++
+					generateKeyCount++
+					return key, nil
+				}
+				require.Equal(t, jose.ES256, alg)
+				require.Less(t, generateECKeyCount, len(generatedKeys), "generated too many keys")
+				key := generatedKeys[generateECKeyCount]
+				generateECKeyCount++
 				generateKeyCount++
-				return goodKey, test.generateKeyErr
+				return key, nil
 			}
 
 			ctx, cancel := context.WithCancel(context.Background())
@@ -710,6 +1541,8 @@ func TestJWKSWriterControllerSync(t *testing.T) {
 					"myLabelKey1": "myLabelValue1",
 					"myLabelKey2": "myLabelValue2",
 				},
+				test.externalSigner,
+				clocktesting.NewFakeClock(now),
 				kubeAPIClient,
 				pinnipedAPIClient,
 				kubeInformers.Core().V1().Secrets(),
@@ -722,9 +1555,11 @@ func TestJWKSWriterControllerSync(t *testing.T) {
 			pinnipedInformers.Start(ctx.Done())
 			controllerlib.TestRunSynchronously(t, c)
 
+			queue := &testQueue{}
 			err := controllerlib.TestSync(t, c, controllerlib.Context{
 				Context: ctx,
 				Key:     test.key,
+				Queue:   queue,
 			})
 			if test.wantError != "" {
 				require.EqualError(t, err, test.wantError)
@@ -735,15 +1570,46 @@ func TestJWKSWriterControllerSync(t *testing.T) {
 			require.Equal(t, test.wantGenerateKeyCount, generateKeyCount)
 
 			if test.wantSecretActions != nil {
-				require.Equal(t, test.wantSecretActions, kubeAPIClient.Actions())
+				require.Equal(t, test.wantSecretActions, nonNilActions(kubeAPIClient.Actions()))
 			}
 			if test.wantFederationDomainActions != nil {
-				require.Equal(t, test.wantFederationDomainActions, pinnipedAPIClient.Actions())
+				require.Equal(t, test.wantFederationDomainActions, nonNilActions(pinnipedAPIClient.Actions()))
+			}
+
+			if test.wantRequeueAfter != 0 {
+				require.True(t, queue.called, "expected the key to be requeued")
+				require.Equal(t, test.key, queue.key)
+				require.Equal(t, test.wantRequeueAfter, queue.duration)
+			} else {
+				require.False(t, queue.called, "expected the key to not be requeued")
 			}
 		})
 	}
 }
 
+// testQueue records the call to AddAfter.
+type testQueue struct {
+	called   bool
+	key      controllerlib.Key
+	duration time.Duration
+
+	controllerlib.Queue // panic if any other methods called
+}
+
+func (q *testQueue) AddAfter(key controllerlib.Key, duration time.Duration) {
+	q.called = true
+	q.key = key
+	q.duration = duration
+}
+
+// nonNilActions makes a nil list of actions comparable to an empty list of expected actions.
+func nonNilActions(actions []kubetesting.Action) []kubetesting.Action {
+	if actions == nil {
+		return []kubetesting.Action{}
+	}
+	return actions
+}
+
 func readJWKJSON(t *testing.T, path string) []byte {
 	t.Helper()
 
@@ -27,6 +27,9 @@ import (
 
 const (
 	ldapControllerName = "ldap-upstream-observer"
+
+	// defaultNestedGroupsMaxDepth is used when the nested groups of an LDAPIdentityProvider do not specify a maxDepth.
+	defaultNestedGroupsMaxDepth = 5
 )
 
 type ldapUpstreamGenericLDAPImpl struct {
@@ -135,6 +138,8 @@ type UpstreamLDAPIdentityProviderICache interface {
 type ldapWatcherController struct {
 	cache                        UpstreamLDAPIdentityProviderICache
 	validatedSettingsCache       upstreamwatchers.ValidatedSettingsCacheI
+	nestedGroupsCache            *upstreamldap.NestedGroupsCache
+	hostPools                    *upstreamldap.HostPools
 	ldapDialer                   upstreamldap.LDAPDialer
 	client                       pinnipedclientset.Interface
 	ldapIdentityProviderInformer idpinformers.LDAPIdentityProviderInformer
@@ -153,6 +158,10 @@ func New(
 		idpCache,
 		// start with an empty cache
 		upstreamwatchers.NewValidatedSettingsCache(),
+		// start with an empty cache, which is shared by all the providers created by this controller
+		upstreamldap.NewNestedGroupsCache(),
+		// start with no known hosts, which are shared by all the providers created by this controller
+		upstreamldap.NewHostPools(),
 		// nil means to use a real production dialer when creating objects to add to the cache
 		nil,
 		client,
@@ -166,6 +175,8 @@ func New(
 func newInternal(
 	idpCache UpstreamLDAPIdentityProviderICache,
 	validatedSettingsCache upstreamwatchers.ValidatedSettingsCacheI,
+	nestedGroupsCache *upstreamldap.NestedGroupsCache,
+	hostPools *upstreamldap.HostPools,
 	ldapDialer upstreamldap.LDAPDialer,
 	client pinnipedclientset.Interface,
 	ldapIdentityProviderInformer idpinformers.LDAPIdentityProviderInformer,
@@ -175,6 +186,8 @@ func newInternal(
 	c := ldapWatcherController{
 		cache:                        idpCache,
 		validatedSettingsCache:       validatedSettingsCache,
+		nestedGroupsCache:            nestedGroupsCache,
+		hostPools:                    hostPools,
 		ldapDialer:                   ldapDialer,
 		client:                       client,
 		ldapIdentityProviderInformer: ldapIdentityProviderInformer,
@@ -226,9 +239,12 @@ func (c *ldapWatcherController) validateUpstream(ctx context.Context, upstream *
 	spec := upstream.Spec
 
 	config := &upstreamldap.ProviderConfig{
-		Name:        upstream.Name,
-		ResourceUID: upstream.UID,
-		Host:        spec.Host,
+		Name:            upstream.Name,
+		ResourceUID:     upstream.UID,
+		Host:            spec.Host,
+		AdditionalHosts: spec.AdditionalHosts,
+		SRVDomain:       spec.SRVLookupDomain,
+		LoadBalancing:   upstreamldap.LoadBalancing(spec.LoadBalancing),
 		UserSearch: upstreamldap.UserSearchConfig{
 			Base:              spec.UserSearch.Base,
 			Filter:            spec.UserSearch.Filter,
@@ -239,8 +255,17 @@ func (c *ldapWatcherController) validateUpstream(ctx context.Context, upstream *
 			Base:               spec.GroupSearch.Base,
 			Filter:             spec.GroupSearch.Filter,
 			GroupNameAttribute: spec.GroupSearch.Attributes.GroupName,
+			SkipGroupRefresh:   spec.GroupSearch.SkipGroupRefresh,
 		},
-		Dialer: c.ldapDialer,
+		HostPools: c.hostPools,
+		Dialer:    c.ldapDialer,
+	}
+	if nestedGroups := spec.GroupSearch.NestedGroups; nestedGroups != nil {
+		config.GroupSearch.NestedGroupsMaxDepth = defaultNestedGroupsMaxDepth
+		if nestedGroups.MaxDepth > 0 {
+			config.GroupSearch.NestedGroupsMaxDepth = int(nestedGroups.MaxDepth)
+		}
+		config.NestedGroupsCache = c.nestedGroupsCache
 	}
 
 	conditions := upstreamwatchers.ValidateGenericLDAP(ctx, &ldapUpstreamGenericLDAPImpl{*upstream}, c.secretInformer, c.validatedSettingsCache, config)
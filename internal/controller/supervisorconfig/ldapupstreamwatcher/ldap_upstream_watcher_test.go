@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"sync"
 	"testing"
 	"time"
 
@@ -155,6 +156,7 @@ func TestLDAPUpstreamWatcherControllerSync(t *testing.T) {
 		testBindUsername      = "test-bind-username"
 		testBindPassword      = "test-bind-password"
 		testHost              = "ldap.example.com:123"
+		testHost2             = "ldap2.example.com:123"
 		testUserSearchBase    = "test-user-search-base"
 		testUserSearchFilter  = "test-user-search-filter"
 		testGroupSearchBase   = "test-group-search-base"
@@ -231,6 +233,28 @@ func TestLDAPUpstreamWatcherControllerSync(t *testing.T) {
 	providerConfigForValidUpstreamWithStartTLS := &copyOfProviderConfigForValidUpstreamWithTLS
 	providerConfigForValidUpstreamWithStartTLS.ConnectionProtocol = upstreamldap.StartTLS
 
+	anotherCopyOfProviderConfigForValidUpstreamWithTLS := *providerConfigForValidUpstreamWithTLS
+	providerConfigForValidUpstreamWithMultipleHosts := &anotherCopyOfProviderConfigForValidUpstreamWithTLS
+	providerConfigForValidUpstreamWithMultipleHosts.AdditionalHosts = []string{testHost2}
+	providerConfigForValidUpstreamWithMultipleHosts.LoadBalancing = upstreamldap.RoundRobin
+
+	yetAnotherCopyOfProviderConfigForValidUpstreamWithTLS := *providerConfigForValidUpstreamWithTLS
+	providerConfigForValidUpstreamWithSkipGroupRefresh := &yetAnotherCopyOfProviderConfigForValidUpstreamWithTLS
+	providerConfigForValidUpstreamWithSkipGroupRefresh.GroupSearch.SkipGroupRefresh = true
+
+	// The same nested groups cache is shared by every provider created by the controller.
+	nestedGroupsCache := upstreamldap.NewNestedGroupsCache()
+
+	oneMoreCopyOfProviderConfigForValidUpstreamWithTLS := *providerConfigForValidUpstreamWithTLS
+	providerConfigForValidUpstreamWithDefaultNestedGroups := &oneMoreCopyOfProviderConfigForValidUpstreamWithTLS
+	providerConfigForValidUpstreamWithDefaultNestedGroups.GroupSearch.NestedGroupsMaxDepth = 5
+	providerConfigForValidUpstreamWithDefaultNestedGroups.NestedGroupsCache = nestedGroupsCache
+
+	lastCopyOfProviderConfigForValidUpstreamWithTLS := *providerConfigForValidUpstreamWithTLS
+	providerConfigForValidUpstreamWithNestedGroups := &lastCopyOfProviderConfigForValidUpstreamWithTLS
+	providerConfigForValidUpstreamWithNestedGroups.GroupSearch.NestedGroupsMaxDepth = 2
+	providerConfigForValidUpstreamWithNestedGroups.NestedGroupsCache = nestedGroupsCache
+
 	bindSecretValidTrueCondition := func(gen int64) v1alpha1.Condition {
 		return v1alpha1.Condition{
 			Type:               "BindSecretValid",
@@ -253,6 +277,28 @@ func TestLDAPUpstreamWatcherControllerSync(t *testing.T) {
 			ObservedGeneration: gen,
 		}
 	}
+	ldapConnectionValidTrueConditionForMultipleHosts := func(gen int64, secretVersion string) v1alpha1.Condition {
+		c := ldapConnectionValidTrueCondition(gen, secretVersion)
+		c.Message = fmt.Sprintf(
+			`successfully able to connect to "%s", "%s" and bind as user "%s" [validated with Secret "%s" at version "%s"]`,
+			testHost, testHost2, testBindUsername, testSecretName, secretVersion)
+		return c
+	}
+	hostsHealthyTrueCondition := func(gen int64) v1alpha1.Condition {
+		return v1alpha1.Condition{
+			Type:               "HostsHealthy",
+			Status:             "True",
+			LastTransitionTime: now,
+			Reason:             "Success",
+			Message:            fmt.Sprintf(`all 2 hosts are healthy: "%s", "%s"`, testHost, testHost2),
+			ObservedGeneration: gen,
+		}
+	}
+	withoutTimeOrGeneration := func(c v1alpha1.Condition) v1alpha1.Condition {
+		c.LastTransitionTime = metav1.Time{}
+		c.ObservedGeneration = 0
+		return c
+	}
 	ldapConnectionValidTrueConditionWithoutTimeOrGeneration := func(secretVersion string) v1alpha1.Condition {
 		c := ldapConnectionValidTrueCondition(0, secretVersion)
 		c.LastTransitionTime = metav1.Time{}
@@ -700,6 +746,90 @@ func TestLDAPUpstreamWatcherControllerSync(t *testing.T) {
 				ConnectionValidCondition:  condPtr(ldapConnectionValidTrueConditionWithoutTimeOrGeneration("4242")),
 			}},
 		},
+		{
+			name: "when group refresh is skipped, then the provider is configured to skip it",
+			inputUpstreams: []runtime.Object{editedValidUpstream(func(upstream *v1alpha1.LDAPIdentityProvider) {
+				upstream.Spec.GroupSearch.SkipGroupRefresh = true
+			})},
+			inputSecrets: []runtime.Object{validBindUserSecret("4242")},
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				// Should perform a test dial and bind.
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantResultingCache: []*upstreamldap.ProviderConfig{providerConfigForValidUpstreamWithSkipGroupRefresh},
+			wantResultingUpstreams: []v1alpha1.LDAPIdentityProvider{{
+				ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testName, Generation: 1234, UID: testResourceUID},
+				Status: v1alpha1.LDAPIdentityProviderStatus{
+					Phase:      "Ready",
+					Conditions: allConditionsTrue(1234, "4242"),
+				},
+			}},
+			wantValidatedSettings: map[string]upstreamwatchers.ValidatedSettings{testName: {
+				BindSecretResourceVersion: "4242",
+				LDAPConnectionProtocol:    upstreamldap.TLS,
+				UserSearchBase:            testUserSearchBase,
+				GroupSearchBase:           testGroupSearchBase,
+				IDPSpecGeneration:         1234,
+				ConnectionValidCondition:  condPtr(ldapConnectionValidTrueConditionWithoutTimeOrGeneration("4242")),
+			}},
+		},
+		{
+			name: "when nested groups are enabled without a max depth, then the provider is configured to search them up to the default depth",
+			inputUpstreams: []runtime.Object{editedValidUpstream(func(upstream *v1alpha1.LDAPIdentityProvider) {
+				upstream.Spec.GroupSearch.NestedGroups = &v1alpha1.LDAPIdentityProviderNestedGroups{}
+			})},
+			inputSecrets: []runtime.Object{validBindUserSecret("4242")},
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				// Should perform a test dial and bind.
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantResultingCache: []*upstreamldap.ProviderConfig{providerConfigForValidUpstreamWithDefaultNestedGroups},
+			wantResultingUpstreams: []v1alpha1.LDAPIdentityProvider{{
+				ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testName, Generation: 1234, UID: testResourceUID},
+				Status: v1alpha1.LDAPIdentityProviderStatus{
+					Phase:      "Ready",
+					Conditions: allConditionsTrue(1234, "4242"),
+				},
+			}},
+			wantValidatedSettings: map[string]upstreamwatchers.ValidatedSettings{testName: {
+				BindSecretResourceVersion: "4242",
+				LDAPConnectionProtocol:    upstreamldap.TLS,
+				UserSearchBase:            testUserSearchBase,
+				GroupSearchBase:           testGroupSearchBase,
+				IDPSpecGeneration:         1234,
+				ConnectionValidCondition:  condPtr(ldapConnectionValidTrueConditionWithoutTimeOrGeneration("4242")),
+			}},
+		},
+		{
+			name: "when nested groups are enabled with a max depth, then the provider is configured to search them up to that depth",
+			inputUpstreams: []runtime.Object{editedValidUpstream(func(upstream *v1alpha1.LDAPIdentityProvider) {
+				upstream.Spec.GroupSearch.NestedGroups = &v1alpha1.LDAPIdentityProviderNestedGroups{MaxDepth: 2}
+			})},
+			inputSecrets: []runtime.Object{validBindUserSecret("4242")},
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				// Should perform a test dial and bind.
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantResultingCache: []*upstreamldap.ProviderConfig{providerConfigForValidUpstreamWithNestedGroups},
+			wantResultingUpstreams: []v1alpha1.LDAPIdentityProvider{{
+				ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testName, Generation: 1234, UID: testResourceUID},
+				Status: v1alpha1.LDAPIdentityProviderStatus{
+					Phase:      "Ready",
+					Conditions: allConditionsTrue(1234, "4242"),
+				},
+			}},
+			wantValidatedSettings: map[string]upstreamwatchers.ValidatedSettings{testName: {
+				BindSecretResourceVersion: "4242",
+				LDAPConnectionProtocol:    upstreamldap.TLS,
+				UserSearchBase:            testUserSearchBase,
+				GroupSearchBase:           testGroupSearchBase,
+				IDPSpecGeneration:         1234,
+				ConnectionValidCondition:  condPtr(ldapConnectionValidTrueConditionWithoutTimeOrGeneration("4242")),
+			}},
+		},
 		{
 			name: "one valid upstream and one invalid upstream updates the cache to include only the valid upstream",
 			inputUpstreams: []runtime.Object{validUpstream, editedValidUpstream(func(upstream *v1alpha1.LDAPIdentityProvider) {
@@ -785,6 +915,80 @@ func TestLDAPUpstreamWatcherControllerSync(t *testing.T) {
 			}},
 			wantValidatedSettings: map[string]upstreamwatchers.ValidatedSettings{},
 		},
+		{
+			name: "when there are multiple hosts, then each host is validated",
+			inputUpstreams: []runtime.Object{editedValidUpstream(func(upstream *v1alpha1.LDAPIdentityProvider) {
+				upstream.Spec.AdditionalHosts = []string{testHost2}
+				upstream.Spec.LoadBalancing = v1alpha1.LoadBalancingRoundRobin
+			})},
+			inputSecrets: []runtime.Object{validBindUserSecret("4242")},
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				// Should perform a test dial and bind with each host.
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(2)
+				conn.EXPECT().Close().Times(2)
+			},
+			wantResultingCache: []*upstreamldap.ProviderConfig{providerConfigForValidUpstreamWithMultipleHosts},
+			wantResultingUpstreams: []v1alpha1.LDAPIdentityProvider{{
+				ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testName, Generation: 1234, UID: testResourceUID},
+				Status: v1alpha1.LDAPIdentityProviderStatus{
+					Phase: "Ready",
+					Conditions: []v1alpha1.Condition{
+						bindSecretValidTrueCondition(1234),
+						hostsHealthyTrueCondition(1234),
+						ldapConnectionValidTrueConditionForMultipleHosts(1234, "4242"),
+						tlsConfigurationValidLoadedTrueCondition(1234),
+					},
+				},
+			}},
+			wantValidatedSettings: map[string]upstreamwatchers.ValidatedSettings{testName: {
+				BindSecretResourceVersion: "4242",
+				LDAPConnectionProtocol:    upstreamldap.TLS,
+				UserSearchBase:            testUserSearchBase,
+				GroupSearchBase:           testGroupSearchBase,
+				IDPSpecGeneration:         1234,
+				ConnectionValidCondition: condPtr(withoutTimeOrGeneration(
+					ldapConnectionValidTrueConditionForMultipleHosts(0, "4242"),
+				)),
+			}},
+		},
+		{
+			name: "when some of the hosts cannot be reached, then the upstream is added to the cache with its unhealthy hosts reported, but not the validated settings cache",
+			inputUpstreams: []runtime.Object{editedValidUpstream(func(upstream *v1alpha1.LDAPIdentityProvider) {
+				upstream.Spec.AdditionalHosts = []string{testHost2}
+				upstream.Spec.LoadBalancing = v1alpha1.LoadBalancingRoundRobin
+			})},
+			inputSecrets: []runtime.Object{validBindUserSecret("4242")},
+			dialErrors:   map[string]error{testHost2: fmt.Errorf("some dial error")},
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				// Should perform a test dial and bind with the first host only, without trying StartTLS.
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantErr:            controllerlib.ErrSyntheticRequeue.Error(),
+			wantResultingCache: []*upstreamldap.ProviderConfig{providerConfigForValidUpstreamWithMultipleHosts},
+			wantResultingUpstreams: []v1alpha1.LDAPIdentityProvider{{
+				ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testName, Generation: 1234, UID: testResourceUID},
+				Status: v1alpha1.LDAPIdentityProviderStatus{
+					Phase: "Error",
+					Conditions: []v1alpha1.Condition{
+						bindSecretValidTrueCondition(1234),
+						{
+							Type:               "HostsHealthy",
+							Status:             "False",
+							LastTransitionTime: now,
+							Reason:             "HostsUnhealthy",
+							Message: fmt.Sprintf(
+								`1 of 2 hosts are healthy: "%s"; unhealthy hosts: "%s": error dialing host "%s": some dial error`,
+								testHost, testHost2, testHost2),
+							ObservedGeneration: 1234,
+						},
+						ldapConnectionValidTrueCondition(1234, "4242"),
+						tlsConfigurationValidLoadedTrueCondition(1234),
+					},
+				},
+			}},
+			wantValidatedSettings: map[string]upstreamwatchers.ValidatedSettings{},
+		},
 		{
 			name: "when the LDAP server connection was already validated using TLS for the current resource generation and secret version, then do not validate it again and keep using TLS",
 			inputUpstreams: []runtime.Object{editedValidUpstream(func(upstream *v1alpha1.LDAPIdentityProvider) {
@@ -1098,9 +1302,12 @@ func TestLDAPUpstreamWatcherControllerSync(t *testing.T) {
 				}
 			}
 
+			hostPools := upstreamldap.NewHostPools()
 			controller := newInternal(
 				cache,
 				validatedSettingsCache,
+				nestedGroupsCache,
+				hostPools,
 				dialer,
 				fakePinnipedClient,
 				pinnipedInformers.IDP().V1alpha1().LDAPIdentityProviders(),
@@ -1131,6 +1338,8 @@ func TestLDAPUpstreamWatcherControllerSync(t *testing.T) {
 				// The dialer that was passed in to the controller's constructor should always have been
 				// passed through to the provider.
 				copyOfExpectedValueForResultingCache.Dialer = dialer
+				// The hosts of the providers should always have been shared by the providers created by the controller.
+				copyOfExpectedValueForResultingCache.HostPools = hostPools
 				require.Equal(t, copyOfExpectedValueForResultingCache, actualIDP.GetConfig())
 			}
 
@@ -1154,6 +1363,149 @@ func TestLDAPUpstreamWatcherControllerSync(t *testing.T) {
 	}
 }
 
+func TestLDAPUpstreamWatcherControllerReportsHostsWhichFailAfterValidation(t *testing.T) {
+	t.Parallel()
+
+	const (
+		testNamespace = "test-namespace"
+		testName      = "test-name"
+		testHost      = "ldap.example.com:123"
+		testHost2     = "ldap2.example.com:123"
+	)
+
+	upstream := &v1alpha1.LDAPIdentityProvider{
+		ObjectMeta: metav1.ObjectMeta{Name: testName, Namespace: testNamespace, Generation: 1234, UID: "test-resource-uid"},
+		Spec: v1alpha1.LDAPIdentityProviderSpec{
+			Host:            testHost,
+			AdditionalHosts: []string{testHost2},
+			Bind:            v1alpha1.LDAPIdentityProviderBind{SecretName: "test-bind-secret"},
+			UserSearch:      v1alpha1.LDAPIdentityProviderUserSearch{Base: "test-user-search-base"},
+			GroupSearch:     v1alpha1.LDAPIdentityProviderGroupSearch{Base: "test-group-search-base"},
+		},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-bind-secret", Namespace: testNamespace, ResourceVersion: "4242"},
+		Type:       corev1.SecretTypeBasicAuth,
+		Data:       map[string][]byte{"username": []byte("test-bind-username"), "password": []byte("test-bind-password")},
+	}
+
+	fakePinnipedClient := pinnipedfake.NewSimpleClientset(upstream)
+	pinnipedInformers := pinnipedinformers.NewSharedInformerFactory(fakePinnipedClient, 0)
+	fakeKubeClient := fake.NewSimpleClientset(secret)
+	kubeInformers := informers.NewSharedInformerFactory(fakeKubeClient, 0)
+	cache := provider.NewDynamicUpstreamIDPProvider()
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+	conn := mockldapconn.NewMockConn(ctrl)
+	conn.EXPECT().Bind("test-bind-username", "test-bind-password").AnyTimes()
+	conn.EXPECT().Close().AnyTimes()
+
+	var mu sync.Mutex
+	var dialed []string
+	host2Down := false
+	dialer := upstreamldap.LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (upstreamldap.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		dialed = append(dialed, addr.Endpoint())
+		if host2Down && addr.Endpoint() == testHost2 {
+			return nil, ldap.NewError(ldap.ErrorNetwork, errors.New("some dial error"))
+		}
+		return conn, nil
+	})
+	setHost2Down := func(down bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		host2Down = down
+		dialed = nil
+	}
+	requireDialed := func(want []string) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		require.ElementsMatch(t, want, dialed)
+		dialed = nil
+	}
+
+	ldapIDPInformer := pinnipedInformers.IDP().V1alpha1().LDAPIdentityProviders()
+	controller := newInternal(
+		cache,
+		upstreamwatchers.NewValidatedSettingsCache(),
+		upstreamldap.NewNestedGroupsCache(),
+		upstreamldap.NewHostPools(),
+		dialer,
+		fakePinnipedClient,
+		ldapIDPInformer,
+		kubeInformers.Core().V1().Secrets(),
+		controllerlib.WithInformer,
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pinnipedInformers.Start(ctx.Done())
+	kubeInformers.Start(ctx.Done())
+	controllerlib.TestRunSynchronously(t, controller)
+	syncCtx := controllerlib.Context{Context: ctx, Key: controllerlib.Key{}}
+
+	// The controller only updates the status when it differs from the status in its informer, so wait for the
+	// informer to see the status which was written by the previous sync before syncing again.
+	testSync := func() error {
+		t.Helper()
+		actual, err := fakePinnipedClient.IDPV1alpha1().LDAPIdentityProviders(testNamespace).Get(ctx, testName, metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			cached, err := ldapIDPInformer.Lister().LDAPIdentityProviders(testNamespace).Get(testName)
+			return err == nil && cached.ResourceVersion == actual.ResourceVersion
+		}, 10*time.Second, 10*time.Millisecond)
+		return controllerlib.TestSync(t, controller, syncCtx)
+	}
+
+	requireHostsHealthyCondition := func(wantStatus v1alpha1.ConditionStatus, wantMessage string) {
+		t.Helper()
+		actual, err := fakePinnipedClient.IDPV1alpha1().LDAPIdentityProviders(testNamespace).Get(ctx, testName, metav1.GetOptions{})
+		require.NoError(t, err)
+		for _, condition := range actual.Status.Conditions {
+			if condition.Type == "HostsHealthy" {
+				require.Equal(t, wantStatus, condition.Status)
+				require.Equal(t, wantMessage, condition.Message)
+				return
+			}
+		}
+		require.Fail(t, "no HostsHealthy condition", "conditions: %v", actual.Status.Conditions)
+	}
+	allHealthyMessage := fmt.Sprintf(`all 2 hosts are healthy: "%s", "%s"`, testHost, testHost2)
+
+	// Both hosts are validated, so the validated settings are cached.
+	require.NoError(t, testSync())
+	requireHostsHealthyCondition(v1alpha1.ConditionTrue, allHealthyMessage)
+	requireDialed([]string{testHost, testHost2})
+
+	// While the hosts are healthy, the cached settings are used without connecting to the hosts again.
+	require.NoError(t, testSync())
+	requireHostsHealthyCondition(v1alpha1.ConditionTrue, allHealthyMessage)
+	requireDialed(nil)
+
+	// The second host goes down, which is noticed by a provider of the IDP, e.g. during a login.
+	setHost2Down(true)
+	ldapProviders := cache.GetLDAPIdentityProviders()
+	require.Len(t, ldapProviders, 1)
+	require.Error(t, ldapProviders[0].(*upstreamldap.Provider).TestConnection(ctx))
+	requireDialed([]string{testHost, testHost2})
+
+	// The next sync reports the unhealthy host, even though the settings were already validated.
+	require.EqualError(t, testSync(), controllerlib.ErrSyntheticRequeue.Error())
+	requireHostsHealthyCondition(v1alpha1.ConditionFalse, fmt.Sprintf(
+		`1 of 2 hosts are healthy: "%s"; unhealthy hosts: "%s": error dialing host "%s": LDAP Result Code 200 "Network Error": some dial error`,
+		testHost, testHost2, testHost2))
+	requireDialed([]string{testHost, testHost2})
+
+	// Once the host is back, the next sync validates the hosts again and reports that they are all healthy.
+	setHost2Down(false)
+	require.NoError(t, testSync())
+	requireHostsHealthyCondition(v1alpha1.ConditionTrue, allHealthyMessage)
+	requireDialed([]string{testHost, testHost2})
+}
+
 func normalizeLDAPUpstreams(upstreams []v1alpha1.LDAPIdentityProvider, now metav1.Time) []v1alpha1.LDAPIdentityProvider {
 	result := make([]v1alpha1.LDAPIdentityProvider, 0, len(upstreams))
 	for _, u := range upstreams {
@@ -0,0 +1,179 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package oidcclientwatcher implements a controller which watches OIDCClients and reports the results of their
+// validation on their status.
+package oidcclientwatcher
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corev1informers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/utils/clock"
+
+	"go.pinniped.dev/generated/latest/apis/supervisor/config/v1alpha1"
+	pinnipedclientset "go.pinniped.dev/generated/latest/client/supervisor/clientset/versioned"
+	configinformers "go.pinniped.dev/generated/latest/client/supervisor/informers/externalversions/config/v1alpha1"
+	pinnipedcontroller "go.pinniped.dev/internal/controller"
+	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/oidcclientvalidator"
+)
+
+const (
+	oidcClientControllerName = "oidc-client-watcher-controller"
+)
+
+type oidcClientWatcherController struct {
+	log                logr.Logger
+	clock              clock.Clock
+	client             pinnipedclientset.Interface
+	oidcClientInformer configinformers.OIDCClientInformer
+	secretInformer     corev1informers.SecretInformer
+}
+
+// New instantiates a new controllerlib.Controller which will validate OIDCClients and update their status.
+// The validated clients are read directly from the informer caches by the clientregistry.ClientManager, so this
+// controller does not need to notify anyone about them.
+func New(
+	client pinnipedclientset.Interface,
+	oidcClientInformer configinformers.OIDCClientInformer,
+	secretInformer corev1informers.SecretInformer,
+	clock clock.Clock,
+	log logr.Logger,
+	withInformer pinnipedcontroller.WithInformerOptionFunc,
+) controllerlib.Controller {
+	c := oidcClientWatcherController{
+		log:                log.WithName(oidcClientControllerName),
+		clock:              clock,
+		client:             client,
+		oidcClientInformer: oidcClientInformer,
+		secretInformer:     secretInformer,
+	}
+	return controllerlib.New(
+		controllerlib.Config{Name: oidcClientControllerName, Syncer: &c},
+		withInformer(
+			oidcClientInformer,
+			pinnipedcontroller.MatchAnythingFilter(pinnipedcontroller.SingletonQueue()),
+			controllerlib.InformerOption{},
+		),
+		withInformer(
+			secretInformer,
+			pinnipedcontroller.MatchAnySecretOfTypeFilter(oidcclientvalidator.SecretType, pinnipedcontroller.SingletonQueue()),
+			controllerlib.InformerOption{},
+		),
+	)
+}
+
+// Sync implements controllerlib.Syncer.
+func (c *oidcClientWatcherController) Sync(ctx controllerlib.Context) error {
+	oidcClients, err := c.oidcClientInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list OIDCClients: %w", err)
+	}
+
+	for _, oidcClient := range oidcClients {
+		secret, err := c.secretInformer.Lister().Secrets(oidcClient.Namespace).Get(oidcClient.Spec.ClientSecret.SecretName)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed to get Secret %q for OIDCClient %q: %w", oidcClient.Spec.ClientSecret.SecretName, oidcClient.Name, err)
+		}
+
+		// When the Secret was not found, then secret is nil and the validator will report that.
+		_, conditions, _ := oidcclientvalidator.Validate(oidcClient, secret)
+		c.updateStatus(ctx.Context, oidcClient, conditions)
+	}
+
+	return nil
+}
+
+func (c *oidcClientWatcherController) updateStatus(
+	ctx context.Context,
+	oidcClient *v1alpha1.OIDCClient,
+	conditions []*v1alpha1.Condition,
+) {
+	log := c.log.WithValues("namespace", oidcClient.Namespace, "name", oidcClient.Name)
+	updated := oidcClient.DeepCopy()
+
+	hadErrorCondition := c.mergeConditions(conditions, oidcClient.Generation, &updated.Status.Conditions, log)
+
+	updated.Status.Phase = v1alpha1.PhaseReady
+	if hadErrorCondition {
+		updated.Status.Phase = v1alpha1.PhaseError
+	}
+
+	if equality.Semantic.DeepEqual(oidcClient, updated) {
+		return
+	}
+
+	_, err := c.client.
+		ConfigV1alpha1().
+		OIDCClients(oidcClient.Namespace).
+		UpdateStatus(ctx, updated, metav1.UpdateOptions{})
+	if err != nil {
+		log.Error(err, "failed to update status")
+	}
+}
+
+// mergeConditions merges conditions into conditionsToUpdate. It returns true if it merged any error conditions.
+func (c *oidcClientWatcherController) mergeConditions(
+	conditions []*v1alpha1.Condition,
+	observedGeneration int64,
+	conditionsToUpdate *[]v1alpha1.Condition,
+	log logr.Logger,
+) bool {
+	hadErrorCondition := false
+	for i := range conditions {
+		cond := conditions[i].DeepCopy()
+		cond.LastTransitionTime = metav1.NewTime(c.clock.Now())
+		cond.ObservedGeneration = observedGeneration
+		if mergeCondition(conditionsToUpdate, cond) {
+			log.Info("updated condition", "type", cond.Type, "status", cond.Status, "reason", cond.Reason, "message", cond.Message)
+		}
+		if cond.Status == v1alpha1.ConditionFalse {
+			hadErrorCondition = true
+		}
+	}
+	sort.SliceStable(*conditionsToUpdate, func(i, j int) bool {
+		return (*conditionsToUpdate)[i].Type < (*conditionsToUpdate)[j].Type
+	})
+	return hadErrorCondition
+}
+
+// mergeCondition merges a new v1alpha1.Condition into a slice of existing conditions. It returns true
+// if the condition has meaningfully changed.
+func mergeCondition(existing *[]v1alpha1.Condition, new *v1alpha1.Condition) bool {
+	// Find any existing condition with a matching type.
+	var old *v1alpha1.Condition
+	for i := range *existing {
+		if (*existing)[i].Type == new.Type {
+			old = &(*existing)[i]
+			break
+		}
+	}
+
+	// If there is no existing condition of this type, append this one and we're done.
+	if old == nil {
+		*existing = append(*existing, *new)
+		return true
+	}
+
+	// Keep the LastTransitionTime when the status has not changed.
+	if old.Status == new.Status {
+		new.LastTransitionTime = old.LastTransitionTime
+	}
+
+	// If anything has actually changed, update the entry and return true.
+	if !equality.Semantic.DeepEqual(old, new) {
+		*old = *new
+		return true
+	}
+
+	// Otherwise the entry is already up to date.
+	return false
+}
@@ -0,0 +1,189 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package oidcclientwatcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"go.pinniped.dev/generated/latest/apis/supervisor/config/v1alpha1"
+	pinnipedfake "go.pinniped.dev/generated/latest/client/supervisor/clientset/versioned/fake"
+	pinnipedinformers "go.pinniped.dev/generated/latest/client/supervisor/informers/externalversions"
+	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/testutil/testlogger"
+)
+
+const (
+	testNamespace = "test-namespace"
+	testName      = "client.oauth.pinniped.dev-test"
+
+	// testClientSecretHash is a bcrypt hash of "some-client-secret" with cost 12.
+	testClientSecretHash = "$2a$12$yHGWWZy/UWGN7V0ETyyP/etrfr1n0GOdWpwJt3HxUqBlar/3Z3.D6"
+)
+
+func TestOIDCClientWatcherControllerSync(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	earlier := metav1.NewTime(now.Add(-time.Hour))
+	nowMeta := metav1.NewTime(now)
+
+	validClient := &v1alpha1.OIDCClient{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testName, Generation: 1234},
+		Spec: v1alpha1.OIDCClientSpec{
+			AllowedRedirectURIs: []v1alpha1.RedirectURI{"https://app.example.com/callback"},
+			AllowedGrantTypes:   []v1alpha1.GrantType{"authorization_code", "refresh_token"},
+			AllowedScopes:       []v1alpha1.Scope{"openid", "offline_access"},
+			ClientSecret:        v1alpha1.OIDCClientSecret{SecretName: "some-secret"},
+		},
+	}
+	validSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: "some-secret"},
+		Type:       "secrets.pinniped.dev/oidc-client-secret",
+		Data:       map[string][]byte{"clientSecretHash": []byte(testClientSecretHash)},
+	}
+
+	successConditions := func(transitionTime metav1.Time) []v1alpha1.Condition {
+		return []v1alpha1.Condition{
+			{Type: "AllowedGrantTypesValid", Status: "True", Reason: "Success", Message: `"allowedGrantTypes" is valid`, ObservedGeneration: 1234, LastTransitionTime: transitionTime},
+			{Type: "AllowedRedirectURIsValid", Status: "True", Reason: "Success", Message: "all redirect URIs are valid", ObservedGeneration: 1234, LastTransitionTime: transitionTime},
+			{Type: "AllowedScopesValid", Status: "True", Reason: "Success", Message: `"allowedScopes" is valid`, ObservedGeneration: 1234, LastTransitionTime: transitionTime},
+			{Type: "ClientIDValid", Status: "True", Reason: "Success", Message: `client ID "client.oauth.pinniped.dev-test" is valid`, ObservedGeneration: 1234, LastTransitionTime: transitionTime},
+			{Type: "ClientSecretValid", Status: "True", Reason: "Success", Message: "loaded client secret hash", ObservedGeneration: 1234, LastTransitionTime: transitionTime},
+		}
+	}
+
+	tests := []struct {
+		name              string
+		inputClients      []runtime.Object
+		inputSecrets      []runtime.Object
+		wantErr           string
+		wantClientsStatus []v1alpha1.OIDCClientStatus
+		wantStatusUpdates int
+	}{
+		{
+			name:              "no OIDCClients",
+			wantClientsStatus: []v1alpha1.OIDCClientStatus{},
+		},
+		{
+			name:         "valid OIDCClient",
+			inputClients: []runtime.Object{validClient},
+			inputSecrets: []runtime.Object{validSecret},
+			wantClientsStatus: []v1alpha1.OIDCClientStatus{
+				{Phase: "Ready", Conditions: successConditions(nowMeta)},
+			},
+			wantStatusUpdates: 1,
+		},
+		{
+			name: "valid OIDCClient whose status is already up to date",
+			inputClients: []runtime.Object{func() runtime.Object {
+				c := validClient.DeepCopy()
+				c.Status = v1alpha1.OIDCClientStatus{Phase: "Ready", Conditions: successConditions(earlier)}
+				return c
+			}()},
+			inputSecrets: []runtime.Object{validSecret},
+			wantClientsStatus: []v1alpha1.OIDCClientStatus{
+				{Phase: "Ready", Conditions: successConditions(earlier)},
+			},
+			wantStatusUpdates: 0,
+		},
+		{
+			name:         "OIDCClient whose Secret is missing",
+			inputClients: []runtime.Object{validClient},
+			wantClientsStatus: []v1alpha1.OIDCClientStatus{
+				{Phase: "Error", Conditions: func() []v1alpha1.Condition {
+					c := successConditions(nowMeta)
+					c[4] = v1alpha1.Condition{
+						Type: "ClientSecretValid", Status: "False", Reason: "SecretNotFound",
+						Message:            `referenced Secret "some-secret" was not found`,
+						ObservedGeneration: 1234, LastTransitionTime: nowMeta,
+					}
+					return c
+				}()},
+			},
+			wantStatusUpdates: 1,
+		},
+		{
+			name: "OIDCClient whose Secret was deleted after it was previously valid",
+			inputClients: []runtime.Object{func() runtime.Object {
+				c := validClient.DeepCopy()
+				c.Status = v1alpha1.OIDCClientStatus{Phase: "Ready", Conditions: successConditions(earlier)}
+				return c
+			}()},
+			wantClientsStatus: []v1alpha1.OIDCClientStatus{
+				{Phase: "Error", Conditions: func() []v1alpha1.Condition {
+					c := successConditions(earlier)
+					c[4] = v1alpha1.Condition{
+						Type: "ClientSecretValid", Status: "False", Reason: "SecretNotFound",
+						Message:            `referenced Secret "some-secret" was not found`,
+						ObservedGeneration: 1234, LastTransitionTime: nowMeta,
+					}
+					return c
+				}()},
+			},
+			wantStatusUpdates: 1,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			fakePinnipedClient := pinnipedfake.NewSimpleClientset(tt.inputClients...)
+			pinnipedInformers := pinnipedinformers.NewSharedInformerFactory(fakePinnipedClient, 0)
+			fakeKubeClient := fake.NewSimpleClientset(tt.inputSecrets...)
+			kubeInformers := informers.NewSharedInformerFactory(fakeKubeClient, 0)
+			testLog := testlogger.New(t)
+
+			controller := New(
+				fakePinnipedClient,
+				pinnipedInformers.Config().V1alpha1().OIDCClients(),
+				kubeInformers.Core().V1().Secrets(),
+				clocktesting.NewFakeClock(now),
+				testLog.Logger,
+				controllerlib.WithInformer,
+			)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			pinnipedInformers.Start(ctx.Done())
+			kubeInformers.Start(ctx.Done())
+			controllerlib.TestRunSynchronously(t, controller)
+
+			syncCtx := controllerlib.Context{Context: ctx, Key: controllerlib.Key{}}
+
+			if err := controllerlib.TestSync(t, controller, syncCtx); tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+
+			actualClients, err := fakePinnipedClient.ConfigV1alpha1().OIDCClients(testNamespace).List(ctx, metav1.ListOptions{})
+			require.NoError(t, err)
+			actualStatuses := make([]v1alpha1.OIDCClientStatus, 0, len(actualClients.Items))
+			for _, c := range actualClients.Items {
+				actualStatuses = append(actualStatuses, c.Status)
+			}
+			require.Equal(t, tt.wantClientsStatus, actualStatuses)
+
+			statusUpdates := 0
+			for _, action := range fakePinnipedClient.Actions() {
+				if action.GetVerb() == "update" && action.GetSubresource() == "status" {
+					statusUpdates++
+				}
+			}
+			require.Equal(t, tt.wantStatusUpdates, statusUpdates)
+		})
+	}
+}
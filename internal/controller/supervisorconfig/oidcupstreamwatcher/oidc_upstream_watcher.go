@@ -36,6 +36,7 @@ import (
 	"go.pinniped.dev/internal/controllerlib"
 	"go.pinniped.dev/internal/net/phttp"
 	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/tracing"
 	"go.pinniped.dev/internal/upstreamoidc"
 )
 
@@ -350,9 +351,12 @@ func (c *oidcWatcherController) validateIssuer(ctx context.Context, upstream *v1
 	}
 
 	// Get the revocation endpoint, if there is one. Many providers do not offer a revocation endpoint.
+	// Also get the end session endpoint, if there is one.
 	var additionalDiscoveryClaims struct {
 		// "revocation_endpoint" is specified by https://datatracker.ietf.org/doc/html/rfc8414#section-2
 		RevocationEndpoint string `json:"revocation_endpoint"`
+		// "end_session_endpoint" is specified by https://openid.net/specs/openid-connect-rpinitiated-1_0.html#OPMetadata
+		EndSessionEndpoint string `json:"end_session_endpoint"`
 	}
 	if err := discoveredProvider.Claims(&additionalDiscoveryClaims); err != nil {
 		// This shouldn't actually happen because the above call to NewProvider() would have already returned this error.
@@ -376,6 +380,19 @@ func (c *oidcWatcherController) validateIssuer(ctx context.Context, upstream *v1
 		// Remember the URL for later use.
 		result.RevocationURL = revocationURL
 	}
+	if upstream.Spec.LogoutConfig.RedirectToUpstreamEndSession && additionalDiscoveryClaims.EndSessionEndpoint != "" {
+		// Found an end session URL which we were configured to use. Validate it.
+		endSessionURL, endSessionURLCondition := validateHTTPSURL(
+			additionalDiscoveryClaims.EndSessionEndpoint,
+			"end session endpoint",
+			reasonInvalidResponse,
+		)
+		if endSessionURLCondition != nil {
+			return endSessionURLCondition
+		}
+		// Remember the URL for later use.
+		result.EndSessionURL = endSessionURL
+	}
 
 	_, authorizeURLCondition := validateHTTPSURL(
 		discoveredProvider.Endpoint().AuthURL,
@@ -452,6 +469,8 @@ func getClient(upstream *v1alpha1.OIDCIdentityProvider) (*http.Client, error) {
 func defaultClientShortTimeout(rootCAs *x509.CertPool) *http.Client {
 	c := phttp.Default(rootCAs)
 	c.Timeout = time.Minute
+	// Trace the requests to the provider, e.g. during logins and refreshes, and propagate the trace to it.
+	c.Transport = tracing.WrapTransport(c.Transport)
 	return c
 }
 
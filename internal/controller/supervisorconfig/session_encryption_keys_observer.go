@@ -0,0 +1,138 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package supervisorconfig
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apiserver/pkg/storage/value/encrypt/envelope"
+	corev1informers "k8s.io/client-go/informers/core/v1"
+
+	"go.pinniped.dev/generated/latest/client/supervisor/informers/externalversions/config/v1alpha1"
+	"go.pinniped.dev/internal/constable"
+	pinnipedcontroller "go.pinniped.dev/internal/controller"
+	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/sessionencryption"
+)
+
+type sessionEncryptionKeysObserverController struct {
+	issuerToKeysSetter       IssuerToSessionEncryptionKeysSetter
+	kms                      envelope.Service
+	federationDomainInformer v1alpha1.FederationDomainInformer
+	secretInformer           corev1informers.SecretInformer
+
+	// kmsDecrypted caches the keys which were decrypted by the KMS, by their encrypted value, so that each key is
+	// only sent to the KMS once.
+	kmsDecrypted map[string][]byte
+}
+
+type IssuerToSessionEncryptionKeysSetter interface {
+	SetIssuerToKeys(issuerToKeys map[string]*sessionencryption.Keys)
+}
+
+// NewSessionEncryptionKeysObserverController returns a controller which watches all of the FederationDomains and
+// their corresponding session encryption keys Secrets and fills an in-memory cache of the keys of each currently
+// configured issuer. When kms is not nil, it decrypts the keys which were encrypted by the KMS.
+// This controller assumes that the informers passed to it are already scoped down to the
+// appropriate namespace. It also assumes that the IssuerToSessionEncryptionKeysSetter passed to it has an
+// underlying implementation which is thread-safe.
+func NewSessionEncryptionKeysObserverController(
+	issuerToKeysSetter IssuerToSessionEncryptionKeysSetter,
+	kms envelope.Service,
+	secretInformer corev1informers.SecretInformer,
+	federationDomainInformer v1alpha1.FederationDomainInformer,
+	withInformer pinnipedcontroller.WithInformerOptionFunc,
+) controllerlib.Controller {
+	return controllerlib.New(
+		controllerlib.Config{
+			Name: "session-encryption-keys-observer-controller",
+			Syncer: &sessionEncryptionKeysObserverController{
+				issuerToKeysSetter:       issuerToKeysSetter,
+				kms:                      kms,
+				federationDomainInformer: federationDomainInformer,
+				secretInformer:           secretInformer,
+				kmsDecrypted:             map[string][]byte{},
+			},
+		},
+		withInformer(
+			secretInformer,
+			pinnipedcontroller.MatchAnySecretOfTypeFilter(sessionEncryptionKeysSecretTypeValue, nil),
+			controllerlib.InformerOption{},
+		),
+		withInformer(
+			federationDomainInformer,
+			pinnipedcontroller.MatchAnythingFilter(nil),
+			controllerlib.InformerOption{},
+		),
+	)
+}
+
+func (c *sessionEncryptionKeysObserverController) Sync(ctx controllerlib.Context) error {
+	ns := ctx.Key.Namespace
+	allProviders, err := c.federationDomainInformer.Lister().FederationDomains(ns).List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list FederationDomains: %w", err)
+	}
+
+	// Rebuild the whole map on any change to any Secret or FederationDomain, because either can have changes that
+	// can cause the map to need to be updated.
+	issuerToKeys := map[string]*sessionencryption.Keys{}
+	kmsDecrypted := map[string][]byte{}
+
+	for _, provider := range allProviders {
+		secretRef := provider.Status.Secrets.SessionEncryptionKeys
+		secret, err := c.secretInformer.Lister().Secrets(ns).Get(secretRef.Name)
+		if err != nil {
+			plog.Debug("sessionEncryptionKeysObserverController Sync could not find session encryption keys secret", "namespace", ns, "secretName", secretRef.Name)
+			continue
+		}
+
+		keysFromSecret, ok := readSessionEncryptionKeys(secret)
+		if !ok {
+			plog.Debug("sessionEncryptionKeysObserverController Sync found a session encryption keys secret with Data in an unexpected format", "namespace", ns, "secretName", secretRef.Name)
+			continue
+		}
+
+		keys := &sessionencryption.Keys{ActiveKeyID: keysFromSecret.ActiveKeyID, Keys: map[string][]byte{}}
+		for _, key := range keysFromSecret.Keys {
+			if !key.EncryptedWithKMS {
+				keys.Keys[key.ID] = key.Key
+				continue
+			}
+			decrypted, err := c.decryptWithKMS(key.Key)
+			if err != nil {
+				// The sessions which were encrypted with this key cannot be read until the KMS is available.
+				plog.WarningErr("sessionEncryptionKeysObserverController Sync could not decrypt a session encryption key with the KMS", err, "namespace", ns, "secretName", secretRef.Name, "keyID", key.ID)
+				continue
+			}
+			kmsDecrypted[string(key.Key)] = decrypted
+			keys.Keys[key.ID] = decrypted
+		}
+		issuerToKeys[provider.Spec.Issuer] = keys
+	}
+
+	// Forget about the keys which are not used anymore.
+	c.kmsDecrypted = kmsDecrypted
+
+	plog.Debug(
+		"sessionEncryptionKeysObserverController Sync updated the session encryption keys cache",
+		"issuerCount",
+		len(issuerToKeys),
+	)
+	c.issuerToKeysSetter.SetIssuerToKeys(issuerToKeys)
+
+	return nil
+}
+
+func (c *sessionEncryptionKeysObserverController) decryptWithKMS(encrypted []byte) ([]byte, error) {
+	if decrypted, ok := c.kmsDecrypted[string(encrypted)]; ok {
+		return decrypted, nil
+	}
+	if c.kms == nil {
+		return nil, constable.Error("no KMS is configured")
+	}
+	return c.kms.Decrypt(encrypted)
+}
@@ -0,0 +1,230 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package supervisorconfig
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/storage/value/encrypt/envelope"
+	kubeinformers "k8s.io/client-go/informers"
+	kubernetesfake "k8s.io/client-go/kubernetes/fake"
+
+	configv1alpha1 "go.pinniped.dev/generated/latest/apis/supervisor/config/v1alpha1"
+	pinnipedfake "go.pinniped.dev/generated/latest/client/supervisor/clientset/versioned/fake"
+	pinnipedinformers "go.pinniped.dev/generated/latest/client/supervisor/informers/externalversions"
+	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/sessionencryption"
+)
+
+func TestSessionEncryptionKeysObserverControllerSync(t *testing.T) {
+	t.Parallel()
+
+	const namespace = "some-namespace"
+
+	newFederationDomain := func(name, issuer string) *configv1alpha1.FederationDomain {
+		federationDomain := &configv1alpha1.FederationDomain{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Spec:       configv1alpha1.FederationDomainSpec{Issuer: issuer},
+		}
+		federationDomain.Status.Secrets.SessionEncryptionKeys.Name = name + "-session-encryption-keys"
+		return federationDomain
+	}
+	newSecret := func(name string, keys *sessionEncryptionKeys) *corev1.Secret {
+		data, err := json.Marshal(keys)
+		require.NoError(t, err)
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name + "-session-encryption-keys", Namespace: namespace},
+			Data:       map[string][]byte{"keys": data},
+			Type:       "secrets.pinniped.dev/federation-domain-session-encryption-keys",
+		}
+	}
+
+	tests := []struct {
+		name              string
+		federationDomains []*configv1alpha1.FederationDomain
+		secrets           []*corev1.Secret
+		kms               envelope.Service
+		wantIssuerToKeys  map[string]*sessionencryption.Keys
+	}{
+		{
+			name:             "there are no FederationDomains",
+			wantIssuerToKeys: map[string]*sessionencryption.Keys{},
+		},
+		{
+			name: "some FederationDomains have valid secrets",
+			federationDomains: []*configv1alpha1.FederationDomain{
+				newFederationDomain("fd1", "https://issuer1.example.com"),
+				newFederationDomain("fd2", "https://issuer2.example.com"),
+				newFederationDomain("fd3", "https://issuer3.example.com"),
+				newFederationDomain("fd4", "https://issuer4.example.com"),
+			},
+			secrets: []*corev1.Secret{
+				newSecret("fd1", &sessionEncryptionKeys{
+					ActiveKeyID: "key1",
+					Keys: []sessionEncryptionKey{
+						{ID: "key1", Key: []byte("some-key")},
+						{ID: "key2", Key: []byte("some-retired-key")},
+					},
+				}),
+				newSecret("fd2", &sessionEncryptionKeys{
+					ActiveKeyID: "key3",
+					Keys:        []sessionEncryptionKey{{ID: "key3", Key: []byte("some-other-key")}},
+				}),
+				newSecret("fd3", &sessionEncryptionKeys{
+					ActiveKeyID: "key4",
+					Keys:        []sessionEncryptionKey{{ID: "some-other-key-id", Key: []byte("invalid")}},
+				}),
+			},
+			wantIssuerToKeys: map[string]*sessionencryption.Keys{
+				"https://issuer1.example.com": {ActiveKeyID: "key1", Keys: map[string][]byte{
+					"key1": []byte("some-key"),
+					"key2": []byte("some-retired-key"),
+				}},
+				"https://issuer2.example.com": {ActiveKeyID: "key3", Keys: map[string][]byte{
+					"key3": []byte("some-other-key"),
+				}},
+			},
+		},
+		{
+			name:              "the keys are encrypted by the KMS",
+			federationDomains: []*configv1alpha1.FederationDomain{newFederationDomain("fd1", "https://issuer1.example.com")},
+			secrets: []*corev1.Secret{
+				newSecret("fd1", &sessionEncryptionKeys{
+					ActiveKeyID: "key1",
+					Keys: []sessionEncryptionKey{
+						{ID: "key1", Key: []byte("kms:some-key"), EncryptedWithKMS: true},
+						{ID: "key2", Key: []byte("some-key-which-was-not-encrypted-yet")},
+					},
+				}),
+			},
+			kms: &fakeKMS{},
+			wantIssuerToKeys: map[string]*sessionencryption.Keys{
+				"https://issuer1.example.com": {ActiveKeyID: "key1", Keys: map[string][]byte{
+					"key1": []byte("some-key"),
+					"key2": []byte("some-key-which-was-not-encrypted-yet"),
+				}},
+			},
+		},
+		{
+			name:              "the keys are encrypted by the KMS, but the KMS fails",
+			federationDomains: []*configv1alpha1.FederationDomain{newFederationDomain("fd1", "https://issuer1.example.com")},
+			secrets: []*corev1.Secret{
+				newSecret("fd1", &sessionEncryptionKeys{
+					ActiveKeyID: "key1",
+					Keys: []sessionEncryptionKey{
+						{ID: "key1", Key: []byte("kms:some-key"), EncryptedWithKMS: true},
+						{ID: "key2", Key: []byte("some-key-which-was-not-encrypted-yet")},
+					},
+				}),
+			},
+			kms: &fakeKMS{err: errors.New("some kms error")},
+			wantIssuerToKeys: map[string]*sessionencryption.Keys{
+				"https://issuer1.example.com": {ActiveKeyID: "key1", Keys: map[string][]byte{
+					"key2": []byte("some-key-which-was-not-encrypted-yet"),
+				}},
+			},
+		},
+		{
+			name:              "the keys are encrypted by a KMS, but no KMS is configured",
+			federationDomains: []*configv1alpha1.FederationDomain{newFederationDomain("fd1", "https://issuer1.example.com")},
+			secrets: []*corev1.Secret{
+				newSecret("fd1", &sessionEncryptionKeys{
+					ActiveKeyID: "key1",
+					Keys:        []sessionEncryptionKey{{ID: "key1", Key: []byte("kms:some-key"), EncryptedWithKMS: true}},
+				}),
+			},
+			wantIssuerToKeys: map[string]*sessionencryption.Keys{
+				"https://issuer1.example.com": {ActiveKeyID: "key1", Keys: map[string][]byte{}},
+			},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			kubeInformerClient := kubernetesfake.NewSimpleClientset()
+			for _, secret := range test.secrets {
+				require.NoError(t, kubeInformerClient.Tracker().Add(secret))
+			}
+			pinnipedInformerClient := pinnipedfake.NewSimpleClientset()
+			for _, federationDomain := range test.federationDomains {
+				require.NoError(t, pinnipedInformerClient.Tracker().Add(federationDomain))
+			}
+			kubeInformers := kubeinformers.NewSharedInformerFactory(kubeInformerClient, 0)
+			pinnipedInformers := pinnipedinformers.NewSharedInformerFactory(pinnipedInformerClient, 0)
+
+			setter := &fakeIssuerToSessionEncryptionKeysSetter{}
+			c := NewSessionEncryptionKeysObserverController(
+				setter,
+				test.kms,
+				kubeInformers.Core().V1().Secrets(),
+				pinnipedInformers.Config().V1alpha1().FederationDomains(),
+				controllerlib.WithInformer,
+			)
+
+			// Must start informers before calling TestRunSynchronously().
+			kubeInformers.Start(ctx.Done())
+			pinnipedInformers.Start(ctx.Done())
+			controllerlib.TestRunSynchronously(t, c)
+
+			err := controllerlib.TestSync(t, c, controllerlib.Context{
+				Context: ctx,
+				Key:     controllerlib.Key{Namespace: namespace, Name: "any-name"},
+			})
+			require.NoError(t, err)
+
+			require.True(t, setter.called)
+			require.Equal(t, test.wantIssuerToKeys, setter.issuerToKeys)
+		})
+	}
+}
+
+func TestSessionEncryptionKeysObserverControllerCachesKMSResults(t *testing.T) {
+	t.Parallel()
+
+	kms := &countingKMS{}
+	c := &sessionEncryptionKeysObserverController{kms: kms, kmsDecrypted: map[string][]byte{}}
+
+	decrypted, err := c.decryptWithKMS([]byte("kms:some-key"))
+	require.NoError(t, err)
+	require.Equal(t, "some-key", string(decrypted))
+	require.Equal(t, 1, kms.decryptCount)
+
+	// Only the keys which were decrypted during a sync are cached.
+	c.kmsDecrypted = map[string][]byte{"kms:some-key": decrypted}
+	decrypted, err = c.decryptWithKMS([]byte("kms:some-key"))
+	require.NoError(t, err)
+	require.Equal(t, "some-key", string(decrypted))
+	require.Equal(t, 1, kms.decryptCount)
+}
+
+type fakeIssuerToSessionEncryptionKeysSetter struct {
+	called       bool
+	issuerToKeys map[string]*sessionencryption.Keys
+}
+
+func (f *fakeIssuerToSessionEncryptionKeysSetter) SetIssuerToKeys(issuerToKeys map[string]*sessionencryption.Keys) {
+	f.called = true
+	f.issuerToKeys = issuerToKeys
+}
+
+type countingKMS struct {
+	fakeKMS
+	decryptCount int
+}
+
+func (c *countingKMS) Decrypt(data []byte) ([]byte, error) {
+	c.decryptCount++
+	return c.fakeKMS.Decrypt(data)
+}
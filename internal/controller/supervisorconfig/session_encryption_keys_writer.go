@@ -0,0 +1,464 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package supervisorconfig
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/storage/value/encrypt/envelope"
+	corev1informers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
+
+	configv1alpha1 "go.pinniped.dev/generated/latest/apis/supervisor/config/v1alpha1"
+	pinnipedclientset "go.pinniped.dev/generated/latest/client/supervisor/clientset/versioned"
+	configinformers "go.pinniped.dev/generated/latest/client/supervisor/informers/externalversions/config/v1alpha1"
+	pinnipedcontroller "go.pinniped.dev/internal/controller"
+	"go.pinniped.dev/internal/controller/supervisorconfig/generator"
+	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/sessionencryption"
+)
+
+const (
+	// sessionEncryptionKeysKey is the key in a FederationDomain's session encryption keys Secret's Data map. It
+	// points to a sessionEncryptionKeys as JSON.
+	//
+	// Note! The value for this key will contain private key material, unless the keys are encrypted by a KMS!
+	sessionEncryptionKeysKey = "keys"
+
+	sessionEncryptionKeysSecretTypeValue corev1.SecretType = "secrets.pinniped.dev/federation-domain-session-encryption-keys"
+
+	// retiredSessionEncryptionKeyGracePeriod is how long a retired key is kept at least, even when no stored session
+	// uses it anymore, because sessions which were just encrypted with it may not be in the informer cache yet.
+	retiredSessionEncryptionKeyGracePeriod = 5 * time.Minute
+	// retiredSessionEncryptionKeyCheckInterval is how often to check whether the sessions which use a retired key
+	// have all been re-encrypted or deleted.
+	retiredSessionEncryptionKeyCheckInterval = time.Minute
+)
+
+// generateSessionEncryptionKey is stubbed out for the purpose of testing. The default behavior is to generate a
+// random key and a random key ID.
+//nolint:gochecknoglobals
+var generateSessionEncryptionKey = func(r io.Reader) (string, []byte, error) {
+	keyID := make([]byte, 8)
+	if _, err := io.ReadFull(r, keyID); err != nil {
+		return "", nil, err
+	}
+	key := make([]byte, sessionencryption.KeySize)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return "", nil, err
+	}
+	return hex.EncodeToString(keyID), key, nil
+}
+
+// sessionEncryptionKeys is stored as JSON in a FederationDomain's session encryption keys Secret.
+type sessionEncryptionKeys struct {
+	// ActiveKeyID is the ID of the key which encrypts new sessions.
+	ActiveKeyID string `json:"activeKeyID"`
+	// Keys are the active key and the retired keys which may still encrypt some stored sessions.
+	Keys []sessionEncryptionKey `json:"keys"`
+	// HandledRotationRequest is the value of the FederationDomain's spec.sessionEncryption.rotationRequest which
+	// was last handled, so each new value causes exactly one rotation.
+	HandledRotationRequest string `json:"handledRotationRequest,omitempty"`
+}
+
+type sessionEncryptionKey struct {
+	ID  string `json:"id"`
+	Key []byte `json:"key"`
+	// EncryptedWithKMS is whether Key is encrypted by the KMS plugin of the Supervisor.
+	EncryptedWithKMS bool `json:"encryptedWithKMS,omitempty"`
+	// RetiredAt is when the key stopped encrypting new sessions. It is nil for the active key.
+	RetiredAt *metav1.Time `json:"retiredAt,omitempty"`
+}
+
+type sessionEncryptionKeysWriterController struct {
+	secretLabels             map[string]string
+	kms                      envelope.Service
+	clock                    clock.Clock
+	pinnipedClient           pinnipedclientset.Interface
+	kubeClient               kubernetes.Interface
+	federationDomainInformer configinformers.FederationDomainInformer
+	secretInformer           corev1informers.SecretInformer
+}
+
+// NewSessionEncryptionKeysWriterController returns a controllerlib.Controller that ensures a FederationDomain has a
+// corresponding Secret which holds the keys that encrypt its stored sessions. A new key becomes active whenever the
+// FederationDomain's spec.sessionEncryption.rotationRequest changes. Retired keys are deleted once no stored
+// session is encrypted with them anymore.
+//
+// When kms is not nil, the keys are encrypted by it before they are stored in the Secret.
+func NewSessionEncryptionKeysWriterController(
+	secretLabels map[string]string,
+	kms envelope.Service,
+	clock clock.Clock,
+	kubeClient kubernetes.Interface,
+	pinnipedClient pinnipedclientset.Interface,
+	secretInformer corev1informers.SecretInformer,
+	federationDomainInformer configinformers.FederationDomainInformer,
+	withInformer pinnipedcontroller.WithInformerOptionFunc,
+) controllerlib.Controller {
+	isSecretToSync := func(obj metav1.Object) bool {
+		return generator.IsFederationDomainSecretOfType(obj, sessionEncryptionKeysSecretTypeValue)
+	}
+
+	return controllerlib.New(
+		controllerlib.Config{
+			Name: "session-encryption-keys-writer-controller",
+			Syncer: &sessionEncryptionKeysWriterController{
+				secretLabels:             secretLabels,
+				kms:                      kms,
+				clock:                    clock,
+				kubeClient:               kubeClient,
+				pinnipedClient:           pinnipedClient,
+				secretInformer:           secretInformer,
+				federationDomainInformer: federationDomainInformer,
+			},
+		},
+		// We want to be notified when a FederationDomain's secret gets updated or deleted. When this happens, we
+		// should get notified via the corresponding FederationDomain key.
+		withInformer(
+			secretInformer,
+			pinnipedcontroller.SimpleFilter(isSecretToSync, pinnipedcontroller.SecretIsControlledByParentFunc(isSecretToSync)),
+			controllerlib.InformerOption{},
+		),
+		withInformer(
+			federationDomainInformer,
+			pinnipedcontroller.MatchAnythingFilter(nil), // nil parent func is fine because each event is distinct
+			controllerlib.InformerOption{},
+		),
+	)
+}
+
+// Sync implements controllerlib.Syncer.
+func (c *sessionEncryptionKeysWriterController) Sync(ctx controllerlib.Context) error {
+	federationDomain, err := c.federationDomainInformer.Lister().FederationDomains(ctx.Key.Namespace).Get(ctx.Key.Name)
+	notFound := k8serrors.IsNotFound(err)
+	if err != nil && !notFound {
+		return fmt.Errorf(
+			"failed to get %s/%s FederationDomain: %w",
+			ctx.Key.Namespace,
+			ctx.Key.Name,
+			err,
+		)
+	}
+
+	if notFound {
+		// The corresponding secret to this FederationDomain should have been garbage collected since it should have
+		// had this FederationDomain as its owner.
+		plog.Debug(
+			"FederationDomain deleted",
+			"federationdomain",
+			klog.KRef(ctx.Key.Namespace, ctx.Key.Name),
+		)
+		return nil
+	}
+
+	// Only go to the API when the keys in the cache need to change.
+	keys, ok := c.keysFromCache(federationDomain)
+	if !ok || c.keysNeedUpdate(keys, federationDomain) {
+		keys, err = c.createOrUpdateSecret(ctx.Context, federationDomain)
+		if err != nil {
+			return fmt.Errorf("cannot create or update secret: %w", err)
+		}
+	}
+
+	// Ensure that the FederationDomain points to the secret and describes its keys.
+	newFederationDomain := federationDomain.DeepCopy()
+	newFederationDomain.Status.Secrets.SessionEncryptionKeys.Name = sessionEncryptionKeysSecretName(federationDomain)
+	newFederationDomain.Status.SessionEncryption = sessionEncryptionStatus(keys)
+	if !equality.Semantic.DeepEqual(federationDomain.Status, newFederationDomain.Status) {
+		if err := c.updateFederationDomainStatus(ctx.Context, newFederationDomain); err != nil {
+			return fmt.Errorf("cannot update FederationDomain: %w", err)
+		}
+		plog.Debug("updated FederationDomain", "federationdomain", klog.KObj(newFederationDomain))
+	}
+
+	// Check again later whether the retired keys are still used by any stored session.
+	if len(keys.Keys) > 1 {
+		ctx.Queue.AddAfter(ctx.Key, retiredSessionEncryptionKeyCheckInterval)
+	}
+
+	return nil
+}
+
+func sessionEncryptionKeysSecretName(federationDomain *configv1alpha1.FederationDomain) string {
+	if federationDomain.Status.Secrets.SessionEncryptionKeys.Name != "" {
+		return federationDomain.Status.Secrets.SessionEncryptionKeys.Name
+	}
+	return federationDomain.Name + "-session-encryption-keys"
+}
+
+func sessionEncryptionStatus(keys *sessionEncryptionKeys) configv1alpha1.FederationDomainSessionEncryptionStatus {
+	status := configv1alpha1.FederationDomainSessionEncryptionStatus{ActiveKeyID: keys.ActiveKeyID}
+	for _, key := range keys.Keys {
+		if key.ID != keys.ActiveKeyID {
+			status.RetiredKeyIDs = append(status.RetiredKeyIDs, key.ID)
+		}
+	}
+	return status
+}
+
+// keysFromCache returns the keys from the FederationDomain's secret in the cache. It returns false when the secret
+// does not exist or is invalid.
+func (c *sessionEncryptionKeysWriterController) keysFromCache(federationDomain *configv1alpha1.FederationDomain) (*sessionEncryptionKeys, bool) {
+	secret, err := c.secretInformer.Lister().Secrets(federationDomain.Namespace).Get(sessionEncryptionKeysSecretName(federationDomain))
+	if err != nil {
+		return nil, false
+	}
+	return readSessionEncryptionKeys(secret)
+}
+
+// readSessionEncryptionKeys parses the keys of a secret. It returns false when the secret is invalid.
+func readSessionEncryptionKeys(secret *corev1.Secret) (*sessionEncryptionKeys, bool) {
+	if secret.Type != sessionEncryptionKeysSecretTypeValue {
+		plog.Debug("secret does not have the expected type", "expectedType", sessionEncryptionKeysSecretTypeValue, "actualType", secret.Type)
+		return nil, false
+	}
+
+	var keys sessionEncryptionKeys
+	if err := json.Unmarshal(secret.Data[sessionEncryptionKeysKey], &keys); err != nil {
+		plog.Debug("cannot unmarshal session encryption keys", "err", err)
+		return nil, false
+	}
+
+	for _, key := range keys.Keys {
+		if key.ID == keys.ActiveKeyID {
+			return &keys, true
+		}
+	}
+	plog.Debug("did not find active session encryption key", "keyid", keys.ActiveKeyID)
+	return nil, false
+}
+
+// keysNeedUpdate returns whether a rotation was requested, whether some keys still need to be encrypted by the KMS,
+// or whether some retired keys are not used anymore.
+func (c *sessionEncryptionKeysWriterController) keysNeedUpdate(
+	keys *sessionEncryptionKeys,
+	federationDomain *configv1alpha1.FederationDomain,
+) bool {
+	if c.rotationRequested(keys, federationDomain) {
+		return true
+	}
+	for _, key := range keys.Keys {
+		if c.kms != nil && !key.EncryptedWithKMS {
+			return true
+		}
+		if c.isUnusedRetiredKey(key, federationDomain.Namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *sessionEncryptionKeysWriterController) rotationRequested(
+	keys *sessionEncryptionKeys,
+	federationDomain *configv1alpha1.FederationDomain,
+) bool {
+	request := federationDomain.Spec.SessionEncryption.RotationRequest
+	return request != "" && request != keys.HandledRotationRequest
+}
+
+// isUnusedRetiredKey returns whether a key was retired a while ago and no stored session is encrypted with it.
+func (c *sessionEncryptionKeysWriterController) isUnusedRetiredKey(key sessionEncryptionKey, namespace string) bool {
+	if key.RetiredAt == nil || c.clock.Now().Before(key.RetiredAt.Add(retiredSessionEncryptionKeyGracePeriod)) {
+		return false
+	}
+	selector := labels.SelectorFromSet(labels.Set{crud.EncryptionKeyIDLabelKey: key.ID})
+	sessions, err := c.secretInformer.Lister().Secrets(namespace).List(selector)
+	if err != nil {
+		return false
+	}
+	return len(sessions) == 0
+}
+
+// generateKeys returns the keys for a new secret, with a single active key.
+func (c *sessionEncryptionKeysWriterController) generateKeys(federationDomain *configv1alpha1.FederationDomain) (*sessionEncryptionKeys, error) {
+	keys := &sessionEncryptionKeys{
+		// A brand new key does not need to be rotated again because of a rotation request made before it existed.
+		HandledRotationRequest: federationDomain.Spec.SessionEncryption.RotationRequest,
+	}
+	if err := c.addActiveKey(keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// updateKeys rotates the keys when a rotation was requested, encrypts the keys with the KMS when there is one, and
+// deletes the retired keys which are not used anymore.
+func (c *sessionEncryptionKeysWriterController) updateKeys(
+	keys *sessionEncryptionKeys,
+	federationDomain *configv1alpha1.FederationDomain,
+) error {
+	if c.rotationRequested(keys, federationDomain) {
+		retiredKeyID := keys.ActiveKeyID
+		if err := c.addActiveKey(keys); err != nil {
+			return err
+		}
+		keys.HandledRotationRequest = federationDomain.Spec.SessionEncryption.RotationRequest
+		plog.Info("rotated FederationDomain session encryption key",
+			"federationdomain", klog.KObj(federationDomain),
+			"activatedKeyID", keys.ActiveKeyID,
+			"retiredKeyID", retiredKeyID,
+		)
+	}
+
+	stillUsed := make([]sessionEncryptionKey, 0, len(keys.Keys))
+	for _, key := range keys.Keys {
+		if c.isUnusedRetiredKey(key, federationDomain.Namespace) {
+			plog.Info("deleted unused FederationDomain session encryption key",
+				"federationdomain", klog.KObj(federationDomain),
+				"keyID", key.ID,
+			)
+			continue
+		}
+		if c.kms != nil && !key.EncryptedWithKMS {
+			encrypted, err := c.kms.Encrypt(key.Key)
+			if err != nil {
+				return fmt.Errorf("cannot encrypt session encryption key with KMS: %w", err)
+			}
+			key.Key = encrypted
+			key.EncryptedWithKMS = true
+		}
+		stillUsed = append(stillUsed, key)
+	}
+	keys.Keys = stillUsed
+
+	return nil
+}
+
+// addActiveKey generates a new key and makes it the active key. The previous active key is retired.
+func (c *sessionEncryptionKeysWriterController) addActiveKey(keys *sessionEncryptionKeys) error {
+	keyID, key, err := generateSessionEncryptionKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("cannot generate session encryption key: %w", err)
+	}
+
+	now := metav1.NewTime(c.clock.Now())
+	for i := range keys.Keys {
+		if keys.Keys[i].RetiredAt == nil {
+			keys.Keys[i].RetiredAt = &now
+		}
+	}
+	keys.Keys = append([]sessionEncryptionKey{{ID: keyID, Key: key}}, keys.Keys...)
+	keys.ActiveKeyID = keyID
+	return nil
+}
+
+func (c *sessionEncryptionKeysWriterController) createOrUpdateSecret(
+	ctx context.Context,
+	federationDomain *configv1alpha1.FederationDomain,
+) (*sessionEncryptionKeys, error) {
+	secretClient := c.kubeClient.CoreV1().Secrets(federationDomain.Namespace)
+	var result *sessionEncryptionKeys
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		// Decide what to change based on the secret from the API instead of the cache, to avoid rotating twice
+		// when the cache has not seen our previous update yet.
+		oldSecret, err := secretClient.Get(ctx, sessionEncryptionKeysSecretName(federationDomain), metav1.GetOptions{})
+		notFound := k8serrors.IsNotFound(err)
+		if err != nil && !notFound {
+			return fmt.Errorf("cannot get secret: %w", err)
+		}
+
+		var keys *sessionEncryptionKeys
+		if !notFound {
+			var ok bool
+			if keys, ok = readSessionEncryptionKeys(oldSecret); ok && !c.keysNeedUpdate(keys, federationDomain) {
+				result = keys
+				return nil
+			}
+		}
+
+		if keys == nil {
+			// The secret does not exist or it is invalid, so start over with new keys.
+			if keys, err = c.generateKeys(federationDomain); err != nil {
+				return err
+			}
+		}
+		if err := c.updateKeys(keys, federationDomain); err != nil {
+			return err
+		}
+		data, err := json.Marshal(keys)
+		if err != nil {
+			return fmt.Errorf("cannot marshal session encryption keys: %w", err)
+		}
+
+		if notFound {
+			newSecret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      sessionEncryptionKeysSecretName(federationDomain),
+					Namespace: federationDomain.Namespace,
+					Labels:    c.secretLabels,
+					OwnerReferences: []metav1.OwnerReference{
+						*metav1.NewControllerRef(federationDomain, schema.GroupVersionKind{
+							Group:   configv1alpha1.SchemeGroupVersion.Group,
+							Version: configv1alpha1.SchemeGroupVersion.Version,
+							Kind:    federationDomainKind,
+						}),
+					},
+				},
+				Data: map[string][]byte{sessionEncryptionKeysKey: data},
+				Type: sessionEncryptionKeysSecretTypeValue,
+			}
+			if _, err := secretClient.Create(ctx, newSecret, metav1.CreateOptions{}); err != nil {
+				return fmt.Errorf("cannot create secret: %w", err)
+			}
+			plog.Debug("created secret", "secret", klog.KObj(newSecret))
+			result = keys
+			return nil
+		}
+
+		oldSecret.Data = map[string][]byte{sessionEncryptionKeysKey: data}
+		oldSecret.Type = sessionEncryptionKeysSecretTypeValue
+		if _, err := secretClient.Update(ctx, oldSecret, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+		plog.Debug("updated secret", "secret", klog.KObj(oldSecret))
+		result = keys
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *sessionEncryptionKeysWriterController) updateFederationDomainStatus(
+	ctx context.Context,
+	newFederationDomain *configv1alpha1.FederationDomain,
+) error {
+	federationDomainClient := c.pinnipedClient.ConfigV1alpha1().FederationDomains(newFederationDomain.Namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		oldFederationDomain, err := federationDomainClient.Get(ctx, newFederationDomain.Name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("cannot get FederationDomain: %w", err)
+		}
+
+		if newFederationDomain.Status.Secrets.SessionEncryptionKeys.Name == oldFederationDomain.Status.Secrets.SessionEncryptionKeys.Name &&
+			equality.Semantic.DeepEqual(newFederationDomain.Status.SessionEncryption, oldFederationDomain.Status.SessionEncryption) {
+			// If the existing FederationDomain is up to date, we don't need to update it.
+			return nil
+		}
+
+		oldFederationDomain.Status.Secrets.SessionEncryptionKeys.Name = newFederationDomain.Status.Secrets.SessionEncryptionKeys.Name
+		oldFederationDomain.Status.SessionEncryption = newFederationDomain.Status.SessionEncryption
+		_, err = federationDomainClient.UpdateStatus(ctx, oldFederationDomain, metav1.UpdateOptions{})
+		return err
+	})
+}
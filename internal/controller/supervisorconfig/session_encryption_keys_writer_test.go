@@ -0,0 +1,407 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package supervisorconfig
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/storage/value/encrypt/envelope"
+	kubeinformers "k8s.io/client-go/informers"
+	kubernetesfake "k8s.io/client-go/kubernetes/fake"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	configv1alpha1 "go.pinniped.dev/generated/latest/apis/supervisor/config/v1alpha1"
+	pinnipedfake "go.pinniped.dev/generated/latest/client/supervisor/clientset/versioned/fake"
+	pinnipedinformers "go.pinniped.dev/generated/latest/client/supervisor/informers/externalversions"
+	"go.pinniped.dev/internal/controllerlib"
+)
+
+func TestSessionEncryptionKeysWriterControllerSync(t *testing.T) {
+	// We shouldn't run this test in parallel since it messes with a global function (generateSessionEncryptionKey).
+
+	const namespace = "tuna-namespace"
+
+	now := time.Date(2022, 5, 12, 3, 4, 5, 0, time.Local)
+	retiredLongAgo := metav1.NewTime(now.Add(-time.Hour))
+	retiredJustNow := metav1.NewTime(now.Add(-time.Minute))
+	nowTime := metav1.NewTime(now)
+
+	federationDomain := &configv1alpha1.FederationDomain{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "good-federationDomain",
+			Namespace: namespace,
+			UID:       "good-federationDomain-uid",
+		},
+		Spec: configv1alpha1.FederationDomainSpec{
+			Issuer: "https://some-issuer.com",
+		},
+	}
+	withRotationRequest := func(federationDomain *configv1alpha1.FederationDomain, request string) *configv1alpha1.FederationDomain {
+		federationDomain = federationDomain.DeepCopy()
+		federationDomain.Spec.SessionEncryption.RotationRequest = request
+		return federationDomain
+	}
+	withStatus := func(
+		federationDomain *configv1alpha1.FederationDomain,
+		status configv1alpha1.FederationDomainSessionEncryptionStatus,
+	) *configv1alpha1.FederationDomain {
+		federationDomain = federationDomain.DeepCopy()
+		federationDomain.Status.Secrets.SessionEncryptionKeys.Name = "good-federationDomain-session-encryption-keys"
+		federationDomain.Status.SessionEncryption = status
+		return federationDomain
+	}
+
+	newSecret := func(keys *sessionEncryptionKeys) *corev1.Secret {
+		data, err := json.Marshal(keys)
+		require.NoError(t, err)
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "good-federationDomain-session-encryption-keys",
+				Namespace: namespace,
+				Labels:    map[string]string{"myLabelKey1": "myLabelValue1"},
+				OwnerReferences: []metav1.OwnerReference{
+					{
+						APIVersion:         configv1alpha1.SchemeGroupVersion.String(),
+						Kind:               "FederationDomain",
+						Name:               federationDomain.Name,
+						UID:                federationDomain.UID,
+						BlockOwnerDeletion: boolPtr(true),
+						Controller:         boolPtr(true),
+					},
+				},
+			},
+			Data: map[string][]byte{"keys": data},
+			Type: "secrets.pinniped.dev/federation-domain-session-encryption-keys",
+		}
+	}
+	newSessionSecret := func(keyID string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "some-session-" + keyID,
+				Namespace: namespace,
+				Labels:    map[string]string{"storage.pinniped.dev/encryption-key-id": keyID},
+			},
+		}
+	}
+
+	key := func(b byte) []byte { return bytes.Repeat([]byte{b}, 32) }
+	existingKeys := func() *sessionEncryptionKeys {
+		return &sessionEncryptionKeys{
+			ActiveKeyID: "existing-key",
+			Keys:        []sessionEncryptionKey{{ID: "existing-key", Key: key('e')}},
+		}
+	}
+	existingStatus := configv1alpha1.FederationDomainSessionEncryptionStatus{ActiveKeyID: "existing-key"}
+	keysWithRetiredKey := func(retiredAt metav1.Time) *sessionEncryptionKeys {
+		return &sessionEncryptionKeys{
+			ActiveKeyID: "existing-key",
+			Keys: []sessionEncryptionKey{
+				{ID: "existing-key", Key: key('e')},
+				{ID: "retired-key", Key: key('r'), RetiredAt: &retiredAt},
+			},
+		}
+	}
+	statusWithRetiredKey := configv1alpha1.FederationDomainSessionEncryptionStatus{
+		ActiveKeyID:   "existing-key",
+		RetiredKeyIDs: []string{"retired-key"},
+	}
+
+	tests := []struct {
+		name                          string
+		federationDomains             []*configv1alpha1.FederationDomain
+		secrets                       []*corev1.Secret
+		kms                           envelope.Service
+		wantKeys                      *sessionEncryptionKeys
+		wantStatus                    *configv1alpha1.FederationDomainSessionEncryptionStatus
+		wantGenerateKeyCount          int
+		wantNoSecretWrites            bool
+		wantRequeueAfter              time.Duration
+		wantError                     string
+		wantFederationDomainNotExists bool
+	}{
+		{
+			name:                          "FederationDomain does not exist",
+			wantNoSecretWrites:            true,
+			wantFederationDomainNotExists: true,
+		},
+		{
+			name:              "secret does not exist",
+			federationDomains: []*configv1alpha1.FederationDomain{withRotationRequest(federationDomain, "old-request")},
+			wantKeys: &sessionEncryptionKeys{
+				ActiveKeyID:            "generated-key-1",
+				Keys:                   []sessionEncryptionKey{{ID: "generated-key-1", Key: key(1)}},
+				HandledRotationRequest: "old-request",
+			},
+			wantStatus:           &configv1alpha1.FederationDomainSessionEncryptionStatus{ActiveKeyID: "generated-key-1"},
+			wantGenerateKeyCount: 1,
+		},
+		{
+			name:               "secret is up to date",
+			federationDomains:  []*configv1alpha1.FederationDomain{withStatus(federationDomain, existingStatus)},
+			secrets:            []*corev1.Secret{newSecret(existingKeys())},
+			wantKeys:           existingKeys(),
+			wantStatus:         &existingStatus,
+			wantNoSecretWrites: true,
+		},
+		{
+			name:               "secret is up to date, but the FederationDomain status is not",
+			federationDomains:  []*configv1alpha1.FederationDomain{federationDomain},
+			secrets:            []*corev1.Secret{newSecret(existingKeys())},
+			wantKeys:           existingKeys(),
+			wantStatus:         &existingStatus,
+			wantNoSecretWrites: true,
+		},
+		{
+			name:              "secret is invalid",
+			federationDomains: []*configv1alpha1.FederationDomain{withStatus(federationDomain, existingStatus)},
+			secrets: []*corev1.Secret{func() *corev1.Secret {
+				s := newSecret(existingKeys())
+				s.Data["keys"] = []byte(`{"activeKeyID":"some-other-key","keys":[]}`)
+				return s
+			}()},
+			wantKeys: &sessionEncryptionKeys{
+				ActiveKeyID: "generated-key-1",
+				Keys:        []sessionEncryptionKey{{ID: "generated-key-1", Key: key(1)}},
+			},
+			wantStatus:           &configv1alpha1.FederationDomainSessionEncryptionStatus{ActiveKeyID: "generated-key-1"},
+			wantGenerateKeyCount: 1,
+		},
+		{
+			name:              "a rotation was requested",
+			federationDomains: []*configv1alpha1.FederationDomain{withRotationRequest(withStatus(federationDomain, existingStatus), "new-request")},
+			secrets:           []*corev1.Secret{newSecret(existingKeys())},
+			wantKeys: &sessionEncryptionKeys{
+				ActiveKeyID: "generated-key-1",
+				Keys: []sessionEncryptionKey{
+					{ID: "generated-key-1", Key: key(1)},
+					{ID: "existing-key", Key: key('e'), RetiredAt: &nowTime},
+				},
+				HandledRotationRequest: "new-request",
+			},
+			wantStatus: &configv1alpha1.FederationDomainSessionEncryptionStatus{
+				ActiveKeyID:   "generated-key-1",
+				RetiredKeyIDs: []string{"existing-key"},
+			},
+			wantGenerateKeyCount: 1,
+			wantRequeueAfter:     time.Minute,
+		},
+		{
+			name: "the rotation request was already handled",
+			federationDomains: []*configv1alpha1.FederationDomain{
+				withRotationRequest(withStatus(federationDomain, existingStatus), "old-request"),
+			},
+			secrets: []*corev1.Secret{newSecret(func() *sessionEncryptionKeys {
+				keys := existingKeys()
+				keys.HandledRotationRequest = "old-request"
+				return keys
+			}())},
+			wantKeys: func() *sessionEncryptionKeys {
+				keys := existingKeys()
+				keys.HandledRotationRequest = "old-request"
+				return keys
+			}(),
+			wantStatus:         &existingStatus,
+			wantNoSecretWrites: true,
+		},
+		{
+			name:              "a retired key is not used anymore",
+			federationDomains: []*configv1alpha1.FederationDomain{withStatus(federationDomain, statusWithRetiredKey)},
+			secrets: []*corev1.Secret{
+				newSecret(keysWithRetiredKey(retiredLongAgo)),
+				newSessionSecret("existing-key"),
+			},
+			wantKeys:   existingKeys(),
+			wantStatus: &existingStatus,
+		},
+		{
+			name:              "a retired key is still used by a session",
+			federationDomains: []*configv1alpha1.FederationDomain{withStatus(federationDomain, statusWithRetiredKey)},
+			secrets: []*corev1.Secret{
+				newSecret(keysWithRetiredKey(retiredLongAgo)),
+				newSessionSecret("retired-key"),
+			},
+			wantKeys:           keysWithRetiredKey(retiredLongAgo),
+			wantStatus:         &statusWithRetiredKey,
+			wantNoSecretWrites: true,
+			wantRequeueAfter:   time.Minute,
+		},
+		{
+			name:               "a retired key was retired too recently to be deleted",
+			federationDomains:  []*configv1alpha1.FederationDomain{withStatus(federationDomain, statusWithRetiredKey)},
+			secrets:            []*corev1.Secret{newSecret(keysWithRetiredKey(retiredJustNow))},
+			wantKeys:           keysWithRetiredKey(retiredJustNow),
+			wantStatus:         &statusWithRetiredKey,
+			wantNoSecretWrites: true,
+			wantRequeueAfter:   time.Minute,
+		},
+		{
+			name:              "the keys are encrypted by the KMS",
+			federationDomains: []*configv1alpha1.FederationDomain{withStatus(federationDomain, existingStatus)},
+			secrets:           []*corev1.Secret{newSecret(existingKeys())},
+			kms:               &fakeKMS{},
+			wantKeys: &sessionEncryptionKeys{
+				ActiveKeyID: "existing-key",
+				Keys: []sessionEncryptionKey{
+					{ID: "existing-key", Key: append([]byte("kms:"), key('e')...), EncryptedWithKMS: true},
+				},
+			},
+			wantStatus: &existingStatus,
+		},
+		{
+			name:              "new keys are encrypted by the KMS",
+			federationDomains: []*configv1alpha1.FederationDomain{federationDomain},
+			kms:               &fakeKMS{},
+			wantKeys: &sessionEncryptionKeys{
+				ActiveKeyID: "generated-key-1",
+				Keys: []sessionEncryptionKey{
+					{ID: "generated-key-1", Key: append([]byte("kms:"), key(1)...), EncryptedWithKMS: true},
+				},
+			},
+			wantStatus:           &configv1alpha1.FederationDomainSessionEncryptionStatus{ActiveKeyID: "generated-key-1"},
+			wantGenerateKeyCount: 1,
+		},
+		{
+			name:              "the KMS fails",
+			federationDomains: []*configv1alpha1.FederationDomain{withStatus(federationDomain, existingStatus)},
+			secrets:           []*corev1.Secret{newSecret(existingKeys())},
+			kms:               &fakeKMS{err: errors.New("some kms error")},
+			wantError:         "cannot create or update secret: cannot encrypt session encryption key with KMS: some kms error",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			// We shouldn't run this test in parallel since it messes with a global function (generateSessionEncryptionKey).
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			generateKeyCount := 0
+			generateSessionEncryptionKeyWas := generateSessionEncryptionKey
+			generateSessionEncryptionKey = func(_ io.Reader) (string, []byte, error) {
+				generateKeyCount++
+				return fmt.Sprintf("generated-key-%d", generateKeyCount), key(byte(generateKeyCount)), nil
+			}
+			defer func() {
+				generateSessionEncryptionKey = generateSessionEncryptionKeyWas
+			}()
+
+			kubeAPIClient := kubernetesfake.NewSimpleClientset()
+			kubeInformerClient := kubernetesfake.NewSimpleClientset()
+			for _, secret := range test.secrets {
+				require.NoError(t, kubeAPIClient.Tracker().Add(secret))
+				require.NoError(t, kubeInformerClient.Tracker().Add(secret))
+			}
+
+			pinnipedAPIClient := pinnipedfake.NewSimpleClientset()
+			pinnipedInformerClient := pinnipedfake.NewSimpleClientset()
+			for _, federationDomain := range test.federationDomains {
+				require.NoError(t, pinnipedAPIClient.Tracker().Add(federationDomain))
+				require.NoError(t, pinnipedInformerClient.Tracker().Add(federationDomain))
+			}
+
+			kubeInformers := kubeinformers.NewSharedInformerFactory(kubeInformerClient, 0)
+			pinnipedInformers := pinnipedinformers.NewSharedInformerFactory(pinnipedInformerClient, 0)
+
+			c := NewSessionEncryptionKeysWriterController(
+				map[string]string{"myLabelKey1": "myLabelValue1"},
+				test.kms,
+				clocktesting.NewFakeClock(now),
+				kubeAPIClient,
+				pinnipedAPIClient,
+				kubeInformers.Core().V1().Secrets(),
+				pinnipedInformers.Config().V1alpha1().FederationDomains(),
+				controllerlib.WithInformer,
+			)
+
+			// Must start informers before calling TestRunSynchronously().
+			kubeInformers.Start(ctx.Done())
+			pinnipedInformers.Start(ctx.Done())
+			controllerlib.TestRunSynchronously(t, c)
+
+			key := controllerlib.Key{Namespace: namespace, Name: federationDomain.Name}
+			queue := &testQueue{}
+			err := controllerlib.TestSync(t, c, controllerlib.Context{
+				Context: ctx,
+				Key:     key,
+				Queue:   queue,
+			})
+			if test.wantError != "" {
+				require.EqualError(t, err, test.wantError)
+				return
+			}
+			require.NoError(t, err)
+
+			require.Equal(t, test.wantGenerateKeyCount, generateKeyCount)
+
+			for _, action := range kubeAPIClient.Actions() {
+				if test.wantNoSecretWrites {
+					require.Equal(t, "get", action.GetVerb(), "expected no writes to secrets")
+				}
+			}
+
+			if test.wantKeys != nil {
+				secret, err := kubeAPIClient.CoreV1().Secrets(namespace).Get(ctx, "good-federationDomain-session-encryption-keys", metav1.GetOptions{})
+				require.NoError(t, err)
+				require.Equal(t, corev1.SecretType("secrets.pinniped.dev/federation-domain-session-encryption-keys"), secret.Type)
+				require.Equal(t, map[string]string{"myLabelKey1": "myLabelValue1"}, secret.Labels)
+				require.Len(t, secret.OwnerReferences, 1)
+				require.Equal(t, federationDomain.UID, secret.OwnerReferences[0].UID)
+
+				var keys sessionEncryptionKeys
+				require.NoError(t, json.Unmarshal(secret.Data["keys"], &keys))
+				require.Equal(t, test.wantKeys, &keys)
+			}
+
+			if test.wantFederationDomainNotExists {
+				require.Empty(t, pinnipedAPIClient.Actions())
+			}
+			if test.wantStatus != nil {
+				updated, err := pinnipedAPIClient.ConfigV1alpha1().FederationDomains(namespace).Get(ctx, federationDomain.Name, metav1.GetOptions{})
+				require.NoError(t, err)
+				require.Equal(t, "good-federationDomain-session-encryption-keys", updated.Status.Secrets.SessionEncryptionKeys.Name)
+				require.Equal(t, *test.wantStatus, updated.Status.SessionEncryption)
+			}
+
+			if test.wantRequeueAfter != 0 {
+				require.True(t, queue.called, "expected the key to be requeued")
+				require.Equal(t, key, queue.key)
+				require.Equal(t, test.wantRequeueAfter, queue.duration)
+			} else {
+				require.False(t, queue.called, "expected the key to not be requeued")
+			}
+		})
+	}
+}
+
+// fakeKMS "encrypts" data by prefixing it, so that tests can easily see what was encrypted.
+type fakeKMS struct {
+	err error
+}
+
+func (f *fakeKMS) Encrypt(data []byte) ([]byte, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return append([]byte("kms:"), data...), nil
+}
+
+func (f *fakeKMS) Decrypt(data []byte) ([]byte, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if !bytes.HasPrefix(data, []byte("kms:")) {
+		return nil, errors.New("not encrypted by this kms")
+	}
+	return bytes.TrimPrefix(data, []byte("kms:")), nil
+}
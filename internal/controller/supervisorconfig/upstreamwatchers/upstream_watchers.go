@@ -7,7 +7,9 @@ import (
 	"context"
 	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
@@ -36,8 +38,10 @@ const (
 	typeBindSecretValid              = "BindSecretValid"
 	typeTLSConfigurationValid        = "TLSConfigurationValid"
 	typeLDAPConnectionValid          = "LDAPConnectionValid"
+	typeHostsHealthy                 = "HostsHealthy"
 	TypeSearchBaseFound              = "SearchBaseFound"
 	reasonLDAPConnectionError        = "LDAPConnectionError"
+	reasonHostsUnhealthy             = "HostsUnhealthy"
 	noTLSConfigurationMessage        = "no TLS configuration provided"
 	loadedTLSConfigurationMessage    = "loaded TLS configuration"
 	ReasonUsingConfigurationFromSpec = "UsingConfigurationFromSpec"
@@ -59,7 +63,8 @@ type ValidatedSettings struct {
 	// Cache copies of the conditions that were computed when the above settings were cached, so we
 	// can keep writing them to the status in the future. This matters most when the first attempt
 	// to write them to the IDP's status fails. In this case, future Syncs calls will be able to
-	// use these cached values to try writing them again.
+	// use these cached values to try writing them again. The HostsHealthy condition is not cached,
+	// since the health of the hosts changes without any change to the IDP.
 	ConnectionValidCondition, SearchBaseFoundCondition *v1alpha1.Condition
 }
 
@@ -156,27 +161,32 @@ func ValidateTLSConfig(tlsSpec *v1alpha1.TLSSpec, config *upstreamldap.ProviderC
 	return validTLSCondition(loadedTLSConfigurationMessage)
 }
 
+// TestConnection validates the connection to each host of the LDAP IDP. The returned LDAPConnectionValid condition is
+// true when at least one host could be validated. The returned HostsHealthy condition, which reports the status of each
+// host, is nil when the LDAP IDP has only one host.
 func TestConnection(
 	ctx context.Context,
 	bindSecretName string,
 	config *upstreamldap.ProviderConfig,
 	currentSecretVersion string,
-) *v1alpha1.Condition {
+) (*v1alpha1.Condition, *v1alpha1.Condition) {
 	// First try using TLS.
 	config.ConnectionProtocol = upstreamldap.TLS
 	tlsLDAPProvider := upstreamldap.New(*config)
+	ldapProvider := tlsLDAPProvider
 	err := tlsLDAPProvider.TestConnection(ctx)
-	if err != nil {
+	if err != nil && len(validatedHosts(err)) == 0 {
 		plog.InfoErr("testing LDAP connection using TLS failed, so trying again with StartTLS", err, "host", config.Host)
-		// If there was any error, try again with StartTLS instead.
+		// If no host could be validated, try again with StartTLS instead.
 		config.ConnectionProtocol = upstreamldap.StartTLS
 		startTLSLDAPProvider := upstreamldap.New(*config)
 		startTLSErr := startTLSLDAPProvider.TestConnection(ctx)
-		if startTLSErr == nil {
+		if startTLSErr == nil || len(validatedHosts(startTLSErr)) > 0 {
 			plog.Info("testing LDAP connection using StartTLS succeeded", "host", config.Host)
-			// Successfully able to fall back to using StartTLS, so clear the original
+			// Successfully able to fall back to using StartTLS, so replace the original
 			// error and consider the connection test to be successful.
-			err = nil
+			ldapProvider = startTLSLDAPProvider
+			err = startTLSErr
 		} else {
 			plog.InfoErr("testing LDAP connection using StartTLS also failed", err, "host", config.Host)
 			// Falling back to StartTLS also failed, so put TLS back into the config
@@ -185,25 +195,79 @@ func TestConnection(
 		}
 	}
 
-	if err != nil {
+	// The hosts which were discovered using DNS are cached by the provider, so they are not looked up again.
+	hosts, _ := ldapProvider.Hosts(ctx)
+	var hostsHealthyCondition *v1alpha1.Condition
+	if len(hosts) > 1 || config.SRVDomain != "" {
+		hostsHealthyCondition = hostsHealthy(hosts, err)
+	}
+
+	if err != nil && len(validatedHosts(err)) == 0 {
 		return &v1alpha1.Condition{
 			Type:   typeLDAPConnectionValid,
 			Status: v1alpha1.ConditionFalse,
 			Reason: reasonLDAPConnectionError,
-			Message: fmt.Sprintf(`could not successfully connect to "%s" and bind as user "%s": %s`,
-				config.Host, config.BindUsername, err.Error()),
-		}
+			Message: fmt.Sprintf(`could not successfully connect to %s and bind as user "%s": %s`,
+				quotedHosts(hosts), config.BindUsername, err.Error()),
+		}, hostsHealthyCondition
 	}
 
+	if err != nil {
+		hosts = validatedHosts(err)
+	}
 	return &v1alpha1.Condition{
 		Type:   typeLDAPConnectionValid,
 		Status: v1alpha1.ConditionTrue,
 		Reason: ReasonSuccess,
-		Message: fmt.Sprintf(`successfully able to connect to "%s" and bind as user "%s" [validated with Secret "%s" at version "%s"]`,
-			config.Host, config.BindUsername, bindSecretName, currentSecretVersion),
+		Message: fmt.Sprintf(`successfully able to connect to %s and bind as user "%s" [validated with Secret "%s" at version "%s"]`,
+			quotedHosts(hosts), config.BindUsername, bindSecretName, currentSecretVersion),
+	}, hostsHealthyCondition
+}
+
+func hostsHealthy(hosts []string, err error) *v1alpha1.Condition {
+	hostsErr := &upstreamldap.HostsError{}
+	if !errors.As(err, &hostsErr) {
+		return &v1alpha1.Condition{
+			Type:    typeHostsHealthy,
+			Status:  v1alpha1.ConditionTrue,
+			Reason:  ReasonSuccess,
+			Message: fmt.Sprintf("all %d hosts are healthy: %s", len(hosts), quotedHosts(hosts)),
+		}
+	}
+
+	messages := make([]string, 0, len(hostsErr.Errors))
+	for _, hostErr := range hostsErr.Errors {
+		messages = append(messages, fmt.Sprintf("%q: %s", hostErr.Host, hostErr.Err.Error()))
+	}
+	return &v1alpha1.Condition{
+		Type:   typeHostsHealthy,
+		Status: v1alpha1.ConditionFalse,
+		Reason: reasonHostsUnhealthy,
+		Message: fmt.Sprintf("%d of %d hosts are healthy: %s; unhealthy hosts: %s",
+			len(hostsErr.Validated), len(hosts), quotedHosts(hostsErr.Validated), strings.Join(messages, "; ")),
 	}
 }
 
+// validatedHosts returns the hosts which could be validated when TestConnection returned err.
+func validatedHosts(err error) []string {
+	hostsErr := &upstreamldap.HostsError{}
+	if errors.As(err, &hostsErr) {
+		return hostsErr.Validated
+	}
+	return nil
+}
+
+func quotedHosts(hosts []string) string {
+	if len(hosts) == 0 {
+		return "none"
+	}
+	quoted := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		quoted = append(quoted, fmt.Sprintf("%q", host))
+	}
+	return strings.Join(quoted, ", ")
+}
+
 func validTLSCondition(message string) *v1alpha1.Condition {
 	return &v1alpha1.Condition{
 		Type:    typeTLSConfigurationValid,
@@ -301,11 +365,13 @@ func ValidateGenericLDAP(
 	tlsValidCondition := ValidateTLSConfig(upstream.Spec().TLSSpec(), config)
 	conditions.Append(tlsValidCondition, true)
 
-	var ldapConnectionValidCondition, searchBaseFoundCondition *v1alpha1.Condition
 	// No point in trying to connect to the server if the config was already determined to be invalid.
 	if secretValidCondition.Status == v1alpha1.ConditionTrue && tlsValidCondition.Status == v1alpha1.ConditionTrue {
-		ldapConnectionValidCondition, searchBaseFoundCondition = validateAndSetLDAPServerConnectivityAndSearchBase(ctx, validatedSettingsCache, upstream, config, currentSecretVersion)
+		ldapConnectionValidCondition, hostsHealthyCondition, searchBaseFoundCondition := validateAndSetLDAPServerConnectivityAndSearchBase(ctx, validatedSettingsCache, upstream, config, currentSecretVersion)
 		conditions.Append(ldapConnectionValidCondition, false)
+		if hostsHealthyCondition != nil { // only used when there are multiple hosts, so may be nil
+			conditions.Append(hostsHealthyCondition, false)
+		}
 		if searchBaseFoundCondition != nil { // currently, only used for AD, so may be nil
 			conditions.Append(searchBaseFoundCondition, true)
 		}
@@ -319,48 +385,72 @@ func validateAndSetLDAPServerConnectivityAndSearchBase(
 	upstream UpstreamGenericLDAPIDP,
 	config *upstreamldap.ProviderConfig,
 	currentSecretVersion string,
-) (*v1alpha1.Condition, *v1alpha1.Condition) {
+) (*v1alpha1.Condition, *v1alpha1.Condition, *v1alpha1.Condition) {
 	validatedSettings, hasPreviousValidatedSettings := validatedSettingsCache.Get(upstream.Name(), currentSecretVersion, upstream.Generation())
-	var ldapConnectionValidCondition, searchBaseFoundCondition *v1alpha1.Condition
 
 	if hasPreviousValidatedSettings && validatedSettings.UserSearchBase != "" && validatedSettings.GroupSearchBase != "" {
-		// Found previously validated settings in the cache (which is also not missing search base fields), so use them.
-		config.ConnectionProtocol = validatedSettings.LDAPConnectionProtocol
-		config.UserSearch.Base = validatedSettings.UserSearchBase
-		config.GroupSearch.Base = validatedSettings.GroupSearchBase
-		ldapConnectionValidCondition = validatedSettings.ConnectionValidCondition.DeepCopy()
-		searchBaseFoundCondition = validatedSettings.SearchBaseFoundCondition.DeepCopy()
-	} else {
-		// Did not find previously validated settings in the cache, so probe the LDAP server.
-		testConnectionTimeout, cancelFunc := context.WithTimeout(ctx, probeLDAPTimeout)
-		defer cancelFunc()
-		ldapConnectionValidCondition = TestConnection(testConnectionTimeout, upstream.Spec().BindSecretName(), config, currentSecretVersion)
-
-		searchBaseTimeout, cancelFunc := context.WithTimeout(ctx, probeLDAPTimeout)
-		defer cancelFunc()
-		searchBaseFoundCondition = upstream.Spec().DetectAndSetSearchBase(searchBaseTimeout, config)
-
-		// When there were no failures, write the newly validated settings to the cache.
-		// It's okay for the search base condition to be nil, since it's only used by Active Directory providers,
-		// but if it exists make sure it was not a failure.
-		if ldapConnectionValidCondition.Status == v1alpha1.ConditionTrue &&
-			(searchBaseFoundCondition == nil || (searchBaseFoundCondition.Status == v1alpha1.ConditionTrue)) {
-			// Remember (in-memory for this pod) that the controller has successfully validated the LDAP or AD provider
-			// using this version of the Secret. This is for performance reasons, to avoid attempting to connect to
-			// the LDAP server more than is needed. If the pod restarts, it will attempt this validation again.
-			validatedSettingsCache.Set(upstream.Name(), ValidatedSettings{
-				IDPSpecGeneration:         upstream.Generation(),
-				BindSecretResourceVersion: currentSecretVersion,
-				LDAPConnectionProtocol:    config.ConnectionProtocol,
-				UserSearchBase:            config.UserSearch.Base,
-				GroupSearchBase:           config.GroupSearch.Base,
-				ConnectionValidCondition:  ldapConnectionValidCondition.DeepCopy(),
-				SearchBaseFoundCondition:  searchBaseFoundCondition.DeepCopy(), // currently, only used for AD, so may be nil
-			})
+		// Found previously validated settings in the cache (which is also not missing search base fields). The hosts
+		// may have become unhealthy since then, e.g. when a host could not be dialed during a login, so use the cached
+		// settings only while all hosts are still healthy. Otherwise, validate each host again below, which also
+		// notices when the unhealthy hosts have recovered.
+		hostsHealthyCondition := currentHostsHealthyCondition(ctx, config, validatedSettings.LDAPConnectionProtocol)
+		if hostsHealthyCondition == nil || hostsHealthyCondition.Status == v1alpha1.ConditionTrue {
+			config.ConnectionProtocol = validatedSettings.LDAPConnectionProtocol
+			config.UserSearch.Base = validatedSettings.UserSearchBase
+			config.GroupSearch.Base = validatedSettings.GroupSearchBase
+			return validatedSettings.ConnectionValidCondition.DeepCopy(), hostsHealthyCondition, validatedSettings.SearchBaseFoundCondition.DeepCopy()
 		}
 	}
 
-	return ldapConnectionValidCondition, searchBaseFoundCondition
+	// Did not find previously validated settings in the cache, so probe the LDAP server.
+	testConnectionTimeout, cancelFunc := context.WithTimeout(ctx, probeLDAPTimeout)
+	defer cancelFunc()
+	ldapConnectionValidCondition, hostsHealthyCondition := TestConnection(testConnectionTimeout, upstream.Spec().BindSecretName(), config, currentSecretVersion)
+
+	searchBaseTimeout, cancelFunc := context.WithTimeout(ctx, probeLDAPTimeout)
+	defer cancelFunc()
+	searchBaseFoundCondition := upstream.Spec().DetectAndSetSearchBase(searchBaseTimeout, config)
+
+	// When there were no failures, write the newly validated settings to the cache.
+	// It's okay for the hosts healthy condition to be nil, since it's only used by providers with multiple hosts,
+	// and for the search base condition to be nil, since it's only used by Active Directory providers,
+	// but if they exist make sure they were not a failure. This way, the unhealthy hosts are validated again.
+	if ldapConnectionValidCondition.Status == v1alpha1.ConditionTrue &&
+		(hostsHealthyCondition == nil || (hostsHealthyCondition.Status == v1alpha1.ConditionTrue)) &&
+		(searchBaseFoundCondition == nil || (searchBaseFoundCondition.Status == v1alpha1.ConditionTrue)) {
+		// Remember (in-memory for this pod) that the controller has successfully validated the LDAP or AD provider
+		// using this version of the Secret. This is for performance reasons, to avoid attempting to connect to
+		// the LDAP server more than is needed. If the pod restarts, it will attempt this validation again.
+		validatedSettingsCache.Set(upstream.Name(), ValidatedSettings{
+			IDPSpecGeneration:         upstream.Generation(),
+			BindSecretResourceVersion: currentSecretVersion,
+			LDAPConnectionProtocol:    config.ConnectionProtocol,
+			UserSearchBase:            config.UserSearch.Base,
+			GroupSearchBase:           config.GroupSearch.Base,
+			ConnectionValidCondition:  ldapConnectionValidCondition.DeepCopy(),
+			SearchBaseFoundCondition:  searchBaseFoundCondition.DeepCopy(), // currently, only used for AD, so may be nil
+		})
+	}
+
+	return ldapConnectionValidCondition, hostsHealthyCondition, searchBaseFoundCondition
+}
+
+// currentHostsHealthyCondition returns the HostsHealthy condition of the LDAP IDP from the most recent dial of each of
+// its hosts, which is shared by all of the providers of the IDP, without connecting to the hosts. Like for
+// TestConnection, it is nil when the LDAP IDP has only one host.
+func currentHostsHealthyCondition(
+	ctx context.Context,
+	config *upstreamldap.ProviderConfig,
+	connectionProtocol upstreamldap.LDAPConnectionProtocol,
+) *v1alpha1.Condition {
+	// The hosts which were discovered using DNS depend on the connection protocol.
+	configWithProtocol := *config
+	configWithProtocol.ConnectionProtocol = connectionProtocol
+	hosts, err := upstreamldap.New(configWithProtocol).HostsHealth(ctx)
+	if len(hosts) <= 1 && config.SRVDomain == "" {
+		return nil
+	}
+	return hostsHealthy(hosts, err)
 }
 
 func EvaluateConditions(conditions GradatedConditions, config *upstreamldap.ProviderConfig) (provider.UpstreamLDAPIdentityProviderI, bool) {
@@ -6,10 +6,10 @@ package supervisorstorage
 import (
 	"context"
 	"errors"
-	"fmt"
 	"time"
 
 	coreosoidc "github.com/coreos/go-oidc/v3/oidc"
+	"github.com/ory/fosite"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
@@ -19,15 +19,19 @@ import (
 	clocktesting "k8s.io/utils/clock/testing"
 	"k8s.io/utils/strings/slices"
 
+	"go.pinniped.dev/internal/audit"
 	pinnipedcontroller "go.pinniped.dev/internal/controller"
 	"go.pinniped.dev/internal/controllerlib"
 	"go.pinniped.dev/internal/crud"
 	"go.pinniped.dev/internal/fositestorage/accesstoken"
 	"go.pinniped.dev/internal/fositestorage/authorizationcode"
+	"go.pinniped.dev/internal/fositestorage/devicecode"
 	"go.pinniped.dev/internal/fositestorage/openidconnect"
 	"go.pinniped.dev/internal/fositestorage/pkce"
 	"go.pinniped.dev/internal/fositestorage/refreshtoken"
+	"go.pinniped.dev/internal/oidc"
 	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/oidc/revocation"
 	"go.pinniped.dev/internal/plog"
 	"go.pinniped.dev/internal/psession"
 )
@@ -36,6 +40,7 @@ const minimumRepeatInterval = 30 * time.Second
 
 type garbageCollectorController struct {
 	idpCache              UpstreamOIDCIdentityProviderICache
+	transformer           crud.Transformer
 	secretInformer        corev1informers.SecretInformer
 	kubeClient            kubernetes.Interface
 	clock                 clock.Clock
@@ -47,8 +52,12 @@ type UpstreamOIDCIdentityProviderICache interface {
 	GetOIDCIdentityProviders() []provider.UpstreamOIDCIdentityProviderI
 }
 
+// GarbageCollectorController returns a controller which deletes expired Secrets. The transformer decrypts the
+// session storage Secrets, so that their upstream OIDC tokens can be revoked. It may be nil when the sessions are
+// not encrypted.
 func GarbageCollectorController(
 	idpCache UpstreamOIDCIdentityProviderICache,
+	transformer crud.Transformer,
 	clock clock.Clock,
 	kubeClient kubernetes.Interface,
 	secretInformer corev1informers.SecretInformer,
@@ -67,6 +76,7 @@ func GarbageCollectorController(
 			Name: "garbage-collector-controller",
 			Syncer: &garbageCollectorController{
 				idpCache:       idpCache,
+				transformer:    transformer,
 				secretInformer: secretInformer,
 				kubeClient:     kubeClient,
 				clock:          clock,
@@ -132,7 +142,8 @@ func (c *garbageCollectorController) Sync(ctx controllerlib.Context) error {
 		// The Secret has expired. Check if it is a downstream session storage Secret, which may require extra processing.
 		storageType, isSessionStorage := secret.Labels[crud.SecretLabelKey]
 		if isSessionStorage {
-			revokeErr := c.maybeRevokeUpstreamOIDCToken(ctx.Context, storageType, secret)
+			decode := func(data crud.JSON) error { return crud.FromSecret(storageType, secret, c.transformer, data) }
+			revokeErr := maybeRevokeUpstreamOIDCToken(ctx.Context, c.idpCache, storageType, decode, logKV(secret))
 			if revokeErr != nil {
 				plog.WarningErr("garbage collector could not revoke upstream OIDC token", revokeErr, logKV(secret)...)
 				// Note that RevokeToken (called by the private helper) might have returned an error of type
@@ -169,7 +180,9 @@ func (c *garbageCollectorController) Sync(ctx controllerlib.Context) error {
 	return nil
 }
 
-func (c *garbageCollectorController) maybeRevokeUpstreamOIDCToken(ctx context.Context, storageType string, secret *v1.Secret) error {
+// maybeRevokeUpstreamOIDCToken revokes the upstream OIDC token of an expired downstream session storage item of the
+// given type, when needed. The decode function reads the item, regardless of where it is stored.
+func maybeRevokeUpstreamOIDCToken(ctx context.Context, idpCache UpstreamOIDCIdentityProviderICache, storageType string, decode func(data crud.JSON) error, logKV []interface{}) error {
 	// All downstream session storage types hold upstream tokens when the upstream IDP is an OIDC provider.
 	// However, some of them will be outdated because they are not updated by fosite after creation.
 	// Our goal below is to always revoke the latest upstream refresh token that we are holding for the
@@ -182,7 +195,7 @@ func (c *garbageCollectorController) maybeRevokeUpstreamOIDCToken(ctx context.Co
 	// upstream access token more than once.
 	switch storageType {
 	case authorizationcode.TypeLabelValue:
-		authorizeCodeSession, err := authorizationcode.ReadFromSecret(secret)
+		authorizeCodeSession, err := authorizationcode.Read(decode)
 		if err != nil {
 			return err
 		}
@@ -192,32 +205,45 @@ func (c *garbageCollectorController) maybeRevokeUpstreamOIDCToken(ctx context.Co
 			return nil
 		}
 		// When the downstream authcode was never used, then its storage must contain the latest upstream token.
-		return c.tryRevokeUpstreamOIDCToken(ctx, authorizeCodeSession.Request.Session.(*psession.PinnipedSession).Custom, secret)
+		return tryRevokeUpstreamOIDCToken(ctx, idpCache, authorizeCodeSession.Request, logKV)
 
 	case accesstoken.TypeLabelValue:
 		// For access token storage, check if the "offline_access" scope was granted on the downstream session.
 		// If it was granted, then the latest upstream token should be found in the refresh token storage instead.
 		// If it was not granted, then the user could not possibly have performed a downstream refresh, so the
 		// access token storage has the latest version of the upstream token.
-		accessTokenSession, err := accesstoken.ReadFromSecret(secret)
+		accessTokenSession, err := accesstoken.Read(decode)
 		if err != nil {
 			return err
 		}
-		pinnipedSession := accessTokenSession.Request.Session.(*psession.PinnipedSession)
 		if slices.Contains(accessTokenSession.Request.GetGrantedScopes(), coreosoidc.ScopeOfflineAccess) {
 			return nil
 		}
-		return c.tryRevokeUpstreamOIDCToken(ctx, pinnipedSession.Custom, secret)
+		return tryRevokeUpstreamOIDCToken(ctx, idpCache, accessTokenSession.Request, logKV)
 
 	case refreshtoken.TypeLabelValue:
 		// For refresh token storage, always revoke its upstream token. This refresh token storage could be
 		// the result of the initial downstream authcode exchange, or it could be the result of a downstream
 		// refresh. Either way, it always contains the latest upstream token when it exists.
-		refreshTokenSession, err := refreshtoken.ReadFromSecret(secret)
+		refreshTokenSession, err := refreshtoken.Read(decode)
 		if err != nil {
 			return err
 		}
-		return c.tryRevokeUpstreamOIDCToken(ctx, refreshTokenSession.Request.Session.(*psession.PinnipedSession).Custom, secret)
+		return tryRevokeUpstreamOIDCToken(ctx, idpCache, refreshTokenSession.Request, logKV)
+
+	case devicecode.TypeLabelValue:
+		// For device code storage, the session holds the upstream token after the user has logged in using the
+		// device verification page. When the device code was never redeemed, then its storage must contain the
+		// latest upstream token, similar to the authcode storage case above. Redeeming the device code deletes
+		// its storage, so the upstream token is then handled by the access token and refresh token cases.
+		deviceCodeSession, err := devicecode.Read(decode)
+		if err != nil {
+			return err
+		}
+		if deviceCodeSession.Status != devicecode.StatusApproved {
+			return nil
+		}
+		return tryRevokeUpstreamOIDCToken(ctx, idpCache, deviceCodeSession.Request, logKV)
 
 	case pkce.TypeLabelValue:
 		// For PKCE storage, its very existence means that the downstream authcode was never exchanged, because
@@ -234,49 +260,26 @@ func (c *garbageCollectorController) maybeRevokeUpstreamOIDCToken(ctx context.Co
 
 	default:
 		// There are no other storage types, so this should never happen in practice.
-		return errors.New("garbage collector saw invalid label on Secret when trying to determine if upstream revocation was needed")
+		return errors.New("garbage collector saw invalid storage type when trying to determine if upstream revocation was needed")
 	}
 }
 
-func (c *garbageCollectorController) tryRevokeUpstreamOIDCToken(ctx context.Context, customSessionData *psession.CustomSessionData, secret *v1.Secret) error {
+func tryRevokeUpstreamOIDCToken(ctx context.Context, idpCache UpstreamOIDCIdentityProviderICache, request fosite.Requester, logKV []interface{}) error {
+	customSessionData := request.GetSession().(*psession.PinnipedSession).Custom
+
 	// When session was for another upstream IDP type, e.g. LDAP, there is no upstream OIDC token involved.
-	if customSessionData.ProviderType != psession.ProviderTypeOIDC {
+	if customSessionData.ProviderType != psession.ProviderTypeOIDC || customSessionData.OIDC == nil {
 		return nil
 	}
 
-	// Try to find the provider that was originally used to create the stored session.
-	var foundOIDCIdentityProviderI provider.UpstreamOIDCIdentityProviderI
-	for _, p := range c.idpCache.GetOIDCIdentityProviders() {
-		if p.GetName() == customSessionData.ProviderName && p.GetResourceUID() == customSessionData.ProviderUID {
-			foundOIDCIdentityProviderI = p
-			break
-		}
-	}
-	if foundOIDCIdentityProviderI == nil {
-		return fmt.Errorf("could not find upstream OIDC provider named %q with resource UID %q", customSessionData.ProviderName, customSessionData.ProviderUID)
-	}
-
-	// In practice, there should only be one of these tokens saved in the session.
-	upstreamRefreshToken := customSessionData.OIDC.UpstreamRefreshToken
-	upstreamAccessToken := customSessionData.OIDC.UpstreamAccessToken
-
-	if upstreamRefreshToken != "" {
-		err := foundOIDCIdentityProviderI.RevokeToken(ctx, upstreamRefreshToken, provider.RefreshTokenType)
-		if err != nil {
-			return err
-		}
-		plog.Trace("garbage collector successfully revoked upstream OIDC refresh token (or provider has no revocation endpoint)", logKV(secret)...)
+	err := revocation.RevokeUpstreamOIDCTokens(ctx, idpCache, customSessionData)
+	if err != nil || customSessionData.OIDC.UpstreamRefreshToken != "" || customSessionData.OIDC.UpstreamAccessToken != "" {
+		audit.Record(ctx, oidc.NewAuditEvent(audit.TypeUpstreamTokenRevocation, "", request).Failure(err))
 	}
-
-	if upstreamAccessToken != "" {
-		err := foundOIDCIdentityProviderI.RevokeToken(ctx, upstreamAccessToken, provider.AccessTokenType)
-		if err != nil {
-			return err
-		}
-		plog.Trace("garbage collector successfully revoked upstream OIDC access token (or provider has no revocation endpoint)", logKV(secret)...)
+	if err == nil {
+		plog.Trace("garbage collector successfully revoked upstream OIDC tokens (or provider has no revocation endpoint)", logKV...)
 	}
-
-	return nil
+	return err
 }
 
 func logKV(secret *v1.Secret) []interface{} {
@@ -18,19 +18,24 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	kubeinformers "k8s.io/client-go/informers"
 	kubernetesfake "k8s.io/client-go/kubernetes/fake"
 	kubetesting "k8s.io/client-go/testing"
 	"k8s.io/utils/clock"
 	clocktesting "k8s.io/utils/clock/testing"
 
+	"go.pinniped.dev/internal/audit"
 	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/crud"
 	"go.pinniped.dev/internal/fositestorage/accesstoken"
 	"go.pinniped.dev/internal/fositestorage/authorizationcode"
+	"go.pinniped.dev/internal/fositestorage/devicecode"
 	"go.pinniped.dev/internal/fositestorage/refreshtoken"
 	"go.pinniped.dev/internal/oidc/clientregistry"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/psession"
+	"go.pinniped.dev/internal/sessionencryption"
 	"go.pinniped.dev/internal/testutil"
 	"go.pinniped.dev/internal/testutil/oidctestutil"
 )
@@ -48,6 +53,7 @@ func TestGarbageCollectorControllerInformerFilters(t *testing.T) {
 			observableWithInformerOption = testutil.NewObservableWithInformerOption()
 			secretsInformer := kubeinformers.NewSharedInformerFactory(nil, 0).Core().V1().Secrets()
 			_ = GarbageCollectorController(
+				nil,
 				nil,
 				clock.RealClock{},
 				nil,
@@ -133,6 +139,8 @@ func TestGarbageCollectorControllerSync(t *testing.T) {
 			syncContext             *controllerlib.Context
 			fakeClock               *clocktesting.FakeClock
 			frozenNow               time.Time
+			keyring                 *sessionencryption.Keyring
+			auditEvents             func() []audit.Event
 		)
 
 		// Defer starting the informers until the last possible moment so that the
@@ -141,6 +149,7 @@ func TestGarbageCollectorControllerSync(t *testing.T) {
 			// Set this at the last second to allow for injection of server override.
 			subject = GarbageCollectorController(
 				idpCache,
+				keyring.ForIssuer(""),
 				fakeClock,
 				kubeClient,
 				kubeInformers.Core().V1().Secrets(),
@@ -165,6 +174,7 @@ func TestGarbageCollectorControllerSync(t *testing.T) {
 
 		it.Before(func() {
 			r = require.New(t)
+			auditEvents = testutil.RecordAuditEvents(t, audit.ComponentSupervisor)
 
 			cancelContext, cancelContextCancelFunc = context.WithCancel(context.Background())
 
@@ -173,6 +183,13 @@ func TestGarbageCollectorControllerSync(t *testing.T) {
 			kubeInformers = kubeinformers.NewSharedInformerFactory(kubeInformerClient, 0)
 			frozenNow = time.Now().UTC()
 			fakeClock = clocktesting.NewFakeClock(frozenNow)
+			keyring = sessionencryption.NewKeyring()
+			keyring.SetIssuerToKeys(map[string]*sessionencryption.Keys{
+				"https://issuer.example.com": {
+					ActiveKeyID: "some-key-id",
+					Keys:        map[string][]byte{"some-key-id": []byte("0123456789abcdef0123456789abcdef")},
+				},
+			})
 
 			unrelatedSecret := &corev1.Secret{
 				ObjectMeta: metav1.ObjectMeta{
@@ -371,6 +388,22 @@ func TestGarbageCollectorControllerSync(t *testing.T) {
 					},
 				)
 
+				// The revocation is recorded in the audit log.
+				r.Equal([]audit.Event{{
+					APIVersion: audit.APIVersion,
+					Kind:       audit.Kind,
+					Time:       auditEvents()[0].Time,
+					Component:  audit.ComponentSupervisor,
+					Type:       audit.TypeUpstreamTokenRevocation,
+					SessionID:  "request-id-1",
+					IdentityProvider: &audit.IdentityProvider{
+						Name: "upstream-oidc-provider-name",
+						Type: "oidc",
+						UID:  "upstream-oidc-provider-uid",
+					},
+					Outcome: audit.OutcomeSuccess,
+				}}, auditEvents())
+
 				// Both authcode session secrets are deleted.
 				r.ElementsMatch(
 					[]kubetesting.Action{
@@ -781,6 +814,13 @@ func TestGarbageCollectorControllerSync(t *testing.T) {
 					},
 				)
 
+				// The failed revocation is recorded in the audit log.
+				events := auditEvents()
+				r.Len(events, 1)
+				r.Equal(audit.TypeUpstreamTokenRevocation, events[0].Type)
+				r.Equal(audit.OutcomeFailure, events[0].Outcome)
+				r.Equal("retryable revocation error: some retryable upstream revocation error", events[0].Reason)
+
 				// The authcode session secrets is not deleted.
 				r.Empty(kubeClient.Actions())
 			})
@@ -1138,6 +1178,95 @@ func TestGarbageCollectorControllerSync(t *testing.T) {
 			})
 		})
 
+		when("there are valid, expired device code secrets which contain upstream refresh tokens", func() {
+			it.Before(func() {
+				newDeviceCodeSecret := func(name, uid, rv string, status devicecode.Status, upstreamRefreshToken string) *corev1.Secret {
+					deviceCodeSession := &devicecode.Session{
+						Version:   "1",
+						Signature: name + "-signature",
+						UserCode:  "BCDF-GHJK",
+						Status:    status,
+						Request: &fosite.Request{
+							ID:     "request-id-" + uid,
+							Client: &clientregistry.Client{},
+							Session: &psession.PinnipedSession{
+								Custom: &psession.CustomSessionData{
+									ProviderUID:  "upstream-oidc-provider-uid",
+									ProviderName: "upstream-oidc-provider-name",
+									ProviderType: psession.ProviderTypeOIDC,
+									OIDC: &psession.OIDCSessionData{
+										UpstreamRefreshToken: upstreamRefreshToken,
+									},
+								},
+							},
+						},
+					}
+					deviceCodeSessionJSON, err := json.Marshal(deviceCodeSession)
+					r.NoError(err)
+					secret := &corev1.Secret{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:            name,
+							Namespace:       installedInNamespace,
+							UID:             types.UID(uid),
+							ResourceVersion: rv,
+							Annotations: map[string]string{
+								"storage.pinniped.dev/garbage-collect-after": frozenNow.Add(-time.Second).Format(time.RFC3339),
+							},
+							Labels: map[string]string{
+								"storage.pinniped.dev/type": devicecode.TypeLabelValue,
+							},
+						},
+						Data: map[string][]byte{
+							"pinniped-storage-data":    deviceCodeSessionJSON,
+							"pinniped-storage-version": []byte("1"),
+						},
+						Type: "storage.pinniped.dev/" + devicecode.TypeLabelValue,
+					}
+					_, err = devicecode.ReadFromSecret(secret)
+					r.NoError(err, "the test author accidentally formed an invalid device code secret")
+					return secret
+				}
+
+				approvedSecret := newDeviceCodeSecret("approvedDeviceCodeSession", "uid-123", "rv-123", devicecode.StatusApproved, "fake-upstream-refresh-token")
+				pendingSecret := newDeviceCodeSecret("pendingDeviceCodeSession", "uid-456", "rv-456", devicecode.StatusPending, "")
+				for _, secret := range []*corev1.Secret{approvedSecret, pendingSecret} {
+					r.NoError(kubeInformerClient.Tracker().Add(secret))
+					r.NoError(kubeClient.Tracker().Add(secret))
+				}
+			})
+
+			it("should revoke upstream tokens only from the approved device code secrets and delete them all", func() {
+				happyOIDCUpstream := oidctestutil.NewTestUpstreamOIDCIdentityProviderBuilder().
+					WithName("upstream-oidc-provider-name").
+					WithResourceUID("upstream-oidc-provider-uid").
+					WithRevokeTokenError(nil)
+				idpListerBuilder := oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(happyOIDCUpstream.Build())
+
+				startInformersAndController(idpListerBuilder.Build())
+				r.NoError(controllerlib.TestSync(t, subject, *syncContext))
+
+				// The upstream refresh token is only revoked for the approved device code session, since a pending
+				// device code session does not hold any upstream tokens yet.
+				idpListerBuilder.RequireExactlyOneCallToRevokeToken(t,
+					"upstream-oidc-provider-name",
+					&oidctestutil.RevokeTokenArgs{
+						Ctx:       syncContext.Context,
+						Token:     "fake-upstream-refresh-token",
+						TokenType: provider.RefreshTokenType,
+					},
+				)
+
+				// Both session secrets are deleted.
+				r.ElementsMatch(
+					[]kubetesting.Action{
+						kubetesting.NewDeleteActionWithOptions(secretsGVR, installedInNamespace, "approvedDeviceCodeSession", testutil.NewPreconditions("uid-123", "rv-123")),
+						kubetesting.NewDeleteActionWithOptions(secretsGVR, installedInNamespace, "pendingDeviceCodeSession", testutil.NewPreconditions("uid-456", "rv-456")),
+					},
+					kubeClient.Actions(),
+				)
+			})
+		})
+
 		when("there are valid, expired refresh secrets which contain upstream refresh tokens", func() {
 			it.Before(func() {
 				oidcRefreshSession := &refreshtoken.Session{
@@ -1214,6 +1343,83 @@ func TestGarbageCollectorControllerSync(t *testing.T) {
 			})
 		})
 
+		when("there is a valid, expired, encrypted refresh secret which contains an upstream refresh token", func() {
+			it.Before(func() {
+				oidcRefreshSession := &refreshtoken.Session{
+					Version: "2",
+					Request: &fosite.Request{
+						ID:     "request-id-1",
+						Client: &clientregistry.Client{},
+						Session: &psession.PinnipedSession{
+							Custom: &psession.CustomSessionData{
+								ProviderUID:  "upstream-oidc-provider-uid",
+								ProviderName: "upstream-oidc-provider-name",
+								ProviderType: psession.ProviderTypeOIDC,
+								OIDC: &psession.OIDCSessionData{
+									UpstreamRefreshToken: "fake-upstream-refresh-token",
+								},
+							},
+						},
+					},
+				}
+				oidcRefreshSessionJSON, err := json.Marshal(oidcRefreshSession)
+				r.NoError(err)
+				oidcRefreshSessionSecret, err := crud.ReencryptSecret(&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:            "oidcRefreshSession",
+						Namespace:       installedInNamespace,
+						UID:             "uid-123",
+						ResourceVersion: "rv-123",
+						Annotations: map[string]string{
+							"storage.pinniped.dev/garbage-collect-after": frozenNow.Add(-time.Second).Format(time.RFC3339),
+						},
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": refreshtoken.TypeLabelValue,
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    oidcRefreshSessionJSON,
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/" + refreshtoken.TypeLabelValue,
+				}, keyring.ForIssuer("https://issuer.example.com"))
+				r.NoError(err)
+				_, err = refreshtoken.ReadFromSecret(oidcRefreshSessionSecret)
+				r.ErrorIs(err, crud.ErrSecretEncrypted, "the test author accidentally formed an unencrypted refresh token secret")
+				r.NoError(kubeInformerClient.Tracker().Add(oidcRefreshSessionSecret))
+				r.NoError(kubeClient.Tracker().Add(oidcRefreshSessionSecret))
+			})
+
+			it("should decrypt the secret to revoke its upstream token and delete it", func() {
+				happyOIDCUpstream := oidctestutil.NewTestUpstreamOIDCIdentityProviderBuilder().
+					WithName("upstream-oidc-provider-name").
+					WithResourceUID("upstream-oidc-provider-uid").
+					WithRevokeTokenError(nil)
+				idpListerBuilder := oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(happyOIDCUpstream.Build())
+
+				startInformersAndController(idpListerBuilder.Build())
+				r.NoError(controllerlib.TestSync(t, subject, *syncContext))
+
+				// The upstream refresh token is revoked.
+				idpListerBuilder.RequireExactlyOneCallToRevokeToken(t,
+					"upstream-oidc-provider-name",
+					&oidctestutil.RevokeTokenArgs{
+						Ctx:       syncContext.Context,
+						Token:     "fake-upstream-refresh-token",
+						TokenType: provider.RefreshTokenType,
+					},
+				)
+
+				// The secret is deleted.
+				r.ElementsMatch(
+					[]kubetesting.Action{
+						kubetesting.NewDeleteActionWithOptions(secretsGVR, installedInNamespace, "oidcRefreshSession", testutil.NewPreconditions("uid-123", "rv-123")),
+					},
+					kubeClient.Actions(),
+				)
+			})
+		})
+
 		when("there are valid, expired refresh secrets which contain upstream access tokens", func() {
 			it.Before(func() {
 				oidcRefreshSession := &refreshtoken.Session{
@@ -0,0 +1,127 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package supervisorstorage
+
+import (
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	corev1informers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/utils/clock"
+
+	pinnipedcontroller "go.pinniped.dev/internal/controller"
+	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/plog"
+)
+
+// RetiredKeyLookup finds the Transformer which re-encrypts the data that was encrypted by a retired key.
+type RetiredKeyLookup interface {
+	ForRetiredKey(keyID string) (crud.Transformer, bool)
+}
+
+type reencryptionController struct {
+	keys                  RetiredKeyLookup
+	secretInformer        corev1informers.SecretInformer
+	kubeClient            kubernetes.Interface
+	clock                 clock.Clock
+	timeOfMostRecentSweep time.Time
+}
+
+// ReencryptionController returns a controller which re-encrypts the session storage Secrets which were encrypted
+// by a retired session encryption key with the active key of the same FederationDomain, so that the retired key can
+// be deleted.
+func ReencryptionController(
+	keys RetiredKeyLookup,
+	clock clock.Clock,
+	kubeClient kubernetes.Interface,
+	secretInformer corev1informers.SecretInformer,
+	withInformer pinnipedcontroller.WithInformerOptionFunc,
+) controllerlib.Controller {
+	isEncryptedSecret := func(obj metav1.Object) bool {
+		secret, ok := obj.(*v1.Secret)
+		if !ok {
+			return false
+		}
+		_, ok = secret.Labels[crud.EncryptionKeyIDLabelKey]
+		return ok
+	}
+	return controllerlib.New(
+		controllerlib.Config{
+			Name: "reencryption-controller",
+			Syncer: &reencryptionController{
+				keys:           keys,
+				secretInformer: secretInformer,
+				kubeClient:     kubeClient,
+				clock:          clock,
+			},
+		},
+		withInformer(
+			secretInformer,
+			controllerlib.FilterFuncs{
+				AddFunc: isEncryptedSecret,
+				UpdateFunc: func(oldObj, newObj metav1.Object) bool {
+					return isEncryptedSecret(oldObj) || isEncryptedSecret(newObj)
+				},
+				DeleteFunc: func(obj metav1.Object) bool { return false }, // ignore all deletes
+				ParentFunc: pinnipedcontroller.SingletonQueue(),
+			},
+			controllerlib.InformerOption{},
+		),
+	)
+}
+
+func (c *reencryptionController) Sync(ctx controllerlib.Context) error {
+	// Like the garbage collector, this controller rate limits itself, since it is triggered by any change to any
+	// encrypted Secret. Key rotations do not change those Secrets, so they are noticed at the informer's full-resync
+	// interval at the latest.
+	now := c.clock.Now()
+	if since := now.Sub(c.timeOfMostRecentSweep); since < minimumRepeatInterval {
+		ctx.Queue.AddAfter(ctx.Key, minimumRepeatInterval-since)
+		return nil
+	}
+	c.timeOfMostRecentSweep = now
+
+	hasKeyID, err := labels.NewRequirement(crud.EncryptionKeyIDLabelKey, selection.Exists, nil)
+	if err != nil {
+		return err
+	}
+	listOfSecrets, err := c.secretInformer.Lister().List(labels.NewSelector().Add(*hasKeyID))
+	if err != nil {
+		return err
+	}
+
+	reencrypted := 0
+	for _, secret := range listOfSecrets {
+		transformer, ok := c.keys.ForRetiredKey(secret.Labels[crud.EncryptionKeyIDLabelKey])
+		if !ok {
+			// The Secret is encrypted with an active key, or with a key which is not known (yet).
+			continue
+		}
+
+		newSecret, err := crud.ReencryptSecret(secret, transformer)
+		if err != nil {
+			plog.WarningErr("failed to re-encrypt session storage secret", err, logKV(secret)...)
+			continue
+		}
+
+		// The Secret may have been updated or deleted by its session in the meantime, in which case it will be
+		// handled by a later sweep, if it still needs to be re-encrypted.
+		if _, err := c.kubeClient.CoreV1().Secrets(secret.Namespace).Update(ctx.Context, newSecret, metav1.UpdateOptions{}); err != nil {
+			plog.WarningErr("failed to update re-encrypted session storage secret", err, logKV(secret)...)
+			continue
+		}
+		reencrypted++
+	}
+
+	if reencrypted > 0 {
+		plog.Info("re-encrypted session storage secrets", "count", reencrypted)
+	}
+
+	return nil
+}
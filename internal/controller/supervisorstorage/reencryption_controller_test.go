@@ -0,0 +1,174 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package supervisorstorage
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeinformers "k8s.io/client-go/informers"
+	kubernetesfake "k8s.io/client-go/kubernetes/fake"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/sessionencryption"
+)
+
+func TestReencryptionControllerSync(t *testing.T) {
+	const namespace = "some-namespace"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	frozenNow := time.Now().UTC()
+	fakeClock := clocktesting.NewFakeClock(frozenNow)
+
+	type testJSON struct {
+		Data string
+	}
+
+	keyring := sessionencryption.NewKeyring()
+	keyring.SetIssuerToKeys(map[string]*sessionencryption.Keys{
+		"https://issuer1.example.com": {ActiveKeyID: "old-key", Keys: map[string][]byte{
+			"old-key": bytes.Repeat([]byte("o"), sessionencryption.KeySize),
+		}},
+		"https://issuer2.example.com": {ActiveKeyID: "other-key", Keys: map[string][]byte{
+			"other-key": bytes.Repeat([]byte("x"), sessionencryption.KeySize),
+		}},
+	})
+
+	// Store some sessions with the keys which are active before the rotation.
+	kubeAPIClient := kubernetesfake.NewSimpleClientset()
+	secrets := kubeAPIClient.CoreV1().Secrets(namespace)
+	backend := crud.NewEncryptedSecretsBackend(secrets, keyring)
+	storage1 := crud.ForIssuer(backend, "https://issuer1.example.com").Storage("candies", fakeClock.Now, time.Hour)
+	_, err := storage1.Create(ctx, "session1", &testJSON{Data: "snorlax"}, nil)
+	require.NoError(t, err)
+	storage2 := crud.ForIssuer(backend, "https://issuer2.example.com").Storage("candies", fakeClock.Now, time.Hour)
+	_, err = storage2.Create(ctx, "session2", &testJSON{Data: "pikachu"}, nil)
+	require.NoError(t, err)
+	_, err = crud.New("candies", secrets, fakeClock.Now, time.Hour).Create(ctx, "unencrypted", &testJSON{Data: "eevee"}, nil)
+	require.NoError(t, err)
+	unknownKeySecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "some-session-with-an-unknown-key",
+			Namespace: namespace,
+			Labels:    map[string]string{crud.EncryptionKeyIDLabelKey: "unknown-key"},
+		},
+	}
+	_, err = secrets.Create(ctx, unknownKeySecret, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	// Rotate the keys of issuer1.
+	keyring.SetIssuerToKeys(map[string]*sessionencryption.Keys{
+		"https://issuer1.example.com": {ActiveKeyID: "new-key", Keys: map[string][]byte{
+			"old-key": bytes.Repeat([]byte("o"), sessionencryption.KeySize),
+			"new-key": bytes.Repeat([]byte("n"), sessionencryption.KeySize),
+		}},
+		"https://issuer2.example.com": {ActiveKeyID: "other-key", Keys: map[string][]byte{
+			"other-key": bytes.Repeat([]byte("x"), sessionencryption.KeySize),
+		}},
+	})
+
+	kubeInformerClient := kubernetesfake.NewSimpleClientset()
+	secretList, err := secrets.List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	secretsBefore := map[string]corev1.Secret{}
+	for _, secret := range secretList.Items {
+		secret := secret
+		require.NoError(t, kubeInformerClient.Tracker().Add(&secret))
+		secretsBefore[secret.Name] = secret
+	}
+	kubeInformers := kubeinformers.NewSharedInformerFactory(kubeInformerClient, 0)
+
+	subject := ReencryptionController(
+		keyring,
+		fakeClock,
+		kubeAPIClient,
+		kubeInformers.Core().V1().Secrets(),
+		controllerlib.WithInformer,
+	)
+
+	// Must start informers before calling TestRunSynchronously().
+	kubeInformers.Start(ctx.Done())
+	controllerlib.TestRunSynchronously(t, subject)
+
+	kubeAPIClient.ClearActions()
+	syncContext := controllerlib.Context{Context: ctx, Name: subject.Name(), Key: controllerlib.Key{}}
+	require.NoError(t, controllerlib.TestSync(t, subject, syncContext))
+
+	// Only the session which was encrypted with the retired key was updated.
+	require.Len(t, kubeAPIClient.Actions(), 1)
+	require.Equal(t, "update", kubeAPIClient.Actions()[0].GetVerb())
+
+	secretList, err = secrets.List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	for _, secret := range secretList.Items {
+		if secret.Labels[crud.EncryptionKeyIDLabelKey] == "new-key" {
+			require.NotEqual(t, secretsBefore[secret.Name].Data, secret.Data)
+			continue
+		}
+		require.Equal(t, secretsBefore[secret.Name], secret)
+	}
+
+	// The sessions can still be read.
+	got := &testJSON{}
+	_, err = storage1.Get(ctx, "session1", got)
+	require.NoError(t, err)
+	require.Equal(t, "snorlax", got.Data)
+	_, err = storage2.Get(ctx, "session2", got)
+	require.NoError(t, err)
+	require.Equal(t, "pikachu", got.Data)
+
+	// Without the retired key, the re-encrypted session can still be read.
+	keyring.SetIssuerToKeys(map[string]*sessionencryption.Keys{
+		"https://issuer1.example.com": {ActiveKeyID: "new-key", Keys: map[string][]byte{
+			"new-key": bytes.Repeat([]byte("n"), sessionencryption.KeySize),
+		}},
+	})
+	_, err = storage1.Get(ctx, "session1", got)
+	require.NoError(t, err)
+	require.Equal(t, "snorlax", got.Data)
+}
+
+func TestReencryptionControllerRateLimits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	kubeAPIClient := kubernetesfake.NewSimpleClientset()
+	kubeInformers := kubeinformers.NewSharedInformerFactory(kubernetesfake.NewSimpleClientset(), 0)
+
+	subject := ReencryptionController(
+		sessionencryption.NewKeyring(),
+		fakeClock,
+		kubeAPIClient,
+		kubeInformers.Core().V1().Secrets(),
+		controllerlib.WithInformer,
+	)
+	kubeInformers.Start(ctx.Done())
+	controllerlib.TestRunSynchronously(t, subject)
+
+	queue := &testQueue{t: t}
+	syncContext := controllerlib.Context{Context: ctx, Name: subject.Name(), Key: controllerlib.Key{}, Queue: queue}
+
+	require.NoError(t, controllerlib.TestSync(t, subject, syncContext))
+	require.False(t, queue.called)
+
+	fakeClock.Step(10 * time.Second)
+	require.NoError(t, controllerlib.TestSync(t, subject, syncContext))
+	require.True(t, queue.called)
+	require.Equal(t, 20*time.Second, queue.duration)
+
+	fakeClock.Step(20 * time.Second)
+	queue.called = false
+	require.NoError(t, controllerlib.TestSync(t, subject, syncContext))
+	require.False(t, queue.called)
+}
@@ -0,0 +1,100 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package supervisorstorage
+
+import (
+	"errors"
+	"time"
+
+	"k8s.io/utils/clock"
+
+	pinnipedcontroller "go.pinniped.dev/internal/controller"
+	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/crud/sqlstorage"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/plog"
+)
+
+// sqlGarbageCollectionBatchSize is the maximum number of expired rows which are read from the database at once.
+const sqlGarbageCollectionBatchSize = 500
+
+type sqlGarbageCollectorController struct {
+	idpCache UpstreamOIDCIdentityProviderICache
+	backend  *sqlstorage.Backend
+	clock    clock.Clock
+}
+
+// SQLGarbageCollectorController is the equivalent of GarbageCollectorController for downstream sessions which are
+// stored in a SQL database instead of in Secrets.
+func SQLGarbageCollectorController(
+	idpCache UpstreamOIDCIdentityProviderICache,
+	clock clock.Clock,
+	backend *sqlstorage.Backend,
+	withInitialEvent pinnipedcontroller.WithInitialEventOptionFunc,
+) controllerlib.Controller {
+	return controllerlib.New(
+		controllerlib.Config{
+			Name: "sql-garbage-collector-controller",
+			Syncer: &sqlGarbageCollectorController{
+				idpCache: idpCache,
+				backend:  backend,
+				clock:    clock,
+			},
+		},
+		// There is no informer for the database, so start with an initial event and then requeue it after each sweep.
+		withInitialEvent(controllerlib.Key{Name: "sql-session-storage"}),
+	)
+}
+
+func (c *sqlGarbageCollectorController) Sync(ctx controllerlib.Context) error {
+	defer ctx.Queue.AddAfter(ctx.Key, minimumRepeatInterval)
+
+	// make sure we have a consistent, static meaning for the current time during the sync loop
+	now := c.clock.Now()
+
+	plog.Info("starting SQL storage garbage collection sweep")
+
+	for {
+		records, err := c.backend.ListExpired(ctx.Context, now, sqlGarbageCollectionBatchSize)
+		if err != nil {
+			return err
+		}
+
+		deleted := 0
+		for i := range records {
+			record := records[i]
+
+			revokeErr := maybeRevokeUpstreamOIDCToken(ctx.Context, c.idpCache, record.Resource, record.Decode, logKVForRecord(record))
+			if revokeErr != nil {
+				plog.WarningErr("garbage collector could not revoke upstream OIDC token", revokeErr, logKVForRecord(record)...)
+				// Retry the revocation during a later sweep, but only for a while, like for Secrets.
+				fourHoursAgo := now.Add(-4 * time.Hour)
+				if errors.As(revokeErr, &provider.RetryableRevocationError{}) && record.ExpiresAt.After(fourHoursAgo) {
+					plog.Trace("garbage collector keeping row to retry upstream OIDC token revocation later", logKVForRecord(record)...)
+					continue
+				}
+			}
+
+			if err := c.backend.DeleteRecord(ctx.Context, record); err != nil {
+				plog.WarningErr("failed to garbage collect resource", err, logKVForRecord(record)...)
+				continue
+			}
+			deleted++
+			plog.Info("storage garbage collector deleted resource", logKVForRecord(record)...)
+		}
+
+		// Stop when there are no more expired rows, or when the remaining rows were all kept for a later sweep.
+		if len(records) < sqlGarbageCollectionBatchSize || deleted == 0 {
+			return nil
+		}
+	}
+}
+
+func logKVForRecord(record sqlstorage.Record) []interface{} {
+	return []interface{}{
+		"name", record.Name,
+		"garbageCollectAfter", record.ExpiresAt,
+		"storageTypeLabelValue", record.Resource,
+	}
+}
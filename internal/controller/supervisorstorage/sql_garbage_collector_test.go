@@ -0,0 +1,137 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package supervisorstorage
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/stretchr/testify/require"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/crud/sqlstorage"
+	"go.pinniped.dev/internal/fositestorage/refreshtoken"
+	"go.pinniped.dev/internal/oidc/clientregistry"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/psession"
+	"go.pinniped.dev/internal/testutil/oidctestutil"
+)
+
+func TestSQLGarbageCollectorController(t *testing.T) {
+	frozenNow := time.Now().UTC()
+
+	newRefreshTokenSession := func(requestID string) *fosite.Request {
+		return &fosite.Request{
+			ID:     requestID,
+			Client: &clientregistry.Client{},
+			Session: &psession.PinnipedSession{
+				Custom: &psession.CustomSessionData{
+					ProviderUID:  "upstream-oidc-provider-uid",
+					ProviderName: "upstream-oidc-provider-name",
+					ProviderType: psession.ProviderTypeOIDC,
+					OIDC: &psession.OIDCSessionData{
+						UpstreamRefreshToken: "fake-upstream-refresh-token-" + requestID,
+					},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name               string
+		expiredFor         time.Duration
+		revokeTokenError   error
+		wantRevokedToken   string
+		wantRemainingCount int
+	}{
+		{
+			name:               "expired sessions are revoked upstream and deleted",
+			expiredFor:         time.Minute,
+			wantRevokedToken:   "fake-upstream-refresh-token-expired",
+			wantRemainingCount: 1,
+		},
+		{
+			name:               "expired sessions are kept when the upstream revocation should be retried",
+			expiredFor:         time.Minute,
+			revokeTokenError:   provider.NewRetryableRevocationError(errors.New("some retryable upstream revocation error")),
+			wantRevokedToken:   "fake-upstream-refresh-token-expired",
+			wantRemainingCount: 2,
+		},
+		{
+			name:               "long-since expired sessions are deleted even when the upstream revocation should be retried",
+			expiredFor:         5 * time.Hour,
+			revokeTokenError:   provider.NewRetryableRevocationError(errors.New("some retryable upstream revocation error")),
+			wantRevokedToken:   "fake-upstream-refresh-token-expired",
+			wantRemainingCount: 1,
+		},
+		{
+			name:               "expired sessions are deleted when the upstream revocation fails",
+			expiredFor:         time.Minute,
+			revokeTokenError:   errors.New("some upstream revocation error not worth retrying"),
+			wantRevokedToken:   "fake-upstream-refresh-token-expired",
+			wantRemainingCount: 1,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			backend, err := sqlstorage.Open(ctx, sqlstorage.SQLite, filepath.Join(t.TempDir(), "sessions.db"))
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, backend.Close()) })
+
+			// Both sessions are created with a one hour lifetime, so only the first one has expired by now.
+			createdAt := frozenNow.Add(-time.Hour - tt.expiredFor)
+			storage := refreshtoken.New(backend, func() time.Time { return createdAt }, time.Hour)
+			require.NoError(t, storage.CreateRefreshTokenSession(ctx, "expired-signature", newRefreshTokenSession("expired")))
+			createdAt = frozenNow
+			require.NoError(t, storage.CreateRefreshTokenSession(ctx, "active-signature", newRefreshTokenSession("active")))
+
+			oidcUpstream := oidctestutil.NewTestUpstreamOIDCIdentityProviderBuilder().
+				WithName("upstream-oidc-provider-name").
+				WithResourceUID("upstream-oidc-provider-uid").
+				WithRevokeTokenError(tt.revokeTokenError)
+			idpListerBuilder := oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(oidcUpstream.Build())
+
+			subject := SQLGarbageCollectorController(
+				idpListerBuilder.Build(),
+				clocktesting.NewFakeClock(frozenNow),
+				backend,
+				controllerlib.WithInitialEvent,
+			)
+			queue := &testQueue{t: t}
+			syncContext := controllerlib.Context{
+				Context: ctx,
+				Name:    subject.Name(),
+				Key:     controllerlib.Key{Name: "sql-session-storage"},
+				Queue:   queue,
+			}
+			require.NoError(t, controllerlib.TestSync(t, subject, syncContext))
+
+			idpListerBuilder.RequireExactlyOneCallToRevokeToken(t,
+				"upstream-oidc-provider-name",
+				&oidctestutil.RevokeTokenArgs{
+					Ctx:       ctx,
+					Token:     tt.wantRevokedToken,
+					TokenType: provider.RefreshTokenType,
+				},
+			)
+
+			sessions, err := storage.ListRefreshTokenSessions(ctx)
+			require.NoError(t, err)
+			require.Len(t, sessions, tt.wantRemainingCount)
+
+			// There is no informer, so the controller always runs again later.
+			require.True(t, queue.called)
+			require.Equal(t, syncContext.Key, queue.key)
+			require.Equal(t, minimumRepeatInterval, queue.duration)
+		})
+	}
+}
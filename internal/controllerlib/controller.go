@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package controllerlib
@@ -17,6 +17,7 @@ import (
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
 
+	"go.pinniped.dev/internal/metrics"
 	"go.pinniped.dev/internal/plog"
 )
 
@@ -194,7 +195,9 @@ func (c *controller) processNextWorkItem(ctx context.Context) {
 		Recorder: c.recorder,
 	}
 
+	start := time.Now()
 	err := c.sync(syncCtx)
+	metrics.ObserveControllerSync(c.Name(), start, err)
 	c.handleKey(key, err)
 }
 
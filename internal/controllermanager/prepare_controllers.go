@@ -94,6 +94,10 @@ type Config struct {
 
 	// Labels are labels that should be added to any resources created by the controllers.
 	Labels map[string]string
+
+	// AllowReservedUsernamesAndGroups disables the impersonation proxy's rejection of client certificates
+	// which it issued for usernames or groups that are reserved by Kubernetes.
+	AllowReservedUsernamesAndGroups bool
 }
 
 // PrepareControllers prepares the controllers and their informers and returns a function that will start them when called.
@@ -272,7 +276,7 @@ func PrepareControllers(c *Config) (controllerinit.RunnerBuilder, error) {
 				c.NamesConfig.ImpersonationCACertificateSecret,
 				c.Labels,
 				clock.RealClock{},
-				impersonator.New,
+				impersonator.NewFactory(c.AllowReservedUsernamesAndGroups),
 				c.NamesConfig.ImpersonationSignerSecret,
 				c.ImpersonationSigningCertProvider,
 				klogr.New(),
@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package crud
@@ -25,6 +25,10 @@ import (
 const (
 	SecretLabelKey = "storage.pinniped.dev/type"
 
+	// EncryptionKeyIDLabelKey is the label which records the ID of the key which encrypted the data of a Secret.
+	// Secrets without this label store their data unencrypted.
+	EncryptionKeyIDLabelKey = "storage.pinniped.dev/encryption-key-id"
+
 	SecretLifetimeAnnotationKey        = "storage.pinniped.dev/garbage-collect-after"
 	SecretLifetimeAnnotationDateFormat = time.RFC3339
 
@@ -37,19 +41,95 @@ const (
 	ErrSecretTypeMismatch    = constable.Error("secret storage data has incorrect type")
 	ErrSecretLabelMismatch   = constable.Error("secret storage data has incorrect label")
 	ErrSecretVersionMismatch = constable.Error("secret storage data has incorrect version")
+	ErrNoSecretsMatchedLabel = constable.Error("none found")
+	ErrSecretEncrypted       = constable.Error("secret storage data is encrypted, but no encryption keys are available")
 )
 
 type Storage interface {
 	Create(ctx context.Context, signature string, data JSON, additionalLabels map[string]string) (resourceVersion string, err error)
 	Get(ctx context.Context, signature string, data JSON) (resourceVersion string, err error)
-	Update(ctx context.Context, signature, resourceVersion string, data JSON) (newResourceVersion string, err error)
+	Update(ctx context.Context, signature, resourceVersion string, data JSON, additionalLabels map[string]string) (newResourceVersion string, err error)
 	Delete(ctx context.Context, signature string) error
+	GetByLabel(ctx context.Context, labelName string, labelValue string, data JSON) (resourceVersion string, err error)
 	DeleteByLabel(ctx context.Context, labelName string, labelValue string) error
+	ListByLabel(ctx context.Context, labelName string, labelValue string, newData func() JSON) ([]JSON, error)
+	List(ctx context.Context, newData func() JSON) ([]JSON, error)
 }
 
 type JSON interface{} // document that we need valid JSON types
 
+// Backend creates the Storage of each resource type. Every implementation must report missing data and conflicting
+// updates using the errors of the Kubernetes API, e.g. errors.IsNotFound, so that callers can handle all of them alike.
+type Backend interface {
+	Storage(resource string, clock func() time.Time, lifetime time.Duration) Storage
+}
+
+// Transformer encrypts the data of each Secret before it is stored, and decrypts it after it is read. The associated
+// data is authenticated, but not encrypted, so that encrypted data cannot be copied from one Secret to another.
+type Transformer interface {
+	// Encrypt encrypts the data, and returns the ID of the key which encrypted it.
+	Encrypt(plaintext, associatedData []byte) (ciphertext []byte, keyID string, err error)
+	// Decrypt decrypts data which was encrypted by the key with the given ID.
+	Decrypt(ciphertext, associatedData []byte, keyID string) (plaintext []byte, err error)
+}
+
+// EncryptionKeys provides the Transformer of each FederationDomain.
+type EncryptionKeys interface {
+	// ForIssuer returns a Transformer which encrypts and decrypts data using the keys of the FederationDomain with the
+	// given issuer. The Transformer of the empty issuer only decrypts, using the keys of all FederationDomains.
+	ForIssuer(issuer string) Transformer
+}
+
+// issuerScopedBackend is implemented by Backends which store the data of each FederationDomain differently.
+type issuerScopedBackend interface {
+	forIssuer(issuer string) Backend
+}
+
+// ForIssuer returns the Backend which stores the data of the FederationDomain with the given issuer. Backends which
+// store the data of all FederationDomains alike are returned unchanged.
+func ForIssuer(backend Backend, issuer string) Backend {
+	if b, ok := backend.(issuerScopedBackend); ok {
+		return b.forIssuer(issuer)
+	}
+	return backend
+}
+
+// NewSecretsBackend returns the default Backend, which stores each piece of data as a Secret.
+func NewSecretsBackend(secrets corev1client.SecretInterface) Backend {
+	return secretsBackend{secrets: secrets}
+}
+
+// NewEncryptedSecretsBackend is similar to NewSecretsBackend, but the data of each Secret is encrypted using the keys
+// of the FederationDomain which stored it, see ForIssuer. Secrets which were stored without encryption can still be
+// read. The Backend itself may only be used to read data which was stored by any FederationDomain.
+func NewEncryptedSecretsBackend(secrets corev1client.SecretInterface, keys EncryptionKeys) Backend {
+	return secretsBackend{secrets: secrets, keys: keys}
+}
+
+type secretsBackend struct {
+	secrets corev1client.SecretInterface
+	keys    EncryptionKeys // nil when the data is not encrypted
+	issuer  string
+}
+
+func (b secretsBackend) Storage(resource string, clock func() time.Time, lifetime time.Duration) Storage {
+	storage := newSecretsStorage(resource, b.secrets, clock, lifetime)
+	if b.keys != nil {
+		storage.transformer = b.keys.ForIssuer(b.issuer)
+	}
+	return newTracingStorage(storage, resource)
+}
+
+func (b secretsBackend) forIssuer(issuer string) Backend {
+	b.issuer = issuer
+	return b
+}
+
 func New(resource string, secrets corev1client.SecretInterface, clock func() time.Time, lifetime time.Duration) Storage {
+	return newTracingStorage(newSecretsStorage(resource, secrets, clock, lifetime), resource)
+}
+
+func newSecretsStorage(resource string, secrets corev1client.SecretInterface, clock func() time.Time, lifetime time.Duration) *secretsStorage {
 	return &secretsStorage{
 		resource:   resource,
 		secretType: secretType(resource),
@@ -60,11 +140,12 @@ func New(resource string, secrets corev1client.SecretInterface, clock func() tim
 }
 
 type secretsStorage struct {
-	resource   string
-	secretType corev1.SecretType
-	secrets    corev1client.SecretInterface
-	clock      func() time.Time
-	lifetime   time.Duration
+	resource    string
+	secretType  corev1.SecretType
+	secrets     corev1client.SecretInterface
+	clock       func() time.Time
+	lifetime    time.Duration
+	transformer Transformer // nil when the data is not encrypted
 }
 
 func (s *secretsStorage) Create(ctx context.Context, signature string, data JSON, additionalLabels map[string]string) (string, error) {
@@ -85,19 +166,20 @@ func (s *secretsStorage) Get(ctx context.Context, signature string, data JSON) (
 		return "", fmt.Errorf("failed to get %s for signature %s: %w", s.resource, signature, err)
 	}
 
-	err = FromSecret(s.resource, secret, data)
+	err = FromSecret(s.resource, secret, s.transformer, data)
 	if err != nil {
 		return "", fmt.Errorf("error during get for signature %s: %w", signature, err)
 	}
 	return secret.ResourceVersion, nil
 }
 
-func (s *secretsStorage) Update(ctx context.Context, signature, resourceVersion string, data JSON) (string, error) {
+func (s *secretsStorage) Update(ctx context.Context, signature, resourceVersion string, data JSON, additionalLabels map[string]string) (string, error) {
 	// Note: There may be a small bug here in that toSecret will move the SecretLifetimeAnnotationKey date forward
 	// instead of keeping the storage resource's original SecretLifetimeAnnotationKey value. However, we only use
-	// this Update method in one place, and it doesn't matter in that place. Be aware that it might need improvement
-	// if we start using this Update method in more places.
-	secret, err := s.toSecret(signature, resourceVersion, data, nil)
+	// this Update method for authcode and device code storage, and it doesn't matter for those short-lived sessions.
+	// Be aware that it might need improvement if we start using this Update method in more places.
+	// Labels are also replaced, so the caller must pass the same additionalLabels which it used during Create.
+	secret, err := s.toSecret(signature, resourceVersion, data, additionalLabels)
 	if err != nil {
 		return "", err
 	}
@@ -115,6 +197,36 @@ func (s *secretsStorage) Delete(ctx context.Context, signature string) error {
 	return nil
 }
 
+// GetByLabel is similar to Get, but finds the Secret by label instead of by signature. When more than one Secret
+// matches the label, then the most recently created Secret is used.
+func (s *secretsStorage) GetByLabel(ctx context.Context, labelName string, labelValue string, data JSON) (string, error) {
+	list, err := s.secrets.List(ctx, metav1.ListOptions{
+		LabelSelector: labels.Set{
+			SecretLabelKey: s.resource,
+			labelName:      labelValue,
+		}.String(),
+	})
+	if err != nil {
+		return "", fmt.Errorf(`failed to list secrets for resource "%s" matching label "%s=%s": %w`, s.resource, labelName, labelValue, err)
+	}
+	if len(list.Items) == 0 {
+		return "", fmt.Errorf(`failed to get secret for resource "%s" matching label "%s=%s": %w`, s.resource, labelName, labelValue, ErrNoSecretsMatchedLabel)
+	}
+
+	newest := &list.Items[0]
+	for i := range list.Items {
+		if newest.CreationTimestamp.Before(&list.Items[i].CreationTimestamp) {
+			newest = &list.Items[i]
+		}
+	}
+
+	err = FromSecret(s.resource, newest, s.transformer, data)
+	if err != nil {
+		return "", fmt.Errorf("error during get for secret %s: %w", newest.Name, err)
+	}
+	return newest.ResourceVersion, nil
+}
+
 func (s *secretsStorage) DeleteByLabel(ctx context.Context, labelName string, labelValue string) error {
 	list, err := s.secrets.List(ctx, metav1.ListOptions{
 		LabelSelector: labels.Set{
@@ -126,7 +238,7 @@ func (s *secretsStorage) DeleteByLabel(ctx context.Context, labelName string, la
 		return fmt.Errorf(`failed to list secrets for resource "%s" matching label "%s=%s": %w`, s.resource, labelName, labelValue, err)
 	}
 	if len(list.Items) == 0 {
-		return fmt.Errorf(`failed to delete secrets for resource "%s" matching label "%s=%s": none found`, s.resource, labelName, labelValue)
+		return fmt.Errorf(`failed to delete secrets for resource "%s" matching label "%s=%s": %w`, s.resource, labelName, labelValue, ErrNoSecretsMatchedLabel)
 	}
 	// TODO try to delete all of the items and consolidate all of the errors and return them all
 	for _, secret := range list.Items {
@@ -138,18 +250,94 @@ func (s *secretsStorage) DeleteByLabel(ctx context.Context, labelName string, la
 	return nil
 }
 
+// ListByLabel returns the data of all Secrets of this resource type which have the given label. Each of them is
+// unmarshalled into a new value returned by newData. Secrets which cannot be read, e.g. because they were stored by an
+// older version of Pinniped, are skipped. It is not an error when no Secrets match the label.
+func (s *secretsStorage) ListByLabel(ctx context.Context, labelName string, labelValue string, newData func() JSON) ([]JSON, error) {
+	list, err := s.secrets.List(ctx, metav1.ListOptions{
+		LabelSelector: labels.Set{
+			SecretLabelKey: s.resource,
+			labelName:      labelValue,
+		}.String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf(`failed to list secrets for resource "%s" matching label "%s=%s": %w`, s.resource, labelName, labelValue, err)
+	}
+	return s.readAll(list.Items, newData), nil
+}
+
+// List is similar to ListByLabel, but returns the data of all Secrets of this resource type.
+func (s *secretsStorage) List(ctx context.Context, newData func() JSON) ([]JSON, error) {
+	list, err := s.secrets.List(ctx, metav1.ListOptions{
+		LabelSelector: labels.Set{SecretLabelKey: s.resource}.String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf(`failed to list secrets for resource "%s": %w`, s.resource, err)
+	}
+	return s.readAll(list.Items, newData), nil
+}
+
+func (s *secretsStorage) readAll(secrets []corev1.Secret, newData func() JSON) []JSON {
+	result := make([]JSON, 0, len(secrets))
+	for i := range secrets {
+		data := newData()
+		if err := FromSecret(s.resource, &secrets[i], s.transformer, data); err != nil {
+			continue
+		}
+		result = append(result, data)
+	}
+	return result
+}
+
 // FromSecret is similar to Get, but for when you already have a Secret in hand, e.g. from an informer.
-// It validates and unmarshals the Secret. The data parameter is filled in as the result.
-func FromSecret(resource string, secret *corev1.Secret, data JSON) error {
+// It validates, decrypts and unmarshals the Secret. The data parameter is filled in as the result. The transformer
+// may be nil when the Secret is not expected to be encrypted.
+func FromSecret(resource string, secret *corev1.Secret, transformer Transformer, data JSON) error {
 	if err := validateSecret(resource, secret); err != nil {
 		return err
 	}
-	if err := json.Unmarshal(secret.Data[secretDataKey], data); err != nil {
+	buf, err := decrypt(secret, transformer)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %s: %w", resource, err)
+	}
+	if err := json.Unmarshal(buf, data); err != nil {
 		return fmt.Errorf("failed to decode %s: %w", resource, err)
 	}
 	return nil
 }
 
+// ReencryptSecret returns a copy of a Secret whose data is decrypted and then encrypted again by the transformer,
+// e.g. with a new key after the previous key was rotated. Secrets which were stored without encryption are encrypted.
+func ReencryptSecret(secret *corev1.Secret, transformer Transformer) (*corev1.Secret, error) {
+	buf, err := decrypt(secret, transformer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secret %s: %w", secret.Name, err)
+	}
+	encrypted, keyID, err := transformer.Encrypt(buf, []byte(secret.Name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt secret %s: %w", secret.Name, err)
+	}
+
+	secret = secret.DeepCopy()
+	secret.Data[secretDataKey] = encrypted
+	if secret.Labels == nil {
+		secret.Labels = map[string]string{}
+	}
+	secret.Labels[EncryptionKeyIDLabelKey] = keyID
+	return secret, nil
+}
+
+func decrypt(secret *corev1.Secret, transformer Transformer) ([]byte, error) {
+	keyID, encrypted := secret.Labels[EncryptionKeyIDLabelKey]
+	if !encrypted {
+		return secret.Data[secretDataKey], nil
+	}
+	if transformer == nil {
+		return nil, ErrSecretEncrypted
+	}
+	return transformer.Decrypt(secret.Data[secretDataKey], []byte(secret.Name), keyID)
+}
+
 func secretType(resource string) corev1.SecretType {
 	return corev1.SecretType(fmt.Sprintf(secretTypeFormat, resource))
 }
@@ -180,9 +368,10 @@ func (s *secretsStorage) getName(signature string) string {
 }
 
 func (s *secretsStorage) toSecret(signature, resourceVersion string, data JSON, additionalLabels map[string]string) (*corev1.Secret, error) {
+	name := s.getName(signature)
 	buf, err := json.Marshal(data)
 	if err != nil {
-		return nil, fmt.Errorf("failed to encode secret data for %s: %w", s.getName(signature), err)
+		return nil, fmt.Errorf("failed to encode secret data for %s: %w", name, err)
 	}
 
 	labelsToAdd := map[string]string{
@@ -192,9 +381,19 @@ func (s *secretsStorage) toSecret(signature, resourceVersion string, data JSON,
 		labelsToAdd[labelName] = labelValue
 	}
 
+	if s.transformer != nil {
+		// The Secret's name is authenticated, so the encrypted data of one Secret cannot be copied into another.
+		var keyID string
+		buf, keyID, err = s.transformer.Encrypt(buf, []byte(name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt secret data for %s: %w", name, err)
+		}
+		labelsToAdd[EncryptionKeyIDLabelKey] = keyID
+	}
+
 	return &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:            s.getName(signature),
+			Name:            name,
 			ResourceVersion: resourceVersion,
 			Labels:          labelsToAdd,
 			Annotations: map[string]string{
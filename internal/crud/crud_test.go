@@ -7,6 +7,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -109,6 +110,23 @@ func TestStorage(t *testing.T) {
 			wantSecrets: nil,
 			wantErr:     `failed to delete secrets for resource "tokens" matching label "additionalLabel=matching-value": none found`,
 		},
+		{
+			name:     "get non-existent by label",
+			resource: "tokens",
+			mocks:    nil,
+			run: func(t *testing.T, storage Storage, fakeClock *clocktesting.FakeClock) error {
+				_, err := storage.GetByLabel(ctx, "additionalLabel", "matching-value", &testJSON{})
+				require.True(t, errors.Is(err, ErrNoSecretsMatchedLabel))
+				return err
+			},
+			wantActions: []coretesting.Action{
+				coretesting.NewListAction(secretsGVR, schema.GroupVersionKind{Group: "", Version: "v1", Kind: "Secret"}, namespace, metav1.ListOptions{
+					LabelSelector: "storage.pinniped.dev/type=tokens,additionalLabel=matching-value",
+				}),
+			},
+			wantSecrets: nil,
+			wantErr:     `failed to get secret for resource "tokens" matching label "additionalLabel=matching-value": none found`,
+		},
 		{
 			name:     "create and get",
 			resource: "access-tokens",
@@ -442,7 +460,7 @@ func TestStorage(t *testing.T) {
 				require.Equal(t, data, out)
 
 				newData := &testJSON{Data: "shirts"}
-				rv2, err := storage.Update(ctx, signature, rv1, newData)
+				rv2, err := storage.Update(ctx, signature, rv1, newData, nil)
 				require.Equal(t, "45", rv2) // mock sets to a higher value on update
 				require.NoError(t, err)
 
@@ -759,6 +777,438 @@ func TestStorage(t *testing.T) {
 			},
 			wantErr: `failed to list secrets for resource "seals" matching label "additionalLabel=matching-value": some listing error`,
 		},
+		{
+			name:     "get by label chooses the newest matching secret",
+			resource: "seals",
+			mocks: func(t *testing.T, mock mocker) {
+				require.NoError(t, mock.Tracker().Add(&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:              "pinniped-storage-seals-older",
+						Namespace:         namespace,
+						ResourceVersion:   "1",
+						CreationTimestamp: metav1.NewTime(fakeNow.Add(-time.Minute)),
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": "seals",
+							"additionalLabel":           "matching-value",
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"older-seal"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/seals",
+				}))
+				require.NoError(t, mock.Tracker().Add(&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:              "pinniped-storage-seals-newer",
+						Namespace:         namespace,
+						ResourceVersion:   "2",
+						CreationTimestamp: metav1.NewTime(fakeNow),
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": "seals",
+							"additionalLabel":           "matching-value",
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"newer-seal"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/seals",
+				}))
+				require.NoError(t, mock.Tracker().Add(&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:              "pinniped-storage-seals-nonmatching",
+						Namespace:         namespace,
+						ResourceVersion:   "3",
+						CreationTimestamp: metav1.NewTime(fakeNow.Add(time.Minute)),
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": "seals",
+							"additionalLabel":           "non-matching-value",
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"non-matching-seal"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/seals",
+				}))
+				require.NoError(t, mock.Tracker().Add(&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:              "pinniped-storage-seals-othertype",
+						Namespace:         namespace,
+						ResourceVersion:   "4",
+						CreationTimestamp: metav1.NewTime(fakeNow.Add(time.Minute)),
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": "walruses",
+							"additionalLabel":           "matching-value",
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"walrus"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/walruses",
+				}))
+			},
+			run: func(t *testing.T, storage Storage, fakeClock *clocktesting.FakeClock) error {
+				out := &testJSON{}
+				rv, err := storage.GetByLabel(ctx, "additionalLabel", "matching-value", out)
+				require.NoError(t, err)
+				require.Equal(t, "2", rv)
+				require.Equal(t, &testJSON{Data: "newer-seal"}, out)
+				return nil
+			},
+			wantActions: []coretesting.Action{
+				coretesting.NewListAction(secretsGVR, schema.GroupVersionKind{Group: "", Version: "v1", Kind: "Secret"}, namespace, metav1.ListOptions{
+					LabelSelector: "storage.pinniped.dev/type=seals,additionalLabel=matching-value",
+				}),
+			},
+			wantSecrets: []corev1.Secret{
+				*&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:              "pinniped-storage-seals-newer",
+						Namespace:         namespace,
+						ResourceVersion:   "2",
+						CreationTimestamp: metav1.NewTime(fakeNow),
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": "seals",
+							"additionalLabel":           "matching-value",
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"newer-seal"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/seals",
+				},
+				*&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:              "pinniped-storage-seals-nonmatching",
+						Namespace:         namespace,
+						ResourceVersion:   "3",
+						CreationTimestamp: metav1.NewTime(fakeNow.Add(time.Minute)),
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": "seals",
+							"additionalLabel":           "non-matching-value",
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"non-matching-seal"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/seals",
+				},
+				*&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:              "pinniped-storage-seals-older",
+						Namespace:         namespace,
+						ResourceVersion:   "1",
+						CreationTimestamp: metav1.NewTime(fakeNow.Add(-time.Minute)),
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": "seals",
+							"additionalLabel":           "matching-value",
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"older-seal"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/seals",
+				},
+				*&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:              "pinniped-storage-seals-othertype",
+						Namespace:         namespace,
+						ResourceVersion:   "4",
+						CreationTimestamp: metav1.NewTime(fakeNow.Add(time.Minute)),
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": "walruses",
+							"additionalLabel":           "matching-value",
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"walrus"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/walruses",
+				},
+			},
+			wantErr: "",
+		},
+		{
+			name:     "list by label",
+			resource: "seals",
+			mocks: func(t *testing.T, mock mocker) {
+				require.NoError(t, mock.Tracker().Add(&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:            "pinniped-storage-seals-one",
+						Namespace:       namespace,
+						ResourceVersion: "1",
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": "seals",
+							"additionalLabel":           "matching-value",
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"seal-one"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/seals",
+				}))
+				require.NoError(t, mock.Tracker().Add(&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:            "pinniped-storage-seals-two",
+						Namespace:       namespace,
+						ResourceVersion: "2",
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": "seals",
+							"additionalLabel":           "matching-value",
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"seal-two"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/seals",
+				}))
+				require.NoError(t, mock.Tracker().Add(&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:            "pinniped-storage-seals-nonmatching",
+						Namespace:       namespace,
+						ResourceVersion: "3",
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": "seals",
+							"additionalLabel":           "non-matching-value",
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"non-matching-seal"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/seals",
+				}))
+				require.NoError(t, mock.Tracker().Add(&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:            "pinniped-storage-walruses-othertype",
+						Namespace:       namespace,
+						ResourceVersion: "4",
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": "walruses",
+							"additionalLabel":           "matching-value",
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"walrus"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/walruses",
+				}))
+			},
+			run: func(t *testing.T, storage Storage, fakeClock *clocktesting.FakeClock) error {
+				list, err := storage.ListByLabel(ctx, "additionalLabel", "matching-value", func() JSON { return &testJSON{} })
+				require.NoError(t, err)
+				var names []string
+				for _, data := range list {
+					names = append(names, data.(*testJSON).Data)
+				}
+				require.ElementsMatch(t, []string{"seal-one", "seal-two"}, names)
+				return nil
+			},
+			wantActions: []coretesting.Action{
+				coretesting.NewListAction(secretsGVR, schema.GroupVersionKind{Group: "", Version: "v1", Kind: "Secret"}, namespace, metav1.ListOptions{
+					LabelSelector: "storage.pinniped.dev/type=seals,additionalLabel=matching-value",
+				}),
+			},
+			wantSecrets: []corev1.Secret{
+				*&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:            "pinniped-storage-seals-nonmatching",
+						Namespace:       namespace,
+						ResourceVersion: "3",
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": "seals",
+							"additionalLabel":           "non-matching-value",
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"non-matching-seal"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/seals",
+				},
+				*&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:            "pinniped-storage-seals-one",
+						Namespace:       namespace,
+						ResourceVersion: "1",
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": "seals",
+							"additionalLabel":           "matching-value",
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"seal-one"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/seals",
+				},
+				*&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:            "pinniped-storage-seals-two",
+						Namespace:       namespace,
+						ResourceVersion: "2",
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": "seals",
+							"additionalLabel":           "matching-value",
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"seal-two"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/seals",
+				},
+				*&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:            "pinniped-storage-walruses-othertype",
+						Namespace:       namespace,
+						ResourceVersion: "4",
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": "walruses",
+							"additionalLabel":           "matching-value",
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"walrus"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/walruses",
+				},
+			},
+			wantErr: "",
+		},
+		{
+			name:     "list non-existent by label",
+			resource: "tokens",
+			mocks:    nil,
+			run: func(t *testing.T, storage Storage, fakeClock *clocktesting.FakeClock) error {
+				list, err := storage.ListByLabel(ctx, "additionalLabel", "matching-value", func() JSON { return &testJSON{} })
+				require.Empty(t, list)
+				return err
+			},
+			wantActions: []coretesting.Action{
+				coretesting.NewListAction(secretsGVR, schema.GroupVersionKind{Group: "", Version: "v1", Kind: "Secret"}, namespace, metav1.ListOptions{
+					LabelSelector: "storage.pinniped.dev/type=tokens,additionalLabel=matching-value",
+				}),
+			},
+			wantSecrets: nil,
+			wantErr:     "",
+		},
+		{
+			name:     "list skips secrets which cannot be read",
+			resource: "seals",
+			mocks: func(t *testing.T, mock mocker) {
+				require.NoError(t, mock.Tracker().Add(&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:            "pinniped-storage-seals-one",
+						Namespace:       namespace,
+						ResourceVersion: "1",
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": "seals",
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"seal-one"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/seals",
+				}))
+				require.NoError(t, mock.Tracker().Add(&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:            "pinniped-storage-seals-wrongversion",
+						Namespace:       namespace,
+						ResourceVersion: "2",
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": "seals",
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"seal-two"}`),
+						"pinniped-storage-version": []byte("2"),
+					},
+					Type: "storage.pinniped.dev/seals",
+				}))
+			},
+			run: func(t *testing.T, storage Storage, fakeClock *clocktesting.FakeClock) error {
+				list, err := storage.List(ctx, func() JSON { return &testJSON{} })
+				require.NoError(t, err)
+				require.Equal(t, []JSON{&testJSON{Data: "seal-one"}}, list)
+				return nil
+			},
+			wantActions: []coretesting.Action{
+				coretesting.NewListAction(secretsGVR, schema.GroupVersionKind{Group: "", Version: "v1", Kind: "Secret"}, namespace, metav1.ListOptions{
+					LabelSelector: "storage.pinniped.dev/type=seals",
+				}),
+			},
+			wantSecrets: []corev1.Secret{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:            "pinniped-storage-seals-one",
+						Namespace:       namespace,
+						ResourceVersion: "1",
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": "seals",
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"seal-one"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/seals",
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:            "pinniped-storage-seals-wrongversion",
+						Namespace:       namespace,
+						ResourceVersion: "2",
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": "seals",
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"seal-two"}`),
+						"pinniped-storage-version": []byte("2"),
+					},
+					Type: "storage.pinniped.dev/seals",
+				},
+			},
+			wantErr: "",
+		},
+		{
+			name:     "when there is an error listing secrets during a get by label operation",
+			resource: "seals",
+			mocks: func(t *testing.T, mock mocker) {
+				mock.PrependReactor("list", "secrets", func(action coretesting.Action) (handled bool, ret runtime.Object, err error) {
+					listAction := action.(coretesting.ListActionImpl)
+					requiresExactMatch, found := listAction.GetListRestrictions().Labels.RequiresExactMatch("additionalLabel")
+					if !found || requiresExactMatch != "matching-value" {
+						// this list action did not use label selector additionalLabel=matching-value, so allow it to proceed without intervention
+						return false, nil, nil
+					}
+					return true, nil, fmt.Errorf("some listing error")
+				})
+			},
+			run: func(t *testing.T, storage Storage, fakeClock *clocktesting.FakeClock) error {
+				_, err := storage.GetByLabel(ctx, "additionalLabel", "matching-value", &testJSON{})
+				return err
+			},
+			wantActions: []coretesting.Action{
+				coretesting.NewListAction(secretsGVR, schema.GroupVersionKind{Group: "", Version: "v1", Kind: "Secret"}, namespace, metav1.ListOptions{
+					LabelSelector: "storage.pinniped.dev/type=seals,additionalLabel=matching-value",
+				}),
+			},
+			wantErr: `failed to list secrets for resource "seals" matching label "additionalLabel=matching-value": some listing error`,
+		},
 		{
 			name:     "invalid exiting secret type",
 			resource: "candies",
@@ -1110,11 +1560,12 @@ func TestFromSecret(t *testing.T) {
 	}
 
 	tests := []struct {
-		name     string
-		resource string
-		secret   *corev1.Secret
-		wantData *testJSON
-		wantErr  string
+		name        string
+		resource    string
+		secret      *corev1.Secret
+		transformer Transformer
+		wantData    *testJSON
+		wantErr     string
 	}{
 		{
 			name:     "happy path",
@@ -1235,13 +1686,87 @@ func TestFromSecret(t *testing.T) {
 			wantData: &testJSON{Data: "snorlax"},
 			wantErr:  "secret storage data has incorrect type: storage.pinniped.dev/not-candies must equal storage.pinniped.dev/candies",
 		},
+		{
+			name:     "encrypted",
+			resource: "candies",
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            "pinniped-storage-candies-lvzgyywdc2dhjdbgf5jvzfyphosigvhnsh6qlse3blumogoqhqhq",
+					Namespace:       "some-namespace",
+					ResourceVersion: "",
+					Labels: map[string]string{
+						"storage.pinniped.dev/type":              "candies",
+						"storage.pinniped.dev/encryption-key-id": "key-for-some-issuer",
+					},
+					Annotations: map[string]string{
+						"storage.pinniped.dev/garbage-collect-after": fakeNowPlusLifetimeAsString,
+					},
+				},
+				Data: map[string][]byte{
+					"pinniped-storage-data":    []byte(`encrypted(pinniped-storage-candies-lvzgyywdc2dhjdbgf5jvzfyphosigvhnsh6qlse3blumogoqhqhq,{"Data":"snorlax"})`),
+					"pinniped-storage-version": []byte("1"),
+				},
+				Type: "storage.pinniped.dev/candies",
+			},
+			transformer: &fakeTransformer{},
+			wantData:    &testJSON{Data: "snorlax"},
+		},
+		{
+			name:     "encrypted without a transformer",
+			resource: "candies",
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            "pinniped-storage-candies-lvzgyywdc2dhjdbgf5jvzfyphosigvhnsh6qlse3blumogoqhqhq",
+					Namespace:       "some-namespace",
+					ResourceVersion: "",
+					Labels: map[string]string{
+						"storage.pinniped.dev/type":              "candies",
+						"storage.pinniped.dev/encryption-key-id": "key-for-some-issuer",
+					},
+					Annotations: map[string]string{
+						"storage.pinniped.dev/garbage-collect-after": fakeNowPlusLifetimeAsString,
+					},
+				},
+				Data: map[string][]byte{
+					"pinniped-storage-data":    []byte(`encrypted(pinniped-storage-candies-lvzgyywdc2dhjdbgf5jvzfyphosigvhnsh6qlse3blumogoqhqhq,{"Data":"snorlax"})`),
+					"pinniped-storage-version": []byte("1"),
+				},
+				Type: "storage.pinniped.dev/candies",
+			},
+			wantErr: "failed to decrypt candies: secret storage data is encrypted, but no encryption keys are available",
+		},
+		{
+			name:     "encrypted for another secret",
+			resource: "candies",
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            "pinniped-storage-candies-lvzgyywdc2dhjdbgf5jvzfyphosigvhnsh6qlse3blumogoqhqhq",
+					Namespace:       "some-namespace",
+					ResourceVersion: "",
+					Labels: map[string]string{
+						"storage.pinniped.dev/type":              "candies",
+						"storage.pinniped.dev/encryption-key-id": "key-for-some-issuer",
+					},
+					Annotations: map[string]string{
+						"storage.pinniped.dev/garbage-collect-after": fakeNowPlusLifetimeAsString,
+					},
+				},
+				Data: map[string][]byte{
+					"pinniped-storage-data":    []byte(`encrypted(pinniped-storage-candies-some-other-secret,{"Data":"snorlax"})`),
+					"pinniped-storage-version": []byte("1"),
+				},
+				Type: "storage.pinniped.dev/candies",
+			},
+			transformer: &fakeTransformer{},
+			wantErr:     "failed to decrypt candies: cannot decrypt",
+		},
 	}
 	for _, tt := range tests {
 		tt := tt
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
 			data := &testJSON{}
-			err := FromSecret("candies", tt.secret, data)
+			err := FromSecret("candies", tt.secret, tt.transformer, data)
 			if tt.wantErr == "" {
 				require.NoError(t, err)
 				require.Equal(t, data, tt.wantData)
@@ -1251,3 +1776,115 @@ func TestFromSecret(t *testing.T) {
 		})
 	}
 }
+
+func TestEncryptedSecretsBackend(t *testing.T) {
+	ctx := context.Background()
+	fakeNow := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return fakeNow }
+
+	type testJSON struct {
+		Data string
+	}
+
+	client := fake.NewSimpleClientset()
+	secrets := client.CoreV1().Secrets("some-namespace")
+	backend := NewEncryptedSecretsBackend(secrets, fakeEncryptionKeys{})
+
+	// Data is encrypted with the keys of the FederationDomain which stores it.
+	storage := ForIssuer(backend, "some-issuer").Storage("candies", clock, time.Minute)
+	_, err := storage.Create(ctx, "some-signature", &testJSON{Data: "snorlax"}, map[string]string{"some-label": "some-value"})
+	require.NoError(t, err)
+
+	secret, err := secrets.Get(ctx, "pinniped-storage-candies-wkez56wiuco2w3vn", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"storage.pinniped.dev/type":              "candies",
+		"storage.pinniped.dev/encryption-key-id": "key-for-some-issuer",
+		"some-label":                             "some-value",
+	}, secret.Labels)
+	require.Equal(t, `encrypted(pinniped-storage-candies-wkez56wiuco2w3vn,{"Data":"snorlax"})`, string(secret.Data["pinniped-storage-data"]))
+
+	// Data which was stored by any FederationDomain can be read without choosing a FederationDomain.
+	out := &testJSON{}
+	_, err = backend.Storage("candies", clock, time.Minute).Get(ctx, "some-signature", out)
+	require.NoError(t, err)
+	require.Equal(t, "snorlax", out.Data)
+
+	// Data which was stored before it was encrypted can still be read.
+	_, err = New("candies", secrets, clock, time.Minute).Create(ctx, "other-signature", &testJSON{Data: "pikachu"}, nil)
+	require.NoError(t, err)
+	list, err := storage.List(ctx, func() JSON { return &testJSON{} })
+	require.NoError(t, err)
+	require.ElementsMatch(t, []JSON{&testJSON{Data: "snorlax"}, &testJSON{Data: "pikachu"}}, list)
+
+	// Without choosing a FederationDomain, nothing can be stored.
+	_, err = backend.Storage("candies", clock, time.Minute).Create(ctx, "third-signature", &testJSON{Data: "eevee"}, nil)
+	require.EqualError(t, err, "failed to encrypt secret data for pinniped-storage-candies-wymkw57lekbhnln2w4: no keys")
+
+	// Backends which do not encrypt are not affected by the FederationDomain.
+	_, err = ForIssuer(NewSecretsBackend(secrets), "some-issuer").Storage("candies", clock, time.Minute).Create(ctx, "third-signature", &testJSON{Data: "eevee"}, nil)
+	require.NoError(t, err)
+	secret, err = secrets.Get(ctx, "pinniped-storage-candies-wymkw57lekbhnln2w4", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.NotContains(t, secret.Labels, "storage.pinniped.dev/encryption-key-id")
+	require.Equal(t, `{"Data":"eevee"}`, string(secret.Data["pinniped-storage-data"]))
+}
+
+func TestReencryptSecret(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "some-secret",
+			Labels: map[string]string{
+				"storage.pinniped.dev/type":              "candies",
+				"storage.pinniped.dev/encryption-key-id": "key-for-old-issuer",
+			},
+		},
+		Data: map[string][]byte{
+			"pinniped-storage-data":    []byte(`encrypted(some-secret,{"Data":"snorlax"})`),
+			"pinniped-storage-version": []byte("1"),
+		},
+	}
+
+	reencrypted, err := ReencryptSecret(secret, &fakeTransformer{issuer: "new-issuer"})
+	require.NoError(t, err)
+	require.Equal(t, "key-for-new-issuer", reencrypted.Labels["storage.pinniped.dev/encryption-key-id"])
+	require.Equal(t, `encrypted(some-secret,{"Data":"snorlax"})`, string(reencrypted.Data["pinniped-storage-data"]))
+	require.Equal(t, "key-for-old-issuer", secret.Labels["storage.pinniped.dev/encryption-key-id"], "the original secret is not modified")
+
+	// Secrets which were stored without encryption are encrypted.
+	delete(secret.Labels, "storage.pinniped.dev/encryption-key-id")
+	secret.Data["pinniped-storage-data"] = []byte(`{"Data":"snorlax"}`)
+	reencrypted, err = ReencryptSecret(secret, &fakeTransformer{issuer: "new-issuer"})
+	require.NoError(t, err)
+	require.Equal(t, "key-for-new-issuer", reencrypted.Labels["storage.pinniped.dev/encryption-key-id"])
+	require.Equal(t, `encrypted(some-secret,{"Data":"snorlax"})`, string(reencrypted.Data["pinniped-storage-data"]))
+
+	_, err = ReencryptSecret(reencrypted, &fakeTransformer{})
+	require.EqualError(t, err, "failed to encrypt secret some-secret: no keys")
+}
+
+type fakeEncryptionKeys struct{}
+
+func (fakeEncryptionKeys) ForIssuer(issuer string) Transformer {
+	return &fakeTransformer{issuer: issuer}
+}
+
+// fakeTransformer "encrypts" data by wrapping it, so that tests can easily see what was encrypted.
+type fakeTransformer struct {
+	issuer string
+}
+
+func (f *fakeTransformer) Encrypt(plaintext, associatedData []byte) ([]byte, string, error) {
+	if f.issuer == "" {
+		return nil, "", errors.New("no keys")
+	}
+	return []byte(fmt.Sprintf("encrypted(%s,%s)", associatedData, plaintext)), "key-for-" + f.issuer, nil
+}
+
+func (f *fakeTransformer) Decrypt(ciphertext, associatedData []byte, _ string) ([]byte, error) {
+	prefix := fmt.Sprintf("encrypted(%s,", associatedData)
+	if !strings.HasPrefix(string(ciphertext), prefix) || !strings.HasSuffix(string(ciphertext), ")") {
+		return nil, errors.New("cannot decrypt")
+	}
+	return []byte(strings.TrimSuffix(strings.TrimPrefix(string(ciphertext), prefix), ")")), nil
+}
@@ -0,0 +1,466 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package sqlstorage implements a crud.Backend which stores data in a SQL database instead of in Secrets.
+package sqlstorage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/jackc/pgx/v4/stdlib" // register the "pgx" database/sql driver
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	_ "modernc.org/sqlite" // register the "sqlite" database/sql driver
+
+	"go.pinniped.dev/internal/crud"
+)
+
+// Dialect is the flavor of SQL spoken by the database.
+type Dialect string
+
+const (
+	// SQLite is an embedded database in a local file. Only a single process may use the file at a time.
+	SQLite Dialect = "sqlite"
+	// Postgres is PostgreSQL, or any other database which is compatible with PostgreSQL.
+	Postgres Dialect = "postgres"
+)
+
+// The schema works for both dialects. The times are Unix times in nanoseconds, which avoids the differences between
+// the date and time types of the dialects. The index on expires_at allows garbage collection to find expired data
+// without reading the whole table.
+//
+//nolint:gochecknoglobals
+var schemaStatements = []string{
+	`CREATE TABLE IF NOT EXISTS pinniped_storage (
+		resource TEXT NOT NULL,
+		name TEXT NOT NULL,
+		resource_version BIGINT NOT NULL,
+		data TEXT NOT NULL,
+		created_at BIGINT NOT NULL,
+		expires_at BIGINT NOT NULL,
+		PRIMARY KEY (resource, name)
+	)`,
+	`CREATE INDEX IF NOT EXISTS pinniped_storage_expires_at ON pinniped_storage (expires_at)`,
+	`CREATE TABLE IF NOT EXISTS pinniped_storage_labels (
+		resource TEXT NOT NULL,
+		name TEXT NOT NULL,
+		label_name TEXT NOT NULL,
+		label_value TEXT NOT NULL,
+		PRIMARY KEY (resource, name, label_name)
+	)`,
+	`CREATE INDEX IF NOT EXISTS pinniped_storage_labels_value ON pinniped_storage_labels (resource, label_name, label_value)`,
+}
+
+// Backend stores the data of all resource types in the same tables of a SQL database.
+type Backend struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+var _ crud.Backend = &Backend{}
+
+// Open connects to the database and creates the tables of the schema when they do not exist yet. For SQLite, the
+// data source name is the path of the database file. For PostgreSQL, it is a connection string.
+func Open(ctx context.Context, dialect Dialect, dataSourceName string) (*Backend, error) {
+	var driverName string
+	switch dialect {
+	case SQLite:
+		driverName = "sqlite"
+	case Postgres:
+		driverName = "pgx"
+	default:
+		return nil, fmt.Errorf("unknown SQL dialect %q", dialect)
+	}
+
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s database: %w", dialect, err)
+	}
+
+	if dialect == SQLite {
+		// SQLite only allows one writer at a time, so avoid "database is locked" errors by serializing all access.
+		db.SetMaxOpenConns(1)
+	}
+
+	b := &Backend{db: db, dialect: dialect}
+	if err := b.createSchema(ctx); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *Backend) createSchema(ctx context.Context) error {
+	for _, statement := range schemaStatements {
+		if _, err := b.db.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("could not create schema of %s database: %w", b.dialect, err)
+		}
+	}
+	return nil
+}
+
+// Close closes the connections to the database.
+func (b *Backend) Close() error {
+	return b.db.Close()
+}
+
+func (b *Backend) Storage(resource string, clock func() time.Time, lifetime time.Duration) crud.Storage {
+	return &sqlStorage{
+		backend:  b,
+		resource: resource,
+		clock:    clock,
+		lifetime: lifetime,
+	}
+}
+
+// Record is a row of the storage table.
+type Record struct {
+	Resource        string
+	Name            string
+	ResourceVersion string
+	ExpiresAt       time.Time
+	Data            []byte
+}
+
+// Decode unmarshals the data of the record.
+func (r *Record) Decode(data crud.JSON) error {
+	if err := json.Unmarshal(r.Data, data); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", r.Resource, err)
+	}
+	return nil
+}
+
+// ListExpired returns up to limit records which expired before the given time, starting with the oldest ones.
+func (b *Backend) ListExpired(ctx context.Context, now time.Time, limit int) ([]Record, error) {
+	rows, err := b.db.QueryContext(ctx, b.rebind(
+		`SELECT resource, name, resource_version, expires_at, data FROM pinniped_storage
+		WHERE expires_at < ? ORDER BY expires_at LIMIT ?`),
+		now.UnixNano(), limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list expired records: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var records []Record
+	for rows.Next() {
+		var record Record
+		var resourceVersion, expiresAt int64
+		var data string
+		if err := rows.Scan(&record.Resource, &record.Name, &resourceVersion, &expiresAt, &data); err != nil {
+			return nil, fmt.Errorf("failed to list expired records: %w", err)
+		}
+		record.ResourceVersion = strconv.FormatInt(resourceVersion, 10)
+		record.ExpiresAt = time.Unix(0, expiresAt).UTC()
+		record.Data = []byte(data)
+		records = append(records, record)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list expired records: %w", err)
+	}
+	return records, nil
+}
+
+// DeleteRecord deletes the given record, unless it was updated after it was read.
+func (b *Backend) DeleteRecord(ctx context.Context, record Record) error {
+	return b.inTransaction(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, b.rebind(
+			`DELETE FROM pinniped_storage WHERE resource = ? AND name = ? AND resource_version = ?`),
+			record.Resource, record.Name, record.ResourceVersion,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to delete %s %s: %w", record.Resource, record.Name, err)
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			return apierrors.NewConflict(groupResource(record.Resource), record.Name, errors.New("the record was changed or deleted"))
+		}
+		return deleteLabels(ctx, b, tx, record.Resource, record.Name)
+	})
+}
+
+// rebind replaces the ? placeholders of the query with the placeholders of the dialect.
+func (b *Backend) rebind(query string) string {
+	if b.dialect != Postgres {
+		return query
+	}
+	var sb strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			sb.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+func (b *Backend) inTransaction(ctx context.Context, f func(tx *sql.Tx) error) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	if err := f(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+type sqlStorage struct {
+	backend  *Backend
+	resource string
+	clock    func() time.Time
+	lifetime time.Duration
+}
+
+func (s *sqlStorage) Create(ctx context.Context, signature string, data crud.JSON, additionalLabels map[string]string) (string, error) {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode data for %s %s: %w", s.resource, signature, err)
+	}
+	now := s.clock()
+	err = s.backend.inTransaction(ctx, func(tx *sql.Tx) error {
+		// ON CONFLICT DO NOTHING is supported by both dialects, so there is no need to interpret the errors of each driver.
+		result, err := tx.ExecContext(ctx, s.backend.rebind(
+			`INSERT INTO pinniped_storage (resource, name, resource_version, data, created_at, expires_at)
+			VALUES (?, ?, 1, ?, ?, ?) ON CONFLICT DO NOTHING`),
+			s.resource, signature, string(buf), now.UnixNano(), now.Add(s.lifetime).UnixNano(),
+		)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			return apierrors.NewAlreadyExists(groupResource(s.resource), signature)
+		}
+		return insertLabels(ctx, s.backend, tx, s.resource, signature, additionalLabels)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create %s for signature %s: %w", s.resource, signature, err)
+	}
+	return "1", nil
+}
+
+func (s *sqlStorage) Get(ctx context.Context, signature string, data crud.JSON) (string, error) {
+	var resourceVersion int64
+	var buf string
+	err := s.backend.db.QueryRowContext(ctx, s.backend.rebind(
+		`SELECT resource_version, data FROM pinniped_storage WHERE resource = ? AND name = ?`),
+		s.resource, signature,
+	).Scan(&resourceVersion, &buf)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = apierrors.NewNotFound(groupResource(s.resource), signature)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get %s for signature %s: %w", s.resource, signature, err)
+	}
+
+	if err := json.Unmarshal([]byte(buf), data); err != nil {
+		return "", fmt.Errorf("error during get for signature %s: failed to decode %s: %w", signature, s.resource, err)
+	}
+	return strconv.FormatInt(resourceVersion, 10), nil
+}
+
+func (s *sqlStorage) Update(ctx context.Context, signature, resourceVersion string, data crud.JSON, additionalLabels map[string]string) (string, error) {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode data for %s %s: %w", s.resource, signature, err)
+	}
+	oldResourceVersion, err := strconv.ParseInt(resourceVersion, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("failed to update %s for signature %s: invalid resource version %q", s.resource, signature, resourceVersion)
+	}
+	// Like the Secrets backend, this moves the expiration forward, and the labels are replaced.
+	err = s.backend.inTransaction(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, s.backend.rebind(
+			`UPDATE pinniped_storage SET resource_version = ?, data = ?, expires_at = ?
+			WHERE resource = ? AND name = ? AND resource_version = ?`),
+			oldResourceVersion+1, string(buf), s.clock().Add(s.lifetime).UnixNano(), s.resource, signature, oldResourceVersion,
+		)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			return apierrors.NewConflict(groupResource(s.resource), signature,
+				fmt.Errorf("the %s does not exist or its resource version is not %s", s.resource, resourceVersion))
+		}
+		if err := deleteLabels(ctx, s.backend, tx, s.resource, signature); err != nil {
+			return err
+		}
+		return insertLabels(ctx, s.backend, tx, s.resource, signature, additionalLabels)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to update %s for signature %s at resource version %s: %w", s.resource, signature, resourceVersion, err)
+	}
+	return strconv.FormatInt(oldResourceVersion+1, 10), nil
+}
+
+func (s *sqlStorage) Delete(ctx context.Context, signature string) error {
+	err := s.backend.inTransaction(ctx, func(tx *sql.Tx) error {
+		return deleteRow(ctx, s.backend, tx, s.resource, signature)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete %s for signature %s: %w", s.resource, signature, err)
+	}
+	return nil
+}
+
+// GetByLabel is similar to Get, but finds the data by label instead of by signature. When more than one row matches
+// the label, then the most recently created row is used.
+func (s *sqlStorage) GetByLabel(ctx context.Context, labelName string, labelValue string, data crud.JSON) (string, error) {
+	var resourceVersion int64
+	var buf string
+	err := s.backend.db.QueryRowContext(ctx, s.backend.rebind(
+		`SELECT s.resource_version, s.data FROM pinniped_storage s
+		JOIN pinniped_storage_labels l ON l.resource = s.resource AND l.name = s.name
+		WHERE s.resource = ? AND l.label_name = ? AND l.label_value = ?
+		ORDER BY s.created_at DESC LIMIT 1`),
+		s.resource, labelName, labelValue,
+	).Scan(&resourceVersion, &buf)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf(`failed to get %s matching label "%s=%s": %w`, s.resource, labelName, labelValue, crud.ErrNoSecretsMatchedLabel)
+	}
+	if err != nil {
+		return "", fmt.Errorf(`failed to get %s matching label "%s=%s": %w`, s.resource, labelName, labelValue, err)
+	}
+
+	if err := json.Unmarshal([]byte(buf), data); err != nil {
+		return "", fmt.Errorf(`error during get for label "%s=%s": failed to decode %s: %w`, labelName, labelValue, s.resource, err)
+	}
+	return strconv.FormatInt(resourceVersion, 10), nil
+}
+
+func (s *sqlStorage) DeleteByLabel(ctx context.Context, labelName string, labelValue string) error {
+	return s.backend.inTransaction(ctx, func(tx *sql.Tx) error {
+		names, err := s.namesByLabel(ctx, tx, labelName, labelValue)
+		if err != nil {
+			return fmt.Errorf(`failed to list %s matching label "%s=%s": %w`, s.resource, labelName, labelValue, err)
+		}
+		if len(names) == 0 {
+			return fmt.Errorf(`failed to delete %s matching label "%s=%s": %w`, s.resource, labelName, labelValue, crud.ErrNoSecretsMatchedLabel)
+		}
+		for _, name := range names {
+			if err := deleteRow(ctx, s.backend, tx, s.resource, name); err != nil {
+				return fmt.Errorf(`failed to delete %s matching label "%s=%s" with name %s: %w`, s.resource, labelName, labelValue, name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// ListByLabel returns the data of all rows of this resource type which have the given label. Each of them is
+// unmarshalled into a new value returned by newData. Rows which cannot be decoded are skipped. It is not an error
+// when no rows match the label.
+func (s *sqlStorage) ListByLabel(ctx context.Context, labelName string, labelValue string, newData func() crud.JSON) ([]crud.JSON, error) {
+	rows, err := s.backend.db.QueryContext(ctx, s.backend.rebind(
+		`SELECT s.data FROM pinniped_storage s
+		JOIN pinniped_storage_labels l ON l.resource = s.resource AND l.name = s.name
+		WHERE s.resource = ? AND l.label_name = ? AND l.label_value = ?`),
+		s.resource, labelName, labelValue,
+	)
+	if err != nil {
+		return nil, fmt.Errorf(`failed to list %s matching label "%s=%s": %w`, s.resource, labelName, labelValue, err)
+	}
+	return readAll(rows, newData)
+}
+
+// List is similar to ListByLabel, but returns the data of all rows of this resource type.
+func (s *sqlStorage) List(ctx context.Context, newData func() crud.JSON) ([]crud.JSON, error) {
+	rows, err := s.backend.db.QueryContext(ctx, s.backend.rebind(
+		`SELECT data FROM pinniped_storage WHERE resource = ?`),
+		s.resource,
+	)
+	if err != nil {
+		return nil, fmt.Errorf(`failed to list %s: %w`, s.resource, err)
+	}
+	return readAll(rows, newData)
+}
+
+func (s *sqlStorage) namesByLabel(ctx context.Context, tx *sql.Tx, labelName string, labelValue string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, s.backend.rebind(
+		`SELECT name FROM pinniped_storage_labels WHERE resource = ? AND label_name = ? AND label_value = ?`),
+		s.resource, labelName, labelValue,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func readAll(rows *sql.Rows, newData func() crud.JSON) ([]crud.JSON, error) {
+	defer func() { _ = rows.Close() }()
+
+	var result []crud.JSON
+	for rows.Next() {
+		var buf string
+		if err := rows.Scan(&buf); err != nil {
+			return nil, err
+		}
+		data := newData()
+		if err := json.Unmarshal([]byte(buf), data); err != nil {
+			continue
+		}
+		result = append(result, data)
+	}
+	return result, rows.Err()
+}
+
+func insertLabels(ctx context.Context, b *Backend, tx *sql.Tx, resource, name string, labels map[string]string) error {
+	for labelName, labelValue := range labels {
+		if _, err := tx.ExecContext(ctx, b.rebind(
+			`INSERT INTO pinniped_storage_labels (resource, name, label_name, label_value) VALUES (?, ?, ?, ?)`),
+			resource, name, labelName, labelValue,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteLabels(ctx context.Context, b *Backend, tx *sql.Tx, resource, name string) error {
+	_, err := tx.ExecContext(ctx, b.rebind(
+		`DELETE FROM pinniped_storage_labels WHERE resource = ? AND name = ?`),
+		resource, name,
+	)
+	return err
+}
+
+func deleteRow(ctx context.Context, b *Backend, tx *sql.Tx, resource, name string) error {
+	result, err := tx.ExecContext(ctx, b.rebind(
+		`DELETE FROM pinniped_storage WHERE resource = ? AND name = ?`),
+		resource, name,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return apierrors.NewNotFound(groupResource(resource), name)
+	}
+	return deleteLabels(ctx, b, tx, resource, name)
+}
+
+// groupResource is used to build the Kubernetes API errors, which callers use to detect missing or conflicting data.
+func groupResource(resource string) schema.GroupResource {
+	return schema.GroupResource{Group: "storage.pinniped.dev", Resource: resource}
+}
@@ -0,0 +1,223 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package sqlstorage
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"go.pinniped.dev/internal/crud"
+)
+
+type testJSON struct {
+	Data string
+}
+
+func newTestBackend(t *testing.T) *Backend {
+	t.Helper()
+
+	backend, err := Open(context.Background(), SQLite, filepath.Join(t.TempDir(), "sessions.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, backend.Close()) })
+	return backend
+}
+
+func TestOpen(t *testing.T) {
+	_, err := Open(context.Background(), "oracle", "some-data-source")
+	require.EqualError(t, err, `unknown SQL dialect "oracle"`)
+
+	// Opening an existing database must keep its schema and its data.
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	backend, err := Open(context.Background(), SQLite, path)
+	require.NoError(t, err)
+	_, err = backend.Storage("seals", time.Now, time.Hour).Create(context.Background(), "sig", &testJSON{Data: "seal"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, backend.Close())
+
+	backend, err = Open(context.Background(), SQLite, path)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, backend.Close()) }()
+	out := &testJSON{}
+	_, err = backend.Storage("seals", time.Now, time.Hour).Get(context.Background(), "sig", out)
+	require.NoError(t, err)
+	require.Equal(t, "seal", out.Data)
+}
+
+func TestStorage(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	t.Run("create, get, update and delete", func(t *testing.T) {
+		storage := newTestBackend(t).Storage("seals", clock, time.Hour)
+
+		rv, err := storage.Create(ctx, "sig", &testJSON{Data: "seal-one"}, map[string]string{"some-label": "some-value"})
+		require.NoError(t, err)
+		require.Equal(t, "1", rv)
+
+		_, err = storage.Create(ctx, "sig", &testJSON{Data: "seal-two"}, nil)
+		require.True(t, apierrors.IsAlreadyExists(err), "wrong error: %v", err)
+
+		out := &testJSON{}
+		rv, err = storage.Get(ctx, "sig", out)
+		require.NoError(t, err)
+		require.Equal(t, "1", rv)
+		require.Equal(t, &testJSON{Data: "seal-one"}, out)
+
+		rv, err = storage.Update(ctx, "sig", "1", &testJSON{Data: "seal-three"}, map[string]string{"some-label": "other-value"})
+		require.NoError(t, err)
+		require.Equal(t, "2", rv)
+
+		_, err = storage.Update(ctx, "sig", "1", &testJSON{Data: "seal-four"}, nil)
+		require.True(t, apierrors.IsConflict(err), "wrong error: %v", err)
+
+		out = &testJSON{}
+		rv, err = storage.Get(ctx, "sig", out)
+		require.NoError(t, err)
+		require.Equal(t, "2", rv)
+		require.Equal(t, &testJSON{Data: "seal-three"}, out)
+
+		// The labels were replaced during the update.
+		_, err = storage.GetByLabel(ctx, "some-label", "some-value", &testJSON{})
+		require.True(t, errors.Is(err, crud.ErrNoSecretsMatchedLabel), "wrong error: %v", err)
+		_, err = storage.GetByLabel(ctx, "some-label", "other-value", &testJSON{})
+		require.NoError(t, err)
+
+		require.NoError(t, storage.Delete(ctx, "sig"))
+		err = storage.Delete(ctx, "sig")
+		require.True(t, apierrors.IsNotFound(err), "wrong error: %v", err)
+		_, err = storage.Get(ctx, "sig", &testJSON{})
+		require.True(t, apierrors.IsNotFound(err), "wrong error: %v", err)
+		_, err = storage.GetByLabel(ctx, "some-label", "other-value", &testJSON{})
+		require.True(t, errors.Is(err, crud.ErrNoSecretsMatchedLabel), "wrong error: %v", err)
+	})
+
+	t.Run("resource types do not see each other's data", func(t *testing.T) {
+		backend := newTestBackend(t)
+		seals := backend.Storage("seals", clock, time.Hour)
+		walruses := backend.Storage("walruses", clock, time.Hour)
+
+		_, err := seals.Create(ctx, "sig", &testJSON{Data: "seal"}, map[string]string{"some-label": "some-value"})
+		require.NoError(t, err)
+		_, err = walruses.Create(ctx, "sig", &testJSON{Data: "walrus"}, map[string]string{"some-label": "some-value"})
+		require.NoError(t, err)
+
+		out := &testJSON{}
+		_, err = walruses.Get(ctx, "sig", out)
+		require.NoError(t, err)
+		require.Equal(t, "walrus", out.Data)
+
+		list, err := seals.List(ctx, func() crud.JSON { return &testJSON{} })
+		require.NoError(t, err)
+		require.Equal(t, []crud.JSON{&testJSON{Data: "seal"}}, list)
+
+		require.NoError(t, seals.DeleteByLabel(ctx, "some-label", "some-value"))
+		_, err = walruses.GetByLabel(ctx, "some-label", "some-value", &testJSON{})
+		require.NoError(t, err)
+	})
+
+	t.Run("find data by label", func(t *testing.T) {
+		backend := newTestBackend(t)
+		createdAt := now
+		storage := backend.Storage("seals", func() time.Time { return createdAt }, time.Hour)
+
+		_, err := storage.Create(ctx, "sig-one", &testJSON{Data: "seal-one"}, map[string]string{"some-label": "matching-value"})
+		require.NoError(t, err)
+		createdAt = now.Add(time.Minute)
+		_, err = storage.Create(ctx, "sig-two", &testJSON{Data: "seal-two"}, map[string]string{"some-label": "matching-value"})
+		require.NoError(t, err)
+		_, err = storage.Create(ctx, "sig-three", &testJSON{Data: "seal-three"}, map[string]string{"some-label": "non-matching-value"})
+		require.NoError(t, err)
+		_, err = backend.db.ExecContext(ctx, `INSERT INTO pinniped_storage VALUES ('seals', 'sig-four', 1, 'not json', ?, ?)`,
+			now.Add(time.Hour).UnixNano(), now.Add(2*time.Hour).UnixNano())
+		require.NoError(t, err)
+		_, err = backend.db.ExecContext(ctx, `INSERT INTO pinniped_storage_labels VALUES ('seals', 'sig-four', 'some-label', 'matching-value')`)
+		require.NoError(t, err)
+
+		// The most recently created data wins.
+		out := &testJSON{}
+		_, err = storage.GetByLabel(ctx, "some-label", "matching-value", out)
+		require.EqualError(t, err, `error during get for label "some-label=matching-value": failed to decode seals: invalid character 'o' in literal null (expecting 'u')`)
+		_, err = backend.db.ExecContext(ctx, `UPDATE pinniped_storage SET created_at = 0 WHERE name = 'sig-four'`)
+		require.NoError(t, err)
+		_, err = storage.GetByLabel(ctx, "some-label", "matching-value", out)
+		require.NoError(t, err)
+		require.Equal(t, "seal-two", out.Data)
+
+		// Data which cannot be decoded is skipped.
+		list, err := storage.ListByLabel(ctx, "some-label", "matching-value", func() crud.JSON { return &testJSON{} })
+		require.NoError(t, err)
+		require.ElementsMatch(t, []crud.JSON{&testJSON{Data: "seal-one"}, &testJSON{Data: "seal-two"}}, list)
+
+		list, err = storage.ListByLabel(ctx, "some-label", "other-value", func() crud.JSON { return &testJSON{} })
+		require.NoError(t, err)
+		require.Empty(t, list)
+
+		require.NoError(t, storage.DeleteByLabel(ctx, "some-label", "matching-value"))
+		err = storage.DeleteByLabel(ctx, "some-label", "matching-value")
+		require.True(t, errors.Is(err, crud.ErrNoSecretsMatchedLabel), "wrong error: %v", err)
+
+		list, err = storage.List(ctx, func() crud.JSON { return &testJSON{} })
+		require.NoError(t, err)
+		require.Equal(t, []crud.JSON{&testJSON{Data: "seal-three"}}, list)
+	})
+
+	t.Run("garbage collection", func(t *testing.T) {
+		backend := newTestBackend(t)
+		shortLived := backend.Storage("seals", clock, time.Minute)
+		longLived := backend.Storage("walruses", clock, time.Hour)
+
+		_, err := shortLived.Create(ctx, "sig", &testJSON{Data: "seal"}, map[string]string{"some-label": "some-value"})
+		require.NoError(t, err)
+		_, err = longLived.Create(ctx, "sig", &testJSON{Data: "walrus"}, nil)
+		require.NoError(t, err)
+
+		records, err := backend.ListExpired(ctx, now.Add(time.Minute), 10)
+		require.NoError(t, err)
+		require.Empty(t, records)
+
+		records, err = backend.ListExpired(ctx, now.Add(2*time.Minute), 10)
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+		require.Equal(t, "seals", records[0].Resource)
+		require.Equal(t, "sig", records[0].Name)
+		require.Equal(t, "1", records[0].ResourceVersion)
+		require.Equal(t, now.Add(time.Minute), records[0].ExpiresAt)
+		out := &testJSON{}
+		require.NoError(t, records[0].Decode(out))
+		require.Equal(t, "seal", out.Data)
+
+		// Data which was updated after it was listed is not deleted.
+		_, err = shortLived.Update(ctx, "sig", "1", &testJSON{Data: "updated-seal"}, nil)
+		require.NoError(t, err)
+		err = backend.DeleteRecord(ctx, records[0])
+		require.True(t, apierrors.IsConflict(err), "wrong error: %v", err)
+
+		records, err = backend.ListExpired(ctx, now.Add(2*time.Hour), 10)
+		require.NoError(t, err)
+		require.Len(t, records, 2)
+		for _, record := range records {
+			require.NoError(t, backend.DeleteRecord(ctx, record))
+		}
+
+		list, err := shortLived.List(ctx, func() crud.JSON { return &testJSON{} })
+		require.NoError(t, err)
+		require.Empty(t, list)
+		var count int
+		require.NoError(t, backend.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM pinniped_storage_labels`).Scan(&count))
+		require.Zero(t, count)
+	})
+}
+
+func TestRebind(t *testing.T) {
+	query := `SELECT data FROM pinniped_storage WHERE resource = ? AND name = ?`
+	require.Equal(t, query, (&Backend{dialect: SQLite}).rebind(query))
+	require.Equal(t, `SELECT data FROM pinniped_storage WHERE resource = $1 AND name = $2`, (&Backend{dialect: Postgres}).rebind(query))
+}
@@ -0,0 +1,88 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package crud
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"go.pinniped.dev/internal/tracing"
+)
+
+const resourceKey = attribute.Key("pinniped.storage.resource")
+
+var _ Storage = &tracingStorage{}
+
+// tracingStorage starts a span for each operation of a Storage. The signatures are not recorded, since they are
+// derived from the tokens.
+type tracingStorage struct {
+	delegate Storage
+	resource string
+}
+
+func newTracingStorage(delegate Storage, resource string) Storage {
+	return &tracingStorage{delegate: delegate, resource: resource}
+}
+
+func (s *tracingStorage) start(ctx context.Context, operation string) (context.Context, trace.Span) {
+	return tracing.Start(ctx, "crud."+operation, resourceKey.String(s.resource))
+}
+
+func (s *tracingStorage) Create(ctx context.Context, signature string, data JSON, additionalLabels map[string]string) (string, error) {
+	ctx, span := s.start(ctx, "Create")
+	resourceVersion, err := s.delegate.Create(ctx, signature, data, additionalLabels)
+	tracing.End(span, err)
+	return resourceVersion, err
+}
+
+func (s *tracingStorage) Get(ctx context.Context, signature string, data JSON) (string, error) {
+	ctx, span := s.start(ctx, "Get")
+	resourceVersion, err := s.delegate.Get(ctx, signature, data)
+	tracing.End(span, err)
+	return resourceVersion, err
+}
+
+func (s *tracingStorage) Update(ctx context.Context, signature, resourceVersion string, data JSON, additionalLabels map[string]string) (string, error) {
+	ctx, span := s.start(ctx, "Update")
+	newResourceVersion, err := s.delegate.Update(ctx, signature, resourceVersion, data, additionalLabels)
+	tracing.End(span, err)
+	return newResourceVersion, err
+}
+
+func (s *tracingStorage) Delete(ctx context.Context, signature string) error {
+	ctx, span := s.start(ctx, "Delete")
+	err := s.delegate.Delete(ctx, signature)
+	tracing.End(span, err)
+	return err
+}
+
+func (s *tracingStorage) GetByLabel(ctx context.Context, labelName string, labelValue string, data JSON) (string, error) {
+	ctx, span := s.start(ctx, "GetByLabel")
+	resourceVersion, err := s.delegate.GetByLabel(ctx, labelName, labelValue, data)
+	tracing.End(span, err)
+	return resourceVersion, err
+}
+
+func (s *tracingStorage) DeleteByLabel(ctx context.Context, labelName string, labelValue string) error {
+	ctx, span := s.start(ctx, "DeleteByLabel")
+	err := s.delegate.DeleteByLabel(ctx, labelName, labelValue)
+	tracing.End(span, err)
+	return err
+}
+
+func (s *tracingStorage) ListByLabel(ctx context.Context, labelName string, labelValue string, newData func() JSON) ([]JSON, error) {
+	ctx, span := s.start(ctx, "ListByLabel")
+	list, err := s.delegate.ListByLabel(ctx, labelName, labelValue, newData)
+	tracing.End(span, err)
+	return list, err
+}
+
+func (s *tracingStorage) List(ctx context.Context, newData func() JSON) ([]JSON, error) {
+	ctx, span := s.start(ctx, "List")
+	list, err := s.delegate.List(ctx, newData)
+	tracing.End(span, err)
+	return list, err
+}
@@ -81,6 +81,12 @@ func (c *Cache) Get(key interface{}) *clientauthenticationv1beta1.ExecCredential
 }
 
 func (c *Cache) Put(key interface{}, cred *clientauthenticationv1beta1.ExecCredential) {
+	c.PutForIssuer(key, "", cred)
+}
+
+// PutForIssuer is like Put, but it also records the issuer of the OIDC session which the credential was issued for,
+// so that RemoveIssuer can remove the credential when the user logs out of that issuer.
+func (c *Cache) PutForIssuer(key interface{}, issuer string, cred *clientauthenticationv1beta1.ExecCredential) {
 	// Create the cache directory if it does not exist.
 	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil && !errors.Is(err, os.ErrExist) {
 		c.errReporter(fmt.Errorf("could not create credential cache directory: %w", err))
@@ -94,6 +100,7 @@ func (c *Cache) Put(key interface{}, cred *clientauthenticationv1beta1.ExecCrede
 		for i := range cache.Entries {
 			if cache.Entries[i].Key == cacheKey {
 				// Update the stored entry and return.
+				cache.Entries[i].Issuer = issuer
 				cache.Entries[i].Credential = cred.Status
 				cache.Entries[i].LastUsedTimestamp = metav1.Now()
 				return
@@ -104,6 +111,7 @@ func (c *Cache) Put(key interface{}, cred *clientauthenticationv1beta1.ExecCrede
 		now := metav1.Now()
 		cache.Entries = append(cache.Entries, entry{
 			Key:               cacheKey,
+			Issuer:            issuer,
 			CreationTimestamp: now,
 			LastUsedTimestamp: now,
 			Credential:        cred.Status,
@@ -111,6 +119,29 @@ func (c *Cache) Put(key interface{}, cred *clientauthenticationv1beta1.ExecCrede
 	})
 }
 
+// RemoveIssuer removes the credentials which were issued for the OIDC sessions of the given issuer, and returns how
+// many were removed. It does not return an error but may silently fail to update the cache.
+func (c *Cache) RemoveIssuer(issuer string) int {
+	// If the cache file does not exist, exit immediately with no error log
+	if _, err := os.Stat(c.path); errors.Is(err, os.ErrNotExist) {
+		return 0
+	}
+
+	removed := 0
+	c.withCache(func(cache *credCache) {
+		kept := make([]entry, 0, len(cache.Entries))
+		for _, e := range cache.Entries {
+			if e.Issuer == issuer {
+				removed++
+				continue
+			}
+			kept = append(kept, e)
+		}
+		cache.Entries = kept
+	})
+	return removed
+}
+
 func jsonSHA256Hex(key interface{}) string {
 	hash := sha256.New()
 	if err := json.NewEncoder(hash).Encode(key); err != nil {
@@ -351,6 +351,39 @@ func TestPutToken(t *testing.T) {
 	}
 }
 
+func TestPutForIssuerAndRemoveIssuer(t *testing.T) {
+	t.Parallel()
+	type testKey struct{ K1, K2 string }
+	cred := func(token string) *clientauthenticationv1beta1.ExecCredential {
+		return &clientauthenticationv1beta1.ExecCredential{
+			Status: &clientauthenticationv1beta1.ExecCredentialStatus{
+				ExpirationTimestamp: timePtr(time.Now().Add(1 * time.Hour)),
+				Token:               token,
+			},
+		}
+	}
+
+	tmp := testutil.TempDir(t) + "/cachedir/credentials.yaml"
+	errors := errorCollector{t: t}
+	c := New(tmp)
+	c.errReporter = errors.report
+
+	require.Zero(t, c.RemoveIssuer("test-issuer"))
+
+	c.PutForIssuer(testKey{K1: "v1"}, "test-issuer", cred("token-one"))
+	c.PutForIssuer(testKey{K1: "v2"}, "other-issuer", cred("token-two"))
+	c.PutForIssuer(testKey{K1: "v3"}, "test-issuer", cred("token-three"))
+	c.Put(testKey{K1: "v4"}, cred("token-four"))
+
+	require.Equal(t, 2, c.RemoveIssuer("test-issuer"))
+	require.Nil(t, c.Get(testKey{K1: "v1"}))
+	require.Nil(t, c.Get(testKey{K1: "v3"}))
+	require.Equal(t, "token-two", c.Get(testKey{K1: "v2"}).Status.Token)
+	require.Equal(t, "token-four", c.Get(testKey{K1: "v4"}).Status.Token)
+	require.Zero(t, c.RemoveIssuer("test-issuer"))
+	errors.require(nil)
+}
+
 func TestHashing(t *testing.T) {
 	type testKey struct{ K1, K2 string }
 	require.Equal(t, "38e0b9de817f645c4bec37c0d4a3e58baecccb040f5718dc069a72c7385a0bed", jsonSHA256Hex(nil))
@@ -1,10 +1,11 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package accesstoken
 
 import (
 	"context"
+	stderrors "errors"
 	"fmt"
 	"time"
 
@@ -12,7 +13,6 @@ import (
 	"github.com/ory/fosite/handler/oauth2"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
-	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 
 	"go.pinniped.dev/internal/constable"
 	"go.pinniped.dev/internal/crud"
@@ -35,6 +35,8 @@ const (
 type RevocationStorage interface {
 	oauth2.AccessTokenStorage
 	RevokeAccessToken(ctx context.Context, requestID string) error
+	GetAccessTokenSessionByRequestID(ctx context.Context, requestID string) (fosite.Requester, error)
+	ListAccessTokenSessions(ctx context.Context) ([]fosite.Requester, error)
 }
 
 var _ RevocationStorage = &accessTokenStorage{}
@@ -48,15 +50,19 @@ type Session struct {
 	Version string          `json:"version"`
 }
 
-func New(secrets corev1client.SecretInterface, clock func() time.Time, sessionStorageLifetime time.Duration) RevocationStorage {
-	return &accessTokenStorage{storage: crud.New(TypeLabelValue, secrets, clock, sessionStorageLifetime)}
+func New(backend crud.Backend, clock func() time.Time, sessionStorageLifetime time.Duration) RevocationStorage {
+	return &accessTokenStorage{storage: backend.Storage(TypeLabelValue, clock, sessionStorageLifetime)}
 }
 
-// ReadFromSecret reads the contents of a Secret as a Session.
+// ReadFromSecret reads the contents of an unencrypted Secret as a Session.
 func ReadFromSecret(secret *v1.Secret) (*Session, error) {
+	return Read(func(data crud.JSON) error { return crud.FromSecret(TypeLabelValue, secret, nil, data) })
+}
+
+// Read reads stored data of any storage backend as a Session. The decode function unmarshals the stored data.
+func Read(decode func(data crud.JSON) error) (*Session, error) {
 	session := newValidEmptyAccessTokenSession()
-	err := crud.FromSecret(TypeLabelValue, secret, session)
-	if err != nil {
+	if err := decode(session); err != nil {
 		return nil, err
 	}
 	if session.Version != accessTokenStorageVersion {
@@ -102,6 +108,50 @@ func (a *accessTokenStorage) DeleteAccessTokenSession(ctx context.Context, signa
 	return a.storage.Delete(ctx, signature)
 }
 
+// GetAccessTokenSessionByRequestID finds the access token session of the given request. When there is more than one,
+// then the most recently created session is returned.
+func (a *accessTokenStorage) GetAccessTokenSessionByRequestID(ctx context.Context, requestID string) (fosite.Requester, error) {
+	session := newValidEmptyAccessTokenSession()
+	_, err := a.storage.GetByLabel(ctx, fositestorage.StorageRequestIDLabelName, requestID, session)
+
+	if stderrors.Is(err, crud.ErrNoSecretsMatchedLabel) {
+		return nil, fosite.ErrNotFound.WithWrap(err).WithDebug(err.Error())
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get access token session for request %s: %w", requestID, err)
+	}
+
+	if version := session.Version; version != accessTokenStorageVersion {
+		return nil, fmt.Errorf("%w: access token session for request %s has version %s instead of %s",
+			ErrInvalidAccessTokenRequestVersion, requestID, version, accessTokenStorageVersion)
+	}
+
+	if session.Request.ID == "" {
+		return nil, fmt.Errorf("malformed access token session for request %s: %w", requestID, ErrInvalidAccessTokenRequestData)
+	}
+
+	return session.Request, nil
+}
+
+// ListAccessTokenSessions finds the access token sessions of all downstream sessions. Sessions which cannot be read,
+// e.g. because they were stored by an older version of Pinniped, are skipped.
+func (a *accessTokenStorage) ListAccessTokenSessions(ctx context.Context) ([]fosite.Requester, error) {
+	list, err := a.storage.List(ctx, func() crud.JSON { return newValidEmptyAccessTokenSession() })
+	if err != nil {
+		return nil, fmt.Errorf("failed to list access token sessions: %w", err)
+	}
+	requests := make([]fosite.Requester, 0, len(list))
+	for _, data := range list {
+		session := data.(*Session)
+		if session.Version != accessTokenStorageVersion || session.Request.ID == "" {
+			continue
+		}
+		requests = append(requests, session.Request)
+	}
+	return requests, nil
+}
+
 func (a *accessTokenStorage) getSession(ctx context.Context, signature string) (*Session, string, error) {
 	session := newValidEmptyAccessTokenSession()
 	rv, err := a.storage.Get(ctx, signature, session)
@@ -13,7 +13,6 @@ import (
 	"github.com/ory/fosite/handler/oauth2"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
-	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 
 	"go.pinniped.dev/internal/constable"
 	"go.pinniped.dev/internal/crud"
@@ -33,7 +32,12 @@ const (
 	authorizeCodeStorageVersion = "2"
 )
 
-var _ oauth2.AuthorizeCodeStorage = &authorizeCodeStorage{}
+type RevocationStorage interface {
+	oauth2.AuthorizeCodeStorage
+	RevokeAuthorizeCodeSession(ctx context.Context, requestID string) error
+}
+
+var _ RevocationStorage = &authorizeCodeStorage{}
 
 type authorizeCodeStorage struct {
 	storage crud.Storage
@@ -45,15 +49,19 @@ type Session struct {
 	Version string          `json:"version"`
 }
 
-func New(secrets corev1client.SecretInterface, clock func() time.Time, sessionStorageLifetime time.Duration) oauth2.AuthorizeCodeStorage {
-	return &authorizeCodeStorage{storage: crud.New(TypeLabelValue, secrets, clock, sessionStorageLifetime)}
+func New(backend crud.Backend, clock func() time.Time, sessionStorageLifetime time.Duration) RevocationStorage {
+	return &authorizeCodeStorage{storage: backend.Storage(TypeLabelValue, clock, sessionStorageLifetime)}
 }
 
-// ReadFromSecret reads the contents of a Secret as a Session.
+// ReadFromSecret reads the contents of an unencrypted Secret as a Session.
 func ReadFromSecret(secret *v1.Secret) (*Session, error) {
+	return Read(func(data crud.JSON) error { return crud.FromSecret(TypeLabelValue, secret, nil, data) })
+}
+
+// Read reads stored data of any storage backend as a Session. The decode function unmarshals the stored data.
+func Read(decode func(data crud.JSON) error) (*Session, error) {
 	session := NewValidEmptyAuthorizeCodeSession()
-	err := crud.FromSecret(TypeLabelValue, secret, session)
-	if err != nil {
+	if err := decode(session); err != nil {
 		return nil, err
 	}
 	if session.Version != authorizeCodeStorageVersion {
@@ -88,7 +96,12 @@ func (a *authorizeCodeStorage) CreateAuthorizeCodeSession(ctx context.Context, s
 	//      of the consent authorization request. It is used to identify the session.
 	//  signature for lookup in the DB
 
-	_, err = a.storage.Create(ctx, signature, &Session{Active: true, Request: request, Version: authorizeCodeStorageVersion}, nil)
+	_, err = a.storage.Create(
+		ctx,
+		signature,
+		&Session{Active: true, Request: request, Version: authorizeCodeStorageVersion},
+		requestIDLabels(request),
+	)
 	return err
 }
 
@@ -116,7 +129,7 @@ func (a *authorizeCodeStorage) InvalidateAuthorizeCodeSession(ctx context.Contex
 	}
 
 	session.Active = false
-	if _, err := a.storage.Update(ctx, signature, rv, session); err != nil {
+	if _, err := a.storage.Update(ctx, signature, rv, session, requestIDLabels(session.Request)); err != nil {
 		if errors.IsConflict(err) {
 			return &errSerializationFailureWithCause{cause: err}
 		}
@@ -126,6 +139,15 @@ func (a *authorizeCodeStorage) InvalidateAuthorizeCodeSession(ctx context.Contex
 	return nil
 }
 
+// RevokeAuthorizeCodeSession deletes the authorization code session of the given authorize request.
+func (a *authorizeCodeStorage) RevokeAuthorizeCodeSession(ctx context.Context, requestID string) error {
+	return a.storage.DeleteByLabel(ctx, fositestorage.StorageRequestIDLabelName, requestID)
+}
+
+func requestIDLabels(request *fosite.Request) map[string]string {
+	return map[string]string{fositestorage.StorageRequestIDLabelName: request.GetID()}
+}
+
 func (a *authorizeCodeStorage) getSession(ctx context.Context, signature string) (*Session, string, error) {
 	session := NewValidEmptyAuthorizeCodeSession()
 	rv, err := a.storage.Get(ctx, signature, session)
@@ -373,37 +395,59 @@ const ExpectedAuthorizeCodeSessionJSONFromFuzzing = `{
 					"掘ʃƸ澺淗a紽ǒ|鰽ŋ猊",
 					"毇妬\u003e6鉢緋uƴŤȱʀļÂ?"
 				],
+				"upstreamUsername": "27就伒犘c钡ɏȫ",
+				"upstreamGroups": [
+					"R蜚蠣麹概÷驣7Ʀ澉1æɽ誮",
+					"ʫ繕ȫ",
+					"ŚB碠k9"
+				],
+				"loginTime": "2008-10-11T09:03:39.213799988Z",
+				"lastRefreshTime": "2064-09-18T18:12:18.985977048Z",
+				"federationDomainIssuer": "ůď逳",
 				"oidc": {
-					"upstreamRefreshToken": "\u003cƬb",
-					"upstreamAccessToken": "犘c钡ɏȫ",
-					"upstreamSubject": "鬌",
-					"upstreamIssuer": "%OpKȱ藚ɏ¬Ê蒭堜"
+					"upstreamRefreshToken": "?3)藵睋邔\u0026Ű惫蜀",
+					"upstreamAccessToken": "É4İ\u003e×1飞O+î艔",
+					"upstreamSubject": "s",
+					"upstreamIssuer": "OƉ",
+					"upstreamIDToken": "%Ä摱ìÓȐĨf跞@)¿,ɭS隑i",
+					"passthroughClaims": {
+						"Ǘ艱iYn面@yȝƋ鬯犦獢9c5¤": 2166276558,
+						"岵骘胲ƤkǦ闧鸖I¶媁y衑拁Ȃ縅": {
+							"Vƅȭǝ*擦28ǅ ": [
+								3829273251
+							],
+							"ã置bņ抰蛖": {
+								"\u0026錝D肁Ŷɽ蔒PR}Ųʓ": null,
+								"y_º$": {
+									"轘屔挝ʌ鼂.诼消P姧": false
+								}
+							}
+						}
+					}
 				},
 				"ldap": {
-					"userDN": "ȗ韚ʫ繕ȫ碰+",
+					"userDN": "_¸]fś酷ɂ/沴Ȃ僒鬎鉌X縆跣Šɞ",
 					"extraRefreshAttributes": {
-						"+î艔垎0": "ĝ",
-						"4İ": "墀jMʥ",
-						"k9帴": "磊ůď逳鞪?3)藵睋邔\u0026Ű惫蜀Ģ"
+						"鳛Nč乿Ɣ": "õC嶃"
 					}
 				},
 				"activedirectory": {
-					"userDN": "%Ä摱ìÓȐĨf跞@)¿,ɭS隑i",
+					"userDN": "Ɯ/気ū齢q萮左/",
 					"extraRefreshAttributes": {
-						" 皦pSǬŝ社Vƅȭǝ*擦28ǅ": "vư",
-						"艱iYn面@yȝƋ鬯犦獢9c5¤.岵": "浛a齙\\蹼偦歛"
+						"2\\袓,5JƊ津x荃墎]a": "ň",
+						"¡XôĖ": "ŉ0緃責cpbɋ抿*泡hUɨ"
 					}
 				}
 			}
 		},
 		"requestedAudience": [
-			"置b",
-			"筫MN\u0026錝D肁Ŷɽ蔒PR}Ųʓl{"
+			"ű鹠NƤ鷒絓ǳ舼Y[ɲȝ",
+			"ŔfȀ"
 		],
 		"grantedAudience": [
-			"jÃ轘屔挝",
-			"Œų崓ļ憽-蹐È_¸]fś",
-			"ɵʮGɃɫ囤1+,Ȳ"
+			"+橇肅a",
+			"ŷ2葕",
+			"}% B駚ǛSĘ驧ml婆Ĵ"
 		]
 	},
 	"version": "2"
@@ -0,0 +1,179 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicecode
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"time"
+
+	"github.com/ory/fosite"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+
+	"go.pinniped.dev/internal/constable"
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/fositestorage"
+	"go.pinniped.dev/internal/oidc/clientregistry"
+	"go.pinniped.dev/internal/psession"
+)
+
+const (
+	TypeLabelValue = "device-code"
+
+	// UserCodeLabelName is the label which allows a device code session to be found by its user code.
+	UserCodeLabelName = "storage.pinniped.dev/device-user-code"
+
+	ErrInvalidDeviceCodeRequestVersion = constable.Error("device code request data has wrong version")
+	ErrInvalidDeviceCodeRequestData    = constable.Error("device code request data must be present")
+
+	// Version 1 was the initial release of storage.
+	deviceCodeStorageVersion = "1"
+)
+
+// Status is the progress of the user's login for a device code session.
+type Status string
+
+const (
+	// StatusPending means that the user has not yet finished logging in.
+	StatusPending Status = "pending"
+	// StatusApproved means that the user has logged in, and that the session of the request holds their identity.
+	StatusApproved Status = "approved"
+)
+
+type Storage interface {
+	CreateDeviceCodeSession(ctx context.Context, session *Session) error
+	GetDeviceCodeSession(ctx context.Context, signature string) (*Session, string, error)
+	GetDeviceCodeSessionByUserCode(ctx context.Context, userCode string) (*Session, string, error)
+	UpdateDeviceCodeSession(ctx context.Context, session *Session, resourceVersion string) error
+	DeleteDeviceCodeSession(ctx context.Context, signature string) error
+}
+
+var _ Storage = &deviceCodeStorage{}
+
+type deviceCodeStorage struct {
+	storage crud.Storage
+}
+
+// Session is a pending or approved device authorization request. It is keyed by the signature of the device code,
+// and can also be found by its user code.
+type Session struct {
+	Request      *fosite.Request `json:"request"`
+	Signature    string          `json:"signature"`
+	UserCode     string          `json:"userCode"`
+	Status       Status          `json:"status"`
+	ExpiresAt    time.Time       `json:"expiresAt"`
+	LastPolledAt time.Time       `json:"lastPolledAt"`
+	Version      string          `json:"version"`
+
+	// ApprovalToken is set when the user confirms the user code on the device verification page. The same value is
+	// given to their browser in the device approval cookie, and the session can only be approved by that browser.
+	ApprovalToken string `json:"approvalToken,omitempty"`
+}
+
+func New(backend crud.Backend, clock func() time.Time, sessionStorageLifetime time.Duration) Storage {
+	return &deviceCodeStorage{storage: backend.Storage(TypeLabelValue, clock, sessionStorageLifetime)}
+}
+
+// ReadFromSecret reads the contents of an unencrypted Secret as a Session.
+func ReadFromSecret(secret *v1.Secret) (*Session, error) {
+	return Read(func(data crud.JSON) error { return crud.FromSecret(TypeLabelValue, secret, nil, data) })
+}
+
+// Read reads stored data of any storage backend as a Session. The decode function unmarshals the stored data.
+func Read(decode func(data crud.JSON) error) (*Session, error) {
+	session := newValidEmptyDeviceCodeSession()
+	if err := decode(session); err != nil {
+		return nil, err
+	}
+	if err := validateSession(session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (d *deviceCodeStorage) CreateDeviceCodeSession(ctx context.Context, session *Session) error {
+	if _, err := fositestorage.ValidateAndExtractAuthorizeRequest(session.Request); err != nil {
+		return err
+	}
+	session.Version = deviceCodeStorageVersion
+	_, err := d.storage.Create(ctx, session.Signature, session, labels(session))
+	return err
+}
+
+// GetDeviceCodeSession returns the session and its resource version, which must be passed to
+// UpdateDeviceCodeSession to update the session.
+func (d *deviceCodeStorage) GetDeviceCodeSession(ctx context.Context, signature string) (*Session, string, error) {
+	session := newValidEmptyDeviceCodeSession()
+	rv, err := d.storage.Get(ctx, signature, session)
+	if errors.IsNotFound(err) {
+		return nil, "", fosite.ErrNotFound.WithWrap(err).WithDebug(err.Error())
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get device code session for %s: %w", signature, err)
+	}
+	if err := validateSession(session); err != nil {
+		return nil, "", err
+	}
+	return session, rv, nil
+}
+
+// GetDeviceCodeSessionByUserCode is like GetDeviceCodeSession, but finds the session using the code which the user
+// typed into the verification page.
+func (d *deviceCodeStorage) GetDeviceCodeSessionByUserCode(ctx context.Context, userCode string) (*Session, string, error) {
+	session := newValidEmptyDeviceCodeSession()
+	rv, err := d.storage.GetByLabel(ctx, UserCodeLabelName, userCode, session)
+	if stderrors.Is(err, crud.ErrNoSecretsMatchedLabel) {
+		return nil, "", fosite.ErrNotFound.WithWrap(err).WithDebug(err.Error())
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get device code session for user code %s: %w", userCode, err)
+	}
+	if err := validateSession(session); err != nil {
+		return nil, "", err
+	}
+	return session, rv, nil
+}
+
+// UpdateDeviceCodeSession updates the session, failing with a conflict error when the session was updated by
+// someone else since it was read at the given resource version.
+func (d *deviceCodeStorage) UpdateDeviceCodeSession(ctx context.Context, session *Session, resourceVersion string) error {
+	if _, err := fositestorage.ValidateAndExtractAuthorizeRequest(session.Request); err != nil {
+		return err
+	}
+	_, err := d.storage.Update(ctx, session.Signature, resourceVersion, session, labels(session))
+	return err
+}
+
+func (d *deviceCodeStorage) DeleteDeviceCodeSession(ctx context.Context, signature string) error {
+	return d.storage.Delete(ctx, signature)
+}
+
+func labels(session *Session) map[string]string {
+	return map[string]string{
+		fositestorage.StorageRequestIDLabelName: session.Request.GetID(),
+		UserCodeLabelName:                       session.UserCode,
+	}
+}
+
+func validateSession(session *Session) error {
+	if version := session.Version; version != deviceCodeStorageVersion {
+		return fmt.Errorf("%w: device code session has version %s instead of %s",
+			ErrInvalidDeviceCodeRequestVersion, version, deviceCodeStorageVersion)
+	}
+	if session.Request.ID == "" || session.Signature == "" || session.UserCode == "" {
+		return fmt.Errorf("malformed device code session: %w", ErrInvalidDeviceCodeRequestData)
+	}
+	return nil
+}
+
+func newValidEmptyDeviceCodeSession() *Session {
+	return &Session{
+		Request: &fosite.Request{
+			Client:  &clientregistry.Client{},
+			Session: &psession.PinnipedSession{},
+		},
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicecode
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/oidc/clientregistry"
+	"go.pinniped.dev/internal/psession"
+	"go.pinniped.dev/internal/testutil"
+)
+
+const namespace = "test-ns"
+
+var fakeNow = time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+var lifetime = time.Minute * 11
+var fakeNowPlusLifetimeAsString = metav1.Time{Time: fakeNow.Add(lifetime)}.Format(time.RFC3339)
+
+func TestDeviceCodeStorage(t *testing.T) {
+	ctx, client, secrets, storage := makeTestSubject()
+
+	session := &Session{
+		Request: &fosite.Request{
+			ID: "abcd-1",
+			Client: &clientregistry.Client{
+				DefaultOpenIDConnectClient: fosite.DefaultOpenIDConnectClient{
+					DefaultClient: &fosite.DefaultClient{ID: "pinny", Public: true},
+				},
+			},
+			RequestedScope: fosite.Arguments{"openid"},
+			Form:           url.Values{"key": []string{"val"}},
+			Session:        testutil.NewFakePinnipedSession(),
+		},
+		Signature: "fancy-signature",
+		UserCode:  "BCDF-GHJK",
+		Status:    StatusPending,
+		ExpiresAt: fakeNow.Add(10 * time.Minute),
+	}
+	require.NoError(t, storage.CreateDeviceCodeSession(ctx, session))
+
+	secret, err := secrets.Get(ctx, "pinniped-storage-device-code-pwu5zs7lekbhnln2w4", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, corev1.SecretType("storage.pinniped.dev/device-code"), secret.Type)
+	require.Equal(t, map[string]string{
+		"storage.pinniped.dev/type":             "device-code",
+		"storage.pinniped.dev/request-id":       "abcd-1",
+		"storage.pinniped.dev/device-user-code": "BCDF-GHJK",
+	}, secret.Labels)
+	require.Equal(t, fakeNowPlusLifetimeAsString, secret.Annotations["storage.pinniped.dev/garbage-collect-after"])
+	testutil.LogActualJSONFromCreateAction(t, client, 0) // makes it easier to update expected values when needed
+
+	fromSecret, err := ReadFromSecret(secret)
+	require.NoError(t, err)
+	require.Equal(t, session, fromSecret)
+
+	gotSession, rv, err := storage.GetDeviceCodeSession(ctx, "fancy-signature")
+	require.NoError(t, err)
+	require.Equal(t, session, gotSession)
+
+	gotSession, rvByUserCode, err := storage.GetDeviceCodeSessionByUserCode(ctx, "BCDF-GHJK")
+	require.NoError(t, err)
+	require.Equal(t, session, gotSession)
+	require.Equal(t, rv, rvByUserCode)
+
+	gotSession.Status = StatusApproved
+	gotSession.LastPolledAt = fakeNow.Add(time.Minute)
+	require.NoError(t, storage.UpdateDeviceCodeSession(ctx, gotSession, rv))
+
+	updatedSession, _, err := storage.GetDeviceCodeSession(ctx, "fancy-signature")
+	require.NoError(t, err)
+	require.Equal(t, StatusApproved, updatedSession.Status)
+	require.Equal(t, fakeNow.Add(time.Minute), updatedSession.LastPolledAt)
+
+	require.NoError(t, storage.DeleteDeviceCodeSession(ctx, "fancy-signature"))
+	_, _, err = storage.GetDeviceCodeSession(ctx, "fancy-signature")
+	require.True(t, errors.Is(err, fosite.ErrNotFound))
+}
+
+func TestGetNotFound(t *testing.T) {
+	ctx, _, _, storage := makeTestSubject()
+
+	_, _, notFoundErr := storage.GetDeviceCodeSession(ctx, "non-existent-signature")
+	require.EqualError(t, notFoundErr, "not_found")
+	require.True(t, errors.Is(notFoundErr, fosite.ErrNotFound))
+
+	_, _, notFoundErr = storage.GetDeviceCodeSessionByUserCode(ctx, "NONE-XIST")
+	require.EqualError(t, notFoundErr, "not_found")
+	require.True(t, errors.Is(notFoundErr, fosite.ErrNotFound))
+}
+
+func TestWrongVersion(t *testing.T) {
+	ctx, _, secrets, storage := makeTestSubject()
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "pinniped-storage-device-code-pwu5zs7lekbhnln2w4",
+			Labels: map[string]string{
+				"storage.pinniped.dev/type": "device-code",
+			},
+		},
+		Data: map[string][]byte{
+			"pinniped-storage-data":    []byte(`{"request":{"id":"abcd-1"},"signature":"fancy-signature","userCode":"BCDF-GHJK","version":"not-the-right-version"}`),
+			"pinniped-storage-version": []byte("1"),
+		},
+		Type: "storage.pinniped.dev/device-code",
+	}
+	_, err := secrets.Create(ctx, secret, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	_, _, err = storage.GetDeviceCodeSession(ctx, "fancy-signature")
+	require.EqualError(t, err, "device code request data has wrong version: device code session has version not-the-right-version instead of 1")
+}
+
+func TestMalformedSession(t *testing.T) {
+	ctx, _, secrets, storage := makeTestSubject()
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "pinniped-storage-device-code-pwu5zs7lekbhnln2w4",
+			Labels: map[string]string{
+				"storage.pinniped.dev/type": "device-code",
+			},
+		},
+		Data: map[string][]byte{
+			"pinniped-storage-data":    []byte(`{"nonsense-key": "nonsense-value","version":"1"}`),
+			"pinniped-storage-version": []byte("1"),
+		},
+		Type: "storage.pinniped.dev/device-code",
+	}
+	_, err := secrets.Create(ctx, secret, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	_, _, err = storage.GetDeviceCodeSession(ctx, "fancy-signature")
+	require.EqualError(t, err, "malformed device code session: device code request data must be present")
+}
+
+func TestCreateWithWrongRequesterDataTypes(t *testing.T) {
+	ctx, _, _, storage := makeTestSubject()
+
+	err := storage.CreateDeviceCodeSession(ctx, &Session{
+		Request:   &fosite.Request{Session: nil, Client: &clientregistry.Client{}},
+		Signature: "signature-doesnt-matter",
+	})
+	require.EqualError(t, err, "requester's session must be of type PinnipedSession")
+
+	err = storage.CreateDeviceCodeSession(ctx, &Session{
+		Request:   &fosite.Request{Session: &psession.PinnipedSession{}, Client: nil},
+		Signature: "signature-doesnt-matter",
+	})
+	require.EqualError(t, err, "requester's client must be of type clientregistry.Client")
+}
+
+func makeTestSubject() (context.Context, *fake.Clientset, corev1client.SecretInterface, Storage) {
+	client := fake.NewSimpleClientset()
+	secrets := client.CoreV1().Secrets(namespace)
+	return context.Background(), client, secrets, New(crud.NewSecretsBackend(secrets), clocktesting.NewFakeClock(fakeNow).Now, lifetime)
+}
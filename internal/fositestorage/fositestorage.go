@@ -1,9 +1,13 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package fositestorage
 
 import (
+	"crypto/sha256"
+	"encoding/base32"
+	"strings"
+
 	"github.com/ory/fosite"
 
 	"go.pinniped.dev/internal/constable"
@@ -16,8 +20,17 @@ const (
 	ErrInvalidClientType      = constable.Error("requester's client must be of type clientregistry.Client")
 	ErrInvalidSessionType     = constable.Error("requester's session must be of type PinnipedSession")
 	StorageRequestIDLabelName = "storage.pinniped.dev/request-id" //nolint:gosec // this is not a credential
+	StorageSubjectLabelName   = "storage.pinniped.dev/subject"    //nolint:gosec // this is not a credential
 )
 
+// SubjectLabelValue returns the value of the StorageSubjectLabelName label for the given downstream subject.
+// Subjects are URLs which are often too long or contain characters which are not allowed in label values,
+// so the label value is a hash of the subject instead.
+func SubjectLabelValue(subject string) string {
+	hash := sha256.Sum256([]byte(subject))
+	return strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(hash[:]))
+}
+
 func ValidateAndExtractAuthorizeRequest(requester fosite.Requester) (*fosite.Request, error) {
 	request, ok1 := requester.(*fosite.Request)
 	if !ok1 {
@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package openidconnect
@@ -12,7 +12,6 @@ import (
 	"github.com/ory/fosite"
 	"github.com/ory/fosite/handler/openid"
 	"k8s.io/apimachinery/pkg/api/errors"
-	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 
 	"go.pinniped.dev/internal/constable"
 	"go.pinniped.dev/internal/crud"
@@ -33,7 +32,12 @@ const (
 	oidcStorageVersion = "2"
 )
 
-var _ openid.OpenIDConnectRequestStorage = &openIDConnectRequestStorage{}
+type RevocationStorage interface {
+	openid.OpenIDConnectRequestStorage
+	RevokeOpenIDConnectSession(ctx context.Context, requestID string) error
+}
+
+var _ RevocationStorage = &openIDConnectRequestStorage{}
 
 type openIDConnectRequestStorage struct {
 	storage crud.Storage
@@ -44,8 +48,8 @@ type session struct {
 	Version string          `json:"version"`
 }
 
-func New(secrets corev1client.SecretInterface, clock func() time.Time, sessionStorageLifetime time.Duration) openid.OpenIDConnectRequestStorage {
-	return &openIDConnectRequestStorage{storage: crud.New(TypeLabelValue, secrets, clock, sessionStorageLifetime)}
+func New(backend crud.Backend, clock func() time.Time, sessionStorageLifetime time.Duration) RevocationStorage {
+	return &openIDConnectRequestStorage{storage: backend.Storage(TypeLabelValue, clock, sessionStorageLifetime)}
 }
 
 func (a *openIDConnectRequestStorage) CreateOpenIDConnectSession(ctx context.Context, authcode string, requester fosite.Requester) error {
@@ -59,7 +63,12 @@ func (a *openIDConnectRequestStorage) CreateOpenIDConnectSession(ctx context.Con
 		return err
 	}
 
-	_, err = a.storage.Create(ctx, signature, &session{Request: request, Version: oidcStorageVersion}, nil)
+	_, err = a.storage.Create(
+		ctx,
+		signature,
+		&session{Request: request, Version: oidcStorageVersion},
+		map[string]string{fositestorage.StorageRequestIDLabelName: requester.GetID()},
+	)
 	return err
 }
 
@@ -87,6 +96,11 @@ func (a *openIDConnectRequestStorage) DeleteOpenIDConnectSession(ctx context.Con
 	return a.storage.Delete(ctx, signature)
 }
 
+// RevokeOpenIDConnectSession deletes the OIDC session of the given authorize request.
+func (a *openIDConnectRequestStorage) RevokeOpenIDConnectSession(ctx context.Context, requestID string) error {
+	return a.storage.DeleteByLabel(ctx, fositestorage.StorageRequestIDLabelName, requestID)
+}
+
 func (a *openIDConnectRequestStorage) getSession(ctx context.Context, signature string) (*session, string, error) {
 	session := newValidEmptyOIDCSession()
 	rv, err := a.storage.Get(ctx, signature, session)
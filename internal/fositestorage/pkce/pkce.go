@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package pkce
@@ -11,7 +11,6 @@ import (
 	"github.com/ory/fosite"
 	"github.com/ory/fosite/handler/pkce"
 	"k8s.io/apimachinery/pkg/api/errors"
-	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 
 	"go.pinniped.dev/internal/constable"
 	"go.pinniped.dev/internal/crud"
@@ -31,7 +30,12 @@ const (
 	pkceStorageVersion = "2"
 )
 
-var _ pkce.PKCERequestStorage = &pkceStorage{}
+type RevocationStorage interface {
+	pkce.PKCERequestStorage
+	RevokePKCERequestSession(ctx context.Context, requestID string) error
+}
+
+var _ RevocationStorage = &pkceStorage{}
 
 type pkceStorage struct {
 	storage crud.Storage
@@ -42,8 +46,8 @@ type session struct {
 	Version string          `json:"version"`
 }
 
-func New(secrets corev1client.SecretInterface, clock func() time.Time, sessionStorageLifetime time.Duration) pkce.PKCERequestStorage {
-	return &pkceStorage{storage: crud.New(TypeLabelValue, secrets, clock, sessionStorageLifetime)}
+func New(backend crud.Backend, clock func() time.Time, sessionStorageLifetime time.Duration) RevocationStorage {
+	return &pkceStorage{storage: backend.Storage(TypeLabelValue, clock, sessionStorageLifetime)}
 }
 
 func (a *pkceStorage) CreatePKCERequestSession(ctx context.Context, signature string, requester fosite.Requester) error {
@@ -52,7 +56,12 @@ func (a *pkceStorage) CreatePKCERequestSession(ctx context.Context, signature st
 		return err
 	}
 
-	_, err = a.storage.Create(ctx, signature, &session{Request: request, Version: pkceStorageVersion}, nil)
+	_, err = a.storage.Create(
+		ctx,
+		signature,
+		&session{Request: request, Version: pkceStorageVersion},
+		map[string]string{fositestorage.StorageRequestIDLabelName: requester.GetID()},
+	)
 	return err
 }
 
@@ -70,6 +79,11 @@ func (a *pkceStorage) DeletePKCERequestSession(ctx context.Context, signature st
 	return a.storage.Delete(ctx, signature)
 }
 
+// RevokePKCERequestSession deletes the PKCE session of the given authorize request.
+func (a *pkceStorage) RevokePKCERequestSession(ctx context.Context, requestID string) error {
+	return a.storage.DeleteByLabel(ctx, fositestorage.StorageRequestIDLabelName, requestID)
+}
+
 func (a *pkceStorage) getSession(ctx context.Context, signature string) (*session, string, error) {
 	session := newValidEmptyPKCESession()
 	rv, err := a.storage.Get(ctx, signature, session)
@@ -5,6 +5,7 @@ package refreshtoken
 
 import (
 	"context"
+	stderrors "errors"
 	"fmt"
 	"time"
 
@@ -12,7 +13,6 @@ import (
 	"github.com/ory/fosite/handler/oauth2"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
-	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 
 	"go.pinniped.dev/internal/constable"
 	"go.pinniped.dev/internal/crud"
@@ -35,7 +35,10 @@ const (
 type RevocationStorage interface {
 	oauth2.RefreshTokenStorage
 	RevokeRefreshToken(ctx context.Context, requestID string) error
+	GetRefreshTokenSessionByRequestID(ctx context.Context, requestID string) (fosite.Requester, error)
 	RevokeRefreshTokenMaybeGracePeriod(ctx context.Context, requestID string, signature string) error
+	ListRefreshTokenSessionsBySubject(ctx context.Context, subject string) ([]fosite.Requester, error)
+	ListRefreshTokenSessions(ctx context.Context) ([]fosite.Requester, error)
 }
 
 var _ RevocationStorage = &refreshTokenStorage{}
@@ -49,25 +52,36 @@ type Session struct {
 	Version string          `json:"version"`
 }
 
-func New(secrets corev1client.SecretInterface, clock func() time.Time, sessionStorageLifetime time.Duration) RevocationStorage {
-	return &refreshTokenStorage{storage: crud.New(TypeLabelValue, secrets, clock, sessionStorageLifetime)}
+func New(backend crud.Backend, clock func() time.Time, sessionStorageLifetime time.Duration) RevocationStorage {
+	return &refreshTokenStorage{storage: backend.Storage(TypeLabelValue, clock, sessionStorageLifetime)}
 }
 
-// ReadFromSecret reads the contents of a Secret as a Session.
+// ReadFromSecret reads the contents of an unencrypted Secret as a Session.
 func ReadFromSecret(secret *v1.Secret) (*Session, error) {
+	return Read(func(data crud.JSON) error { return crud.FromSecret(TypeLabelValue, secret, nil, data) })
+}
+
+// Read reads stored data of any storage backend as a Session. The decode function unmarshals the stored data.
+func Read(decode func(data crud.JSON) error) (*Session, error) {
 	session := newValidEmptyRefreshTokenSession()
-	err := crud.FromSecret(TypeLabelValue, secret, session)
-	if err != nil {
+	if err := decode(session); err != nil {
 		return nil, err
 	}
+	if err := validateSession(session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func validateSession(session *Session) error {
 	if session.Version != refreshTokenStorageVersion {
-		return nil, fmt.Errorf("%w: refresh token session has version %s instead of %s",
+		return fmt.Errorf("%w: refresh token session has version %s instead of %s",
 			ErrInvalidRefreshTokenRequestVersion, session.Version, refreshTokenStorageVersion)
 	}
 	if session.Request.ID == "" {
-		return nil, fmt.Errorf("malformed refresh token session: %w", ErrInvalidRefreshTokenRequestData)
+		return fmt.Errorf("malformed refresh token session: %w", ErrInvalidRefreshTokenRequestData)
 	}
-	return session, nil
+	return nil
 }
 
 func (a *refreshTokenStorage) RevokeRefreshToken(ctx context.Context, requestID string) error {
@@ -85,11 +99,17 @@ func (a *refreshTokenStorage) CreateRefreshTokenSession(ctx context.Context, sig
 		return err
 	}
 
+	labels := map[string]string{fositestorage.StorageRequestIDLabelName: requester.GetID()}
+	// Index the session by its downstream subject, so all the sessions of a user can be found.
+	if subject := downstreamSubject(request.Session.(*psession.PinnipedSession)); subject != "" {
+		labels[fositestorage.StorageSubjectLabelName] = fositestorage.SubjectLabelValue(subject)
+	}
+
 	_, err = a.storage.Create(
 		ctx,
 		signature,
 		&Session{Request: request, Version: refreshTokenStorageVersion},
-		map[string]string{fositestorage.StorageRequestIDLabelName: requester.GetID()},
+		labels,
 	)
 	return err
 }
@@ -108,6 +128,69 @@ func (a *refreshTokenStorage) DeleteRefreshTokenSession(ctx context.Context, sig
 	return a.storage.Delete(ctx, signature)
 }
 
+// GetRefreshTokenSessionByRequestID finds the refresh token session of the given request. When there is more than one,
+// then the most recently created session is returned.
+func (a *refreshTokenStorage) GetRefreshTokenSessionByRequestID(ctx context.Context, requestID string) (fosite.Requester, error) {
+	session := newValidEmptyRefreshTokenSession()
+	_, err := a.storage.GetByLabel(ctx, fositestorage.StorageRequestIDLabelName, requestID, session)
+
+	if stderrors.Is(err, crud.ErrNoSecretsMatchedLabel) {
+		return nil, fosite.ErrNotFound.WithWrap(err).WithDebug(err.Error())
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get refresh token session for request %s: %w", requestID, err)
+	}
+
+	if version := session.Version; version != refreshTokenStorageVersion {
+		return nil, fmt.Errorf("%w: refresh token session for request %s has version %s instead of %s",
+			ErrInvalidRefreshTokenRequestVersion, requestID, version, refreshTokenStorageVersion)
+	}
+
+	if session.Request.ID == "" {
+		return nil, fmt.Errorf("malformed refresh token session for request %s: %w", requestID, ErrInvalidRefreshTokenRequestData)
+	}
+
+	return session.Request, nil
+}
+
+// ListRefreshTokenSessionsBySubject finds the refresh token sessions of all the downstream sessions of the given
+// downstream subject. Sessions which cannot be read, e.g. because they were stored by an older version of Pinniped,
+// are skipped.
+func (a *refreshTokenStorage) ListRefreshTokenSessionsBySubject(ctx context.Context, subject string) ([]fosite.Requester, error) {
+	list, err := a.storage.ListByLabel(ctx, fositestorage.StorageSubjectLabelName, fositestorage.SubjectLabelValue(subject), newData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list refresh token sessions by subject: %w", err)
+	}
+	return validRequests(list), nil
+}
+
+// ListRefreshTokenSessions is similar to ListRefreshTokenSessionsBySubject, but finds the refresh token sessions of
+// all downstream sessions.
+func (a *refreshTokenStorage) ListRefreshTokenSessions(ctx context.Context) ([]fosite.Requester, error) {
+	list, err := a.storage.List(ctx, newData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list refresh token sessions: %w", err)
+	}
+	return validRequests(list), nil
+}
+
+func newData() crud.JSON {
+	return newValidEmptyRefreshTokenSession()
+}
+
+func validRequests(list []crud.JSON) []fosite.Requester {
+	requests := make([]fosite.Requester, 0, len(list))
+	for _, data := range list {
+		session := data.(*Session)
+		if validateSession(session) != nil {
+			continue
+		}
+		requests = append(requests, session.Request)
+	}
+	return requests
+}
+
 func (a *refreshTokenStorage) getSession(ctx context.Context, signature string) (*Session, string, error) {
 	session := newValidEmptyRefreshTokenSession()
 	rv, err := a.storage.Get(ctx, signature, session)
@@ -132,6 +215,15 @@ func (a *refreshTokenStorage) getSession(ctx context.Context, signature string)
 	return session, rv, nil
 }
 
+// downstreamSubject returns the downstream subject of the session, or an empty string when the session has none.
+// Note that calling IDTokenClaims() would initialize the claims of the session as a side effect.
+func downstreamSubject(session *psession.PinnipedSession) string {
+	if session.Fosite == nil || session.Fosite.Claims == nil {
+		return ""
+	}
+	return session.Fosite.Claims.Subject
+}
+
 func newValidEmptyRefreshTokenSession() *Session {
 	return &Session{
 		Request: &fosite.Request{
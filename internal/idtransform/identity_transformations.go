@@ -0,0 +1,254 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package idtransform contains the identity transformations and policies which may be applied to the username
+// and groups of an upstream identity before a downstream identity is issued by a FederationDomain.
+package idtransform
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"go.pinniped.dev/internal/reservednames"
+)
+
+// DefaultRejectedAuthenticationMessage is used when a policy rejects a user but does not configure its own message.
+const DefaultRejectedAuthenticationMessage = "authentication was rejected by a configured policy"
+
+// TransformationResult is the result of evaluating a transformation or a pipeline of transformations.
+type TransformationResult struct {
+	Username string
+	Groups   []string
+
+	// AuthenticationAllowed is false when a policy rejected the user, in which case
+	// RejectedAuthenticationMessage explains why.
+	AuthenticationAllowed         bool
+	RejectedAuthenticationMessage string
+}
+
+// IdentityTransformation is a single step in a TransformationPipeline.
+type IdentityTransformation interface {
+	Evaluate(username string, groups []string) (*TransformationResult, error)
+}
+
+// TransformationPipeline is an ordered list of IdentityTransformations. The zero value and nil are both valid
+// pipelines which make no changes to the identity. A TransformationPipeline is itself an IdentityTransformation,
+// so pipelines may be nested.
+type TransformationPipeline struct {
+	transforms []IdentityTransformation
+}
+
+// NewTransformationPipeline returns an empty pipeline.
+func NewTransformationPipeline() *TransformationPipeline {
+	return &TransformationPipeline{}
+}
+
+// AppendTransformation adds a transformation to the end of the pipeline.
+func (p *TransformationPipeline) AppendTransformation(t IdentityTransformation) {
+	p.transforms = append(p.transforms, t)
+}
+
+// Evaluate runs each transformation in order, passing the output of each to the next. Evaluation stops at the
+// first transformation which rejects the user. The returned groups are never nil and contain no duplicates.
+func (p *TransformationPipeline) Evaluate(username string, groups []string) (*TransformationResult, error) {
+	accumulatedResult := &TransformationResult{
+		Username:              username,
+		Groups:                groups,
+		AuthenticationAllowed: true,
+	}
+	if p != nil {
+		for i, transform := range p.transforms {
+			var err error
+			accumulatedResult, err = transform.Evaluate(accumulatedResult.Username, accumulatedResult.Groups)
+			if err != nil {
+				return nil, fmt.Errorf("identity transformation at index %d: %w", i, err)
+			}
+			if !accumulatedResult.AuthenticationAllowed {
+				if accumulatedResult.RejectedAuthenticationMessage == "" {
+					accumulatedResult.RejectedAuthenticationMessage = DefaultRejectedAuthenticationMessage
+				}
+				return accumulatedResult, nil
+			}
+		}
+	}
+	if strings.TrimSpace(accumulatedResult.Username) == "" {
+		return nil, fmt.Errorf("identity transformation returned an empty username")
+	}
+	accumulatedResult.Groups = uniqueGroups(accumulatedResult.Groups)
+	return accumulatedResult, nil
+}
+
+func uniqueGroups(groups []string) []string {
+	seen := sets.NewString()
+	unique := make([]string, 0, len(groups))
+	for _, group := range groups {
+		if !seen.Has(group) {
+			seen.Insert(group)
+			unique = append(unique, group)
+		}
+	}
+	return unique
+}
+
+type usernamePrefixTransformation struct {
+	prefix string
+}
+
+// NewUsernamePrefixTransformation returns a transformation which prepends prefix to the username.
+func NewUsernamePrefixTransformation(prefix string) IdentityTransformation {
+	return &usernamePrefixTransformation{prefix: prefix}
+}
+
+func (t *usernamePrefixTransformation) Evaluate(username string, groups []string) (*TransformationResult, error) {
+	return allowed(t.prefix+username, groups), nil
+}
+
+type usernameRenameTransformation struct {
+	regex       *regexp.Regexp
+	replacement string
+}
+
+// NewUsernameRenameTransformation returns a transformation which replaces every match of regex in the username
+// with replacement, which may use regexp.Regexp.Expand syntax to refer to capture groups.
+func NewUsernameRenameTransformation(regex, replacement string) (IdentityTransformation, error) {
+	compiled, err := regexp.Compile(regex)
+	if err != nil {
+		return nil, fmt.Errorf("could not compile username rename regex %q: %w", regex, err)
+	}
+	return &usernameRenameTransformation{regex: compiled, replacement: replacement}, nil
+}
+
+func (t *usernameRenameTransformation) Evaluate(username string, groups []string) (*TransformationResult, error) {
+	return allowed(t.regex.ReplaceAllString(username, t.replacement), groups), nil
+}
+
+type groupsMapTransformation struct {
+	mappings map[string]string
+}
+
+// NewGroupsMapTransformation returns a transformation which renames each group which is a key of mappings to
+// the corresponding value. Other groups are unchanged.
+func NewGroupsMapTransformation(mappings map[string]string) IdentityTransformation {
+	copied := make(map[string]string, len(mappings))
+	for from, to := range mappings {
+		copied[from] = to
+	}
+	return &groupsMapTransformation{mappings: copied}
+}
+
+func (t *groupsMapTransformation) Evaluate(username string, groups []string) (*TransformationResult, error) {
+	mapped := make([]string, 0, len(groups))
+	for _, group := range groups {
+		if to, ok := t.mappings[group]; ok {
+			group = to
+		}
+		mapped = append(mapped, group)
+	}
+	return allowed(username, mapped), nil
+}
+
+type groupsFilterTransformation struct {
+	regex   *regexp.Regexp
+	exclude bool
+}
+
+// NewGroupsFilterTransformation returns a transformation which keeps only the groups that match regex,
+// or when exclude is true, removes the groups that match regex.
+func NewGroupsFilterTransformation(regex string, exclude bool) (IdentityTransformation, error) {
+	compiled, err := regexp.Compile(regex)
+	if err != nil {
+		return nil, fmt.Errorf("could not compile groups filter regex %q: %w", regex, err)
+	}
+	return &groupsFilterTransformation{regex: compiled, exclude: exclude}, nil
+}
+
+func (t *groupsFilterTransformation) Evaluate(username string, groups []string) (*TransformationResult, error) {
+	filtered := make([]string, 0, len(groups))
+	for _, group := range groups {
+		if t.regex.MatchString(group) != t.exclude {
+			filtered = append(filtered, group)
+		}
+	}
+	return allowed(username, filtered), nil
+}
+
+type rejectPolicy struct {
+	usernameRegex *regexp.Regexp
+	groupsRegex   *regexp.Regexp
+	message       string
+}
+
+// NewRejectPolicy returns a policy which rejects users whose username matches usernameRegex, or who belong to
+// any group which matches groupsRegex. Either regex may be empty, but not both. When message is empty, then
+// DefaultRejectedAuthenticationMessage is used.
+func NewRejectPolicy(usernameRegex, groupsRegex, message string) (IdentityTransformation, error) {
+	if usernameRegex == "" && groupsRegex == "" {
+		return nil, fmt.Errorf("reject policy must specify at least one of usernameRegex or groupsRegex")
+	}
+	p := &rejectPolicy{message: message}
+	if p.message == "" {
+		p.message = DefaultRejectedAuthenticationMessage
+	}
+	var err error
+	if usernameRegex != "" {
+		if p.usernameRegex, err = regexp.Compile(usernameRegex); err != nil {
+			return nil, fmt.Errorf("could not compile reject policy usernameRegex %q: %w", usernameRegex, err)
+		}
+	}
+	if groupsRegex != "" {
+		if p.groupsRegex, err = regexp.Compile(groupsRegex); err != nil {
+			return nil, fmt.Errorf("could not compile reject policy groupsRegex %q: %w", groupsRegex, err)
+		}
+	}
+	return p, nil
+}
+
+func (p *rejectPolicy) Evaluate(username string, groups []string) (*TransformationResult, error) {
+	if p.usernameRegex != nil && p.usernameRegex.MatchString(username) {
+		return p.rejected(username, groups), nil
+	}
+	if p.groupsRegex != nil {
+		for _, group := range groups {
+			if p.groupsRegex.MatchString(group) {
+				return p.rejected(username, groups), nil
+			}
+		}
+	}
+	return allowed(username, groups), nil
+}
+
+func (p *rejectPolicy) rejected(username string, groups []string) *TransformationResult {
+	return &TransformationResult{
+		Username:                      username,
+		Groups:                        groups,
+		AuthenticationAllowed:         false,
+		RejectedAuthenticationMessage: p.message,
+	}
+}
+
+func allowed(username string, groups []string) *TransformationResult {
+	return &TransformationResult{Username: username, Groups: groups, AuthenticationAllowed: true}
+}
+
+type reservedNamesPolicy struct{}
+
+// NewReservedNamesPolicy returns a policy which rejects users whose username or groups use a prefix which is
+// reserved by Kubernetes, such as system:admin or system:masters.
+func NewReservedNamesPolicy() IdentityTransformation {
+	return &reservedNamesPolicy{}
+}
+
+func (p *reservedNamesPolicy) Evaluate(username string, groups []string) (*TransformationResult, error) {
+	if err := reservednames.Validate(username, groups); err != nil {
+		return &TransformationResult{
+			Username:                      username,
+			Groups:                        groups,
+			AuthenticationAllowed:         false,
+			RejectedAuthenticationMessage: err.Error(),
+		}, nil
+	}
+	return allowed(username, groups), nil
+}
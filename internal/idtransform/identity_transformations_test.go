@@ -0,0 +1,240 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package idtransform
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransformationPipeline(t *testing.T) {
+	mustTransform := func(transform IdentityTransformation, err error) IdentityTransformation {
+		require.NoError(t, err)
+		return transform
+	}
+
+	tests := []struct {
+		name       string
+		transforms []IdentityTransformation
+		username   string
+		groups     []string
+		wantResult *TransformationResult
+		wantErr    string
+	}{
+		{
+			name:     "empty pipeline returns the identity unchanged",
+			username: "ryan",
+			groups:   []string{"admins", "developers"},
+			wantResult: &TransformationResult{
+				Username:              "ryan",
+				Groups:                []string{"admins", "developers"},
+				AuthenticationAllowed: true,
+			},
+		},
+		{
+			name:     "empty pipeline returns non-nil groups",
+			username: "ryan",
+			groups:   nil,
+			wantResult: &TransformationResult{
+				Username:              "ryan",
+				Groups:                []string{},
+				AuthenticationAllowed: true,
+			},
+		},
+		{
+			name: "transforms are applied in order",
+			transforms: []IdentityTransformation{
+				mustTransform(NewUsernameRenameTransformation(`@example\.com$`, "")),
+				NewUsernamePrefixTransformation("ldap:"),
+				NewGroupsMapTransformation(map[string]string{"admins": "cluster-admins", "other": "unused"}),
+				mustTransform(NewGroupsFilterTransformation(`^cluster-`, false)),
+				NewUsernamePrefixTransformation("second:"),
+			},
+			username: "ryan@example.com",
+			groups:   []string{"admins", "developers", "cluster-viewers"},
+			wantResult: &TransformationResult{
+				Username:              "second:ldap:ryan",
+				Groups:                []string{"cluster-admins", "cluster-viewers"},
+				AuthenticationAllowed: true,
+			},
+		},
+		{
+			name: "username rename can use capture groups",
+			transforms: []IdentityTransformation{
+				mustTransform(NewUsernameRenameTransformation(`^(\w+)@(\w+)\.com$`, "$2/$1")),
+			},
+			username: "ryan@example.com",
+			wantResult: &TransformationResult{
+				Username:              "example/ryan",
+				Groups:                []string{},
+				AuthenticationAllowed: true,
+			},
+		},
+		{
+			name: "groups filter can exclude matching groups",
+			transforms: []IdentityTransformation{
+				mustTransform(NewGroupsFilterTransformation(`^system:`, true)),
+			},
+			username: "ryan",
+			groups:   []string{"system:masters", "developers"},
+			wantResult: &TransformationResult{
+				Username:              "ryan",
+				Groups:                []string{"developers"},
+				AuthenticationAllowed: true,
+			},
+		},
+		{
+			name: "groups which become duplicates are removed",
+			transforms: []IdentityTransformation{
+				NewGroupsMapTransformation(map[string]string{"a": "c", "b": "c"}),
+			},
+			username: "ryan",
+			groups:   []string{"a", "b", "c", "d"},
+			wantResult: &TransformationResult{
+				Username:              "ryan",
+				Groups:                []string{"c", "d"},
+				AuthenticationAllowed: true,
+			},
+		},
+		{
+			name: "reject policy matching the username stops the pipeline",
+			transforms: []IdentityTransformation{
+				NewUsernamePrefixTransformation("ldap:"),
+				mustTransform(NewRejectPolicy(`^ldap:admin$`, "", "admins must use another IDP")),
+				NewUsernamePrefixTransformation("not-applied:"),
+			},
+			username: "admin",
+			groups:   []string{"a"},
+			wantResult: &TransformationResult{
+				Username:                      "ldap:admin",
+				Groups:                        []string{"a"},
+				AuthenticationAllowed:         false,
+				RejectedAuthenticationMessage: "admins must use another IDP",
+			},
+		},
+		{
+			name: "reject policy matching a group uses the default message",
+			transforms: []IdentityTransformation{
+				mustTransform(NewRejectPolicy("", `^contractors$`, "")),
+			},
+			username: "ryan",
+			groups:   []string{"developers", "contractors"},
+			wantResult: &TransformationResult{
+				Username:                      "ryan",
+				Groups:                        []string{"developers", "contractors"},
+				AuthenticationAllowed:         false,
+				RejectedAuthenticationMessage: DefaultRejectedAuthenticationMessage,
+			},
+		},
+		{
+			name: "reject policy which does not match allows the user",
+			transforms: []IdentityTransformation{
+				mustTransform(NewRejectPolicy(`^admin$`, `^contractors$`, "")),
+			},
+			username: "ryan",
+			groups:   []string{"developers"},
+			wantResult: &TransformationResult{
+				Username:              "ryan",
+				Groups:                []string{"developers"},
+				AuthenticationAllowed: true,
+			},
+		},
+		{
+			name: "reserved names policy rejects a reserved group",
+			transforms: []IdentityTransformation{
+				NewReservedNamesPolicy(),
+			},
+			username: "ryan",
+			groups:   []string{"developers", "system:masters"},
+			wantResult: &TransformationResult{
+				Username:                      "ryan",
+				Groups:                        []string{"developers", "system:masters"},
+				AuthenticationAllowed:         false,
+				RejectedAuthenticationMessage: `group "system:masters" uses the reserved prefix "system:"`,
+			},
+		},
+		{
+			name: "reserved names policy allows names which are not reserved",
+			transforms: []IdentityTransformation{
+				NewReservedNamesPolicy(),
+			},
+			username: "ryan",
+			groups:   []string{"developers"},
+			wantResult: &TransformationResult{
+				Username:              "ryan",
+				Groups:                []string{"developers"},
+				AuthenticationAllowed: true,
+			},
+		},
+		{
+			name: "pipelines may be nested",
+			transforms: []IdentityTransformation{
+				func() IdentityTransformation {
+					nested := NewTransformationPipeline()
+					nested.AppendTransformation(NewUsernamePrefixTransformation("system:"))
+					return nested
+				}(),
+				NewReservedNamesPolicy(),
+			},
+			username: "admin",
+			wantResult: &TransformationResult{
+				Username:                      "system:admin",
+				Groups:                        []string{},
+				AuthenticationAllowed:         false,
+				RejectedAuthenticationMessage: `username "system:admin" uses the reserved prefix "system:"`,
+			},
+		},
+		{
+			name: "transforms which produce an empty username are an error",
+			transforms: []IdentityTransformation{
+				mustTransform(NewUsernameRenameTransformation(`.*`, "")),
+			},
+			username: "ryan",
+			wantErr:  "identity transformation returned an empty username",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			pipeline := NewTransformationPipeline()
+			for _, transform := range tt.transforms {
+				pipeline.AppendTransformation(transform)
+			}
+
+			result, err := pipeline.Evaluate(tt.username, tt.groups)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				require.Nil(t, result)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantResult, result)
+		})
+	}
+}
+
+func TestNilTransformationPipeline(t *testing.T) {
+	var pipeline *TransformationPipeline
+	result, err := pipeline.Evaluate("ryan", []string{"a", "a"})
+	require.NoError(t, err)
+	require.Equal(t, &TransformationResult{Username: "ryan", Groups: []string{"a"}, AuthenticationAllowed: true}, result)
+}
+
+func TestTransformationConstructorErrors(t *testing.T) {
+	_, err := NewUsernameRenameTransformation(`(`, "")
+	require.EqualError(t, err, "could not compile username rename regex \"(\": error parsing regexp: missing closing ): `(`")
+
+	_, err = NewGroupsFilterTransformation(`[`, false)
+	require.EqualError(t, err, "could not compile groups filter regex \"[\": error parsing regexp: missing closing ]: `[`")
+
+	_, err = NewRejectPolicy("", "", "message")
+	require.EqualError(t, err, "reject policy must specify at least one of usernameRegex or groupsRegex")
+
+	_, err = NewRejectPolicy(`(`, "", "")
+	require.EqualError(t, err, "could not compile reject policy usernameRegex \"(\": error parsing regexp: missing closing ): `(`")
+
+	_, err = NewRejectPolicy("", `(`, "")
+	require.EqualError(t, err, "could not compile reject policy groupsRegex \"(\": error parsing regexp: missing closing ): `(`")
+}
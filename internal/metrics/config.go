@@ -0,0 +1,33 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package metrics
+
+import (
+	"net"
+	"strconv"
+
+	"go.pinniped.dev/internal/constable"
+)
+
+const errInvalidAddress = constable.Error("address must be a host and a port, e.g. :9090")
+
+// Config configures the listener of the metrics endpoint. It is part of the static configuration of both the
+// Supervisor and the Concierge.
+type Config struct {
+	// Address is the TCP address on which the metrics are served over plain HTTP at /metrics, e.g. ":9090" to listen
+	// on all interfaces. Any client which can connect to this address can read the metrics.
+	Address string `json:"address"`
+}
+
+// Validate returns an error when the config is invalid.
+func (c *Config) Validate() error {
+	_, port, err := net.SplitHostPort(c.Address)
+	if err != nil {
+		return errInvalidAddress
+	}
+	if portNumber, err := strconv.ParseUint(port, 10, 16); err != nil || portNumber == 0 {
+		return errInvalidAddress
+	}
+	return nil
+}
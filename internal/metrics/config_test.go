@@ -0,0 +1,39 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		address string
+		wantErr string
+	}{
+		{address: ":9090"},
+		{address: "127.0.0.1:9090"},
+		{address: "[::1]:9090"},
+		{address: "", wantErr: "address must be a host and a port, e.g. :9090"},
+		{address: "127.0.0.1", wantErr: "address must be a host and a port, e.g. :9090"},
+		{address: ":0", wantErr: "address must be a host and a port, e.g. :9090"},
+		{address: ":65536", wantErr: "address must be a host and a port, e.g. :9090"},
+		{address: ":http", wantErr: "address must be a host and a port, e.g. :9090"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.address, func(t *testing.T) {
+			t.Parallel()
+
+			err := (&Config{Address: tt.address}).Validate()
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package metrics defines the Prometheus metrics of the Supervisor and of the Concierge.
+//
+// The metrics are registered into the legacy registry of Kubernetes, next to the metrics of the aggregated API
+// servers and of the queues of the controllers, and they are only recorded after Register was called.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/endpoints/responsewriter"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+
+	// Register the metrics of the workqueues, e.g. the depth of the queue of each controller.
+	_ "k8s.io/component-base/metrics/prometheus/workqueue"
+)
+
+const (
+	namespace = "pinniped"
+
+	// UpstreamTypeOIDC labels the requests to an upstream OIDC provider.
+	UpstreamTypeOIDC = "oidc"
+	// UpstreamTypeLDAP labels the requests to an upstream LDAP or Active Directory provider.
+	UpstreamTypeLDAP = "ldap"
+
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+	// ResultRejected is the result of an authentication which failed because of the credentials of the user, e.g. a
+	// wrong password, as opposed to a failure of the identity provider.
+	ResultRejected = "rejected"
+
+	// GrantTypeOther labels the token requests of any grant type which the Supervisor does not support, so that
+	// clients cannot create an unbounded number of series.
+	GrantTypeOther = "other"
+)
+
+//nolint:gochecknoglobals // the metrics are global, like the registry in which they are registered
+var (
+	// durationBuckets are the buckets of the histograms of durations, in seconds. They range from the duration of a
+	// request served from memory to a slow upstream identity provider.
+	durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+	supervisorEndpointRequests = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      namespace,
+			Subsystem:      "supervisor",
+			Name:           "endpoint_requests_total",
+			Help:           "Number of requests to the endpoints of the FederationDomains, by endpoint and HTTP status code.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"endpoint", "code"},
+	)
+
+	supervisorEndpointDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Namespace:      namespace,
+			Subsystem:      "supervisor",
+			Name:           "endpoint_request_duration_seconds",
+			Help:           "Duration of the requests to the endpoints of the FederationDomains, by endpoint.",
+			Buckets:        durationBuckets,
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"endpoint"},
+	)
+
+	supervisorTokenRequests = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      namespace,
+			Subsystem:      "supervisor",
+			Name:           "token_requests_total",
+			Help:           "Number of requests to the token endpoints of the FederationDomains, by grant type and result.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"grant_type", "result"},
+	)
+
+	// supportedGrantTypes are the grant types of the token endpoint which are used as the values of the grant_type
+	// label. All other grant types are counted as GrantTypeOther.
+	supportedGrantTypes = sets.NewString(
+		"authorization_code",
+		"refresh_token",
+		"urn:ietf:params:oauth:grant-type:token-exchange",
+		"urn:ietf:params:oauth:grant-type:device_code",
+	)
+
+	upstreamRequestDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Namespace:      namespace,
+			Subsystem:      "supervisor",
+			Name:           "upstream_request_duration_seconds",
+			Help:           "Duration of the requests to the upstream identity providers, by type and name of provider, operation and result.",
+			Buckets:        durationBuckets,
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"idp_type", "idp_name", "operation", "result"},
+	)
+
+	authenticatorCacheLookups = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      namespace,
+			Subsystem:      "concierge",
+			Name:           "authenticator_cache_lookups_total",
+			Help:           "Number of lookups of the authenticator of a TokenCredentialRequest, by result (hit or miss).",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"result"},
+	)
+
+	tokenCredentialRequests = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      namespace,
+			Subsystem:      "concierge",
+			Name:           "token_credential_requests_total",
+			Help:           "Number of TokenCredentialRequests, by result.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"result"},
+	)
+
+	impersonationProxyRequestDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Namespace:      namespace,
+			Subsystem:      "concierge",
+			Name:           "impersonation_proxy_request_duration_seconds",
+			Help:           "Duration of the authenticated requests proxied by the impersonation proxy, by verb and HTTP status code.",
+			Buckets:        durationBuckets,
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"verb", "code"},
+	)
+
+	controllerSyncDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Namespace:      namespace,
+			Subsystem:      "controller",
+			Name:           "sync_duration_seconds",
+			Help:           "Duration of the syncs of the controllers, by controller and result.",
+			Buckets:        durationBuckets,
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"controller", "result"},
+	)
+
+	registerOnce sync.Once
+)
+
+// Register registers the metrics of Pinniped into the legacy registry, so they are recorded and served by Handler.
+// It may be called several times.
+func Register() {
+	registerOnce.Do(func() {
+		legacyregistry.MustRegister(
+			supervisorEndpointRequests,
+			supervisorEndpointDuration,
+			supervisorTokenRequests,
+			upstreamRequestDuration,
+			authenticatorCacheLookups,
+			tokenCredentialRequests,
+			impersonationProxyRequestDuration,
+			controllerSyncDuration,
+		)
+	})
+}
+
+// Handler serves all metrics of the legacy registry in the Prometheus text format at /metrics.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", legacyregistry.Handler())
+	return mux
+}
+
+// InstrumentSupervisorEndpoint counts the requests to an endpoint of a FederationDomain and observes their duration.
+// The endpoint is the path of the endpoint relative to the issuer, so that the requests to the same endpoint of
+// all FederationDomains are counted together.
+func InstrumentSupervisorEndpoint(endpoint string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := newStatusRecorder(w)
+		handler.ServeHTTP(recorder.wrap(), r)
+		supervisorEndpointRequests.WithLabelValues(endpoint, recorder.code(r)).Inc()
+		supervisorEndpointDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+	})
+}
+
+// InstrumentImpersonationProxy observes the duration of the requests which are proxied by the impersonation proxy.
+// It must be called inside the handler chain of the impersonation proxy, where the verb of the request is known.
+func InstrumentImpersonationProxy(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := newStatusRecorder(w)
+		handler.ServeHTTP(recorder.wrap(), r)
+		verb := "unknown"
+		if requestInfo, ok := request.RequestInfoFrom(r.Context()); ok && requestInfo.Verb != "" {
+			verb = requestInfo.Verb
+		}
+		impersonationProxyRequestDuration.WithLabelValues(verb, recorder.code(r)).Observe(time.Since(start).Seconds())
+	})
+}
+
+// RecordTokenRequest counts a request to the token endpoint of a FederationDomain with its grant type and result,
+// so that e.g. failed refreshes can be told apart from failed logins.
+func RecordTokenRequest(grantType string, result string) {
+	if !supportedGrantTypes.Has(grantType) {
+		grantType = GrantTypeOther
+	}
+	supervisorTokenRequests.WithLabelValues(grantType, result).Inc()
+}
+
+// ObserveUpstreamRequest observes the duration of an operation with an upstream identity provider, which started at
+// start, e.g. a login or a refresh.
+func ObserveUpstreamRequest(idpType, idpName, operation string, start time.Time, result string) {
+	upstreamRequestDuration.WithLabelValues(idpType, idpName, operation, result).Observe(time.Since(start).Seconds())
+}
+
+// ResultOf returns ResultFailure when err is not nil, and ResultSuccess otherwise.
+func ResultOf(err error) string {
+	if err != nil {
+		return ResultFailure
+	}
+	return ResultSuccess
+}
+
+// RecordAuthenticatorCacheLookup counts a lookup of the authenticator of a TokenCredentialRequest.
+func RecordAuthenticatorCacheLookup(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	authenticatorCacheLookups.WithLabelValues(result).Inc()
+}
+
+// RecordTokenCredentialRequest counts a TokenCredentialRequest with its result.
+func RecordTokenCredentialRequest(result string) {
+	tokenCredentialRequests.WithLabelValues(result).Inc()
+}
+
+// ObserveControllerSync observes the duration of a sync of a controller, which started at start.
+func ObserveControllerSync(controller string, start time.Time, err error) {
+	controllerSyncDuration.WithLabelValues(controller, ResultOf(err)).Observe(time.Since(start).Seconds())
+}
+
+// statusRecorder records the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	return &statusRecorder{ResponseWriter: w}
+}
+
+// wrap returns the recorder as a response writer which keeps the optional interfaces of the original response writer,
+// e.g. http.Flusher for watches and http.Hijacker for upgraded connections.
+func (s *statusRecorder) wrap() http.ResponseWriter {
+	return responsewriter.WrapForHTTP1Or2(s)
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func (s *statusRecorder) code(r *http.Request) string {
+	if s.status == 0 {
+		if httpstream.IsUpgradeRequest(r) {
+			// The connection was hijacked to switch protocols, e.g. for kubectl exec, so the status code was written
+			// directly to the connection.
+			return strconv.Itoa(http.StatusSwitchingProtocols)
+		}
+		// Nothing was written, so the server responds with 200.
+		return strconv.Itoa(http.StatusOK)
+	}
+	return strconv.Itoa(s.status)
+}
@@ -0,0 +1,175 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package metrics
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func TestCounters(t *testing.T) {
+	Register()
+	Register() // may be called several times
+
+	RecordAuthenticatorCacheLookup(true)
+	RecordAuthenticatorCacheLookup(true)
+	RecordAuthenticatorCacheLookup(false)
+	RecordTokenCredentialRequest(ResultSuccess)
+	RecordTokenCredentialRequest("some-result")
+
+	require.NoError(t, testutil.GatherAndCompare(legacyregistry.DefaultGatherer, strings.NewReader(`
+# HELP pinniped_concierge_authenticator_cache_lookups_total [ALPHA] Number of lookups of the authenticator of a TokenCredentialRequest, by result (hit or miss).
+# TYPE pinniped_concierge_authenticator_cache_lookups_total counter
+pinniped_concierge_authenticator_cache_lookups_total{result="hit"} 2
+pinniped_concierge_authenticator_cache_lookups_total{result="miss"} 1
+# HELP pinniped_concierge_token_credential_requests_total [ALPHA] Number of TokenCredentialRequests, by result.
+# TYPE pinniped_concierge_token_credential_requests_total counter
+pinniped_concierge_token_credential_requests_total{result="some-result"} 1
+pinniped_concierge_token_credential_requests_total{result="success"} 1
+`),
+		"pinniped_concierge_authenticator_cache_lookups_total",
+		"pinniped_concierge_token_credential_requests_total",
+	))
+}
+
+func TestInstrumentSupervisorEndpoint(t *testing.T) {
+	Register()
+
+	handler := InstrumentSupervisorEndpoint("/some/endpoint", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/error":
+			http.Error(w, "some error", http.StatusBadRequest)
+		case "/empty":
+		default:
+			_, _ = w.Write([]byte("hello"))
+		}
+	}))
+	for _, path := range []string{"/ok", "/ok", "/error", "/empty"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	require.NoError(t, testutil.GatherAndCompare(legacyregistry.DefaultGatherer, strings.NewReader(`
+# HELP pinniped_supervisor_endpoint_requests_total [ALPHA] Number of requests to the endpoints of the FederationDomains, by endpoint and HTTP status code.
+# TYPE pinniped_supervisor_endpoint_requests_total counter
+pinniped_supervisor_endpoint_requests_total{code="200",endpoint="/some/endpoint"} 3
+pinniped_supervisor_endpoint_requests_total{code="400",endpoint="/some/endpoint"} 1
+`),
+		"pinniped_supervisor_endpoint_requests_total",
+	))
+	requireScraped(t, `pinniped_supervisor_endpoint_request_duration_seconds_count{endpoint="/some/endpoint"} 4`)
+}
+
+func TestRecordTokenRequest(t *testing.T) {
+	Register()
+
+	RecordTokenRequest("authorization_code", ResultSuccess)
+	RecordTokenRequest("refresh_token", ResultSuccess)
+	RecordTokenRequest("refresh_token", ResultFailure)
+	RecordTokenRequest("refresh_token", ResultFailure)
+	RecordTokenRequest("urn:ietf:params:oauth:grant-type:token-exchange", ResultSuccess)
+	RecordTokenRequest("urn:ietf:params:oauth:grant-type:device_code", ResultFailure)
+	RecordTokenRequest("some-unsupported-grant-type", ResultFailure)
+	RecordTokenRequest("", ResultFailure)
+
+	require.NoError(t, testutil.GatherAndCompare(legacyregistry.DefaultGatherer, strings.NewReader(`
+# HELP pinniped_supervisor_token_requests_total [ALPHA] Number of requests to the token endpoints of the FederationDomains, by grant type and result.
+# TYPE pinniped_supervisor_token_requests_total counter
+pinniped_supervisor_token_requests_total{grant_type="authorization_code",result="success"} 1
+pinniped_supervisor_token_requests_total{grant_type="other",result="failure"} 2
+pinniped_supervisor_token_requests_total{grant_type="refresh_token",result="failure"} 2
+pinniped_supervisor_token_requests_total{grant_type="refresh_token",result="success"} 1
+pinniped_supervisor_token_requests_total{grant_type="urn:ietf:params:oauth:grant-type:device_code",result="failure"} 1
+pinniped_supervisor_token_requests_total{grant_type="urn:ietf:params:oauth:grant-type:token-exchange",result="success"} 1
+`),
+		"pinniped_supervisor_token_requests_total",
+	))
+}
+
+func TestInstrumentImpersonationProxy(t *testing.T) {
+	Register()
+
+	handler := InstrumentImpersonationProxy(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The optional interfaces of the response writer of the server are kept, e.g. for watches.
+		if _, ok := w.(http.Flusher); !ok {
+			http.Error(w, "not a flusher", http.StatusInternalServerError)
+			return
+		}
+		if _, ok := w.(http.Hijacker); !ok {
+			http.Error(w, "not a hijacker", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("verb") != "" {
+			r = r.WithContext(request.WithRequestInfo(r.Context(), &request.RequestInfo{Verb: r.URL.Query().Get("verb")}))
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	for _, url := range []string{server.URL, server.URL + "?verb=create"} {
+		resp, err := http.Post(url, "application/json", nil) //nolint:noctx // this is only a test
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+
+	requireScraped(t,
+		`pinniped_concierge_impersonation_proxy_request_duration_seconds_count{code="201",verb="unknown"} 1`,
+		`pinniped_concierge_impersonation_proxy_request_duration_seconds_count{code="201",verb="create"} 1`,
+	)
+}
+
+func TestObserveUpstreamRequestAndControllerSync(t *testing.T) {
+	Register()
+
+	start := time.Now()
+	ObserveUpstreamRequest(UpstreamTypeLDAP, "some-ldap", "authenticate", start, ResultRejected)
+	ObserveUpstreamRequest(UpstreamTypeOIDC, "some-oidc", "refresh", start, ResultOf(errors.New("some error")))
+	ObserveControllerSync("some-controller", start, nil)
+	ObserveControllerSync("some-controller", start, errors.New("some error"))
+
+	requireScraped(t,
+		`pinniped_supervisor_upstream_request_duration_seconds_count{idp_name="some-ldap",idp_type="ldap",operation="authenticate",result="rejected"} 1`,
+		`pinniped_supervisor_upstream_request_duration_seconds_count{idp_name="some-oidc",idp_type="oidc",operation="refresh",result="failure"} 1`,
+		`pinniped_controller_sync_duration_seconds_count{controller="some-controller",result="success"} 1`,
+		`pinniped_controller_sync_duration_seconds_count{controller="some-controller",result="failure"} 1`,
+	)
+}
+
+func TestHandler(t *testing.T) {
+	rr := httptest.NewRecorder()
+	Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/not-metrics", nil))
+	require.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+// requireScraped requires that the lines are in the metrics which are served by Handler.
+func requireScraped(t *testing.T, lines ...string) {
+	t.Helper()
+
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/metrics") //nolint:noctx // this is only a test
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	for _, line := range lines {
+		require.Contains(t, string(body), "\n"+line+"\n")
+	}
+}
@@ -116,6 +116,20 @@ func (mr *MockUpstreamOIDCIdentityProviderIMockRecorder) GetClientID() *gomock.C
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetClientID", reflect.TypeOf((*MockUpstreamOIDCIdentityProviderI)(nil).GetClientID))
 }
 
+// GetEndSessionURL mocks base method.
+func (m *MockUpstreamOIDCIdentityProviderI) GetEndSessionURL() *url.URL {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetEndSessionURL")
+	ret0, _ := ret[0].(*url.URL)
+	return ret0
+}
+
+// GetEndSessionURL indicates an expected call of GetEndSessionURL.
+func (mr *MockUpstreamOIDCIdentityProviderIMockRecorder) GetEndSessionURL() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetEndSessionURL", reflect.TypeOf((*MockUpstreamOIDCIdentityProviderI)(nil).GetEndSessionURL))
+}
+
 // GetGroupsClaim mocks base method.
 func (m *MockUpstreamOIDCIdentityProviderI) GetGroupsClaim() string {
 	m.ctrl.T.Helper()
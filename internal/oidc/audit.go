@@ -0,0 +1,94 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package oidc
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ory/fosite"
+
+	"go.pinniped.dev/internal/audit"
+	"go.pinniped.dev/internal/oidc/clientregistry"
+	"go.pinniped.dev/internal/psession"
+)
+
+// NewAuditEvent returns an audit event about the downstream session of the requester of a FederationDomain. The
+// requester may be nil or incomplete, e.g. when the request was invalid, in which case the event has fewer fields.
+func NewAuditEvent(eventType audit.EventType, issuer string, requester fosite.Requester) *audit.Event {
+	event := &audit.Event{Type: eventType, Issuer: issuer}
+	if requester == nil {
+		return event
+	}
+
+	event.SessionID = requester.GetID()
+	event.ClientID = clientIDForAudit(requester.GetClient())
+
+	session, ok := requester.GetSession().(*psession.PinnipedSession)
+	if !ok || session == nil {
+		return event
+	}
+	if session.Fosite != nil && session.Fosite.Claims != nil {
+		claims := session.Fosite.Claims
+		event.Subject = claims.Subject
+		if event.Issuer == "" {
+			// The issuer of the FederationDomain is recorded in the sessions which were started by its token endpoint.
+			event.Issuer = claims.Issuer
+		}
+		event.Username = DownstreamUsername(claims)
+		event.Groups = DownstreamGroups(claims)
+	}
+	if custom := session.Custom; custom != nil && custom.ProviderName != "" {
+		event.IdentityProvider = AuditIdentityProvider(custom.ProviderName, custom.ProviderType, string(custom.ProviderUID))
+	}
+	return event
+}
+
+// AuditIdentityProvider returns the identity provider of an audit event.
+func AuditIdentityProvider(name string, providerType psession.ProviderType, uid string) *audit.IdentityProvider {
+	return &audit.IdentityProvider{Name: name, Type: string(providerType), UID: uid}
+}
+
+// RecordAuditEvent records an audit event about the downstream session of the requester. The upstream identifies the
+// upstream IDP of the event until the requester has a session which identifies it. When err is not nil, the outcome
+// of the event is a failure.
+func RecordAuditEvent(
+	r *http.Request,
+	eventType audit.EventType,
+	issuer string,
+	requester fosite.Requester,
+	upstream *audit.IdentityProvider,
+	err error,
+) {
+	event := NewAuditEvent(eventType, issuer, requester).Failure(FositeErrorForAudit(err))
+	if event.IdentityProvider == nil {
+		event.IdentityProvider = upstream
+	}
+	audit.RecordRequest(r, event)
+}
+
+// FositeErrorForAudit returns the reason of a failed audit event. Just like the error response to the client, it
+// does not include the debug details of fosite errors, which may be sensitive. Other errors are returned as is.
+func FositeErrorForAudit(err error) error {
+	var rfc6749Error *fosite.RFC6749Error
+	if !errors.As(err, &rfc6749Error) {
+		return err
+	}
+	if description := rfc6749Error.GetDescription(); description != "" {
+		return fmt.Errorf("%s: %s", rfc6749Error.Error(), description)
+	}
+	return errors.New(rfc6749Error.Error())
+}
+
+func clientIDForAudit(client fosite.Client) string {
+	if registryClient, ok := client.(*clientregistry.Client); ok && registryClient.DefaultClient == nil {
+		// A session which was stored without the details of its client has an empty client, which has no ID.
+		return ""
+	}
+	if client == nil {
+		return ""
+	}
+	return client.GetID()
+}
@@ -5,8 +5,10 @@
 package auth
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"net/http"
+	"net/url"
 	"time"
 
 	coreosoidc "github.com/coreos/go-oidc/v3/oidc"
@@ -16,17 +18,20 @@ import (
 	"github.com/ory/fosite/token/jwt"
 	"github.com/pkg/errors"
 	"golang.org/x/oauth2"
+	"k8s.io/apimachinery/pkg/types"
 
 	supervisoroidc "go.pinniped.dev/generated/latest/apis/supervisor/oidc"
-	"go.pinniped.dev/internal/authenticators"
+	"go.pinniped.dev/internal/audit"
 	"go.pinniped.dev/internal/httputil/httperr"
 	"go.pinniped.dev/internal/httputil/securityheader"
+	"go.pinniped.dev/internal/idtransform"
 	"go.pinniped.dev/internal/oidc"
 	"go.pinniped.dev/internal/oidc/csrftoken"
 	"go.pinniped.dev/internal/oidc/downstreamsession"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/plog"
 	"go.pinniped.dev/internal/psession"
+	"go.pinniped.dev/internal/tracing"
 	"go.pinniped.dev/pkg/oidcclient/nonce"
 	"go.pinniped.dev/pkg/oidcclient/pkce"
 )
@@ -34,11 +39,17 @@ import (
 const (
 	promptParamName = "prompt"
 	promptParamNone = "none"
+
+	// browserFlowTemporarySubject is the subject of the temporary session which is used to validate the authorization
+	// requests of the browser flows, before the identity of the user is known.
+	browserFlowTemporarySubject = "none"
 )
 
 func NewHandler(
 	downstreamIssuer string,
 	idpLister oidc.UpstreamIdentityProvidersLister,
+	idTransformsGetter oidc.IdentityTransformsGetter,
+	userInfoPassthroughClaims []string,
 	oauthHelperWithoutStorage fosite.OAuth2Provider,
 	oauthHelperWithStorage fosite.OAuth2Provider,
 	generateCSRF func() (csrftoken.CSRFToken, error),
@@ -55,16 +66,50 @@ func NewHandler(
 			return httperr.Newf(http.StatusMethodNotAllowed, "%s (try GET or POST)", r.Method)
 		}
 
-		oidcUpstream, ldapUpstream, idpType, err := chooseUpstreamIDP(idpLister)
+		if err := r.ParseForm(); err != nil {
+			return httperr.New(http.StatusBadRequest, "error parsing request params")
+		}
+
+		if err := validateDeviceUserCodeParam(r, cookieCodec); err != nil {
+			plog.InfoErr("authorize request has an unconfirmed device user code", err)
+			recordAuthorizeEvent(r, downstreamIssuer, nil, nil, err)
+			return err
+		}
+
+		// The client may choose an upstream IDP by name (and optionally by type) using these custom params.
+		// The Pinniped CLI has been sending these params since v0.9.0.
+		idpNameParam := r.Form.Get(supervisoroidc.AuthorizeUpstreamIDPNameParamName)
+		idpTypeParam := r.Form.Get(supervisoroidc.AuthorizeUpstreamIDPTypeParamName)
+
+		if idpNameParam == "" && countUpstreamIDPs(idpLister) > 1 {
+			if hasCLICredentialHeaders(r) {
+				// The browserless flows cannot show the chooser page, so the client must choose.
+				plog.Warning("authorize request did not specify an upstream provider, but several are configured")
+				return httperr.Newf(http.StatusUnprocessableEntity,
+					"Multiple upstream providers are configured, so the %s param must be specified",
+					supervisoroidc.AuthorizeUpstreamIDPNameParamName)
+			}
+			return handleAuthRequestWithoutChosenUpstream(r, w, oauthHelperWithoutStorage, downstreamIssuer)
+		}
+
+		oidcUpstream, ldapUpstream, idpType, err := chooseUpstreamIDP(idpNameParam, idpTypeParam, idpLister)
 		if err != nil {
 			plog.WarningErr("authorize upstream config", err)
+			recordAuthorizeEvent(r, downstreamIssuer, nil, nil, err)
 			return err
 		}
 
 		if idpType == psession.ProviderTypeOIDC {
-			if len(r.Header.Values(supervisoroidc.AuthorizeUsernameHeaderName)) > 0 {
-				// The client set a username header, so they are trying to log in with a username/password.
-				return handleAuthRequestForOIDCUpstreamPasswordGrant(r, w, oauthHelperWithStorage, oidcUpstream)
+			tracing.SetIdentityProvider(r.Context(), oidcUpstream.GetName(), string(idpType))
+			if hasCLICredentialHeaders(r) {
+				// The client set a username or password header, so they are trying to log in with a username/password.
+				return handleAuthRequestForOIDCUpstreamPasswordGrant(r, w,
+					oauthHelperWithStorage,
+					oidcUpstream,
+					downstreamIssuer,
+					idTransformsGetter.IdentityTransforms(oidcUpstream.GetName(), psession.ProviderTypeOIDC),
+					userInfoPassthroughClaims,
+				)
 			}
 			return handleAuthRequestForOIDCUpstreamAuthcodeGrant(r, w,
 				oauthHelperWithoutStorage,
@@ -75,27 +120,76 @@ func NewHandler(
 				cookieCodec,
 			)
 		}
-		return handleAuthRequestForLDAPUpstream(r, w,
-			oauthHelperWithStorage,
+
+		// We know it's an AD/LDAP upstream.
+		tracing.SetIdentityProvider(r.Context(), ldapUpstream.GetName(), string(idpType))
+		if hasCLICredentialHeaders(r) {
+			// The client set a username or password header, so they are trying to log in from the CLI.
+			return handleAuthRequestForLDAPUpstreamCLIFlow(r, w,
+				oauthHelperWithStorage,
+				ldapUpstream,
+				idpType,
+				downstreamIssuer,
+				idTransformsGetter.IdentityTransforms(ldapUpstream.GetName(), idpType),
+			)
+		}
+		return handleAuthRequestForLDAPUpstreamBrowserFlow(r, w,
+			oauthHelperWithoutStorage,
+			generateCSRF, generateNonce, generatePKCE,
 			ldapUpstream,
 			idpType,
+			downstreamIssuer,
+			upstreamStateEncoder,
+			cookieCodec,
 		)
 	}))
 }
 
-func handleAuthRequestForLDAPUpstream(
+// handleAuthRequestWithoutChosenUpstream validates the authorization request and then redirects the browser to
+// the page which lets the end user choose an upstream IDP. Choosing an upstream IDP on that page will send the
+// browser back to the authorization endpoint with the same params plus the params which select the upstream IDP.
+func handleAuthRequestWithoutChosenUpstream(
+	r *http.Request,
+	w http.ResponseWriter,
+	oauthHelper fosite.OAuth2Provider,
+	downstreamIssuer string,
+) error {
+	authorizeRequester, created := newAuthorizeRequest(r, w, oauthHelper, downstreamIssuer, nil, false)
+	if !created {
+		return nil
+	}
+
+	promptParam := r.Form.Get(promptParamName)
+	if promptParam == promptParamNone && oidc.ScopeWasRequested(authorizeRequester, coreosoidc.ScopeOpenID) {
+		// The user would need to interact with the chooser page, which is not allowed by prompt=none.
+		return writeAuthorizeError(r, w, oauthHelper, authorizeRequester, downstreamIssuer, nil, fosite.ErrLoginRequired, false)
+	}
+
+	http.Redirect(w, r,
+		downstreamIssuer+oidc.ChooseIDPEndpointPath+"?"+r.Form.Encode(),
+		http.StatusSeeOther, // match fosite and https://tools.ietf.org/id/draft-ietf-oauth-security-topics-18.html#section-4.11
+	)
+
+	return nil
+}
+
+func handleAuthRequestForLDAPUpstreamCLIFlow(
 	r *http.Request,
 	w http.ResponseWriter,
 	oauthHelper fosite.OAuth2Provider,
 	ldapUpstream provider.UpstreamLDAPIdentityProviderI,
 	idpType psession.ProviderType,
+	downstreamIssuer string,
+	idTransforms *idtransform.TransformationPipeline,
 ) error {
-	authorizeRequester, created := newAuthorizeRequest(r, w, oauthHelper, true)
+	upstream := oidc.AuditIdentityProvider(ldapUpstream.GetName(), idpType, string(ldapUpstream.GetResourceUID()))
+
+	authorizeRequester, created := newAuthorizeRequest(r, w, oauthHelper, downstreamIssuer, upstream, true)
 	if !created {
 		return nil
 	}
 
-	username, password, hadUsernamePasswordValues := requireNonEmptyUsernameAndPasswordHeaders(r, w, oauthHelper, authorizeRequester)
+	username, password, hadUsernamePasswordValues := requireNonEmptyUsernameAndPasswordHeaders(r, w, oauthHelper, authorizeRequester, downstreamIssuer, upstream)
 	if !hadUsernamePasswordValues {
 		return nil
 	}
@@ -103,39 +197,21 @@ func handleAuthRequestForLDAPUpstream(
 	authenticateResponse, authenticated, err := ldapUpstream.AuthenticateUser(r.Context(), username, password)
 	if err != nil {
 		plog.WarningErr("unexpected error during upstream LDAP authentication", err, "upstreamName", ldapUpstream.GetName())
+		recordAuthorizeEvent(r, downstreamIssuer, authorizeRequester, upstream, err)
 		return httperr.New(http.StatusBadGateway, "unexpected error during upstream authentication")
 	}
 	if !authenticated {
-		return writeAuthorizeError(w, oauthHelper, authorizeRequester,
+		return writeAuthorizeError(r, w, oauthHelper, authorizeRequester, downstreamIssuer, upstream,
 			fosite.ErrAccessDenied.WithHintf("Username/password not accepted by LDAP provider."), true)
 	}
 
-	subject := downstreamSubjectFromUpstreamLDAP(ldapUpstream, authenticateResponse)
+	subject := downstreamsession.DownstreamSubjectFromUpstreamLDAP(ldapUpstream, authenticateResponse)
 	username = authenticateResponse.User.GetName()
 	groups := authenticateResponse.User.GetGroups()
-	dn := authenticateResponse.DN
-
-	customSessionData := &psession.CustomSessionData{
-		ProviderUID:  ldapUpstream.GetResourceUID(),
-		ProviderName: ldapUpstream.GetName(),
-		ProviderType: idpType,
-	}
-
-	if idpType == psession.ProviderTypeLDAP {
-		customSessionData.LDAP = &psession.LDAPSessionData{
-			UserDN:                 dn,
-			ExtraRefreshAttributes: authenticateResponse.ExtraRefreshAttributes,
-		}
-	}
-	if idpType == psession.ProviderTypeActiveDirectory {
-		customSessionData.ActiveDirectory = &psession.ActiveDirectorySessionData{
-			UserDN:                 dn,
-			ExtraRefreshAttributes: authenticateResponse.ExtraRefreshAttributes,
-		}
-	}
+	customSessionData := downstreamsession.MakeDownstreamLDAPOrADCustomSessionData(ldapUpstream, idpType, authenticateResponse)
 
 	return makeDownstreamSessionAndReturnAuthcodeRedirect(r, w,
-		oauthHelper, authorizeRequester, subject, username, groups, customSessionData)
+		oauthHelper, authorizeRequester, downstreamIssuer, subject, username, groups, customSessionData, idTransforms)
 }
 
 func handleAuthRequestForOIDCUpstreamPasswordGrant(
@@ -143,20 +219,25 @@ func handleAuthRequestForOIDCUpstreamPasswordGrant(
 	w http.ResponseWriter,
 	oauthHelper fosite.OAuth2Provider,
 	oidcUpstream provider.UpstreamOIDCIdentityProviderI,
+	downstreamIssuer string,
+	idTransforms *idtransform.TransformationPipeline,
+	userInfoPassthroughClaims []string,
 ) error {
-	authorizeRequester, created := newAuthorizeRequest(r, w, oauthHelper, true)
+	upstream := oidc.AuditIdentityProvider(oidcUpstream.GetName(), psession.ProviderTypeOIDC, string(oidcUpstream.GetResourceUID()))
+
+	authorizeRequester, created := newAuthorizeRequest(r, w, oauthHelper, downstreamIssuer, upstream, true)
 	if !created {
 		return nil
 	}
 
-	username, password, hadUsernamePasswordValues := requireNonEmptyUsernameAndPasswordHeaders(r, w, oauthHelper, authorizeRequester)
+	username, password, hadUsernamePasswordValues := requireNonEmptyUsernameAndPasswordHeaders(r, w, oauthHelper, authorizeRequester, downstreamIssuer, upstream)
 	if !hadUsernamePasswordValues {
 		return nil
 	}
 
 	if !oidcUpstream.AllowsPasswordGrant() {
 		// Return a user-friendly error for this case which is entirely within our control.
-		return writeAuthorizeError(w, oauthHelper, authorizeRequester,
+		return writeAuthorizeError(r, w, oauthHelper, authorizeRequester, downstreamIssuer, upstream,
 			fosite.ErrAccessDenied.WithHint(
 				"Resource owner password credentials grant is not allowed for this upstream provider according to its configuration."), true)
 	}
@@ -170,26 +251,27 @@ func handleAuthRequestForOIDCUpstreamPasswordGrant(
 		// However, the exact response is undefined in the sense that there is no such thing as a password grant in
 		// the OIDC spec, so we don't try too hard to read the upstream errors in this case. (E.g. Dex departs from the
 		// spec and returns something other than an "invalid_grant" error for bad resource owner credentials.)
-		return writeAuthorizeError(w, oauthHelper, authorizeRequester,
+		return writeAuthorizeError(r, w, oauthHelper, authorizeRequester, downstreamIssuer, upstream,
 			fosite.ErrAccessDenied.WithDebug(err.Error()), true) // WithDebug hides the error from the client
 	}
 
 	subject, username, groups, err := downstreamsession.GetDownstreamIdentityFromUpstreamIDToken(oidcUpstream, token.IDToken.Claims)
 	if err != nil {
 		// Return a user-friendly error for this case which is entirely within our control.
-		return writeAuthorizeError(w, oauthHelper, authorizeRequester,
+		return writeAuthorizeError(r, w, oauthHelper, authorizeRequester, downstreamIssuer, upstream,
 			fosite.ErrAccessDenied.WithHintf("Reason: %s.", err.Error()), true,
 		)
 	}
 
-	customSessionData, err := downstreamsession.MakeDownstreamOIDCCustomSessionData(oidcUpstream, token)
+	customSessionData, err := downstreamsession.MakeDownstreamOIDCCustomSessionData(oidcUpstream, token, userInfoPassthroughClaims)
 	if err != nil {
-		return writeAuthorizeError(w, oauthHelper, authorizeRequester,
+		return writeAuthorizeError(r, w, oauthHelper, authorizeRequester, downstreamIssuer, upstream,
 			fosite.ErrAccessDenied.WithHintf("Reason: %s.", err.Error()), true,
 		)
 	}
 
-	return makeDownstreamSessionAndReturnAuthcodeRedirect(r, w, oauthHelper, authorizeRequester, subject, username, groups, customSessionData)
+	return makeDownstreamSessionAndReturnAuthcodeRedirect(r, w,
+		oauthHelper, authorizeRequester, downstreamIssuer, subject, username, groups, customSessionData, idTransforms)
 }
 
 func handleAuthRequestForOIDCUpstreamAuthcodeGrant(
@@ -204,9 +286,118 @@ func handleAuthRequestForOIDCUpstreamAuthcodeGrant(
 	upstreamStateEncoder oidc.Encoder,
 	cookieCodec oidc.Codec,
 ) error {
-	authorizeRequester, created := newAuthorizeRequest(r, w, oauthHelper, false)
+	authRequestState, err := handleBrowserFlowAuthRequest(r, w,
+		oauthHelper,
+		generateCSRF, generateNonce, generatePKCE,
+		oidcUpstream.GetName(),
+		psession.ProviderTypeOIDC,
+		oidcUpstream.GetResourceUID(),
+		downstreamIssuer,
+		upstreamStateEncoder,
+		cookieCodec,
+	)
+	if err != nil || authRequestState == nil {
+		return err
+	}
+
+	upstreamOAuthConfig := oauth2.Config{
+		ClientID: oidcUpstream.GetClientID(),
+		Endpoint: oauth2.Endpoint{
+			AuthURL: oidcUpstream.GetAuthorizationURL().String(),
+		},
+		RedirectURL: fmt.Sprintf("%s/callback", downstreamIssuer),
+		Scopes:      oidcUpstream.GetScopes(),
+	}
+
+	authCodeOptions := []oauth2.AuthCodeOption{
+		authRequestState.nonce.Param(),
+		authRequestState.pkce.Challenge(),
+		authRequestState.pkce.Method(),
+	}
+
+	for key, val := range oidcUpstream.GetAdditionalAuthcodeParams() {
+		authCodeOptions = append(authCodeOptions, oauth2.SetAuthURLParam(key, val))
+	}
+
+	http.Redirect(w, r,
+		upstreamOAuthConfig.AuthCodeURL(
+			authRequestState.encodedStateParam,
+			authCodeOptions...,
+		),
+		http.StatusSeeOther, // match fosite and https://tools.ietf.org/id/draft-ietf-oauth-security-topics-18.html#section-4.11
+	)
+
+	return nil
+}
+
+// handleAuthRequestForLDAPUpstreamBrowserFlow redirects the browser to the Supervisor's own login page, which asks
+// the end user for their LDAP or Active Directory username and password. The login page finishes the authorization
+// request by redirecting back to the client with an authcode after the upstream provider accepts the credentials.
+func handleAuthRequestForLDAPUpstreamBrowserFlow(
+	r *http.Request,
+	w http.ResponseWriter,
+	oauthHelper fosite.OAuth2Provider,
+	generateCSRF func() (csrftoken.CSRFToken, error),
+	generateNonce func() (nonce.Nonce, error),
+	generatePKCE func() (pkce.Code, error),
+	ldapUpstream provider.UpstreamLDAPIdentityProviderI,
+	idpType psession.ProviderType,
+	downstreamIssuer string,
+	upstreamStateEncoder oidc.Encoder,
+	cookieCodec oidc.Codec,
+) error {
+	authRequestState, err := handleBrowserFlowAuthRequest(r, w,
+		oauthHelper,
+		generateCSRF, generateNonce, generatePKCE,
+		ldapUpstream.GetName(),
+		idpType,
+		ldapUpstream.GetResourceUID(),
+		downstreamIssuer,
+		upstreamStateEncoder,
+		cookieCodec,
+	)
+	if err != nil || authRequestState == nil {
+		return err
+	}
+
+	http.Redirect(w, r,
+		downstreamIssuer+oidc.PinnipedLoginPath+"?"+url.Values{"state": {authRequestState.encodedStateParam}}.Encode(),
+		http.StatusSeeOther, // match fosite and https://tools.ietf.org/id/draft-ietf-oauth-security-topics-18.html#section-4.11
+	)
+
+	return nil
+}
+
+// browserFlowAuthRequestState is the result of handleBrowserFlowAuthRequest.
+type browserFlowAuthRequestState struct {
+	encodedStateParam string
+	pkce              pkce.Code
+	nonce             nonce.Nonce
+}
+
+// handleBrowserFlowAuthRequest performs the validations and setup which are shared by the browser-based flows of all
+// types of upstream IDPs. It encodes the authorization request into the upstream state param and makes sure that the
+// browser has a CSRF cookie to match it. When it returns nil state and nil error, then it has already written an
+// error response.
+func handleBrowserFlowAuthRequest(
+	r *http.Request,
+	w http.ResponseWriter,
+	oauthHelper fosite.OAuth2Provider,
+	generateCSRF func() (csrftoken.CSRFToken, error),
+	generateNonce func() (nonce.Nonce, error),
+	generatePKCE func() (pkce.Code, error),
+	upstreamName string,
+	upstreamType psession.ProviderType,
+	upstreamUID types.UID,
+	downstreamIssuer string,
+	upstreamStateEncoder oidc.Encoder,
+	cookieCodec oidc.Codec,
+) (*browserFlowAuthRequestState, error) {
+	upstream := oidc.AuditIdentityProvider(upstreamName, upstreamType, string(upstreamUID))
+
+	authorizeRequester, created := newAuthorizeRequest(r, w, oauthHelper, downstreamIssuer, upstream, false)
 	if !created {
-		return nil
+		return nil, nil
 	}
 
 	now := time.Now()
@@ -214,38 +405,30 @@ func handleAuthRequestForOIDCUpstreamAuthcodeGrant(
 		Fosite: &openid.DefaultSession{
 			Claims: &jwt.IDTokenClaims{
 				// Temporary claim values to allow `NewAuthorizeResponse` to perform other OIDC validations.
-				Subject:     "none",
+				Subject:     browserFlowTemporarySubject,
 				AuthTime:    now,
 				RequestedAt: now,
 			},
 		},
 	})
 	if err != nil {
-		return writeAuthorizeError(w, oauthHelper, authorizeRequester, err, false)
+		return nil, writeAuthorizeError(r, w, oauthHelper, authorizeRequester, downstreamIssuer, upstream, err, false)
 	}
 
 	csrfValue, nonceValue, pkceValue, err := generateValues(generateCSRF, generateNonce, generatePKCE)
 	if err != nil {
 		plog.Error("authorize generate error", err)
-		return err
+		return nil, err
 	}
 	csrfFromCookie := readCSRFCookie(r, cookieCodec)
 	if csrfFromCookie != "" {
 		csrfValue = csrfFromCookie
 	}
 
-	upstreamOAuthConfig := oauth2.Config{
-		ClientID: oidcUpstream.GetClientID(),
-		Endpoint: oauth2.Endpoint{
-			AuthURL: oidcUpstream.GetAuthorizationURL().String(),
-		},
-		RedirectURL: fmt.Sprintf("%s/callback", downstreamIssuer),
-		Scopes:      oidcUpstream.GetScopes(),
-	}
-
 	encodedStateParamValue, err := upstreamStateParam(
 		authorizeRequester,
-		oidcUpstream.GetName(),
+		upstreamName,
+		upstreamType,
 		nonceValue,
 		csrfValue,
 		pkceValue,
@@ -253,22 +436,12 @@ func handleAuthRequestForOIDCUpstreamAuthcodeGrant(
 	)
 	if err != nil {
 		plog.Error("authorize upstream state param error", err)
-		return err
-	}
-
-	authCodeOptions := []oauth2.AuthCodeOption{
-		nonceValue.Param(),
-		pkceValue.Challenge(),
-		pkceValue.Method(),
+		return nil, err
 	}
 
 	promptParam := r.Form.Get(promptParamName)
 	if promptParam == promptParamNone && oidc.ScopeWasRequested(authorizeRequester, coreosoidc.ScopeOpenID) {
-		return writeAuthorizeError(w, oauthHelper, authorizeRequester, fosite.ErrLoginRequired, false)
-	}
-
-	for key, val := range oidcUpstream.GetAdditionalAuthcodeParams() {
-		authCodeOptions = append(authCodeOptions, oauth2.SetAuthURLParam(key, val))
+		return nil, writeAuthorizeError(r, w, oauthHelper, authorizeRequester, downstreamIssuer, upstream, fosite.ErrLoginRequired, false)
 	}
 
 	if csrfFromCookie == "" {
@@ -276,22 +449,33 @@ func handleAuthRequestForOIDCUpstreamAuthcodeGrant(
 		err := addCSRFSetCookieHeader(w, csrfValue, cookieCodec)
 		if err != nil {
 			plog.Error("error setting CSRF cookie", err)
-			return err
+			return nil, err
 		}
 	}
 
-	http.Redirect(w, r,
-		upstreamOAuthConfig.AuthCodeURL(
-			encodedStateParamValue,
-			authCodeOptions...,
-		),
-		http.StatusSeeOther, // match fosite and https://tools.ietf.org/id/draft-ietf-oauth-security-topics-18.html#section-4.11
-	)
+	// The authorization request is valid, and the browser is sent to the upstream IDP or to the login page. The
+	// outcome of the authentication is recorded by the callback or the login endpoint.
+	recordAuthorizeEvent(r, downstreamIssuer, authorizeRequester, upstream, nil)
 
-	return nil
+	return &browserFlowAuthRequestState{
+		encodedStateParam: encodedStateParamValue,
+		pkce:              pkceValue,
+		nonce:             nonceValue,
+	}, nil
 }
 
-func writeAuthorizeError(w http.ResponseWriter, oauthHelper fosite.OAuth2Provider, authorizeRequester fosite.AuthorizeRequester, err error, isBrowserless bool) error {
+func writeAuthorizeError(
+	r *http.Request,
+	w http.ResponseWriter,
+	oauthHelper fosite.OAuth2Provider,
+	authorizeRequester fosite.AuthorizeRequester,
+	downstreamIssuer string,
+	upstream *audit.IdentityProvider,
+	err error,
+	isBrowserless bool,
+) error {
+	recordAuthorizeEvent(r, downstreamIssuer, authorizeRequester, upstream, err)
+
 	if plog.Enabled(plog.LevelTrace) {
 		// When trace level logging is enabled, include the stack trace in the log message.
 		keysAndValues := oidc.FositeErrorForLog(err)
@@ -317,18 +501,34 @@ func makeDownstreamSessionAndReturnAuthcodeRedirect(
 	w http.ResponseWriter,
 	oauthHelper fosite.OAuth2Provider,
 	authorizeRequester fosite.AuthorizeRequester,
+	downstreamIssuer string,
 	subject string,
 	username string,
 	groups []string,
 	customSessionData *psession.CustomSessionData,
+	idTransforms *idtransform.TransformationPipeline,
 ) error {
-	openIDSession := downstreamsession.MakeDownstreamSession(subject, username, groups, customSessionData)
+	// Remember the upstream identity so the identity transformations can be applied again during refresh.
+	customSessionData.UpstreamUsername = username
+	customSessionData.UpstreamGroups = groups
+
+	upstream := oidc.AuditIdentityProvider(customSessionData.ProviderName, customSessionData.ProviderType, string(customSessionData.ProviderUID))
+
+	username, groups, err := downstreamsession.ApplyIdentityTransformations(idTransforms, username, groups)
+	if err != nil {
+		return writeAuthorizeError(r, w, oauthHelper, authorizeRequester, downstreamIssuer, upstream,
+			fosite.ErrAccessDenied.WithHintf("Reason: %s.", err.Error()), true,
+		)
+	}
+
+	openIDSession := downstreamsession.MakeDownstreamSession(authorizeRequester.GetID(), subject, username, groups, customSessionData)
 
 	authorizeResponder, err := oauthHelper.NewAuthorizeResponse(r.Context(), authorizeRequester, openIDSession)
 	if err != nil {
-		return writeAuthorizeError(w, oauthHelper, authorizeRequester, err, true)
+		return writeAuthorizeError(r, w, oauthHelper, authorizeRequester, downstreamIssuer, upstream, err, true)
 	}
 
+	recordAuthorizeEvent(r, downstreamIssuer, authorizeRequester, upstream, nil)
 	w = rewriteStatusSeeOtherToStatusFoundForBrowserless(w)
 	oauthHelper.WriteAuthorizeResponse(w, authorizeRequester, authorizeResponder)
 
@@ -358,21 +558,35 @@ func rewriteStatusSeeOtherToStatusFoundForBrowserless(w http.ResponseWriter) htt
 	})
 }
 
-func requireNonEmptyUsernameAndPasswordHeaders(r *http.Request, w http.ResponseWriter, oauthHelper fosite.OAuth2Provider, authorizeRequester fosite.AuthorizeRequester) (string, string, bool) {
+func requireNonEmptyUsernameAndPasswordHeaders(
+	r *http.Request,
+	w http.ResponseWriter,
+	oauthHelper fosite.OAuth2Provider,
+	authorizeRequester fosite.AuthorizeRequester,
+	downstreamIssuer string,
+	upstream *audit.IdentityProvider,
+) (string, string, bool) {
 	username := r.Header.Get(supervisoroidc.AuthorizeUsernameHeaderName)
 	password := r.Header.Get(supervisoroidc.AuthorizePasswordHeaderName)
 	if username == "" || password == "" {
-		_ = writeAuthorizeError(w, oauthHelper, authorizeRequester,
+		_ = writeAuthorizeError(r, w, oauthHelper, authorizeRequester, downstreamIssuer, upstream,
 			fosite.ErrAccessDenied.WithHintf("Missing or blank username or password."), true)
 		return "", "", false
 	}
 	return username, password, true
 }
 
-func newAuthorizeRequest(r *http.Request, w http.ResponseWriter, oauthHelper fosite.OAuth2Provider, isBrowserless bool) (fosite.AuthorizeRequester, bool) {
+func newAuthorizeRequest(
+	r *http.Request,
+	w http.ResponseWriter,
+	oauthHelper fosite.OAuth2Provider,
+	downstreamIssuer string,
+	upstream *audit.IdentityProvider,
+	isBrowserless bool,
+) (fosite.AuthorizeRequester, bool) {
 	authorizeRequester, err := oauthHelper.NewAuthorizeRequest(r.Context(), r)
 	if err != nil {
-		_ = writeAuthorizeError(w, oauthHelper, authorizeRequester, err, isBrowserless)
+		_ = writeAuthorizeError(r, w, oauthHelper, authorizeRequester, downstreamIssuer, upstream, err, isBrowserless)
 		return nil, false
 	}
 
@@ -385,6 +599,44 @@ func newAuthorizeRequest(r *http.Request, w http.ResponseWriter, oauthHelper fos
 	return authorizeRequester, true
 }
 
+// recordAuthorizeEvent records the audit event of an authorization request. The upstream is nil when the upstream IDP
+// was not chosen yet, and the authorizeRequester is nil when the request was not parsed yet.
+func recordAuthorizeEvent(
+	r *http.Request,
+	downstreamIssuer string,
+	authorizeRequester fosite.AuthorizeRequester,
+	upstream *audit.IdentityProvider,
+	err error,
+) {
+	event := oidc.NewAuditEvent(audit.TypeAuthorize, downstreamIssuer, authorizeRequester).Failure(oidc.FositeErrorForAudit(err))
+	if event.Subject == browserFlowTemporarySubject {
+		// This is not a real identity. The browser flows learn the identity later, at the callback or login endpoint.
+		event.Subject = ""
+	}
+	if event.IdentityProvider == nil {
+		event.IdentityProvider = upstream
+	}
+	audit.RecordRequest(r, event)
+}
+
+// validateDeviceUserCodeParam only allows the device user code param when the browser also has the device approval
+// cookie for the same user code, i.e. when the user confirmed the code on the device verification page. Otherwise,
+// a link to the authorization endpoint with someone else's user code could log the user in on that device.
+func validateDeviceUserCodeParam(r *http.Request, cookieDecoder oidc.Decoder) error {
+	userCode := r.Form.Get(oidc.DeviceUserCodeParamName)
+	if userCode == "" {
+		return nil
+	}
+	approval, err := oidc.ReadDeviceApprovalCookie(r, cookieDecoder)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(approval.UserCode), []byte(userCode)) != 1 {
+		return httperr.Newf(http.StatusForbidden, "the %s param was not confirmed on the device verification page", oidc.DeviceUserCodeParamName)
+	}
+	return nil
+}
+
 func readCSRFCookie(r *http.Request, codec oidc.Decoder) csrftoken.CSRFToken {
 	receivedCSRFCookie, err := r.Cookie(oidc.CSRFCookieName)
 	if err != nil {
@@ -404,39 +656,104 @@ func readCSRFCookie(r *http.Request, codec oidc.Decoder) csrftoken.CSRFToken {
 	return csrfFromCookie
 }
 
-// Select either an OIDC, an LDAP or an AD IDP, or return an error.
-func chooseUpstreamIDP(idpLister oidc.UpstreamIdentityProvidersLister) (provider.UpstreamOIDCIdentityProviderI, provider.UpstreamLDAPIdentityProviderI, psession.ProviderType, error) {
+// hasCLICredentialHeaders returns true when the client sent a username or password header, which means that
+// it is trying to log in without a web browser.
+func hasCLICredentialHeaders(r *http.Request) bool {
+	return len(r.Header.Values(supervisoroidc.AuthorizeUsernameHeaderName)) > 0 ||
+		len(r.Header.Values(supervisoroidc.AuthorizePasswordHeaderName)) > 0
+}
+
+func countUpstreamIDPs(idpLister oidc.UpstreamIdentityProvidersLister) int {
+	return len(idpLister.GetOIDCIdentityProviders()) +
+		len(idpLister.GetLDAPIdentityProviders()) +
+		len(idpLister.GetActiveDirectoryIdentityProviders())
+}
+
+// Select either an OIDC, an LDAP or an AD IDP, or return an error. When idpNameParam is empty, then there must
+// be exactly one configured IDP, which is selected. Otherwise, select the IDP with that name. The idpTypeParam
+// is optional, and is only needed to disambiguate IDPs of different types which happen to have the same name.
+func chooseUpstreamIDP(
+	idpNameParam string,
+	idpTypeParam string,
+	idpLister oidc.UpstreamIdentityProvidersLister,
+) (provider.UpstreamOIDCIdentityProviderI, provider.UpstreamLDAPIdentityProviderI, psession.ProviderType, error) {
 	oidcUpstreams := idpLister.GetOIDCIdentityProviders()
 	ldapUpstreams := idpLister.GetLDAPIdentityProviders()
 	adUpstreams := idpLister.GetActiveDirectoryIdentityProviders()
-	switch {
-	case len(oidcUpstreams)+len(ldapUpstreams)+len(adUpstreams) == 0:
-		return nil, nil, "", httperr.New(
-			http.StatusUnprocessableEntity,
-			"No upstream providers are configured",
-		)
-	case len(oidcUpstreams)+len(ldapUpstreams)+len(adUpstreams) > 1:
-		var upstreamIDPNames []string
-		for _, idp := range oidcUpstreams {
-			upstreamIDPNames = append(upstreamIDPNames, idp.GetName())
+
+	if idpNameParam == "" {
+		switch {
+		case len(oidcUpstreams)+len(ldapUpstreams)+len(adUpstreams) == 0:
+			return nil, nil, "", httperr.New(
+				http.StatusUnprocessableEntity,
+				"No upstream providers are configured",
+			)
+		case len(oidcUpstreams)+len(ldapUpstreams)+len(adUpstreams) > 1:
+			// The caller should have already handled this case, so this is a programming error.
+			return nil, nil, "", httperr.New(
+				http.StatusInternalServerError,
+				"Too many upstream providers are configured",
+			)
+		case len(oidcUpstreams) == 1:
+			return oidcUpstreams[0], nil, psession.ProviderTypeOIDC, nil
+		case len(adUpstreams) == 1:
+			return nil, adUpstreams[0], psession.ProviderTypeActiveDirectory, nil
+		default:
+			return nil, ldapUpstreams[0], psession.ProviderTypeLDAP, nil
+		}
+	}
+
+	typeMatches := func(t psession.ProviderType) bool {
+		return idpTypeParam == "" || idpTypeParam == string(t)
+	}
+
+	var (
+		foundOIDC    provider.UpstreamOIDCIdentityProviderI
+		foundLDAP    provider.UpstreamLDAPIdentityProviderI
+		foundType    psession.ProviderType
+		foundMatches int
+	)
+	if typeMatches(psession.ProviderTypeOIDC) {
+		for _, p := range oidcUpstreams {
+			if p.GetName() == idpNameParam {
+				foundOIDC, foundType = p, psession.ProviderTypeOIDC
+				foundMatches++
+			}
 		}
-		for _, idp := range ldapUpstreams {
-			upstreamIDPNames = append(upstreamIDPNames, idp.GetName())
+	}
+	if typeMatches(psession.ProviderTypeLDAP) {
+		for _, p := range ldapUpstreams {
+			if p.GetName() == idpNameParam {
+				foundLDAP, foundType = p, psession.ProviderTypeLDAP
+				foundMatches++
+			}
 		}
-		for _, idp := range adUpstreams {
-			upstreamIDPNames = append(upstreamIDPNames, idp.GetName())
+	}
+	if typeMatches(psession.ProviderTypeActiveDirectory) {
+		for _, p := range adUpstreams {
+			if p.GetName() == idpNameParam {
+				foundLDAP, foundType = p, psession.ProviderTypeActiveDirectory
+				foundMatches++
+			}
 		}
-		plog.Warning("Too many upstream providers are configured (found: %s)", upstreamIDPNames)
-		return nil, nil, "", httperr.New(
+	}
+
+	switch {
+	case foundMatches == 0:
+		return nil, nil, "", httperr.Newf(
+			http.StatusUnprocessableEntity,
+			"Did not find upstream provider with name %q", idpNameParam,
+		)
+	case foundMatches > 1:
+		return nil, nil, "", httperr.Newf(
 			http.StatusUnprocessableEntity,
-			"Too many upstream providers are configured (support for multiple upstreams is not yet implemented)",
+			"Found multiple upstream providers with name %q, so the %s param must be specified",
+			idpNameParam, supervisoroidc.AuthorizeUpstreamIDPTypeParamName,
 		)
-	case len(oidcUpstreams) == 1:
-		return oidcUpstreams[0], nil, psession.ProviderTypeOIDC, nil
-	case len(adUpstreams) == 1:
-		return nil, adUpstreams[0], psession.ProviderTypeActiveDirectory, nil
+	case foundType == psession.ProviderTypeOIDC:
+		return foundOIDC, nil, foundType, nil
 	default:
-		return nil, ldapUpstreams[0], psession.ProviderTypeLDAP, nil
+		return nil, foundLDAP, foundType, nil
 	}
 }
 
@@ -463,6 +780,7 @@ func generateValues(
 func upstreamStateParam(
 	authorizeRequester fosite.AuthorizeRequester,
 	upstreamName string,
+	upstreamType psession.ProviderType,
 	nonceValue nonce.Nonce,
 	csrfValue csrftoken.CSRFToken,
 	pkceValue pkce.Code,
@@ -471,6 +789,7 @@ func upstreamStateParam(
 	stateParamData := oidc.UpstreamStateParamData{
 		AuthParams:    authorizeRequester.GetRequestForm().Encode(),
 		UpstreamName:  upstreamName,
+		UpstreamType:  string(upstreamType),
 		Nonce:         nonceValue,
 		CSRFToken:     csrfValue,
 		PKCECode:      pkceValue,
@@ -500,8 +819,3 @@ func addCSRFSetCookieHeader(w http.ResponseWriter, csrfValue csrftoken.CSRFToken
 
 	return nil
 }
-
-func downstreamSubjectFromUpstreamLDAP(ldapUpstream provider.UpstreamLDAPIdentityProviderI, authenticateResponse *authenticators.Response) string {
-	ldapURL := *ldapUpstream.GetURL()
-	return downstreamsession.DownstreamLDAPSubject(authenticateResponse.User.GetUID(), ldapURL)
-}
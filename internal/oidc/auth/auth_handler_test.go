@@ -28,6 +28,7 @@ import (
 
 	"go.pinniped.dev/internal/authenticators"
 	"go.pinniped.dev/internal/here"
+	"go.pinniped.dev/internal/idtransform"
 	"go.pinniped.dev/internal/oidc"
 	"go.pinniped.dev/internal/oidc/csrftoken"
 	"go.pinniped.dev/internal/oidc/jwks"
@@ -205,6 +206,12 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			"state":             happyState,
 		}
 
+		fositeAccessDeniedWithIdentityPolicyRejectedHintErrorQuery = map[string]string{
+			"error":             "access_denied",
+			"error_description": "The resource owner or authorization server denied the request. Reason: configured identity policy rejected this authentication: members of group2 may not log in.",
+			"state":             happyState,
+		}
+
 		fositeLoginRequiredErrorQuery = map[string]string{
 			"error":             "login_required",
 			"error_description": "The Authorization Server requires End-User authentication.",
@@ -220,12 +227,12 @@ func TestAuthorizationEndpoint(t *testing.T) {
 	createOauthHelperWithRealStorage := func(secretsClient v1.SecretInterface) (fosite.OAuth2Provider, *oidc.KubeStorage) {
 		// Configure fosite the same way that the production code would when using Kube storage.
 		// Inject this into our test subject at the last second so we get a fresh storage for every test.
-		kubeOauthStore := oidc.NewKubeStorage(secretsClient, timeoutsConfiguration)
+		kubeOauthStore := oidc.NewKubeStorage(secretsClient, oidctestutil.NewClientManager(t, "some-namespace", nil, nil), timeoutsConfiguration)
 		return oidc.FositeOauth2Helper(kubeOauthStore, downstreamIssuer, hmacSecretFunc, jwksProviderIsUnused, timeoutsConfiguration), kubeOauthStore
 	}
 
 	// Configure fosite the same way that the production code would, using NullStorage to turn off storage.
-	nullOauthStore := oidc.NullStorage{}
+	nullOauthStore := oidc.NullStorage{ClientManager: oidctestutil.NewClientManager(t, "some-namespace", nil, nil)}
 	oauthHelperWithNullStorage := oidc.FositeOauth2Helper(nullOauthStore, downstreamIssuer, hmacSecretFunc, jwksProviderIsUnused, timeoutsConfiguration)
 
 	upstreamAuthURL, err := url.Parse("https://some-upstream-idp:8443/auth")
@@ -422,6 +429,7 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			oidctestutil.ExpectedUpstreamStateParamFormat{
 				P: encodeQuery(modifiedHappyGetRequestQueryMap(queryOverrides)),
 				U: upstreamName,
+				T: "oidc",
 				N: happyNonce,
 				C: csrf,
 				K: happyPKCE,
@@ -432,6 +440,30 @@ func TestAuthorizationEndpoint(t *testing.T) {
 		return encoded
 	}
 
+	expectedUpstreamStateParamForLDAP := func(queryOverrides map[string]string, csrfValueOverride, upstreamName, upstreamType string) string {
+		csrf := happyCSRF
+		if csrfValueOverride != "" {
+			csrf = csrfValueOverride
+		}
+		encoded, err := happyStateEncoder.Encode("s",
+			oidctestutil.ExpectedUpstreamStateParamFormat{
+				P: encodeQuery(modifiedHappyGetRequestQueryMap(queryOverrides)),
+				U: upstreamName,
+				T: upstreamType,
+				N: happyNonce,
+				C: csrf,
+				K: happyPKCE,
+				V: "1",
+			},
+		)
+		require.NoError(t, err)
+		return encoded
+	}
+
+	expectedRedirectLocationForLoginPage := func(expectedUpstreamState string) string {
+		return urlWithQuery(downstreamIssuer+"/login", map[string]string{"state": expectedUpstreamState})
+	}
+
 	expectedRedirectLocationForUpstreamOIDC := func(expectedUpstreamState string, expectedAdditionalParams map[string]string) string {
 		query := map[string]string{
 			"response_type":         "code",
@@ -450,11 +482,13 @@ func TestAuthorizationEndpoint(t *testing.T) {
 	}
 
 	expectedHappyActiveDirectoryUpstreamCustomSession := &psession.CustomSessionData{
-		ProviderUID:  activeDirectoryUpstreamResourceUID,
-		ProviderName: activeDirectoryUpstreamName,
-		ProviderType: psession.ProviderTypeActiveDirectory,
-		OIDC:         nil,
-		LDAP:         nil,
+		ProviderUID:      activeDirectoryUpstreamResourceUID,
+		ProviderName:     activeDirectoryUpstreamName,
+		ProviderType:     psession.ProviderTypeActiveDirectory,
+		UpstreamUsername: happyLDAPUsernameFromAuthenticator,
+		UpstreamGroups:   happyLDAPGroups,
+		OIDC:             nil,
+		LDAP:             nil,
 		ActiveDirectory: &psession.ActiveDirectorySessionData{
 			UserDN:                 happyLDAPUserDN,
 			ExtraRefreshAttributes: map[string]string{happyLDAPExtraRefreshAttribute: happyLDAPExtraRefreshValue},
@@ -462,10 +496,12 @@ func TestAuthorizationEndpoint(t *testing.T) {
 	}
 
 	expectedHappyLDAPUpstreamCustomSession := &psession.CustomSessionData{
-		ProviderUID:  ldapUpstreamResourceUID,
-		ProviderName: ldapUpstreamName,
-		ProviderType: psession.ProviderTypeLDAP,
-		OIDC:         nil,
+		ProviderUID:      ldapUpstreamResourceUID,
+		ProviderName:     ldapUpstreamName,
+		ProviderType:     psession.ProviderTypeLDAP,
+		UpstreamUsername: happyLDAPUsernameFromAuthenticator,
+		UpstreamGroups:   happyLDAPGroups,
+		OIDC:             nil,
 		LDAP: &psession.LDAPSessionData{
 			UserDN:                 happyLDAPUserDN,
 			ExtraRefreshAttributes: map[string]string{happyLDAPExtraRefreshAttribute: happyLDAPExtraRefreshValue},
@@ -474,9 +510,11 @@ func TestAuthorizationEndpoint(t *testing.T) {
 	}
 
 	expectedHappyOIDCPasswordGrantCustomSession := &psession.CustomSessionData{
-		ProviderUID:  oidcPasswordGrantUpstreamResourceUID,
-		ProviderName: oidcPasswordGrantUpstreamName,
-		ProviderType: psession.ProviderTypeOIDC,
+		ProviderUID:      oidcPasswordGrantUpstreamResourceUID,
+		ProviderName:     oidcPasswordGrantUpstreamName,
+		ProviderType:     psession.ProviderTypeOIDC,
+		UpstreamUsername: oidcUpstreamUsername,
+		UpstreamGroups:   oidcUpstreamGroupMembership,
 		OIDC: &psession.OIDCSessionData{
 			UpstreamRefreshToken: oidcPasswordGrantUpstreamRefreshToken,
 			UpstreamSubject:      oidcUpstreamSubject,
@@ -485,9 +523,11 @@ func TestAuthorizationEndpoint(t *testing.T) {
 	}
 
 	expectedHappyOIDCPasswordGrantCustomSessionWithAccessToken := &psession.CustomSessionData{
-		ProviderUID:  oidcPasswordGrantUpstreamResourceUID,
-		ProviderName: oidcPasswordGrantUpstreamName,
-		ProviderType: psession.ProviderTypeOIDC,
+		ProviderUID:      oidcPasswordGrantUpstreamResourceUID,
+		ProviderName:     oidcPasswordGrantUpstreamName,
+		ProviderType:     psession.ProviderTypeOIDC,
+		UpstreamUsername: oidcUpstreamUsername,
+		UpstreamGroups:   oidcUpstreamGroupMembership,
 		OIDC: &psession.OIDCSessionData{
 			UpstreamAccessToken: oidcUpstreamAccessToken,
 			UpstreamSubject:     oidcUpstreamSubject,
@@ -495,29 +535,51 @@ func TestAuthorizationEndpoint(t *testing.T) {
 		},
 	}
 
+	prefixAndFilterTransforms := idtransform.NewTransformationPipeline()
+	prefixAndFilterTransforms.AppendTransformation(idtransform.NewUsernamePrefixTransformation("prefix:"))
+	groupsFilterTransform, err := idtransform.NewGroupsFilterTransformation(`^group[12]$`, false)
+	require.NoError(t, err)
+	prefixAndFilterTransforms.AppendTransformation(groupsFilterTransform)
+
+	rejectGroup2Transforms := idtransform.NewTransformationPipeline()
+	rejectGroup2Policy, err := idtransform.NewRejectPolicy("", `^group2$`, "members of group2 may not log in")
+	require.NoError(t, err)
+	rejectGroup2Transforms.AppendTransformation(rejectGroup2Policy)
+
+	withUpstreamIdentity := func(customSessionData *psession.CustomSessionData, username string, groups []string) *psession.CustomSessionData {
+		copied := *customSessionData
+		copied.UpstreamUsername = username
+		copied.UpstreamGroups = groups
+		return &copied
+	}
+
 	// Note that fosite puts the granted scopes as a param in the redirect URI even though the spec doesn't seem to require it
 	happyAuthcodeDownstreamRedirectLocationRegexp := downstreamRedirectURI + `\?code=([^&]+)&scope=openid&state=` + happyState
 
 	incomingCookieCSRFValue := "csrf-value-from-cookie"
 	encodedIncomingCookieCSRFValue, err := happyCookieEncoder.Encode("csrf", incomingCookieCSRFValue)
 	require.NoError(t, err)
+	encodedIncomingDeviceApproval, err := happyCookieEncoder.Encode("device-approval", &oidc.DeviceApproval{UserCode: "BCDF-GHJK", Token: "some-approval-token"})
+	require.NoError(t, err)
 
 	type testCase struct {
 		name string
 
-		idps                 *oidctestutil.UpstreamIDPListerBuilder
-		generateCSRF         func() (csrftoken.CSRFToken, error)
-		generatePKCE         func() (pkce.Code, error)
-		generateNonce        func() (nonce.Nonce, error)
-		stateEncoder         oidc.Codec
-		cookieEncoder        oidc.Codec
-		method               string
-		path                 string
-		contentType          string
-		body                 string
-		csrfCookie           string
-		customUsernameHeader *string // nil means do not send header, empty means send header with empty value
-		customPasswordHeader *string // nil means do not send header, empty means send header with empty value
+		idps                      *oidctestutil.UpstreamIDPListerBuilder
+		idpTransforms             []provider.FederationDomainIdentityProvider
+		userInfoPassthroughClaims []string
+		generateCSRF              func() (csrftoken.CSRFToken, error)
+		generatePKCE              func() (pkce.Code, error)
+		generateNonce             func() (nonce.Nonce, error)
+		stateEncoder              oidc.Codec
+		cookieEncoder             oidc.Codec
+		method                    string
+		path                      string
+		contentType               string
+		body                      string
+		csrfCookie                string
+		customUsernameHeader      *string // nil means do not send header, empty means send header with empty value
+		customPasswordHeader      *string // nil means do not send header, empty means send header with empty value
 
 		wantStatus                             int
 		wantContentType                        string
@@ -584,6 +646,157 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
 			wantDownstreamCustomSessionData:   expectedHappyOIDCPasswordGrantCustomSession,
 		},
+		{
+			name: "OIDC upstream password grant happy path copies configured userinfo passthrough claims into the session",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+				passwordGrantUpstreamOIDCIdentityProviderBuilder().WithIDTokenClaim("email", "joe@whitehouse.gov").Build(),
+			),
+			userInfoPassthroughClaims:         []string{"email"},
+			method:                            http.MethodGet,
+			path:                              happyGetRequestPath,
+			customUsernameHeader:              pointer.StringPtr(oidcUpstreamUsername),
+			customPasswordHeader:              pointer.StringPtr(oidcUpstreamPassword),
+			wantPasswordGrantCall:             happyUpstreamPasswordGrantMockExpectation,
+			wantStatus:                        http.StatusFound,
+			wantContentType:                   htmlContentType,
+			wantRedirectLocationRegexp:        happyAuthcodeDownstreamRedirectLocationRegexp,
+			wantDownstreamIDTokenSubject:      oidcUpstreamIssuer + "?sub=" + oidcUpstreamSubjectQueryEscaped,
+			wantDownstreamIDTokenUsername:     oidcUpstreamUsername,
+			wantDownstreamIDTokenGroups:       oidcUpstreamGroupMembership,
+			wantDownstreamRequestedScopes:     happyDownstreamScopesRequested,
+			wantDownstreamRedirectURI:         downstreamRedirectURI,
+			wantDownstreamGrantedScopes:       happyDownstreamScopesGranted,
+			wantDownstreamNonce:               downstreamNonce,
+			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
+			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
+			wantDownstreamCustomSessionData: &psession.CustomSessionData{
+				ProviderUID:      oidcPasswordGrantUpstreamResourceUID,
+				ProviderName:     oidcPasswordGrantUpstreamName,
+				ProviderType:     psession.ProviderTypeOIDC,
+				UpstreamUsername: oidcUpstreamUsername,
+				UpstreamGroups:   oidcUpstreamGroupMembership,
+				OIDC: &psession.OIDCSessionData{
+					UpstreamRefreshToken: oidcPasswordGrantUpstreamRefreshToken,
+					UpstreamSubject:      oidcUpstreamSubject,
+					UpstreamIssuer:       oidcUpstreamIssuer,
+					PassthroughClaims:    map[string]interface{}{"email": "joe@whitehouse.gov"},
+				},
+			},
+		},
+		{
+			name:                                   "LDAP upstream browser flow happy path using GET without a CSRF cookie",
+			idps:                                   oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			generateCSRF:                           happyCSRFGenerator,
+			generatePKCE:                           happyPKCEGenerator,
+			generateNonce:                          happyNonceGenerator,
+			stateEncoder:                           happyStateEncoder,
+			cookieEncoder:                          happyCookieEncoder,
+			method:                                 http.MethodGet,
+			path:                                   happyGetRequestPath,
+			wantStatus:                             http.StatusSeeOther,
+			wantContentType:                        htmlContentType,
+			wantCSRFValueInCookieHeader:            happyCSRF,
+			wantLocationHeader:                     expectedRedirectLocationForLoginPage(expectedUpstreamStateParamForLDAP(nil, "", ldapUpstreamName, "ldap")),
+			wantUpstreamStateParamInLocationHeader: true,
+			wantBodyStringWithLocationInHref:       true,
+		},
+		{
+			name:                                   "Active Directory upstream browser flow happy path using GET without a CSRF cookie",
+			idps:                                   oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(&upstreamActiveDirectoryIdentityProvider),
+			generateCSRF:                           happyCSRFGenerator,
+			generatePKCE:                           happyPKCEGenerator,
+			generateNonce:                          happyNonceGenerator,
+			stateEncoder:                           happyStateEncoder,
+			cookieEncoder:                          happyCookieEncoder,
+			method:                                 http.MethodGet,
+			path:                                   happyGetRequestPath,
+			wantStatus:                             http.StatusSeeOther,
+			wantContentType:                        htmlContentType,
+			wantCSRFValueInCookieHeader:            happyCSRF,
+			wantLocationHeader:                     expectedRedirectLocationForLoginPage(expectedUpstreamStateParamForLDAP(nil, "", activeDirectoryUpstreamName, "activedirectory")),
+			wantUpstreamStateParamInLocationHeader: true,
+			wantBodyStringWithLocationInHref:       true,
+		},
+		{
+			name:                                   "LDAP upstream browser flow happy path using GET with a CSRF cookie",
+			idps:                                   oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			generateCSRF:                           happyCSRFGenerator,
+			generatePKCE:                           happyPKCEGenerator,
+			generateNonce:                          happyNonceGenerator,
+			stateEncoder:                           happyStateEncoder,
+			cookieEncoder:                          happyCookieEncoder,
+			method:                                 http.MethodGet,
+			path:                                   happyGetRequestPath,
+			csrfCookie:                             "__Host-pinniped-csrf=" + encodedIncomingCookieCSRFValue + " ",
+			wantStatus:                             http.StatusSeeOther,
+			wantContentType:                        htmlContentType,
+			wantLocationHeader:                     expectedRedirectLocationForLoginPage(expectedUpstreamStateParamForLDAP(nil, incomingCookieCSRFValue, ldapUpstreamName, "ldap")),
+			wantUpstreamStateParamInLocationHeader: true,
+			wantBodyStringWithLocationInHref:       true,
+		},
+		{
+			name:                                   "LDAP upstream browser flow happy path using POST",
+			idps:                                   oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			generateCSRF:                           happyCSRFGenerator,
+			generatePKCE:                           happyPKCEGenerator,
+			generateNonce:                          happyNonceGenerator,
+			stateEncoder:                           happyStateEncoder,
+			cookieEncoder:                          happyCookieEncoder,
+			method:                                 http.MethodPost,
+			path:                                   "/some/path",
+			contentType:                            "application/x-www-form-urlencoded",
+			body:                                   encodeQuery(happyGetRequestQueryMap),
+			wantStatus:                             http.StatusSeeOther,
+			wantContentType:                        "",
+			wantBodyString:                         "",
+			wantCSRFValueInCookieHeader:            happyCSRF,
+			wantLocationHeader:                     expectedRedirectLocationForLoginPage(expectedUpstreamStateParamForLDAP(nil, "", ldapUpstreamName, "ldap")),
+			wantUpstreamStateParamInLocationHeader: true,
+		},
+		{
+			name:               "LDAP upstream browser flow with prompt param none throws an error because the user must use the login page",
+			idps:               oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			generateCSRF:       happyCSRFGenerator,
+			generatePKCE:       happyPKCEGenerator,
+			generateNonce:      happyNonceGenerator,
+			stateEncoder:       happyStateEncoder,
+			cookieEncoder:      happyCookieEncoder,
+			method:             http.MethodGet,
+			path:               modifiedHappyGetRequestPath(map[string]string{"prompt": "none"}),
+			wantStatus:         http.StatusSeeOther,
+			wantContentType:    "application/json; charset=utf-8",
+			wantLocationHeader: urlWithQuery(downstreamRedirectURI, fositeLoginRequiredErrorQuery),
+			wantBodyString:     "",
+		},
+		{
+			name:               "response type is unsupported when using LDAP upstream browser flow",
+			idps:               oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			generateCSRF:       happyCSRFGenerator,
+			generatePKCE:       happyPKCEGenerator,
+			generateNonce:      happyNonceGenerator,
+			stateEncoder:       happyStateEncoder,
+			cookieEncoder:      happyCookieEncoder,
+			method:             http.MethodGet,
+			path:               modifiedHappyGetRequestPath(map[string]string{"response_type": "unsupported"}),
+			wantStatus:         http.StatusSeeOther,
+			wantContentType:    "application/json; charset=utf-8",
+			wantLocationHeader: urlWithQuery(downstreamRedirectURI, fositeUnsupportedResponseTypeErrorQuery),
+			wantBodyString:     "",
+		},
+		{
+			name:            "error while generating CSRF token for LDAP upstream browser flow",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			generateCSRF:    sadCSRFGenerator,
+			generatePKCE:    happyPKCEGenerator,
+			generateNonce:   happyNonceGenerator,
+			stateEncoder:    happyStateEncoder,
+			cookieEncoder:   happyCookieEncoder,
+			method:          http.MethodGet,
+			path:            happyGetRequestPath,
+			wantStatus:      http.StatusInternalServerError,
+			wantContentType: htmlContentType,
+			wantBodyString:  "Internal Server Error: error generating CSRF token\n",
+		},
 		{
 			name:                              "LDAP upstream happy path using GET",
 			idps:                              oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
@@ -626,6 +839,70 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
 			wantDownstreamCustomSessionData:   expectedHappyActiveDirectoryUpstreamCustomSession,
 		},
+		{
+			name: "LDAP upstream happy path using GET with identity transforms",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			idpTransforms: []provider.FederationDomainIdentityProvider{
+				{Name: ldapUpstreamName, Type: psession.ProviderTypeLDAP, Transforms: prefixAndFilterTransforms},
+			},
+			method:                            http.MethodGet,
+			path:                              happyGetRequestPath,
+			customUsernameHeader:              pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader:              pointer.StringPtr(happyLDAPPassword),
+			wantStatus:                        http.StatusFound,
+			wantContentType:                   htmlContentType,
+			wantRedirectLocationRegexp:        happyAuthcodeDownstreamRedirectLocationRegexp,
+			wantDownstreamIDTokenSubject:      upstreamLDAPURL + "&sub=" + happyLDAPUID,
+			wantDownstreamIDTokenUsername:     "prefix:" + happyLDAPUsernameFromAuthenticator,
+			wantDownstreamIDTokenGroups:       []string{"group1", "group2"},
+			wantDownstreamRequestedScopes:     happyDownstreamScopesRequested,
+			wantDownstreamRedirectURI:         downstreamRedirectURI,
+			wantDownstreamGrantedScopes:       happyDownstreamScopesGranted,
+			wantDownstreamNonce:               downstreamNonce,
+			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
+			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
+			wantDownstreamCustomSessionData:   expectedHappyLDAPUpstreamCustomSession,
+		},
+		{
+			name: "OIDC upstream password grant happy path using GET with identity transforms",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(passwordGrantUpstreamOIDCIdentityProviderBuilder().Build()),
+			idpTransforms: []provider.FederationDomainIdentityProvider{
+				{Name: oidcPasswordGrantUpstreamName, Type: psession.ProviderTypeOIDC, Transforms: prefixAndFilterTransforms},
+			},
+			method:                            http.MethodGet,
+			path:                              happyGetRequestPath,
+			customUsernameHeader:              pointer.StringPtr(oidcUpstreamUsername),
+			customPasswordHeader:              pointer.StringPtr(oidcUpstreamPassword),
+			wantPasswordGrantCall:             happyUpstreamPasswordGrantMockExpectation,
+			wantStatus:                        http.StatusFound,
+			wantContentType:                   htmlContentType,
+			wantRedirectLocationRegexp:        happyAuthcodeDownstreamRedirectLocationRegexp,
+			wantDownstreamIDTokenSubject:      oidcUpstreamIssuer + "?sub=" + oidcUpstreamSubjectQueryEscaped,
+			wantDownstreamIDTokenUsername:     "prefix:" + oidcUpstreamUsername,
+			wantDownstreamIDTokenGroups:       []string{},
+			wantDownstreamRequestedScopes:     happyDownstreamScopesRequested,
+			wantDownstreamRedirectURI:         downstreamRedirectURI,
+			wantDownstreamGrantedScopes:       happyDownstreamScopesGranted,
+			wantDownstreamNonce:               downstreamNonce,
+			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
+			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
+			wantDownstreamCustomSessionData:   expectedHappyOIDCPasswordGrantCustomSession,
+		},
+		{
+			name: "LDAP upstream login rejected by identity policy",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			idpTransforms: []provider.FederationDomainIdentityProvider{
+				{Name: ldapUpstreamName, Type: psession.ProviderTypeLDAP, Transforms: rejectGroup2Transforms},
+			},
+			method:               http.MethodGet,
+			path:                 happyGetRequestPath,
+			customUsernameHeader: pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader: pointer.StringPtr(happyLDAPPassword),
+			wantStatus:           http.StatusFound,
+			wantContentType:      "application/json; charset=utf-8",
+			wantLocationHeader:   urlWithQuery(downstreamRedirectURI, fositeAccessDeniedWithIdentityPolicyRejectedHintErrorQuery),
+			wantBodyString:       "",
+		},
 		{
 			name:                                   "OIDC upstream browser flow happy path using GET with a CSRF cookie",
 			idps:                                   oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
@@ -643,6 +920,53 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantUpstreamStateParamInLocationHeader: true,
 			wantBodyStringWithLocationInHref:       true,
 		},
+		{
+			name:                                   "OIDC upstream browser flow with a device user code which was confirmed on the device verification page",
+			idps:                                   oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
+			generateCSRF:                           happyCSRFGenerator,
+			generatePKCE:                           happyPKCEGenerator,
+			generateNonce:                          happyNonceGenerator,
+			stateEncoder:                           happyStateEncoder,
+			cookieEncoder:                          happyCookieEncoder,
+			method:                                 http.MethodGet,
+			path:                                   modifiedHappyGetRequestPath(map[string]string{"pinniped_device_user_code": "BCDF-GHJK"}),
+			csrfCookie:                             "__Host-pinniped-csrf=" + encodedIncomingCookieCSRFValue + "; __Host-pinniped-device-approval=" + encodedIncomingDeviceApproval,
+			wantStatus:                             http.StatusSeeOther,
+			wantContentType:                        htmlContentType,
+			wantLocationHeader:                     expectedRedirectLocationForUpstreamOIDC(expectedUpstreamStateParam(map[string]string{"pinniped_device_user_code": "BCDF-GHJK"}, incomingCookieCSRFValue, ""), nil),
+			wantUpstreamStateParamInLocationHeader: true,
+			wantBodyStringWithLocationInHref:       true,
+		},
+		{
+			name:            "OIDC upstream browser flow with a device user code which was not confirmed on the device verification page, e.g. a link which was crafted by someone else",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
+			generateCSRF:    happyCSRFGenerator,
+			generatePKCE:    happyPKCEGenerator,
+			generateNonce:   happyNonceGenerator,
+			stateEncoder:    happyStateEncoder,
+			cookieEncoder:   happyCookieEncoder,
+			method:          http.MethodGet,
+			path:            modifiedHappyGetRequestPath(map[string]string{"pinniped_device_user_code": "BCDF-GHJK"}),
+			csrfCookie:      "__Host-pinniped-csrf=" + encodedIncomingCookieCSRFValue + " ",
+			wantStatus:      http.StatusForbidden,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBodyString:  "Forbidden: device approval cookie is missing\n",
+		},
+		{
+			name:            "OIDC upstream browser flow with a device approval cookie for another user code",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
+			generateCSRF:    happyCSRFGenerator,
+			generatePKCE:    happyPKCEGenerator,
+			generateNonce:   happyNonceGenerator,
+			stateEncoder:    happyStateEncoder,
+			cookieEncoder:   happyCookieEncoder,
+			method:          http.MethodGet,
+			path:            modifiedHappyGetRequestPath(map[string]string{"pinniped_device_user_code": "ZZZZ-ZZZZ"}),
+			csrfCookie:      "__Host-pinniped-csrf=" + encodedIncomingCookieCSRFValue + "; __Host-pinniped-device-approval=" + encodedIncomingDeviceApproval,
+			wantStatus:      http.StatusForbidden,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBodyString:  "Forbidden: the pinniped_device_user_code param was not confirmed on the device verification page\n",
+		},
 		{
 			name:                                   "OIDC upstream browser flow happy path using POST",
 			idps:                                   oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
@@ -936,10 +1260,12 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
 			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
 			wantDownstreamCustomSessionData: &psession.CustomSessionData{
-				ProviderUID:  oidcPasswordGrantUpstreamResourceUID,
-				ProviderName: oidcPasswordGrantUpstreamName,
-				ProviderType: psession.ProviderTypeOIDC,
-				Warnings:     []string{"Access token from identity provider has lifetime of less than 3 hours. Expect frequent prompts to log in."},
+				ProviderUID:      oidcPasswordGrantUpstreamResourceUID,
+				ProviderName:     oidcPasswordGrantUpstreamName,
+				ProviderType:     psession.ProviderTypeOIDC,
+				UpstreamUsername: oidcUpstreamUsername,
+				UpstreamGroups:   oidcUpstreamGroupMembership,
+				Warnings:         []string{"Access token from identity provider has lifetime of less than 3 hours. Expect frequent prompts to log in."},
 				OIDC: &psession.OIDCSessionData{
 					UpstreamAccessToken: oidcUpstreamAccessToken,
 					UpstreamSubject:     oidcUpstreamSubject,
@@ -1338,24 +1664,28 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantBodyString:       "",
 		},
 		{
-			name:               "response type is unsupported when using LDAP upstream",
-			idps:               oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
-			method:             http.MethodGet,
-			path:               modifiedHappyGetRequestPath(map[string]string{"response_type": "unsupported"}),
-			wantStatus:         http.StatusFound,
-			wantContentType:    "application/json; charset=utf-8",
-			wantLocationHeader: urlWithQuery(downstreamRedirectURI, fositeUnsupportedResponseTypeErrorQuery),
-			wantBodyString:     "",
+			name:                 "response type is unsupported when using LDAP upstream",
+			idps:                 oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method:               http.MethodGet,
+			path:                 modifiedHappyGetRequestPath(map[string]string{"response_type": "unsupported"}),
+			customUsernameHeader: pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader: pointer.StringPtr(happyLDAPPassword),
+			wantStatus:           http.StatusFound,
+			wantContentType:      "application/json; charset=utf-8",
+			wantLocationHeader:   urlWithQuery(downstreamRedirectURI, fositeUnsupportedResponseTypeErrorQuery),
+			wantBodyString:       "",
 		},
 		{
-			name:               "response type is unsupported when using active directory upstream",
-			idps:               oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(&upstreamActiveDirectoryIdentityProvider),
-			method:             http.MethodGet,
-			path:               modifiedHappyGetRequestPath(map[string]string{"response_type": "unsupported"}),
-			wantStatus:         http.StatusFound,
-			wantContentType:    "application/json; charset=utf-8",
-			wantLocationHeader: urlWithQuery(downstreamRedirectURI, fositeUnsupportedResponseTypeErrorQuery),
-			wantBodyString:     "",
+			name:                 "response type is unsupported when using active directory upstream",
+			idps:                 oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(&upstreamActiveDirectoryIdentityProvider),
+			method:               http.MethodGet,
+			path:                 modifiedHappyGetRequestPath(map[string]string{"response_type": "unsupported"}),
+			customUsernameHeader: pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader: pointer.StringPtr(happyLDAPPassword),
+			wantStatus:           http.StatusFound,
+			wantContentType:      "application/json; charset=utf-8",
+			wantLocationHeader:   urlWithQuery(downstreamRedirectURI, fositeUnsupportedResponseTypeErrorQuery),
+			wantBodyString:       "",
 		},
 		{
 			name:               "downstream scopes do not match what is configured for client using OIDC upstream browser flow",
@@ -1436,24 +1766,28 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantBodyString:       "",
 		},
 		{
-			name:               "missing response type in request using LDAP upstream",
-			idps:               oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
-			method:             http.MethodGet,
-			path:               modifiedHappyGetRequestPath(map[string]string{"response_type": ""}),
-			wantStatus:         http.StatusFound,
-			wantContentType:    "application/json; charset=utf-8",
-			wantLocationHeader: urlWithQuery(downstreamRedirectURI, fositeMissingResponseTypeErrorQuery),
-			wantBodyString:     "",
+			name:                 "missing response type in request using LDAP upstream",
+			idps:                 oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method:               http.MethodGet,
+			path:                 modifiedHappyGetRequestPath(map[string]string{"response_type": ""}),
+			customUsernameHeader: pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader: pointer.StringPtr(happyLDAPPassword),
+			wantStatus:           http.StatusFound,
+			wantContentType:      "application/json; charset=utf-8",
+			wantLocationHeader:   urlWithQuery(downstreamRedirectURI, fositeMissingResponseTypeErrorQuery),
+			wantBodyString:       "",
 		},
 		{
-			name:               "missing response type in request using Active Directory upstream",
-			idps:               oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(&upstreamActiveDirectoryIdentityProvider),
-			method:             http.MethodGet,
-			path:               modifiedHappyGetRequestPath(map[string]string{"response_type": ""}),
-			wantStatus:         http.StatusFound,
-			wantContentType:    "application/json; charset=utf-8",
-			wantLocationHeader: urlWithQuery(downstreamRedirectURI, fositeMissingResponseTypeErrorQuery),
-			wantBodyString:     "",
+			name:                 "missing response type in request using Active Directory upstream",
+			idps:                 oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(&upstreamActiveDirectoryIdentityProvider),
+			method:               http.MethodGet,
+			path:                 modifiedHappyGetRequestPath(map[string]string{"response_type": ""}),
+			customUsernameHeader: pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader: pointer.StringPtr(happyLDAPPassword),
+			wantStatus:           http.StatusFound,
+			wantContentType:      "application/json; charset=utf-8",
+			wantLocationHeader:   urlWithQuery(downstreamRedirectURI, fositeMissingResponseTypeErrorQuery),
+			wantBodyString:       "",
 		},
 		{
 			name:            "missing client id in request using OIDC upstream browser flow",
@@ -1792,7 +2126,7 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantDownstreamNonce:               downstreamNonce,
 			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
 			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
-			wantDownstreamCustomSessionData:   expectedHappyOIDCPasswordGrantCustomSession,
+			wantDownstreamCustomSessionData:   withUpstreamIdentity(expectedHappyOIDCPasswordGrantCustomSession, oidcUpstreamIssuer+"?sub="+oidcUpstreamSubjectQueryEscaped, nil),
 		},
 		{
 			name: "OIDC upstream password grant: upstream IDP configures username claim as special claim `email` and `email_verified` upstream claim is missing",
@@ -1818,7 +2152,7 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantDownstreamNonce:               downstreamNonce,
 			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
 			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
-			wantDownstreamCustomSessionData:   expectedHappyOIDCPasswordGrantCustomSession,
+			wantDownstreamCustomSessionData:   withUpstreamIdentity(expectedHappyOIDCPasswordGrantCustomSession, "joe@whitehouse.gov", oidcUpstreamGroupMembership),
 		},
 		{
 			name: "OIDC upstream password grant: upstream IDP configures username claim as special claim `email` and `email_verified` upstream claim is present with true value",
@@ -1845,7 +2179,7 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantDownstreamNonce:               downstreamNonce,
 			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
 			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
-			wantDownstreamCustomSessionData:   expectedHappyOIDCPasswordGrantCustomSession,
+			wantDownstreamCustomSessionData:   withUpstreamIdentity(expectedHappyOIDCPasswordGrantCustomSession, "joe@whitehouse.gov", oidcUpstreamGroupMembership),
 		},
 		{
 			name: "OIDC upstream password grant: upstream IDP configures username claim as anything other than special claim `email` and `email_verified` upstream claim is present with false value",
@@ -1873,7 +2207,7 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantDownstreamNonce:               downstreamNonce,
 			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
 			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
-			wantDownstreamCustomSessionData:   expectedHappyOIDCPasswordGrantCustomSession,
+			wantDownstreamCustomSessionData:   withUpstreamIdentity(expectedHappyOIDCPasswordGrantCustomSession, "joe", oidcUpstreamGroupMembership),
 		},
 		{
 			name: "OIDC upstream password grant: upstream IDP configures username claim as special claim `email` and `email_verified` upstream claim is present with illegal value",
@@ -1933,7 +2267,7 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantDownstreamNonce:               downstreamNonce,
 			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
 			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
-			wantDownstreamCustomSessionData:   expectedHappyOIDCPasswordGrantCustomSession,
+			wantDownstreamCustomSessionData:   withUpstreamIdentity(expectedHappyOIDCPasswordGrantCustomSession, oidcUpstreamSubject, oidcUpstreamGroupMembership),
 		},
 		{
 			name: "OIDC upstream password grant: upstream IDP's configured groups claim in the ID token has a non-array value",
@@ -1958,7 +2292,7 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantDownstreamNonce:               downstreamNonce,
 			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
 			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
-			wantDownstreamCustomSessionData:   expectedHappyOIDCPasswordGrantCustomSession,
+			wantDownstreamCustomSessionData:   withUpstreamIdentity(expectedHappyOIDCPasswordGrantCustomSession, oidcUpstreamUsername, []string{"notAnArrayGroup1 notAnArrayGroup2"}),
 		},
 		{
 			name: "OIDC upstream password grant: upstream IDP's configured groups claim in the ID token is a slice of interfaces",
@@ -1983,7 +2317,7 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantDownstreamNonce:               downstreamNonce,
 			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
 			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
-			wantDownstreamCustomSessionData:   expectedHappyOIDCPasswordGrantCustomSession,
+			wantDownstreamCustomSessionData:   withUpstreamIdentity(expectedHappyOIDCPasswordGrantCustomSession, oidcUpstreamUsername, []string{"group1", "group2"}),
 		},
 		{
 			name: "OIDC upstream password grant: upstream ID token does not contain requested username claim",
@@ -2022,7 +2356,7 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantDownstreamNonce:               downstreamNonce,
 			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
 			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
-			wantDownstreamCustomSessionData:   expectedHappyOIDCPasswordGrantCustomSession,
+			wantDownstreamCustomSessionData:   withUpstreamIdentity(expectedHappyOIDCPasswordGrantCustomSession, oidcUpstreamUsername, nil),
 		},
 		{
 			name: "OIDC upstream password grant: upstream ID token contains username claim with weird format",
@@ -2308,49 +2642,176 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantBodyString:  "Unprocessable Entity: No upstream providers are configured\n",
 		},
 		{
-			name:            "too many upstream providers are configured: multiple OIDC",
-			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build(), upstreamOIDCIdentityProviderBuilder().Build()), // more than one not allowed
-			method:          http.MethodGet,
-			path:            happyGetRequestPath,
-			wantStatus:      http.StatusUnprocessableEntity,
-			wantContentType: "text/plain; charset=utf-8",
-			wantBodyString:  "Unprocessable Entity: Too many upstream providers are configured (support for multiple upstreams is not yet implemented)\n",
+			name:                             "multiple upstream providers are configured and no provider was chosen, so redirect to the chooser page",
+			idps:                             oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()).WithLDAP(&upstreamLDAPIdentityProvider).WithActiveDirectory(&upstreamActiveDirectoryIdentityProvider),
+			method:                           http.MethodGet,
+			path:                             happyGetRequestPath,
+			wantStatus:                       http.StatusSeeOther,
+			wantContentType:                  htmlContentType,
+			wantLocationHeader:               urlWithQuery(downstreamIssuer+oidc.ChooseIDPEndpointPath, happyGetRequestQueryMap),
+			wantBodyStringWithLocationInHref: true,
 		},
 		{
-			name:            "too many upstream providers are configured: multiple LDAP",
-			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider, &upstreamLDAPIdentityProvider), // more than one not allowed
-			method:          http.MethodGet,
-			path:            happyGetRequestPath,
-			wantStatus:      http.StatusUnprocessableEntity,
-			wantContentType: "text/plain; charset=utf-8",
-			wantBodyString:  "Unprocessable Entity: Too many upstream providers are configured (support for multiple upstreams is not yet implemented)\n",
+			name:               "multiple upstream providers are configured and no provider was chosen using POST, so redirect to the chooser page",
+			idps:               oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider, &upstreamActiveDirectoryIdentityProvider),
+			method:             http.MethodPost,
+			path:               "/some/path",
+			contentType:        "application/x-www-form-urlencoded",
+			body:               encodeQuery(happyGetRequestQueryMap),
+			wantStatus:         http.StatusSeeOther,
+			wantContentType:    "",
+			wantBodyString:     "",
+			wantLocationHeader: urlWithQuery(downstreamIssuer+oidc.ChooseIDPEndpointPath, happyGetRequestQueryMap),
+		},
+		{
+			name:               "multiple upstream providers are configured and no provider was chosen with prompt param none returns login_required because the chooser page requires user interaction",
+			idps:               oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()).WithLDAP(&upstreamLDAPIdentityProvider),
+			method:             http.MethodGet,
+			path:               modifiedHappyGetRequestPath(map[string]string{"prompt": "none"}),
+			wantStatus:         http.StatusSeeOther,
+			wantContentType:    "application/json; charset=utf-8",
+			wantLocationHeader: urlWithQuery(downstreamRedirectURI, fositeLoginRequiredErrorQuery),
+			wantBodyString:     "",
+		},
+		{
+			name:               "multiple upstream providers are configured and no provider was chosen with an invalid authorize request returns the usual authorize error",
+			idps:               oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()).WithLDAP(&upstreamLDAPIdentityProvider),
+			method:             http.MethodGet,
+			path:               modifiedHappyGetRequestPath(map[string]string{"response_type": "unsupported"}),
+			wantStatus:         http.StatusSeeOther,
+			wantContentType:    "application/json; charset=utf-8",
+			wantLocationHeader: urlWithQuery(downstreamRedirectURI, fositeUnsupportedResponseTypeErrorQuery),
+			wantBodyString:     "",
+		},
+		{
+			name:                 "multiple upstream providers are configured and no provider was chosen when using the CLI-based flow",
+			idps:                 oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()).WithLDAP(&upstreamLDAPIdentityProvider),
+			method:               http.MethodGet,
+			path:                 happyGetRequestPath,
+			customUsernameHeader: pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader: pointer.StringPtr(happyLDAPPassword),
+			wantStatus:           http.StatusUnprocessableEntity,
+			wantContentType:      "text/plain; charset=utf-8",
+			wantBodyString:       "Unprocessable Entity: Multiple upstream providers are configured, so the pinniped_idp_name param must be specified\n",
+		},
+		{
+			name:                 "multiple upstream providers are configured and no provider was chosen when using the CLI-based flow with only a password header",
+			idps:                 oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()).WithLDAP(&upstreamLDAPIdentityProvider),
+			method:               http.MethodGet,
+			path:                 happyGetRequestPath,
+			customPasswordHeader: pointer.StringPtr(happyLDAPPassword),
+			wantStatus:           http.StatusUnprocessableEntity,
+			wantContentType:      "text/plain; charset=utf-8",
+			wantBodyString:       "Unprocessable Entity: Multiple upstream providers are configured, so the pinniped_idp_name param must be specified\n",
+		},
+		{
+			name:                        "multiple upstream providers are configured and the OIDC provider was chosen by name",
+			idps:                        oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()).WithLDAP(&upstreamLDAPIdentityProvider).WithActiveDirectory(&upstreamActiveDirectoryIdentityProvider),
+			generateCSRF:                happyCSRFGenerator,
+			generatePKCE:                happyPKCEGenerator,
+			generateNonce:               happyNonceGenerator,
+			stateEncoder:                happyStateEncoder,
+			cookieEncoder:               happyCookieEncoder,
+			method:                      http.MethodGet,
+			path:                        modifiedHappyGetRequestPath(map[string]string{"pinniped_idp_name": oidcUpstreamName}),
+			wantStatus:                  http.StatusSeeOther,
+			wantContentType:             htmlContentType,
+			wantCSRFValueInCookieHeader: happyCSRF,
+			wantLocationHeader: expectedRedirectLocationForUpstreamOIDC(
+				expectedUpstreamStateParam(map[string]string{"pinniped_idp_name": oidcUpstreamName}, "", ""), nil,
+			),
+			wantUpstreamStateParamInLocationHeader: true,
+			wantBodyStringWithLocationInHref:       true,
+		},
+		{
+			name:                              "multiple upstream providers are configured and the LDAP provider was chosen by name and type",
+			idps:                              oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()).WithLDAP(&upstreamLDAPIdentityProvider).WithActiveDirectory(&upstreamActiveDirectoryIdentityProvider),
+			method:                            http.MethodGet,
+			path:                              modifiedHappyGetRequestPath(map[string]string{"pinniped_idp_name": ldapUpstreamName, "pinniped_idp_type": "ldap"}),
+			customUsernameHeader:              pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader:              pointer.StringPtr(happyLDAPPassword),
+			wantStatus:                        http.StatusFound,
+			wantContentType:                   htmlContentType,
+			wantRedirectLocationRegexp:        happyAuthcodeDownstreamRedirectLocationRegexp,
+			wantDownstreamIDTokenSubject:      upstreamLDAPURL + "&sub=" + happyLDAPUID,
+			wantDownstreamIDTokenUsername:     happyLDAPUsernameFromAuthenticator,
+			wantDownstreamIDTokenGroups:       happyLDAPGroups,
+			wantDownstreamRequestedScopes:     happyDownstreamScopesRequested,
+			wantDownstreamRedirectURI:         downstreamRedirectURI,
+			wantDownstreamGrantedScopes:       happyDownstreamScopesGranted,
+			wantDownstreamNonce:               downstreamNonce,
+			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
+			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
+			wantDownstreamCustomSessionData:   expectedHappyLDAPUpstreamCustomSession,
+		},
+		{
+			name:                              "multiple upstream providers are configured and the ActiveDirectory provider was chosen by name",
+			idps:                              oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()).WithLDAP(&upstreamLDAPIdentityProvider).WithActiveDirectory(&upstreamActiveDirectoryIdentityProvider),
+			method:                            http.MethodGet,
+			path:                              modifiedHappyGetRequestPath(map[string]string{"pinniped_idp_name": activeDirectoryUpstreamName}),
+			customUsernameHeader:              pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader:              pointer.StringPtr(happyLDAPPassword),
+			wantStatus:                        http.StatusFound,
+			wantContentType:                   htmlContentType,
+			wantRedirectLocationRegexp:        happyAuthcodeDownstreamRedirectLocationRegexp,
+			wantDownstreamIDTokenSubject:      upstreamLDAPURL + "&sub=" + happyLDAPUID,
+			wantDownstreamIDTokenUsername:     happyLDAPUsernameFromAuthenticator,
+			wantDownstreamIDTokenGroups:       happyLDAPGroups,
+			wantDownstreamRequestedScopes:     happyDownstreamScopesRequested,
+			wantDownstreamRedirectURI:         downstreamRedirectURI,
+			wantDownstreamGrantedScopes:       happyDownstreamScopesGranted,
+			wantDownstreamNonce:               downstreamNonce,
+			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
+			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
+			wantDownstreamCustomSessionData:   expectedHappyActiveDirectoryUpstreamCustomSession,
 		},
 		{
-			name:            "too many upstream providers are configured: multiple Active Directory",
-			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(&upstreamLDAPIdentityProvider, &upstreamLDAPIdentityProvider), // more than one not allowed
+			name:            "the chosen upstream provider name does not exist",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()).WithLDAP(&upstreamLDAPIdentityProvider),
 			method:          http.MethodGet,
-			path:            happyGetRequestPath,
+			path:            modifiedHappyGetRequestPath(map[string]string{"pinniped_idp_name": "does-not-exist"}),
 			wantStatus:      http.StatusUnprocessableEntity,
 			wantContentType: "text/plain; charset=utf-8",
-			wantBodyString:  "Unprocessable Entity: Too many upstream providers are configured (support for multiple upstreams is not yet implemented)\n",
+			wantBodyString:  "Unprocessable Entity: Did not find upstream provider with name \"does-not-exist\"\n",
 		},
 		{
-			name:            "too many upstream providers are configured: both OIDC and LDAP",
-			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()).WithLDAP(&upstreamLDAPIdentityProvider), // more than one not allowed
+			name:            "the chosen upstream provider name exists but is not of the chosen type",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()).WithLDAP(&upstreamLDAPIdentityProvider),
 			method:          http.MethodGet,
-			path:            happyGetRequestPath,
+			path:            modifiedHappyGetRequestPath(map[string]string{"pinniped_idp_name": ldapUpstreamName, "pinniped_idp_type": "activedirectory"}),
 			wantStatus:      http.StatusUnprocessableEntity,
 			wantContentType: "text/plain; charset=utf-8",
-			wantBodyString:  "Unprocessable Entity: Too many upstream providers are configured (support for multiple upstreams is not yet implemented)\n",
+			wantBodyString:  "Unprocessable Entity: Did not find upstream provider with name \"some-ldap-idp\"\n",
 		},
 		{
-			name:            "too many upstream providers are configured: OIDC, LDAP and AD",
-			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()).WithLDAP(&upstreamLDAPIdentityProvider).WithActiveDirectory(&upstreamActiveDirectoryIdentityProvider), // more than one not allowed
+			name:            "the chosen upstream provider name is used by providers of different types and no type was chosen",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().WithName(ldapUpstreamName).Build()).WithLDAP(&upstreamLDAPIdentityProvider),
 			method:          http.MethodGet,
-			path:            happyGetRequestPath,
+			path:            modifiedHappyGetRequestPath(map[string]string{"pinniped_idp_name": ldapUpstreamName}),
 			wantStatus:      http.StatusUnprocessableEntity,
 			wantContentType: "text/plain; charset=utf-8",
-			wantBodyString:  "Unprocessable Entity: Too many upstream providers are configured (support for multiple upstreams is not yet implemented)\n",
+			wantBodyString:  "Unprocessable Entity: Found multiple upstream providers with name \"some-ldap-idp\", so the pinniped_idp_type param must be specified\n",
+		},
+		{
+			name:                              "the chosen upstream provider name is used by providers of different types and the type was chosen",
+			idps:                              oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().WithName(ldapUpstreamName).Build()).WithLDAP(&upstreamLDAPIdentityProvider),
+			method:                            http.MethodGet,
+			path:                              modifiedHappyGetRequestPath(map[string]string{"pinniped_idp_name": ldapUpstreamName, "pinniped_idp_type": "ldap"}),
+			customUsernameHeader:              pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader:              pointer.StringPtr(happyLDAPPassword),
+			wantStatus:                        http.StatusFound,
+			wantContentType:                   htmlContentType,
+			wantRedirectLocationRegexp:        happyAuthcodeDownstreamRedirectLocationRegexp,
+			wantDownstreamIDTokenSubject:      upstreamLDAPURL + "&sub=" + happyLDAPUID,
+			wantDownstreamIDTokenUsername:     happyLDAPUsernameFromAuthenticator,
+			wantDownstreamIDTokenGroups:       happyLDAPGroups,
+			wantDownstreamRequestedScopes:     happyDownstreamScopesRequested,
+			wantDownstreamRedirectURI:         downstreamRedirectURI,
+			wantDownstreamGrantedScopes:       happyDownstreamScopesGranted,
+			wantDownstreamNonce:               downstreamNonce,
+			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
+			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
+			wantDownstreamCustomSessionData:   expectedHappyLDAPUpstreamCustomSession,
 		},
 		{
 			name:            "PUT is a bad method",
@@ -2497,6 +2958,8 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			subject := NewHandler(
 				downstreamIssuer,
 				test.idps.Build(),
+				oidctestutil.NewIdentityTransformsGetter(t, test.idpTransforms),
+				test.userInfoPassthroughClaims,
 				oauthHelperWithNullStorage, oauthHelperWithRealStorage,
 				test.generateCSRF, test.generatePKCE, test.generateNonce,
 				test.stateEncoder, test.cookieEncoder,
@@ -2517,6 +2980,8 @@ func TestAuthorizationEndpoint(t *testing.T) {
 		subject := NewHandler(
 			downstreamIssuer,
 			idpLister,
+			oidctestutil.NewIdentityTransformsGetter(t, nil),
+			nil,
 			oauthHelperWithNullStorage, oauthHelperWithRealStorage,
 			test.generateCSRF, test.generatePKCE, test.generateNonce,
 			test.stateEncoder, test.cookieEncoder,
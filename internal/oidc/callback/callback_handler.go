@@ -8,41 +8,59 @@ import (
 	"crypto/subtle"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/ory/fosite"
 
+	"go.pinniped.dev/internal/audit"
+	"go.pinniped.dev/internal/fositestorage/devicecode"
 	"go.pinniped.dev/internal/httputil/httperr"
 	"go.pinniped.dev/internal/httputil/securityheader"
 	"go.pinniped.dev/internal/oidc"
-	"go.pinniped.dev/internal/oidc/csrftoken"
+	"go.pinniped.dev/internal/oidc/device"
 	"go.pinniped.dev/internal/oidc/downstreamsession"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/oidc/provider/formposthtml"
 	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/psession"
+	"go.pinniped.dev/internal/tracing"
 )
 
 func NewHandler(
 	upstreamIDPs oidc.UpstreamOIDCIdentityProvidersLister,
+	idTransformsGetter oidc.IdentityTransformsGetter,
+	userInfoPassthroughClaims []string,
 	oauthHelper fosite.OAuth2Provider,
 	stateDecoder, cookieDecoder oidc.Decoder,
 	redirectURI string,
+	deviceCodeStorage devicecode.Storage,
 ) http.Handler {
+	downstreamIssuer := strings.TrimSuffix(redirectURI, oidc.CallbackEndpointPath)
+
 	handler := httperr.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
 		state, err := validateRequest(r, stateDecoder, cookieDecoder)
 		if err != nil {
+			oidc.RecordAuditEvent(r, audit.TypeCallback, downstreamIssuer, nil, nil, err)
 			return err
 		}
 
-		upstreamIDPConfig := findUpstreamIDPConfig(state.UpstreamName, upstreamIDPs)
+		upstreamIDPConfig := findUpstreamIDPConfig(state.UpstreamName, state.UpstreamType, upstreamIDPs)
 		if upstreamIDPConfig == nil {
 			plog.Warning("upstream provider not found")
-			return httperr.New(http.StatusUnprocessableEntity, "upstream provider not found")
+			err := httperr.New(http.StatusUnprocessableEntity, "upstream provider not found")
+			oidc.RecordAuditEvent(r, audit.TypeCallback, downstreamIssuer, nil,
+				&audit.IdentityProvider{Name: state.UpstreamName, Type: state.UpstreamType}, err)
+			return err
 		}
+		upstream := oidc.AuditIdentityProvider(upstreamIDPConfig.GetName(), psession.ProviderTypeOIDC, string(upstreamIDPConfig.GetResourceUID()))
+		tracing.SetIdentityProvider(r.Context(), upstreamIDPConfig.GetName(), string(psession.ProviderTypeOIDC))
 
 		downstreamAuthParams, err := url.ParseQuery(state.AuthParams)
 		if err != nil {
 			plog.Error("error reading state downstream auth params", err)
-			return httperr.New(http.StatusBadRequest, "error reading state downstream auth params")
+			err := httperr.New(http.StatusBadRequest, "error reading state downstream auth params")
+			oidc.RecordAuditEvent(r, audit.TypeCallback, downstreamIssuer, nil, upstream, err)
+			return err
 		}
 
 		// Recreate enough of the original authorize request so we can pass it to NewAuthorizeRequest().
@@ -50,7 +68,9 @@ func NewHandler(
 		authorizeRequester, err := oauthHelper.NewAuthorizeRequest(r.Context(), reconstitutedAuthRequest)
 		if err != nil {
 			plog.Error("error using state downstream auth params", err)
-			return httperr.New(http.StatusBadRequest, "error using state downstream auth params")
+			err := httperr.New(http.StatusBadRequest, "error using state downstream auth params")
+			oidc.RecordAuditEvent(r, audit.TypeCallback, downstreamIssuer, nil, upstream, err)
+			return err
 		}
 
 		// Automatically grant the openid, offline_access, and pinniped:request-audience scopes, but only if they were requested.
@@ -65,27 +85,57 @@ func NewHandler(
 		)
 		if err != nil {
 			plog.WarningErr("error exchanging and validating upstream tokens", err, "upstreamName", upstreamIDPConfig.GetName())
+			oidc.RecordAuditEvent(r, audit.TypeCallback, downstreamIssuer, authorizeRequester, upstream, err)
 			return httperr.New(http.StatusBadGateway, "error exchanging and validating upstream tokens")
 		}
 
 		subject, username, groups, err := downstreamsession.GetDownstreamIdentityFromUpstreamIDToken(upstreamIDPConfig, token.IDToken.Claims)
 		if err != nil {
+			oidc.RecordAuditEvent(r, audit.TypeCallback, downstreamIssuer, authorizeRequester, upstream, err)
 			return httperr.Wrap(http.StatusUnprocessableEntity, err.Error(), err)
 		}
 
-		customSessionData, err := downstreamsession.MakeDownstreamOIDCCustomSessionData(upstreamIDPConfig, token)
+		customSessionData, err := downstreamsession.MakeDownstreamOIDCCustomSessionData(upstreamIDPConfig, token, userInfoPassthroughClaims)
 		if err != nil {
+			oidc.RecordAuditEvent(r, audit.TypeCallback, downstreamIssuer, authorizeRequester, upstream, err)
 			return httperr.Wrap(http.StatusUnprocessableEntity, err.Error(), err)
 		}
 
-		openIDSession := downstreamsession.MakeDownstreamSession(subject, username, groups, customSessionData)
+		// Remember the upstream identity so the identity transformations can be applied again during refresh.
+		customSessionData.UpstreamUsername = username
+		customSessionData.UpstreamGroups = groups
+
+		idTransforms := idTransformsGetter.IdentityTransforms(upstreamIDPConfig.GetName(), psession.ProviderTypeOIDC)
+		username, groups, err = downstreamsession.ApplyIdentityTransformations(idTransforms, username, groups)
+		if err != nil {
+			err := fosite.ErrAccessDenied.WithHintf("Reason: %s.", err.Error())
+			oidc.RecordAuditEvent(r, audit.TypeCallback, downstreamIssuer, authorizeRequester, upstream, err)
+			oauthHelper.WriteAuthorizeError(w, authorizeRequester, err)
+			return nil
+		}
+
+		openIDSession := downstreamsession.MakeDownstreamSession(authorizeRequester.GetID(), subject, username, groups, customSessionData)
+
+		if userCode := downstreamAuthParams.Get(oidc.DeviceUserCodeParamName); userCode != "" {
+			// The login was started by the device verification page, so the device gets the tokens instead of the browser.
+			if err := device.ApproveSession(r, cookieDecoder, deviceCodeStorage, userCode, authorizeRequester, openIDSession); err != nil {
+				plog.WarningErr("error while approving device code session", err, "upstreamName", upstreamIDPConfig.GetName())
+				oidc.RecordAuditEvent(r, audit.TypeCallback, downstreamIssuer, authorizeRequester, upstream, err)
+				return err
+			}
+			authorizeRequester.SetSession(openIDSession) // only to record the identity in the audit event
+			oidc.RecordAuditEvent(r, audit.TypeCallback, downstreamIssuer, authorizeRequester, upstream, nil)
+			return device.WriteLoggedInPage(w)
+		}
 
 		authorizeResponder, err := oauthHelper.NewAuthorizeResponse(r.Context(), authorizeRequester, openIDSession)
 		if err != nil {
 			plog.WarningErr("error while generating and saving authcode", err, "upstreamName", upstreamIDPConfig.GetName())
+			oidc.RecordAuditEvent(r, audit.TypeCallback, downstreamIssuer, authorizeRequester, upstream, err)
 			return httperr.Wrap(http.StatusInternalServerError, "error while generating and saving authcode", err)
 		}
 
+		oidc.RecordAuditEvent(r, audit.TypeCallback, downstreamIssuer, authorizeRequester, upstream, nil)
 		oauthHelper.WriteAuthorizeResponse(w, authorizeRequester, authorizeResponder)
 
 		return nil
@@ -102,7 +152,7 @@ func validateRequest(r *http.Request, stateDecoder, cookieDecoder oidc.Decoder)
 		return nil, httperr.Newf(http.StatusMethodNotAllowed, "%s (try GET)", r.Method)
 	}
 
-	csrfValue, err := readCSRFCookie(r, cookieDecoder)
+	csrfValue, err := oidc.ReadCSRFCookie(r, cookieDecoder)
 	if err != nil {
 		plog.InfoErr("error reading CSRF cookie", err)
 		return nil, err
@@ -118,7 +168,7 @@ func validateRequest(r *http.Request, stateDecoder, cookieDecoder oidc.Decoder)
 		return nil, httperr.New(http.StatusBadRequest, "state param not found")
 	}
 
-	state, err := readState(r, stateDecoder)
+	state, err := oidc.ReadStateParam(r.FormValue("state"), stateDecoder)
 	if err != nil {
 		plog.InfoErr("error reading state", err)
 		return nil, err
@@ -132,7 +182,12 @@ func validateRequest(r *http.Request, stateDecoder, cookieDecoder oidc.Decoder)
 	return state, nil
 }
 
-func findUpstreamIDPConfig(upstreamName string, upstreamIDPs oidc.UpstreamOIDCIdentityProvidersLister) provider.UpstreamOIDCIdentityProviderI {
+func findUpstreamIDPConfig(upstreamName string, upstreamType string, upstreamIDPs oidc.UpstreamOIDCIdentityProvidersLister) provider.UpstreamOIDCIdentityProviderI {
+	if upstreamType != "" && upstreamType != string(psession.ProviderTypeOIDC) {
+		// Only OIDC upstreams redirect back to the callback endpoint. State params which were created
+		// before the upstream type was added to them do not have a type, so those are found by name.
+		return nil
+	}
 	for _, p := range upstreamIDPs.GetOIDCIdentityProviders() {
 		if p.GetName() == upstreamName {
 			return p
@@ -140,36 +195,3 @@ func findUpstreamIDPConfig(upstreamName string, upstreamIDPs oidc.UpstreamOIDCId
 	}
 	return nil
 }
-
-func readCSRFCookie(r *http.Request, cookieDecoder oidc.Decoder) (csrftoken.CSRFToken, error) {
-	receivedCSRFCookie, err := r.Cookie(oidc.CSRFCookieName)
-	if err != nil {
-		// Error means that the cookie was not found
-		return "", httperr.Wrap(http.StatusForbidden, "CSRF cookie is missing", err)
-	}
-
-	var csrfFromCookie csrftoken.CSRFToken
-	err = cookieDecoder.Decode(oidc.CSRFCookieEncodingName, receivedCSRFCookie.Value, &csrfFromCookie)
-	if err != nil {
-		return "", httperr.Wrap(http.StatusForbidden, "error reading CSRF cookie", err)
-	}
-
-	return csrfFromCookie, nil
-}
-
-func readState(r *http.Request, stateDecoder oidc.Decoder) (*oidc.UpstreamStateParamData, error) {
-	var state oidc.UpstreamStateParamData
-	if err := stateDecoder.Decode(
-		oidc.UpstreamStateParamEncodingName,
-		r.FormValue("state"),
-		&state,
-	); err != nil {
-		return nil, httperr.New(http.StatusBadRequest, "error reading state")
-	}
-
-	if state.FormatVersion != oidc.UpstreamStateParamFormatVersion {
-		return nil, httperr.New(http.StatusUnprocessableEntity, "state format version is invalid")
-	}
-
-	return &state, nil
-}
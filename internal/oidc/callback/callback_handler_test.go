@@ -4,6 +4,7 @@
 package callback
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"net/http"
@@ -14,12 +15,18 @@ import (
 	"time"
 
 	"github.com/gorilla/securecookie"
+	"github.com/ory/fosite"
 	"github.com/stretchr/testify/require"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/fake"
 
+	"go.pinniped.dev/internal/audit"
+	"go.pinniped.dev/internal/fositestorage/devicecode"
+	"go.pinniped.dev/internal/idtransform"
 	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/device/devicehtml"
 	"go.pinniped.dev/internal/oidc/jwks"
+	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/psession"
 	"go.pinniped.dev/internal/testutil"
 	"go.pinniped.dev/internal/testutil/oidctestutil"
@@ -29,6 +36,7 @@ import (
 
 const (
 	happyUpstreamIDPName        = "upstream-idp-name"
+	happyUpstreamIDPType        = "oidc"
 	happyUpstreamIDPResourceUID = "upstream-uid"
 
 	oidcUpstreamIssuer              = "https://my-upstream-issuer.com"
@@ -77,9 +85,11 @@ var (
 	}
 	happyDownstreamRequestParams     = happyDownstreamRequestParamsQuery.Encode()
 	happyDownstreamCustomSessionData = &psession.CustomSessionData{
-		ProviderUID:  happyUpstreamIDPResourceUID,
-		ProviderName: happyUpstreamIDPName,
-		ProviderType: psession.ProviderTypeOIDC,
+		ProviderUID:      happyUpstreamIDPResourceUID,
+		ProviderName:     happyUpstreamIDPName,
+		ProviderType:     psession.ProviderTypeOIDC,
+		UpstreamUsername: oidcUpstreamUsername,
+		UpstreamGroups:   oidcUpstreamGroupMembership,
 		OIDC: &psession.OIDCSessionData{
 			UpstreamRefreshToken: oidcUpstreamRefreshToken,
 			UpstreamIssuer:       oidcUpstreamIssuer,
@@ -87,9 +97,11 @@ var (
 		},
 	}
 	happyDownstreamAccessTokenCustomSessionData = &psession.CustomSessionData{
-		ProviderUID:  happyUpstreamIDPResourceUID,
-		ProviderName: happyUpstreamIDPName,
-		ProviderType: psession.ProviderTypeOIDC,
+		ProviderUID:      happyUpstreamIDPResourceUID,
+		ProviderName:     happyUpstreamIDPName,
+		ProviderType:     psession.ProviderTypeOIDC,
+		UpstreamUsername: oidcUpstreamUsername,
+		UpstreamGroups:   oidcUpstreamGroupMembership,
 		OIDC: &psession.OIDCSessionData{
 			UpstreamAccessToken: oidcUpstreamAccessToken,
 			UpstreamIssuer:      oidcUpstreamIssuer,
@@ -125,6 +137,12 @@ func TestCallbackEndpoint(t *testing.T) {
 	require.NoError(t, err)
 	happyCSRFCookie := "__Host-pinniped-csrf=" + encodedIncomingCookieCSRFValue
 
+	encodedDeviceApproval, err := happyCookieCodec.Encode("device-approval", &oidc.DeviceApproval{UserCode: "BCDF-GHJK", Token: deviceApprovalToken})
+	require.NoError(t, err)
+	happyCSRFAndDeviceApprovalCookies := happyCSRFCookie + "; __Host-pinniped-device-approval=" + encodedDeviceApproval
+	encodedWrongDeviceApproval, err := happyCookieCodec.Encode("device-approval", &oidc.DeviceApproval{UserCode: "BCDF-GHJK", Token: "some-other-token"})
+	require.NoError(t, err)
+
 	happyExchangeAndValidateTokensArgs := &oidctestutil.ExchangeAuthcodeAndValidateTokenArgs{
 		Authcode:             happyUpstreamAuthcode,
 		PKCECodeVerifier:     oidcpkce.Code(happyDownstreamPKCE),
@@ -135,18 +153,37 @@ func TestCallbackEndpoint(t *testing.T) {
 	// Note that fosite puts the granted scopes as a param in the redirect URI even though the spec doesn't seem to require it
 	happyDownstreamRedirectLocationRegexp := downstreamRedirectURI + `\?code=([^&]+)&scope=openid&state=` + happyDownstreamState
 
+	withUpstreamIdentity := func(customSessionData *psession.CustomSessionData, username string, groups []string) *psession.CustomSessionData {
+		copied := *customSessionData
+		copied.UpstreamUsername = username
+		copied.UpstreamGroups = groups
+		return &copied
+	}
+
+	prefixTransforms := idtransform.NewTransformationPipeline()
+	prefixTransforms.AppendTransformation(idtransform.NewUsernamePrefixTransformation("prefix:"))
+	prefixTransforms.AppendTransformation(idtransform.NewGroupsMapTransformation(map[string]string{"test-pinniped-group-0": "mapped-group"}))
+
+	rejectTransforms := idtransform.NewTransformationPipeline()
+	rejectPolicy, err := idtransform.NewRejectPolicy(`^test-pinniped-username$`, "", "this user is not allowed")
+	require.NoError(t, err)
+	rejectTransforms.AppendTransformation(rejectPolicy)
+
 	tests := []struct {
 		name string
 
-		idps       *oidctestutil.UpstreamIDPListerBuilder
-		method     string
-		path       string
-		csrfCookie string
+		idps                      *oidctestutil.UpstreamIDPListerBuilder
+		idpTransforms             []provider.FederationDomainIdentityProvider
+		userInfoPassthroughClaims []string
+		method                    string
+		path                      string
+		csrfCookie                string
 
 		wantStatus                        int
 		wantContentType                   string
 		wantBody                          string
 		wantRedirectLocationRegexp        string
+		wantRedirectLocationString        string
 		wantBodyFormResponseRegexp        string
 		wantDownstreamGrantedScopes       []string
 		wantDownstreamIDTokenSubject      string
@@ -159,6 +196,10 @@ func TestCallbackEndpoint(t *testing.T) {
 		wantDownstreamCustomSessionData   *psession.CustomSessionData
 
 		wantAuthcodeExchangeCall *expectedAuthcodeExchange
+
+		deviceUserCode                string
+		wantDeviceCodeSessionApproved bool
+		wantDeviceCodeSessionUsername string
 	}{
 		{
 			name:   "GET with good state and cookie and successful upstream token exchange with response_mode=form_post returns 200 with HTML+JS form",
@@ -213,6 +254,78 @@ func TestCallbackEndpoint(t *testing.T) {
 				args:                    happyExchangeAndValidateTokensArgs,
 			},
 		},
+		{
+			name:   "GET with a state param which has no upstream type finds the upstream by name",
+			idps:   oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(happyUpstream().Build()),
+			method: http.MethodGet,
+			path: newRequestPath().WithState(
+				happyUpstreamStateParam().WithUpstreamType("").Build(t, happyStateCodec),
+			).String(),
+			csrfCookie:                        happyCSRFCookie,
+			wantStatus:                        http.StatusSeeOther,
+			wantRedirectLocationRegexp:        happyDownstreamRedirectLocationRegexp,
+			wantBody:                          "",
+			wantDownstreamIDTokenSubject:      oidcUpstreamIssuer + "?sub=" + oidcUpstreamSubjectQueryEscaped,
+			wantDownstreamIDTokenUsername:     oidcUpstreamUsername,
+			wantDownstreamIDTokenGroups:       oidcUpstreamGroupMembership,
+			wantDownstreamRequestedScopes:     happyDownstreamScopesRequested,
+			wantDownstreamGrantedScopes:       happyDownstreamScopesGranted,
+			wantDownstreamNonce:               downstreamNonce,
+			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
+			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
+			wantDownstreamCustomSessionData:   happyDownstreamCustomSessionData,
+			wantAuthcodeExchangeCall: &expectedAuthcodeExchange{
+				performedByUpstreamName: happyUpstreamIDPName,
+				args:                    happyExchangeAndValidateTokensArgs,
+			},
+		},
+		{
+			name: "GET with good state and cookie and successful upstream token exchange applies identity transforms",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(happyUpstream().Build()),
+			idpTransforms: []provider.FederationDomainIdentityProvider{
+				{Name: happyUpstreamIDPName, Type: psession.ProviderTypeOIDC, Transforms: prefixTransforms},
+			},
+			method:                            http.MethodGet,
+			path:                              newRequestPath().WithState(happyState).String(),
+			csrfCookie:                        happyCSRFCookie,
+			wantStatus:                        http.StatusSeeOther,
+			wantRedirectLocationRegexp:        happyDownstreamRedirectLocationRegexp,
+			wantBody:                          "",
+			wantDownstreamIDTokenSubject:      oidcUpstreamIssuer + "?sub=" + oidcUpstreamSubjectQueryEscaped,
+			wantDownstreamIDTokenUsername:     "prefix:" + oidcUpstreamUsername,
+			wantDownstreamIDTokenGroups:       []string{"mapped-group", "test-pinniped-group-1"},
+			wantDownstreamRequestedScopes:     happyDownstreamScopesRequested,
+			wantDownstreamGrantedScopes:       happyDownstreamScopesGranted,
+			wantDownstreamNonce:               downstreamNonce,
+			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
+			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
+			wantDownstreamCustomSessionData:   happyDownstreamCustomSessionData,
+			wantAuthcodeExchangeCall: &expectedAuthcodeExchange{
+				performedByUpstreamName: happyUpstreamIDPName,
+				args:                    happyExchangeAndValidateTokensArgs,
+			},
+		},
+		{
+			name: "GET with good state and cookie and successful upstream token exchange when an identity policy rejects the user returns 303 to downstream client callback with an error",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(happyUpstream().Build()),
+			idpTransforms: []provider.FederationDomainIdentityProvider{
+				{Name: happyUpstreamIDPName, Type: psession.ProviderTypeOIDC, Transforms: rejectTransforms},
+			},
+			method:     http.MethodGet,
+			path:       newRequestPath().WithState(happyState).String(),
+			csrfCookie: happyCSRFCookie,
+			wantStatus: http.StatusSeeOther,
+			wantRedirectLocationString: downstreamRedirectURI + "?" + url.Values{
+				"error":             []string{"access_denied"},
+				"error_description": []string{"The resource owner or authorization server denied the request. Reason: configured identity policy rejected this authentication: this user is not allowed."},
+				"state":             []string{happyDownstreamState},
+			}.Encode(),
+			wantBody: "",
+			wantAuthcodeExchangeCall: &expectedAuthcodeExchange{
+				performedByUpstreamName: happyUpstreamIDPName,
+				args:                    happyExchangeAndValidateTokensArgs,
+			},
+		},
 		{
 			name:                              "GET with authcode exchange that returns an access token but no refresh token when there is a userinfo endpoint returns 303 to downstream client callback with its state and code",
 			idps:                              oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(happyUpstream().WithEmptyRefreshToken().WithAccessToken(oidcUpstreamAccessToken, metav1.NewTime(time.Now().Add(9*time.Hour))).WithUserInfoURL().Build()),
@@ -254,10 +367,12 @@ func TestCallbackEndpoint(t *testing.T) {
 			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
 			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
 			wantDownstreamCustomSessionData: &psession.CustomSessionData{
-				ProviderUID:  happyUpstreamIDPResourceUID,
-				ProviderName: happyUpstreamIDPName,
-				ProviderType: psession.ProviderTypeOIDC,
-				Warnings:     []string{"Access token from identity provider has lifetime of less than 3 hours. Expect frequent prompts to log in."},
+				ProviderUID:      happyUpstreamIDPResourceUID,
+				ProviderName:     happyUpstreamIDPName,
+				ProviderType:     psession.ProviderTypeOIDC,
+				UpstreamUsername: oidcUpstreamUsername,
+				UpstreamGroups:   oidcUpstreamGroupMembership,
+				Warnings:         []string{"Access token from identity provider has lifetime of less than 3 hours. Expect frequent prompts to log in."},
 				OIDC: &psession.OIDCSessionData{
 					UpstreamAccessToken: oidcUpstreamAccessToken,
 					UpstreamIssuer:      oidcUpstreamIssuer,
@@ -288,7 +403,82 @@ func TestCallbackEndpoint(t *testing.T) {
 			wantDownstreamNonce:               downstreamNonce,
 			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
 			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
-			wantDownstreamCustomSessionData:   happyDownstreamCustomSessionData,
+			wantDownstreamCustomSessionData:   withUpstreamIdentity(happyDownstreamCustomSessionData, oidcUpstreamIssuer+"?sub="+oidcUpstreamSubjectQueryEscaped, nil),
+			wantAuthcodeExchangeCall: &expectedAuthcodeExchange{
+				performedByUpstreamName: happyUpstreamIDPName,
+				args:                    happyExchangeAndValidateTokensArgs,
+			},
+		},
+		{
+			name: "configured userinfo passthrough claims are copied from the upstream ID token into the session",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+				happyUpstream().WithIDTokenClaim("email", "joe@whitehouse.gov").WithIDTokenClaim("department", "some-department").Build(),
+			),
+			userInfoPassthroughClaims:         []string{"email", "some-claim-missing-from-the-id-token"},
+			method:                            http.MethodGet,
+			path:                              newRequestPath().WithState(happyState).String(),
+			csrfCookie:                        happyCSRFCookie,
+			wantStatus:                        http.StatusSeeOther,
+			wantRedirectLocationRegexp:        happyDownstreamRedirectLocationRegexp,
+			wantBody:                          "",
+			wantDownstreamIDTokenSubject:      oidcUpstreamIssuer + "?sub=" + oidcUpstreamSubjectQueryEscaped,
+			wantDownstreamIDTokenUsername:     oidcUpstreamUsername,
+			wantDownstreamIDTokenGroups:       oidcUpstreamGroupMembership,
+			wantDownstreamRequestedScopes:     happyDownstreamScopesRequested,
+			wantDownstreamGrantedScopes:       happyDownstreamScopesGranted,
+			wantDownstreamNonce:               downstreamNonce,
+			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
+			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
+			wantDownstreamCustomSessionData: &psession.CustomSessionData{
+				ProviderUID:      happyUpstreamIDPResourceUID,
+				ProviderName:     happyUpstreamIDPName,
+				ProviderType:     psession.ProviderTypeOIDC,
+				UpstreamUsername: oidcUpstreamUsername,
+				UpstreamGroups:   oidcUpstreamGroupMembership,
+				OIDC: &psession.OIDCSessionData{
+					UpstreamRefreshToken: oidcUpstreamRefreshToken,
+					UpstreamIssuer:       oidcUpstreamIssuer,
+					UpstreamSubject:      oidcUpstreamSubject,
+					PassthroughClaims:    map[string]interface{}{"email": "joe@whitehouse.gov"},
+				},
+			},
+			wantAuthcodeExchangeCall: &expectedAuthcodeExchange{
+				performedByUpstreamName: happyUpstreamIDPName,
+				args:                    happyExchangeAndValidateTokensArgs,
+			},
+		},
+		{
+			name: "upstream ID token is stored in the session when the upstream end session endpoint is used for logout",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+				happyUpstream().WithRawIDToken("some-upstream-id-token").WithEndSessionURL(&url.URL{Scheme: "https", Host: "upstream.example.com", Path: "/logout"}).Build(),
+			),
+			method:                            http.MethodGet,
+			path:                              newRequestPath().WithState(happyState).String(),
+			csrfCookie:                        happyCSRFCookie,
+			wantStatus:                        http.StatusSeeOther,
+			wantRedirectLocationRegexp:        happyDownstreamRedirectLocationRegexp,
+			wantBody:                          "",
+			wantDownstreamIDTokenSubject:      oidcUpstreamIssuer + "?sub=" + oidcUpstreamSubjectQueryEscaped,
+			wantDownstreamIDTokenUsername:     oidcUpstreamUsername,
+			wantDownstreamIDTokenGroups:       oidcUpstreamGroupMembership,
+			wantDownstreamRequestedScopes:     happyDownstreamScopesRequested,
+			wantDownstreamGrantedScopes:       happyDownstreamScopesGranted,
+			wantDownstreamNonce:               downstreamNonce,
+			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
+			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
+			wantDownstreamCustomSessionData: &psession.CustomSessionData{
+				ProviderUID:      happyUpstreamIDPResourceUID,
+				ProviderName:     happyUpstreamIDPName,
+				ProviderType:     psession.ProviderTypeOIDC,
+				UpstreamUsername: oidcUpstreamUsername,
+				UpstreamGroups:   oidcUpstreamGroupMembership,
+				OIDC: &psession.OIDCSessionData{
+					UpstreamRefreshToken: oidcUpstreamRefreshToken,
+					UpstreamIssuer:       oidcUpstreamIssuer,
+					UpstreamSubject:      oidcUpstreamSubject,
+					UpstreamIDToken:      "some-upstream-id-token",
+				},
+			},
 			wantAuthcodeExchangeCall: &expectedAuthcodeExchange{
 				performedByUpstreamName: happyUpstreamIDPName,
 				args:                    happyExchangeAndValidateTokensArgs,
@@ -313,7 +503,7 @@ func TestCallbackEndpoint(t *testing.T) {
 			wantDownstreamNonce:               downstreamNonce,
 			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
 			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
-			wantDownstreamCustomSessionData:   happyDownstreamCustomSessionData,
+			wantDownstreamCustomSessionData:   withUpstreamIdentity(happyDownstreamCustomSessionData, "joe@whitehouse.gov", oidcUpstreamGroupMembership),
 			wantAuthcodeExchangeCall: &expectedAuthcodeExchange{
 				performedByUpstreamName: happyUpstreamIDPName,
 				args:                    happyExchangeAndValidateTokensArgs,
@@ -340,7 +530,7 @@ func TestCallbackEndpoint(t *testing.T) {
 			wantDownstreamNonce:               downstreamNonce,
 			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
 			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
-			wantDownstreamCustomSessionData:   happyDownstreamCustomSessionData,
+			wantDownstreamCustomSessionData:   withUpstreamIdentity(happyDownstreamCustomSessionData, "joe@whitehouse.gov", oidcUpstreamGroupMembership),
 			wantAuthcodeExchangeCall: &expectedAuthcodeExchange{
 				performedByUpstreamName: happyUpstreamIDPName,
 				args:                    happyExchangeAndValidateTokensArgs,
@@ -368,7 +558,7 @@ func TestCallbackEndpoint(t *testing.T) {
 			wantDownstreamNonce:               downstreamNonce,
 			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
 			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
-			wantDownstreamCustomSessionData:   happyDownstreamCustomSessionData,
+			wantDownstreamCustomSessionData:   withUpstreamIdentity(happyDownstreamCustomSessionData, "joe", oidcUpstreamGroupMembership),
 			wantAuthcodeExchangeCall: &expectedAuthcodeExchange{
 				performedByUpstreamName: happyUpstreamIDPName,
 				args:                    happyExchangeAndValidateTokensArgs,
@@ -498,7 +688,7 @@ func TestCallbackEndpoint(t *testing.T) {
 			wantDownstreamNonce:               downstreamNonce,
 			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
 			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
-			wantDownstreamCustomSessionData:   happyDownstreamCustomSessionData,
+			wantDownstreamCustomSessionData:   withUpstreamIdentity(happyDownstreamCustomSessionData, oidcUpstreamSubject, oidcUpstreamGroupMembership),
 			wantAuthcodeExchangeCall: &expectedAuthcodeExchange{
 				performedByUpstreamName: happyUpstreamIDPName,
 				args:                    happyExchangeAndValidateTokensArgs,
@@ -523,7 +713,7 @@ func TestCallbackEndpoint(t *testing.T) {
 			wantDownstreamNonce:               downstreamNonce,
 			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
 			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
-			wantDownstreamCustomSessionData:   happyDownstreamCustomSessionData,
+			wantDownstreamCustomSessionData:   withUpstreamIdentity(happyDownstreamCustomSessionData, oidcUpstreamUsername, []string{"notAnArrayGroup1 notAnArrayGroup2"}),
 			wantAuthcodeExchangeCall: &expectedAuthcodeExchange{
 				performedByUpstreamName: happyUpstreamIDPName,
 				args:                    happyExchangeAndValidateTokensArgs,
@@ -548,7 +738,7 @@ func TestCallbackEndpoint(t *testing.T) {
 			wantDownstreamNonce:               downstreamNonce,
 			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
 			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
-			wantDownstreamCustomSessionData:   happyDownstreamCustomSessionData,
+			wantDownstreamCustomSessionData:   withUpstreamIdentity(happyDownstreamCustomSessionData, oidcUpstreamUsername, []string{"group1", "group2"}),
 			wantAuthcodeExchangeCall: &expectedAuthcodeExchange{
 				performedByUpstreamName: happyUpstreamIDPName,
 				args:                    happyExchangeAndValidateTokensArgs,
@@ -742,6 +932,18 @@ func TestCallbackEndpoint(t *testing.T) {
 			wantContentType: htmlContentType,
 			wantBody:        "Unprocessable Entity: upstream provider not found\n",
 		},
+		{
+			name:   "state param names an upstream provider of a type which does not use the callback endpoint",
+			idps:   oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(happyUpstream().Build()),
+			method: http.MethodGet,
+			path: newRequestPath().WithState(
+				happyUpstreamStateParam().WithUpstreamType("ldap").Build(t, happyStateCodec),
+			).String(),
+			csrfCookie:      happyCSRFCookie,
+			wantStatus:      http.StatusUnprocessableEntity,
+			wantContentType: htmlContentType,
+			wantBody:        "Unprocessable Entity: upstream provider not found\n",
+		},
 		{
 			name:            "the CSRF cookie does not exist on request",
 			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(happyUpstream().Build()),
@@ -824,7 +1026,7 @@ func TestCallbackEndpoint(t *testing.T) {
 			wantDownstreamNonce:               downstreamNonce,
 			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
 			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
-			wantDownstreamCustomSessionData:   happyDownstreamCustomSessionData,
+			wantDownstreamCustomSessionData:   withUpstreamIdentity(happyDownstreamCustomSessionData, oidcUpstreamUsername, nil),
 			wantAuthcodeExchangeCall: &expectedAuthcodeExchange{
 				performedByUpstreamName: happyUpstreamIDPName,
 				args:                    happyExchangeAndValidateTokensArgs,
@@ -1006,25 +1208,120 @@ func TestCallbackEndpoint(t *testing.T) {
 				args:                    happyExchangeAndValidateTokensArgs,
 			},
 		},
+		{
+			name:   "login started by the device verification page approves the device code session instead of returning an authcode",
+			idps:   oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(happyUpstream().Build()),
+			method: http.MethodGet,
+			path: newRequestPath().WithState(
+				happyUpstreamStateParam().WithAuthorizeRequestParams(
+					shallowCopyAndModifyQuery(
+						happyDownstreamRequestParamsQuery,
+						map[string]string{"pinniped_device_user_code": "BCDF-GHJK"},
+					).Encode(),
+				).Build(t, happyStateCodec),
+			).String(),
+			csrfCookie:                    happyCSRFAndDeviceApprovalCookies,
+			deviceUserCode:                "BCDF-GHJK",
+			wantStatus:                    http.StatusOK,
+			wantContentType:               htmlContentType,
+			wantBody:                      happyDeviceLoggedInPage(t),
+			wantDeviceCodeSessionApproved: true,
+			wantDeviceCodeSessionUsername: oidcUpstreamUsername,
+			wantAuthcodeExchangeCall: &expectedAuthcodeExchange{
+				performedByUpstreamName: happyUpstreamIDPName,
+				args:                    happyExchangeAndValidateTokensArgs,
+			},
+		},
+		{
+			name:   "login started by the device verification page with a user code which is not found",
+			idps:   oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(happyUpstream().Build()),
+			method: http.MethodGet,
+			path: newRequestPath().WithState(
+				happyUpstreamStateParam().WithAuthorizeRequestParams(
+					shallowCopyAndModifyQuery(
+						happyDownstreamRequestParamsQuery,
+						map[string]string{"pinniped_device_user_code": "ZZZZ-ZZZZ"},
+					).Encode(),
+				).Build(t, happyStateCodec),
+			).String(),
+			csrfCookie:      happyCSRFAndDeviceApprovalCookies,
+			deviceUserCode:  "BCDF-GHJK",
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: htmlContentType,
+			wantBody:        "Bad Request: user code not found\n",
+			wantAuthcodeExchangeCall: &expectedAuthcodeExchange{
+				performedByUpstreamName: happyUpstreamIDPName,
+				args:                    happyExchangeAndValidateTokensArgs,
+			},
+		},
+		{
+			name:   "authorize request with a user code which was not confirmed on the device verification page does not approve the device code session",
+			idps:   oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(happyUpstream().Build()),
+			method: http.MethodGet,
+			path: newRequestPath().WithState(
+				happyUpstreamStateParam().WithAuthorizeRequestParams(
+					shallowCopyAndModifyQuery(
+						happyDownstreamRequestParamsQuery,
+						map[string]string{"pinniped_device_user_code": "BCDF-GHJK"},
+					).Encode(),
+				).Build(t, happyStateCodec),
+			).String(),
+			csrfCookie:      happyCSRFCookie,
+			deviceUserCode:  "BCDF-GHJK",
+			wantStatus:      http.StatusForbidden,
+			wantContentType: htmlContentType,
+			wantBody:        "Forbidden: device approval cookie is missing\n",
+			wantAuthcodeExchangeCall: &expectedAuthcodeExchange{
+				performedByUpstreamName: happyUpstreamIDPName,
+				args:                    happyExchangeAndValidateTokensArgs,
+			},
+		},
+		{
+			name:   "login started by the device verification page with a device approval cookie from an earlier confirmation",
+			idps:   oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(happyUpstream().Build()),
+			method: http.MethodGet,
+			path: newRequestPath().WithState(
+				happyUpstreamStateParam().WithAuthorizeRequestParams(
+					shallowCopyAndModifyQuery(
+						happyDownstreamRequestParamsQuery,
+						map[string]string{"pinniped_device_user_code": "BCDF-GHJK"},
+					).Encode(),
+				).Build(t, happyStateCodec),
+			).String(),
+			csrfCookie:      happyCSRFCookie + "; __Host-pinniped-device-approval=" + encodedWrongDeviceApproval,
+			deviceUserCode:  "BCDF-GHJK",
+			wantStatus:      http.StatusForbidden,
+			wantContentType: htmlContentType,
+			wantBody:        "Forbidden: device approval cookie does not match the device code session\n",
+			wantAuthcodeExchangeCall: &expectedAuthcodeExchange{
+				performedByUpstreamName: happyUpstreamIDPName,
+				args:                    happyExchangeAndValidateTokensArgs,
+			},
+		},
 	}
 	for _, test := range tests {
 		test := test
 
 		t.Run(test.name, func(t *testing.T) {
+			auditEvents := testutil.RecordAuditEvents(t, audit.ComponentSupervisor)
 			client := fake.NewSimpleClientset()
 			secrets := client.CoreV1().Secrets("some-namespace")
 
 			// Configure fosite the same way that the production code would.
 			// Inject this into our test subject at the last second so we get a fresh storage for every test.
 			timeoutsConfiguration := oidc.DefaultOIDCTimeoutsConfiguration()
-			oauthStore := oidc.NewKubeStorage(secrets, timeoutsConfiguration)
+			oauthStore := oidc.NewKubeStorage(secrets, oidctestutil.NewClientManager(t, "some-namespace", nil, nil), timeoutsConfiguration)
 			hmacSecretFunc := func() []byte { return []byte("some secret - must have at least 32 bytes") }
 			require.GreaterOrEqual(t, len(hmacSecretFunc()), 32, "fosite requires that hmac secrets have at least 32 bytes")
 			jwksProviderIsUnused := jwks.NewDynamicJWKSProvider()
 			oauthHelper := oidc.FositeOauth2Helper(oauthStore, downstreamIssuer, hmacSecretFunc, jwksProviderIsUnused, timeoutsConfiguration)
 
-			subject := NewHandler(test.idps.Build(), oauthHelper, happyStateCodec, happyCookieCodec, happyUpstreamRedirectURI)
+			subject := NewHandler(test.idps.Build(), oidctestutil.NewIdentityTransformsGetter(t, test.idpTransforms), test.userInfoPassthroughClaims, oauthHelper, happyStateCodec, happyCookieCodec, happyUpstreamRedirectURI, oauthStore)
 			reqContext := context.WithValue(context.Background(), struct{ name string }{name: "test"}, "request-context")
+
+			if test.deviceUserCode != "" {
+				createPendingDeviceCodeSession(t, oauthStore, test.deviceUserCode)
+			}
 			req := httptest.NewRequest(test.method, test.path, nil).WithContext(reqContext)
 			if test.csrfCookie != "" {
 				req.Header.Set("Cookie", test.csrfCookie)
@@ -1035,6 +1332,8 @@ func TestCallbackEndpoint(t *testing.T) {
 			t.Logf("response body: %q", rsp.Body.String())
 
 			testutil.RequireSecurityHeaders(t, rsp)
+			wantAuditFailure := test.wantStatus >= http.StatusBadRequest || strings.Contains(test.wantRedirectLocationString, "error=")
+			requireCallbackAuditEvent(t, auditEvents(), wantAuditFailure, test.wantDownstreamIDTokenUsername, test.wantDeviceCodeSessionUsername)
 
 			if test.wantAuthcodeExchangeCall != nil {
 				test.wantAuthcodeExchangeCall.args.Ctx = reqContext
@@ -1080,6 +1379,10 @@ func TestCallbackEndpoint(t *testing.T) {
 				require.Empty(t, rsp.Body.String())
 			}
 
+			if test.wantRedirectLocationString != "" {
+				require.Equal(t, test.wantRedirectLocationString, rsp.Header().Get("Location"))
+			}
+
 			if test.wantRedirectLocationRegexp != "" { //nolint:nestif // don't mind have several sequential if statements in this test
 				require.Len(t, rsp.Header().Values("Location"), 1)
 				oidctestutil.RequireAuthCodeRegexpMatch(
@@ -1102,10 +1405,89 @@ func TestCallbackEndpoint(t *testing.T) {
 					test.wantDownstreamCustomSessionData,
 				)
 			}
+
+			if test.deviceUserCode != "" {
+				deviceCodeSession, _, err := oauthStore.GetDeviceCodeSession(reqContext, deviceCodeSessionSignature)
+				require.NoError(t, err)
+				if test.wantDeviceCodeSessionApproved {
+					require.Equal(t, devicecode.StatusApproved, deviceCodeSession.Status)
+					require.Equal(t, happyDownstreamScopesGranted, []string(deviceCodeSession.Request.GetGrantedScopes()))
+					pinnipedSession, ok := deviceCodeSession.Request.GetSession().(*psession.PinnipedSession)
+					require.True(t, ok)
+					require.Equal(t, test.wantDeviceCodeSessionUsername, pinnipedSession.Fosite.Claims.Extra["username"])
+					wantCustomSessionData := *happyDownstreamCustomSessionData
+					wantCustomSessionData.LoginTime = pinnipedSession.Fosite.Claims.AuthTime
+					require.Equal(t, &wantCustomSessionData, pinnipedSession.Custom)
+				} else {
+					require.Equal(t, devicecode.StatusPending, deviceCodeSession.Status)
+				}
+			}
 		})
 	}
 }
 
+// requireCallbackAuditEvent asserts that each request to the callback endpoint records exactly one audit event,
+// which is a failure exactly when the request failed, including when the client was redirected with an error.
+func requireCallbackAuditEvent(t *testing.T, events []audit.Event, wantFailure bool, wantUsernames ...string) {
+	t.Helper()
+
+	require.Len(t, events, 1)
+	event := events[0]
+	require.Equal(t, audit.TypeCallback, event.Type)
+	// The issuer is derived from the callback URL of the FederationDomain.
+	require.Equal(t, strings.TrimSuffix(happyUpstreamRedirectURI, oidc.CallbackEndpointPath), event.Issuer)
+	if wantFailure {
+		require.Equal(t, audit.OutcomeFailure, event.Outcome)
+		require.NotEmpty(t, event.Reason)
+		return
+	}
+	require.Equal(t, audit.OutcomeSuccess, event.Outcome)
+	require.Empty(t, event.Reason)
+	require.NotNil(t, event.IdentityProvider)
+	require.NotEmpty(t, event.Subject)
+	for _, wantUsername := range wantUsernames {
+		if wantUsername != "" {
+			require.Equal(t, wantUsername, event.Username)
+		}
+	}
+}
+
+const (
+	deviceCodeSessionSignature = "device-code-signature"
+	deviceApprovalToken        = "some-approval-token"
+)
+
+func createPendingDeviceCodeSession(t *testing.T, storage *oidc.KubeStorage, userCode string) {
+	t.Helper()
+
+	ctx := context.Background()
+	client, err := storage.GetClient(ctx, downstreamClientID)
+	require.NoError(t, err)
+
+	request := fosite.NewRequest()
+	request.ID = "device-request-id"
+	request.Client = client
+	request.RequestedScope = happyDownstreamScopesRequested
+	request.Session = psession.NewPinnipedSession()
+
+	require.NoError(t, storage.CreateDeviceCodeSession(ctx, &devicecode.Session{
+		Request:       request,
+		Signature:     deviceCodeSessionSignature,
+		UserCode:      userCode,
+		Status:        devicecode.StatusPending,
+		ExpiresAt:     time.Now().Add(time.Minute),
+		ApprovalToken: deviceApprovalToken,
+	}))
+}
+
+func happyDeviceLoggedInPage(t *testing.T) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	require.NoError(t, devicehtml.Template().Execute(&buf, &devicehtml.PageData{LoggedIn: true}))
+	return buf.String()
+}
+
 type expectedAuthcodeExchange struct {
 	performedByUpstreamName string
 	args                    *oidctestutil.ExchangeAuthcodeAndValidateTokenArgs
@@ -1161,6 +1543,7 @@ type upstreamStateParamBuilder oidctestutil.ExpectedUpstreamStateParamFormat
 func happyUpstreamStateParam() *upstreamStateParamBuilder {
 	return &upstreamStateParamBuilder{
 		U: happyUpstreamIDPName,
+		T: happyUpstreamIDPType,
 		P: happyDownstreamRequestParams,
 		N: happyDownstreamNonce,
 		C: happyDownstreamCSRF,
@@ -1180,6 +1563,11 @@ func (b *upstreamStateParamBuilder) WithAuthorizeRequestParams(params string) *u
 	return b
 }
 
+func (b *upstreamStateParamBuilder) WithUpstreamType(upstreamType string) *upstreamStateParamBuilder {
+	b.T = upstreamType
+	return b
+}
+
 func (b *upstreamStateParamBuilder) WithNonce(nonce string) *upstreamStateParamBuilder {
 	b.N = nonce
 	return b
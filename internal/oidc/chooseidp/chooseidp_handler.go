@@ -0,0 +1,99 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package chooseidp provides a handler for the upstream identity provider chooser page.
+package chooseidp
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+
+	"go.pinniped.dev/generated/latest/apis/supervisor/idpdiscovery/v1alpha1"
+	supervisoroidc "go.pinniped.dev/generated/latest/apis/supervisor/oidc"
+	"go.pinniped.dev/internal/httputil/httperr"
+	"go.pinniped.dev/internal/httputil/securityheader"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/chooseidp/chooseidphtml"
+	"go.pinniped.dev/internal/plog"
+)
+
+// NewHandler returns an http.Handler that serves a web page which allows the end user to choose which
+// upstream identity provider to use for an authorization request. The authorization endpoint redirects
+// browsers here when there are several upstream identity providers and the authorization request did not
+// specify which one to use. Each choice on the page links back to the authorization endpoint with the
+// original authorization request parameters plus the parameters which select the chosen identity provider.
+func NewHandler(authorizeURL string, upstreamIDPs oidc.UpstreamIdentityProvidersLister) http.Handler {
+	handler := httperr.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if r.Method != http.MethodGet {
+			return httperr.Newf(http.StatusMethodNotAllowed, "%s (try GET)", r.Method)
+		}
+
+		// This is just a sanity check that it appears to be an authorize request. The authorization endpoint
+		// will validate all the params again when the user makes their choice.
+		query := r.URL.Query()
+		if query.Get("client_id") == "" || query.Get("response_type") == "" {
+			return httperr.New(http.StatusBadRequest, "missing required authorize params")
+		}
+
+		identityProviders := identityProviderChoices(authorizeURL, query, upstreamIDPs)
+		if len(identityProviders) == 0 {
+			return httperr.New(http.StatusUnprocessableEntity, "No upstream providers are configured")
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := chooseidphtml.Template().Execute(w, &chooseidphtml.PageData{IdentityProviders: identityProviders})
+		if err != nil {
+			plog.Error("error rendering identity provider chooser page", err)
+			return httperr.Wrap(http.StatusInternalServerError, "error rendering page", err)
+		}
+		return nil
+	})
+	return securityheader.WrapWithCustomCSP(handler, chooseidphtml.ContentSecurityPolicy())
+}
+
+func identityProviderChoices(
+	authorizeURL string,
+	authorizeParams url.Values,
+	upstreamIDPs oidc.UpstreamIdentityProvidersLister,
+) []chooseidphtml.IdentityProvider {
+	var choices []chooseidphtml.IdentityProvider
+	add := func(name string, idpType v1alpha1.IDPType) {
+		choices = append(choices, chooseidphtml.IdentityProvider{
+			Name: name,
+			Type: idpType.String(),
+			URL:  authorizeURLForIDP(authorizeURL, authorizeParams, name, idpType),
+		})
+	}
+
+	// The cache of IDPs could change at any time, so always recalculate the list.
+	for _, p := range upstreamIDPs.GetOIDCIdentityProviders() {
+		add(p.GetName(), v1alpha1.IDPTypeOIDC)
+	}
+	for _, p := range upstreamIDPs.GetLDAPIdentityProviders() {
+		add(p.GetName(), v1alpha1.IDPTypeLDAP)
+	}
+	for _, p := range upstreamIDPs.GetActiveDirectoryIdentityProviders() {
+		add(p.GetName(), v1alpha1.IDPTypeActiveDirectory)
+	}
+
+	// Sort the same way as the IDP discovery endpoint, so the page does not change unnecessarily.
+	sort.SliceStable(choices, func(i, j int) bool {
+		if choices[i].Name == choices[j].Name {
+			return choices[i].Type < choices[j].Type
+		}
+		return choices[i].Name < choices[j].Name
+	})
+
+	return choices
+}
+
+func authorizeURLForIDP(authorizeURL string, authorizeParams url.Values, idpName string, idpType v1alpha1.IDPType) string {
+	params := url.Values{}
+	for k, v := range authorizeParams {
+		params[k] = v
+	}
+	params.Set(supervisoroidc.AuthorizeUpstreamIDPNameParamName, idpName)
+	params.Set(supervisoroidc.AuthorizeUpstreamIDPTypeParamName, idpType.String())
+	return authorizeURL + "?" + params.Encode()
+}
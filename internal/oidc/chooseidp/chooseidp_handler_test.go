@@ -0,0 +1,169 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package chooseidp
+
+import (
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/testutil/oidctestutil"
+)
+
+func TestChooseIDPHandler(t *testing.T) {
+	const (
+		authorizeURL = "https://my-issuer.com/some-path" + oidc.AuthorizationEndpointPath
+		happyQuery   = "?client_id=pinniped-cli&response_type=code&scope=openid&state=some-state"
+	)
+
+	idpLink := func(name, idpType string) string {
+		params := url.Values{
+			"client_id":         []string{"pinniped-cli"},
+			"response_type":     []string{"code"},
+			"scope":             []string{"openid"},
+			"state":             []string{"some-state"},
+			"pinniped_idp_name": []string{name},
+			"pinniped_idp_type": []string{idpType},
+		}
+		href := authorizeURL + "?" + params.Encode()
+		return `<li><a href="` + html.EscapeString(href) + `" class="idp" data-type="` + idpType + `">` + name + `</a></li>`
+	}
+
+	tests := []struct {
+		name string
+
+		idps   *oidctestutil.UpstreamIDPListerBuilder
+		method string
+		path   string
+
+		wantStatus          int
+		wantContentType     string
+		wantBodyString      string
+		wantBodyContainsAll []string
+		wantIDPLinkCount    int
+	}{
+		{
+			name: "happy path",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().
+				WithOIDC(&oidctestutil.TestUpstreamOIDCIdentityProvider{Name: "z-some-oidc-idp"}).
+				WithOIDC(&oidctestutil.TestUpstreamOIDCIdentityProvider{Name: "x-some-idp"}).
+				WithLDAP(&oidctestutil.TestUpstreamLDAPIdentityProvider{Name: "a-some-ldap-idp"}).
+				WithLDAP(&oidctestutil.TestUpstreamLDAPIdentityProvider{Name: "x-some-idp"}).
+				WithActiveDirectory(&oidctestutil.TestUpstreamLDAPIdentityProvider{Name: "y-some-ad-idp"}),
+			method:          http.MethodGet,
+			path:            "/some/path" + happyQuery,
+			wantStatus:      http.StatusOK,
+			wantContentType: "text/html; charset=utf-8",
+			wantBodyContainsAll: []string{
+				"<title>Choose Identity Provider</title>",
+				idpLink("a-some-ldap-idp", "ldap") + "\n        " +
+					idpLink("x-some-idp", "ldap") + "\n        " +
+					idpLink("x-some-idp", "oidc") + "\n        " +
+					idpLink("y-some-ad-idp", "activedirectory") + "\n        " +
+					idpLink("z-some-oidc-idp", "oidc"),
+			},
+			wantIDPLinkCount: 5,
+		},
+		{
+			name: "previously chosen IDP params are replaced",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().
+				WithOIDC(&oidctestutil.TestUpstreamOIDCIdentityProvider{Name: "some-oidc-idp"}),
+			method:              http.MethodGet,
+			path:                "/some/path" + happyQuery + "&pinniped_idp_name=some-other-idp&pinniped_idp_type=ldap",
+			wantStatus:          http.StatusOK,
+			wantContentType:     "text/html; charset=utf-8",
+			wantBodyContainsAll: []string{idpLink("some-oidc-idp", "oidc")},
+			wantIDPLinkCount:    1,
+		},
+		{
+			name:            "no upstream providers are configured",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder(),
+			method:          http.MethodGet,
+			path:            "/some/path" + happyQuery,
+			wantStatus:      http.StatusUnprocessableEntity,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBodyString:  "Unprocessable Entity: No upstream providers are configured\n",
+		},
+		{
+			name:            "missing client_id param",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(&oidctestutil.TestUpstreamOIDCIdentityProvider{Name: "some-oidc-idp"}),
+			method:          http.MethodGet,
+			path:            "/some/path?response_type=code",
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBodyString:  "Bad Request: missing required authorize params\n",
+		},
+		{
+			name:            "missing response_type param",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(&oidctestutil.TestUpstreamOIDCIdentityProvider{Name: "some-oidc-idp"}),
+			method:          http.MethodGet,
+			path:            "/some/path?client_id=pinniped-cli",
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBodyString:  "Bad Request: missing required authorize params\n",
+		},
+		{
+			name:            "bad method",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(&oidctestutil.TestUpstreamOIDCIdentityProvider{Name: "some-oidc-idp"}),
+			method:          http.MethodPost,
+			path:            "/some/path" + happyQuery,
+			wantStatus:      http.StatusMethodNotAllowed,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBodyString:  "Method Not Allowed: POST (try GET)\n",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			handler := NewHandler(authorizeURL, test.idps.Build())
+			req := httptest.NewRequest(test.method, test.path, nil)
+			rsp := httptest.NewRecorder()
+			handler.ServeHTTP(rsp, req)
+
+			require.Equal(t, test.wantStatus, rsp.Code)
+			require.Equal(t, test.wantContentType, rsp.Header().Get("Content-Type"))
+
+			if test.wantBodyString != "" {
+				require.Equal(t, test.wantBodyString, rsp.Body.String())
+			}
+			for _, want := range test.wantBodyContainsAll {
+				require.Contains(t, rsp.Body.String(), want)
+			}
+			require.Equal(t, test.wantIDPLinkCount, strings.Count(rsp.Body.String(), `class="idp"`))
+		})
+	}
+}
+
+func TestChooseIDPHandlerRecalculatesIDPs(t *testing.T) {
+	idpLister := oidctestutil.NewUpstreamIDPListerBuilder().
+		WithOIDC(&oidctestutil.TestUpstreamOIDCIdentityProvider{Name: "some-oidc-idp"}).
+		Build()
+	handler := NewHandler("https://my-issuer.com"+oidc.AuthorizationEndpointPath, idpLister)
+	req := httptest.NewRequest(http.MethodGet, "/some/path?client_id=pinniped-cli&response_type=code", nil)
+
+	rsp := httptest.NewRecorder()
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, http.StatusOK, rsp.Code)
+	require.Contains(t, rsp.Body.String(), ">some-oidc-idp</a>")
+
+	// Change the list of IDPs in the cache.
+	idpLister.SetOIDCIdentityProviders([]provider.UpstreamOIDCIdentityProviderI{})
+	idpLister.SetLDAPIdentityProviders([]provider.UpstreamLDAPIdentityProviderI{
+		&oidctestutil.TestUpstreamLDAPIdentityProvider{Name: "some-ldap-idp"},
+	})
+
+	// Make the same request to the same handler instance again, and expect different results.
+	rsp = httptest.NewRecorder()
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, http.StatusOK, rsp.Code)
+	require.NotContains(t, rsp.Body.String(), ">some-oidc-idp</a>")
+	require.Contains(t, rsp.Body.String(), ">some-ldap-idp</a>")
+}
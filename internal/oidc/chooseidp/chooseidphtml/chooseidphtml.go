@@ -0,0 +1,73 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package chooseidphtml defines HTML templates used by the Supervisor.
+//nolint: gochecknoglobals // This package uses globals to ensure that all parsing and minifying happens at init.
+package chooseidphtml
+
+import (
+	"crypto/sha256"
+	_ "embed" // Needed to trigger //go:embed directives below.
+	"encoding/base64"
+	"html/template"
+	"strings"
+
+	"github.com/tdewolff/minify/v2/minify"
+)
+
+var (
+	//go:embed choose_idp.css
+	rawCSS      string
+	minifiedCSS = mustMinify(minify.CSS(rawCSS))
+
+	//go:embed choose_idp.gohtml
+	rawHTMLTemplate string
+)
+
+// Parse the Go templated HTML and inject functions providing the minified inline CSS.
+var parsedHTMLTemplate = template.Must(template.New("choose_idp.gohtml").Funcs(template.FuncMap{
+	"minifiedCSS": func() template.CSS { return template.CSS(minifiedCSS) },
+}).Parse(rawHTMLTemplate))
+
+// Generate the CSP header value once since it's effectively constant:
+var cspValue = strings.Join([]string{
+	`default-src 'none'`,
+	`style-src '` + cspHash(minifiedCSS) + `'`,
+	`img-src data:`,
+	`frame-ancestors 'none'`,
+}, "; ")
+
+// IdentityProvider is a single choice rendered on the page.
+type IdentityProvider struct {
+	// Name is the name of the upstream identity provider resource.
+	Name string
+	// Type is the type of the upstream identity provider, e.g. "oidc".
+	Type string
+	// URL is the authorization endpoint URL which starts a login with this identity provider.
+	URL string
+}
+
+// PageData is the input to the Template().
+type PageData struct {
+	IdentityProviders []IdentityProvider
+}
+
+func mustMinify(s string, err error) string {
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func cspHash(s string) string {
+	hashBytes := sha256.Sum256([]byte(s))
+	return "sha256-" + base64.StdEncoding.EncodeToString(hashBytes[:])
+}
+
+// ContentSecurityPolicy returns the Content-Security-Policy header value to make the Template() operate correctly.
+//
+// See https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Content-Security-Policy/default-src#:~:text=%27%3Chash-algorithm%3E-%3Cbase64-value%3E%27.
+func ContentSecurityPolicy() string { return cspValue }
+
+// Template returns the html/template.Template for rendering the identity provider chooser page.
+func Template() *template.Template { return parsedHTMLTemplate }
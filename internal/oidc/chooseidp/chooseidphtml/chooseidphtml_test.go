@@ -0,0 +1,81 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package chooseidphtml
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/here"
+)
+
+var (
+	testPageData = &PageData{
+		IdentityProviders: []IdentityProvider{
+			{
+				Name: "my-ldap",
+				Type: "ldap",
+				URL:  "https://example.com/issuer/oauth2/authorize?client_id=pinniped-cli&pinniped_idp_name=my-ldap&pinniped_idp_type=ldap",
+			},
+			{
+				Name: "my-oidc",
+				Type: "oidc",
+				URL:  "https://example.com/issuer/oauth2/authorize?client_id=pinniped-cli&pinniped_idp_name=my-oidc&pinniped_idp_type=oidc",
+			},
+		},
+	}
+
+	testExpectedChooseIDPOutput = here.Doc(`
+        <!DOCTYPE html>
+        <html lang="en">
+        <head>
+            <meta charset="UTF-8">
+            <title>Choose Identity Provider</title>
+            <style>body{font-family:metropolis-light,Helvetica,sans-serif}h1{font-size:20px}.box{position:absolute;top:100px;left:50%;width:400px;margin-left:-200px;font-size:14px;line-height:24px}ul{list-style:none;padding:0}li{margin:10px 0}a.idp{display:block;padding:10px;border:1px solid #ddd;color:#1b3951;text-decoration:none;word-wrap:break-word;transition:all .1s}a.idp:hover{background-color:#eee;transform:scale(1.01)}a.idp:active{background-color:#ddd;transform:scale(.99)}</style>
+            <link id="favicon" rel="icon" href="data:image/svg+xml,<svg xmlns=%22http://www.w3.org/2000/svg%22 viewBox=%220 0 100 100%22><text y=%22.9em%22 font-size=%2290%22>🔑</text></svg>"/>
+        </head>
+        <body>
+        <div class="box">
+            <h1>Choose an identity provider</h1>
+            <p>Log in with one of the following identity providers:</p>
+            <ul>
+                <li><a href="https://example.com/issuer/oauth2/authorize?client_id=pinniped-cli&amp;pinniped_idp_name=my-ldap&amp;pinniped_idp_type=ldap" class="idp" data-type="ldap">my-ldap</a></li>
+                <li><a href="https://example.com/issuer/oauth2/authorize?client_id=pinniped-cli&amp;pinniped_idp_name=my-oidc&amp;pinniped_idp_type=oidc" class="idp" data-type="oidc">my-oidc</a></li>
+            </ul>
+        </div>
+        </body>
+        </html>
+		`)
+
+	// It's okay if this changes in the future, but this gives us a chance to eyeball the formatting.
+	// Our browser-based integration tests should find any incompatibilities.
+	testExpectedCSP = `default-src 'none'; ` +
+		`style-src 'sha256-/ugbLMHw60OwKdmVaLP/eg41S0xcGaCsbZpO6RNdDa4='; ` +
+		`img-src data:; ` +
+		`frame-ancestors 'none'`
+)
+
+func TestTemplate(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Template().Execute(&buf, testPageData))
+
+	// t.Logf("actual value:\n%s", buf.String()) // useful when updating minify library causes new output
+	require.Equal(t, testExpectedChooseIDPOutput, buf.String())
+}
+
+func TestContentSecurityPolicyHashes(t *testing.T) {
+	require.Equal(t, testExpectedCSP, ContentSecurityPolicy())
+}
+
+func TestHelpers(t *testing.T) {
+	// These are silly tests but it's easy to we might as well have them.
+	require.Equal(t, "test", mustMinify("test", nil))
+	require.PanicsWithError(t, "some error", func() { mustMinify("", fmt.Errorf("some error")) })
+
+	// Example test vector from https://content-security-policy.com/hash/.
+	require.Equal(t, "sha256-RFWPLDbv2BY+rCkDzsE+0fr8ylGr2R2faWMhq4lfEQc=", cspHash("doSomething();"))
+}
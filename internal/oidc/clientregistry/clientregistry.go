@@ -1,4 +1,4 @@
-// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2021-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 // Package clientregistry defines Pinniped's OAuth2/OIDC clients.
@@ -7,10 +7,17 @@ package clientregistry
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/ory/fosite"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+
+	configv1alpha1 "go.pinniped.dev/generated/latest/apis/supervisor/config/v1alpha1"
+	configv1alpha1listers "go.pinniped.dev/generated/latest/client/supervisor/listers/config/v1alpha1"
+	"go.pinniped.dev/internal/oidcclientvalidator"
 )
 
 // Client represents a Pinniped OAuth/OIDC client.
@@ -30,28 +37,67 @@ var (
 	_ fosite.ResponseModeClient  = (*Client)(nil)
 )
 
-// StaticClientManager is a fosite.ClientManager with statically-defined clients.
-type StaticClientManager struct{}
+// ClientManager is a fosite.ClientManager which knows about the static pinniped-cli client and about the dynamic
+// clients which are configured by OIDCClient resources in the Supervisor's namespace.
+type ClientManager struct {
+	oidcClientsLister configv1alpha1listers.OIDCClientNamespaceLister
+	secretsLister     corev1listers.SecretNamespaceLister
+}
+
+var _ fosite.ClientManager = (*ClientManager)(nil)
 
-var _ fosite.ClientManager = (*StaticClientManager)(nil)
+// NewClientManager returns a ClientManager which reads OIDCClients and their client secret Secrets from the given
+// namespaced listers, which are typically backed by informers.
+func NewClientManager(
+	oidcClientsLister configv1alpha1listers.OIDCClientNamespaceLister,
+	secretsLister corev1listers.SecretNamespaceLister,
+) *ClientManager {
+	return &ClientManager{
+		oidcClientsLister: oidcClientsLister,
+		secretsLister:     secretsLister,
+	}
+}
 
-// GetClient returns a static client specified by the given ID.
+// GetClient returns the client specified by the given ID.
 //
-// It returns a fosite.ErrNotFound if an unknown client is specified.
-func (StaticClientManager) GetClient(_ context.Context, id string) (fosite.Client, error) {
-	switch id {
-	case "pinniped-cli":
+// It returns a fosite.ErrNotFound if an unknown client is specified, or if the OIDCClient of the specified client
+// is invalid.
+func (m *ClientManager) GetClient(_ context.Context, id string) (fosite.Client, error) {
+	if id == PinnipedCLI().GetID() {
 		return PinnipedCLI(), nil
-	default:
+	}
+
+	if !strings.HasPrefix(id, oidcclientvalidator.ClientIDPrefix) {
+		return nil, fosite.ErrNotFound.WithDescription("no such client")
+	}
+
+	oidcClient, err := m.oidcClientsLister.Get(id)
+	if apierrors.IsNotFound(err) {
 		return nil, fosite.ErrNotFound.WithDescription("no such client")
 	}
+	if err != nil {
+		return nil, fosite.ErrServerError.WithWrap(err).WithDebug(err.Error())
+	}
+
+	secret, err := m.secretsLister.Get(oidcClient.Spec.ClientSecret.SecretName)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, fosite.ErrServerError.WithWrap(err).WithDebug(err.Error())
+	}
+
+	valid, _, hash := oidcclientvalidator.Validate(oidcClient, secret)
+	if !valid {
+		// Do not use an invalid client. The OIDCClient's status conditions describe what is wrong with it.
+		return nil, fosite.ErrNotFound.WithDescription("no such client")
+	}
+
+	return oidcClientToFositeClient(oidcClient, hash), nil
 }
 
 // ClientAssertionJWTValid returns an error if the JTI is
 // known or the DB check failed and nil if the JTI is not known.
 //
-// This functionality is not supported by the StaticClientManager.
-func (StaticClientManager) ClientAssertionJWTValid(ctx context.Context, jti string) error {
+// This functionality is not supported by the ClientManager.
+func (*ClientManager) ClientAssertionJWTValid(ctx context.Context, jti string) error {
 	return fmt.Errorf("not implemented")
 }
 
@@ -60,11 +106,52 @@ func (StaticClientManager) ClientAssertionJWTValid(ctx context.Context, jti stri
 // up any existing JTIs that have expired as those tokens can
 // not be replayed due to the expiry.
 //
-// This functionality is not supported by the StaticClientManager.
-func (StaticClientManager) SetClientAssertionJWT(ctx context.Context, jti string, exp time.Time) error {
+// This functionality is not supported by the ClientManager.
+func (*ClientManager) SetClientAssertionJWT(ctx context.Context, jti string, exp time.Time) error {
 	return fmt.Errorf("not implemented")
 }
 
+// oidcClientToFositeClient converts a validated OIDCClient into a confidential Client.
+func oidcClientToFositeClient(oidcClient *configv1alpha1.OIDCClient, clientSecretHash []byte) *Client {
+	redirectURIs := make([]string, 0, len(oidcClient.Spec.AllowedRedirectURIs))
+	for _, u := range oidcClient.Spec.AllowedRedirectURIs {
+		redirectURIs = append(redirectURIs, string(u))
+	}
+	grantTypes := make(fosite.Arguments, 0, len(oidcClient.Spec.AllowedGrantTypes))
+	for _, g := range oidcClient.Spec.AllowedGrantTypes {
+		grantTypes = append(grantTypes, string(g))
+	}
+	scopes := make(fosite.Arguments, 0, len(oidcClient.Spec.AllowedScopes))
+	for _, s := range oidcClient.Spec.AllowedScopes {
+		scopes = append(scopes, string(s))
+	}
+	tokenEndpointAuthMethod := oidcClient.Spec.TokenEndpointAuthMethod
+	if tokenEndpointAuthMethod == "" {
+		tokenEndpointAuthMethod = configv1alpha1.ClientSecretBasic
+	}
+
+	return &Client{
+		DefaultOpenIDConnectClient: fosite.DefaultOpenIDConnectClient{
+			DefaultClient: &fosite.DefaultClient{
+				ID:            oidcClient.Name,
+				Secret:        clientSecretHash,
+				RedirectURIs:  redirectURIs,
+				GrantTypes:    grantTypes,
+				ResponseTypes: []string{"code"},
+				Scopes:        scopes,
+				Audience:      nil,
+				Public:        false,
+			},
+			RequestURIs:                       nil,
+			JSONWebKeys:                       nil,
+			JSONWebKeysURI:                    "",
+			RequestObjectSigningAlgorithm:     "",
+			TokenEndpointAuthSigningAlgorithm: oidc.RS256,
+			TokenEndpointAuthMethod:           string(tokenEndpointAuthMethod),
+		},
+	}
+}
+
 // PinnipedCLI returns the static Client corresponding to the Pinniped CLI.
 func PinnipedCLI() *Client {
 	return &Client{
@@ -77,6 +164,7 @@ func PinnipedCLI() *Client {
 					"authorization_code",
 					"refresh_token",
 					"urn:ietf:params:oauth:grant-type:token-exchange",
+					"urn:ietf:params:oauth:grant-type:device_code",
 				},
 				ResponseTypes: []string{"code"},
 				Scopes: fosite.Arguments{
@@ -1,4 +1,4 @@
-// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2021-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package clientregistry
@@ -12,34 +12,144 @@ import (
 	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/ory/fosite"
 	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	configv1alpha1 "go.pinniped.dev/generated/latest/apis/supervisor/config/v1alpha1"
+	configv1alpha1listers "go.pinniped.dev/generated/latest/client/supervisor/listers/config/v1alpha1"
 )
 
-func TestStaticRegistry(t *testing.T) {
+const (
+	testNamespace = "some-namespace"
+	testClientID  = "client.oauth.pinniped.dev-test"
+
+	// testClientSecretHash is a bcrypt hash of "some-client-secret" with cost 12.
+	testClientSecretHash = "$2a$12$yHGWWZy/UWGN7V0ETyyP/etrfr1n0GOdWpwJt3HxUqBlar/3Z3.D6"
+)
+
+func TestClientManager(t *testing.T) {
 	ctx := context.Background()
 
-	t.Run("unimplemented methods", func(t *testing.T) {
-		registry := StaticClientManager{}
-		require.EqualError(t, registry.ClientAssertionJWTValid(ctx, "some-token-id"), "not implemented")
-		require.EqualError(t, registry.SetClientAssertionJWT(ctx, "some-token-id", time.Now()), "not implemented")
-	})
+	validOIDCClient := func() *configv1alpha1.OIDCClient {
+		return &configv1alpha1.OIDCClient{
+			ObjectMeta: metav1.ObjectMeta{Name: testClientID, Namespace: testNamespace},
+			Spec: configv1alpha1.OIDCClientSpec{
+				AllowedRedirectURIs: []configv1alpha1.RedirectURI{"https://app.example.com/callback"},
+				AllowedGrantTypes:   []configv1alpha1.GrantType{"authorization_code", "refresh_token"},
+				AllowedScopes:       []configv1alpha1.Scope{"openid", "offline_access", "email"},
+				ClientSecret:        configv1alpha1.OIDCClientSecret{SecretName: "some-secret"},
+			},
+		}
+	}
+	validSecret := func() *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "some-secret", Namespace: testNamespace},
+			Type:       "secrets.pinniped.dev/oidc-client-secret",
+			Data:       map[string][]byte{"clientSecretHash": []byte(testClientSecretHash)},
+		}
+	}
 
-	t.Run("not found", func(t *testing.T) {
-		registry := StaticClientManager{}
-		got, err := registry.GetClient(ctx, "does-not-exist")
+	newClientManager := func(t *testing.T, oidcClients []*configv1alpha1.OIDCClient, secrets []*corev1.Secret) *ClientManager {
+		oidcClientsIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+		for _, oidcClient := range oidcClients {
+			require.NoError(t, oidcClientsIndexer.Add(oidcClient))
+		}
+		secretsIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+		for _, secret := range secrets {
+			require.NoError(t, secretsIndexer.Add(secret))
+		}
+		return NewClientManager(
+			configv1alpha1listers.NewOIDCClientLister(oidcClientsIndexer).OIDCClients(testNamespace),
+			corev1listers.NewSecretLister(secretsIndexer).Secrets(testNamespace),
+		)
+	}
+
+	requireNotFound := func(t *testing.T, got fosite.Client, err error) {
 		require.Error(t, err)
 		require.Nil(t, got)
 		rfcErr := fosite.ErrorToRFC6749Error(err)
 		require.NotNil(t, rfcErr)
 		require.Equal(t, rfcErr.CodeField, 404)
 		require.Equal(t, rfcErr.GetDescription(), "no such client")
+	}
+
+	t.Run("unimplemented methods", func(t *testing.T) {
+		registry := newClientManager(t, nil, nil)
+		require.EqualError(t, registry.ClientAssertionJWTValid(ctx, "some-token-id"), "not implemented")
+		require.EqualError(t, registry.SetClientAssertionJWT(ctx, "some-token-id", time.Now()), "not implemented")
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		registry := newClientManager(t, nil, nil)
+		got, err := registry.GetClient(ctx, "does-not-exist")
+		requireNotFound(t, got, err)
+	})
+
+	t.Run("OIDCClient without the required name prefix is not found", func(t *testing.T) {
+		oidcClient := validOIDCClient()
+		oidcClient.Name = "does-not-have-prefix"
+		registry := newClientManager(t, []*configv1alpha1.OIDCClient{oidcClient}, []*corev1.Secret{validSecret()})
+		got, err := registry.GetClient(ctx, "does-not-have-prefix")
+		requireNotFound(t, got, err)
+	})
+
+	t.Run("OIDCClient in another namespace is not found", func(t *testing.T) {
+		oidcClient := validOIDCClient()
+		oidcClient.Namespace = "other-namespace"
+		registry := newClientManager(t, []*configv1alpha1.OIDCClient{oidcClient}, []*corev1.Secret{validSecret()})
+		got, err := registry.GetClient(ctx, testClientID)
+		requireNotFound(t, got, err)
+	})
+
+	t.Run("OIDCClient whose Secret does not exist is not found", func(t *testing.T) {
+		registry := newClientManager(t, []*configv1alpha1.OIDCClient{validOIDCClient()}, nil)
+		got, err := registry.GetClient(ctx, testClientID)
+		requireNotFound(t, got, err)
+	})
+
+	t.Run("invalid OIDCClient is not found", func(t *testing.T) {
+		oidcClient := validOIDCClient()
+		oidcClient.Spec.AllowedScopes = []configv1alpha1.Scope{"email"}
+		registry := newClientManager(t, []*configv1alpha1.OIDCClient{oidcClient}, []*corev1.Secret{validSecret()})
+		got, err := registry.GetClient(ctx, testClientID)
+		requireNotFound(t, got, err)
 	})
 
 	t.Run("pinniped CLI", func(t *testing.T) {
-		registry := StaticClientManager{}
+		registry := newClientManager(t, nil, nil)
 		got, err := registry.GetClient(ctx, "pinniped-cli")
 		require.NoError(t, err)
 		require.NotNil(t, got)
 		require.IsType(t, &Client{}, got)
+		require.True(t, got.IsPublic())
+	})
+
+	t.Run("valid OIDCClient", func(t *testing.T) {
+		registry := newClientManager(t, []*configv1alpha1.OIDCClient{validOIDCClient()}, []*corev1.Secret{validSecret()})
+		got, err := registry.GetClient(ctx, testClientID)
+		require.NoError(t, err)
+		require.IsType(t, &Client{}, got)
+		c := got.(*Client)
+		require.Equal(t, testClientID, c.GetID())
+		require.Equal(t, []byte(testClientSecretHash), c.GetHashedSecret())
+		require.Equal(t, []string{"https://app.example.com/callback"}, c.GetRedirectURIs())
+		require.Equal(t, fosite.Arguments{"authorization_code", "refresh_token"}, c.GetGrantTypes())
+		require.Equal(t, fosite.Arguments{"code"}, c.GetResponseTypes())
+		require.Equal(t, fosite.Arguments{"openid", "offline_access", "email"}, c.GetScopes())
+		require.False(t, c.IsPublic())
+		require.Equal(t, "client_secret_basic", c.GetTokenEndpointAuthMethod())
+		require.Equal(t, []fosite.ResponseModeType{"", "query", "form_post"}, c.GetResponseModes())
+	})
+
+	t.Run("valid OIDCClient which uses client_secret_post", func(t *testing.T) {
+		oidcClient := validOIDCClient()
+		oidcClient.Spec.TokenEndpointAuthMethod = configv1alpha1.ClientSecretPost
+		registry := newClientManager(t, []*configv1alpha1.OIDCClient{oidcClient}, []*corev1.Secret{validSecret()})
+		got, err := registry.GetClient(ctx, testClientID)
+		require.NoError(t, err)
+		require.Equal(t, "client_secret_post", got.(*Client).GetTokenEndpointAuthMethod())
 	})
 }
 
@@ -48,7 +158,7 @@ func TestPinnipedCLI(t *testing.T) {
 	require.Equal(t, "pinniped-cli", c.GetID())
 	require.Nil(t, c.GetHashedSecret())
 	require.Equal(t, []string{"http://127.0.0.1/callback"}, c.GetRedirectURIs())
-	require.Equal(t, fosite.Arguments{"authorization_code", "refresh_token", "urn:ietf:params:oauth:grant-type:token-exchange"}, c.GetGrantTypes())
+	require.Equal(t, fosite.Arguments{"authorization_code", "refresh_token", "urn:ietf:params:oauth:grant-type:token-exchange", "urn:ietf:params:oauth:grant-type:device_code"}, c.GetGrantTypes())
 	require.Equal(t, fosite.Arguments{"code"}, c.GetResponseTypes())
 	require.Equal(t, fosite.Arguments{oidc.ScopeOpenID, oidc.ScopeOfflineAccess, "profile", "email", "pinniped:request-audience"}, c.GetScopes())
 	require.True(t, c.IsPublic())
@@ -72,7 +182,8 @@ func TestPinnipedCLI(t *testing.T) {
 		  "grant_types": [
 			"authorization_code",
 			"refresh_token",
-			"urn:ietf:params:oauth:grant-type:token-exchange"
+			"urn:ietf:params:oauth:grant-type:token-exchange",
+			"urn:ietf:params:oauth:grant-type:device_code"
 		  ],
 		  "response_types": [
 			"code"
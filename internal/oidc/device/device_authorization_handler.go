@@ -0,0 +1,188 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package device provides the handlers for the OAuth 2.0 device authorization grant (RFC 8628), which allows the user
+// to log in using a web browser on another computer than the one which runs the client.
+package device
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ory/fosite"
+
+	"go.pinniped.dev/internal/fositestorage/devicecode"
+	"go.pinniped.dev/internal/httputil/httperr"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/psession"
+)
+
+const (
+	// userCodeCharset avoids vowels, to avoid spelling words, and avoids characters which look alike.
+	userCodeCharset = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength  = 8
+)
+
+// Storage is the storage needed by the device handlers.
+type Storage interface {
+	fosite.ClientManager
+	devicecode.Storage
+}
+
+type authorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+// NewAuthorizationHandler returns an http.Handler for the device authorization endpoint
+// (https://datatracker.ietf.org/doc/html/rfc8628#section-3.1). It starts a device code session and returns the device
+// code, which the client uses to poll the token endpoint, and the user code, which the user enters on the device
+// verification page. Only clients which are allowed to use the device code grant may use this endpoint. The
+// pinniped_idp_name and pinniped_idp_type params are remembered, and are later used to choose the upstream identity
+// provider in the same way as they are used by the authorization endpoint.
+func NewAuthorizationHandler(
+	issuerURL string,
+	oauthHelper fosite.OAuth2Provider,
+	storage Storage,
+	deviceCodeLifespan time.Duration,
+) http.Handler {
+	return httperr.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if r.Method != http.MethodPost {
+			return httperr.Newf(http.StatusMethodNotAllowed, "%s (try POST)", r.Method)
+		}
+		if err := r.ParseForm(); err != nil {
+			oauthHelper.WriteAccessError(w, nil, fosite.ErrInvalidRequest.WithHint("Unable to parse HTTP body."))
+			return nil
+		}
+
+		request, err := newDeviceAuthorizationRequest(r, storage)
+		if err != nil {
+			plog.Info("device authorization request error", oidc.FositeErrorForLog(err)...)
+			oauthHelper.WriteAccessError(w, nil, err)
+			return nil
+		}
+
+		deviceCode, err := generateDeviceCode()
+		if err != nil {
+			return httperr.Wrap(http.StatusInternalServerError, "error generating device code", err)
+		}
+		userCode, err := generateUserCode()
+		if err != nil {
+			return httperr.Wrap(http.StatusInternalServerError, "error generating user code", err)
+		}
+
+		err = storage.CreateDeviceCodeSession(r.Context(), &devicecode.Session{
+			Request:   request,
+			Signature: oidc.DeviceCodeSignature(deviceCode),
+			UserCode:  userCode,
+			Status:    devicecode.StatusPending,
+			ExpiresAt: request.GetRequestedAt().Add(deviceCodeLifespan),
+		})
+		if err != nil {
+			plog.Error("error saving device code session", err)
+			return httperr.Wrap(http.StatusInternalServerError, "error saving device code session", err)
+		}
+
+		verificationURI := issuerURL + oidc.DeviceVerificationEndpointPath
+		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Pragma", "no-cache")
+		if err := json.NewEncoder(w).Encode(&authorizationResponse{
+			DeviceCode:              deviceCode,
+			UserCode:                userCode,
+			VerificationURI:         verificationURI,
+			VerificationURIComplete: verificationURI + "?" + url.Values{"user_code": {userCode}}.Encode(),
+			ExpiresIn:               int64(deviceCodeLifespan.Seconds()),
+			Interval:                int64(oidc.DeviceCodePollInterval.Seconds()),
+		}); err != nil {
+			plog.Error("error writing device authorization response", err)
+		}
+		return nil
+	})
+}
+
+// newDeviceAuthorizationRequest validates the client and the requested scopes.
+func newDeviceAuthorizationRequest(r *http.Request, storage Storage) (*fosite.Request, error) {
+	clientID := r.PostForm.Get("client_id")
+	if clientID == "" {
+		return nil, fosite.ErrInvalidRequest.WithHint("Request parameter 'client_id' is missing.")
+	}
+	client, err := storage.GetClient(r.Context(), clientID)
+	if err != nil {
+		return nil, fosite.ErrInvalidClient.WithHint("The requested OAuth 2.0 Client does not exist.").WithWrap(err).WithDebug(err.Error())
+	}
+	if !client.GetGrantTypes().Has(oidc.DeviceCodeGrantType) {
+		return nil, fosite.ErrUnauthorizedClient.WithHintf("The OAuth 2.0 Client is not allowed to use authorization grant %q.", oidc.DeviceCodeGrantType)
+	}
+
+	scopes := fosite.RemoveEmpty(strings.Split(r.PostForm.Get("scope"), " "))
+	for _, scope := range scopes {
+		if !fosite.ExactScopeStrategy(client.GetScopes(), scope) {
+			return nil, fosite.ErrInvalidScope.WithHintf("The OAuth 2.0 Client is not allowed to request scope '%s'.", scope)
+		}
+	}
+
+	request := fosite.NewRequest()
+	request.Client = client
+	request.RequestedScope = scopes
+	request.Form = r.PostForm
+	request.Session = psession.NewPinnipedSession()
+	return request, nil
+}
+
+func generateDeviceCode() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// generateUserCode returns a random user code which is formatted like "BCDF-GHJK" to make it easier to type.
+func generateUserCode() (string, error) {
+	code := make([]byte, 0, userCodeLength)
+	for i := 0; i < userCodeLength; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeCharset))))
+		if err != nil {
+			return "", err
+		}
+		code = append(code, userCodeCharset[n.Int64()])
+	}
+	return formatUserCode(string(code)), nil
+}
+
+func formatUserCode(code string) string {
+	return fmt.Sprintf("%s-%s", code[:userCodeLength/2], code[userCodeLength/2:])
+}
+
+// normalizeUserCode allows the user to type the user code in lower case, and with or without the dash.
+// It returns false when the input cannot be a user code.
+func normalizeUserCode(input string) (string, bool) {
+	code := make([]byte, 0, userCodeLength)
+	for _, c := range strings.ToUpper(input) {
+		switch {
+		case strings.ContainsRune(userCodeCharset, c):
+			code = append(code, byte(c))
+		case c == '-' || c == ' ':
+			continue
+		default:
+			return "", false
+		}
+	}
+	if len(code) != userCodeLength {
+		return "", false
+	}
+	return formatUserCode(string(code)), true
+}
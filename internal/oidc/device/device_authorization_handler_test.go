@@ -0,0 +1,222 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package device
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"go.pinniped.dev/internal/fositestorage/devicecode"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/jwks"
+	"go.pinniped.dev/internal/psession"
+	"go.pinniped.dev/internal/testutil"
+	"go.pinniped.dev/internal/testutil/oidctestutil"
+)
+
+const (
+	downstreamIssuer = "https://my-downstream-issuer.com/path"
+	pinnipedCLI      = "pinniped-cli"
+)
+
+func TestAuthorizationHandler(t *testing.T) {
+	tests := []struct {
+		name            string
+		method          string
+		body            url.Values
+		wantStatus      int
+		wantContentType string
+		wantErrorType   string
+		wantScopes      []string
+		wantIDPName     string
+	}{
+		{
+			name:            "happy path",
+			method:          http.MethodPost,
+			body:            url.Values{"client_id": {pinnipedCLI}, "scope": {"openid offline_access"}, "pinniped_idp_name": {"my-oidc"}, "pinniped_idp_type": {"oidc"}},
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json",
+			wantScopes:      []string{"openid", "offline_access"},
+			wantIDPName:     "my-oidc",
+		},
+		{
+			name:            "happy path without scopes or upstream params",
+			method:          http.MethodPost,
+			body:            url.Values{"client_id": {pinnipedCLI}},
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json",
+		},
+		{
+			name:            "wrong method",
+			method:          http.MethodGet,
+			wantStatus:      http.StatusMethodNotAllowed,
+			wantContentType: "text/plain; charset=utf-8",
+		},
+		{
+			name:            "missing client_id",
+			method:          http.MethodPost,
+			body:            url.Values{"scope": {"openid"}},
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "application/json",
+			wantErrorType:   "invalid_request",
+		},
+		{
+			name:            "unknown client",
+			method:          http.MethodPost,
+			body:            url.Values{"client_id": {"some-other-client"}},
+			wantStatus:      http.StatusUnauthorized,
+			wantContentType: "application/json",
+			wantErrorType:   "invalid_client",
+		},
+		{
+			name:            "scope which is not allowed for the client",
+			method:          http.MethodPost,
+			body:            url.Values{"client_id": {pinnipedCLI}, "scope": {"openid some-other-scope"}},
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "application/json",
+			wantErrorType:   "invalid_scope",
+		},
+		{
+			name:            "happy path with an LDAP upstream, which uses the login page",
+			method:          http.MethodPost,
+			body:            url.Values{"client_id": {pinnipedCLI}, "scope": {"openid"}, "pinniped_idp_name": {"my-ldap"}, "pinniped_idp_type": {"ldap"}},
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json",
+			wantScopes:      []string{"openid"},
+			wantIDPName:     "my-ldap",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			storage := newTestStorage(t)
+			oauthHelper := oidc.FositeOauth2Helper(storage, downstreamIssuer, func() []byte { return []byte("some secret - must have at least 32 bytes") }, jwks.NewDynamicJWKSProvider(), oidc.DefaultOIDCTimeoutsConfiguration())
+			subject := NewAuthorizationHandler(downstreamIssuer, oauthHelper, storage, 10*time.Minute)
+
+			req := httptest.NewRequest(test.method, "/path/shouldn't/matter", strings.NewReader(test.body.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rsp := httptest.NewRecorder()
+			subject.ServeHTTP(rsp, req)
+			t.Logf("response body: %q", rsp.Body.String())
+
+			require.Equal(t, test.wantStatus, rsp.Code)
+			testutil.RequireEqualContentType(t, rsp.Header().Get("Content-Type"), test.wantContentType)
+			if test.wantStatus == http.StatusMethodNotAllowed {
+				return
+			}
+
+			var parsedResponseBody map[string]interface{}
+			require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &parsedResponseBody))
+			require.Equal(t, "no-store", rsp.Header().Get("Cache-Control"))
+
+			if test.wantErrorType != "" {
+				require.Equal(t, test.wantErrorType, parsedResponseBody["error"])
+				return
+			}
+
+			require.ElementsMatch(t,
+				[]string{"device_code", "user_code", "verification_uri", "verification_uri_complete", "expires_in", "interval"},
+				getMapKeys(parsedResponseBody))
+			userCode := parsedResponseBody["user_code"].(string)
+			require.Regexp(t, `^[BCDFGHJKLMNPQRSTVWXZ]{4}-[BCDFGHJKLMNPQRSTVWXZ]{4}$`, userCode)
+			require.Equal(t, downstreamIssuer+"/oauth2/device", parsedResponseBody["verification_uri"])
+			require.Equal(t, downstreamIssuer+"/oauth2/device?user_code="+userCode, parsedResponseBody["verification_uri_complete"])
+			require.Equal(t, float64(600), parsedResponseBody["expires_in"])
+			require.Equal(t, float64(5), parsedResponseBody["interval"])
+
+			session, _, err := storage.GetDeviceCodeSession(context.Background(), oidc.DeviceCodeSignature(parsedResponseBody["device_code"].(string)))
+			require.NoError(t, err)
+			require.Equal(t, devicecode.StatusPending, session.Status)
+			require.Equal(t, userCode, session.UserCode)
+			require.Equal(t, pinnipedCLI, session.Request.GetClient().GetID())
+			require.Equal(t, test.wantScopes, []string(session.Request.GetRequestedScopes()))
+			require.Empty(t, session.Request.GetGrantedScopes())
+			require.Equal(t, test.wantIDPName, session.Request.GetRequestForm().Get("pinniped_idp_name"))
+			testutil.RequireTimeInDelta(t, time.Now().Add(10*time.Minute), session.ExpiresAt, 5*time.Second)
+		})
+	}
+}
+
+func TestNormalizeUserCode(t *testing.T) {
+	tests := []struct {
+		input  string
+		want   string
+		wantOK bool
+	}{
+		{input: "BCDF-GHJK", want: "BCDF-GHJK", wantOK: true},
+		{input: "bcdfghjk", want: "BCDF-GHJK", wantOK: true},
+		{input: " bcdf ghjk ", want: "BCDF-GHJK", wantOK: true},
+		{input: "BCDF-GHJ", wantOK: false},
+		{input: "BCDF-GHJKL", wantOK: false},
+		{input: "ABCD-EFGH", wantOK: false},
+		{input: "", wantOK: false},
+	}
+	for _, test := range tests {
+		got, ok := normalizeUserCode(test.input)
+		require.Equal(t, test.wantOK, ok, "input %q", test.input)
+		require.Equal(t, test.want, got, "input %q", test.input)
+	}
+}
+
+func TestGenerateUserCode(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		userCode, err := generateUserCode()
+		require.NoError(t, err)
+		normalized, ok := normalizeUserCode(userCode)
+		require.True(t, ok)
+		require.Equal(t, userCode, normalized)
+	}
+}
+
+func newTestStorage(t *testing.T) *oidc.KubeStorage {
+	t.Helper()
+
+	secrets := fake.NewSimpleClientset().CoreV1().Secrets("some-namespace")
+	return oidc.NewKubeStorage(secrets, oidctestutil.NewClientManager(t, "some-namespace", nil, nil), oidc.DefaultOIDCTimeoutsConfiguration())
+}
+
+// createPendingSession simulates the device authorization endpoint having already run.
+func createPendingSession(t *testing.T, storage *oidc.KubeStorage, userCode string, expiresAt time.Time, form url.Values) *devicecode.Session {
+	t.Helper()
+
+	ctx := context.Background()
+	client, err := storage.GetClient(ctx, pinnipedCLI)
+	require.NoError(t, err)
+
+	request, err := newDeviceAuthorizationRequest(
+		&http.Request{PostForm: form},
+		storage,
+	)
+	require.NoError(t, err)
+	request.ID = "some-device-request-id"
+	request.Client = client
+	request.Session = psession.NewPinnipedSession()
+
+	session := &devicecode.Session{
+		Request:   request,
+		Signature: "some-device-code-signature",
+		UserCode:  userCode,
+		Status:    devicecode.StatusPending,
+		ExpiresAt: expiresAt,
+	}
+	require.NoError(t, storage.CreateDeviceCodeSession(ctx, session))
+	return session
+}
+
+func getMapKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,282 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package device
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ory/fosite"
+	"golang.org/x/oauth2"
+
+	supervisoroidc "go.pinniped.dev/generated/latest/apis/supervisor/oidc"
+	"go.pinniped.dev/internal/constable"
+	"go.pinniped.dev/internal/fositestorage/devicecode"
+	"go.pinniped.dev/internal/httputil/httperr"
+	"go.pinniped.dev/internal/httputil/securityheader"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/csrftoken"
+	"go.pinniped.dev/internal/oidc/device/devicehtml"
+	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/psession"
+	"go.pinniped.dev/pkg/oidcclient/nonce"
+	"go.pinniped.dev/pkg/oidcclient/pkce"
+	"go.pinniped.dev/pkg/oidcclient/state"
+)
+
+const (
+	invalidUserCodeMessage = "The code is invalid or expired. Please check the code shown on your device."
+
+	errInvalidUserCode = constable.Error("invalid user code")
+)
+
+// NewVerificationHandler returns an http.Handler for the device verification page, where the user enters the user
+// code which is shown by their device. After the user confirms the code, the browser is redirected to the
+// authorization endpoint to start a normal login with the upstream identity provider, on behalf of the client which
+// started the device code session. When the login succeeds, the callback endpoint approves the device code session
+// instead of returning an authcode, so the device can redeem its device code for tokens. Confirming the code gives
+// the browser a single-use device approval cookie, and only a login from that browser can approve the session, so
+// an authorization request which was crafted elsewhere cannot skip the confirmation.
+func NewVerificationHandler(issuerURL string, storage Storage, cookieEncoder oidc.Encoder) http.Handler {
+	handler := httperr.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		switch r.Method {
+		case http.MethodGet:
+			userCodeParam := r.URL.Query().Get("user_code")
+			if userCodeParam == "" {
+				return renderPage(w, http.StatusOK, &devicehtml.PageData{FormAction: issuerURL + oidc.DeviceVerificationEndpointPath})
+			}
+			session, _, err := findPendingSession(r.Context(), storage, userCodeParam)
+			if err != nil {
+				return renderInvalidUserCode(w, issuerURL, err)
+			}
+			return renderPage(w, http.StatusOK, &devicehtml.PageData{
+				FormAction: issuerURL + oidc.DeviceVerificationEndpointPath,
+				UserCode:   session.UserCode,
+			})
+
+		case http.MethodPost:
+			if !isSameOrigin(r, issuerURL) {
+				// Only the confirmation page may start the login, so other websites cannot submit the confirmation
+				// on behalf of the user.
+				return httperr.New(http.StatusForbidden, "cross-origin request not allowed")
+			}
+			if err := r.ParseForm(); err != nil {
+				return httperr.New(http.StatusBadRequest, "error parsing request params")
+			}
+			session, rv, err := findPendingSession(r.Context(), storage, r.PostForm.Get("user_code"))
+			if err != nil {
+				return renderInvalidUserCode(w, issuerURL, err)
+			}
+			if err := startApproval(r.Context(), w, storage, cookieEncoder, session, rv); err != nil {
+				return err
+			}
+			authorizeURL, err := authorizeURLForSession(issuerURL, session)
+			if err != nil {
+				return httperr.Wrap(http.StatusInternalServerError, "error generating authorize params", err)
+			}
+			http.Redirect(w, r, authorizeURL, http.StatusSeeOther)
+			return nil
+
+		default:
+			return httperr.Newf(http.StatusMethodNotAllowed, "%s (try GET or POST)", r.Method)
+		}
+	})
+	return securityheader.WrapWithCustomCSP(handler, devicehtml.ContentSecurityPolicy())
+}
+
+// ApproveSession is called by the callback endpoint when the user has logged in after starting the login on the
+// device verification page. It stores the user's downstream session in the device code session, so the device can
+// redeem its device code for tokens. The approval must come from the device approval cookie which the verification
+// page gave to the same browser for the same user code.
+func ApproveSession(
+	r *http.Request,
+	cookieDecoder oidc.Decoder,
+	storage devicecode.Storage,
+	userCode string,
+	authorizeRequester fosite.AuthorizeRequester,
+	downstreamSession *psession.PinnipedSession,
+) error {
+	approval, err := oidc.ReadDeviceApprovalCookie(r, cookieDecoder)
+	if err != nil {
+		return err
+	}
+	session, rv, err := findPendingSession(r.Context(), storage, userCode)
+	if err != nil {
+		return err
+	}
+	if session.ApprovalToken == "" ||
+		approval.UserCode != session.UserCode ||
+		subtle.ConstantTimeCompare([]byte(approval.Token), []byte(session.ApprovalToken)) != 1 {
+		return httperr.New(http.StatusForbidden, "device approval cookie does not match the device code session")
+	}
+	if session.Request.GetClient().GetID() != authorizeRequester.GetClient().GetID() {
+		return httperr.New(http.StatusBadRequest, "client of the device code session does not match the authorization request")
+	}
+
+	// Use the ID of the authorization request, like the authcode flow does, since the ID of the downstream session
+	// is also included as the sid claim of the ID tokens.
+	session.Request.SetID(authorizeRequester.GetID())
+	session.Request.SetSession(downstreamSession)
+	session.Request.SetRequestedScopes(authorizeRequester.GetRequestedScopes())
+	session.Request.GrantedScope = authorizeRequester.GetGrantedScopes()
+	session.Status = devicecode.StatusApproved
+	session.ApprovalToken = ""
+
+	if err := storage.UpdateDeviceCodeSession(r.Context(), session, rv); err != nil {
+		return httperr.Wrap(http.StatusInternalServerError, "error approving device code session", err)
+	}
+	return nil
+}
+
+// WriteLoggedInPage tells the user that they may return to their device, and removes the used device approval cookie.
+func WriteLoggedInPage(w http.ResponseWriter) error {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidc.DeviceApprovalCookieName,
+		Value:    "",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   true,
+		Path:     "/",
+	})
+	w.Header().Set("Content-Security-Policy", devicehtml.ContentSecurityPolicy())
+	return renderPage(w, http.StatusOK, &devicehtml.PageData{LoggedIn: true})
+}
+
+// findPendingSession returns a device code session which is waiting for the user to log in, and its resource version.
+func findPendingSession(ctx context.Context, storage devicecode.Storage, userCodeParam string) (*devicecode.Session, string, error) {
+	userCode, ok := normalizeUserCode(userCodeParam)
+	if !ok {
+		return nil, "", httperr.Wrap(http.StatusBadRequest, "invalid user code", errInvalidUserCode)
+	}
+	session, rv, err := storage.GetDeviceCodeSessionByUserCode(ctx, userCode)
+	if errors.Is(err, fosite.ErrNotFound) {
+		return nil, "", httperr.Wrap(http.StatusBadRequest, "user code not found", errInvalidUserCode)
+	}
+	if err != nil {
+		plog.Error("error reading device code session", err)
+		return nil, "", httperr.Wrap(http.StatusInternalServerError, "error reading device code session", err)
+	}
+	if session.Status != devicecode.StatusPending || time.Now().After(session.ExpiresAt) {
+		return nil, "", httperr.Wrap(http.StatusBadRequest, "user code has expired or was already used", errInvalidUserCode)
+	}
+	return session, rv, nil
+}
+
+// startApproval stores a new single-use approval token in the device code session, and gives the same token to the
+// browser in the device approval cookie. Confirming the user code again replaces the token of any earlier attempt.
+func startApproval(
+	ctx context.Context,
+	w http.ResponseWriter,
+	storage devicecode.Storage,
+	cookieEncoder oidc.Encoder,
+	session *devicecode.Session,
+	rv string,
+) error {
+	token, err := csrftoken.Generate()
+	if err != nil {
+		return httperr.Wrap(http.StatusInternalServerError, "error generating device approval token", err)
+	}
+	encodedApproval, err := cookieEncoder.Encode(oidc.DeviceApprovalCookieEncodingName,
+		&oidc.DeviceApproval{UserCode: session.UserCode, Token: string(token)})
+	if err != nil {
+		return httperr.Wrap(http.StatusInternalServerError, "error encoding device approval cookie", err)
+	}
+
+	session.ApprovalToken = string(token)
+	if err := storage.UpdateDeviceCodeSession(ctx, session, rv); err != nil {
+		return httperr.Wrap(http.StatusInternalServerError, "error updating device code session", err)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidc.DeviceApprovalCookieName,
+		Value:    encodedApproval,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   true,
+		Path:     "/",
+	})
+	return nil
+}
+
+// authorizeURLForSession returns the URL of an authorization request from the client of the device code session,
+// which is marked by the user code so the callback endpoint knows to approve the device code session.
+func authorizeURLForSession(issuerURL string, session *devicecode.Session) (string, error) {
+	client := session.Request.GetClient()
+	if len(client.GetRedirectURIs()) == 0 {
+		return "", errors.New("client has no redirect URIs")
+	}
+
+	// The device never redeems an authcode, but these are still required by the authorization endpoint.
+	stateParam, err := state.Generate()
+	if err != nil {
+		return "", err
+	}
+	nonceParam, err := nonce.Generate()
+	if err != nil {
+		return "", err
+	}
+	pkceCode, err := pkce.Generate()
+	if err != nil {
+		return "", err
+	}
+
+	authorizeOptions := []oauth2.AuthCodeOption{
+		nonceParam.Param(),
+		pkceCode.Challenge(),
+		pkceCode.Method(),
+		oauth2.SetAuthURLParam(oidc.DeviceUserCodeParamName, session.UserCode),
+	}
+	for _, param := range []string{supervisoroidc.AuthorizeUpstreamIDPNameParamName, supervisoroidc.AuthorizeUpstreamIDPTypeParamName} {
+		if value := session.Request.GetRequestForm().Get(param); value != "" {
+			authorizeOptions = append(authorizeOptions, oauth2.SetAuthURLParam(param, value))
+		}
+	}
+
+	oauth2Config := &oauth2.Config{
+		ClientID:    client.GetID(),
+		Endpoint:    oauth2.Endpoint{AuthURL: issuerURL + oidc.AuthorizationEndpointPath},
+		RedirectURL: client.GetRedirectURIs()[0],
+		Scopes:      session.Request.GetRequestedScopes(),
+	}
+	return oauth2Config.AuthCodeURL(stateParam.String(), authorizeOptions...), nil
+}
+
+func renderInvalidUserCode(w http.ResponseWriter, issuerURL string, err error) error {
+	if !errors.Is(err, errInvalidUserCode) {
+		return err
+	}
+	plog.Info("device verification error", "err", err.Error())
+	return renderPage(w, http.StatusBadRequest, &devicehtml.PageData{
+		FormAction:   issuerURL + oidc.DeviceVerificationEndpointPath,
+		ErrorMessage: invalidUserCodeMessage,
+	})
+}
+
+func renderPage(w http.ResponseWriter, status int, data *devicehtml.PageData) error {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := devicehtml.Template().Execute(w, data); err != nil {
+		plog.Error("error rendering device verification page", err)
+	}
+	return nil
+}
+
+// isSameOrigin checks the Origin header which browsers send with POST requests. Requests without one are rejected,
+// since they cannot be told apart from a form which was submitted by another website.
+func isSameOrigin(r *http.Request, issuerURL string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	issuer, err := url.Parse(issuerURL)
+	if err != nil {
+		return false
+	}
+	return origin == issuer.Scheme+"://"+issuer.Host
+}
@@ -0,0 +1,356 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package device
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/ory/fosite"
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/fositestorage/devicecode"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/testutil"
+)
+
+const happyUserCode = "BCDF-GHJK"
+
+func newTestCookieCodec() *securecookie.SecureCookie {
+	codec := securecookie.New([]byte("fake-cookie-hash-secret"), []byte("0123456789ABCDEF"))
+	codec.SetSerializer(securecookie.JSONEncoder{})
+	return codec
+}
+
+func TestVerificationHandler(t *testing.T) {
+	happyForm := url.Values{"client_id": {pinnipedCLI}, "scope": {"openid offline_access"}, "pinniped_idp_name": {"my-oidc"}, "pinniped_idp_type": {"oidc"}}
+
+	tests := []struct {
+		name             string
+		method           string
+		path             string
+		body             url.Values
+		origin           string
+		sessionExpiresIn time.Duration
+
+		wantStatus            int
+		wantBodyContains      string
+		wantBody              string
+		wantRedirectLocation  *url.URL
+		wantRedirectParams    url.Values
+		wantRedirectParamKeys []string
+		wantApprovalCookie    bool
+	}{
+		{
+			name:             "GET without a user code shows the form to enter a user code",
+			method:           http.MethodGet,
+			path:             "/oauth2/device",
+			wantStatus:       http.StatusOK,
+			wantBodyContains: `<form method="get" action="https://my-downstream-issuer.com/path/oauth2/device">`,
+		},
+		{
+			name:             "GET with a valid user code asks the user to confirm the user code",
+			method:           http.MethodGet,
+			path:             "/oauth2/device?user_code=bcdfghjk",
+			sessionExpiresIn: time.Minute,
+			wantStatus:       http.StatusOK,
+			wantBodyContains: `<input type="hidden" name="user_code" value="BCDF-GHJK">`,
+		},
+		{
+			name:             "GET with a user code which is not found",
+			method:           http.MethodGet,
+			path:             "/oauth2/device?user_code=ZZZZ-ZZZZ",
+			sessionExpiresIn: time.Minute,
+			wantStatus:       http.StatusBadRequest,
+			wantBodyContains: `<p class="error">The code is invalid or expired. Please check the code shown on your device.</p>`,
+		},
+		{
+			name:             "GET with a malformed user code",
+			method:           http.MethodGet,
+			path:             "/oauth2/device?user_code=not-a-code",
+			wantStatus:       http.StatusBadRequest,
+			wantBodyContains: `<p class="error">The code is invalid or expired. Please check the code shown on your device.</p>`,
+		},
+		{
+			name:             "GET with an expired user code",
+			method:           http.MethodGet,
+			path:             "/oauth2/device?user_code=BCDF-GHJK",
+			sessionExpiresIn: -time.Second,
+			wantStatus:       http.StatusBadRequest,
+			wantBodyContains: `<p class="error">The code is invalid or expired. Please check the code shown on your device.</p>`,
+		},
+		{
+			name:             "POST with a valid user code redirects to the authorization endpoint",
+			method:           http.MethodPost,
+			path:             "/oauth2/device",
+			body:             url.Values{"user_code": {happyUserCode}},
+			origin:           "https://my-downstream-issuer.com",
+			sessionExpiresIn: time.Minute,
+			wantStatus:       http.StatusSeeOther,
+			wantRedirectLocation: &url.URL{
+				Scheme: "https",
+				Host:   "my-downstream-issuer.com",
+				Path:   "/path/oauth2/authorize",
+			},
+			wantRedirectParams: url.Values{
+				"client_id":                 {pinnipedCLI},
+				"redirect_uri":              {"http://127.0.0.1/callback"},
+				"response_type":             {"code"},
+				"scope":                     {"openid offline_access"},
+				"code_challenge_method":     {"S256"},
+				"pinniped_idp_name":         {"my-oidc"},
+				"pinniped_idp_type":         {"oidc"},
+				"pinniped_device_user_code": {happyUserCode},
+			},
+			wantRedirectParamKeys: []string{"state", "nonce", "code_challenge"},
+			wantApprovalCookie:    true,
+		},
+		{
+			name:             "POST from another origin",
+			method:           http.MethodPost,
+			path:             "/oauth2/device",
+			body:             url.Values{"user_code": {happyUserCode}},
+			origin:           "https://evil.example.com",
+			sessionExpiresIn: time.Minute,
+			wantStatus:       http.StatusForbidden,
+			wantBody:         "Forbidden: cross-origin request not allowed\n",
+		},
+		{
+			name:             "POST without an Origin header",
+			method:           http.MethodPost,
+			path:             "/oauth2/device",
+			body:             url.Values{"user_code": {happyUserCode}},
+			sessionExpiresIn: time.Minute,
+			wantStatus:       http.StatusForbidden,
+			wantBody:         "Forbidden: cross-origin request not allowed\n",
+		},
+		{
+			name:             "POST with an expired user code",
+			method:           http.MethodPost,
+			path:             "/oauth2/device",
+			body:             url.Values{"user_code": {happyUserCode}},
+			origin:           "https://my-downstream-issuer.com",
+			sessionExpiresIn: -time.Second,
+			wantStatus:       http.StatusBadRequest,
+			wantBodyContains: `<p class="error">The code is invalid or expired. Please check the code shown on your device.</p>`,
+		},
+		{
+			name:       "wrong method",
+			method:     http.MethodPut,
+			path:       "/oauth2/device",
+			wantStatus: http.StatusMethodNotAllowed,
+			wantBody:   "Method Not Allowed: PUT (try GET or POST)\n",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			storage := newTestStorage(t)
+			if test.sessionExpiresIn != 0 {
+				createPendingSession(t, storage, happyUserCode, time.Now().Add(test.sessionExpiresIn), happyForm)
+			}
+			cookieCodec := newTestCookieCodec()
+			subject := NewVerificationHandler(downstreamIssuer, storage, cookieCodec)
+
+			req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if test.origin != "" {
+				req.Header.Set("Origin", test.origin)
+			}
+			rsp := httptest.NewRecorder()
+			subject.ServeHTTP(rsp, req)
+			t.Logf("response body: %q", rsp.Body.String())
+
+			testutil.RequireSecurityHeaders(t, rsp)
+			require.Equal(t, test.wantStatus, rsp.Code)
+
+			if test.wantBody != "" {
+				require.Equal(t, test.wantBody, rsp.Body.String())
+			}
+			if test.wantBodyContains != "" {
+				testutil.RequireEqualContentType(t, rsp.Header().Get("Content-Type"), "text/html; charset=utf-8")
+				require.Contains(t, rsp.Body.String(), test.wantBodyContains)
+			}
+			if test.wantRedirectLocation != nil {
+				location, err := url.Parse(rsp.Header().Get("Location"))
+				require.NoError(t, err)
+				params := location.Query()
+				location.RawQuery = ""
+				require.Equal(t, test.wantRedirectLocation, location)
+				for _, key := range test.wantRedirectParamKeys {
+					require.NotEmpty(t, params.Get(key), "param %q", key)
+					params.Del(key)
+				}
+				require.Equal(t, test.wantRedirectParams, params)
+			}
+
+			cookies := rsp.Result().Cookies() //nolint:bodyclose // the recorder has no body to close
+			if !test.wantApprovalCookie {
+				require.Empty(t, cookies)
+				return
+			}
+			require.Len(t, cookies, 1)
+			require.Equal(t, "__Host-pinniped-device-approval", cookies[0].Name)
+			require.True(t, cookies[0].Secure)
+			require.True(t, cookies[0].HttpOnly)
+			require.Equal(t, http.SameSiteLaxMode, cookies[0].SameSite)
+			require.Equal(t, "/", cookies[0].Path)
+			var approval oidc.DeviceApproval
+			require.NoError(t, cookieCodec.Decode("device-approval", cookies[0].Value, &approval))
+			require.Equal(t, happyUserCode, approval.UserCode)
+			session, _, err := storage.GetDeviceCodeSession(context.Background(), "some-device-code-signature")
+			require.NoError(t, err)
+			require.NotEmpty(t, approval.Token)
+			require.Equal(t, session.ApprovalToken, approval.Token)
+		})
+	}
+}
+
+func TestApproveSession(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name             string
+		userCode         string
+		clientID         string
+		sessionExpiresIn time.Duration
+		cookie           func(t *testing.T, codec *securecookie.SecureCookie, approvalCookie *http.Cookie) *http.Cookie
+		wantErr          string
+	}{
+		{
+			name:             "happy path",
+			userCode:         happyUserCode,
+			clientID:         pinnipedCLI,
+			sessionExpiresIn: time.Minute,
+		},
+		{
+			name:             "user code not found",
+			userCode:         "ZZZZ-ZZZZ",
+			clientID:         pinnipedCLI,
+			sessionExpiresIn: time.Minute,
+			wantErr:          "user code not found: invalid user code",
+		},
+		{
+			name:             "expired session",
+			userCode:         happyUserCode,
+			clientID:         pinnipedCLI,
+			sessionExpiresIn: -time.Second,
+			wantErr:          "user code has expired or was already used: invalid user code",
+		},
+		{
+			name:             "wrong client",
+			userCode:         happyUserCode,
+			clientID:         "some-other-client",
+			sessionExpiresIn: time.Minute,
+			wantErr:          "client of the device code session does not match the authorization request",
+		},
+		{
+			name:             "missing device approval cookie, e.g. when the authorize request was crafted by someone else",
+			userCode:         happyUserCode,
+			clientID:         pinnipedCLI,
+			sessionExpiresIn: time.Minute,
+			cookie: func(t *testing.T, _ *securecookie.SecureCookie, _ *http.Cookie) *http.Cookie {
+				return nil
+			},
+			wantErr: "device approval cookie is missing: http: named cookie not present",
+		},
+		{
+			name:             "device approval cookie which was not encoded by the Supervisor",
+			userCode:         happyUserCode,
+			clientID:         pinnipedCLI,
+			sessionExpiresIn: time.Minute,
+			cookie: func(t *testing.T, _ *securecookie.SecureCookie, approvalCookie *http.Cookie) *http.Cookie {
+				return &http.Cookie{Name: approvalCookie.Name, Value: "not-encoded-by-pinniped"}
+			},
+			wantErr: "error reading device approval cookie: securecookie: base64 decode failed - caused by: illegal base64 data at input byte 20",
+		},
+		{
+			name:             "device approval cookie with the wrong token",
+			userCode:         happyUserCode,
+			clientID:         pinnipedCLI,
+			sessionExpiresIn: time.Minute,
+			cookie: func(t *testing.T, codec *securecookie.SecureCookie, approvalCookie *http.Cookie) *http.Cookie {
+				encoded, err := codec.Encode("device-approval", &oidc.DeviceApproval{UserCode: happyUserCode, Token: "some-other-token"})
+				require.NoError(t, err)
+				return &http.Cookie{Name: approvalCookie.Name, Value: encoded}
+			},
+			wantErr: "device approval cookie does not match the device code session",
+		},
+		{
+			name:             "device approval cookie for another user code",
+			userCode:         happyUserCode,
+			clientID:         pinnipedCLI,
+			sessionExpiresIn: time.Minute,
+			cookie: func(t *testing.T, codec *securecookie.SecureCookie, approvalCookie *http.Cookie) *http.Cookie {
+				var approval oidc.DeviceApproval
+				require.NoError(t, codec.Decode("device-approval", approvalCookie.Value, &approval))
+				approval.UserCode = "ZZZZ-ZZZZ"
+				encoded, err := codec.Encode("device-approval", &approval)
+				require.NoError(t, err)
+				return &http.Cookie{Name: approvalCookie.Name, Value: encoded}
+			},
+			wantErr: "device approval cookie does not match the device code session",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			storage := newTestStorage(t)
+			cookieCodec := newTestCookieCodec()
+			createPendingSession(t, storage, happyUserCode, time.Now().Add(time.Minute), url.Values{"client_id": {pinnipedCLI}})
+
+			// Simulate the user confirming the user code on the verification page.
+			pendingSession, rv, err := storage.GetDeviceCodeSession(ctx, "some-device-code-signature")
+			require.NoError(t, err)
+			pendingSession.ExpiresAt = time.Now().Add(test.sessionExpiresIn)
+			verificationRsp := httptest.NewRecorder()
+			require.NoError(t, startApproval(ctx, verificationRsp, storage, cookieCodec, pendingSession, rv))
+			cookies := verificationRsp.Result().Cookies() //nolint:bodyclose // the recorder has no body to close
+			require.Len(t, cookies, 1)
+			approvalCookie := cookies[0]
+			if test.cookie != nil {
+				approvalCookie = test.cookie(t, cookieCodec, approvalCookie)
+			}
+
+			authorizeRequester := fosite.NewAuthorizeRequest()
+			authorizeRequester.ID = "some-authorize-request-id"
+			authorizeRequester.Client = &fosite.DefaultClient{ID: test.clientID}
+			authorizeRequester.RequestedScope = fosite.Arguments{"openid", "offline_access"}
+			authorizeRequester.GrantedScope = fosite.Arguments{"openid", "offline_access"}
+			downstreamSession := testutil.NewFakePinnipedSession()
+
+			callbackReq := httptest.NewRequest(http.MethodGet, "/callback", nil)
+			if approvalCookie != nil {
+				callbackReq.AddCookie(approvalCookie)
+			}
+
+			err = ApproveSession(callbackReq, cookieCodec, storage, test.userCode, authorizeRequester, downstreamSession)
+			session, _, getErr := storage.GetDeviceCodeSession(ctx, "some-device-code-signature")
+			require.NoError(t, getErr)
+
+			if test.wantErr != "" {
+				require.EqualError(t, err, test.wantErr)
+				require.Equal(t, devicecode.StatusPending, session.Status)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, devicecode.StatusApproved, session.Status)
+			require.Empty(t, session.ApprovalToken)
+			require.Equal(t, "some-authorize-request-id", session.Request.GetID())
+			require.Equal(t, fosite.Arguments{"openid", "offline_access"}, session.Request.GetGrantedScopes())
+			require.Equal(t, downstreamSession, session.Request.GetSession())
+
+			// The user code cannot be used again.
+			require.EqualError(t, ApproveSession(callbackReq, cookieCodec, storage, test.userCode, authorizeRequester, downstreamSession),
+				"user code has expired or was already used: invalid user code")
+		})
+	}
+}
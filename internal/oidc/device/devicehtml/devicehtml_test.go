@@ -0,0 +1,136 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicehtml
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/here"
+)
+
+var (
+	testExpectedCSS = `body{font-family:metropolis-light,Helvetica,sans-serif}h1{font-size:20px}.box{position:absolute;top:100px;left:50%;width:400px;margin-left:-200px;font-size:14px;line-height:24px}.code{font-family:monospace;font-size:24px;letter-spacing:2px}.error{color:#c21d00}input[type=text]{display:block;width:100%;box-sizing:border-box;margin:10px 0;padding:10px;font-family:monospace;font-size:18px;text-transform:uppercase}button{padding:10px 20px;border:1px solid #ddd;background-color:#fff;color:#1b3951;font-size:14px;cursor:pointer}button:hover{background-color:#eee}`
+
+	testExpectedEnterCodeOutput = here.Doc(`
+        <!DOCTYPE html>
+        <html lang="en">
+        <head>
+            <meta charset="UTF-8">
+            <title>Device Login</title>
+            <style>` + testExpectedCSS + `</style>
+            <link id="favicon" rel="icon" href="data:image/svg+xml,<svg xmlns=%22http://www.w3.org/2000/svg%22 viewBox=%220 0 100 100%22><text y=%22.9em%22 font-size=%2290%22>🔑</text></svg>"/>
+        </head>
+        <body>
+        <div class="box">
+            <h1>Log in to your device</h1>
+            <p class="error">The code is invalid.</p>
+            <form method="get" action="https://example.com/issuer/oauth2/device">
+                <label for="user_code">Enter the code shown on your device:</label>
+                <input type="text" id="user_code" name="user_code" autocomplete="off" autofocus required>
+                <button type="submit">Next</button>
+            </form>
+        </div>
+        </body>
+        </html>
+		`)
+
+	testExpectedConfirmCodeOutput = here.Doc(`
+        <!DOCTYPE html>
+        <html lang="en">
+        <head>
+            <meta charset="UTF-8">
+            <title>Device Login</title>
+            <style>` + testExpectedCSS + `</style>
+            <link id="favicon" rel="icon" href="data:image/svg+xml,<svg xmlns=%22http://www.w3.org/2000/svg%22 viewBox=%220 0 100 100%22><text y=%22.9em%22 font-size=%2290%22>🔑</text></svg>"/>
+        </head>
+        <body>
+        <div class="box">
+            <h1>Log in to your device</h1>
+            <p>Only continue if this code is shown on your own device:</p>
+            <p class="code">BCDF-GHJK</p>
+            <form method="post" action="https://example.com/issuer/oauth2/device">
+                <input type="hidden" name="user_code" value="BCDF-GHJK">
+                <button type="submit">Continue</button>
+            </form>
+        </div>
+        </body>
+        </html>
+		`)
+
+	testExpectedLoggedInOutput = here.Doc(`
+        <!DOCTYPE html>
+        <html lang="en">
+        <head>
+            <meta charset="UTF-8">
+            <title>Device Login</title>
+            <style>` + testExpectedCSS + `</style>
+            <link id="favicon" rel="icon" href="data:image/svg+xml,<svg xmlns=%22http://www.w3.org/2000/svg%22 viewBox=%220 0 100 100%22><text y=%22.9em%22 font-size=%2290%22>🔑</text></svg>"/>
+        </head>
+        <body>
+        <div class="box">
+            <h1>Login succeeded</h1>
+            <p>You have been logged in. You may now close this tab and return to your device.</p>
+        </div>
+        </body>
+        </html>
+		`)
+
+	// It's okay if this changes in the future, but this gives us a chance to eyeball the formatting.
+	// Our browser-based integration tests should find any incompatibilities.
+	testExpectedCSP = `default-src 'none'; ` +
+		`style-src 'sha256-Q8AeywgS9D5Cnip/hJZJ+5EjWzdbJ2CtxH1KhnO0Tkk='; ` +
+		`img-src data:; ` +
+		`frame-ancestors 'none'`
+)
+
+func TestTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		pageData *PageData
+		want     string
+	}{
+		{
+			name:     "enter code with error message",
+			pageData: &PageData{FormAction: "https://example.com/issuer/oauth2/device", ErrorMessage: "The code is invalid."},
+			want:     testExpectedEnterCodeOutput,
+		},
+		{
+			name:     "confirm code",
+			pageData: &PageData{FormAction: "https://example.com/issuer/oauth2/device", UserCode: "BCDF-GHJK"},
+			want:     testExpectedConfirmCodeOutput,
+		},
+		{
+			name:     "logged in",
+			pageData: &PageData{LoggedIn: true},
+			want:     testExpectedLoggedInOutput,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, Template().Execute(&buf, tt.pageData))
+
+			// t.Logf("actual value:\n%s", buf.String()) // useful when updating minify library causes new output
+			require.Equal(t, tt.want, buf.String())
+		})
+	}
+}
+
+func TestContentSecurityPolicyHashes(t *testing.T) {
+	require.Equal(t, testExpectedCSP, ContentSecurityPolicy())
+}
+
+func TestHelpers(t *testing.T) {
+	// These are silly tests but it's easy to we might as well have them.
+	require.Equal(t, "test", mustMinify("test", nil))
+	require.PanicsWithError(t, "some error", func() { mustMinify("", fmt.Errorf("some error")) })
+
+	// Example test vector from https://content-security-policy.com/hash/.
+	require.Equal(t, "sha256-RFWPLDbv2BY+rCkDzsE+0fr8ylGr2R2faWMhq4lfEQc=", cspHash("doSomething();"))
+}
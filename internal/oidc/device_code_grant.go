@@ -0,0 +1,226 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+
+	coreosoidc "github.com/coreos/go-oidc/v3/oidc"
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/compose"
+	"github.com/ory/fosite/handler/oauth2"
+	"github.com/ory/fosite/handler/openid"
+	"github.com/ory/x/errorsx"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"go.pinniped.dev/internal/fositestorage/devicecode"
+)
+
+// DeviceCodeGrantType is the grant type of the device authorization grant (RFC 8628).
+const DeviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// These are the errors from https://datatracker.ietf.org/doc/html/rfc8628#section-3.5, which fosite does not define.
+var (
+	ErrAuthorizationPending = &fosite.RFC6749Error{
+		ErrorField:       "authorization_pending",
+		DescriptionField: "The authorization request is still pending because the user has not yet finished logging in.",
+		CodeField:        http.StatusBadRequest,
+	}
+
+	ErrSlowDown = &fosite.RFC6749Error{
+		ErrorField:       "slow_down",
+		DescriptionField: "The authorization request is still pending and the client must increase its polling interval by 5 seconds.",
+		CodeField:        http.StatusBadRequest,
+	}
+
+	ErrExpiredToken = &fosite.RFC6749Error{
+		ErrorField:       "expired_token",
+		DescriptionField: "The device code has expired. The client must start a new device authorization request.",
+		CodeField:        http.StatusBadRequest,
+	}
+)
+
+// deviceCodeGrantStorage is the storage needed by the DeviceCodeGrantHandler.
+type deviceCodeGrantStorage interface {
+	devicecode.Storage
+	oauth2.AccessTokenStorage
+	oauth2.RefreshTokenStorage
+}
+
+// DeviceCodeSignature returns the signature of a device code, which is the key of its device code session in storage.
+func DeviceCodeSignature(deviceCode string) string {
+	hash := sha256.Sum256([]byte(deviceCode))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+func DeviceCodeGrantFactory(config *compose.Config, storage interface{}, strategy interface{}) interface{} {
+	return &DeviceCodeGrantHandler{
+		accessTokenStrategy:  strategy.(oauth2.AccessTokenStrategy),
+		refreshTokenStrategy: strategy.(oauth2.RefreshTokenStrategy),
+		idTokenStrategy:      strategy.(openid.OpenIDConnectTokenStrategy),
+		storage:              storage.(deviceCodeGrantStorage),
+		accessTokenLifespan:  config.GetAccessTokenLifespan(),
+		refreshTokenLifespan: config.GetRefreshTokenLifespan(),
+		refreshTokenScopes:   config.GetRefreshTokenScopes(),
+		pollInterval:         DeviceCodePollInterval,
+	}
+}
+
+// DeviceCodeGrantHandler allows a device to redeem its device code for tokens after the user has logged in
+// using the device verification page, as described in https://datatracker.ietf.org/doc/html/rfc8628#section-3.4.
+type DeviceCodeGrantHandler struct {
+	accessTokenStrategy  oauth2.AccessTokenStrategy
+	refreshTokenStrategy oauth2.RefreshTokenStrategy
+	idTokenStrategy      openid.OpenIDConnectTokenStrategy
+	storage              deviceCodeGrantStorage
+	accessTokenLifespan  time.Duration
+	refreshTokenLifespan time.Duration
+	refreshTokenScopes   []string
+	pollInterval         time.Duration
+}
+
+var _ fosite.TokenEndpointHandler = (*DeviceCodeGrantHandler)(nil)
+
+func (d *DeviceCodeGrantHandler) HandleTokenEndpointRequest(ctx context.Context, requester fosite.AccessRequester) error {
+	if !d.CanHandleTokenEndpointRequest(requester) {
+		return errorsx.WithStack(fosite.ErrUnknownRequest)
+	}
+
+	if !requester.GetClient().GetGrantTypes().Has(DeviceCodeGrantType) {
+		return errorsx.WithStack(fosite.ErrUnauthorizedClient.WithHintf("The OAuth 2.0 Client is not allowed to use authorization grant %q.", DeviceCodeGrantType))
+	}
+
+	deviceCode := requester.GetRequestForm().Get("device_code")
+	if deviceCode == "" {
+		return errorsx.WithStack(fosite.ErrInvalidRequest.WithHint("missing device_code parameter"))
+	}
+
+	session, rv, err := d.storage.GetDeviceCodeSession(ctx, DeviceCodeSignature(deviceCode))
+	if errors.Is(err, fosite.ErrNotFound) {
+		return errorsx.WithStack(fosite.ErrInvalidGrant.WithWrap(err).WithDebug(err.Error()))
+	}
+	if err != nil {
+		return errorsx.WithStack(fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+	}
+
+	if session.Request.GetClient().GetID() != requester.GetClient().GetID() {
+		return errorsx.WithStack(fosite.ErrInvalidGrant.WithHint("The OAuth 2.0 Client ID from this request does not match the one from the device authorization request."))
+	}
+
+	now := time.Now().UTC()
+	if now.After(session.ExpiresAt) {
+		return errorsx.WithStack(ErrExpiredToken)
+	}
+
+	if session.Status != devicecode.StatusApproved {
+		pollingTooFast := !session.LastPolledAt.IsZero() && now.Sub(session.LastPolledAt) < d.pollInterval
+		session.LastPolledAt = now
+		if err := d.storage.UpdateDeviceCodeSession(ctx, session, rv); err != nil {
+			if apierrors.IsConflict(err) {
+				// Another request for the same device code was handled at the same time.
+				return errorsx.WithStack(ErrSlowDown)
+			}
+			return errorsx.WithStack(fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+		}
+		if pollingTooFast {
+			return errorsx.WithStack(ErrSlowDown)
+		}
+		return errorsx.WithStack(ErrAuthorizationPending)
+	}
+
+	// The session was approved by the callback endpoint, so it holds the user's downstream session.
+	requester.SetRequestedScopes(session.Request.GetRequestedScopes())
+	requester.SetRequestedAudience(session.Request.GetRequestedAudience())
+	for _, scope := range session.Request.GetGrantedScopes() {
+		requester.GrantScope(scope)
+	}
+	for _, audience := range session.Request.GetGrantedAudience() {
+		requester.GrantAudience(audience)
+	}
+	requester.SetSession(session.Request.GetSession())
+	requester.SetID(session.Request.GetID())
+
+	requester.GetSession().SetExpiresAt(fosite.AccessToken, now.Add(d.accessTokenLifespan).Round(time.Second))
+	if d.refreshTokenLifespan > -1 {
+		requester.GetSession().SetExpiresAt(fosite.RefreshToken, now.Add(d.refreshTokenLifespan).Round(time.Second))
+	}
+
+	return nil
+}
+
+func (d *DeviceCodeGrantHandler) PopulateTokenEndpointResponse(ctx context.Context, requester fosite.AccessRequester, responder fosite.AccessResponder) error {
+	if !d.CanHandleTokenEndpointRequest(requester) {
+		return errorsx.WithStack(fosite.ErrUnknownRequest)
+	}
+
+	access, accessSignature, err := d.accessTokenStrategy.GenerateAccessToken(ctx, requester)
+	if err != nil {
+		return errorsx.WithStack(fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+	}
+
+	var refresh, refreshSignature string
+	if d.canIssueRefreshToken(requester) {
+		refresh, refreshSignature, err = d.refreshTokenStrategy.GenerateRefreshToken(ctx, requester)
+		if err != nil {
+			return errorsx.WithStack(fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+		}
+	}
+
+	// Delete the device code session first, so the device code can only be redeemed once.
+	deviceCodeSignature := DeviceCodeSignature(requester.GetRequestForm().Get("device_code"))
+	if err := d.storage.DeleteDeviceCodeSession(ctx, deviceCodeSignature); err != nil {
+		if apierrors.IsNotFound(err) {
+			return errorsx.WithStack(fosite.ErrInvalidGrant.WithHint("The device code has already been used.").WithWrap(err).WithDebug(err.Error()))
+		}
+		return errorsx.WithStack(fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+	}
+
+	if err := d.storage.CreateAccessTokenSession(ctx, accessSignature, requester.Sanitize([]string{})); err != nil {
+		return errorsx.WithStack(fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+	}
+	if refreshSignature != "" {
+		if err := d.storage.CreateRefreshTokenSession(ctx, refreshSignature, requester.Sanitize([]string{})); err != nil {
+			return errorsx.WithStack(fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+		}
+	}
+
+	responder.SetAccessToken(access)
+	responder.SetTokenType("bearer")
+	responder.SetExpiresIn(time.Until(requester.GetSession().GetExpiresAt(fosite.AccessToken)).Round(time.Second))
+	responder.SetScopes(requester.GetGrantedScopes())
+	if refresh != "" {
+		responder.SetExtra("refresh_token", refresh)
+	}
+
+	// Generating the ID token updates the claims of the session, so this must happen after the session was stored.
+	if requester.GetGrantedScopes().Has(coreosoidc.ScopeOpenID) {
+		idToken, err := d.idTokenStrategy.GenerateIDToken(ctx, requester)
+		if err != nil {
+			return errorsx.WithStack(err)
+		}
+		responder.SetExtra("id_token", idToken)
+	}
+
+	return nil
+}
+
+func (d *DeviceCodeGrantHandler) canIssueRefreshToken(requester fosite.Requester) bool {
+	if len(d.refreshTokenScopes) > 0 && !requester.GetGrantedScopes().HasOneOf(d.refreshTokenScopes...) {
+		return false
+	}
+	return requester.GetClient().GetGrantTypes().Has("refresh_token")
+}
+
+func (d *DeviceCodeGrantHandler) CanSkipClientAuth(_ fosite.AccessRequester) bool {
+	return false
+}
+
+func (d *DeviceCodeGrantHandler) CanHandleTokenEndpointRequest(requester fosite.AccessRequester) bool {
+	return requester.GetGrantTypes().ExactOne(DeviceCodeGrantType)
+}
@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 // Package discovery provides a handler for the OIDC discovery endpoint.
@@ -11,8 +11,12 @@ import (
 
 	"go.pinniped.dev/generated/latest/apis/supervisor/idpdiscovery/v1alpha1"
 	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/jwks"
 )
 
+// defaultIDTokenSigningAlg is advertised when the FederationDomain does not have any signing keys yet.
+const defaultIDTokenSigningAlg = "ES256"
+
 // Metadata holds all fields (that we care about) from the OpenID Provider Metadata section in the
 // OpenID Connect Discovery specification:
 // https://openid.net/specs/openid-connect-discovery-1_0.html#rfc.section.3.
@@ -38,6 +42,21 @@ type Metadata struct {
 	ScopesSupported                   []string `json:"scopes_supported"`
 	ClaimsSupported                   []string `json:"claims_supported"`
 
+	// RevocationEndpoint is defined by the OAuth 2.0 Authorization Server Metadata specification (RFC 8414).
+	RevocationEndpoint string `json:"revocation_endpoint"`
+
+	// EndSessionEndpoint is defined by the OpenID Connect RP-Initiated Logout specification.
+	EndSessionEndpoint string `json:"end_session_endpoint"`
+
+	// UserInfoEndpoint is defined by the OpenID Connect Discovery specification.
+	UserInfoEndpoint string `json:"userinfo_endpoint"`
+
+	// IntrospectionEndpoint is defined by the OAuth 2.0 Authorization Server Metadata specification (RFC 8414).
+	IntrospectionEndpoint string `json:"introspection_endpoint"`
+
+	// DeviceAuthorizationEndpoint is defined by the OAuth 2.0 Device Authorization Grant specification (RFC 8628).
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+
 	// ^^^ Optional ^^^
 
 	// vvv Custom vvv
@@ -47,13 +66,20 @@ type Metadata struct {
 	// ^^^ Custom ^^^
 }
 
-// NewHandler returns an http.Handler that serves an OIDC discovery endpoint.
-func NewHandler(issuerURL string) http.Handler {
+// NewHandler returns an http.Handler that serves an OIDC discovery endpoint. The advertised ID token signing
+// algorithms are those of the keys which are currently published in the issuer's JWKS, so they follow changes
+// to the FederationDomain's signing algorithm.
+func NewHandler(issuerURL string, jwksProvider jwks.DynamicJWKSProvider) http.Handler {
 	oidcConfig := Metadata{
-		Issuer:                issuerURL,
-		AuthorizationEndpoint: issuerURL + oidc.AuthorizationEndpointPath,
-		TokenEndpoint:         issuerURL + oidc.TokenEndpointPath,
-		JWKSURI:               issuerURL + oidc.JWKSEndpointPath,
+		Issuer:                      issuerURL,
+		AuthorizationEndpoint:       issuerURL + oidc.AuthorizationEndpointPath,
+		TokenEndpoint:               issuerURL + oidc.TokenEndpointPath,
+		JWKSURI:                     issuerURL + oidc.JWKSEndpointPath,
+		RevocationEndpoint:          issuerURL + oidc.RevocationEndpointPath,
+		EndSessionEndpoint:          issuerURL + oidc.EndSessionEndpointPath,
+		UserInfoEndpoint:            issuerURL + oidc.UserInfoEndpointPath,
+		IntrospectionEndpoint:       issuerURL + oidc.IntrospectionEndpointPath,
+		DeviceAuthorizationEndpoint: issuerURL + oidc.DeviceAuthorizationEndpointPath,
 		OIDCDiscoveryResponse: v1alpha1.OIDCDiscoveryResponse{
 			SupervisorDiscovery: v1alpha1.OIDCDiscoveryResponseIDPEndpoint{
 				PinnipedIDPsEndpoint: issuerURL + oidc.PinnipedIDPsPathV1Alpha1,
@@ -62,31 +88,62 @@ func NewHandler(issuerURL string) http.Handler {
 		ResponseTypesSupported:            []string{"code"},
 		ResponseModesSupported:            []string{"query", "form_post"},
 		SubjectTypesSupported:             []string{"public"},
-		IDTokenSigningAlgValuesSupported:  []string{"ES256"},
-		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
 		ScopesSupported:                   []string{"openid", "offline"},
 		ClaimsSupported:                   []string{"groups"},
 	}
 
-	var b bytes.Buffer
-	encodeErr := json.NewEncoder(&b).Encode(&oidcConfig)
-	encodedMetadata := b.Bytes()
-
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, `Method not allowed (try GET)`, http.StatusMethodNotAllowed)
 			return
 		}
 
-		if encodeErr != nil {
-			http.Error(w, encodeErr.Error(), http.StatusInternalServerError)
+		metadata := oidcConfig
+		metadata.IDTokenSigningAlgValuesSupported = idTokenSigningAlgs(jwksProvider, issuerURL)
+
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(&metadata); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		if _, err := w.Write(encodedMetadata); err != nil {
+		if _, err := w.Write(b.Bytes()); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 	})
 }
+
+// idTokenSigningAlgs returns the algorithms of the keys in the issuer's JWKS, starting with the algorithm of the
+// active key. During a change of the signing algorithm, the JWKS contains keys for both the old and the new algorithm.
+func idTokenSigningAlgs(jwksProvider jwks.DynamicJWKSProvider, issuerURL string) []string {
+	keySet, activeSigner := jwksProvider.GetJWKS(issuerURL)
+
+	var algs []string
+	add := func(alg string) {
+		if alg == "" {
+			return
+		}
+		for _, existing := range algs {
+			if existing == alg {
+				return
+			}
+		}
+		algs = append(algs, alg)
+	}
+	if activeSigner != nil {
+		add(activeSigner.Public().Algorithm)
+	}
+	if keySet != nil {
+		for _, key := range keySet.Keys {
+			add(key.Algorithm)
+		}
+	}
+
+	if len(algs) == 0 {
+		return []string{defaultIDTokenSigningAlg}
+	}
+	return algs
+}
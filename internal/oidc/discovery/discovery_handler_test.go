@@ -1,57 +1,118 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package discovery
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
 
 	"go.pinniped.dev/internal/here"
 	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/jwks"
+	"go.pinniped.dev/internal/oidc/signer"
 )
 
 func TestDiscovery(t *testing.T) {
-	tests := []struct {
-		name string
+	const issuer = "https://some-issuer.com/some/path"
 
-		issuer string
-		method string
-		path   string
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ecJWK := &jose.JSONWebKey{Key: ecKey, KeyID: "ec-key", Algorithm: "ES256", Use: "sig"}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rsaJWK := &jose.JSONWebKey{Key: rsaKey, KeyID: "rsa-key", Algorithm: "RS256", Use: "sig"}
+	rsaSigner, err := signer.NewJWKSigner(rsaJWK)
+	require.NoError(t, err)
+	ecSigner, err := signer.NewJWKSigner(ecJWK)
+	require.NoError(t, err)
 
-		wantStatus      int
-		wantContentType string
-		wantBodyJSON    string
-		wantBodyString  string
-	}{
-		{
-			name:            "happy path",
-			issuer:          "https://some-issuer.com/some/path",
-			method:          http.MethodGet,
-			path:            "/some/path" + oidc.WellKnownEndpointPath,
-			wantStatus:      http.StatusOK,
-			wantContentType: "application/json",
-			wantBodyJSON: here.Doc(`
+	wantBodyJSON := func(algs string) string {
+		return strings.ReplaceAll(here.Doc(`
 			{
 				"issuer": "https://some-issuer.com/some/path",
 				"authorization_endpoint": "https://some-issuer.com/some/path/oauth2/authorize",
 				"token_endpoint": "https://some-issuer.com/some/path/oauth2/token",
+				"revocation_endpoint": "https://some-issuer.com/some/path/oauth2/revoke",
+				"end_session_endpoint": "https://some-issuer.com/some/path/oauth2/logout",
+				"userinfo_endpoint": "https://some-issuer.com/some/path/oauth2/userinfo",
+				"introspection_endpoint": "https://some-issuer.com/some/path/oauth2/introspect",
+				"device_authorization_endpoint": "https://some-issuer.com/some/path/oauth2/device_authorization",
 				"jwks_uri": "https://some-issuer.com/some/path/jwks.json",
 				"response_types_supported": ["code"],
 				"response_modes_supported": ["query", "form_post"],
 				"subject_types_supported": ["public"],
-				"id_token_signing_alg_values_supported": ["ES256"],
-				"token_endpoint_auth_methods_supported": ["client_secret_basic"],
+				"id_token_signing_alg_values_supported": ALGS,
+				"token_endpoint_auth_methods_supported": ["client_secret_basic", "client_secret_post", "none"],
 				"scopes_supported": ["openid", "offline"],
 				"claims_supported": ["groups"],
 				"discovery.supervisor.pinniped.dev/v1alpha1": {
 					"pinniped_identity_providers_endpoint": "https://some-issuer.com/some/path/v1alpha1/pinniped_identity_providers"
 				}
 			}
-			`),
+			`), "ALGS", algs)
+	}
+
+	tests := []struct {
+		name string
+
+		issuer       string
+		method       string
+		path         string
+		jwksProvider func(jwks.DynamicJWKSProvider)
+
+		wantStatus      int
+		wantContentType string
+		wantBodyJSON    string
+		wantBodyString  string
+	}{
+		{
+			name:            "happy path without signing keys",
+			issuer:          issuer,
+			method:          http.MethodGet,
+			path:            "/some/path" + oidc.WellKnownEndpointPath,
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json",
+			wantBodyJSON:    wantBodyJSON(`["ES256"]`),
+		},
+		{
+			name:   "happy path with an RS256 signing key",
+			issuer: issuer,
+			method: http.MethodGet,
+			path:   "/some/path" + oidc.WellKnownEndpointPath,
+			jwksProvider: func(provider jwks.DynamicJWKSProvider) {
+				provider.SetIssuerToJWKSMap(
+					map[string]*jose.JSONWebKeySet{issuer: {Keys: []jose.JSONWebKey{rsaJWK.Public()}}},
+					map[string]signer.Signer{issuer: rsaSigner},
+				)
+			},
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json",
+			wantBodyJSON:    wantBodyJSON(`["RS256"]`),
+		},
+		{
+			name:   "happy path while changing the signing algorithm advertises the active algorithm first",
+			issuer: issuer,
+			method: http.MethodGet,
+			path:   "/some/path" + oidc.WellKnownEndpointPath,
+			jwksProvider: func(provider jwks.DynamicJWKSProvider) {
+				provider.SetIssuerToJWKSMap(
+					map[string]*jose.JSONWebKeySet{issuer: {Keys: []jose.JSONWebKey{ecJWK.Public(), rsaJWK.Public(), ecJWK.Public()}}},
+					map[string]signer.Signer{issuer: ecSigner},
+				)
+			},
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json",
+			wantBodyJSON:    wantBodyJSON(`["ES256", "RS256"]`),
 		},
 		{
 			name:            "bad method",
@@ -66,7 +127,11 @@ func TestDiscovery(t *testing.T) {
 	for _, test := range tests {
 		test := test
 		t.Run(test.name, func(t *testing.T) {
-			handler := NewHandler(test.issuer)
+			jwksProvider := jwks.NewDynamicJWKSProvider()
+			if test.jwksProvider != nil {
+				test.jwksProvider(jwksProvider)
+			}
+			handler := NewHandler(test.issuer, jwksProvider)
 			req := httptest.NewRequest(test.method, test.path, nil)
 			rsp := httptest.NewRecorder()
 			handler.ServeHTTP(rsp, req)
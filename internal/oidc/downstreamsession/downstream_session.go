@@ -16,7 +16,9 @@ import (
 	"github.com/ory/fosite/token/jwt"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
+	"go.pinniped.dev/internal/authenticators"
 	"go.pinniped.dev/internal/constable"
+	"go.pinniped.dev/internal/idtransform"
 	"go.pinniped.dev/internal/oidc"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/plog"
@@ -38,9 +40,13 @@ const (
 	emailVerifiedClaimFalseErr         = constable.Error("email_verified claim in upstream ID token has false value")
 )
 
-// MakeDownstreamSession creates a downstream OIDC session.
-func MakeDownstreamSession(subject string, username string, groups []string, custom *psession.CustomSessionData) *psession.PinnipedSession {
+// MakeDownstreamSession creates a downstream OIDC session. The sessionID should be the ID of the authorize request.
+// It records the current time as the login time in the custom session data.
+func MakeDownstreamSession(sessionID string, subject string, username string, groups []string, custom *psession.CustomSessionData) *psession.PinnipedSession {
 	now := time.Now().UTC()
+	if custom != nil {
+		custom.LoginTime = now
+	}
 	openIDSession := &psession.PinnipedSession{
 		Fosite: &openid.DefaultSession{
 			Claims: &jwt.IDTokenClaims{
@@ -55,13 +61,40 @@ func MakeDownstreamSession(subject string, username string, groups []string, cus
 		groups = []string{}
 	}
 	openIDSession.IDTokenClaims().Extra = map[string]interface{}{
-		oidc.DownstreamUsernameClaim: username,
-		oidc.DownstreamGroupsClaim:   groups,
+		oidc.DownstreamUsernameClaim:  username,
+		oidc.DownstreamGroupsClaim:    groups,
+		oidc.DownstreamSessionIDClaim: sessionID,
 	}
 	return openIDSession
 }
 
-func MakeDownstreamOIDCCustomSessionData(oidcUpstream provider.UpstreamOIDCIdentityProviderI, token *oidctypes.Token) (*psession.CustomSessionData, error) {
+// ApplyIdentityTransformations applies the identity transformations to the upstream username and groups and returns
+// the resulting downstream username and groups. It returns an error when the transformations fail or when a
+// configured policy rejects the user. The error message is safe to show to the end user.
+func ApplyIdentityTransformations(
+	identityTransforms *idtransform.TransformationPipeline,
+	username string,
+	groups []string,
+) (string, []string, error) {
+	transformationResult, err := identityTransforms.Evaluate(username, groups)
+	if err != nil {
+		plog.Error("unexpected identity transformation error during authentication", err, "inputUsername", username)
+		return "", nil, fmt.Errorf("configured identity transformation failed: %w", err)
+	}
+	if !transformationResult.AuthenticationAllowed {
+		plog.Debug("authentication rejected by configured identity policy", "inputUsername", username, "inputGroups", groups)
+		return "", nil, fmt.Errorf("configured identity policy rejected this authentication: %s", transformationResult.RejectedAuthenticationMessage)
+	}
+	return transformationResult.Username, transformationResult.Groups, nil
+}
+
+// MakeDownstreamOIDCCustomSessionData returns the custom session data of a login using an OIDC upstream. It copies the
+// upstream ID token claims which are named by passthroughClaims, so the UserInfo endpoint can return them.
+func MakeDownstreamOIDCCustomSessionData(
+	oidcUpstream provider.UpstreamOIDCIdentityProviderI,
+	token *oidctypes.Token,
+	passthroughClaims []string,
+) (*psession.CustomSessionData, error) {
 	upstreamSubject, err := ExtractStringClaimValue(oidc.IDTokenSubjectClaim, oidcUpstream.GetName(), token.IDToken.Claims)
 	if err != nil {
 		return nil, err
@@ -76,10 +109,14 @@ func MakeDownstreamOIDCCustomSessionData(oidcUpstream provider.UpstreamOIDCIdent
 		ProviderName: oidcUpstream.GetName(),
 		ProviderType: psession.ProviderTypeOIDC,
 		OIDC: &psession.OIDCSessionData{
-			UpstreamIssuer:  upstreamIssuer,
-			UpstreamSubject: upstreamSubject,
+			UpstreamIssuer:    upstreamIssuer,
+			UpstreamSubject:   upstreamSubject,
+			PassthroughClaims: upstreamPassthroughClaims(passthroughClaims, token.IDToken.Claims),
 		},
 	}
+	if oidcUpstream.GetEndSessionURL() != nil {
+		customSessionData.OIDC.UpstreamIDToken = token.IDToken.Token
+	}
 
 	const pleaseCheck = "please check configuration of OIDCIdentityProvider and the client in the " +
 		"upstream provider's API/UI and try to get a refresh token if possible"
@@ -117,6 +154,23 @@ func MakeDownstreamOIDCCustomSessionData(oidcUpstream provider.UpstreamOIDCIdent
 	return customSessionData, nil
 }
 
+// upstreamPassthroughClaims returns the named claims which are present in the upstream ID token, or nil when there
+// are none.
+func upstreamPassthroughClaims(names []string, idTokenClaims map[string]interface{}) map[string]interface{} {
+	var claims map[string]interface{}
+	for _, name := range names {
+		value, ok := idTokenClaims[name]
+		if !ok {
+			continue
+		}
+		if claims == nil {
+			claims = map[string]interface{}{}
+		}
+		claims[name] = value
+	}
+	return claims
+}
+
 // GrantScopesIfRequested auto-grants the scopes for which we do not require end-user approval, if they were requested.
 func GrantScopesIfRequested(authorizeRequester fosite.AuthorizeRequester) {
 	oidc.GrantScopeIfRequested(authorizeRequester, coreosoidc.ScopeOpenID)
@@ -228,6 +282,42 @@ func ExtractStringClaimValue(claimName string, upstreamIDPName string, idTokenCl
 	return valueAsString, nil
 }
 
+// MakeDownstreamLDAPOrADCustomSessionData returns the custom session data for a user who was authenticated by an
+// upstream LDAP or Active Directory provider.
+func MakeDownstreamLDAPOrADCustomSessionData(
+	ldapUpstream provider.UpstreamLDAPIdentityProviderI,
+	idpType psession.ProviderType,
+	authenticateResponse *authenticators.Response,
+) *psession.CustomSessionData {
+	customSessionData := &psession.CustomSessionData{
+		ProviderUID:  ldapUpstream.GetResourceUID(),
+		ProviderName: ldapUpstream.GetName(),
+		ProviderType: idpType,
+	}
+
+	if idpType == psession.ProviderTypeLDAP {
+		customSessionData.LDAP = &psession.LDAPSessionData{
+			UserDN:                 authenticateResponse.DN,
+			ExtraRefreshAttributes: authenticateResponse.ExtraRefreshAttributes,
+		}
+	}
+	if idpType == psession.ProviderTypeActiveDirectory {
+		customSessionData.ActiveDirectory = &psession.ActiveDirectorySessionData{
+			UserDN:                 authenticateResponse.DN,
+			ExtraRefreshAttributes: authenticateResponse.ExtraRefreshAttributes,
+		}
+	}
+
+	return customSessionData
+}
+
+// DownstreamSubjectFromUpstreamLDAP returns the downstream subject for a user who was authenticated by an
+// upstream LDAP or Active Directory provider.
+func DownstreamSubjectFromUpstreamLDAP(ldapUpstream provider.UpstreamLDAPIdentityProviderI, authenticateResponse *authenticators.Response) string {
+	ldapURL := *ldapUpstream.GetURL()
+	return DownstreamLDAPSubject(authenticateResponse.User.GetUID(), ldapURL)
+}
+
 func DownstreamLDAPSubject(uid string, ldapURL url.URL) string {
 	q := ldapURL.Query()
 	q.Set(oidc.IDTokenSubjectClaim, uid)
@@ -1,12 +1,10 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package oidc
 
 import (
 	"context"
-	"crypto/ecdsa"
-	"reflect"
 
 	"github.com/ory/fosite"
 	"github.com/ory/fosite/compose"
@@ -14,6 +12,7 @@ import (
 
 	"go.pinniped.dev/internal/constable"
 	"go.pinniped.dev/internal/oidc/jwks"
+	"go.pinniped.dev/internal/oidc/signer"
 	"go.pinniped.dev/internal/plog"
 )
 
@@ -46,26 +45,21 @@ func (s *dynamicOpenIDConnectECDSAStrategy) GenerateIDToken(
 	ctx context.Context,
 	requester fosite.Requester,
 ) (string, error) {
-	_, activeJwk := s.jwksProvider.GetJWKS(s.fositeConfig.IDTokenIssuer)
-	if activeJwk == nil {
+	_, activeSigner := s.jwksProvider.GetJWKS(s.fositeConfig.IDTokenIssuer)
+	if activeSigner == nil {
 		plog.Debug("no JWK found for issuer", "issuer", s.fositeConfig.IDTokenIssuer)
 		return "", fosite.ErrTemporarilyUnavailable.WithWrap(constable.Error("no JWK found for issuer"))
 	}
-	key, ok := activeJwk.Key.(*ecdsa.PrivateKey)
-	if !ok {
-		actualType := "nil"
-		if t := reflect.TypeOf(activeJwk.Key); t != nil {
-			actualType = t.String()
-		}
-		plog.Debug(
-			"JWK must be of type ecdsa",
-			"issuer",
-			s.fositeConfig.IDTokenIssuer,
-			"actualType",
-			actualType,
-		)
-		return "", fosite.ErrServerError.WithWrap(constable.Error("JWK must be of type ecdsa"))
-	}
 
-	return compose.NewOpenIDConnectECDSAStrategy(s.fositeConfig, key).GenerateIDToken(ctx, requester)
+	// The signer might hold its private key outside of the Supervisor process, so give it to fosite in place of
+	// a private key. The signer also names its key in the ID token's kid header, so verifiers can find the right
+	// key in the JWKS while several keys are published during a key rotation. The ID token is signed with the
+	// algorithm of the signer's key, which depends on the configuration of the FederationDomain.
+	strategy := &openid.DefaultStrategy{
+		JWTStrategy:         signer.NewJWTStrategy(activeSigner),
+		Expiry:              s.fositeConfig.GetIDTokenLifespan(),
+		Issuer:              s.fositeConfig.IDTokenIssuer,
+		MinParameterEntropy: s.fositeConfig.GetMinParameterEntropy(),
+	}
+	return strategy.GenerateIDToken(ctx, requester)
 }
@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package oidc
@@ -6,6 +6,7 @@ package oidc
 import (
 	"context"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
@@ -19,8 +20,10 @@ import (
 	"github.com/ory/fosite/token/jwt"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/square/go-jose.v2"
+	josejwt "gopkg.in/square/go-jose.v2/jwt"
 
 	"go.pinniped.dev/internal/oidc/jwks"
+	"go.pinniped.dev/internal/oidc/signer"
 	"go.pinniped.dev/internal/testutil/oidctestutil"
 )
 
@@ -36,8 +39,23 @@ func TestDynamicOpenIDConnectECDSAStrategy(t *testing.T) {
 	ecPrivateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	require.NoError(t, err)
 
+	jwkSigner, err := signer.NewJWKSigner(&jose.JSONWebKey{Key: ecPrivateKey})
+	require.NoError(t, err)
+	jwkSignerWithKeyID, err := signer.NewJWKSigner(&jose.JSONWebKey{Key: ecPrivateKey, KeyID: "some-key-id"})
+	require.NoError(t, err)
+	thumbprintKeyID, err := signer.KeyID(&ecPrivateKey.PublicKey)
+	require.NoError(t, err)
+
 	rsaPrivateKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	require.NoError(t, err)
+	rs256Signer, err := signer.NewJWKSigner(&jose.JSONWebKey{Key: rsaPrivateKey, KeyID: "rs256-key-id", Algorithm: "RS256"})
+	require.NoError(t, err)
+	ps256Signer, err := signer.NewJWKSigner(&jose.JSONWebKey{Key: rsaPrivateKey, KeyID: "ps256-key-id", Algorithm: "PS256"})
+	require.NoError(t, err)
+	edPublicKey, edPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edDSASigner, err := signer.NewJWKSigner(&jose.JSONWebKey{Key: edPrivateKey, KeyID: "eddsa-key-id", Algorithm: "EdDSA"})
+	require.NoError(t, err)
 
 	tests := []struct {
 		name           string
@@ -45,46 +63,87 @@ func TestDynamicOpenIDConnectECDSAStrategy(t *testing.T) {
 		jwksProvider   func(jwks.DynamicJWKSProvider)
 		wantErrorType  *fosite.RFC6749Error
 		wantErrorCause string
-		wantSigningJWK *jose.JSONWebKey
+		wantErr        string
+		wantKeyID      string
+		wantAlg        string
+		wantPublicKey  interface{}
 	}{
 		{
-			name:   "jwks provider does contain signing key for issuer",
+			name:   "jwks provider does contain signer for issuer",
+			issuer: goodIssuer,
+			jwksProvider: func(provider jwks.DynamicJWKSProvider) {
+				provider.SetIssuerToJWKSMap(
+					nil,
+					map[string]signer.Signer{
+						goodIssuer: jwkSigner,
+					},
+				)
+			},
+			wantKeyID: thumbprintKeyID,
+			wantAlg:   "ES256",
+		},
+		{
+			name:   "jwks provider contains signer with a key ID for issuer",
 			issuer: goodIssuer,
 			jwksProvider: func(provider jwks.DynamicJWKSProvider) {
 				provider.SetIssuerToJWKSMap(
 					nil,
-					map[string]*jose.JSONWebKey{
-						goodIssuer: {
-							Key: ecPrivateKey,
-						},
+					map[string]signer.Signer{
+						goodIssuer: jwkSignerWithKeyID,
 					},
 				)
 			},
-			wantSigningJWK: &jose.JSONWebKey{
-				Key: ecPrivateKey,
+			wantKeyID: "some-key-id",
+			wantAlg:   "ES256",
+		},
+		{
+			name:   "jwks provider contains RS256 signer for issuer",
+			issuer: goodIssuer,
+			jwksProvider: func(provider jwks.DynamicJWKSProvider) {
+				provider.SetIssuerToJWKSMap(nil, map[string]signer.Signer{goodIssuer: rs256Signer})
+			},
+			wantKeyID:     "rs256-key-id",
+			wantAlg:       "RS256",
+			wantPublicKey: &rsaPrivateKey.PublicKey,
+		},
+		{
+			name:   "jwks provider contains PS256 signer for issuer",
+			issuer: goodIssuer,
+			jwksProvider: func(provider jwks.DynamicJWKSProvider) {
+				provider.SetIssuerToJWKSMap(nil, map[string]signer.Signer{goodIssuer: ps256Signer})
+			},
+			wantKeyID:     "ps256-key-id",
+			wantAlg:       "PS256",
+			wantPublicKey: &rsaPrivateKey.PublicKey,
+		},
+		{
+			name:   "jwks provider contains EdDSA signer for issuer",
+			issuer: goodIssuer,
+			jwksProvider: func(provider jwks.DynamicJWKSProvider) {
+				provider.SetIssuerToJWKSMap(nil, map[string]signer.Signer{goodIssuer: edDSASigner})
 			},
+			wantKeyID:     "eddsa-key-id",
+			wantAlg:       "EdDSA",
+			wantPublicKey: edPublicKey,
 		},
 		{
-			name:           "jwks provider does not contain signing key for issuer",
+			name:           "jwks provider does not contain signer for issuer",
 			issuer:         goodIssuer,
 			wantErrorType:  fosite.ErrTemporarilyUnavailable,
 			wantErrorCause: "no JWK found for issuer",
 		},
 		{
-			name:   "jwks provider contains signing key of wrong type for issuer",
+			name:   "signer for issuer fails to sign",
 			issuer: goodIssuer,
 			jwksProvider: func(provider jwks.DynamicJWKSProvider) {
 				provider.SetIssuerToJWKSMap(
 					nil,
-					map[string]*jose.JSONWebKey{
-						goodIssuer: {
-							Key: rsaPrivateKey,
-						},
+					map[string]signer.Signer{
+						goodIssuer: &failingSigner{Signer: jwkSigner},
 					},
 				)
 			},
-			wantErrorType:  fosite.ErrServerError,
-			wantErrorCause: "JWK must be of type ecdsa",
+			wantErr: "some signing error",
 		},
 	}
 	for _, test := range tests {
@@ -118,19 +177,40 @@ func TestDynamicOpenIDConnectECDSAStrategy(t *testing.T) {
 			if test.wantErrorType != nil {
 				require.True(t, errors.Is(err, test.wantErrorType))
 				require.EqualError(t, err.(*fosite.RFC6749Error).Cause(), test.wantErrorCause)
+			} else if test.wantErr != "" {
+				require.EqualError(t, err, test.wantErr)
 			} else {
 				require.NoError(t, err)
 
-				privateKey, ok := test.wantSigningJWK.Key.(*ecdsa.PrivateKey)
-				require.True(t, ok, "wanted private key to be *ecdsa.PrivateKey, but was %T", test.wantSigningJWK)
+				parsedToken, err := josejwt.ParseSigned(idToken)
+				require.NoError(t, err)
+				require.Len(t, parsedToken.Headers, 1)
+				require.Equal(t, test.wantKeyID, parsedToken.Headers[0].KeyID)
+				require.Equal(t, test.wantAlg, parsedToken.Headers[0].Algorithm)
 
-				// Perform a light validation on the token to make sure 1) we passed through the correct
-				// signing key and 2) we forwarded the fosite.Requester correctly. Token generation is
-				// tested more expansively in the token endpoint.
-				token := oidctestutil.VerifyECDSAIDToken(t, goodIssuer, clientID, privateKey, idToken)
-				require.Equal(t, goodSubject, token.Subject)
-				require.Equal(t, goodNonce, token.Nonce)
+				if test.wantPublicKey == nil {
+					// Perform a light validation on the token to make sure 1) we passed through the correct
+					// signer and 2) we forwarded the fosite.Requester correctly. Token generation is
+					// tested more expansively in the token endpoint.
+					token := oidctestutil.VerifyECDSAIDToken(t, goodIssuer, clientID, ecPrivateKey, idToken)
+					require.Equal(t, goodSubject, token.Subject)
+					require.Equal(t, goodNonce, token.Nonce)
+				} else {
+					var claims josejwt.Claims
+					require.NoError(t, parsedToken.Claims(test.wantPublicKey, &claims))
+					require.Equal(t, goodSubject, claims.Subject)
+					require.Equal(t, goodIssuer, claims.Issuer)
+				}
 			}
 		})
 	}
 }
+
+// failingSigner is a signer whose external system cannot sign.
+type failingSigner struct {
+	signer.Signer
+}
+
+func (s *failingSigner) SignPayload(_ []byte, _ jose.SignatureAlgorithm) ([]byte, error) {
+	return nil, errors.New("some signing error")
+}
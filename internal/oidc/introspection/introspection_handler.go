@@ -0,0 +1,118 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package introspection provides a handler for the OAuth 2.0 token introspection endpoint (RFC 7662).
+package introspection
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ory/fosite"
+
+	"go.pinniped.dev/internal/httputil/httperr"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/psession"
+)
+
+// response is the JSON response of the introspection endpoint. Only the active field is included for inactive tokens.
+type response struct {
+	Active    bool     `json:"active"`
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Username  string   `json:"username,omitempty"`
+	Groups    []string `json:"groups,omitempty"`
+	Scope     string   `json:"scope,omitempty"`
+	ClientID  string   `json:"client_id,omitempty"`
+	Audience  []string `json:"aud,omitempty"`
+	TokenType string   `json:"token_type,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+}
+
+// NewHandler returns an http.Handler which allows resource servers to validate downstream access tokens. The caller
+// must authenticate as a registered OIDCClient using HTTP basic auth. An access token is only reported as active to
+// the client to which it was issued, or to a client whose ID is in the token's granted audience. Refresh tokens are
+// never reported as active.
+func NewHandler(issuerURL string, oauthHelper fosite.OAuth2Provider) http.Handler {
+	return httperr.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		// Fosite would also allow the caller to authenticate using any downstream access token, but only registered
+		// clients should be able to introspect the tokens of other users.
+		rawClientID, _, ok := r.BasicAuth()
+		if !ok || fosite.AccessTokenFromRequest(r) != "" {
+			oauthHelper.WriteIntrospectionError(w, fosite.ErrRequestUnauthorized.WithHint("HTTP Authorization header missing."))
+			return nil
+		}
+
+		// This authenticates the client, and checks the signature, storage, and expiration of the token.
+		introspection, err := oauthHelper.NewIntrospectionRequest(r.Context(), r, psession.NewPinnipedSession())
+		if err != nil {
+			plog.Info("introspection request error", oidc.FositeErrorForLog(err)...)
+			oauthHelper.WriteIntrospectionError(w, err)
+			return nil
+		}
+
+		// Fosite already checked that the client ID can be decoded when it authenticated the client.
+		clientID, _ := url.QueryUnescape(rawClientID)
+		requester := introspection.GetAccessRequester()
+		if introspection.GetTokenUse() != fosite.AccessToken || !canIntrospect(clientID, requester) {
+			writeResponse(w, &response{Active: false})
+			return nil
+		}
+
+		session, ok := requester.GetSession().(*psession.PinnipedSession)
+		if !ok || session.Fosite == nil || session.Fosite.Claims == nil {
+			return httperr.New(http.StatusInternalServerError, "unexpected session type")
+		}
+
+		tokenClientID := requester.GetClient().GetID()
+		writeResponse(w, &response{
+			Active:    true,
+			Issuer:    issuerURL,
+			Subject:   session.Fosite.Claims.Subject,
+			Username:  oidc.DownstreamUsername(session.Fosite.Claims),
+			Groups:    oidc.DownstreamGroups(session.Fosite.Claims),
+			Scope:     strings.Join(requester.GetGrantedScopes(), " "),
+			ClientID:  tokenClientID,
+			Audience:  audience(requester),
+			TokenType: fosite.BearerAccessToken,
+			ExpiresAt: session.GetExpiresAt(fosite.AccessToken).Unix(),
+			IssuedAt:  requester.GetRequestedAt().Unix(),
+		})
+		return nil
+	})
+}
+
+// canIntrospect decides whether the client may see the details of the access token. Like the token exchange grant,
+// which only accepts tokens from the client which they were issued to, other clients may not see the identity of
+// the user, unless the token was explicitly granted to them as an audience.
+func canIntrospect(clientID string, requester fosite.Requester) bool {
+	if requester.GetClient().GetID() == clientID {
+		return true
+	}
+	return requester.GetGrantedAudience().Has(clientID)
+}
+
+// audience returns the client of the token followed by the token's granted audience.
+func audience(requester fosite.Requester) []string {
+	tokenClientID := requester.GetClient().GetID()
+	aud := []string{tokenClientID}
+	for _, a := range requester.GetGrantedAudience() {
+		if a != tokenClientID {
+			aud = append(aud, a)
+		}
+	}
+	return aud
+}
+
+func writeResponse(w http.ResponseWriter, r *response) {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	if err := json.NewEncoder(w).Encode(r); err != nil {
+		plog.Error("error writing introspection response", err)
+	}
+}
@@ -0,0 +1,346 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package introspection
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/compose"
+	"github.com/ory/fosite/handler/openid"
+	"github.com/ory/fosite/token/jwt"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	configv1alpha1 "go.pinniped.dev/generated/latest/apis/supervisor/config/v1alpha1"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/clientregistry"
+	"go.pinniped.dev/internal/psession"
+	"go.pinniped.dev/internal/testutil/oidctestutil"
+)
+
+const (
+	namespace = "some-namespace"
+	issuer    = "https://some-issuer.com"
+
+	tokenClientID          = "client.oauth.pinniped.dev-app"
+	resourceServerClientID = "client.oauth.pinniped.dev-resource-server"
+	otherClientID          = "client.oauth.pinniped.dev-other"
+	clientSecret           = "some-client-secret"
+	// clientSecretHash is a bcrypt hash of "some-client-secret" with cost 12.
+	clientSecretHash = "$2a$12$yHGWWZy/UWGN7V0ETyyP/etrfr1n0GOdWpwJt3HxUqBlar/3Z3.D6"
+)
+
+func TestIntrospectionHandler(t *testing.T) {
+	hmacSecret := []byte("some secret - must have at least 32 bytes")
+	requestedAt := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	expiresAt := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+
+	tests := []struct {
+		name string
+
+		grantedScopes   fosite.Arguments
+		grantedAudience fosite.Arguments
+		expired         bool
+
+		// Returns the form and basic auth credentials of the request, given the stored tokens.
+		request       func(accessToken, refreshToken string) (url.Values, *url.Userinfo)
+		useBearerAuth bool
+		method        string
+
+		wantStatus       int
+		wantBodyJSON     string
+		wantBodyContains string
+	}{
+		{
+			name: "client introspects its own access token",
+			request: func(accessToken, _ string) (url.Values, *url.Userinfo) {
+				return url.Values{"token": {accessToken}}, url.UserPassword(tokenClientID, clientSecret)
+			},
+			wantStatus: http.StatusOK,
+			wantBodyJSON: `{
+				"active": true,
+				"iss": "https://some-issuer.com",
+				"sub": "some-subject",
+				"username": "some-username",
+				"groups": ["group1", "group2"],
+				"scope": "openid offline_access",
+				"client_id": "client.oauth.pinniped.dev-app",
+				"aud": ["client.oauth.pinniped.dev-app"],
+				"token_type": "bearer",
+				"exp": EXP,
+				"iat": 1641092645
+			}`,
+		},
+		{
+			name:            "resource server introspects an access token which was granted to it as an audience",
+			grantedAudience: fosite.Arguments{resourceServerClientID},
+			request: func(accessToken, _ string) (url.Values, *url.Userinfo) {
+				return url.Values{"token": {accessToken}, "token_type_hint": {"access_token"}}, url.UserPassword(resourceServerClientID, clientSecret)
+			},
+			wantStatus: http.StatusOK,
+			wantBodyJSON: `{
+				"active": true,
+				"iss": "https://some-issuer.com",
+				"sub": "some-subject",
+				"username": "some-username",
+				"groups": ["group1", "group2"],
+				"scope": "openid offline_access",
+				"client_id": "client.oauth.pinniped.dev-app",
+				"aud": ["client.oauth.pinniped.dev-app", "client.oauth.pinniped.dev-resource-server"],
+				"token_type": "bearer",
+				"exp": EXP,
+				"iat": 1641092645
+			}`,
+		},
+		{
+			name: "resource server introspects an access token which was not granted to it",
+			request: func(accessToken, _ string) (url.Values, *url.Userinfo) {
+				return url.Values{"token": {accessToken}}, url.UserPassword(resourceServerClientID, clientSecret)
+			},
+			wantStatus:   http.StatusOK,
+			wantBodyJSON: `{"active": false}`,
+		},
+		{
+			name:          "another client introspects an access token which was granted the pinniped:request-audience scope",
+			grantedScopes: fosite.Arguments{"openid", "offline_access", "pinniped:request-audience"},
+			request: func(accessToken, _ string) (url.Values, *url.Userinfo) {
+				return url.Values{"token": {accessToken}}, url.UserPassword(resourceServerClientID, clientSecret)
+			},
+			wantStatus:   http.StatusOK,
+			wantBodyJSON: `{"active": false}`,
+		},
+		{
+			name:            "another client introspects an access token which was granted to a different audience",
+			grantedAudience: fosite.Arguments{resourceServerClientID},
+			request: func(accessToken, _ string) (url.Values, *url.Userinfo) {
+				return url.Values{"token": {accessToken}}, url.UserPassword(otherClientID, clientSecret)
+			},
+			wantStatus:   http.StatusOK,
+			wantBodyJSON: `{"active": false}`,
+		},
+		{
+			name: "refresh token is never active",
+			request: func(_, refreshToken string) (url.Values, *url.Userinfo) {
+				return url.Values{"token": {refreshToken}}, url.UserPassword(tokenClientID, clientSecret)
+			},
+			wantStatus:   http.StatusOK,
+			wantBodyJSON: `{"active": false}`,
+		},
+		{
+			name: "unknown token",
+			request: func(_, _ string) (url.Values, *url.Userinfo) {
+				return url.Values{"token": {"some-unknown-token.some-signature"}}, url.UserPassword(tokenClientID, clientSecret)
+			},
+			wantStatus:   http.StatusOK,
+			wantBodyJSON: `{"active": false}`,
+		},
+		{
+			name:    "expired access token",
+			expired: true,
+			request: func(accessToken, _ string) (url.Values, *url.Userinfo) {
+				return url.Values{"token": {accessToken}}, url.UserPassword(tokenClientID, clientSecret)
+			},
+			wantStatus:   http.StatusOK,
+			wantBodyJSON: `{"active": false}`,
+		},
+		{
+			name: "missing client authentication",
+			request: func(accessToken, _ string) (url.Values, *url.Userinfo) {
+				return url.Values{"token": {accessToken}}, nil
+			},
+			wantStatus:       http.StatusUnauthorized,
+			wantBodyContains: `"error":"request_unauthorized"`,
+		},
+		{
+			name:          "bearer token authentication is not allowed",
+			useBearerAuth: true,
+			request: func(_, refreshToken string) (url.Values, *url.Userinfo) {
+				return url.Values{"token": {refreshToken}}, nil
+			},
+			wantStatus:       http.StatusUnauthorized,
+			wantBodyContains: `"error":"request_unauthorized"`,
+		},
+		{
+			name: "access_token param is not allowed in addition to client authentication",
+			request: func(accessToken, _ string) (url.Values, *url.Userinfo) {
+				return url.Values{"token": {accessToken}, "access_token": {accessToken}}, url.UserPassword(resourceServerClientID, "wrong-secret")
+			},
+			wantStatus:       http.StatusUnauthorized,
+			wantBodyContains: `"error":"request_unauthorized"`,
+		},
+		{
+			name: "wrong client secret",
+			request: func(accessToken, _ string) (url.Values, *url.Userinfo) {
+				return url.Values{"token": {accessToken}}, url.UserPassword(tokenClientID, "wrong-secret")
+			},
+			wantStatus:       http.StatusUnauthorized,
+			wantBodyContains: `"error":"request_unauthorized"`,
+		},
+		{
+			name: "public client cannot authenticate",
+			request: func(accessToken, _ string) (url.Values, *url.Userinfo) {
+				return url.Values{"token": {accessToken}}, url.UserPassword("pinniped-cli", "")
+			},
+			wantStatus:       http.StatusUnauthorized,
+			wantBodyContains: `"error":"request_unauthorized"`,
+		},
+		{
+			name:   "wrong method",
+			method: http.MethodGet,
+			request: func(accessToken, _ string) (url.Values, *url.Userinfo) {
+				return url.Values{"token": {accessToken}}, url.UserPassword(tokenClientID, clientSecret)
+			},
+			wantStatus:       http.StatusBadRequest,
+			wantBodyContains: `"error":"invalid_request"`,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			secrets := fake.NewSimpleClientset().CoreV1().Secrets(namespace)
+			clientManager := oidctestutil.NewClientManager(t, namespace,
+				[]*configv1alpha1.OIDCClient{
+					newOIDCClient(tokenClientID, "app-secret"),
+					newOIDCClient(resourceServerClientID, "resource-server-secret"),
+					newOIDCClient(otherClientID, "other-secret"),
+				},
+				[]*corev1.Secret{
+					newClientSecret("app-secret"),
+					newClientSecret("resource-server-secret"),
+					newClientSecret("other-secret"),
+				},
+			)
+			timeoutsConfiguration := oidc.DefaultOIDCTimeoutsConfiguration()
+			oauthStore := oidc.NewKubeStorage(secrets, clientManager, timeoutsConfiguration)
+			oauthHelper := oidc.FositeOauth2Helper(oauthStore, issuer, func() []byte { return hmacSecret }, nil, timeoutsConfiguration)
+
+			grantedScopes := test.grantedScopes
+			if grantedScopes == nil {
+				grantedScopes = fosite.Arguments{"openid", "offline_access"}
+			}
+			tokenExpiresAt := expiresAt
+			if test.expired {
+				tokenExpiresAt = time.Now().UTC().Add(-time.Minute)
+			}
+			accessToken, refreshToken := createStoredSession(ctx, t, oauthStore, clientManager, grantedScopes, test.grantedAudience, requestedAt, tokenExpiresAt, hmacSecret)
+
+			method := test.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			form, basicAuth := test.request(accessToken, refreshToken)
+			req := httptest.NewRequest(method, "/oauth2/introspect", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if basicAuth != nil {
+				password, _ := basicAuth.Password()
+				req.SetBasicAuth(basicAuth.Username(), password)
+			}
+			if test.useBearerAuth {
+				req.Header.Set("Authorization", "Bearer "+accessToken)
+			}
+			rsp := httptest.NewRecorder()
+
+			NewHandler(issuer, oauthHelper).ServeHTTP(rsp, req)
+
+			require.Equal(t, test.wantStatus, rsp.Code, "unexpected response body: %s", rsp.Body.String())
+			require.Equal(t, "no-store", rsp.Header().Get("Cache-Control"))
+			if test.wantBodyJSON != "" {
+				require.Equal(t, "application/json;charset=UTF-8", rsp.Header().Get("Content-Type"))
+				wantBodyJSON := strings.ReplaceAll(test.wantBodyJSON, "EXP", strconv.FormatInt(expiresAt.Unix(), 10))
+				require.JSONEq(t, wantBodyJSON, rsp.Body.String())
+			}
+			if test.wantBodyContains != "" {
+				require.Contains(t, rsp.Body.String(), test.wantBodyContains)
+			}
+		})
+	}
+}
+
+func newOIDCClient(name string, secretName string) *configv1alpha1.OIDCClient {
+	return &configv1alpha1.OIDCClient{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec: configv1alpha1.OIDCClientSpec{
+			AllowedRedirectURIs: []configv1alpha1.RedirectURI{"https://app.example.com/callback"},
+			AllowedGrantTypes:   []configv1alpha1.GrantType{"authorization_code", "refresh_token"},
+			AllowedScopes:       []configv1alpha1.Scope{"openid", "offline_access"},
+			ClientSecret:        configv1alpha1.OIDCClientSecret{SecretName: secretName},
+		},
+	}
+}
+
+func newClientSecret(name string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Type:       "secrets.pinniped.dev/oidc-client-secret",
+		Data:       map[string][]byte{"clientSecretHash": []byte(clientSecretHash)},
+	}
+}
+
+// createStoredSession stores a downstream access token session and refresh token session for the app client in the
+// same way as the token endpoint, and returns the tokens.
+func createStoredSession(
+	ctx context.Context,
+	t *testing.T,
+	oauthStore *oidc.KubeStorage,
+	clientManager *clientregistry.ClientManager,
+	grantedScopes fosite.Arguments,
+	grantedAudience fosite.Arguments,
+	requestedAt time.Time,
+	expiresAt time.Time,
+	hmacSecret []byte,
+) (string, string) {
+	t.Helper()
+
+	client, err := clientManager.GetClient(ctx, tokenClientID)
+	require.NoError(t, err)
+
+	request := &fosite.Request{
+		ID:          "some-request-id",
+		Client:      client,
+		RequestedAt: requestedAt,
+		Session: &psession.PinnipedSession{
+			Fosite: &openid.DefaultSession{
+				Claims: &jwt.IDTokenClaims{
+					Subject: "some-subject",
+					Extra: map[string]interface{}{
+						oidc.DownstreamUsernameClaim:  "some-username",
+						oidc.DownstreamGroupsClaim:    []string{"group1", "group2"},
+						oidc.DownstreamSessionIDClaim: "some-request-id",
+					},
+				},
+				Headers:   &jwt.Headers{},
+				ExpiresAt: map[fosite.TokenType]time.Time{fosite.AccessToken: expiresAt},
+			},
+			Custom: &psession.CustomSessionData{ProviderType: psession.ProviderTypeOIDC, OIDC: &psession.OIDCSessionData{}},
+		},
+		RequestedScope:    grantedScopes,
+		GrantedScope:      grantedScopes,
+		RequestedAudience: grantedAudience,
+		GrantedAudience:   grantedAudience,
+		Form:              url.Values{},
+	}
+
+	strategy := compose.NewOAuth2HMACStrategy(&compose.Config{}, hmacSecret, nil)
+	accessToken, accessTokenSignature, err := strategy.GenerateAccessToken(ctx, request)
+	require.NoError(t, err)
+	refreshToken, refreshTokenSignature, err := strategy.GenerateRefreshToken(ctx, request)
+	require.NoError(t, err)
+
+	require.NoError(t, oauthStore.CreateAccessTokenSession(ctx, accessTokenSignature, request))
+	require.NoError(t, oauthStore.CreateRefreshTokenSession(ctx, refreshTokenSignature, request))
+
+	return accessToken, refreshToken
+}
@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package jwks
@@ -7,41 +7,46 @@ import (
 	"sync"
 
 	"gopkg.in/square/go-jose.v2"
+
+	"go.pinniped.dev/internal/oidc/signer"
 )
 
+// DynamicJWKSProvider holds the keys of each issuer. The JWKS of an issuer contains every public key which may be
+// needed to verify its tokens, which may include the next key and some retired keys during a key rotation.
+// The active signer signs new tokens, and its private key may be held outside of the Supervisor process.
 type DynamicJWKSProvider interface {
 	SetIssuerToJWKSMap(
 		issuerToJWKSMap map[string]*jose.JSONWebKeySet,
-		issuerToActiveJWKMap map[string]*jose.JSONWebKey,
+		issuerToActiveSignerMap map[string]signer.Signer,
 	)
-	GetJWKS(issuerName string) (jwks *jose.JSONWebKeySet, activeJWK *jose.JSONWebKey)
+	GetJWKS(issuerName string) (jwks *jose.JSONWebKeySet, activeSigner signer.Signer)
 }
 
 type dynamicJWKSProvider struct {
-	issuerToJWKSMap      map[string]*jose.JSONWebKeySet
-	issuerToActiveJWKMap map[string]*jose.JSONWebKey
-	mutex                sync.RWMutex
+	issuerToJWKSMap         map[string]*jose.JSONWebKeySet
+	issuerToActiveSignerMap map[string]signer.Signer
+	mutex                   sync.RWMutex
 }
 
 func NewDynamicJWKSProvider() DynamicJWKSProvider {
 	return &dynamicJWKSProvider{
-		issuerToJWKSMap:      map[string]*jose.JSONWebKeySet{},
-		issuerToActiveJWKMap: map[string]*jose.JSONWebKey{},
+		issuerToJWKSMap:         map[string]*jose.JSONWebKeySet{},
+		issuerToActiveSignerMap: map[string]signer.Signer{},
 	}
 }
 
 func (p *dynamicJWKSProvider) SetIssuerToJWKSMap(
 	issuerToJWKSMap map[string]*jose.JSONWebKeySet,
-	issuerToActiveJWKMap map[string]*jose.JSONWebKey,
+	issuerToActiveSignerMap map[string]signer.Signer,
 ) {
 	p.mutex.Lock() // acquire a write lock
 	defer p.mutex.Unlock()
 	p.issuerToJWKSMap = issuerToJWKSMap
-	p.issuerToActiveJWKMap = issuerToActiveJWKMap
+	p.issuerToActiveSignerMap = issuerToActiveSignerMap
 }
 
-func (p *dynamicJWKSProvider) GetJWKS(issuerName string) (*jose.JSONWebKeySet, *jose.JSONWebKey) {
+func (p *dynamicJWKSProvider) GetJWKS(issuerName string) (*jose.JSONWebKeySet, signer.Signer) {
 	p.mutex.RLock() // acquire a read lock
 	defer p.mutex.RUnlock()
-	return p.issuerToJWKSMap[issuerName], p.issuerToActiveJWKMap[issuerName]
+	return p.issuerToJWKSMap[issuerName], p.issuerToActiveSignerMap[issuerName]
 }
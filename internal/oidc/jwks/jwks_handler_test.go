@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package jwks
@@ -13,6 +13,7 @@ import (
 	"gopkg.in/square/go-jose.v2"
 
 	"go.pinniped.dev/internal/here"
+	"go.pinniped.dev/internal/oidc/signer"
 )
 
 func TestJWKSEndpoint(t *testing.T) {
@@ -108,9 +109,7 @@ func newDynamicJWKSProvider(t *testing.T, issuer string, jwksJSON string) Dynami
 	issuerToJWKSMap := map[string]*jose.JSONWebKeySet{
 		issuer: &keySet,
 	}
-	issuerToActiveJWKMap := map[string]*jose.JSONWebKey{
-		issuer: &keySet.Keys[0],
-	}
-	jwksProvider.SetIssuerToJWKSMap(issuerToJWKSMap, issuerToActiveJWKMap)
+	// The handler only serves the JWKS, so it does not need a signer for the active key.
+	jwksProvider.SetIssuerToJWKSMap(issuerToJWKSMap, map[string]signer.Signer{})
 	return jwksProvider
 }
@@ -5,16 +5,16 @@ package oidc
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/ory/fosite"
-	"github.com/ory/fosite/handler/oauth2"
-	"github.com/ory/fosite/handler/openid"
-	fositepkce "github.com/ory/fosite/handler/pkce"
 	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 
+	"go.pinniped.dev/internal/crud"
 	"go.pinniped.dev/internal/fositestorage/accesstoken"
 	"go.pinniped.dev/internal/fositestorage/authorizationcode"
+	"go.pinniped.dev/internal/fositestorage/devicecode"
 	"go.pinniped.dev/internal/fositestorage/openidconnect"
 	"go.pinniped.dev/internal/fositestorage/pkce"
 	"go.pinniped.dev/internal/fositestorage/refreshtoken"
@@ -24,24 +24,33 @@ import (
 
 type KubeStorage struct {
 	clientManager            fosite.ClientManager
-	authorizationCodeStorage oauth2.AuthorizeCodeStorage
-	pkceStorage              fositepkce.PKCERequestStorage
-	oidcStorage              openid.OpenIDConnectRequestStorage
+	authorizationCodeStorage authorizationcode.RevocationStorage
+	pkceStorage              pkce.RevocationStorage
+	oidcStorage              openidconnect.RevocationStorage
 	accessTokenStorage       accesstoken.RevocationStorage
 	refreshTokenStorage      refreshtoken.RevocationStorage
+	deviceCodeStorage        devicecode.Storage
 }
 
 var _ fositestoragei.AllFositeStorage = &KubeStorage{}
+var _ devicecode.Storage = &KubeStorage{}
 
-func NewKubeStorage(secrets corev1client.SecretInterface, timeoutsConfiguration TimeoutsConfiguration) *KubeStorage {
+// NewKubeStorage returns the storage of the downstream sessions, which stores them as Secrets.
+func NewKubeStorage(secrets corev1client.SecretInterface, clientManager *clientregistry.ClientManager, timeoutsConfiguration TimeoutsConfiguration) *KubeStorage {
+	return NewStorage(crud.NewSecretsBackend(secrets), clientManager, timeoutsConfiguration)
+}
+
+// NewStorage is similar to NewKubeStorage, but stores the downstream sessions using the given storage backend.
+func NewStorage(backend crud.Backend, clientManager *clientregistry.ClientManager, timeoutsConfiguration TimeoutsConfiguration) *KubeStorage {
 	nowFunc := time.Now
 	return &KubeStorage{
-		clientManager:            &clientregistry.StaticClientManager{},
-		authorizationCodeStorage: authorizationcode.New(secrets, nowFunc, timeoutsConfiguration.AuthorizationCodeSessionStorageLifetime),
-		pkceStorage:              pkce.New(secrets, nowFunc, timeoutsConfiguration.PKCESessionStorageLifetime),
-		oidcStorage:              openidconnect.New(secrets, nowFunc, timeoutsConfiguration.OIDCSessionStorageLifetime),
-		accessTokenStorage:       accesstoken.New(secrets, nowFunc, timeoutsConfiguration.AccessTokenSessionStorageLifetime),
-		refreshTokenStorage:      refreshtoken.New(secrets, nowFunc, timeoutsConfiguration.RefreshTokenSessionStorageLifetime),
+		clientManager:            clientManager,
+		authorizationCodeStorage: authorizationcode.New(backend, nowFunc, timeoutsConfiguration.AuthorizationCodeSessionStorageLifetime),
+		pkceStorage:              pkce.New(backend, nowFunc, timeoutsConfiguration.PKCESessionStorageLifetime),
+		oidcStorage:              openidconnect.New(backend, nowFunc, timeoutsConfiguration.OIDCSessionStorageLifetime),
+		accessTokenStorage:       accesstoken.New(backend, nowFunc, timeoutsConfiguration.AccessTokenSessionStorageLifetime),
+		refreshTokenStorage:      refreshtoken.New(backend, nowFunc, timeoutsConfiguration.RefreshTokenSessionStorageLifetime),
+		deviceCodeStorage:        devicecode.New(backend, nowFunc, timeoutsConfiguration.DeviceCodeSessionStorageLifetime),
 	}
 }
 
@@ -184,6 +193,102 @@ func (k KubeStorage) RevokeRefreshTokenMaybeGracePeriod(ctx context.Context, req
 	return k.refreshTokenStorage.RevokeRefreshTokenMaybeGracePeriod(ctx, requestID, signature)
 }
 
+//
+// Device code sessions:
+//
+// These are keyed by the signature of the device code, and are also labeled with the user code.
+//
+// Pinniped creates these in the device authorization endpoint, and approves them in the callback endpoint after the
+// user has logged in using the device verification page. Pinniped deletes them in the token endpoint when the device
+// code is redeemed. If the device never redeems its device code, then they are deleted by the garbage collector.
+//
+
+func (k KubeStorage) CreateDeviceCodeSession(ctx context.Context, session *devicecode.Session) error {
+	return k.deviceCodeStorage.CreateDeviceCodeSession(ctx, session)
+}
+
+func (k KubeStorage) GetDeviceCodeSession(ctx context.Context, signatureOfDeviceCode string) (*devicecode.Session, string, error) {
+	return k.deviceCodeStorage.GetDeviceCodeSession(ctx, signatureOfDeviceCode)
+}
+
+func (k KubeStorage) GetDeviceCodeSessionByUserCode(ctx context.Context, userCode string) (*devicecode.Session, string, error) {
+	return k.deviceCodeStorage.GetDeviceCodeSessionByUserCode(ctx, userCode)
+}
+
+func (k KubeStorage) UpdateDeviceCodeSession(ctx context.Context, session *devicecode.Session, resourceVersion string) error {
+	return k.deviceCodeStorage.UpdateDeviceCodeSession(ctx, session, resourceVersion)
+}
+
+func (k KubeStorage) DeleteDeviceCodeSession(ctx context.Context, signatureOfDeviceCode string) error {
+	return k.deviceCodeStorage.DeleteDeviceCodeSession(ctx, signatureOfDeviceCode)
+}
+
+//
+// Downstream sessions:
+//
+// All of the storage for a downstream session is labeled with the ID of the original authorization request, because
+// fosite reuses that ID for every token request of the session, including refreshes. This allows the whole session
+// to be found and deleted, e.g. when the user logs out.
+//
+
+// GetSessionRequestByRequestID returns the most up-to-date stored request for the downstream session, i.e. the request
+// from the session's refresh token storage if there is one, or else from the session's access token storage.
+func (k KubeStorage) GetSessionRequestByRequestID(ctx context.Context, requestID string) (fosite.Requester, error) {
+	request, err := k.refreshTokenStorage.GetRefreshTokenSessionByRequestID(ctx, requestID)
+	if errors.Is(err, fosite.ErrNotFound) {
+		return k.accessTokenStorage.GetAccessTokenSessionByRequestID(ctx, requestID)
+	}
+	return request, err
+}
+
+// ListSessionRequestsBySubject returns the stored requests of all the downstream sessions of the given downstream
+// subject which can be refreshed. Sessions without a refresh token are short-lived, so they are not included.
+func (k KubeStorage) ListSessionRequestsBySubject(ctx context.Context, subject string) ([]fosite.Requester, error) {
+	return k.refreshTokenStorage.ListRefreshTokenSessionsBySubject(ctx, subject)
+}
+
+// ListSessionRequests returns the most up-to-date stored request of every downstream session, like
+// GetSessionRequestByRequestID does for a single session.
+func (k KubeStorage) ListSessionRequests(ctx context.Context) ([]fosite.Requester, error) {
+	refreshTokenRequests, err := k.refreshTokenStorage.ListRefreshTokenSessions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	accessTokenRequests, err := k.accessTokenStorage.ListAccessTokenSessions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	requests := make([]fosite.Requester, 0, len(refreshTokenRequests)+len(accessTokenRequests))
+	seen := make(map[string]bool, len(refreshTokenRequests))
+	for _, request := range append(refreshTokenRequests, accessTokenRequests...) {
+		// A session has several access tokens after each refresh, and its refresh token holds its latest request.
+		if seen[request.GetID()] {
+			continue
+		}
+		seen[request.GetID()] = true
+		requests = append(requests, request)
+	}
+	return requests, nil
+}
+
+// RevokeSession deletes all storage for the downstream session. It is not an error when some types of storage were
+// already deleted or were never created for the session.
+func (k KubeStorage) RevokeSession(ctx context.Context, requestID string) error {
+	for _, revoke := range []func(ctx context.Context, requestID string) error{
+		k.refreshTokenStorage.RevokeRefreshToken,
+		k.accessTokenStorage.RevokeAccessToken,
+		k.oidcStorage.RevokeOpenIDConnectSession,
+		k.pkceStorage.RevokePKCERequestSession,
+		k.authorizationCodeStorage.RevokeAuthorizeCodeSession,
+	} {
+		if err := revoke(ctx, requestID); err != nil && !errors.Is(err, crud.ErrNoSecretsMatchedLabel) {
+			return err
+		}
+	}
+	return nil
+}
+
 //
 // OAuth client definitions:
 //
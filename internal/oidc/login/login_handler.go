@@ -0,0 +1,279 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package login provides a handler for the Supervisor's login page, which is used by the browser-based flow
+// for LDAP and Active Directory upstream identity providers.
+package login
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+
+	"github.com/ory/fosite"
+
+	"go.pinniped.dev/internal/audit"
+	"go.pinniped.dev/internal/constable"
+	"go.pinniped.dev/internal/fositestorage/devicecode"
+	"go.pinniped.dev/internal/httputil/httperr"
+	"go.pinniped.dev/internal/httputil/securityheader"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/device"
+	"go.pinniped.dev/internal/oidc/downstreamsession"
+	"go.pinniped.dev/internal/oidc/login/loginhtml"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/oidc/provider/formposthtml"
+	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/psession"
+)
+
+const (
+	stateParamName    = "state"
+	usernameParamName = "username"
+	passwordParamName = "password"
+	errParamName      = "err"
+
+	errParamLoginFailed   = "login_error"
+	errParamInternalError = "internal_error"
+
+	loginFailedMessage   = "Incorrect username or password."
+	internalErrorMessage = "An internal error occurred. Please contact your administrator for help."
+
+	errMissingUsernameOrPassword = constable.Error("missing username or password")
+	errLoginFailed               = constable.Error("username/password not accepted by the upstream provider")
+)
+
+// NewHandler returns an http.Handler for the Supervisor's login page. The authorization endpoint redirects browsers
+// here when an authorization request chooses an LDAP or Active Directory upstream without sending credentials in
+// headers. GET renders a form which asks for a username and password. The form posts back to this endpoint, which
+// authenticates the user with the upstream provider and then finishes the original authorization request, which
+// was encoded into the upstream state param by the authorization endpoint. Both methods require the CSRF cookie
+// which was set by the authorization endpoint to match the state param.
+func NewHandler(
+	downstreamIssuer string,
+	upstreamIDPs oidc.UpstreamIdentityProvidersLister,
+	idTransformsGetter oidc.IdentityTransformsGetter,
+	oauthHelper fosite.OAuth2Provider,
+	stateDecoder, cookieDecoder oidc.Decoder,
+	deviceCodeStorage devicecode.Storage,
+) http.Handler {
+	handler := httperr.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			return httperr.Newf(http.StatusMethodNotAllowed, "%s (try GET or POST)", r.Method)
+		}
+
+		if err := r.ParseForm(); err != nil {
+			return httperr.New(http.StatusBadRequest, "error parsing request params")
+		}
+
+		encodedState := r.Form.Get(stateParamName)
+		state, err := validateRequest(r, encodedState, stateDecoder, cookieDecoder)
+		if err != nil {
+			if r.Method == http.MethodPost {
+				oidc.RecordAuditEvent(r, audit.TypeLogin, downstreamIssuer, nil, nil, err)
+			}
+			return err
+		}
+
+		ldapUpstream, idpType := findUpstreamIDPConfig(state.UpstreamName, state.UpstreamType, upstreamIDPs)
+		if ldapUpstream == nil {
+			plog.Warning("upstream provider not found")
+			err := httperr.New(http.StatusUnprocessableEntity, "upstream provider not found")
+			if r.Method == http.MethodPost {
+				oidc.RecordAuditEvent(r, audit.TypeLogin, downstreamIssuer, nil,
+					&audit.IdentityProvider{Name: state.UpstreamName, Type: state.UpstreamType}, err)
+			}
+			return err
+		}
+
+		if r.Method == http.MethodGet {
+			return renderLoginForm(w, downstreamIssuer, encodedState, ldapUpstream.GetName(), r.Form.Get(errParamName))
+		}
+
+		// Only the submissions of the login form are audited, since showing the form does not authenticate anyone.
+		upstream := oidc.AuditIdentityProvider(ldapUpstream.GetName(), idpType, string(ldapUpstream.GetResourceUID()))
+
+		downstreamAuthParams, err := url.ParseQuery(state.AuthParams)
+		if err != nil {
+			plog.Error("error reading state downstream auth params", err)
+			err := httperr.New(http.StatusBadRequest, "error reading state downstream auth params")
+			oidc.RecordAuditEvent(r, audit.TypeLogin, downstreamIssuer, nil, upstream, err)
+			return err
+		}
+
+		// Recreate enough of the original authorize request so we can pass it to NewAuthorizeRequest().
+		reconstitutedAuthRequest := &http.Request{Form: downstreamAuthParams}
+		authorizeRequester, err := oauthHelper.NewAuthorizeRequest(r.Context(), reconstitutedAuthRequest)
+		if err != nil {
+			plog.Error("error using state downstream auth params", err)
+			err := httperr.New(http.StatusBadRequest, "error using state downstream auth params")
+			oidc.RecordAuditEvent(r, audit.TypeLogin, downstreamIssuer, nil, upstream, err)
+			return err
+		}
+
+		// Automatically grant the openid, offline_access, and pinniped:request-audience scopes, but only if they were requested.
+		downstreamsession.GrantScopesIfRequested(authorizeRequester)
+
+		username := r.PostForm.Get(usernameParamName)
+		password := r.PostForm.Get(passwordParamName)
+		if username == "" || password == "" {
+			oidc.RecordAuditEvent(r, audit.TypeLogin, downstreamIssuer, authorizeRequester, upstream, errMissingUsernameOrPassword)
+			return redirectToLoginForm(w, r, downstreamIssuer, encodedState, errParamLoginFailed)
+		}
+
+		authenticateResponse, authenticated, err := ldapUpstream.AuthenticateUser(r.Context(), username, password)
+		if err != nil {
+			plog.WarningErr("unexpected error during upstream LDAP authentication", err, "upstreamName", ldapUpstream.GetName())
+			oidc.RecordAuditEvent(r, audit.TypeLogin, downstreamIssuer, authorizeRequester, upstream, err)
+			return redirectToLoginForm(w, r, downstreamIssuer, encodedState, errParamInternalError)
+		}
+		if !authenticated {
+			oidc.RecordAuditEvent(r, audit.TypeLogin, downstreamIssuer, authorizeRequester, upstream, errLoginFailed)
+			return redirectToLoginForm(w, r, downstreamIssuer, encodedState, errParamLoginFailed)
+		}
+
+		subject := downstreamsession.DownstreamSubjectFromUpstreamLDAP(ldapUpstream, authenticateResponse)
+		username = authenticateResponse.User.GetName()
+		groups := authenticateResponse.User.GetGroups()
+		customSessionData := downstreamsession.MakeDownstreamLDAPOrADCustomSessionData(ldapUpstream, idpType, authenticateResponse)
+
+		// Remember the upstream identity so the identity transformations can be applied again during refresh.
+		customSessionData.UpstreamUsername = username
+		customSessionData.UpstreamGroups = groups
+
+		idTransforms := idTransformsGetter.IdentityTransforms(ldapUpstream.GetName(), idpType)
+		username, groups, err = downstreamsession.ApplyIdentityTransformations(idTransforms, username, groups)
+		if err != nil {
+			err := fosite.ErrAccessDenied.WithHintf("Reason: %s.", err.Error())
+			oidc.RecordAuditEvent(r, audit.TypeLogin, downstreamIssuer, authorizeRequester, upstream, err)
+			oauthHelper.WriteAuthorizeError(w, authorizeRequester, err)
+			return nil
+		}
+
+		openIDSession := downstreamsession.MakeDownstreamSession(authorizeRequester.GetID(), subject, username, groups, customSessionData)
+
+		if userCode := downstreamAuthParams.Get(oidc.DeviceUserCodeParamName); userCode != "" {
+			// The login was started by the device verification page, so the device gets the tokens instead of the browser.
+			if err := device.ApproveSession(r, cookieDecoder, deviceCodeStorage, userCode, authorizeRequester, openIDSession); err != nil {
+				plog.WarningErr("error while approving device code session", err, "upstreamName", ldapUpstream.GetName())
+				oidc.RecordAuditEvent(r, audit.TypeLogin, downstreamIssuer, authorizeRequester, upstream, err)
+				return err
+			}
+			authorizeRequester.SetSession(openIDSession) // only to record the identity in the audit event
+			oidc.RecordAuditEvent(r, audit.TypeLogin, downstreamIssuer, authorizeRequester, upstream, nil)
+			return device.WriteLoggedInPage(w)
+		}
+
+		authorizeResponder, err := oauthHelper.NewAuthorizeResponse(r.Context(), authorizeRequester, openIDSession)
+		if err != nil {
+			plog.WarningErr("error while generating and saving authcode", err, "upstreamName", ldapUpstream.GetName())
+			oidc.RecordAuditEvent(r, audit.TypeLogin, downstreamIssuer, authorizeRequester, upstream, err)
+			return httperr.Wrap(http.StatusInternalServerError, "error while generating and saving authcode", err)
+		}
+
+		oidc.RecordAuditEvent(r, audit.TypeLogin, downstreamIssuer, authorizeRequester, upstream, nil)
+
+		// The response could be a form_post page instead of a redirect, which needs a different policy than the login form.
+		w.Header().Set("Content-Security-Policy", formposthtml.ContentSecurityPolicy())
+		oauthHelper.WriteAuthorizeResponse(w, authorizeRequester, authorizeResponder)
+
+		return nil
+	})
+	return securityheader.WrapWithCustomCSP(handler, loginhtml.ContentSecurityPolicy())
+}
+
+func validateRequest(r *http.Request, encodedState string, stateDecoder, cookieDecoder oidc.Decoder) (*oidc.UpstreamStateParamData, error) {
+	csrfValue, err := oidc.ReadCSRFCookie(r, cookieDecoder)
+	if err != nil {
+		plog.InfoErr("error reading CSRF cookie", err)
+		return nil, err
+	}
+
+	if encodedState == "" {
+		plog.Info("state param not found")
+		return nil, httperr.New(http.StatusBadRequest, "state param not found")
+	}
+
+	state, err := oidc.ReadStateParam(encodedState, stateDecoder)
+	if err != nil {
+		plog.InfoErr("error reading state", err)
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(state.CSRFToken), []byte(csrfValue)) != 1 {
+		plog.Info("CSRF value does not match")
+		return nil, httperr.New(http.StatusForbidden, "CSRF value does not match")
+	}
+
+	return state, nil
+}
+
+func findUpstreamIDPConfig(
+	upstreamName string,
+	upstreamType string,
+	upstreamIDPs oidc.UpstreamIdentityProvidersLister,
+) (provider.UpstreamLDAPIdentityProviderI, psession.ProviderType) {
+	switch psession.ProviderType(upstreamType) {
+	case psession.ProviderTypeLDAP:
+		return findUpstreamIDPConfigByName(upstreamName, upstreamIDPs.GetLDAPIdentityProviders(), psession.ProviderTypeLDAP)
+	case psession.ProviderTypeActiveDirectory:
+		return findUpstreamIDPConfigByName(upstreamName, upstreamIDPs.GetActiveDirectoryIdentityProviders(), psession.ProviderTypeActiveDirectory)
+	case "":
+		// State params which were created before the upstream type was added to them do not have a type,
+		// so use whichever LDAP or Active Directory upstream has the name.
+		if p, t := findUpstreamIDPConfigByName(upstreamName, upstreamIDPs.GetLDAPIdentityProviders(), psession.ProviderTypeLDAP); p != nil {
+			return p, t
+		}
+		return findUpstreamIDPConfigByName(upstreamName, upstreamIDPs.GetActiveDirectoryIdentityProviders(), psession.ProviderTypeActiveDirectory)
+	default:
+		// Only LDAP and Active Directory upstreams use the login page.
+		return nil, ""
+	}
+}
+
+func findUpstreamIDPConfigByName(
+	upstreamName string,
+	candidates []provider.UpstreamLDAPIdentityProviderI,
+	upstreamType psession.ProviderType,
+) (provider.UpstreamLDAPIdentityProviderI, psession.ProviderType) {
+	for _, p := range candidates {
+		if p.GetName() == upstreamName {
+			return p, upstreamType
+		}
+	}
+	return nil, ""
+}
+
+func renderLoginForm(w http.ResponseWriter, downstreamIssuer string, encodedState string, idpName string, errParam string) error {
+	pageData := &loginhtml.PageData{
+		PostPath:             downstreamIssuer + oidc.PinnipedLoginPath,
+		State:                encodedState,
+		IdentityProviderName: idpName,
+	}
+	switch errParam {
+	case errParamLoginFailed:
+		pageData.ErrorMessage = loginFailedMessage
+	case errParamInternalError:
+		pageData.ErrorMessage = internalErrorMessage
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := loginhtml.Template().Execute(w, pageData); err != nil {
+		plog.Error("error rendering login page", err)
+		return httperr.Wrap(http.StatusInternalServerError, "error rendering page", err)
+	}
+	return nil
+}
+
+// redirectToLoginForm sends the browser back to the login form to show an error message after a failed login.
+func redirectToLoginForm(w http.ResponseWriter, r *http.Request, downstreamIssuer string, encodedState string, errParam string) error {
+	query := url.Values{
+		stateParamName: []string{encodedState},
+		errParamName:   []string{errParam},
+	}
+	http.Redirect(w, r,
+		downstreamIssuer+oidc.PinnipedLoginPath+"?"+query.Encode(),
+		http.StatusSeeOther, // match fosite and https://tools.ietf.org/id/draft-ietf-oauth-security-topics-18.html#section-4.11
+	)
+	return nil
+}
@@ -0,0 +1,782 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package login
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/ory/fosite"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"go.pinniped.dev/internal/authenticators"
+	"go.pinniped.dev/internal/fositestorage/devicecode"
+	"go.pinniped.dev/internal/idtransform"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/device/devicehtml"
+	"go.pinniped.dev/internal/oidc/jwks"
+	"go.pinniped.dev/internal/oidc/login/loginhtml"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/oidc/provider/formposthtml"
+	"go.pinniped.dev/internal/psession"
+	"go.pinniped.dev/internal/testutil"
+	"go.pinniped.dev/internal/testutil/oidctestutil"
+)
+
+const (
+	ldapUpstreamName                   = "some-ldap-idp"
+	ldapUpstreamResourceUID            = "ldap-resource-uid"
+	activeDirectoryUpstreamName        = "some-active-directory-idp"
+	activeDirectoryUpstreamResourceUID = "active-directory-resource-uid"
+	upstreamLDAPURL                    = "ldaps://some-ldap-host:123?base=ou%3Dusers%2Cdc%3Dpinniped%2Cdc%3Ddev"
+
+	happyLDAPUsername                  = "some-ldap-user"
+	happyLDAPUsernameFromAuthenticator = "some-mapped-ldap-username"
+	happyLDAPPassword                  = "some-ldap-password" //nolint:gosec
+	happyLDAPUID                       = "some-ldap-uid"
+	happyLDAPUserDN                    = "cn=foo,dn=bar"
+	happyLDAPExtraRefreshAttribute     = "some-refresh-attribute"
+	happyLDAPExtraRefreshValue         = "some-refresh-attribute-value"
+
+	happyDownstreamState = "8b-state"
+	happyDownstreamCSRF  = "test-csrf"
+
+	downstreamIssuer              = "https://my-downstream-issuer.com/path"
+	downstreamRedirectURI         = "http://127.0.0.1/callback"
+	downstreamClientID            = "pinniped-cli"
+	downstreamNonce               = "some-nonce-value"
+	downstreamPKCEChallenge       = "some-challenge"
+	downstreamPKCEChallengeMethod = "S256"
+
+	htmlContentType = "text/html; charset=utf-8"
+)
+
+var (
+	happyLDAPGroups                = []string{"group1", "group2", "group3"}
+	happyDownstreamScopesRequested = []string{"openid"}
+	happyDownstreamScopesGranted   = []string{"openid"}
+
+	happyDownstreamRequestParamsQuery = url.Values{
+		"response_type":         []string{"code"},
+		"scope":                 []string{strings.Join(happyDownstreamScopesRequested, " ")},
+		"client_id":             []string{downstreamClientID},
+		"state":                 []string{happyDownstreamState},
+		"nonce":                 []string{downstreamNonce},
+		"code_challenge":        []string{downstreamPKCEChallenge},
+		"code_challenge_method": []string{downstreamPKCEChallengeMethod},
+		"redirect_uri":          []string{downstreamRedirectURI},
+	}
+)
+
+func TestLoginEndpoint(t *testing.T) {
+	parsedUpstreamLDAPURL, err := url.Parse(upstreamLDAPURL)
+	require.NoError(t, err)
+
+	ldapAuthenticateFunc := func(ctx context.Context, username, password string) (*authenticators.Response, bool, error) {
+		if username == "" || password == "" {
+			return nil, false, errors.New("should not have passed empty username or password to the authenticator")
+		}
+		if username == happyLDAPUsername && password == happyLDAPPassword {
+			return &authenticators.Response{
+				User: &user.DefaultInfo{
+					Name:   happyLDAPUsernameFromAuthenticator,
+					UID:    happyLDAPUID,
+					Groups: happyLDAPGroups,
+				},
+				DN: happyLDAPUserDN,
+				ExtraRefreshAttributes: map[string]string{
+					happyLDAPExtraRefreshAttribute: happyLDAPExtraRefreshValue,
+				},
+			}, true, nil
+		}
+		return nil, false, nil
+	}
+
+	upstreamLDAPIdentityProvider := oidctestutil.TestUpstreamLDAPIdentityProvider{
+		Name:             ldapUpstreamName,
+		ResourceUID:      ldapUpstreamResourceUID,
+		URL:              parsedUpstreamLDAPURL,
+		AuthenticateFunc: ldapAuthenticateFunc,
+	}
+
+	upstreamActiveDirectoryIdentityProvider := oidctestutil.TestUpstreamLDAPIdentityProvider{
+		Name:             activeDirectoryUpstreamName,
+		ResourceUID:      activeDirectoryUpstreamResourceUID,
+		URL:              parsedUpstreamLDAPURL,
+		AuthenticateFunc: ldapAuthenticateFunc,
+	}
+
+	erroringUpstreamLDAPIdentityProvider := oidctestutil.TestUpstreamLDAPIdentityProvider{
+		Name:        ldapUpstreamName,
+		ResourceUID: ldapUpstreamResourceUID,
+		AuthenticateFunc: func(ctx context.Context, username, password string) (*authenticators.Response, bool, error) {
+			return nil, false, errors.New("some ldap upstream auth error")
+		},
+	}
+
+	var stateEncoderHashKey = []byte("fake-hash-secret")
+	var stateEncoderBlockKey = []byte("0123456789ABCDEF") // block encryption requires 16/24/32 bytes for AES
+	var cookieEncoderHashKey = []byte("fake-hash-secret2")
+	var cookieEncoderBlockKey = []byte("0123456789ABCDE2") // block encryption requires 16/24/32 bytes for AES
+
+	var happyStateCodec = securecookie.New(stateEncoderHashKey, stateEncoderBlockKey)
+	happyStateCodec.SetSerializer(securecookie.JSONEncoder{})
+	var happyCookieCodec = securecookie.New(cookieEncoderHashKey, cookieEncoderBlockKey)
+	happyCookieCodec.SetSerializer(securecookie.JSONEncoder{})
+
+	encodeState := func(upstreamName string, upstreamType string, authParams url.Values) string {
+		encoded, err := happyStateCodec.Encode("s", oidctestutil.ExpectedUpstreamStateParamFormat{
+			P: authParams.Encode(),
+			U: upstreamName,
+			T: upstreamType,
+			N: "test-nonce",
+			C: happyDownstreamCSRF,
+			K: "test-pkce",
+			V: "1",
+		})
+		require.NoError(t, err)
+		return encoded
+	}
+
+	happyLDAPState := encodeState(ldapUpstreamName, "ldap", happyDownstreamRequestParamsQuery)
+	happyActiveDirectoryState := encodeState(activeDirectoryUpstreamName, "activedirectory", happyDownstreamRequestParamsQuery)
+
+	encodedIncomingCookieCSRFValue, err := happyCookieCodec.Encode("csrf", happyDownstreamCSRF)
+	require.NoError(t, err)
+	happyCSRFCookie := "__Host-pinniped-csrf=" + encodedIncomingCookieCSRFValue
+
+	encodedDeviceApproval, err := happyCookieCodec.Encode("device-approval", &oidc.DeviceApproval{UserCode: "BCDF-GHJK", Token: deviceApprovalToken})
+	require.NoError(t, err)
+	happyCSRFAndDeviceApprovalCookies := happyCSRFCookie + "; __Host-pinniped-device-approval=" + encodedDeviceApproval
+
+	wrongCSRFValueCookie, err := happyCookieCodec.Encode("csrf", "wrong-csrf-value")
+	require.NoError(t, err)
+
+	happyLoginBody := func(state string) string {
+		return url.Values{
+			"state":    []string{state},
+			"username": []string{happyLDAPUsername},
+			"password": []string{happyLDAPPassword},
+		}.Encode()
+	}
+
+	loginFormRedirectLocation := func(state string, errParam string) string {
+		return downstreamIssuer + "/login?" + url.Values{"state": []string{state}, "err": []string{errParam}}.Encode()
+	}
+
+	expectedLDAPCustomSessionData := &psession.CustomSessionData{
+		ProviderUID:      ldapUpstreamResourceUID,
+		ProviderName:     ldapUpstreamName,
+		ProviderType:     psession.ProviderTypeLDAP,
+		UpstreamUsername: happyLDAPUsernameFromAuthenticator,
+		UpstreamGroups:   happyLDAPGroups,
+		LDAP: &psession.LDAPSessionData{
+			UserDN:                 happyLDAPUserDN,
+			ExtraRefreshAttributes: map[string]string{happyLDAPExtraRefreshAttribute: happyLDAPExtraRefreshValue},
+		},
+	}
+
+	expectedActiveDirectoryCustomSessionData := &psession.CustomSessionData{
+		ProviderUID:      activeDirectoryUpstreamResourceUID,
+		ProviderName:     activeDirectoryUpstreamName,
+		ProviderType:     psession.ProviderTypeActiveDirectory,
+		UpstreamUsername: happyLDAPUsernameFromAuthenticator,
+		UpstreamGroups:   happyLDAPGroups,
+		ActiveDirectory: &psession.ActiveDirectorySessionData{
+			UserDN:                 happyLDAPUserDN,
+			ExtraRefreshAttributes: map[string]string{happyLDAPExtraRefreshAttribute: happyLDAPExtraRefreshValue},
+		},
+	}
+
+	prefixTransforms := idtransform.NewTransformationPipeline()
+	prefixTransforms.AppendTransformation(idtransform.NewUsernamePrefixTransformation("prefix:"))
+
+	rejectTransforms := idtransform.NewTransformationPipeline()
+	rejectPolicy, err := idtransform.NewRejectPolicy(`^some-mapped-ldap-username$`, "", "this user is not allowed")
+	require.NoError(t, err)
+	rejectTransforms.AppendTransformation(rejectPolicy)
+
+	// Note that fosite puts the granted scopes as a param in the redirect URI even though the spec doesn't seem to require it
+	happyDownstreamRedirectLocationRegexp := downstreamRedirectURI + `\?code=([^&]+)&scope=openid&state=` + happyDownstreamState
+
+	tests := []struct {
+		name string
+
+		idps          *oidctestutil.UpstreamIDPListerBuilder
+		idpTransforms []provider.FederationDomainIdentityProvider
+		method        string
+		path          string
+		body          string
+		csrfCookie    string
+
+		// When set, a pending device code session with this user code is created before the request is made.
+		deviceUserCode string
+
+		wantStatus                    int
+		wantContentType               string
+		wantCSP                       string
+		wantBody                      string
+		wantRedirectLocationString    string
+		wantRedirectLocationRegexp    string
+		wantBodyFormResponseRegexp    string
+		wantDownstreamIDTokenSubject  string
+		wantDownstreamIDTokenUsername string
+		wantDownstreamIDTokenGroups   []string
+		wantDownstreamCustomSession   *psession.CustomSessionData
+		wantDeviceCodeSessionApproved bool
+		wantDeviceCodeSessionUsername string
+	}{
+		{
+			name:            "GET with good state and cookie renders the login form",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method:          http.MethodGet,
+			path:            "/login?" + url.Values{"state": []string{happyLDAPState}}.Encode(),
+			csrfCookie:      happyCSRFCookie,
+			wantStatus:      http.StatusOK,
+			wantContentType: htmlContentType,
+			wantCSP:         loginhtml.ContentSecurityPolicy(),
+			wantBody:        expectedLoginPage(t, happyLDAPState, ldapUpstreamName, ""),
+		},
+		{
+			name:            "GET with good state and cookie for an Active Directory upstream renders the login form",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(&upstreamActiveDirectoryIdentityProvider),
+			method:          http.MethodGet,
+			path:            "/login?" + url.Values{"state": []string{happyActiveDirectoryState}}.Encode(),
+			csrfCookie:      happyCSRFCookie,
+			wantStatus:      http.StatusOK,
+			wantContentType: htmlContentType,
+			wantCSP:         loginhtml.ContentSecurityPolicy(),
+			wantBody:        expectedLoginPage(t, happyActiveDirectoryState, activeDirectoryUpstreamName, ""),
+		},
+		{
+			name:            "GET after a failed login renders the login form with an error message",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method:          http.MethodGet,
+			path:            "/login?" + url.Values{"state": []string{happyLDAPState}, "err": []string{"login_error"}}.Encode(),
+			csrfCookie:      happyCSRFCookie,
+			wantStatus:      http.StatusOK,
+			wantContentType: htmlContentType,
+			wantCSP:         loginhtml.ContentSecurityPolicy(),
+			wantBody:        expectedLoginPage(t, happyLDAPState, ldapUpstreamName, "Incorrect username or password."),
+		},
+		{
+			name:            "GET after an internal error renders the login form with an error message",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method:          http.MethodGet,
+			path:            "/login?" + url.Values{"state": []string{happyLDAPState}, "err": []string{"internal_error"}}.Encode(),
+			csrfCookie:      happyCSRFCookie,
+			wantStatus:      http.StatusOK,
+			wantContentType: htmlContentType,
+			wantCSP:         loginhtml.ContentSecurityPolicy(),
+			wantBody:        expectedLoginPage(t, happyLDAPState, ldapUpstreamName, "An internal error occurred. Please contact your administrator for help."),
+		},
+		{
+			name:            "GET with an unrecognized err param renders the login form without an error message",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method:          http.MethodGet,
+			path:            "/login?" + url.Values{"state": []string{happyLDAPState}, "err": []string{"<script>"}}.Encode(),
+			csrfCookie:      happyCSRFCookie,
+			wantStatus:      http.StatusOK,
+			wantContentType: htmlContentType,
+			wantCSP:         loginhtml.ContentSecurityPolicy(),
+			wantBody:        expectedLoginPage(t, happyLDAPState, ldapUpstreamName, ""),
+		},
+		{
+			name:            "PUT is not allowed",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method:          http.MethodPut,
+			path:            "/login?" + url.Values{"state": []string{happyLDAPState}}.Encode(),
+			csrfCookie:      happyCSRFCookie,
+			wantStatus:      http.StatusMethodNotAllowed,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBody:        "Method Not Allowed: PUT (try GET or POST)\n",
+		},
+		{
+			name:            "GET without a CSRF cookie is an error",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method:          http.MethodGet,
+			path:            "/login?" + url.Values{"state": []string{happyLDAPState}}.Encode(),
+			wantStatus:      http.StatusForbidden,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBody:        "Forbidden: CSRF cookie is missing\n",
+		},
+		{
+			name:            "GET with an undecodable CSRF cookie is an error",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method:          http.MethodGet,
+			path:            "/login?" + url.Values{"state": []string{happyLDAPState}}.Encode(),
+			csrfCookie:      "__Host-pinniped-csrf=this-value-was-not-signed-by-pinniped",
+			wantStatus:      http.StatusForbidden,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBody:        "Forbidden: error reading CSRF cookie\n",
+		},
+		{
+			name:            "GET with a CSRF cookie which does not match the state is an error",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method:          http.MethodGet,
+			path:            "/login?" + url.Values{"state": []string{happyLDAPState}}.Encode(),
+			csrfCookie:      "__Host-pinniped-csrf=" + wrongCSRFValueCookie,
+			wantStatus:      http.StatusForbidden,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBody:        "Forbidden: CSRF value does not match\n",
+		},
+		{
+			name:            "GET without a state param is an error",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method:          http.MethodGet,
+			path:            "/login",
+			csrfCookie:      happyCSRFCookie,
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBody:        "Bad Request: state param not found\n",
+		},
+		{
+			name:            "GET with an undecodable state param is an error",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method:          http.MethodGet,
+			path:            "/login?state=this-value-was-not-signed-by-pinniped",
+			csrfCookie:      happyCSRFCookie,
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBody:        "Bad Request: error reading state\n",
+		},
+		{
+			name:            "GET with a state param for an OIDC upstream is an error",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method:          http.MethodGet,
+			path:            "/login?" + url.Values{"state": []string{encodeState(ldapUpstreamName, "oidc", happyDownstreamRequestParamsQuery)}}.Encode(),
+			csrfCookie:      happyCSRFCookie,
+			wantStatus:      http.StatusUnprocessableEntity,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBody:        "Unprocessable Entity: upstream provider not found\n",
+		},
+		{
+			name:            "GET with a state param for an upstream which no longer exists is an error",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(&upstreamActiveDirectoryIdentityProvider),
+			method:          http.MethodGet,
+			path:            "/login?" + url.Values{"state": []string{happyLDAPState}}.Encode(),
+			csrfCookie:      happyCSRFCookie,
+			wantStatus:      http.StatusUnprocessableEntity,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBody:        "Unprocessable Entity: upstream provider not found\n",
+		},
+		{
+			name:                          "POST with good credentials returns 303 to downstream client callback with its state and code",
+			idps:                          oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method:                        http.MethodPost,
+			path:                          "/login",
+			body:                          happyLoginBody(happyLDAPState),
+			csrfCookie:                    happyCSRFCookie,
+			wantStatus:                    http.StatusSeeOther,
+			wantCSP:                       formposthtml.ContentSecurityPolicy(),
+			wantRedirectLocationRegexp:    happyDownstreamRedirectLocationRegexp,
+			wantDownstreamIDTokenSubject:  upstreamLDAPURL + "&sub=" + happyLDAPUID,
+			wantDownstreamIDTokenUsername: happyLDAPUsernameFromAuthenticator,
+			wantDownstreamIDTokenGroups:   happyLDAPGroups,
+			wantDownstreamCustomSession:   expectedLDAPCustomSessionData,
+		},
+		{
+			name:                          "POST with good credentials for an Active Directory upstream returns 303 to downstream client callback with its state and code",
+			idps:                          oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(&upstreamActiveDirectoryIdentityProvider),
+			method:                        http.MethodPost,
+			path:                          "/login",
+			body:                          happyLoginBody(happyActiveDirectoryState),
+			csrfCookie:                    happyCSRFCookie,
+			wantStatus:                    http.StatusSeeOther,
+			wantCSP:                       formposthtml.ContentSecurityPolicy(),
+			wantRedirectLocationRegexp:    happyDownstreamRedirectLocationRegexp,
+			wantDownstreamIDTokenSubject:  upstreamLDAPURL + "&sub=" + happyLDAPUID,
+			wantDownstreamIDTokenUsername: happyLDAPUsernameFromAuthenticator,
+			wantDownstreamIDTokenGroups:   happyLDAPGroups,
+			wantDownstreamCustomSession:   expectedActiveDirectoryCustomSessionData,
+		},
+		{
+			name:                          "POST with a state param which has no upstream type finds the upstream by name",
+			idps:                          oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider).WithActiveDirectory(&upstreamActiveDirectoryIdentityProvider),
+			method:                        http.MethodPost,
+			path:                          "/login",
+			body:                          happyLoginBody(encodeState(activeDirectoryUpstreamName, "", happyDownstreamRequestParamsQuery)),
+			csrfCookie:                    happyCSRFCookie,
+			wantStatus:                    http.StatusSeeOther,
+			wantCSP:                       formposthtml.ContentSecurityPolicy(),
+			wantRedirectLocationRegexp:    happyDownstreamRedirectLocationRegexp,
+			wantDownstreamIDTokenSubject:  upstreamLDAPURL + "&sub=" + happyLDAPUID,
+			wantDownstreamIDTokenUsername: happyLDAPUsernameFromAuthenticator,
+			wantDownstreamIDTokenGroups:   happyLDAPGroups,
+			wantDownstreamCustomSession:   expectedActiveDirectoryCustomSessionData,
+		},
+		{
+			name:   "POST with good credentials and response_mode=form_post returns 200 with HTML+JS form",
+			idps:   oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method: http.MethodPost,
+			path:   "/login",
+			body: happyLoginBody(encodeState(ldapUpstreamName, "ldap", shallowCopyAndModifyQuery(
+				happyDownstreamRequestParamsQuery, map[string]string{"response_mode": "form_post"},
+			))),
+			csrfCookie:                    happyCSRFCookie,
+			wantStatus:                    http.StatusOK,
+			wantContentType:               "text/html;charset=UTF-8",
+			wantCSP:                       formposthtml.ContentSecurityPolicy(),
+			wantBodyFormResponseRegexp:    `<code id="manual-auth-code">(.+)</code>`,
+			wantDownstreamIDTokenSubject:  upstreamLDAPURL + "&sub=" + happyLDAPUID,
+			wantDownstreamIDTokenUsername: happyLDAPUsernameFromAuthenticator,
+			wantDownstreamIDTokenGroups:   happyLDAPGroups,
+			wantDownstreamCustomSession:   expectedLDAPCustomSessionData,
+		},
+		{
+			name: "POST with good credentials applies identity transforms",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			idpTransforms: []provider.FederationDomainIdentityProvider{
+				{Name: ldapUpstreamName, Type: psession.ProviderTypeLDAP, Transforms: prefixTransforms},
+			},
+			method:                        http.MethodPost,
+			path:                          "/login",
+			body:                          happyLoginBody(happyLDAPState),
+			csrfCookie:                    happyCSRFCookie,
+			wantStatus:                    http.StatusSeeOther,
+			wantCSP:                       formposthtml.ContentSecurityPolicy(),
+			wantRedirectLocationRegexp:    happyDownstreamRedirectLocationRegexp,
+			wantDownstreamIDTokenSubject:  upstreamLDAPURL + "&sub=" + happyLDAPUID,
+			wantDownstreamIDTokenUsername: "prefix:" + happyLDAPUsernameFromAuthenticator,
+			wantDownstreamIDTokenGroups:   happyLDAPGroups,
+			wantDownstreamCustomSession:   expectedLDAPCustomSessionData,
+		},
+		{
+			name: "POST with good credentials when an identity policy rejects the user returns 303 to downstream client callback with an error",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			idpTransforms: []provider.FederationDomainIdentityProvider{
+				{Name: ldapUpstreamName, Type: psession.ProviderTypeLDAP, Transforms: rejectTransforms},
+			},
+			method:     http.MethodPost,
+			path:       "/login",
+			body:       happyLoginBody(happyLDAPState),
+			csrfCookie: happyCSRFCookie,
+			wantStatus: http.StatusSeeOther,
+			wantCSP:    loginhtml.ContentSecurityPolicy(),
+			wantRedirectLocationString: downstreamRedirectURI + "?" + url.Values{
+				"error":             []string{"access_denied"},
+				"error_description": []string{"The resource owner or authorization server denied the request. Reason: configured identity policy rejected this authentication: this user is not allowed."},
+				"state":             []string{happyDownstreamState},
+			}.Encode(),
+		},
+		{
+			name:   "POST with a wrong password redirects back to the login form with an error",
+			idps:   oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method: http.MethodPost,
+			path:   "/login",
+			body: url.Values{
+				"state":    []string{happyLDAPState},
+				"username": []string{happyLDAPUsername},
+				"password": []string{"wrong-password"},
+			}.Encode(),
+			csrfCookie:                 happyCSRFCookie,
+			wantStatus:                 http.StatusSeeOther,
+			wantCSP:                    loginhtml.ContentSecurityPolicy(),
+			wantRedirectLocationString: loginFormRedirectLocation(happyLDAPState, "login_error"),
+		},
+		{
+			name:   "POST with a blank username redirects back to the login form with an error",
+			idps:   oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method: http.MethodPost,
+			path:   "/login",
+			body: url.Values{
+				"state":    []string{happyLDAPState},
+				"password": []string{happyLDAPPassword},
+			}.Encode(),
+			csrfCookie:                 happyCSRFCookie,
+			wantStatus:                 http.StatusSeeOther,
+			wantCSP:                    loginhtml.ContentSecurityPolicy(),
+			wantRedirectLocationString: loginFormRedirectLocation(happyLDAPState, "login_error"),
+		},
+		{
+			name:   "POST with a blank password redirects back to the login form with an error",
+			idps:   oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method: http.MethodPost,
+			path:   "/login",
+			body: url.Values{
+				"state":    []string{happyLDAPState},
+				"username": []string{happyLDAPUsername},
+			}.Encode(),
+			csrfCookie:                 happyCSRFCookie,
+			wantStatus:                 http.StatusSeeOther,
+			wantCSP:                    loginhtml.ContentSecurityPolicy(),
+			wantRedirectLocationString: loginFormRedirectLocation(happyLDAPState, "login_error"),
+		},
+		{
+			name:                       "POST when the upstream returns an error redirects back to the login form with an error",
+			idps:                       oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&erroringUpstreamLDAPIdentityProvider),
+			method:                     http.MethodPost,
+			path:                       "/login",
+			body:                       happyLoginBody(happyLDAPState),
+			csrfCookie:                 happyCSRFCookie,
+			wantStatus:                 http.StatusSeeOther,
+			wantCSP:                    loginhtml.ContentSecurityPolicy(),
+			wantRedirectLocationString: loginFormRedirectLocation(happyLDAPState, "internal_error"),
+		},
+		{
+			name:   "POST for a login started by the device verification page approves the device code session",
+			idps:   oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method: http.MethodPost,
+			path:   "/login",
+			body: happyLoginBody(encodeState(ldapUpstreamName, "ldap", shallowCopyAndModifyQuery(
+				happyDownstreamRequestParamsQuery, map[string]string{"pinniped_device_user_code": "BCDF-GHJK"},
+			))),
+			csrfCookie:                    happyCSRFAndDeviceApprovalCookies,
+			deviceUserCode:                "BCDF-GHJK",
+			wantStatus:                    http.StatusOK,
+			wantContentType:               htmlContentType,
+			wantBody:                      happyDeviceLoggedInPage(t),
+			wantDeviceCodeSessionApproved: true,
+			wantDeviceCodeSessionUsername: happyLDAPUsernameFromAuthenticator,
+		},
+		{
+			name:   "POST for a login started by the device verification page with a user code which is not found",
+			idps:   oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method: http.MethodPost,
+			path:   "/login",
+			body: happyLoginBody(encodeState(ldapUpstreamName, "ldap", shallowCopyAndModifyQuery(
+				happyDownstreamRequestParamsQuery, map[string]string{"pinniped_device_user_code": "ZZZZ-ZZZZ"},
+			))),
+			csrfCookie:      happyCSRFAndDeviceApprovalCookies,
+			deviceUserCode:  "BCDF-GHJK",
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBody:        "Bad Request: user code not found\n",
+		},
+		{
+			name:   "POST for an authorize request with a user code which was not confirmed on the device verification page does not approve the device code session",
+			idps:   oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method: http.MethodPost,
+			path:   "/login",
+			body: happyLoginBody(encodeState(ldapUpstreamName, "ldap", shallowCopyAndModifyQuery(
+				happyDownstreamRequestParamsQuery, map[string]string{"pinniped_device_user_code": "BCDF-GHJK"},
+			))),
+			csrfCookie:      happyCSRFCookie,
+			deviceUserCode:  "BCDF-GHJK",
+			wantStatus:      http.StatusForbidden,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBody:        "Forbidden: device approval cookie is missing\n",
+		},
+		{
+			name:            "POST without a CSRF cookie is an error",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method:          http.MethodPost,
+			path:            "/login",
+			body:            happyLoginBody(happyLDAPState),
+			wantStatus:      http.StatusForbidden,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBody:        "Forbidden: CSRF cookie is missing\n",
+		},
+		{
+			name:            "POST with state param in the query instead of the body is still validated",
+			idps:            oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method:          http.MethodPost,
+			path:            "/login?" + url.Values{"state": []string{"this-value-was-not-signed-by-pinniped"}}.Encode(),
+			body:            url.Values{"username": []string{happyLDAPUsername}, "password": []string{happyLDAPPassword}}.Encode(),
+			csrfCookie:      happyCSRFCookie,
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBody:        "Bad Request: error reading state\n",
+		},
+		{
+			name:   "POST with state param which has invalid downstream auth params is an error",
+			idps:   oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&upstreamLDAPIdentityProvider),
+			method: http.MethodPost,
+			path:   "/login",
+			body: happyLoginBody(encodeState(ldapUpstreamName, "ldap", shallowCopyAndModifyQuery(
+				happyDownstreamRequestParamsQuery, map[string]string{"client_id": "bogus"},
+			))),
+			csrfCookie:      happyCSRFCookie,
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBody:        "Bad Request: error using state downstream auth params\n",
+		},
+	}
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			secrets := client.CoreV1().Secrets("some-namespace")
+
+			// Configure fosite the same way that the production code would.
+			timeoutsConfiguration := oidc.DefaultOIDCTimeoutsConfiguration()
+			oauthStore := oidc.NewKubeStorage(secrets, oidctestutil.NewClientManager(t, "some-namespace", nil, nil), timeoutsConfiguration)
+			hmacSecretFunc := func() []byte { return []byte("some secret - must have at least 32 bytes") }
+			jwksProviderIsUnused := jwks.NewDynamicJWKSProvider()
+			oauthHelper := oidc.FositeOauth2Helper(oauthStore, downstreamIssuer, hmacSecretFunc, jwksProviderIsUnused, timeoutsConfiguration)
+
+			subject := NewHandler(downstreamIssuer, test.idps.Build(), oidctestutil.NewIdentityTransformsGetter(t, test.idpTransforms), oauthHelper, happyStateCodec, happyCookieCodec, oauthStore)
+
+			if test.deviceUserCode != "" {
+				createPendingDeviceCodeSession(t, oauthStore, test.deviceUserCode)
+			}
+
+			req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+			if test.body != "" {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			if test.csrfCookie != "" {
+				req.Header.Set("Cookie", test.csrfCookie)
+			}
+			rsp := httptest.NewRecorder()
+			subject.ServeHTTP(rsp, req)
+			t.Logf("response: %#v", rsp)
+			t.Logf("response body: %q", rsp.Body.String())
+
+			testutil.RequireSecurityHeaders(t, rsp)
+			if test.wantCSP != "" {
+				require.Equal(t, test.wantCSP, rsp.Header().Get("Content-Security-Policy"))
+			}
+
+			require.Equal(t, test.wantStatus, rsp.Code)
+			testutil.RequireEqualContentType(t, rsp.Header().Get("Content-Type"), test.wantContentType)
+
+			switch {
+			case test.wantBodyFormResponseRegexp != "":
+				oidctestutil.RequireAuthCodeRegexpMatch(
+					t,
+					rsp.Body.String(),
+					test.wantBodyFormResponseRegexp,
+					client,
+					secrets,
+					oauthStore,
+					happyDownstreamScopesGranted,
+					test.wantDownstreamIDTokenSubject,
+					test.wantDownstreamIDTokenUsername,
+					test.wantDownstreamIDTokenGroups,
+					happyDownstreamScopesRequested,
+					downstreamPKCEChallenge,
+					downstreamPKCEChallengeMethod,
+					downstreamNonce,
+					downstreamClientID,
+					downstreamRedirectURI,
+					test.wantDownstreamCustomSession,
+				)
+			case test.wantRedirectLocationRegexp != "":
+				require.Len(t, rsp.Header().Values("Location"), 1)
+				oidctestutil.RequireAuthCodeRegexpMatch(
+					t,
+					rsp.Header().Get("Location"),
+					test.wantRedirectLocationRegexp,
+					client,
+					secrets,
+					oauthStore,
+					happyDownstreamScopesGranted,
+					test.wantDownstreamIDTokenSubject,
+					test.wantDownstreamIDTokenUsername,
+					test.wantDownstreamIDTokenGroups,
+					happyDownstreamScopesRequested,
+					downstreamPKCEChallenge,
+					downstreamPKCEChallengeMethod,
+					downstreamNonce,
+					downstreamClientID,
+					downstreamRedirectURI,
+					test.wantDownstreamCustomSession,
+				)
+			case test.wantRedirectLocationString != "":
+				require.Equal(t, test.wantRedirectLocationString, rsp.Header().Get("Location"))
+				require.Empty(t, client.Actions())
+			case test.deviceUserCode != "":
+				require.Equal(t, test.wantBody, rsp.Body.String())
+				require.Empty(t, rsp.Header().Values("Location"))
+			default:
+				require.Equal(t, test.wantBody, rsp.Body.String())
+				require.Empty(t, rsp.Header().Values("Location"))
+				require.Empty(t, client.Actions())
+			}
+
+			if test.deviceUserCode != "" {
+				deviceCodeSession, _, err := oauthStore.GetDeviceCodeSession(context.Background(), deviceCodeSessionSignature)
+				require.NoError(t, err)
+				if test.wantDeviceCodeSessionApproved {
+					require.Equal(t, devicecode.StatusApproved, deviceCodeSession.Status)
+					require.Equal(t, happyDownstreamScopesGranted, []string(deviceCodeSession.Request.GetGrantedScopes()))
+					pinnipedSession, ok := deviceCodeSession.Request.GetSession().(*psession.PinnipedSession)
+					require.True(t, ok)
+					require.Equal(t, test.wantDeviceCodeSessionUsername, pinnipedSession.Fosite.Claims.Extra["username"])
+					wantCustomSessionData := *expectedLDAPCustomSessionData
+					wantCustomSessionData.LoginTime = pinnipedSession.Fosite.Claims.AuthTime
+					require.Equal(t, &wantCustomSessionData, pinnipedSession.Custom)
+				} else {
+					require.Equal(t, devicecode.StatusPending, deviceCodeSession.Status)
+				}
+			}
+		})
+	}
+}
+
+func expectedLoginPage(t *testing.T, state string, idpName string, errorMessage string) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	require.NoError(t, loginhtml.Template().Execute(&buf, &loginhtml.PageData{
+		PostPath:             downstreamIssuer + "/login",
+		State:                state,
+		IdentityProviderName: idpName,
+		ErrorMessage:         errorMessage,
+	}))
+	return buf.String()
+}
+
+const (
+	deviceCodeSessionSignature = "device-code-signature"
+	deviceApprovalToken        = "some-approval-token"
+)
+
+func createPendingDeviceCodeSession(t *testing.T, storage *oidc.KubeStorage, userCode string) {
+	t.Helper()
+
+	ctx := context.Background()
+	client, err := storage.GetClient(ctx, downstreamClientID)
+	require.NoError(t, err)
+
+	request := fosite.NewRequest()
+	request.ID = "device-request-id"
+	request.Client = client
+	request.RequestedScope = happyDownstreamScopesRequested
+	request.Session = psession.NewPinnipedSession()
+
+	require.NoError(t, storage.CreateDeviceCodeSession(ctx, &devicecode.Session{
+		Request:       request,
+		Signature:     deviceCodeSessionSignature,
+		UserCode:      userCode,
+		Status:        devicecode.StatusPending,
+		ExpiresAt:     time.Now().Add(time.Minute),
+		ApprovalToken: deviceApprovalToken,
+	}))
+}
+
+func happyDeviceLoggedInPage(t *testing.T) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	require.NoError(t, devicehtml.Template().Execute(&buf, &devicehtml.PageData{LoggedIn: true}))
+	return buf.String()
+}
+
+func shallowCopyAndModifyQuery(query url.Values, modifications map[string]string) url.Values {
+	copied := url.Values{}
+	for key, value := range query {
+		copied[key] = value
+	}
+	for key, value := range modifications {
+		if value == "" {
+			copied.Del(key)
+		} else {
+			copied[key] = []string{value}
+		}
+	}
+	return copied
+}
@@ -0,0 +1,130 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package loginhtml
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/here"
+)
+
+var (
+	testExpectedCSS = `body{font-family:metropolis-light,Helvetica,sans-serif}` +
+		`h1{font-size:20px}` +
+		`.box{position:absolute;top:100px;left:50%;width:400px;margin-left:-200px;font-size:14px;line-height:24px}` +
+		`.error{color:#c21d00}` +
+		`label{display:block;margin-top:10px}` +
+		`input[type=text],input[type=password]{display:block;width:100%;box-sizing:border-box;margin:5px 0;padding:10px;font-size:14px}` +
+		`button{margin-top:10px;padding:10px 20px;border:1px solid #ddd;background-color:#fff;color:#1b3951;font-size:14px;cursor:pointer}` +
+		`button:hover{background-color:#eee}`
+
+	// It's okay if this changes in the future, but this gives us a chance to eyeball the formatting.
+	// Our browser-based integration tests should find any incompatibilities.
+	testExpectedCSP = `default-src 'none'; ` +
+		`style-src 'sha256-BDNJQjGQmFIsfoP6iDAwSa0aabGKoS7mkjHMXA01HN4='; ` +
+		`img-src data:; ` +
+		`frame-ancestors 'none'`
+)
+
+func TestTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		pageData *PageData
+		wantBody string
+	}{
+		{
+			name: "login form",
+			pageData: &PageData{
+				PostPath:             "https://example.com/issuer/login",
+				State:                "some-encoded-state",
+				IdentityProviderName: "my-ldap",
+			},
+			wantBody: here.Docf(`
+				<!DOCTYPE html>
+				<html lang="en">
+				<head>
+				    <meta charset="UTF-8">
+				    <title>Log In</title>
+				    <style>%s</style>
+				    <link id="favicon" rel="icon" href="data:image/svg+xml,<svg xmlns=%%22http://www.w3.org/2000/svg%%22 viewBox=%%220 0 100 100%%22><text y=%%22.9em%%22 font-size=%%2290%%22>🔑</text></svg>"/>
+				</head>
+				<body>
+				<div class="box">
+				    <h1>Log in to my-ldap</h1>
+				    <form method="post" action="https://example.com/issuer/login">
+				        <input type="hidden" name="state" value="some-encoded-state">
+				        <label for="username">Username</label>
+				        <input type="text" id="username" name="username" autocomplete="username" autofocus required>
+				        <label for="password">Password</label>
+				        <input type="password" id="password" name="password" autocomplete="current-password" required>
+				        <button type="submit">Log in</button>
+				    </form>
+				</div>
+				</body>
+				</html>
+			`, testExpectedCSS),
+		},
+		{
+			name: "login form with an error message",
+			pageData: &PageData{
+				PostPath:             "https://example.com/issuer/login",
+				State:                "some-encoded-state",
+				IdentityProviderName: "my-ldap",
+				ErrorMessage:         "Incorrect username or password.",
+			},
+			wantBody: here.Docf(`
+				<!DOCTYPE html>
+				<html lang="en">
+				<head>
+				    <meta charset="UTF-8">
+				    <title>Log In</title>
+				    <style>%s</style>
+				    <link id="favicon" rel="icon" href="data:image/svg+xml,<svg xmlns=%%22http://www.w3.org/2000/svg%%22 viewBox=%%220 0 100 100%%22><text y=%%22.9em%%22 font-size=%%2290%%22>🔑</text></svg>"/>
+				</head>
+				<body>
+				<div class="box">
+				    <h1>Log in to my-ldap</h1>
+				    <p class="error">Incorrect username or password.</p>
+				    <form method="post" action="https://example.com/issuer/login">
+				        <input type="hidden" name="state" value="some-encoded-state">
+				        <label for="username">Username</label>
+				        <input type="text" id="username" name="username" autocomplete="username" autofocus required>
+				        <label for="password">Password</label>
+				        <input type="password" id="password" name="password" autocomplete="current-password" required>
+				        <button type="submit">Log in</button>
+				    </form>
+				</div>
+				</body>
+				</html>
+			`, testExpectedCSS),
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, Template().Execute(&buf, tt.pageData))
+
+			// t.Logf("actual value:\n%s", buf.String()) // useful when updating minify library causes new output
+			require.Equal(t, tt.wantBody, buf.String())
+		})
+	}
+}
+
+func TestContentSecurityPolicyHashes(t *testing.T) {
+	require.Equal(t, testExpectedCSP, ContentSecurityPolicy())
+}
+
+func TestHelpers(t *testing.T) {
+	// These are silly tests but it's easy to we might as well have them.
+	require.Equal(t, "test", mustMinify("test", nil))
+	require.PanicsWithError(t, "some error", func() { mustMinify("", fmt.Errorf("some error")) })
+
+	// Example test vector from https://content-security-policy.com/hash/.
+	require.Equal(t, "sha256-RFWPLDbv2BY+rCkDzsE+0fr8ylGr2R2faWMhq4lfEQc=", cspHash("doSomething();"))
+}
@@ -0,0 +1,261 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package logout provides a handler for the OIDC RP-Initiated Logout end session endpoint.
+package logout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ory/fosite"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"go.pinniped.dev/internal/httputil/httperr"
+	"go.pinniped.dev/internal/httputil/securityheader"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/jwks"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/oidc/revocation"
+	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/psession"
+)
+
+// SessionStore finds and deletes the storage of downstream sessions.
+type SessionStore interface {
+	GetSessionRequestByRequestID(ctx context.Context, requestID string) (fosite.Requester, error)
+	RevokeSession(ctx context.Context, requestID string) error
+}
+
+// idTokenHintClaims are the claims of the id_token_hint which are needed to find the downstream session.
+type idTokenHintClaims struct {
+	jwt.Claims
+	SessionID string `json:"sid"`
+}
+
+// NewHandler returns an http.Handler which implements the end session endpoint of OpenID Connect RP-Initiated Logout
+// (https://openid.net/specs/openid-connect-rpinitiated-1_0.html). The client identifies the downstream session to
+// end using an ID token which was issued for that session. All storage for the downstream session is deleted, and
+// the upstream OIDC tokens which were held by the session are revoked. Then the user agent is redirected to the
+// upstream provider's own end session endpoint when the upstream provider is configured to allow that, or else
+// back to the client's post_logout_redirect_uri. The upstream provider sends the user agent back to the
+// Supervisor's post logout endpoint, which then redirects it to the client's post_logout_redirect_uri.
+func NewHandler(
+	issuerURL string,
+	jwksProvider jwks.DynamicJWKSProvider,
+	clientManager fosite.ClientManager,
+	sessionStore SessionStore,
+	idpLister oidc.UpstreamIdentityProvidersLister,
+	stateEncoder oidc.Encoder,
+	maxExpiredIDTokenHintAge time.Duration,
+) http.Handler {
+	handler := httperr.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			return httperr.Newf(http.StatusMethodNotAllowed, "%s (try GET or POST)", r.Method)
+		}
+		if err := r.ParseForm(); err != nil {
+			return httperr.Wrap(http.StatusBadRequest, "invalid form", err)
+		}
+		params := r.Form
+
+		idTokenHint := params.Get("id_token_hint")
+		if idTokenHint == "" {
+			return httperr.New(http.StatusBadRequest, "missing id_token_hint param")
+		}
+		claims, err := validateIDTokenHint(issuerURL, jwksProvider, idTokenHint, maxExpiredIDTokenHintAge)
+		if err != nil {
+			plog.Info("logout request has invalid id_token_hint", "err", err)
+			return httperr.New(http.StatusBadRequest, "invalid id_token_hint param")
+		}
+
+		// The ID token was issued to exactly one client.
+		if len(claims.Audience) != 1 {
+			return httperr.New(http.StatusBadRequest, "invalid id_token_hint param")
+		}
+		clientID := claims.Audience[0]
+		if requestedClientID := params.Get("client_id"); requestedClientID != "" && requestedClientID != clientID {
+			return httperr.New(http.StatusBadRequest, "client_id param does not match the id_token_hint")
+		}
+		client, err := clientManager.GetClient(r.Context(), clientID)
+		if err != nil {
+			return httperr.New(http.StatusBadRequest, "unknown client")
+		}
+
+		var postLogoutRedirectURL *url.URL
+		if rawPostLogoutRedirectURI := params.Get("post_logout_redirect_uri"); rawPostLogoutRedirectURI != "" {
+			// Clients must use one of their registered redirect URIs.
+			postLogoutRedirectURL, err = fosite.MatchRedirectURIWithClientRedirectURIs(rawPostLogoutRedirectURI, client)
+			if err != nil {
+				return httperr.New(http.StatusBadRequest, "post_logout_redirect_uri param is not registered for the client")
+			}
+		}
+
+		customSessionData, err := endSession(r.Context(), sessionStore, clientID, claims.SessionID)
+		if err != nil {
+			plog.Error("error ending downstream session", err, "clientID", clientID)
+			return httperr.New(http.StatusInternalServerError, "error ending session")
+		}
+
+		// The downstream session was already deleted, so a failure to revoke the upstream tokens is not reported
+		// to the client. The upstream tokens may still expire or be revoked by the upstream provider later.
+		var upstreamProvider provider.UpstreamOIDCIdentityProviderI
+		var upstreamIDToken string
+		if customSessionData != nil {
+			if err := revocation.RevokeUpstreamOIDCTokens(r.Context(), idpLister, customSessionData); err != nil {
+				plog.WarningErr("failed to revoke upstream token during logout", err,
+					"providerName", customSessionData.ProviderName, "providerUID", customSessionData.ProviderUID)
+			}
+			upstreamProvider = findUpstreamOIDCIdentityProvider(idpLister, customSessionData)
+			if customSessionData.OIDC != nil {
+				upstreamIDToken = customSessionData.OIDC.UpstreamIDToken
+			}
+		}
+
+		state := params.Get("state")
+		switch {
+		case upstreamProvider != nil && upstreamProvider.GetEndSessionURL() != nil:
+			redirectURL, err := upstreamEndSessionRedirect(issuerURL, upstreamProvider, upstreamIDToken, stateEncoder, clientID, postLogoutRedirectURL, state)
+			if err != nil {
+				plog.Error("error encoding post logout state param", err, "clientID", clientID)
+				return httperr.New(http.StatusInternalServerError, "error encoding state")
+			}
+			http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+		case postLogoutRedirectURL != nil:
+			http.Redirect(w, r, withParams(postLogoutRedirectURL, url.Values{"state": {state}}), http.StatusSeeOther)
+		default:
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			_, _ = fmt.Fprintln(w, "You have been logged out.")
+		}
+		return nil
+	})
+	return securityheader.Wrap(handler)
+}
+
+// validateIDTokenHint checks that the ID token was signed by one of the issuer's keys and was issued by the issuer.
+// The ID token is allowed to be expired, because logging out should still work after the client's ID token expired,
+// but not for longer than maxExpiredAge, after which its session cannot be refreshed anymore.
+func validateIDTokenHint(issuerURL string, jwksProvider jwks.DynamicJWKSProvider, idTokenHint string, maxExpiredAge time.Duration) (*idTokenHintClaims, error) {
+	token, err := jwt.ParseSigned(idTokenHint)
+	if err != nil {
+		return nil, err
+	}
+
+	keySet, _ := jwksProvider.GetJWKS(issuerURL)
+	if keySet == nil {
+		return nil, fmt.Errorf("no JWKS found for issuer %q", issuerURL)
+	}
+
+	// ID tokens issued by older versions of the Supervisor do not have a key ID, so try each key of the issuer.
+	for _, key := range keySet.Keys {
+		var claims idTokenHintClaims
+		if err := token.Claims(key.Public().Key, &claims); err != nil {
+			continue
+		}
+		now := time.Now()
+		err := claims.Validate(jwt.Expected{Issuer: issuerURL, Time: now})
+		if errors.Is(err, jwt.ErrExpired) && now.Sub(claims.Expiry.Time()) <= maxExpiredAge {
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &claims, nil
+	}
+	return nil, errors.New("ID token was not signed by any of the issuer's keys")
+}
+
+// endSession deletes all storage for the downstream session, and returns the custom session data which the session
+// held before it was deleted. It is not an error when the session no longer exists, e.g. because the user already
+// logged out, in which case it returns nil.
+func endSession(ctx context.Context, sessionStore SessionStore, clientID string, sessionID string) (*psession.CustomSessionData, error) {
+	if sessionID == "" {
+		return nil, nil
+	}
+
+	requester, err := sessionStore.GetSessionRequestByRequestID(ctx, sessionID)
+	if errors.Is(err, fosite.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if requester.GetClient().GetID() != clientID {
+		return nil, errors.New("downstream session belongs to a different client")
+	}
+
+	if err := sessionStore.RevokeSession(ctx, sessionID); err != nil {
+		return nil, err
+	}
+
+	session, ok := requester.GetSession().(*psession.PinnipedSession)
+	if !ok || session.Custom == nil {
+		return nil, nil
+	}
+	return session.Custom, nil
+}
+
+func findUpstreamOIDCIdentityProvider(
+	idpLister oidc.UpstreamIdentityProvidersLister,
+	customSessionData *psession.CustomSessionData,
+) provider.UpstreamOIDCIdentityProviderI {
+	if customSessionData.ProviderType != psession.ProviderTypeOIDC {
+		return nil
+	}
+	for _, p := range idpLister.GetOIDCIdentityProviders() {
+		if p.GetName() == customSessionData.ProviderName && p.GetResourceUID() == customSessionData.ProviderUID {
+			return p
+		}
+	}
+	return nil
+}
+
+// upstreamEndSessionRedirect returns the URL of the upstream provider's end session endpoint. The upstream ID token
+// of the session is sent as the id_token_hint, when one was stored. When the client asked to be redirected after
+// logout, then the upstream provider is asked to redirect to the Supervisor's post logout endpoint instead, so that
+// only the Supervisor's own URL needs to be registered with the upstream provider. The client's already validated
+// post_logout_redirect_uri and state are encoded into the state param, which the upstream provider passes back.
+func upstreamEndSessionRedirect(
+	issuerURL string,
+	upstreamProvider provider.UpstreamOIDCIdentityProviderI,
+	upstreamIDToken string,
+	stateEncoder oidc.Encoder,
+	clientID string,
+	postLogoutRedirectURL *url.URL,
+	state string,
+) (string, error) {
+	params := url.Values{
+		"client_id":     {upstreamProvider.GetClientID()},
+		"id_token_hint": {upstreamIDToken},
+	}
+	if postLogoutRedirectURL != nil {
+		encodedState, err := stateEncoder.Encode(oidc.PostLogoutStateParamEncodingName, &oidc.PostLogoutStateParamData{
+			ClientID:              clientID,
+			PostLogoutRedirectURI: postLogoutRedirectURL.String(),
+			State:                 state,
+			FormatVersion:         oidc.PostLogoutStateParamFormatVersion,
+		})
+		if err != nil {
+			return "", err
+		}
+		params.Set("post_logout_redirect_uri", issuerURL+oidc.PostLogoutEndpointPath)
+		params.Set("state", encodedState)
+	}
+	return withParams(upstreamProvider.GetEndSessionURL(), params), nil
+}
+
+// withParams returns the URL with the non-empty params added to its existing query params.
+func withParams(u *url.URL, params url.Values) string {
+	result := *u
+	query := result.Query()
+	for k, v := range params {
+		if len(v) > 0 && v[0] != "" {
+			query[k] = v
+		}
+	}
+	result.RawQuery = query.Encode()
+	return result.String()
+}
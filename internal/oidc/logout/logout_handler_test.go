@@ -0,0 +1,437 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package logout
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/handler/openid"
+	fositejwt "github.com/ory/fosite/token/jwt"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+
+	configv1alpha1 "go.pinniped.dev/generated/latest/apis/supervisor/config/v1alpha1"
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/fositestorage/accesstoken"
+	"go.pinniped.dev/internal/fositestorage/openidconnect"
+	"go.pinniped.dev/internal/fositestorage/refreshtoken"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/clientregistry"
+	"go.pinniped.dev/internal/oidc/jwks"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/oidc/signer"
+	"go.pinniped.dev/internal/psession"
+	"go.pinniped.dev/internal/testutil"
+	"go.pinniped.dev/internal/testutil/oidctestutil"
+)
+
+const (
+	namespace = "some-namespace"
+	issuer    = "https://some-issuer.com"
+	requestID = "some-request-id"
+
+	upstreamOIDCName     = "some-oidc-idp"
+	upstreamOIDCUID      = types.UID("some-oidc-idp-uid")
+	upstreamClientID     = "some-upstream-client-id"
+	upstreamRefreshToken = "some-upstream-refresh-token"
+	upstreamIDToken      = "some-upstream-id-token"
+
+	confidentialClientID = "client.oauth.pinniped.dev-test"
+	// confidentialClientSecretHash is a bcrypt hash of "some-client-secret" with cost 12.
+	confidentialClientSecretHash = "$2a$12$yHGWWZy/UWGN7V0ETyyP/etrfr1n0GOdWpwJt3HxUqBlar/3Z3.D6"
+)
+
+func TestLogoutHandler(t *testing.T) {
+	const maxExpiredIDTokenHintAge = 9 * time.Hour
+
+	signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	activeSigner, err := signer.NewJWKSigner(&jose.JSONWebKey{Key: signingKey})
+	require.NoError(t, err)
+	otherSigningKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	stateCodec := securecookie.New([]byte("some-state-encoder-hash-key"), []byte("0123456789ABCDEF"))
+
+	upstreamEndSessionURL, err := url.Parse("https://upstream.example.com/logout?foo=bar")
+	require.NoError(t, err)
+
+	validClaims := func() idTokenHintClaims {
+		return idTokenHintClaims{
+			Claims: jwt.Claims{
+				Issuer:   issuer,
+				Subject:  "some-subject",
+				Audience: jwt.Audience{"pinniped-cli"},
+				Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			},
+			SessionID: requestID,
+		}
+	}
+
+	tests := []struct {
+		name string
+
+		storedForClientID     string
+		storedUpstreamIDToken string
+		upstreamEndSessionURL *url.URL
+		revokeTokenErr        error
+
+		method      string
+		claims      func(c *idTokenHintClaims)
+		signingKey  *ecdsa.PrivateKey
+		noIDToken   bool
+		extraParams url.Values
+
+		wantStatus             int
+		wantBody               string
+		wantLocation           string
+		wantPostLogoutState    *oidc.PostLogoutStateParamData
+		wantSessionRevoked     bool
+		wantUpstreamRevokeArgs *oidctestutil.RevokeTokenArgs
+	}{
+		{
+			name:                   "GET request without a redirect URI ends the session and shows a logged out page",
+			wantStatus:             http.StatusOK,
+			wantBody:               "You have been logged out.\n",
+			wantSessionRevoked:     true,
+			wantUpstreamRevokeArgs: &oidctestutil.RevokeTokenArgs{Token: upstreamRefreshToken, TokenType: provider.RefreshTokenType},
+		},
+		{
+			name:                   "POST request without a redirect URI ends the session and shows a logged out page",
+			method:                 http.MethodPost,
+			extraParams:            url.Values{"client_id": {"pinniped-cli"}},
+			wantStatus:             http.StatusOK,
+			wantBody:               "You have been logged out.\n",
+			wantSessionRevoked:     true,
+			wantUpstreamRevokeArgs: &oidctestutil.RevokeTokenArgs{Token: upstreamRefreshToken, TokenType: provider.RefreshTokenType},
+		},
+		{
+			name:                   "expired ID token is still accepted",
+			claims:                 func(c *idTokenHintClaims) { c.Expiry = jwt.NewNumericDate(time.Now().Add(-time.Hour)) },
+			wantStatus:             http.StatusOK,
+			wantBody:               "You have been logged out.\n",
+			wantSessionRevoked:     true,
+			wantUpstreamRevokeArgs: &oidctestutil.RevokeTokenArgs{Token: upstreamRefreshToken, TokenType: provider.RefreshTokenType},
+		},
+		{
+			name: "ID token which expired longer ago than the refresh token lifespan",
+			claims: func(c *idTokenHintClaims) {
+				c.Expiry = jwt.NewNumericDate(time.Now().Add(-maxExpiredIDTokenHintAge - time.Minute))
+			},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "Bad Request: invalid id_token_hint param\n",
+		},
+		{
+			name:                   "redirects to a registered loopback post logout redirect URI",
+			extraParams:            url.Values{"post_logout_redirect_uri": {"http://127.0.0.1:1234/callback"}, "state": {"some-state"}},
+			wantStatus:             http.StatusSeeOther,
+			wantLocation:           "http://127.0.0.1:1234/callback?state=some-state",
+			wantSessionRevoked:     true,
+			wantUpstreamRevokeArgs: &oidctestutil.RevokeTokenArgs{Token: upstreamRefreshToken, TokenType: provider.RefreshTokenType},
+		},
+		{
+			name:                   "redirects a confidential client to its post logout redirect URI",
+			storedForClientID:      confidentialClientID,
+			claims:                 func(c *idTokenHintClaims) { c.Audience = jwt.Audience{confidentialClientID} },
+			extraParams:            url.Values{"post_logout_redirect_uri": {"https://app.example.com/callback"}},
+			wantStatus:             http.StatusSeeOther,
+			wantLocation:           "https://app.example.com/callback",
+			wantSessionRevoked:     true,
+			wantUpstreamRevokeArgs: &oidctestutil.RevokeTokenArgs{Token: upstreamRefreshToken, TokenType: provider.RefreshTokenType},
+		},
+		{
+			name:                   "redirects to the end session endpoint of the upstream provider with the stored upstream ID token",
+			storedUpstreamIDToken:  upstreamIDToken,
+			upstreamEndSessionURL:  upstreamEndSessionURL,
+			wantStatus:             http.StatusSeeOther,
+			wantLocation:           "https://upstream.example.com/logout?client_id=some-upstream-client-id&foo=bar&id_token_hint=some-upstream-id-token",
+			wantSessionRevoked:     true,
+			wantUpstreamRevokeArgs: &oidctestutil.RevokeTokenArgs{Token: upstreamRefreshToken, TokenType: provider.RefreshTokenType},
+		},
+		{
+			name:                  "asks the upstream provider to redirect to the post logout endpoint with the post logout redirect URI and state in its state param",
+			storedUpstreamIDToken: upstreamIDToken,
+			upstreamEndSessionURL: upstreamEndSessionURL,
+			extraParams:           url.Values{"post_logout_redirect_uri": {"http://127.0.0.1:1234/callback"}, "state": {"some-state"}},
+			wantStatus:            http.StatusSeeOther,
+			wantLocation:          "https://upstream.example.com/logout?client_id=some-upstream-client-id&foo=bar&id_token_hint=some-upstream-id-token&post_logout_redirect_uri=https%3A%2F%2Fsome-issuer.com%2Foauth2%2Flogout%2Fcallback",
+			wantPostLogoutState: &oidc.PostLogoutStateParamData{
+				ClientID:              "pinniped-cli",
+				PostLogoutRedirectURI: "http://127.0.0.1:1234/callback",
+				State:                 "some-state",
+				FormatVersion:         "1",
+			},
+			wantSessionRevoked:     true,
+			wantUpstreamRevokeArgs: &oidctestutil.RevokeTokenArgs{Token: upstreamRefreshToken, TokenType: provider.RefreshTokenType},
+		},
+		{
+			name:                   "redirects to the end session endpoint of the upstream provider when no upstream ID token was stored",
+			upstreamEndSessionURL:  upstreamEndSessionURL,
+			wantStatus:             http.StatusSeeOther,
+			wantLocation:           "https://upstream.example.com/logout?client_id=some-upstream-client-id&foo=bar",
+			wantSessionRevoked:     true,
+			wantUpstreamRevokeArgs: &oidctestutil.RevokeTokenArgs{Token: upstreamRefreshToken, TokenType: provider.RefreshTokenType},
+		},
+		{
+			name:                   "upstream revocation fails after the downstream session was ended",
+			revokeTokenErr:         errors.New("some upstream revocation error"),
+			wantStatus:             http.StatusOK,
+			wantBody:               "You have been logged out.\n",
+			wantSessionRevoked:     true,
+			wantUpstreamRevokeArgs: &oidctestutil.RevokeTokenArgs{Token: upstreamRefreshToken, TokenType: provider.RefreshTokenType},
+		},
+		{
+			name:       "session was already ended",
+			claims:     func(c *idTokenHintClaims) { c.SessionID = "some-other-request-id" },
+			wantStatus: http.StatusOK,
+			wantBody:   "You have been logged out.\n",
+		},
+		{
+			name:       "ID token without a session ID",
+			claims:     func(c *idTokenHintClaims) { c.SessionID = "" },
+			wantStatus: http.StatusOK,
+			wantBody:   "You have been logged out.\n",
+		},
+		{
+			name:              "session belongs to a different client",
+			storedForClientID: confidentialClientID,
+			wantStatus:        http.StatusInternalServerError,
+			wantBody:          "Internal Server Error: error ending session\n",
+		},
+		{
+			name:       "missing id_token_hint",
+			noIDToken:  true,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "Bad Request: missing id_token_hint param\n",
+		},
+		{
+			name:       "ID token signed by a different key",
+			signingKey: otherSigningKey,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "Bad Request: invalid id_token_hint param\n",
+		},
+		{
+			name:       "ID token from a different issuer",
+			claims:     func(c *idTokenHintClaims) { c.Issuer = "https://some-other-issuer.com" },
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "Bad Request: invalid id_token_hint param\n",
+		},
+		{
+			name:       "ID token with several audiences",
+			claims:     func(c *idTokenHintClaims) { c.Audience = jwt.Audience{"pinniped-cli", confidentialClientID} },
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "Bad Request: invalid id_token_hint param\n",
+		},
+		{
+			name:       "ID token for an unknown client",
+			claims:     func(c *idTokenHintClaims) { c.Audience = jwt.Audience{"some-unknown-client"} },
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "Bad Request: unknown client\n",
+		},
+		{
+			name:        "client_id param does not match the ID token",
+			extraParams: url.Values{"client_id": {confidentialClientID}},
+			wantStatus:  http.StatusBadRequest,
+			wantBody:    "Bad Request: client_id param does not match the id_token_hint\n",
+		},
+		{
+			name:        "post logout redirect URI is not registered for the client",
+			extraParams: url.Values{"post_logout_redirect_uri": {"https://app.example.com/callback"}},
+			wantStatus:  http.StatusBadRequest,
+			wantBody:    "Bad Request: post_logout_redirect_uri param is not registered for the client\n",
+		},
+		{
+			name:       "wrong HTTP method",
+			method:     http.MethodPut,
+			wantStatus: http.StatusMethodNotAllowed,
+			wantBody:   "Method Not Allowed: PUT (try GET or POST)\n",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			oidcUpstreamBuilder := oidctestutil.NewTestUpstreamOIDCIdentityProviderBuilder().
+				WithName(upstreamOIDCName).
+				WithResourceUID(upstreamOIDCUID).
+				WithClientID(upstreamClientID).
+				WithEndSessionURL(test.upstreamEndSessionURL)
+			if test.revokeTokenErr != nil {
+				oidcUpstreamBuilder = oidcUpstreamBuilder.WithRevokeTokenError(test.revokeTokenErr)
+			}
+			idps := oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(oidcUpstreamBuilder.Build())
+
+			jwksProvider := jwks.NewDynamicJWKSProvider()
+			jwksProvider.SetIssuerToJWKSMap(
+				map[string]*jose.JSONWebKeySet{issuer: {Keys: []jose.JSONWebKey{{Key: &signingKey.PublicKey}}}},
+				map[string]signer.Signer{issuer: activeSigner},
+			)
+
+			secrets := fake.NewSimpleClientset().CoreV1().Secrets(namespace)
+			clientManager := newClientManager(t)
+			oauthStore := oidc.NewKubeStorage(secrets, clientManager, oidc.DefaultOIDCTimeoutsConfiguration())
+
+			storedForClientID := test.storedForClientID
+			if storedForClientID == "" {
+				storedForClientID = "pinniped-cli"
+			}
+			createStoredSession(ctx, t, oauthStore, storedForClientID, test.storedUpstreamIDToken)
+
+			params := url.Values{}
+			if !test.noIDToken {
+				claims := validClaims()
+				if test.claims != nil {
+					test.claims(&claims)
+				}
+				key := test.signingKey
+				if key == nil {
+					key = signingKey
+				}
+				params.Set("id_token_hint", signIDToken(t, key, claims))
+			}
+			for k, v := range test.extraParams {
+				params[k] = v
+			}
+
+			var req *http.Request
+			switch test.method {
+			case "", http.MethodGet:
+				req = httptest.NewRequest(http.MethodGet, "/oauth2/logout?"+params.Encode(), nil)
+			default:
+				req = httptest.NewRequest(test.method, "/oauth2/logout", strings.NewReader(params.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			rsp := httptest.NewRecorder()
+
+			NewHandler(issuer, jwksProvider, clientManager, oauthStore, idps.Build(), stateCodec, maxExpiredIDTokenHintAge).ServeHTTP(rsp, req)
+
+			require.Equal(t, test.wantStatus, rsp.Code, "unexpected response body: %s", rsp.Body.String())
+			if test.wantBody != "" {
+				require.Equal(t, test.wantBody, rsp.Body.String())
+			}
+			location := rsp.Header().Get("Location")
+			if test.wantPostLogoutState != nil {
+				// The encoded state param is different every time, so decode it and compare the rest of the URL.
+				var encodedState string
+				location, encodedState = removeQueryParam(t, location, "state")
+				state, err := oidc.ReadPostLogoutStateParam(encodedState, stateCodec)
+				require.NoError(t, err)
+				require.Equal(t, test.wantPostLogoutState, state)
+			}
+			require.Equal(t, test.wantLocation, location)
+
+			wantNumberOfSessions := 1
+			if test.wantSessionRevoked {
+				wantNumberOfSessions = 0
+			}
+			testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: accesstoken.TypeLabelValue}, wantNumberOfSessions)
+			testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: refreshtoken.TypeLabelValue}, wantNumberOfSessions)
+			testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: openidconnect.TypeLabelValue}, wantNumberOfSessions)
+
+			if test.wantUpstreamRevokeArgs != nil {
+				test.wantUpstreamRevokeArgs.Ctx = req.Context()
+				idps.RequireExactlyOneCallToRevokeToken(t, upstreamOIDCName, test.wantUpstreamRevokeArgs)
+			} else {
+				idps.RequireExactlyZeroCallsToRevokeToken(t)
+			}
+		})
+	}
+}
+
+func newClientManager(t *testing.T) *clientregistry.ClientManager {
+	t.Helper()
+
+	return oidctestutil.NewClientManager(t, namespace,
+		[]*configv1alpha1.OIDCClient{{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: confidentialClientID},
+			Spec: configv1alpha1.OIDCClientSpec{
+				AllowedRedirectURIs: []configv1alpha1.RedirectURI{"https://app.example.com/callback"},
+				AllowedGrantTypes:   []configv1alpha1.GrantType{"authorization_code", "refresh_token"},
+				AllowedScopes:       []configv1alpha1.Scope{"openid", "offline_access"},
+				ClientSecret:        configv1alpha1.OIDCClientSecret{SecretName: "some-secret"},
+			},
+		}},
+		[]*corev1.Secret{{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "some-secret"},
+			Type:       "secrets.pinniped.dev/oidc-client-secret",
+			Data:       map[string][]byte{"clientSecretHash": []byte(confidentialClientSecretHash)},
+		}},
+	)
+}
+
+// removeQueryParam returns the URL without the query param, and the value of that query param.
+func removeQueryParam(t *testing.T, rawURL string, name string) (string, string) {
+	t.Helper()
+
+	u, err := url.Parse(rawURL)
+	require.NoError(t, err)
+	query := u.Query()
+	value := query.Get(name)
+	query.Del(name)
+	u.RawQuery = query.Encode()
+	return u.String(), value
+}
+
+func signIDToken(t *testing.T, key *ecdsa.PrivateKey, claims idTokenHintClaims) string {
+	t.Helper()
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, nil)
+	require.NoError(t, err)
+	idToken, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	require.NoError(t, err)
+	return idToken
+}
+
+// createStoredSession stores a downstream OIDC session, access token session and refresh token session in the same
+// way as the token endpoint, for a session which was started using an upstream OIDC provider.
+func createStoredSession(ctx context.Context, t *testing.T, oauthStore *oidc.KubeStorage, clientID string, upstreamIDToken string) {
+	t.Helper()
+
+	client, err := oauthStore.GetClient(ctx, clientID)
+	require.NoError(t, err)
+
+	request := &fosite.Request{
+		ID:          requestID,
+		Client:      client,
+		RequestedAt: time.Now().UTC(),
+		Session: &psession.PinnipedSession{
+			Fosite: &openid.DefaultSession{
+				Claims:  &fositejwt.IDTokenClaims{Subject: "some-subject"},
+				Headers: &fositejwt.Headers{},
+			},
+			Custom: &psession.CustomSessionData{
+				ProviderUID:  upstreamOIDCUID,
+				ProviderName: upstreamOIDCName,
+				ProviderType: psession.ProviderTypeOIDC,
+				OIDC:         &psession.OIDCSessionData{UpstreamRefreshToken: upstreamRefreshToken, UpstreamIDToken: upstreamIDToken},
+			},
+		},
+		RequestedScope: fosite.Arguments{"openid", "offline_access"},
+		GrantedScope:   fosite.Arguments{"openid", "offline_access"},
+		Form:           url.Values{},
+	}
+
+	require.NoError(t, oauthStore.CreateOpenIDConnectSession(ctx, "some-authcode.some-authcode-signature", request))
+	require.NoError(t, oauthStore.CreateAccessTokenSession(ctx, "some-access-token-signature", request))
+	require.NoError(t, oauthStore.CreateRefreshTokenSession(ctx, "some-refresh-token-signature", request))
+}
@@ -0,0 +1,51 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package logout
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/ory/fosite"
+
+	"go.pinniped.dev/internal/httputil/httperr"
+	"go.pinniped.dev/internal/httputil/securityheader"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/plog"
+)
+
+// NewPostLogoutHandler returns an http.Handler for the post logout endpoint, to which an upstream OIDC provider
+// redirects the user agent after its own end session endpoint has logged out the user. The state param, which was
+// created by the handler of NewHandler, holds the client's post_logout_redirect_uri and state. The user agent is
+// redirected to that post_logout_redirect_uri, after checking again that it is still registered for the client.
+func NewPostLogoutHandler(clientManager fosite.ClientManager, stateDecoder oidc.Decoder) http.Handler {
+	handler := httperr.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if r.Method != http.MethodGet {
+			return httperr.Newf(http.StatusMethodNotAllowed, "%s (try GET)", r.Method)
+		}
+
+		encodedState := r.URL.Query().Get("state")
+		if encodedState == "" {
+			return httperr.New(http.StatusBadRequest, "missing state param")
+		}
+		state, err := oidc.ReadPostLogoutStateParam(encodedState, stateDecoder)
+		if err != nil {
+			plog.Info("post logout request has invalid state param", "err", err)
+			return err
+		}
+
+		client, err := clientManager.GetClient(r.Context(), state.ClientID)
+		if err != nil {
+			return httperr.New(http.StatusBadRequest, "unknown client")
+		}
+		postLogoutRedirectURL, err := fosite.MatchRedirectURIWithClientRedirectURIs(state.PostLogoutRedirectURI, client)
+		if err != nil {
+			return httperr.New(http.StatusBadRequest, "post_logout_redirect_uri is not registered for the client")
+		}
+
+		http.Redirect(w, r, withParams(postLogoutRedirectURL, url.Values{"state": {state.State}}), http.StatusSeeOther)
+		return nil
+	})
+	return securityheader.Wrap(handler)
+}
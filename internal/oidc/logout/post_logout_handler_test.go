@@ -0,0 +1,241 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package logout
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/jwks"
+	"go.pinniped.dev/internal/oidc/signer"
+	"go.pinniped.dev/internal/testutil/oidctestutil"
+)
+
+func TestPostLogoutHandler(t *testing.T) {
+	stateCodec := securecookie.New([]byte("some-state-encoder-hash-key"), []byte("0123456789ABCDEF"))
+	otherStateCodec := securecookie.New([]byte("some-other-state-encoder-hash-key"), []byte("0123456789ABCDEF"))
+
+	encodeState := func(codec securecookie.Codec, name string, state *oidc.PostLogoutStateParamData) string {
+		encoded, err := codec.Encode(name, state)
+		require.NoError(t, err)
+		return encoded
+	}
+	happyState := func() *oidc.PostLogoutStateParamData {
+		return &oidc.PostLogoutStateParamData{
+			ClientID:              confidentialClientID,
+			PostLogoutRedirectURI: "https://app.example.com/callback",
+			State:                 "some-state",
+			FormatVersion:         "1",
+		}
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		state  string
+
+		wantStatus   int
+		wantBody     string
+		wantLocation string
+	}{
+		{
+			name:         "redirects to the post logout redirect URI with the state",
+			state:        encodeState(stateCodec, oidc.PostLogoutStateParamEncodingName, happyState()),
+			wantStatus:   http.StatusSeeOther,
+			wantLocation: "https://app.example.com/callback?state=some-state",
+		},
+		{
+			name: "redirects to the post logout redirect URI without a state",
+			state: encodeState(stateCodec, oidc.PostLogoutStateParamEncodingName, func() *oidc.PostLogoutStateParamData {
+				s := happyState()
+				s.State = ""
+				return s
+			}()),
+			wantStatus:   http.StatusSeeOther,
+			wantLocation: "https://app.example.com/callback",
+		},
+		{
+			name: "redirects a public client to a loopback post logout redirect URI on any port",
+			state: encodeState(stateCodec, oidc.PostLogoutStateParamEncodingName, func() *oidc.PostLogoutStateParamData {
+				s := happyState()
+				s.ClientID = "pinniped-cli"
+				s.PostLogoutRedirectURI = "http://127.0.0.1:1234/callback"
+				return s
+			}()),
+			wantStatus:   http.StatusSeeOther,
+			wantLocation: "http://127.0.0.1:1234/callback?state=some-state",
+		},
+		{
+			name:       "missing state param",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "Bad Request: missing state param\n",
+		},
+		{
+			name:       "state param was not encoded by the Supervisor",
+			state:      "some-state",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "Bad Request: error reading state\n",
+		},
+		{
+			name:       "state param was encoded with a different key",
+			state:      encodeState(otherStateCodec, oidc.PostLogoutStateParamEncodingName, happyState()),
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "Bad Request: error reading state\n",
+		},
+		{
+			name:       "upstream state param from the authorization endpoint cannot be used",
+			state:      encodeState(stateCodec, oidc.UpstreamStateParamEncodingName, happyState()),
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "Bad Request: error reading state\n",
+		},
+		{
+			name: "state param has the wrong format version",
+			state: encodeState(stateCodec, oidc.PostLogoutStateParamEncodingName, func() *oidc.PostLogoutStateParamData {
+				s := happyState()
+				s.FormatVersion = "2"
+				return s
+			}()),
+			wantStatus: http.StatusUnprocessableEntity,
+			wantBody:   "Unprocessable Entity: state format version is invalid\n",
+		},
+		{
+			name: "client no longer exists",
+			state: encodeState(stateCodec, oidc.PostLogoutStateParamEncodingName, func() *oidc.PostLogoutStateParamData {
+				s := happyState()
+				s.ClientID = "client.oauth.pinniped.dev-deleted"
+				return s
+			}()),
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "Bad Request: unknown client\n",
+		},
+		{
+			name: "post logout redirect URI is no longer registered for the client",
+			state: encodeState(stateCodec, oidc.PostLogoutStateParamEncodingName, func() *oidc.PostLogoutStateParamData {
+				s := happyState()
+				s.PostLogoutRedirectURI = "https://app.example.com/other-callback"
+				return s
+			}()),
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "Bad Request: post_logout_redirect_uri is not registered for the client\n",
+		},
+		{
+			name:       "wrong HTTP method",
+			method:     http.MethodPost,
+			state:      encodeState(stateCodec, oidc.PostLogoutStateParamEncodingName, happyState()),
+			wantStatus: http.StatusMethodNotAllowed,
+			wantBody:   "Method Not Allowed: POST (try GET)\n",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			method := test.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			target := "/oauth2/logout/callback"
+			if test.state != "" {
+				target += "?" + url.Values{"state": {test.state}}.Encode()
+			}
+			req := httptest.NewRequest(method, target, nil)
+			rsp := httptest.NewRecorder()
+
+			NewPostLogoutHandler(newClientManager(t), stateCodec).ServeHTTP(rsp, req)
+
+			require.Equal(t, test.wantStatus, rsp.Code, "unexpected response body: %s", rsp.Body.String())
+			if test.wantBody != "" {
+				require.Equal(t, test.wantBody, rsp.Body.String())
+			}
+			require.Equal(t, test.wantLocation, rsp.Header().Get("Location"))
+		})
+	}
+}
+
+func TestLogoutThroughUpstreamEndSessionEndpointRoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	activeSigner, err := signer.NewJWKSigner(&jose.JSONWebKey{Key: signingKey})
+	require.NoError(t, err)
+	jwksProvider := jwks.NewDynamicJWKSProvider()
+	jwksProvider.SetIssuerToJWKSMap(
+		map[string]*jose.JSONWebKeySet{issuer: {Keys: []jose.JSONWebKey{{Key: &signingKey.PublicKey}}}},
+		map[string]signer.Signer{issuer: activeSigner},
+	)
+
+	upstreamEndSessionURL, err := url.Parse("https://upstream.example.com/logout")
+	require.NoError(t, err)
+	idps := oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+		oidctestutil.NewTestUpstreamOIDCIdentityProviderBuilder().
+			WithName(upstreamOIDCName).
+			WithResourceUID(upstreamOIDCUID).
+			WithClientID(upstreamClientID).
+			WithEndSessionURL(upstreamEndSessionURL).
+			Build(),
+	).Build()
+
+	stateCodec := securecookie.New([]byte("some-state-encoder-hash-key"), []byte("0123456789ABCDEF"))
+	clientManager := newClientManager(t)
+	oauthStore := oidc.NewKubeStorage(fake.NewSimpleClientset().CoreV1().Secrets(namespace), clientManager, oidc.DefaultOIDCTimeoutsConfiguration())
+	createStoredSession(ctx, t, oauthStore, confidentialClientID, upstreamIDToken)
+
+	// The client starts the logout at the Supervisor's end session endpoint.
+	idTokenHint := signIDToken(t, signingKey, idTokenHintClaims{
+		Claims: jwt.Claims{
+			Issuer:   issuer,
+			Subject:  "some-subject",
+			Audience: jwt.Audience{confidentialClientID},
+			Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+		SessionID: requestID,
+	})
+	logoutParams := url.Values{
+		"id_token_hint":            {idTokenHint},
+		"post_logout_redirect_uri": {"https://app.example.com/callback"},
+		"state":                    {"some-client-state"},
+	}
+	rsp := httptest.NewRecorder()
+	NewHandler(issuer, jwksProvider, clientManager, oauthStore, idps, stateCodec, time.Hour).
+		ServeHTTP(rsp, httptest.NewRequest(http.MethodGet, "/oauth2/logout?"+logoutParams.Encode(), nil))
+	require.Equal(t, http.StatusSeeOther, rsp.Code, "unexpected response body: %s", rsp.Body.String())
+
+	// The Supervisor redirects the browser to the upstream provider, which is asked to redirect back to the
+	// Supervisor's post logout endpoint, and not to the client.
+	upstreamLogoutURL, err := url.Parse(rsp.Header().Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, "https://upstream.example.com/logout", upstreamLogoutURL.Scheme+"://"+upstreamLogoutURL.Host+upstreamLogoutURL.Path)
+	upstreamLogoutParams := upstreamLogoutURL.Query()
+	require.Equal(t, upstreamIDToken, upstreamLogoutParams.Get("id_token_hint"))
+	require.Equal(t, "https://some-issuer.com/oauth2/logout/callback", upstreamLogoutParams.Get("post_logout_redirect_uri"))
+	require.NotEmpty(t, upstreamLogoutParams.Get("state"))
+	require.NotEqual(t, "some-client-state", upstreamLogoutParams.Get("state"))
+
+	// After logging out the user, the upstream provider redirects the browser to the post logout endpoint with the
+	// state param which it was given.
+	postLogoutURL, err := url.Parse(upstreamLogoutParams.Get("post_logout_redirect_uri"))
+	require.NoError(t, err)
+	postLogoutURL.RawQuery = url.Values{"state": {upstreamLogoutParams.Get("state")}}.Encode()
+	rsp = httptest.NewRecorder()
+	NewPostLogoutHandler(clientManager, stateCodec).
+		ServeHTTP(rsp, httptest.NewRequest(http.MethodGet, postLogoutURL.RequestURI(), nil))
+
+	// Then the Supervisor redirects the browser to the client, with the client's own state.
+	require.Equal(t, http.StatusSeeOther, rsp.Code, "unexpected response body: %s", rsp.Body.String())
+	require.Equal(t, "https://app.example.com/callback?state=some-client-state", rsp.Header().Get("Location"))
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/ory/fosite"
 
 	"go.pinniped.dev/internal/constable"
+	"go.pinniped.dev/internal/fositestorage/devicecode"
 	"go.pinniped.dev/internal/fositestoragei"
 	"go.pinniped.dev/internal/oidc/clientregistry"
 )
@@ -16,10 +17,11 @@ import (
 const errNullStorageNotImplemented = constable.Error("NullStorage does not implement this method. It should not have been called.")
 
 type NullStorage struct {
-	clientregistry.StaticClientManager
+	*clientregistry.ClientManager
 }
 
 var _ fositestoragei.AllFositeStorage = &NullStorage{}
+var _ devicecode.Storage = &NullStorage{}
 
 func (NullStorage) RevokeRefreshToken(_ context.Context, _ string) error {
 	return errNullStorageNotImplemented
@@ -92,3 +94,23 @@ func (NullStorage) GetAuthorizeCodeSession(_ context.Context, _ string, _ fosite
 func (NullStorage) InvalidateAuthorizeCodeSession(_ context.Context, _ string) (err error) {
 	return errNullStorageNotImplemented
 }
+
+func (NullStorage) CreateDeviceCodeSession(_ context.Context, _ *devicecode.Session) error {
+	return errNullStorageNotImplemented
+}
+
+func (NullStorage) GetDeviceCodeSession(_ context.Context, _ string) (*devicecode.Session, string, error) {
+	return nil, "", errNullStorageNotImplemented
+}
+
+func (NullStorage) GetDeviceCodeSessionByUserCode(_ context.Context, _ string) (*devicecode.Session, string, error) {
+	return nil, "", errNullStorageNotImplemented
+}
+
+func (NullStorage) UpdateDeviceCodeSession(_ context.Context, _ *devicecode.Session, _ string) error {
+	return errNullStorageNotImplemented
+}
+
+func (NullStorage) DeleteDeviceCodeSession(_ context.Context, _ string) error {
+	return errNullStorageNotImplemented
+}
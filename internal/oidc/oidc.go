@@ -1,20 +1,25 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 // Package oidc contains common OIDC functionality needed by Pinniped.
 package oidc
 
 import (
+	"net/http"
 	"time"
 
 	coreosoidc "github.com/coreos/go-oidc/v3/oidc"
 	"github.com/ory/fosite"
 	"github.com/ory/fosite/compose"
+	"github.com/ory/fosite/token/jwt"
 
+	"go.pinniped.dev/internal/httputil/httperr"
+	"go.pinniped.dev/internal/idtransform"
 	"go.pinniped.dev/internal/oidc/csrftoken"
 	"go.pinniped.dev/internal/oidc/jwks"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/oidc/provider/formposthtml"
+	"go.pinniped.dev/internal/psession"
 	"go.pinniped.dev/pkg/oidcclient/nonce"
 	"go.pinniped.dev/pkg/oidcclient/pkce"
 )
@@ -22,10 +27,20 @@ import (
 const (
 	WellKnownEndpointPath     = "/.well-known/openid-configuration"
 	AuthorizationEndpointPath = "/oauth2/authorize"
-	TokenEndpointPath         = "/oauth2/token" //nolint:gosec // ignore lint warning that this is a credential
+	TokenEndpointPath         = "/oauth2/token"  //nolint:gosec // ignore lint warning that this is a credential
+	RevocationEndpointPath    = "/oauth2/revoke" //nolint:gosec // ignore lint warning that this is a credential
 	CallbackEndpointPath      = "/callback"
 	JWKSEndpointPath          = "/jwks.json"
 	PinnipedIDPsPathV1Alpha1  = "/v1alpha1/pinniped_identity_providers"
+	ChooseIDPEndpointPath     = "/choose_identity_provider"
+	EndSessionEndpointPath    = "/oauth2/logout"
+	PostLogoutEndpointPath    = "/oauth2/logout/callback"
+	UserInfoEndpointPath      = "/oauth2/userinfo"
+	IntrospectionEndpointPath = "/oauth2/introspect"
+	PinnipedLoginPath         = "/login"
+
+	DeviceAuthorizationEndpointPath = "/oauth2/device_authorization"
+	DeviceVerificationEndpointPath  = "/oauth2/device"
 )
 
 const (
@@ -38,6 +53,14 @@ const (
 	// because it will be encoded into the upstream state param value and we're trying to keep that small.
 	UpstreamStateParamEncodingName = "s"
 
+	// Just in case we need to make a breaking change to the format of the post logout state param, we are including
+	// a format version number, in the same way as for the upstream state param.
+	PostLogoutStateParamFormatVersion = "1"
+
+	// The `name` passed to the encoder for encoding the post logout state param value. It differs from the name of
+	// the upstream state param, so that neither state param can be used in place of the other.
+	PostLogoutStateParamEncodingName = "l"
+
 	// CSRFCookieName is the name of the browser cookie which shall hold our CSRF value.
 	// The `__Host` prefix has a special meaning. See:
 	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Cookies#Cookie_prefixes.
@@ -62,10 +85,34 @@ const (
 	// information.
 	DownstreamGroupsClaim = "groups"
 
+	// DownstreamSessionIDClaim is the sid claim from https://openid.net/specs/openid-connect-frontchannel-1_0.html
+	// which identifies the user's downstream session in the downstream ID token. Its value is the ID of the original
+	// authorization request, which is also the ID of all storage related to the session. It allows the session to be
+	// found again given an ID token, e.g. by the end_session_endpoint.
+	DownstreamSessionIDClaim = "sid"
+
 	// CSRFCookieLifespan is the length of time that the CSRF cookie is valid. After this time, the
 	// Supervisor's authorization endpoint should give the browser a new CSRF cookie. We set it to
 	// a week so that it is unlikely to expire during a login.
 	CSRFCookieLifespan = time.Hour * 24 * 7
+
+	// DeviceUserCodeParamName is a custom param which the device verification page adds to the authorization request
+	// that it starts on behalf of a device. Its value is the user code of the device code session, which tells the
+	// callback endpoint to approve that session instead of redirecting with an authcode. The param is only accepted
+	// from a browser which also has the device approval cookie for the same user code.
+	DeviceUserCodeParamName = "pinniped_device_user_code"
+
+	// DeviceApprovalCookieName is the name of the browser cookie which the device verification page sets when the
+	// user confirms a user code. It proves that the login was started by the confirmation page in this browser.
+	DeviceApprovalCookieName = "__Host-pinniped-device-approval"
+
+	// DeviceApprovalCookieEncodingName is the `name` passed to the encoder for encoding and decoding the device
+	// approval cookie contents.
+	DeviceApprovalCookieEncodingName = "device-approval"
+
+	// DeviceCodePollInterval is the minimum time that clients must wait between requests to the token endpoint
+	// using the device code grant.
+	DeviceCodePollInterval = 5 * time.Second
 )
 
 // Encoder is the encoding side of the securecookie.Codec interface.
@@ -85,6 +132,14 @@ type Codec interface {
 	Decoder
 }
 
+// DeviceApproval is the content of the device approval cookie. The token is a single-use random value which is
+// also stored in the device code session of the user code, so only the browser which confirmed the user code on the
+// device verification page can approve that session.
+type DeviceApproval struct {
+	UserCode string `json:"u"`
+	Token    string `json:"t"`
+}
+
 // UpstreamStateParamData is the format of the state parameter that we use when we communicate to an
 // upstream OIDC provider.
 //
@@ -93,12 +148,95 @@ type Codec interface {
 type UpstreamStateParamData struct {
 	AuthParams    string              `json:"p"`
 	UpstreamName  string              `json:"u"`
+	UpstreamType  string              `json:"t"`
 	Nonce         nonce.Nonce         `json:"n"`
 	CSRFToken     csrftoken.CSRFToken `json:"c"`
 	PKCECode      pkce.Code           `json:"k"`
 	FormatVersion string              `json:"v"`
 }
 
+// PostLogoutStateParamData is the format of the state parameter that we send to the end_session_endpoint of an
+// upstream OIDC provider. It remembers where the Supervisor's post logout endpoint should send the browser after the
+// upstream provider has logged out the user.
+//
+// Keep the JSON to a minimal size because the upstream provider could impose size limitations on
+// the state param.
+type PostLogoutStateParamData struct {
+	ClientID              string `json:"c"`
+	PostLogoutRedirectURI string `json:"r"`
+	State                 string `json:"s,omitempty"`
+	FormatVersion         string `json:"v"`
+}
+
+// ReadCSRFCookie decodes the CSRF cookie which was set by the authorization endpoint.
+func ReadCSRFCookie(r *http.Request, cookieDecoder Decoder) (csrftoken.CSRFToken, error) {
+	receivedCSRFCookie, err := r.Cookie(CSRFCookieName)
+	if err != nil {
+		// Error means that the cookie was not found
+		return "", httperr.Wrap(http.StatusForbidden, "CSRF cookie is missing", err)
+	}
+
+	var csrfFromCookie csrftoken.CSRFToken
+	err = cookieDecoder.Decode(CSRFCookieEncodingName, receivedCSRFCookie.Value, &csrfFromCookie)
+	if err != nil {
+		return "", httperr.Wrap(http.StatusForbidden, "error reading CSRF cookie", err)
+	}
+
+	return csrfFromCookie, nil
+}
+
+// ReadDeviceApprovalCookie decodes the device approval cookie which was set by the device verification page.
+func ReadDeviceApprovalCookie(r *http.Request, cookieDecoder Decoder) (*DeviceApproval, error) {
+	receivedCookie, err := r.Cookie(DeviceApprovalCookieName)
+	if err != nil {
+		// Error means that the cookie was not found
+		return nil, httperr.Wrap(http.StatusForbidden, "device approval cookie is missing", err)
+	}
+
+	var approval DeviceApproval
+	if err := cookieDecoder.Decode(DeviceApprovalCookieEncodingName, receivedCookie.Value, &approval); err != nil {
+		return nil, httperr.Wrap(http.StatusForbidden, "error reading device approval cookie", err)
+	}
+
+	return &approval, nil
+}
+
+// ReadStateParam decodes the upstream state param which was created by the authorization endpoint.
+func ReadStateParam(encodedState string, stateDecoder Decoder) (*UpstreamStateParamData, error) {
+	var state UpstreamStateParamData
+	if err := stateDecoder.Decode(
+		UpstreamStateParamEncodingName,
+		encodedState,
+		&state,
+	); err != nil {
+		return nil, httperr.New(http.StatusBadRequest, "error reading state")
+	}
+
+	if state.FormatVersion != UpstreamStateParamFormatVersion {
+		return nil, httperr.New(http.StatusUnprocessableEntity, "state format version is invalid")
+	}
+
+	return &state, nil
+}
+
+// ReadPostLogoutStateParam decodes the post logout state param which was created by the end session endpoint.
+func ReadPostLogoutStateParam(encodedState string, stateDecoder Decoder) (*PostLogoutStateParamData, error) {
+	var state PostLogoutStateParamData
+	if err := stateDecoder.Decode(
+		PostLogoutStateParamEncodingName,
+		encodedState,
+		&state,
+	); err != nil {
+		return nil, httperr.New(http.StatusBadRequest, "error reading state")
+	}
+
+	if state.FormatVersion != PostLogoutStateParamFormatVersion {
+		return nil, httperr.New(http.StatusUnprocessableEntity, "state format version is invalid")
+	}
+
+	return &state, nil
+}
+
 type TimeoutsConfiguration struct {
 	// The length of time that our state param that we encrypt and pass to the upstream OIDC IDP should be considered
 	// valid. If a state param generated by the authorize endpoint is sent to the callback endpoint after this much
@@ -165,28 +303,67 @@ type TimeoutsConfiguration struct {
 	// when the token does not exist. If this is desirable, then the RefreshTokenSessionStorageLifetime can be made
 	// to be significantly larger than RefreshTokenLifespan, at the cost of slower cleanup.
 	RefreshTokenSessionStorageLifetime time.Duration
+
+	// DeviceCodeLifespan is the length of time that a device code and its user code are valid. The user must finish
+	// logging in on the verification page, and the device must redeem its device code, before this time has passed.
+	DeviceCodeLifespan time.Duration
+
+	// DeviceCodeSessionStorageLifetime is the length of time after which a device code session is allowed to be
+	// garbage collected from storage. The session is deleted when the device code is redeemed, so this can be just
+	// slightly longer than the DeviceCodeLifespan.
+	DeviceCodeSessionStorageLifetime time.Duration
+
+	// SessionIdleTimeout is the length of time after which a session can no longer be refreshed when it has not been
+	// refreshed since the user logged in or last refreshed it. Zero means that a session may be idle for as long as
+	// its refresh token is valid.
+	SessionIdleTimeout time.Duration
+
+	// MaxSessionLength is the length of time after the user logged in after which a session can no longer be
+	// refreshed. Zero means that a session may be refreshed indefinitely.
+	MaxSessionLength time.Duration
 }
 
 // Get the defaults for the Supervisor server.
 func DefaultOIDCTimeoutsConfiguration() TimeoutsConfiguration {
-	accessTokenLifespan := 2 * time.Minute
+	return NewTimeoutsConfiguration(provider.TokenLifespans{})
+}
+
+// NewTimeoutsConfiguration returns the timeouts for a FederationDomain with the given token lifespans and session
+// limits, where zero values mean that the defaults should be used. The session storage lifetimes are derived from the lifespans, so
+// the garbage collector never deletes a session while its tokens are still valid.
+func NewTimeoutsConfiguration(tokenLifespans provider.TokenLifespans) TimeoutsConfiguration {
+	upstreamStateParamLifespan := valueOrDefault(tokenLifespans.UpstreamState, 90*time.Minute)
+	accessTokenLifespan := valueOrDefault(tokenLifespans.AccessToken, 2*time.Minute)
+	idTokenLifespan := valueOrDefault(tokenLifespans.IDToken, accessTokenLifespan)
+	refreshTokenLifespan := valueOrDefault(tokenLifespans.RefreshToken, 9*time.Hour)
 	authorizationCodeLifespan := 10 * time.Minute
-	refreshTokenLifespan := 9 * time.Hour
+	deviceCodeLifespan := 10 * time.Minute
 
 	return TimeoutsConfiguration{
-		UpstreamStateParamLifespan:              90 * time.Minute,
+		UpstreamStateParamLifespan:              upstreamStateParamLifespan,
 		AuthorizeCodeLifespan:                   authorizationCodeLifespan,
 		AccessTokenLifespan:                     accessTokenLifespan,
-		IDTokenLifespan:                         accessTokenLifespan,
+		IDTokenLifespan:                         idTokenLifespan,
 		RefreshTokenLifespan:                    refreshTokenLifespan,
 		AuthorizationCodeSessionStorageLifetime: authorizationCodeLifespan + refreshTokenLifespan,
 		PKCESessionStorageLifetime:              authorizationCodeLifespan + (1 * time.Minute),
 		OIDCSessionStorageLifetime:              authorizationCodeLifespan + (1 * time.Minute),
 		AccessTokenSessionStorageLifetime:       refreshTokenLifespan + accessTokenLifespan,
 		RefreshTokenSessionStorageLifetime:      refreshTokenLifespan + accessTokenLifespan,
+		DeviceCodeLifespan:                      deviceCodeLifespan,
+		DeviceCodeSessionStorageLifetime:        deviceCodeLifespan + (1 * time.Minute),
+		SessionIdleTimeout:                      tokenLifespans.SessionIdleTimeout,
+		MaxSessionLength:                        tokenLifespans.MaxSessionLength,
 	}
 }
 
+func valueOrDefault(value, defaultValue time.Duration) time.Duration {
+	if value <= 0 {
+		return defaultValue
+	}
+	return value
+}
+
 func FositeOauth2Helper(
 	oauthStore interface{},
 	issuer string,
@@ -230,7 +407,10 @@ func FositeOauth2Helper(
 		compose.OpenIDConnectExplicitFactory,
 		compose.OpenIDConnectRefreshFactory,
 		compose.OAuth2PKCEFactory,
-		TokenExchangeFactory, // handle the "urn:ietf:params:oauth:grant-type:token-exchange" grant type
+		compose.OAuth2TokenRevocationFactory,    // handle requests to the revocation endpoint
+		compose.OAuth2TokenIntrospectionFactory, // validate access tokens for the userinfo endpoint
+		TokenExchangeFactory,                    // handle the "urn:ietf:params:oauth:grant-type:token-exchange" grant type
+		DeviceCodeGrantFactory,                  // handle the "urn:ietf:params:oauth:grant-type:device_code" grant type
 	)
 	provider.(*fosite.Fosite).FormPostHTMLTemplate = formposthtml.Template()
 	return provider
@@ -281,6 +461,12 @@ type UpstreamIdentityProvidersLister interface {
 	UpstreamActiveDirectoryIdentityProviderLister
 }
 
+// IdentityTransformsGetter returns the identity transformations which should be applied to users who authenticate
+// using the given upstream identity provider.
+type IdentityTransformsGetter interface {
+	IdentityTransforms(idpName string, idpType psession.ProviderType) *idtransform.TransformationPipeline
+}
+
 func GrantScopeIfRequested(authorizeRequester fosite.AuthorizeRequester, scopeName string) {
 	if ScopeWasRequested(authorizeRequester, scopeName) {
 		authorizeRequester.GrantScope(scopeName)
@@ -295,3 +481,29 @@ func ScopeWasRequested(authorizeRequester fosite.AuthorizeRequester, scopeName s
 	}
 	return false
 }
+
+// DownstreamUsername returns the downstream username claim of the ID token claims of a session, or an empty string
+// when the session has none.
+func DownstreamUsername(claims *jwt.IDTokenClaims) string {
+	username, _ := claims.Extra[DownstreamUsernameClaim].(string)
+	return username
+}
+
+// DownstreamGroups returns the downstream groups claim of the ID token claims of a session. The claim is a []string
+// in new sessions, but it is a []interface{} after the session was read back from storage.
+func DownstreamGroups(claims *jwt.IDTokenClaims) []string {
+	switch groups := claims.Extra[DownstreamGroupsClaim].(type) {
+	case []string:
+		return groups
+	case []interface{}:
+		result := make([]string, 0, len(groups))
+		for _, group := range groups {
+			if s, ok := group.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	default:
+		return nil
+	}
+}
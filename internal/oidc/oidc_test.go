@@ -0,0 +1,126 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package oidc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ory/fosite/token/jwt"
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/oidc/provider"
+)
+
+func TestNewTimeoutsConfiguration(t *testing.T) {
+	tests := []struct {
+		name           string
+		tokenLifespans provider.TokenLifespans
+		want           TimeoutsConfiguration
+	}{
+		{
+			name: "defaults",
+			want: TimeoutsConfiguration{
+				UpstreamStateParamLifespan:              90 * time.Minute,
+				AuthorizeCodeLifespan:                   10 * time.Minute,
+				AccessTokenLifespan:                     2 * time.Minute,
+				IDTokenLifespan:                         2 * time.Minute,
+				RefreshTokenLifespan:                    9 * time.Hour,
+				AuthorizationCodeSessionStorageLifetime: 9*time.Hour + 10*time.Minute,
+				PKCESessionStorageLifetime:              11 * time.Minute,
+				OIDCSessionStorageLifetime:              11 * time.Minute,
+				AccessTokenSessionStorageLifetime:       9*time.Hour + 2*time.Minute,
+				RefreshTokenSessionStorageLifetime:      9*time.Hour + 2*time.Minute,
+				DeviceCodeLifespan:                      10 * time.Minute,
+				DeviceCodeSessionStorageLifetime:        11 * time.Minute,
+			},
+		},
+		{
+			name: "all lifespans configured",
+			tokenLifespans: provider.TokenLifespans{
+				AccessToken:   5 * time.Minute,
+				IDToken:       15 * time.Minute,
+				RefreshToken:  24 * time.Hour,
+				UpstreamState: 30 * time.Minute,
+			},
+			want: TimeoutsConfiguration{
+				UpstreamStateParamLifespan:              30 * time.Minute,
+				AuthorizeCodeLifespan:                   10 * time.Minute,
+				AccessTokenLifespan:                     5 * time.Minute,
+				IDTokenLifespan:                         15 * time.Minute,
+				RefreshTokenLifespan:                    24 * time.Hour,
+				AuthorizationCodeSessionStorageLifetime: 24*time.Hour + 10*time.Minute,
+				PKCESessionStorageLifetime:              11 * time.Minute,
+				OIDCSessionStorageLifetime:              11 * time.Minute,
+				AccessTokenSessionStorageLifetime:       24*time.Hour + 5*time.Minute,
+				RefreshTokenSessionStorageLifetime:      24*time.Hour + 5*time.Minute,
+				DeviceCodeLifespan:                      10 * time.Minute,
+				DeviceCodeSessionStorageLifetime:        11 * time.Minute,
+			},
+		},
+		{
+			name:           "ID token lifespan defaults to the configured access token lifespan",
+			tokenLifespans: provider.TokenLifespans{AccessToken: 5 * time.Minute},
+			want: TimeoutsConfiguration{
+				UpstreamStateParamLifespan:              90 * time.Minute,
+				AuthorizeCodeLifespan:                   10 * time.Minute,
+				AccessTokenLifespan:                     5 * time.Minute,
+				IDTokenLifespan:                         5 * time.Minute,
+				RefreshTokenLifespan:                    9 * time.Hour,
+				AuthorizationCodeSessionStorageLifetime: 9*time.Hour + 10*time.Minute,
+				PKCESessionStorageLifetime:              11 * time.Minute,
+				OIDCSessionStorageLifetime:              11 * time.Minute,
+				AccessTokenSessionStorageLifetime:       9*time.Hour + 5*time.Minute,
+				RefreshTokenSessionStorageLifetime:      9*time.Hour + 5*time.Minute,
+				DeviceCodeLifespan:                      10 * time.Minute,
+				DeviceCodeSessionStorageLifetime:        11 * time.Minute,
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, NewTimeoutsConfiguration(tt.tokenLifespans))
+		})
+	}
+
+	require.Equal(t, NewTimeoutsConfiguration(provider.TokenLifespans{}), DefaultOIDCTimeoutsConfiguration())
+}
+
+func TestDownstreamUsernameAndGroups(t *testing.T) {
+	tests := []struct {
+		name         string
+		extra        map[string]interface{}
+		wantUsername string
+		wantGroups   []string
+	}{
+		{
+			name:         "new session",
+			extra:        map[string]interface{}{"username": "some-user", "groups": []string{"group1", "group2"}},
+			wantUsername: "some-user",
+			wantGroups:   []string{"group1", "group2"},
+		},
+		{
+			name:         "session read back from storage",
+			extra:        map[string]interface{}{"username": "some-user", "groups": []interface{}{"group1", "group2"}},
+			wantUsername: "some-user",
+			wantGroups:   []string{"group1", "group2"},
+		},
+		{
+			name:  "claims of the wrong type",
+			extra: map[string]interface{}{"username": 42, "groups": "group1"},
+		},
+		{
+			name: "no claims",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			claims := &jwt.IDTokenClaims{Extra: tt.extra}
+			require.Equal(t, tt.wantUsername, DownstreamUsername(claims))
+			require.Equal(t, tt.wantGroups, DownstreamGroups(claims))
+		})
+	}
+}
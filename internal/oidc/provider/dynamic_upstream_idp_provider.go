@@ -61,6 +61,10 @@ type UpstreamOIDCIdentityProviderI interface {
 	// GetAdditionalAuthcodeParams returns additional params to be sent on authcode requests.
 	GetAdditionalAuthcodeParams() map[string]string
 
+	// GetEndSessionURL returns the End Session Endpoint fetched from discovery, but only when the provider is configured
+	// to have users redirected there when they log out of the Supervisor. Otherwise, it returns nil.
+	GetEndSessionURL() *url.URL
+
 	// PasswordCredentialsGrantAndValidateTokens performs upstream OIDC resource owner password credentials grant and
 	// token validation. Returns the validated raw tokens as well as the parsed claims of the ID token.
 	PasswordCredentialsGrantAndValidateTokens(ctx context.Context, username, password string) (*oidctypes.Token, error)
@@ -107,8 +111,10 @@ type UpstreamLDAPIdentityProviderI interface {
 	// UserAuthenticator adds an interface method for performing user authentication against the upstream LDAP provider.
 	authenticators.UserAuthenticator
 
-	// PerformRefresh performs a refresh against the upstream LDAP identity provider
-	PerformRefresh(ctx context.Context, storedRefreshAttributes StoredRefreshAttributes) error
+	// PerformRefresh performs a refresh against the upstream LDAP identity provider. It returns the user's refreshed
+	// group memberships, or nil when the groups were not refreshed, in which case the groups from the initial login
+	// should be kept.
+	PerformRefresh(ctx context.Context, storedRefreshAttributes StoredRefreshAttributes) ([]string, error)
 }
 
 type StoredRefreshAttributes struct {
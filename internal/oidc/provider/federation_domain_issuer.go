@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package provider
@@ -7,20 +7,136 @@ import (
 	"fmt"
 	"net/url"
 	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/sets"
 
 	"go.pinniped.dev/internal/constable"
+	"go.pinniped.dev/internal/idtransform"
+	"go.pinniped.dev/internal/psession"
 )
 
+// FederationDomainIdentityProvider is a reference to an upstream identity provider which may be used
+// by a FederationDomain.
+type FederationDomainIdentityProvider struct {
+	Name string
+	Type psession.ProviderType
+
+	// Transforms are applied to the identities of users who authenticate using this identity provider
+	// via this FederationDomain. May be nil when there are no transforms.
+	Transforms *idtransform.TransformationPipeline
+}
+
+// TokenLifespans are the lifespans of the tokens issued by a FederationDomain, and the limits of its user sessions.
+// A zero lifespan means that the default lifespan should be used, while a zero limit means that there is no limit.
+type TokenLifespans struct {
+	AccessToken   time.Duration
+	IDToken       time.Duration
+	RefreshToken  time.Duration
+	UpstreamState time.Duration
+
+	SessionIdleTimeout time.Duration
+	MaxSessionLength   time.Duration
+
+	// MaxConcurrentSessions is the maximum number of refreshable sessions of each user. When a new login would exceed
+	// it, then the new login is rejected when RejectNewLoginOverSessionLimit is true, or else the oldest sessions of
+	// the user are revoked.
+	MaxConcurrentSessions          int
+	RejectNewLoginOverSessionLimit bool
+}
+
+// The bounds of the configurable token lifespans. Since the shortest refresh token lifespan is not shorter than the
+// longest access and ID token lifespans, a refresh token always outlives the tokens which were issued with it.
+const (
+	MinAccessTokenLifespan   = time.Minute
+	MaxAccessTokenLifespan   = time.Hour
+	MinIDTokenLifespan       = time.Minute
+	MaxIDTokenLifespan       = time.Hour
+	MinRefreshTokenLifespan  = time.Hour
+	MaxRefreshTokenLifespan  = 30 * 24 * time.Hour
+	MinUpstreamStateLifespan = 5 * time.Minute
+	MaxUpstreamStateLifespan = 24 * time.Hour
+	MinSessionIdleTimeout    = 5 * time.Minute
+	MaxSessionIdleTimeout    = 30 * 24 * time.Hour
+	MinMaxSessionLength      = time.Hour
+	MaxMaxSessionLength      = 365 * 24 * time.Hour
+)
+
+func (l TokenLifespans) validate() error {
+	for _, lifespan := range []struct {
+		name     string
+		value    time.Duration
+		min, max time.Duration
+	}{
+		{name: "accessTokenLifespan", value: l.AccessToken, min: MinAccessTokenLifespan, max: MaxAccessTokenLifespan},
+		{name: "idTokenLifespan", value: l.IDToken, min: MinIDTokenLifespan, max: MaxIDTokenLifespan},
+		{name: "refreshTokenLifespan", value: l.RefreshToken, min: MinRefreshTokenLifespan, max: MaxRefreshTokenLifespan},
+		{name: "upstreamStateLifespan", value: l.UpstreamState, min: MinUpstreamStateLifespan, max: MaxUpstreamStateLifespan},
+		{name: "sessionIdleTimeout", value: l.SessionIdleTimeout, min: MinSessionIdleTimeout, max: MaxSessionIdleTimeout},
+		{name: "maxSessionLength", value: l.MaxSessionLength, min: MinMaxSessionLength, max: MaxMaxSessionLength},
+	} {
+		if lifespan.value != 0 && (lifespan.value < lifespan.min || lifespan.value > lifespan.max) {
+			return fmt.Errorf("tokens.%s must be between %s and %s", lifespan.name, lifespan.min, lifespan.max)
+		}
+	}
+	if l.MaxConcurrentSessions < 0 {
+		return constable.Error("tokens.maxConcurrentSessions must be at least 1")
+	}
+	return nil
+}
+
+// reservedUserInfoClaims are the claims which the Supervisor sets itself in its ID tokens and UserInfo responses,
+// so they cannot be passed through from upstream ID tokens.
+var reservedUserInfoClaims = sets.NewString(
+	"sub", "username", "groups", "sid", "iss", "aud", "azp", "exp", "iat", "nbf", "jti",
+	"nonce", "auth_time", "rat", "at_hash", "c_hash", "acr", "amr",
+)
+
+func validateUserInfoPassthroughClaims(claims []string) error {
+	seen := sets.NewString()
+	for _, claim := range claims {
+		switch {
+		case claim == "":
+			return constable.Error("userInfo.passthroughClaims must not contain empty claim names")
+		case reservedUserInfoClaims.Has(claim):
+			return fmt.Errorf("userInfo.passthroughClaims must not contain %q, which is set by the Supervisor", claim)
+		case seen.Has(claim):
+			return fmt.Errorf("userInfo.passthroughClaims must not contain %q more than once", claim)
+		}
+		seen.Insert(claim)
+	}
+	return nil
+}
+
 // FederationDomainIssuer represents all of the settings and state for a downstream OIDC provider
 // as defined by a FederationDomain.
 type FederationDomainIssuer struct {
-	issuer     string
-	issuerHost string
-	issuerPath string
+	issuer            string
+	issuerHost        string
+	issuerPath        string
+	identityProviders []FederationDomainIdentityProvider
+	tokenLifespans    TokenLifespans
+
+	userInfoPassthroughClaims []string
 }
 
-func NewFederationDomainIssuer(issuer string) (*FederationDomainIssuer, error) {
-	p := FederationDomainIssuer{issuer: issuer}
+// NewFederationDomainIssuer returns a validated FederationDomainIssuer. The identityProviders are the
+// upstream identity providers which may be used by this FederationDomain. When identityProviders is nil,
+// then all upstream identity providers may be used. The zero values of tokenLifespans mean that the defaults
+// should be used. The userInfoPassthroughClaims are the names of the upstream ID token claims which the UserInfo
+// endpoint returns.
+func NewFederationDomainIssuer(
+	issuer string,
+	identityProviders []FederationDomainIdentityProvider,
+	tokenLifespans TokenLifespans,
+	userInfoPassthroughClaims []string,
+) (*FederationDomainIssuer, error) {
+	p := FederationDomainIssuer{
+		issuer:                    issuer,
+		identityProviders:         identityProviders,
+		tokenLifespans:            tokenLifespans,
+		userInfoPassthroughClaims: userInfoPassthroughClaims,
+	}
 	err := p.validate()
 	if err != nil {
 		return nil, err
@@ -58,6 +174,14 @@ func (p *FederationDomainIssuer) validate() error {
 		return constable.Error(`issuer must not have fragment`)
 	}
 
+	if err := p.tokenLifespans.validate(); err != nil {
+		return err
+	}
+
+	if err := validateUserInfoPassthroughClaims(p.userInfoPassthroughClaims); err != nil {
+		return err
+	}
+
 	p.issuerHost = issuerURL.Host
 	p.issuerPath = issuerURL.Path
 
@@ -75,3 +199,33 @@ func (p *FederationDomainIssuer) IssuerHost() string {
 func (p *FederationDomainIssuer) IssuerPath() string {
 	return p.issuerPath
 }
+
+// IdentityProviders returns the upstream identity providers which may be used by this FederationDomain.
+// When it returns nil, then all upstream identity providers may be used.
+func (p *FederationDomainIssuer) IdentityProviders() []FederationDomainIdentityProvider {
+	return p.identityProviders
+}
+
+// TokenLifespans returns the configured lifespans of the tokens issued by this FederationDomain and the configured
+// limits of its sessions.
+func (p *FederationDomainIssuer) TokenLifespans() TokenLifespans {
+	return p.tokenLifespans
+}
+
+// UserInfoPassthroughClaims returns the names of the upstream ID token claims which are copied into the sessions of
+// this FederationDomain, and which its UserInfo endpoint returns.
+func (p *FederationDomainIssuer) UserInfoPassthroughClaims() []string {
+	return p.userInfoPassthroughClaims
+}
+
+// IdentityTransforms returns the identity transformation pipeline which should be applied to users who authenticate
+// to this FederationDomain using the given upstream identity provider. It never returns nil. When no transforms are
+// configured for the identity provider, then it returns an empty pipeline.
+func (p *FederationDomainIssuer) IdentityTransforms(idpName string, idpType psession.ProviderType) *idtransform.TransformationPipeline {
+	for _, idp := range p.identityProviders {
+		if idp.Name == idpName && idp.Type == idpType && idp.Transforms != nil {
+			return idp.Transforms
+		}
+	}
+	return idtransform.NewTransformationPipeline()
+}
@@ -1,12 +1,16 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package provider
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/idtransform"
+	"go.pinniped.dev/internal/psession"
 )
 
 func TestFederationDomainIssuerValidations(t *testing.T) {
@@ -72,7 +76,7 @@ func TestFederationDomainIssuerValidations(t *testing.T) {
 	for _, tt := range tests {
 		tt := tt
 		t.Run(tt.name, func(t *testing.T) {
-			_, err := NewFederationDomainIssuer(tt.issuer)
+			_, err := NewFederationDomainIssuer(tt.issuer, nil, TokenLifespans{}, nil)
 			if tt.wantError != "" {
 				require.EqualError(t, err, tt.wantError)
 			} else {
@@ -81,3 +85,165 @@ func TestFederationDomainIssuerValidations(t *testing.T) {
 		})
 	}
 }
+
+func TestFederationDomainIssuerTokenLifespanValidations(t *testing.T) {
+	tests := []struct {
+		name           string
+		tokenLifespans TokenLifespans
+		wantError      string
+	}{
+		{
+			name: "defaults",
+		},
+		{
+			name: "lifespans at their minimums",
+			tokenLifespans: TokenLifespans{
+				AccessToken:        time.Minute,
+				IDToken:            time.Minute,
+				RefreshToken:       time.Hour,
+				UpstreamState:      5 * time.Minute,
+				SessionIdleTimeout: 5 * time.Minute,
+				MaxSessionLength:   time.Hour,
+			},
+		},
+		{
+			name: "lifespans at their maximums",
+			tokenLifespans: TokenLifespans{
+				AccessToken:        time.Hour,
+				IDToken:            time.Hour,
+				RefreshToken:       720 * time.Hour,
+				UpstreamState:      24 * time.Hour,
+				SessionIdleTimeout: 720 * time.Hour,
+				MaxSessionLength:   8760 * time.Hour,
+			},
+		},
+		{
+			name:           "access token lifespan too short",
+			tokenLifespans: TokenLifespans{AccessToken: 59 * time.Second},
+			wantError:      "tokens.accessTokenLifespan must be between 1m0s and 1h0m0s",
+		},
+		{
+			name:           "negative access token lifespan",
+			tokenLifespans: TokenLifespans{AccessToken: -time.Minute},
+			wantError:      "tokens.accessTokenLifespan must be between 1m0s and 1h0m0s",
+		},
+		{
+			name:           "ID token lifespan too long",
+			tokenLifespans: TokenLifespans{IDToken: 2 * time.Hour},
+			wantError:      "tokens.idTokenLifespan must be between 1m0s and 1h0m0s",
+		},
+		{
+			name:           "refresh token lifespan too short",
+			tokenLifespans: TokenLifespans{RefreshToken: 30 * time.Minute},
+			wantError:      "tokens.refreshTokenLifespan must be between 1h0m0s and 720h0m0s",
+		},
+		{
+			name:           "refresh token lifespan too long",
+			tokenLifespans: TokenLifespans{RefreshToken: 721 * time.Hour},
+			wantError:      "tokens.refreshTokenLifespan must be between 1h0m0s and 720h0m0s",
+		},
+		{
+			name:           "upstream state lifespan too short",
+			tokenLifespans: TokenLifespans{UpstreamState: time.Minute},
+			wantError:      "tokens.upstreamStateLifespan must be between 5m0s and 24h0m0s",
+		},
+		{
+			name:           "session idle timeout too short",
+			tokenLifespans: TokenLifespans{SessionIdleTimeout: time.Minute},
+			wantError:      "tokens.sessionIdleTimeout must be between 5m0s and 720h0m0s",
+		},
+		{
+			name:           "max session length too long",
+			tokenLifespans: TokenLifespans{MaxSessionLength: 8761 * time.Hour},
+			wantError:      "tokens.maxSessionLength must be between 1h0m0s and 8760h0m0s",
+		},
+		{
+			name:           "concurrent session limit",
+			tokenLifespans: TokenLifespans{MaxConcurrentSessions: 1, RejectNewLoginOverSessionLimit: true},
+		},
+		{
+			name:           "negative concurrent session limit",
+			tokenLifespans: TokenLifespans{MaxConcurrentSessions: -1},
+			wantError:      "tokens.maxConcurrentSessions must be at least 1",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewFederationDomainIssuer("https://tuna.com", nil, tt.tokenLifespans, nil)
+			if tt.wantError != "" {
+				require.EqualError(t, err, tt.wantError)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tt.tokenLifespans, p.TokenLifespans())
+			}
+		})
+	}
+}
+
+func TestFederationDomainIssuerUserInfoPassthroughClaimsValidations(t *testing.T) {
+	tests := []struct {
+		name              string
+		passthroughClaims []string
+		wantError         string
+	}{
+		{
+			name: "no passthrough claims",
+		},
+		{
+			name:              "valid passthrough claims",
+			passthroughClaims: []string{"email", "department"},
+		},
+		{
+			name:              "empty claim name",
+			passthroughClaims: []string{"email", ""},
+			wantError:         "userInfo.passthroughClaims must not contain empty claim names",
+		},
+		{
+			name:              "claim which is set by the Supervisor",
+			passthroughClaims: []string{"email", "groups"},
+			wantError:         `userInfo.passthroughClaims must not contain "groups", which is set by the Supervisor`,
+		},
+		{
+			name:              "duplicate claim name",
+			passthroughClaims: []string{"email", "email"},
+			wantError:         `userInfo.passthroughClaims must not contain "email" more than once`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewFederationDomainIssuer("https://tuna.com", nil, TokenLifespans{}, tt.passthroughClaims)
+			if tt.wantError != "" {
+				require.EqualError(t, err, tt.wantError)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tt.passthroughClaims, p.UserInfoPassthroughClaims())
+			}
+		})
+	}
+}
+
+func TestFederationDomainIssuerIdentityTransforms(t *testing.T) {
+	ldapTransforms := idtransform.NewTransformationPipeline()
+	ldapTransforms.AppendTransformation(idtransform.NewUsernamePrefixTransformation("ldap:"))
+
+	subject, err := NewFederationDomainIssuer("https://tuna.com", []FederationDomainIdentityProvider{
+		{Name: "some-idp", Type: psession.ProviderTypeLDAP, Transforms: ldapTransforms},
+		{Name: "some-idp", Type: psession.ProviderTypeOIDC},
+	}, TokenLifespans{}, nil)
+	require.NoError(t, err)
+
+	require.Same(t, ldapTransforms, subject.IdentityTransforms("some-idp", psession.ProviderTypeLDAP))
+
+	for _, pipeline := range []*idtransform.TransformationPipeline{
+		subject.IdentityTransforms("some-idp", psession.ProviderTypeOIDC),
+		subject.IdentityTransforms("some-idp", psession.ProviderTypeActiveDirectory),
+		subject.IdentityTransforms("other-idp", psession.ProviderTypeLDAP),
+	} {
+		require.NotNil(t, pipeline)
+		result, err := pipeline.Evaluate("ryan", []string{"a"})
+		require.NoError(t, err)
+		require.Equal(t, "ryan", result.Username)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package manager
+
+import (
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/psession"
+)
+
+// federationDomainIDPLister is an oidc.UpstreamIdentityProvidersLister which only lists the upstream
+// identity providers which may be used by a single FederationDomain.
+type federationDomainIDPLister struct {
+	upstreamIDPs oidc.UpstreamIdentityProvidersLister
+	allowed      map[federationDomainIDPKey]bool
+}
+
+type federationDomainIDPKey struct {
+	name    string
+	idpType psession.ProviderType
+}
+
+var _ oidc.UpstreamIdentityProvidersLister = (*federationDomainIDPLister)(nil)
+
+// newFederationDomainIDPLister returns a lister which filters the upstreamIDPs down to only those which are
+// allowed by the federationDomain. When the federationDomain does not restrict its identity providers, then
+// upstreamIDPs is returned unchanged.
+func newFederationDomainIDPLister(
+	federationDomain *provider.FederationDomainIssuer,
+	upstreamIDPs oidc.UpstreamIdentityProvidersLister,
+) oidc.UpstreamIdentityProvidersLister {
+	identityProviders := federationDomain.IdentityProviders()
+	if identityProviders == nil {
+		return upstreamIDPs
+	}
+
+	allowed := make(map[federationDomainIDPKey]bool, len(identityProviders))
+	for _, idp := range identityProviders {
+		allowed[federationDomainIDPKey{name: idp.Name, idpType: idp.Type}] = true
+	}
+
+	return &federationDomainIDPLister{upstreamIDPs: upstreamIDPs, allowed: allowed}
+}
+
+func (l *federationDomainIDPLister) isAllowed(name string, idpType psession.ProviderType) bool {
+	return l.allowed[federationDomainIDPKey{name: name, idpType: idpType}]
+}
+
+func (l *federationDomainIDPLister) GetOIDCIdentityProviders() []provider.UpstreamOIDCIdentityProviderI {
+	var idps []provider.UpstreamOIDCIdentityProviderI
+	for _, idp := range l.upstreamIDPs.GetOIDCIdentityProviders() {
+		if l.isAllowed(idp.GetName(), psession.ProviderTypeOIDC) {
+			idps = append(idps, idp)
+		}
+	}
+	return idps
+}
+
+func (l *federationDomainIDPLister) GetLDAPIdentityProviders() []provider.UpstreamLDAPIdentityProviderI {
+	return l.filterLDAP(l.upstreamIDPs.GetLDAPIdentityProviders(), psession.ProviderTypeLDAP)
+}
+
+func (l *federationDomainIDPLister) GetActiveDirectoryIdentityProviders() []provider.UpstreamLDAPIdentityProviderI {
+	return l.filterLDAP(l.upstreamIDPs.GetActiveDirectoryIdentityProviders(), psession.ProviderTypeActiveDirectory)
+}
+
+func (l *federationDomainIDPLister) filterLDAP(
+	ldapIDPs []provider.UpstreamLDAPIdentityProviderI,
+	idpType psession.ProviderType,
+) []provider.UpstreamLDAPIdentityProviderI {
+	var idps []provider.UpstreamLDAPIdentityProviderI
+	for _, idp := range ldapIDPs {
+		if l.isAllowed(idp.GetName(), idpType) {
+			idps = append(idps, idp)
+		}
+	}
+	return idps
+}
@@ -0,0 +1,125 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package manager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/psession"
+	"go.pinniped.dev/internal/testutil/oidctestutil"
+)
+
+func TestFederationDomainIDPLister(t *testing.T) {
+	upstreamIDPs := oidctestutil.NewUpstreamIDPListerBuilder().
+		WithOIDC(
+			&oidctestutil.TestUpstreamOIDCIdentityProvider{Name: "oidc-1"},
+			&oidctestutil.TestUpstreamOIDCIdentityProvider{Name: "oidc-2"},
+			&oidctestutil.TestUpstreamOIDCIdentityProvider{Name: "same-name"},
+		).
+		WithLDAP(
+			&oidctestutil.TestUpstreamLDAPIdentityProvider{Name: "ldap-1"},
+			&oidctestutil.TestUpstreamLDAPIdentityProvider{Name: "same-name"},
+		).
+		WithActiveDirectory(
+			&oidctestutil.TestUpstreamLDAPIdentityProvider{Name: "ad-1"},
+			&oidctestutil.TestUpstreamLDAPIdentityProvider{Name: "ad-2"},
+		).
+		Build()
+
+	idpNames := func(lister oidc.UpstreamIdentityProvidersLister) (oidcNames, ldapNames, adNames []string) {
+		for _, idp := range lister.GetOIDCIdentityProviders() {
+			oidcNames = append(oidcNames, idp.GetName())
+		}
+		for _, idp := range lister.GetLDAPIdentityProviders() {
+			ldapNames = append(ldapNames, idp.GetName())
+		}
+		for _, idp := range lister.GetActiveDirectoryIdentityProviders() {
+			adNames = append(adNames, idp.GetName())
+		}
+		return
+	}
+
+	tests := []struct {
+		name              string
+		identityProviders []provider.FederationDomainIdentityProvider
+		wantOIDC          []string
+		wantLDAP          []string
+		wantAD            []string
+	}{
+		{
+			name:              "nil identity providers allows all upstream IDPs",
+			identityProviders: nil,
+			wantOIDC:          []string{"oidc-1", "oidc-2", "same-name"},
+			wantLDAP:          []string{"ldap-1", "same-name"},
+			wantAD:            []string{"ad-1", "ad-2"},
+		},
+		{
+			name:              "empty identity providers allows no upstream IDPs",
+			identityProviders: []provider.FederationDomainIdentityProvider{},
+		},
+		{
+			name: "only the listed upstream IDPs are allowed",
+			identityProviders: []provider.FederationDomainIdentityProvider{
+				{Name: "oidc-2", Type: psession.ProviderTypeOIDC},
+				{Name: "same-name", Type: psession.ProviderTypeLDAP},
+				{Name: "ad-1", Type: psession.ProviderTypeActiveDirectory},
+			},
+			wantOIDC: []string{"oidc-2"},
+			wantLDAP: []string{"same-name"},
+			wantAD:   []string{"ad-1"},
+		},
+		{
+			name: "names must match an upstream IDP of the listed type",
+			identityProviders: []provider.FederationDomainIdentityProvider{
+				{Name: "oidc-1", Type: psession.ProviderTypeLDAP},
+				{Name: "ldap-1", Type: psession.ProviderTypeActiveDirectory},
+				{Name: "ad-1", Type: psession.ProviderTypeOIDC},
+			},
+		},
+		{
+			name: "listed upstream IDPs which do not exist are ignored",
+			identityProviders: []provider.FederationDomainIdentityProvider{
+				{Name: "does-not-exist", Type: psession.ProviderTypeOIDC},
+				{Name: "ldap-1", Type: psession.ProviderTypeLDAP},
+			},
+			wantLDAP: []string{"ldap-1"},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			federationDomain, err := provider.NewFederationDomainIssuer("https://issuer.example.com", test.identityProviders, provider.TokenLifespans{}, nil)
+			require.NoError(t, err)
+
+			subject := newFederationDomainIDPLister(federationDomain, upstreamIDPs)
+
+			oidcNames, ldapNames, adNames := idpNames(subject)
+			require.Equal(t, test.wantOIDC, oidcNames)
+			require.Equal(t, test.wantLDAP, ldapNames)
+			require.Equal(t, test.wantAD, adNames)
+		})
+	}
+
+	t.Run("reflects changes to the upstream IDPs", func(t *testing.T) {
+		federationDomain, err := provider.NewFederationDomainIssuer("https://issuer.example.com", []provider.FederationDomainIdentityProvider{
+			{Name: "new-oidc", Type: psession.ProviderTypeOIDC},
+		}, provider.TokenLifespans{}, nil)
+		require.NoError(t, err)
+		dynamicIDPs := oidctestutil.NewUpstreamIDPListerBuilder().Build()
+
+		subject := newFederationDomainIDPLister(federationDomain, dynamicIDPs)
+		require.Empty(t, subject.GetOIDCIdentityProviders())
+
+		dynamicIDPs.SetOIDCIdentityProviders([]provider.UpstreamOIDCIdentityProviderI{
+			&oidctestutil.TestUpstreamOIDCIdentityProvider{Name: "new-oidc"},
+			&oidctestutil.TestUpstreamOIDCIdentityProvider{Name: "other-oidc"},
+		})
+		require.Len(t, subject.GetOIDCIdentityProviders(), 1)
+		require.Equal(t, "new-oidc", subject.GetOIDCIdentityProviders()[0].GetName())
+	})
+}
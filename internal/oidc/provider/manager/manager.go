@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package manager
@@ -8,24 +8,38 @@ import (
 	"strings"
 	"sync"
 
-	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
-
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/metrics"
 	"go.pinniped.dev/internal/oidc"
 	"go.pinniped.dev/internal/oidc/auth"
 	"go.pinniped.dev/internal/oidc/callback"
+	"go.pinniped.dev/internal/oidc/chooseidp"
+	"go.pinniped.dev/internal/oidc/clientregistry"
 	"go.pinniped.dev/internal/oidc/csrftoken"
+	"go.pinniped.dev/internal/oidc/device"
 	"go.pinniped.dev/internal/oidc/discovery"
 	"go.pinniped.dev/internal/oidc/dynamiccodec"
 	"go.pinniped.dev/internal/oidc/idpdiscovery"
+	"go.pinniped.dev/internal/oidc/introspection"
 	"go.pinniped.dev/internal/oidc/jwks"
+	"go.pinniped.dev/internal/oidc/login"
+	"go.pinniped.dev/internal/oidc/logout"
 	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/oidc/revocation"
 	"go.pinniped.dev/internal/oidc/token"
+	"go.pinniped.dev/internal/oidc/userinfo"
 	"go.pinniped.dev/internal/plog"
 	"go.pinniped.dev/internal/secret"
+	"go.pinniped.dev/internal/tracing"
 	"go.pinniped.dev/pkg/oidcclient/nonce"
 	"go.pinniped.dev/pkg/oidcclient/pkce"
 )
 
+// SessionEncryptionKeys tells whether the keys which encrypt the stored sessions of each issuer are loaded.
+type SessionEncryptionKeys interface {
+	HasActiveKey(issuer string) bool
+}
+
 // Manager can manage multiple active OIDC providers. It acts as a request router for them.
 //
 // It is thread-safe.
@@ -37,27 +51,42 @@ type Manager struct {
 	dynamicJWKSProvider jwks.DynamicJWKSProvider             // in-memory cache of per-issuer JWKS data
 	upstreamIDPs        oidc.UpstreamIdentityProvidersLister // in-memory cache of upstream IDPs
 	secretCache         *secret.Cache                        // in-memory cache of cryptographic material
-	secretsClient       corev1client.SecretInterface
+	clientManager       *clientregistry.ClientManager        // in-memory cache of downstream OIDC clients
+	sessionStorage      crud.Backend                         // where the downstream sessions are stored
+	sessionKeys         SessionEncryptionKeys                // in-memory cache of the keys which encrypt the stored sessions
+
+	allowReservedUsernamesAndGroups bool // when false, reject logins and refreshes for reserved usernames and groups
 }
 
 // NewManager returns an empty Manager.
 // nextHandler will be invoked for any requests that could not be handled by this manager's providers.
 // dynamicJWKSProvider will be used as an in-memory cache for per-issuer JWKS data.
 // upstreamIDPs will be used as an in-memory cache of currently configured upstream IDPs.
+// sessionStorage will be used to store the downstream sessions.
+// sessionKeys will be used to tell when the keys which encrypt the stored sessions of an issuer are loaded. It may be nil
+// when the sessions are not encrypted.
+// clientManager will be used to look up the downstream OIDC clients.
+// allowReservedUsernamesAndGroups disables the rejection of downstream identities which use names reserved by Kubernetes.
 func NewManager(
 	nextHandler http.Handler,
 	dynamicJWKSProvider jwks.DynamicJWKSProvider,
 	upstreamIDPs oidc.UpstreamIdentityProvidersLister,
 	secretCache *secret.Cache,
-	secretsClient corev1client.SecretInterface,
+	sessionStorage crud.Backend,
+	sessionKeys SessionEncryptionKeys,
+	clientManager *clientregistry.ClientManager,
+	allowReservedUsernamesAndGroups bool,
 ) *Manager {
 	return &Manager{
-		providerHandlers:    make(map[string]http.Handler),
-		nextHandler:         nextHandler,
-		dynamicJWKSProvider: dynamicJWKSProvider,
-		upstreamIDPs:        upstreamIDPs,
-		secretCache:         secretCache,
-		secretsClient:       secretsClient,
+		providerHandlers:                make(map[string]http.Handler),
+		nextHandler:                     nextHandler,
+		dynamicJWKSProvider:             dynamicJWKSProvider,
+		upstreamIDPs:                    upstreamIDPs,
+		secretCache:                     secretCache,
+		sessionStorage:                  sessionStorage,
+		sessionKeys:                     sessionKeys,
+		clientManager:                   clientManager,
+		allowReservedUsernamesAndGroups: allowReservedUsernamesAndGroups,
 	}
 }
 
@@ -88,14 +117,16 @@ func (m *Manager) SetProviders(federationDomains ...*provider.FederationDomainIs
 
 		tokenHMACKeyGetter := wrapGetter(incomingProvider.Issuer(), m.secretCache.GetTokenHMACKey)
 
-		timeoutsConfiguration := oidc.DefaultOIDCTimeoutsConfiguration()
+		timeoutsConfiguration := oidc.NewTimeoutsConfiguration(incomingProvider.TokenLifespans())
 
 		// Use NullStorage for the authorize endpoint because we do not actually want to store anything until
 		// the upstream callback endpoint is called later.
-		oauthHelperWithNullStorage := oidc.FositeOauth2Helper(oidc.NullStorage{}, issuer, tokenHMACKeyGetter, nil, timeoutsConfiguration)
+		oauthHelperWithNullStorage := oidc.FositeOauth2Helper(oidc.NullStorage{ClientManager: m.clientManager}, issuer, tokenHMACKeyGetter, nil, timeoutsConfiguration)
 
 		// For all the other endpoints, make another oauth helper with exactly the same settings except use real storage.
-		oauthHelperWithKubeStorage := oidc.FositeOauth2Helper(oidc.NewKubeStorage(m.secretsClient, timeoutsConfiguration), issuer, tokenHMACKeyGetter, m.dynamicJWKSProvider, timeoutsConfiguration)
+		// Each FederationDomain encrypts its stored sessions with its own keys, when the storage supports encryption.
+		kubeStorage := oidc.NewStorage(crud.ForIssuer(m.sessionStorage, issuer), m.clientManager, timeoutsConfiguration)
+		oauthHelperWithKubeStorage := oidc.FositeOauth2Helper(kubeStorage, issuer, tokenHMACKeyGetter, m.dynamicJWKSProvider, timeoutsConfiguration)
 
 		var upstreamStateEncoder = dynamiccodec.New(
 			timeoutsConfiguration.UpstreamStateParamLifespan,
@@ -103,15 +134,39 @@ func (m *Manager) SetProviders(federationDomains ...*provider.FederationDomainIs
 			wrapGetter(incomingProvider.Issuer(), m.secretCache.GetStateEncoderBlockKey),
 		)
 
-		m.providerHandlers[(issuerHostWithPath + oidc.WellKnownEndpointPath)] = discovery.NewHandler(issuer)
+		// Each FederationDomain may only use the upstream IDPs that it allows.
+		upstreamIDPs := newFederationDomainIDPLister(incomingProvider, m.upstreamIDPs)
+
+		// Each FederationDomain applies its own identity transformations, followed by the reserved names policy.
+		var idTransformsGetter oidc.IdentityTransformsGetter = incomingProvider
+		if !m.allowReservedUsernamesAndGroups {
+			idTransformsGetter = &reservedNamesIdentityTransformsGetter{delegate: incomingProvider}
+		}
 
-		m.providerHandlers[(issuerHostWithPath + oidc.JWKSEndpointPath)] = jwks.NewHandler(issuer, m.dynamicJWKSProvider)
+		// Each endpoint is instrumented with the metrics of the endpoints of all FederationDomains, and each of its
+		// requests starts a span named after the endpoint.
+		addHandler := func(endpointPath string, handler http.Handler) {
+			m.providerHandlers[issuerHostWithPath+endpointPath] = metrics.InstrumentSupervisorEndpoint(endpointPath,
+				tracing.InstrumentHandler(endpointPath, handler))
+		}
 
-		m.providerHandlers[(issuerHostWithPath + oidc.PinnipedIDPsPathV1Alpha1)] = idpdiscovery.NewHandler(m.upstreamIDPs)
+		// The endpoints which read or write the stored sessions cannot be used until the keys which encrypt the
+		// sessions of this issuer are loaded, e.g. right after the Supervisor starts or the FederationDomain is created.
+		addSessionHandler := func(endpointPath string, handler http.Handler) {
+			addHandler(endpointPath, m.requireSessionEncryptionKeys(issuer, handler))
+		}
 
-		m.providerHandlers[(issuerHostWithPath + oidc.AuthorizationEndpointPath)] = auth.NewHandler(
+		addHandler(oidc.WellKnownEndpointPath, discovery.NewHandler(issuer, m.dynamicJWKSProvider))
+
+		addHandler(oidc.JWKSEndpointPath, jwks.NewHandler(issuer, m.dynamicJWKSProvider))
+
+		addHandler(oidc.PinnipedIDPsPathV1Alpha1, idpdiscovery.NewHandler(upstreamIDPs))
+
+		addSessionHandler(oidc.AuthorizationEndpointPath, auth.NewHandler(
 			issuer,
-			m.upstreamIDPs,
+			upstreamIDPs,
+			idTransformsGetter,
+			incomingProvider.UserInfoPassthroughClaims(),
 			oauthHelperWithNullStorage,
 			oauthHelperWithKubeStorage,
 			csrftoken.Generate,
@@ -119,20 +174,91 @@ func (m *Manager) SetProviders(federationDomains ...*provider.FederationDomainIs
 			nonce.Generate,
 			upstreamStateEncoder,
 			csrfCookieEncoder,
-		)
+		))
+
+		addHandler(oidc.ChooseIDPEndpointPath, chooseidp.NewHandler(
+			issuer+oidc.AuthorizationEndpointPath,
+			upstreamIDPs,
+		))
 
-		m.providerHandlers[(issuerHostWithPath + oidc.CallbackEndpointPath)] = callback.NewHandler(
-			m.upstreamIDPs,
+		addSessionHandler(oidc.CallbackEndpointPath, callback.NewHandler(
+			upstreamIDPs,
+			idTransformsGetter,
+			incomingProvider.UserInfoPassthroughClaims(),
 			oauthHelperWithKubeStorage,
 			upstreamStateEncoder,
 			csrfCookieEncoder,
 			issuer+oidc.CallbackEndpointPath,
-		)
+			kubeStorage,
+		))
 
-		m.providerHandlers[(issuerHostWithPath + oidc.TokenEndpointPath)] = token.NewHandler(
-			m.upstreamIDPs,
+		addSessionHandler(oidc.PinnipedLoginPath, login.NewHandler(
+			issuer,
+			upstreamIDPs,
+			idTransformsGetter,
 			oauthHelperWithKubeStorage,
-		)
+			upstreamStateEncoder,
+			csrfCookieEncoder,
+			kubeStorage,
+		))
+
+		addSessionHandler(oidc.DeviceAuthorizationEndpointPath, device.NewAuthorizationHandler(
+			issuer,
+			oauthHelperWithKubeStorage,
+			kubeStorage,
+			timeoutsConfiguration.DeviceCodeLifespan,
+		))
+
+		addSessionHandler(oidc.DeviceVerificationEndpointPath, device.NewVerificationHandler(
+			issuer,
+			kubeStorage,
+			csrfCookieEncoder,
+		))
+
+		addSessionHandler(oidc.TokenEndpointPath, token.NewHandler(
+			issuer,
+			upstreamIDPs,
+			idTransformsGetter,
+			oauthHelperWithKubeStorage,
+			kubeStorage,
+			token.SessionLimits{
+				IdleTimeout:                              timeoutsConfiguration.SessionIdleTimeout,
+				MaxLength:                                timeoutsConfiguration.MaxSessionLength,
+				MaxConcurrentSessions:                    incomingProvider.TokenLifespans().MaxConcurrentSessions,
+				RejectNewLoginOverConcurrentSessionLimit: incomingProvider.TokenLifespans().RejectNewLoginOverSessionLimit,
+			},
+		))
+
+		addSessionHandler(oidc.RevocationEndpointPath, revocation.NewHandler(
+			upstreamIDPs,
+			oauthHelperWithKubeStorage,
+			kubeStorage,
+		))
+
+		addSessionHandler(oidc.EndSessionEndpointPath, logout.NewHandler(
+			issuer,
+			m.dynamicJWKSProvider,
+			m.clientManager,
+			kubeStorage,
+			upstreamIDPs,
+			upstreamStateEncoder,
+			timeoutsConfiguration.RefreshTokenLifespan,
+		))
+
+		addHandler(oidc.PostLogoutEndpointPath, logout.NewPostLogoutHandler(
+			m.clientManager,
+			upstreamStateEncoder,
+		))
+
+		addSessionHandler(oidc.UserInfoEndpointPath, userinfo.NewHandler(
+			oauthHelperWithKubeStorage,
+			incomingProvider.UserInfoPassthroughClaims(),
+		))
+
+		addSessionHandler(oidc.IntrospectionEndpointPath, introspection.NewHandler(
+			issuer,
+			oauthHelperWithKubeStorage,
+		))
 
 		plog.Debug("oidc provider manager added or updated issuer", "issuer", issuer)
 	}
@@ -163,6 +289,23 @@ func (m *Manager) findHandler(req *http.Request) http.Handler {
 	return m.providerHandlers[strings.ToLower(req.Host)+"/"+req.URL.Path]
 }
 
+// requireSessionEncryptionKeys responds with an error, instead of calling the handler, while the keys which encrypt
+// the stored sessions of the issuer are not loaded, so that the handler does not fail to read or write those sessions.
+func (m *Manager) requireSessionEncryptionKeys(issuer string, handler http.Handler) http.Handler {
+	if m.sessionKeys == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.sessionKeys.HasActiveKey(issuer) {
+			plog.Warning("session encryption keys are not loaded yet", "issuer", issuer, "path", r.URL.Path)
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable)+": session encryption keys are not loaded yet", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
 func wrapGetter(issuer string, getter func(string) []byte) func() []byte {
 	return func() []byte {
 		return getter(issuer)
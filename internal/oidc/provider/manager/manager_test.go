@@ -22,11 +22,14 @@ import (
 	"gopkg.in/square/go-jose.v2"
 	"k8s.io/client-go/kubernetes/fake"
 
+	"go.pinniped.dev/internal/crud"
 	"go.pinniped.dev/internal/here"
 	"go.pinniped.dev/internal/oidc"
 	"go.pinniped.dev/internal/oidc/discovery"
 	"go.pinniped.dev/internal/oidc/jwks"
 	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/oidc/signer"
+	"go.pinniped.dev/internal/psession"
 	"go.pinniped.dev/internal/testutil"
 	"go.pinniped.dev/internal/testutil/oidctestutil"
 	"go.pinniped.dev/pkg/oidcclient/nonce"
@@ -182,7 +185,7 @@ func TestManager(t *testing.T) {
 			return actualLocationQueryParams.Get("code")
 		}
 
-		requireTokenRequestToBeHandled := func(requestIssuer, authCode string, jwks *jose.JSONWebKeySet, jwkIssuer string) {
+		requireTokenRequestToBeHandled := func(requestIssuer, authCode string, jwks *jose.JSONWebKeySet, jwkIssuer string) (string, string) {
 			recorder := httptest.NewRecorder()
 
 			numberOfKubeActionsBeforeThisRequest := len(kubeClient.Actions())
@@ -219,6 +222,140 @@ func TestManager(t *testing.T) {
 			// Make sure that we wired up the callback endpoint to use kube storage for fosite sessions.
 			r.Equal(len(kubeClient.Actions()), numberOfKubeActionsBeforeThisRequest+8,
 				"did not perform any kube actions during the callback request, but should have")
+
+			// Return the access token and ID token so we can use them in our next requests to the userinfo
+			// endpoint, the introspection endpoint, the revocation endpoint, and the end session endpoint.
+			accessToken, ok := body["access_token"].(string)
+			r.True(ok, "wanted access_token type to be string, but was %T", body["access_token"])
+			return accessToken, idToken
+		}
+
+		requireUserInfoRequestToBeHandled := func(requestIssuer, accessToken string) {
+			recorder := httptest.NewRecorder()
+
+			numberOfKubeActionsBeforeThisRequest := len(kubeClient.Actions())
+
+			userInfoRequest := newGetRequest(requestIssuer + oidc.UserInfoEndpointPath)
+			userInfoRequest.Header.Set("Authorization", "Bearer "+accessToken)
+			subject.ServeHTTP(recorder, userInfoRequest)
+
+			r.False(fallbackHandlerWasCalled)
+
+			// Minimal check to ensure that the right endpoint was called
+			var body map[string]interface{}
+			r.Equal(http.StatusOK, recorder.Code)
+			r.NoError(json.Unmarshal(recorder.Body.Bytes(), &body))
+			r.Contains(body, "sub")
+			r.Contains(body, "username")
+
+			// Make sure that we wired up the userinfo endpoint to use kube storage for fosite sessions.
+			r.Greater(len(kubeClient.Actions()), numberOfKubeActionsBeforeThisRequest,
+				"did not perform any kube actions during the userinfo request, but should have")
+		}
+
+		requireIntrospectionRequestToBeHandled := func(requestIssuer, accessToken string) {
+			recorder := httptest.NewRecorder()
+
+			// The pinniped-cli client is a public client, so it cannot authenticate to the introspection endpoint.
+			introspectionRequestBody := url.Values{
+				"token": []string{accessToken},
+			}.Encode()
+			introspectionRequest := newPostRequest(requestIssuer+oidc.IntrospectionEndpointPath, introspectionRequestBody)
+			introspectionRequest.SetBasicAuth(downstreamClientID, "")
+			subject.ServeHTTP(recorder, introspectionRequest)
+
+			r.False(fallbackHandlerWasCalled)
+
+			// Minimal check to ensure that the right endpoint was called
+			r.Equal(http.StatusUnauthorized, recorder.Code)
+			r.Contains(recorder.Body.String(), `"error":"request_unauthorized"`)
+		}
+
+		requireLoginRequestToBeHandled := func(requestIssuer string) {
+			recorder := httptest.NewRecorder()
+			subject.ServeHTTP(recorder, newGetRequest(requestIssuer+oidc.PinnipedLoginPath+"?state=some-state"))
+
+			r.False(fallbackHandlerWasCalled)
+
+			// Minimal check to ensure that the right endpoint was called
+			r.Equal(http.StatusForbidden, recorder.Code)
+			r.Equal("Forbidden: CSRF cookie is missing\n", recorder.Body.String())
+		}
+
+		requireDeviceRequestsToBeHandled := func(requestIssuer string) {
+			numberOfKubeActionsBeforeThisRequest := len(kubeClient.Actions())
+
+			deviceAuthorizationRequestBody := url.Values{
+				"client_id": []string{downstreamClientID},
+				"scope":     []string{"openid"},
+			}.Encode()
+			recorder := httptest.NewRecorder()
+			subject.ServeHTTP(recorder, newPostRequest(requestIssuer+oidc.DeviceAuthorizationEndpointPath, deviceAuthorizationRequestBody))
+
+			r.False(fallbackHandlerWasCalled)
+
+			// Minimal check to ensure that the right endpoint was called
+			var body map[string]interface{}
+			r.Equal(http.StatusOK, recorder.Code)
+			r.NoError(json.Unmarshal(recorder.Body.Bytes(), &body))
+			r.Contains(body, "device_code")
+			userCode, ok := body["user_code"].(string)
+			r.True(ok, "wanted user_code type to be string, but was %T", body["user_code"])
+
+			// Make sure that we wired up the device authorization endpoint to use kube storage for device code sessions.
+			r.Greater(len(kubeClient.Actions()), numberOfKubeActionsBeforeThisRequest,
+				"did not perform any kube actions during the device authorization request, but should have")
+
+			// The verification page finds the device code session which was just created.
+			recorder = httptest.NewRecorder()
+			subject.ServeHTTP(recorder, newGetRequest(requestIssuer+oidc.DeviceVerificationEndpointPath+"?user_code="+userCode))
+
+			r.False(fallbackHandlerWasCalled)
+			r.Equal(http.StatusOK, recorder.Code)
+			r.Contains(recorder.Body.String(), userCode)
+		}
+
+		requireRevocationRequestToBeHandled := func(requestIssuer, accessToken string) {
+			recorder := httptest.NewRecorder()
+
+			numberOfKubeActionsBeforeThisRequest := len(kubeClient.Actions())
+
+			revocationRequestBody := url.Values{
+				"token":           []string{accessToken},
+				"token_type_hint": []string{"access_token"},
+				"client_id":       []string{downstreamClientID},
+			}.Encode()
+			subject.ServeHTTP(recorder, newPostRequest(requestIssuer+oidc.RevocationEndpointPath, revocationRequestBody))
+
+			r.False(fallbackHandlerWasCalled)
+
+			// Minimal check to ensure that the right endpoint was called
+			r.Equal(http.StatusOK, recorder.Code)
+
+			// Make sure that we wired up the revocation endpoint to use kube storage for fosite sessions.
+			r.Greater(len(kubeClient.Actions()), numberOfKubeActionsBeforeThisRequest,
+				"did not perform any kube actions during the revocation request, but should have")
+		}
+
+		requireLogoutRequestToBeHandled := func(requestIssuer, idToken string) {
+			recorder := httptest.NewRecorder()
+
+			numberOfKubeActionsBeforeThisRequest := len(kubeClient.Actions())
+
+			logoutRequestParams := "?" + url.Values{
+				"id_token_hint": []string{idToken},
+			}.Encode()
+			subject.ServeHTTP(recorder, newGetRequest(requestIssuer+oidc.EndSessionEndpointPath+logoutRequestParams))
+
+			r.False(fallbackHandlerWasCalled)
+
+			// Minimal check to ensure that the right endpoint was called
+			r.Equal(http.StatusOK, recorder.Code)
+			r.Equal("You have been logged out.\n", recorder.Body.String())
+
+			// Make sure that we wired up the end session endpoint to use kube storage for fosite sessions.
+			r.Greater(len(kubeClient.Actions()), numberOfKubeActionsBeforeThisRequest,
+				"did not perform any kube actions during the logout request, but should have")
 		}
 
 		requireJWKSRequestToBeHandled := func(requestIssuer, requestURLSuffix, expectedJWKKeyID string) *jose.JSONWebKeySet {
@@ -283,7 +420,7 @@ func TestManager(t *testing.T) {
 			cache.SetStateEncoderHashKey(issuer2, []byte("some-state-encoder-hash-key-2"))
 			cache.SetStateEncoderBlockKey(issuer2, []byte("16-bytes-STATE02"))
 
-			subject = NewManager(nextHandler, dynamicJWKSProvider, idpLister, &cache, secretsClient)
+			subject = NewManager(nextHandler, dynamicJWKSProvider, idpLister, &cache, crud.NewSecretsBackend(secretsClient), nil, oidctestutil.NewClientManager(t, "some-namespace", nil, nil), false)
 		})
 
 		when("given no providers via SetProviders()", func() {
@@ -312,6 +449,12 @@ func TestManager(t *testing.T) {
 			return &k
 		}
 
+		newTestSigner := func(keyID string) signer.Signer {
+			s, err := signer.NewJWKSigner(newTestJWK(keyID))
+			r.NoError(err)
+			return s
+		}
+
 		requireRoutesMatchingRequestsToAppropriateProvider := func() {
 			requireDiscoveryRequestToBeHandled(issuer1, "", issuer1)
 			requireDiscoveryRequestToBeHandled(issuer2, "", issuer2)
@@ -376,19 +519,61 @@ func TestManager(t *testing.T) {
 			downstreamAuthCode3 := requireCallbackRequestToBeHandled(issuer1DifferentCaseHostname, callbackRequestParams1, csrfCookieValue1)
 			downstreamAuthCode4 := requireCallbackRequestToBeHandled(issuer2DifferentCaseHostname, callbackRequestParams2, csrfCookieValue2)
 
-			requireTokenRequestToBeHandled(issuer1, downstreamAuthCode1, issuer1JWKS, issuer1)
-			requireTokenRequestToBeHandled(issuer2, downstreamAuthCode2, issuer2JWKS, issuer2)
+			accessToken1, idToken1 := requireTokenRequestToBeHandled(issuer1, downstreamAuthCode1, issuer1JWKS, issuer1)
+			accessToken2, idToken2 := requireTokenRequestToBeHandled(issuer2, downstreamAuthCode2, issuer2JWKS, issuer2)
+
+			// Hostnames are case-insensitive, so test that we can handle that.
+			accessToken3, idToken3 := requireTokenRequestToBeHandled(issuer1DifferentCaseHostname, downstreamAuthCode3, issuer1JWKS, issuer1)
+			accessToken4, idToken4 := requireTokenRequestToBeHandled(issuer2DifferentCaseHostname, downstreamAuthCode4, issuer2JWKS, issuer2)
+
+			requireUserInfoRequestToBeHandled(issuer1, accessToken1)
+			requireUserInfoRequestToBeHandled(issuer2, accessToken2)
+
+			// Hostnames are case-insensitive, so test that we can handle that.
+			requireUserInfoRequestToBeHandled(issuer1DifferentCaseHostname, accessToken3)
+			requireUserInfoRequestToBeHandled(issuer2DifferentCaseHostname, accessToken4)
+
+			requireIntrospectionRequestToBeHandled(issuer1, accessToken1)
+			requireIntrospectionRequestToBeHandled(issuer2, accessToken2)
+
+			// Hostnames are case-insensitive, so test that we can handle that.
+			requireIntrospectionRequestToBeHandled(issuer1DifferentCaseHostname, accessToken3)
+			requireIntrospectionRequestToBeHandled(issuer2DifferentCaseHostname, accessToken4)
+
+			requireLoginRequestToBeHandled(issuer1)
+			requireLoginRequestToBeHandled(issuer2)
+
+			// Hostnames are case-insensitive, so test that we can handle that.
+			requireLoginRequestToBeHandled(issuer1DifferentCaseHostname)
+			requireLoginRequestToBeHandled(issuer2DifferentCaseHostname)
+
+			requireDeviceRequestsToBeHandled(issuer1)
+			requireDeviceRequestsToBeHandled(issuer2)
+
+			// Hostnames are case-insensitive, so test that we can handle that.
+			requireDeviceRequestsToBeHandled(issuer1DifferentCaseHostname)
+			requireDeviceRequestsToBeHandled(issuer2DifferentCaseHostname)
+
+			requireRevocationRequestToBeHandled(issuer1, accessToken1)
+			requireRevocationRequestToBeHandled(issuer2, accessToken2)
 
 			// Hostnames are case-insensitive, so test that we can handle that.
-			requireTokenRequestToBeHandled(issuer1DifferentCaseHostname, downstreamAuthCode3, issuer1JWKS, issuer1)
-			requireTokenRequestToBeHandled(issuer2DifferentCaseHostname, downstreamAuthCode4, issuer2JWKS, issuer2)
+			requireRevocationRequestToBeHandled(issuer1DifferentCaseHostname, accessToken3)
+			requireRevocationRequestToBeHandled(issuer2DifferentCaseHostname, accessToken4)
+
+			requireLogoutRequestToBeHandled(issuer1, idToken1)
+			requireLogoutRequestToBeHandled(issuer2, idToken2)
+
+			// Hostnames are case-insensitive, so test that we can handle that.
+			requireLogoutRequestToBeHandled(issuer1DifferentCaseHostname, idToken3)
+			requireLogoutRequestToBeHandled(issuer2DifferentCaseHostname, idToken4)
 		}
 
 		when("given some valid providers via SetProviders()", func() {
 			it.Before(func() {
-				p1, err := provider.NewFederationDomainIssuer(issuer1)
+				p1, err := provider.NewFederationDomainIssuer(issuer1, nil, provider.TokenLifespans{}, nil)
 				r.NoError(err)
-				p2, err := provider.NewFederationDomainIssuer(issuer2)
+				p2, err := provider.NewFederationDomainIssuer(issuer2, nil, provider.TokenLifespans{}, nil)
 				r.NoError(err)
 				subject.SetProviders(p1, p2)
 
@@ -396,11 +581,11 @@ func TestManager(t *testing.T) {
 					issuer1: {Keys: []jose.JSONWebKey{*newTestJWK(issuer1KeyID)}},
 					issuer2: {Keys: []jose.JSONWebKey{*newTestJWK(issuer2KeyID)}},
 				}
-				activeJWK := map[string]*jose.JSONWebKey{
-					issuer1: newTestJWK(issuer1KeyID),
-					issuer2: newTestJWK(issuer2KeyID),
+				activeSigners := map[string]signer.Signer{
+					issuer1: newTestSigner(issuer1KeyID),
+					issuer2: newTestSigner(issuer2KeyID),
 				}
-				dynamicJWKSProvider.SetIssuerToJWKSMap(jwksMap, activeJWK)
+				dynamicJWKSProvider.SetIssuerToJWKSMap(jwksMap, activeSigners)
 			})
 
 			it("sends all non-matching host requests to the nextHandler", func() {
@@ -429,9 +614,9 @@ func TestManager(t *testing.T) {
 
 		when("given the same valid providers as arguments to SetProviders() in reverse order", func() {
 			it.Before(func() {
-				p1, err := provider.NewFederationDomainIssuer(issuer1)
+				p1, err := provider.NewFederationDomainIssuer(issuer1, nil, provider.TokenLifespans{}, nil)
 				r.NoError(err)
-				p2, err := provider.NewFederationDomainIssuer(issuer2)
+				p2, err := provider.NewFederationDomainIssuer(issuer2, nil, provider.TokenLifespans{}, nil)
 				r.NoError(err)
 				subject.SetProviders(p2, p1)
 
@@ -439,16 +624,96 @@ func TestManager(t *testing.T) {
 					issuer1: {Keys: []jose.JSONWebKey{*newTestJWK(issuer1KeyID)}},
 					issuer2: {Keys: []jose.JSONWebKey{*newTestJWK(issuer2KeyID)}},
 				}
-				activeJWK := map[string]*jose.JSONWebKey{
-					issuer1: newTestJWK(issuer1KeyID),
-					issuer2: newTestJWK(issuer2KeyID),
+				activeSigners := map[string]signer.Signer{
+					issuer1: newTestSigner(issuer1KeyID),
+					issuer2: newTestSigner(issuer2KeyID),
 				}
-				dynamicJWKSProvider.SetIssuerToJWKSMap(jwksMap, activeJWK)
+				dynamicJWKSProvider.SetIssuerToJWKSMap(jwksMap, activeSigners)
 			})
 
 			it("still routes matching requests to the appropriate provider", func() {
 				requireRoutesMatchingRequestsToAppropriateProvider()
 			})
 		})
+
+		when("the session encryption keys of some providers are not loaded yet", func() {
+			var sessionKeys fakeSessionEncryptionKeys
+
+			it.Before(func() {
+				sessionKeys = fakeSessionEncryptionKeys{issuer1: true}
+				subject.sessionKeys = sessionKeys
+
+				p1, err := provider.NewFederationDomainIssuer(issuer1, nil, provider.TokenLifespans{}, nil)
+				r.NoError(err)
+				p2, err := provider.NewFederationDomainIssuer(issuer2, nil, provider.TokenLifespans{}, nil)
+				r.NoError(err)
+				subject.SetProviders(p1, p2)
+			})
+
+			it("rejects the requests which use the stored sessions of those providers until their keys are loaded", func() {
+				requireDiscoveryRequestToBeHandled(issuer2, "", issuer2)
+
+				recorder := httptest.NewRecorder()
+				subject.ServeHTTP(recorder, newPostRequest(issuer2+oidc.TokenEndpointPath, ""))
+				r.False(fallbackHandlerWasCalled)
+				r.Equal(http.StatusServiceUnavailable, recorder.Code)
+				r.Equal("5", recorder.Header().Get("Retry-After"))
+				r.Equal("Service Unavailable: session encryption keys are not loaded yet\n", recorder.Body.String())
+
+				recorder = httptest.NewRecorder()
+				subject.ServeHTTP(recorder, newPostRequest(issuer1+oidc.TokenEndpointPath, ""))
+				r.Equal(http.StatusBadRequest, recorder.Code)
+
+				sessionKeys[issuer2] = true
+				recorder = httptest.NewRecorder()
+				subject.ServeHTTP(recorder, newPostRequest(issuer2+oidc.TokenEndpointPath, ""))
+				r.Equal(http.StatusBadRequest, recorder.Code)
+			})
+		})
+
+		when("given providers which restrict which upstream IDPs they may use", func() {
+			it.Before(func() {
+				p1, err := provider.NewFederationDomainIssuer(issuer1, []provider.FederationDomainIdentityProvider{
+					{Name: upstreamIDPName, Type: psession.ProviderTypeOIDC},
+				}, provider.TokenLifespans{}, nil)
+				r.NoError(err)
+				p2, err := provider.NewFederationDomainIssuer(issuer2, []provider.FederationDomainIdentityProvider{
+					{Name: upstreamIDPName, Type: psession.ProviderTypeLDAP}, // same name but a different type
+				}, provider.TokenLifespans{}, nil)
+				r.NoError(err)
+				subject.SetProviders(p1, p2)
+			})
+
+			it("only exposes the allowed upstream IDPs to each provider", func() {
+				requirePinnipedIDPsDiscoveryRequestToBeHandled(issuer1, "", upstreamIDPName, upstreamIDPType, upstreamIDPFlows)
+
+				recorder := httptest.NewRecorder()
+				subject.ServeHTTP(recorder, newGetRequest(issuer2+oidc.PinnipedIDPsPathV1Alpha1))
+				r.False(fallbackHandlerWasCalled)
+				r.Equal(http.StatusOK, recorder.Code)
+				r.Equal(`{"pinniped_identity_providers":[]}`+"\n", recorder.Body.String())
+
+				recorder = httptest.NewRecorder()
+				subject.ServeHTTP(recorder, newGetRequest(issuer2+oidc.AuthorizationEndpointPath+"?"+url.Values{
+					"response_type":         []string{"code"},
+					"scope":                 []string{"openid profile email"},
+					"client_id":             []string{"pinniped-cli"},
+					"state":                 []string{"some-state-value-with-enough-bytes-to-exceed-min-allowed"},
+					"nonce":                 []string{"some-nonce-value-with-enough-bytes-to-exceed-min-allowed"},
+					"code_challenge":        []string{"some-challenge"},
+					"code_challenge_method": []string{"S256"},
+					"redirect_uri":          []string{downstreamRedirectURL},
+				}.Encode()))
+				r.False(fallbackHandlerWasCalled)
+				r.Equal(http.StatusUnprocessableEntity, recorder.Code)
+				r.Equal("Unprocessable Entity: No upstream providers are configured\n", recorder.Body.String())
+			})
+		})
 	})
 }
+
+type fakeSessionEncryptionKeys map[string]bool
+
+func (f fakeSessionEncryptionKeys) HasActiveKey(issuer string) bool {
+	return f[issuer]
+}
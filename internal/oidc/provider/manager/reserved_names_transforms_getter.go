@@ -0,0 +1,26 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package manager
+
+import (
+	"go.pinniped.dev/internal/idtransform"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/psession"
+)
+
+// reservedNamesIdentityTransformsGetter is an oidc.IdentityTransformsGetter which appends the reserved names
+// policy to the end of the identity transformations of a FederationDomain, so the policy is enforced on the
+// final downstream identity during logins and refreshes.
+type reservedNamesIdentityTransformsGetter struct {
+	delegate oidc.IdentityTransformsGetter
+}
+
+var _ oidc.IdentityTransformsGetter = (*reservedNamesIdentityTransformsGetter)(nil)
+
+func (g *reservedNamesIdentityTransformsGetter) IdentityTransforms(idpName string, idpType psession.ProviderType) *idtransform.TransformationPipeline {
+	pipeline := idtransform.NewTransformationPipeline()
+	pipeline.AppendTransformation(g.delegate.IdentityTransforms(idpName, idpType))
+	pipeline.AppendTransformation(idtransform.NewReservedNamesPolicy())
+	return pipeline
+}
@@ -0,0 +1,44 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package manager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/idtransform"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/psession"
+	"go.pinniped.dev/internal/testutil/oidctestutil"
+)
+
+func TestReservedNamesIdentityTransformsGetter(t *testing.T) {
+	prefixTransforms := idtransform.NewTransformationPipeline()
+	prefixTransforms.AppendTransformation(idtransform.NewUsernamePrefixTransformation("system:"))
+
+	subject := &reservedNamesIdentityTransformsGetter{
+		delegate: oidctestutil.NewIdentityTransformsGetter(t, []provider.FederationDomainIdentityProvider{
+			{Name: "prefixed-idp", Type: psession.ProviderTypeOIDC, Transforms: prefixTransforms},
+		}),
+	}
+
+	// The policy applies to the result of the FederationDomain's transforms.
+	result, err := subject.IdentityTransforms("prefixed-idp", psession.ProviderTypeOIDC).Evaluate("admin", nil)
+	require.NoError(t, err)
+	require.False(t, result.AuthenticationAllowed)
+	require.Equal(t, `username "system:admin" uses the reserved prefix "system:"`, result.RejectedAuthenticationMessage)
+
+	// The policy also applies to identity providers which have no transforms.
+	result, err = subject.IdentityTransforms("other-idp", psession.ProviderTypeLDAP).Evaluate("ryan", []string{"system:masters"})
+	require.NoError(t, err)
+	require.False(t, result.AuthenticationAllowed)
+	require.Equal(t, `group "system:masters" uses the reserved prefix "system:"`, result.RejectedAuthenticationMessage)
+
+	result, err = subject.IdentityTransforms("other-idp", psession.ProviderTypeLDAP).Evaluate("ryan", []string{"developers"})
+	require.NoError(t, err)
+	require.True(t, result.AuthenticationAllowed)
+	require.Equal(t, "ryan", result.Username)
+	require.Equal(t, []string{"developers"}, result.Groups)
+}
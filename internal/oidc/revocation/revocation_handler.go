@@ -0,0 +1,133 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package revocation provides a handler for the OAuth 2.0 token revocation endpoint (RFC 7009).
+package revocation
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/ory/fosite"
+	fositeoauth2 "github.com/ory/fosite/handler/oauth2"
+	"github.com/ory/fosite/token/hmac"
+
+	"go.pinniped.dev/internal/httputil/httperr"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/psession"
+)
+
+// The downstream access and refresh tokens are opaque HMAC tokens, and their sessions are stored by their signature.
+// Calculating the signature of a token does not require the HMAC key, so this strategy does not need one.
+var tokenSignatureStrategy = &fositeoauth2.HMACSHAStrategy{Enigma: &hmac.HMACStrategy{}}
+
+// NewHandler returns an http.Handler which revokes downstream access and refresh tokens. Revoking either one
+// revokes the whole downstream session. When the session holds an upstream OIDC refresh or access token, then
+// that token is also revoked at the upstream OIDC provider.
+func NewHandler(
+	idpLister oidc.UpstreamIdentityProvidersLister,
+	oauthHelper fosite.OAuth2Provider,
+	oauthStore fositeoauth2.TokenRevocationStorage,
+) http.Handler {
+	return httperr.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		// Fosite will delete the downstream session from storage, so look up the upstream tokens which it holds first.
+		// Fosite will decide whether the request is valid, so any problem finding the session is ignored here.
+		var session *psession.PinnipedSession
+		if r.Method == http.MethodPost && r.ParseForm() == nil {
+			session = findSession(r.Context(), oauthStore, r.PostForm.Get("token"), fosite.TokenType(r.PostForm.Get("token_type_hint")))
+		}
+
+		// This authenticates the client, checks that the token was issued to that client, and revokes the session.
+		err := oauthHelper.NewRevocationRequest(r.Context(), r)
+		if err != nil {
+			plog.Info("revocation request error", oidc.FositeErrorForLog(err)...)
+			oauthHelper.WriteRevocationResponse(w, err)
+			return nil
+		}
+
+		// The downstream session is already revoked, so a failure to revoke the upstream token is not reported to
+		// the client. The upstream token may still expire or be revoked by the upstream provider later.
+		if session != nil {
+			if err := RevokeUpstreamOIDCTokens(r.Context(), idpLister, session.Custom); err != nil {
+				plog.WarningErr("failed to revoke upstream token during downstream token revocation", err,
+					"providerName", session.Custom.ProviderName, "providerUID", session.Custom.ProviderUID)
+			}
+		}
+
+		oauthHelper.WriteRevocationResponse(w, nil)
+		return nil
+	})
+}
+
+// findSession looks up the session of a downstream refresh token or access token, using the same order as fosite.
+// It returns nil when the token is not found.
+func findSession(ctx context.Context, oauthStore fositeoauth2.TokenRevocationStorage, token string, tokenTypeHint fosite.TokenType) *psession.PinnipedSession {
+	getters := []func() (fosite.Requester, error){
+		func() (fosite.Requester, error) {
+			return oauthStore.GetRefreshTokenSession(ctx, tokenSignatureStrategy.RefreshTokenSignature(token), nil)
+		},
+		func() (fosite.Requester, error) {
+			return oauthStore.GetAccessTokenSession(ctx, tokenSignatureStrategy.AccessTokenSignature(token), nil)
+		},
+	}
+	if tokenTypeHint == fosite.AccessToken {
+		getters[0], getters[1] = getters[1], getters[0]
+	}
+
+	for _, getter := range getters {
+		requester, err := getter()
+		if err != nil {
+			continue
+		}
+		if session, ok := requester.GetSession().(*psession.PinnipedSession); ok && session.Custom != nil {
+			return session
+		}
+	}
+	return nil
+}
+
+// RevokeUpstreamOIDCTokens revokes the upstream OIDC refresh and access tokens which are held by a downstream session.
+// It does nothing when the downstream session was not created using an upstream OIDC provider.
+func RevokeUpstreamOIDCTokens(
+	ctx context.Context,
+	idpLister oidc.UpstreamOIDCIdentityProvidersLister,
+	customSessionData *psession.CustomSessionData,
+) error {
+	// When the session was for another upstream IDP type, e.g. LDAP, there is no upstream OIDC token involved.
+	if customSessionData.ProviderType != psession.ProviderTypeOIDC || customSessionData.OIDC == nil {
+		return nil
+	}
+
+	// Try to find the provider that was originally used to create the stored session.
+	var foundOIDCIdentityProviderI provider.UpstreamOIDCIdentityProviderI
+	for _, p := range idpLister.GetOIDCIdentityProviders() {
+		if p.GetName() == customSessionData.ProviderName && p.GetResourceUID() == customSessionData.ProviderUID {
+			foundOIDCIdentityProviderI = p
+			break
+		}
+	}
+	if foundOIDCIdentityProviderI == nil {
+		return fmt.Errorf("could not find upstream OIDC provider named %q with resource UID %q",
+			customSessionData.ProviderName, customSessionData.ProviderUID)
+	}
+
+	// In practice, there should only be one of these tokens saved in the session.
+	if upstreamRefreshToken := customSessionData.OIDC.UpstreamRefreshToken; upstreamRefreshToken != "" {
+		if err := foundOIDCIdentityProviderI.RevokeToken(ctx, upstreamRefreshToken, provider.RefreshTokenType); err != nil {
+			return err
+		}
+		plog.Trace("revoked upstream OIDC refresh token (or provider has no revocation endpoint)", "providerName", customSessionData.ProviderName)
+	}
+
+	if upstreamAccessToken := customSessionData.OIDC.UpstreamAccessToken; upstreamAccessToken != "" {
+		if err := foundOIDCIdentityProviderI.RevokeToken(ctx, upstreamAccessToken, provider.AccessTokenType); err != nil {
+			return err
+		}
+		plog.Trace("revoked upstream OIDC access token (or provider has no revocation endpoint)", "providerName", customSessionData.ProviderName)
+	}
+
+	return nil
+}
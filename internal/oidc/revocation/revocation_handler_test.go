@@ -0,0 +1,329 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package revocation
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/compose"
+	"github.com/ory/fosite/handler/openid"
+	"github.com/ory/fosite/token/jwt"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+
+	configv1alpha1 "go.pinniped.dev/generated/latest/apis/supervisor/config/v1alpha1"
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/fositestorage/accesstoken"
+	"go.pinniped.dev/internal/fositestorage/refreshtoken"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/clientregistry"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/psession"
+	"go.pinniped.dev/internal/testutil"
+	"go.pinniped.dev/internal/testutil/oidctestutil"
+)
+
+const (
+	namespace = "some-namespace"
+
+	upstreamOIDCName = "some-oidc-idp"
+	upstreamOIDCUID  = types.UID("some-oidc-idp-uid")
+	upstreamLDAPName = "some-ldap-idp"
+	upstreamLDAPUID  = types.UID("some-ldap-idp-uid")
+
+	upstreamRefreshToken = "some-upstream-refresh-token"
+	upstreamAccessToken  = "some-upstream-access-token"
+
+	confidentialClientID     = "client.oauth.pinniped.dev-test"
+	confidentialClientSecret = "some-client-secret"
+	// confidentialClientSecretHash is a bcrypt hash of "some-client-secret" with cost 12.
+	confidentialClientSecretHash = "$2a$12$yHGWWZy/UWGN7V0ETyyP/etrfr1n0GOdWpwJt3HxUqBlar/3Z3.D6"
+)
+
+func TestRevocationHandler(t *testing.T) {
+	hmacSecret := []byte("some secret - must have at least 32 bytes")
+
+	oidcCustomSessionData := func() *psession.CustomSessionData {
+		return &psession.CustomSessionData{
+			ProviderUID:  upstreamOIDCUID,
+			ProviderName: upstreamOIDCName,
+			ProviderType: psession.ProviderTypeOIDC,
+			OIDC:         &psession.OIDCSessionData{UpstreamRefreshToken: upstreamRefreshToken},
+		}
+	}
+
+	tests := []struct {
+		name string
+
+		customSessionData *psession.CustomSessionData
+		storedForClientID string
+		revokeTokenErr    error
+
+		// Returns the form and basic auth credentials of the request, given the stored tokens.
+		request func(accessToken, refreshToken string) (url.Values, *url.Userinfo)
+		method  string
+
+		wantStatus             int
+		wantBodyContains       string
+		wantSessionRevoked     bool
+		wantUpstreamRevokeArgs *oidctestutil.RevokeTokenArgs
+	}{
+		{
+			name: "revoking the refresh token revokes the session and the upstream refresh token",
+			request: func(_, refreshToken string) (url.Values, *url.Userinfo) {
+				return url.Values{"token": {refreshToken}, "token_type_hint": {"refresh_token"}, "client_id": {"pinniped-cli"}}, nil
+			},
+			wantStatus:             http.StatusOK,
+			wantSessionRevoked:     true,
+			wantUpstreamRevokeArgs: &oidctestutil.RevokeTokenArgs{Token: upstreamRefreshToken, TokenType: provider.RefreshTokenType},
+		},
+		{
+			name: "revoking the access token revokes the session and the upstream refresh token",
+			request: func(accessToken, _ string) (url.Values, *url.Userinfo) {
+				return url.Values{"token": {accessToken}, "token_type_hint": {"access_token"}, "client_id": {"pinniped-cli"}}, nil
+			},
+			wantStatus:             http.StatusOK,
+			wantSessionRevoked:     true,
+			wantUpstreamRevokeArgs: &oidctestutil.RevokeTokenArgs{Token: upstreamRefreshToken, TokenType: provider.RefreshTokenType},
+		},
+		{
+			name: "revoking the access token without a token type hint",
+			request: func(accessToken, _ string) (url.Values, *url.Userinfo) {
+				return url.Values{"token": {accessToken}, "client_id": {"pinniped-cli"}}, nil
+			},
+			wantStatus:             http.StatusOK,
+			wantSessionRevoked:     true,
+			wantUpstreamRevokeArgs: &oidctestutil.RevokeTokenArgs{Token: upstreamRefreshToken, TokenType: provider.RefreshTokenType},
+		},
+		{
+			name: "session with an upstream access token instead of an upstream refresh token",
+			customSessionData: func() *psession.CustomSessionData {
+				d := oidcCustomSessionData()
+				d.OIDC = &psession.OIDCSessionData{UpstreamAccessToken: upstreamAccessToken}
+				return d
+			}(),
+			request: func(_, refreshToken string) (url.Values, *url.Userinfo) {
+				return url.Values{"token": {refreshToken}, "client_id": {"pinniped-cli"}}, nil
+			},
+			wantStatus:             http.StatusOK,
+			wantSessionRevoked:     true,
+			wantUpstreamRevokeArgs: &oidctestutil.RevokeTokenArgs{Token: upstreamAccessToken, TokenType: provider.AccessTokenType},
+		},
+		{
+			name: "session from an LDAP upstream has no upstream token to revoke",
+			customSessionData: &psession.CustomSessionData{
+				ProviderUID:  upstreamLDAPUID,
+				ProviderName: upstreamLDAPName,
+				ProviderType: psession.ProviderTypeLDAP,
+				LDAP:         &psession.LDAPSessionData{UserDN: "some-dn"},
+			},
+			request: func(_, refreshToken string) (url.Values, *url.Userinfo) {
+				return url.Values{"token": {refreshToken}, "client_id": {"pinniped-cli"}}, nil
+			},
+			wantStatus:         http.StatusOK,
+			wantSessionRevoked: true,
+		},
+		{
+			name: "upstream provider of the session no longer exists",
+			customSessionData: func() *psession.CustomSessionData {
+				d := oidcCustomSessionData()
+				d.ProviderUID = "some-other-uid"
+				return d
+			}(),
+			request: func(_, refreshToken string) (url.Values, *url.Userinfo) {
+				return url.Values{"token": {refreshToken}, "client_id": {"pinniped-cli"}}, nil
+			},
+			wantStatus:         http.StatusOK,
+			wantSessionRevoked: true,
+		},
+		{
+			name:           "upstream revocation fails after the downstream session was revoked",
+			revokeTokenErr: errors.New("some upstream revocation error"),
+			request: func(_, refreshToken string) (url.Values, *url.Userinfo) {
+				return url.Values{"token": {refreshToken}, "client_id": {"pinniped-cli"}}, nil
+			},
+			wantStatus:             http.StatusOK,
+			wantSessionRevoked:     true,
+			wantUpstreamRevokeArgs: &oidctestutil.RevokeTokenArgs{Token: upstreamRefreshToken, TokenType: provider.RefreshTokenType},
+		},
+		{
+			name:              "confidential client revokes its own token using client_secret_basic",
+			storedForClientID: confidentialClientID,
+			request: func(_, refreshToken string) (url.Values, *url.Userinfo) {
+				return url.Values{"token": {refreshToken}}, url.UserPassword(confidentialClientID, confidentialClientSecret)
+			},
+			wantStatus:             http.StatusOK,
+			wantSessionRevoked:     true,
+			wantUpstreamRevokeArgs: &oidctestutil.RevokeTokenArgs{Token: upstreamRefreshToken, TokenType: provider.RefreshTokenType},
+		},
+		{
+			name:              "confidential client uses the wrong client secret",
+			storedForClientID: confidentialClientID,
+			request: func(_, refreshToken string) (url.Values, *url.Userinfo) {
+				return url.Values{"token": {refreshToken}}, url.UserPassword(confidentialClientID, "wrong-secret")
+			},
+			wantStatus:       http.StatusUnauthorized,
+			wantBodyContains: `"error":"invalid_client"`,
+		},
+		{
+			name: "token belongs to a different client",
+			request: func(_, refreshToken string) (url.Values, *url.Userinfo) {
+				return url.Values{"token": {refreshToken}}, url.UserPassword(confidentialClientID, confidentialClientSecret)
+			},
+			// RFC 7009 does not allow the server to reveal whether the token exists, so the response is successful.
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "unknown token",
+			request: func(_, _ string) (url.Values, *url.Userinfo) {
+				return url.Values{"token": {"some-unknown-token.some-unknown-signature"}, "client_id": {"pinniped-cli"}}, nil
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:   "wrong HTTP method",
+			method: http.MethodGet,
+			request: func(_, refreshToken string) (url.Values, *url.Userinfo) {
+				return url.Values{"token": {refreshToken}, "client_id": {"pinniped-cli"}}, nil
+			},
+			wantStatus:       http.StatusBadRequest,
+			wantBodyContains: `"error":"invalid_request"`,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			oidcUpstreamBuilder := oidctestutil.NewTestUpstreamOIDCIdentityProviderBuilder().
+				WithName(upstreamOIDCName).
+				WithResourceUID(upstreamOIDCUID)
+			if test.revokeTokenErr != nil {
+				oidcUpstreamBuilder = oidcUpstreamBuilder.WithRevokeTokenError(test.revokeTokenErr)
+			}
+			idps := oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(oidcUpstreamBuilder.Build())
+
+			secrets := fake.NewSimpleClientset().CoreV1().Secrets(namespace)
+			clientManager := oidctestutil.NewClientManager(t, namespace,
+				[]*configv1alpha1.OIDCClient{{
+					ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: confidentialClientID},
+					Spec: configv1alpha1.OIDCClientSpec{
+						AllowedRedirectURIs: []configv1alpha1.RedirectURI{"https://app.example.com/callback"},
+						AllowedGrantTypes:   []configv1alpha1.GrantType{"authorization_code", "refresh_token"},
+						AllowedScopes:       []configv1alpha1.Scope{"openid", "offline_access"},
+						ClientSecret:        configv1alpha1.OIDCClientSecret{SecretName: "some-secret"},
+					},
+				}},
+				[]*corev1.Secret{{
+					ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "some-secret"},
+					Type:       "secrets.pinniped.dev/oidc-client-secret",
+					Data:       map[string][]byte{"clientSecretHash": []byte(confidentialClientSecretHash)},
+				}},
+			)
+			timeoutsConfiguration := oidc.DefaultOIDCTimeoutsConfiguration()
+			oauthStore := oidc.NewKubeStorage(secrets, clientManager, timeoutsConfiguration)
+			oauthHelper := oidc.FositeOauth2Helper(oauthStore, "https://some-issuer.com", func() []byte { return hmacSecret }, nil, timeoutsConfiguration)
+
+			storedForClientID := test.storedForClientID
+			if storedForClientID == "" {
+				storedForClientID = "pinniped-cli"
+			}
+			customSessionData := test.customSessionData
+			if customSessionData == nil {
+				customSessionData = oidcCustomSessionData()
+			}
+			accessToken, refreshToken := createStoredSession(ctx, t, oauthStore, clientManager, storedForClientID, customSessionData, hmacSecret)
+
+			form, basicAuth := test.request(accessToken, refreshToken)
+			method := test.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			req := httptest.NewRequest(method, "/oauth2/revoke", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if basicAuth != nil {
+				password, _ := basicAuth.Password()
+				req.SetBasicAuth(basicAuth.Username(), password)
+			}
+			rsp := httptest.NewRecorder()
+
+			NewHandler(idps.Build(), oauthHelper, oauthStore).ServeHTTP(rsp, req)
+
+			require.Equal(t, test.wantStatus, rsp.Code, "unexpected response body: %s", rsp.Body.String())
+			if test.wantBodyContains != "" {
+				require.Contains(t, rsp.Body.String(), test.wantBodyContains)
+			}
+
+			wantNumberOfSessions := 1
+			if test.wantSessionRevoked {
+				wantNumberOfSessions = 0
+			}
+			testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: accesstoken.TypeLabelValue}, wantNumberOfSessions)
+			testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: refreshtoken.TypeLabelValue}, wantNumberOfSessions)
+
+			if test.wantUpstreamRevokeArgs != nil {
+				test.wantUpstreamRevokeArgs.Ctx = req.Context()
+				idps.RequireExactlyOneCallToRevokeToken(t, upstreamOIDCName, test.wantUpstreamRevokeArgs)
+			} else {
+				idps.RequireExactlyZeroCallsToRevokeToken(t)
+			}
+		})
+	}
+}
+
+// createStoredSession stores a downstream access token session and refresh token session in the same way as
+// the token endpoint, and returns the tokens.
+func createStoredSession(
+	ctx context.Context,
+	t *testing.T,
+	oauthStore *oidc.KubeStorage,
+	clientManager *clientregistry.ClientManager,
+	clientID string,
+	customSessionData *psession.CustomSessionData,
+	hmacSecret []byte,
+) (string, string) {
+	t.Helper()
+
+	client, err := clientManager.GetClient(ctx, clientID)
+	require.NoError(t, err)
+
+	request := &fosite.Request{
+		ID:          "some-request-id",
+		Client:      client,
+		RequestedAt: time.Now().UTC(),
+		Session: &psession.PinnipedSession{
+			Fosite: &openid.DefaultSession{
+				Claims:  &jwt.IDTokenClaims{Subject: "some-subject"},
+				Headers: &jwt.Headers{},
+			},
+			Custom: customSessionData,
+		},
+		RequestedScope: fosite.Arguments{"openid", "offline_access"},
+		GrantedScope:   fosite.Arguments{"openid", "offline_access"},
+		Form:           url.Values{},
+	}
+
+	strategy := compose.NewOAuth2HMACStrategy(&compose.Config{}, hmacSecret, nil)
+	accessToken, accessTokenSignature, err := strategy.GenerateAccessToken(ctx, request)
+	require.NoError(t, err)
+	refreshToken, refreshTokenSignature, err := strategy.GenerateRefreshToken(ctx, request)
+	require.NoError(t, err)
+
+	require.NoError(t, oauthStore.CreateAccessTokenSession(ctx, accessTokenSignature, request))
+	require.NoError(t, oauthStore.CreateRefreshTokenSession(ctx, refreshTokenSignature, request))
+
+	return accessToken, refreshToken
+}
@@ -0,0 +1,107 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package signer
+
+import (
+	"context"
+	"crypto"
+	"strings"
+
+	"github.com/ory/fosite/token/jwt"
+	"gopkg.in/square/go-jose.v2"
+
+	"go.pinniped.dev/internal/constable"
+)
+
+// jwtStrategy is a fosite jwt.JWTStrategy which signs tokens using the algorithm of a Signer. Fosite's own strategies
+// each support only a single algorithm, e.g. jwt.ES256JWTStrategy.
+type jwtStrategy struct {
+	signer Signer
+}
+
+var _ jwt.JWTStrategy = &jwtStrategy{}
+
+// NewJWTStrategy returns a jwt.JWTStrategy which signs tokens with the signer, using the algorithm of its public key.
+func NewJWTStrategy(s Signer) jwt.JWTStrategy {
+	return &jwtStrategy{signer: s}
+}
+
+func (j *jwtStrategy) algorithm() jose.SignatureAlgorithm {
+	return jose.SignatureAlgorithm(j.signer.Public().Algorithm)
+}
+
+// verificationKey returns the public key wrapped in a JWK, because go-jose cannot verify a signature using a
+// pointer to an ed25519.PublicKey, which is what fosite would pass it when given the bare key.
+func (j *jwtStrategy) verificationKey() *jose.JSONWebKey {
+	return &jose.JSONWebKey{Key: j.signer.Public().Key}
+}
+
+func (j *jwtStrategy) Generate(_ context.Context, claims jwt.MapClaims, header jwt.Mapper) (string, string, error) {
+	if header == nil || claims == nil {
+		return "", "", constable.Error("either claims or header is nil")
+	}
+
+	token := jwt.NewWithClaims(j.algorithm(), claims)
+	for k, v := range header.ToMap() {
+		if _, ok := token.Header[k]; !ok {
+			token.Header[k] = v
+		}
+	}
+
+	rawToken, err := token.SignedString(j.signer)
+	if err != nil {
+		return "", "", err
+	}
+	sig, err := j.GetSignature(context.Background(), rawToken)
+	if err != nil {
+		return "", "", err
+	}
+	return rawToken, sig, nil
+}
+
+func (j *jwtStrategy) Validate(ctx context.Context, token string) (string, error) {
+	if _, err := j.Decode(ctx, token); err != nil {
+		return "", err
+	}
+	return j.GetSignature(ctx, token)
+}
+
+func (j *jwtStrategy) Decode(_ context.Context, token string) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(token, jwt.MapClaims{}, func(*jwt.Token) (interface{}, error) {
+		return j.verificationKey(), nil
+	})
+}
+
+func (j *jwtStrategy) GetSignature(_ context.Context, token string) (string, error) {
+	split := strings.Split(token, ".")
+	if len(split) != 3 {
+		return "", constable.Error("header, body and signature must all be set")
+	}
+	return split[2], nil
+}
+
+func (j *jwtStrategy) Hash(_ context.Context, in []byte) ([]byte, error) {
+	h := j.hash().New()
+	if _, err := h.Write(in); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func (j *jwtStrategy) GetSigningMethodLength() int {
+	return j.hash().Size()
+}
+
+// hash returns the hash function which is used for the at_hash and c_hash claims of ID tokens, which is the hash
+// function of the signing algorithm (OpenID Connect Core 1.0, section 3.1.3.6). Ed25519 uses SHA-512.
+func (j *jwtStrategy) hash() crypto.Hash {
+	switch j.algorithm() {
+	case jose.RS384, jose.PS384, jose.ES384:
+		return crypto.SHA384
+	case jose.EdDSA:
+		return crypto.SHA512
+	default:
+		return crypto.SHA256
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package signer
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/ory/fosite/token/jwt"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+	josejwt "gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestJWTStrategy(t *testing.T) {
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name             string
+		key              crypto.Signer
+		alg              jose.SignatureAlgorithm
+		wantMethodLength int
+	}{
+		{name: "RS256", key: rsaKey, alg: jose.RS256, wantMethodLength: 32},
+		{name: "RS384", key: rsaKey, alg: jose.RS384, wantMethodLength: 48},
+		{name: "PS256", key: rsaKey, alg: jose.PS256, wantMethodLength: 32},
+		{name: "ES256", key: p256Key, alg: jose.ES256, wantMethodLength: 32},
+		{name: "ES384", key: p384Key, alg: jose.ES384, wantMethodLength: 48},
+		{name: "EdDSA", key: edKey, alg: jose.EdDSA, wantMethodLength: 64},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s, err := NewJWKSigner(&jose.JSONWebKey{Key: tt.key, KeyID: "some-key-id", Algorithm: string(tt.alg)})
+			require.NoError(t, err)
+			strategy := NewJWTStrategy(s)
+
+			token, sig, err := strategy.Generate(context.Background(),
+				jwt.MapClaims{"sub": "some-subject"},
+				&jwt.Headers{Extra: map[string]interface{}{"typ": "JWT"}},
+			)
+			require.NoError(t, err)
+			require.NotEmpty(t, sig)
+
+			parsed, err := josejwt.ParseSigned(token)
+			require.NoError(t, err)
+			require.Len(t, parsed.Headers, 1)
+			require.Equal(t, string(tt.alg), parsed.Headers[0].Algorithm)
+			require.Equal(t, "some-key-id", parsed.Headers[0].KeyID)
+			require.Equal(t, "JWT", parsed.Headers[0].ExtraHeaders["typ"])
+
+			var claims josejwt.Claims
+			require.NoError(t, parsed.Claims(&jose.JSONWebKey{Key: tt.key.Public()}, &claims))
+			require.Equal(t, "some-subject", claims.Subject)
+
+			decoded, err := strategy.Decode(context.Background(), token)
+			require.NoError(t, err)
+			require.Equal(t, "some-subject", decoded.Claims["sub"])
+
+			validatedSig, err := strategy.Validate(context.Background(), token)
+			require.NoError(t, err)
+			require.Equal(t, sig, validatedSig)
+
+			hash, err := strategy.Hash(context.Background(), []byte("some-access-token"))
+			require.NoError(t, err)
+			require.Len(t, hash, tt.wantMethodLength)
+			require.Equal(t, tt.wantMethodLength, strategy.GetSigningMethodLength())
+		})
+	}
+
+	t.Run("token signed by another key", func(t *testing.T) {
+		otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		otherSigner, err := NewJWKSigner(&jose.JSONWebKey{Key: otherKey})
+		require.NoError(t, err)
+		token, _, err := NewJWTStrategy(otherSigner).Generate(context.Background(), jwt.MapClaims{}, &jwt.Headers{})
+		require.NoError(t, err)
+
+		s, err := NewJWKSigner(&jose.JSONWebKey{Key: p256Key})
+		require.NoError(t, err)
+		_, err = NewJWTStrategy(s).Validate(context.Background(), token)
+		require.EqualError(t, err, "square/go-jose: error in cryptographic primitive")
+	})
+
+	t.Run("nil claims", func(t *testing.T) {
+		s, err := NewJWKSigner(&jose.JSONWebKey{Key: p256Key})
+		require.NoError(t, err)
+		_, _, err = NewJWTStrategy(s).Generate(context.Background(), nil, &jwt.Headers{})
+		require.EqualError(t, err, "either claims or header is nil")
+	})
+}
@@ -0,0 +1,16 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package signer
+
+// PKCS11Config describes an ECDSA P-256 private key in a PKCS#11 token, e.g. in an HSM.
+type PKCS11Config struct {
+	// ModulePath is the path of the PKCS#11 module, which is a shared library provided by the token's vendor.
+	ModulePath string
+	// TokenLabel is the label of the token which holds the key.
+	TokenLabel string
+	// KeyLabel is the label of both the private key and its public key in the token.
+	KeyLabel string
+	// PIN is the PIN of the token's user.
+	PIN string
+}
@@ -0,0 +1,263 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build cgo
+// +build cgo
+
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+	"gopkg.in/square/go-jose.v2"
+
+	"go.pinniped.dev/internal/plog"
+)
+
+// oidNamedCurveP256 is the DER encoding of the P-256 curve's OID, which is the expected value of CKA_EC_PARAMS.
+//nolint:gochecknoglobals
+var oidNamedCurveP256, _ = asn1.Marshal(asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7})
+
+// pkcs11Signer is a crypto.Signer which signs with a private key that never leaves a PKCS#11 token.
+type pkcs11Signer struct {
+	config    PKCS11Config
+	ctx       *pkcs11.Ctx
+	publicKey *ecdsa.PublicKey
+
+	// PKCS#11 sessions must not be used concurrently, so the mutex guards the session and its key handle.
+	mutex      sync.Mutex
+	session    pkcs11.SessionHandle
+	privateKey pkcs11.ObjectHandle
+	hasSession bool
+}
+
+var _ crypto.Signer = &pkcs11Signer{}
+
+// NewPKCS11Signer loads a PKCS#11 module, logs in to the token, and returns a Signer for the private key with the
+// configured label.
+func NewPKCS11Signer(config PKCS11Config) (ExternalSigner, error) {
+	ctx := pkcs11.New(config.ModulePath)
+	if ctx == nil {
+		return nil, fmt.Errorf("cannot load PKCS#11 module %q", config.ModulePath)
+	}
+	if err := ctx.Initialize(); err != nil && !isPKCS11Error(err, pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		ctx.Destroy()
+		return nil, fmt.Errorf("cannot initialize PKCS#11 module %q: %w", config.ModulePath, err)
+	}
+
+	s := &pkcs11Signer{config: config, ctx: ctx}
+	if err := s.init(); err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+
+	cs, err := newCryptoSigner(s, jose.ES256, "")
+	if err != nil {
+		_ = s.Close()
+		return nil, fmt.Errorf("cannot use PKCS#11 key %q: %w", config.KeyLabel, err)
+	}
+	return &externalSigner{Signer: cs, close: s.Close}, nil
+}
+
+func (s *pkcs11Signer) init() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.openSession(); err != nil {
+		return err
+	}
+
+	publicKeyHandle, err := s.findObject(pkcs11.CKO_PUBLIC_KEY)
+	if err != nil {
+		return err
+	}
+	attrs, err := s.ctx.GetAttributeValue(s.session, publicKeyHandle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return fmt.Errorf("cannot read PKCS#11 public key %q: %w", s.config.KeyLabel, err)
+	}
+	s.publicKey, err = parseECPublicKey(attrs[0].Value, attrs[1].Value)
+	if err != nil {
+		return fmt.Errorf("cannot read PKCS#11 public key %q: %w", s.config.KeyLabel, err)
+	}
+	return nil
+}
+
+// openSession opens a session on the configured token, logs in, and finds the private key. The mutex must be held.
+func (s *pkcs11Signer) openSession() error {
+	slot, err := s.findSlot()
+	if err != nil {
+		return err
+	}
+
+	session, err := s.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return fmt.Errorf("cannot open PKCS#11 session: %w", err)
+	}
+	s.session, s.hasSession = session, true
+
+	if err := s.ctx.Login(session, pkcs11.CKU_USER, s.config.PIN); err != nil && !isPKCS11Error(err, pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		s.closeSession()
+		return fmt.Errorf("cannot log in to PKCS#11 token %q: %w", s.config.TokenLabel, err)
+	}
+
+	privateKey, err := s.findObject(pkcs11.CKO_PRIVATE_KEY)
+	if err != nil {
+		s.closeSession()
+		return err
+	}
+	s.privateKey = privateKey
+	return nil
+}
+
+// closeSession closes the current session. The mutex must be held.
+func (s *pkcs11Signer) closeSession() {
+	if !s.hasSession {
+		return
+	}
+	if err := s.ctx.CloseSession(s.session); err != nil {
+		plog.Debug("cannot close PKCS#11 session", "err", err)
+	}
+	s.hasSession = false
+}
+
+func (s *pkcs11Signer) findSlot() (uint, error) {
+	slots, err := s.ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("cannot list PKCS#11 slots: %w", err)
+	}
+	for _, slot := range slots {
+		info, err := s.ctx.GetTokenInfo(slot)
+		if err != nil {
+			return 0, fmt.Errorf("cannot get PKCS#11 token info: %w", err)
+		}
+		if info.Label == s.config.TokenLabel {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("cannot find PKCS#11 token %q", s.config.TokenLabel)
+}
+
+// findObject finds the only key of the given class which has the configured label. The mutex must be held.
+func (s *pkcs11Signer) findObject(class uint) (pkcs11.ObjectHandle, error) {
+	if err := s.ctx.FindObjectsInit(s.session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, s.config.KeyLabel),
+	}); err != nil {
+		return 0, fmt.Errorf("cannot search for PKCS#11 key %q: %w", s.config.KeyLabel, err)
+	}
+	handles, _, err := s.ctx.FindObjects(s.session, 2)
+	if finalErr := s.ctx.FindObjectsFinal(s.session); err == nil {
+		err = finalErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cannot search for PKCS#11 key %q: %w", s.config.KeyLabel, err)
+	}
+
+	kind := "private"
+	if class == pkcs11.CKO_PUBLIC_KEY {
+		kind = "public"
+	}
+	switch len(handles) {
+	case 0:
+		return 0, fmt.Errorf("cannot find PKCS#11 %s key %q", kind, s.config.KeyLabel)
+	case 1:
+		return handles[0], nil
+	default:
+		return 0, fmt.Errorf("found more than one PKCS#11 %s key %q", kind, s.config.KeyLabel)
+	}
+}
+
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign implements crypto.Signer. It returns an ASN.1 DER encoded ECDSA signature of the digest.
+func (s *pkcs11Signer) Sign(_ io.Reader, digest []byte, _ crypto.SignerOpts) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	signature, err := s.sign(digest)
+	if err != nil {
+		// The session may have been invalidated, e.g. when the HSM was restarted, so try once more with a new session.
+		plog.Debug("PKCS#11 signing failed, retrying with a new session", "err", err)
+		s.closeSession()
+		signature, err = s.sign(digest)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot sign with PKCS#11 key %q: %w", s.config.KeyLabel, err)
+	}
+
+	// PKCS#11 returns ECDSA signatures as the concatenation of r and s.
+	if len(signature) == 0 || len(signature)%2 != 0 {
+		return nil, fmt.Errorf("cannot sign with PKCS#11 key %q: unexpected signature length %d", s.config.KeyLabel, len(signature))
+	}
+	half := len(signature) / 2
+	return asn1.Marshal(struct{ R, S *big.Int }{
+		R: new(big.Int).SetBytes(signature[:half]),
+		S: new(big.Int).SetBytes(signature[half:]),
+	})
+}
+
+// sign signs the digest using the current session, opening a new session when needed. The mutex must be held.
+func (s *pkcs11Signer) sign(digest []byte) ([]byte, error) {
+	if !s.hasSession {
+		if err := s.openSession(); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}, s.privateKey); err != nil {
+		return nil, err
+	}
+	return s.ctx.Sign(s.session, digest)
+}
+
+func (s *pkcs11Signer) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.hasSession {
+		if err := s.ctx.Logout(s.session); err != nil && !isPKCS11Error(err, pkcs11.CKR_USER_NOT_LOGGED_IN) {
+			plog.Debug("cannot log out of PKCS#11 token", "err", err)
+		}
+		s.closeSession()
+	}
+	err := s.ctx.Finalize()
+	s.ctx.Destroy()
+	return err
+}
+
+// parseECPublicKey parses the CKA_EC_PARAMS and CKA_EC_POINT attributes of a PKCS#11 P-256 public key.
+func parseECPublicKey(ecParams, ecPoint []byte) (*ecdsa.PublicKey, error) {
+	if string(ecParams) != string(oidNamedCurveP256) {
+		return nil, ErrNotP256
+	}
+
+	// The point should be a DER encoded OCTET STRING, but some modules return the raw point.
+	var point []byte
+	if rest, err := asn1.Unmarshal(ecPoint, &point); err != nil || len(rest) != 0 {
+		point = ecPoint
+	}
+
+	x, y := elliptic.Unmarshal(elliptic.P256(), point)
+	if x == nil {
+		return nil, errors.New("invalid EC point")
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+}
+
+func isPKCS11Error(err error, code uint) bool {
+	var pkcs11Err pkcs11.Error
+	return errors.As(err, &pkcs11Err) && uint(pkcs11Err) == code
+}
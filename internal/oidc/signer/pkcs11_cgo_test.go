@@ -0,0 +1,154 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build cgo
+// +build cgo
+
+package signer
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests run against SoftHSM when PINNIPED_TEST_SOFTHSM2_MODULE is set to the path of its PKCS#11 module,
+// e.g. /usr/lib/softhsm/libsofthsm2.so on Debian and Ubuntu after installing the softhsm2 package.
+func TestPKCS11Signer(t *testing.T) {
+	modulePath := os.Getenv("PINNIPED_TEST_SOFTHSM2_MODULE")
+	if modulePath == "" {
+		t.Skip("set PINNIPED_TEST_SOFTHSM2_MODULE to the path of the SoftHSM PKCS#11 module to run this test")
+	}
+
+	const (
+		tokenLabel = "pinniped-test-token"
+		keyLabel   = "pinniped-test-key"
+		pin        = "1234"
+	)
+
+	// Use a temporary SoftHSM token directory, so that this test does not depend on or change any existing tokens.
+	tokenDir := t.TempDir()
+	configPath := filepath.Join(t.TempDir(), "softhsm2.conf")
+	require.NoError(t, ioutil.WriteFile(configPath, []byte(fmt.Sprintf("directories.tokendir = %s\n", tokenDir)), 0600))
+	t.Setenv("SOFTHSM2_CONF", configPath)
+
+	publicKey := createSoftHSMKey(t, modulePath, tokenLabel, keyLabel, pin)
+	keyID, err := KeyID(publicKey)
+	require.NoError(t, err)
+
+	t.Run("signs with the key", func(t *testing.T) {
+		s, err := NewPKCS11Signer(PKCS11Config{ModulePath: modulePath, TokenLabel: tokenLabel, KeyLabel: keyLabel, PIN: pin})
+		require.NoError(t, err)
+		defer func() { require.NoError(t, s.Close()) }()
+
+		require.Equal(t, publicKey, s.Public().Key)
+		require.Equal(t, keyID, s.Public().KeyID)
+		for i := 0; i < 3; i++ {
+			requireSignsVerifiableJWS(t, s, publicKey, keyID)
+		}
+	})
+
+	for _, tt := range []struct {
+		name    string
+		config  PKCS11Config
+		wantErr string
+	}{
+		{
+			name:    "module does not exist",
+			config:  PKCS11Config{ModulePath: "/does/not/exist.so", TokenLabel: tokenLabel, KeyLabel: keyLabel, PIN: pin},
+			wantErr: `cannot load PKCS#11 module "/does/not/exist.so"`,
+		},
+		{
+			name:    "token does not exist",
+			config:  PKCS11Config{ModulePath: modulePath, TokenLabel: "wrong-token", KeyLabel: keyLabel, PIN: pin},
+			wantErr: `cannot find PKCS#11 token "wrong-token"`,
+		},
+		{
+			name:    "wrong pin",
+			config:  PKCS11Config{ModulePath: modulePath, TokenLabel: tokenLabel, KeyLabel: keyLabel, PIN: "wrong"},
+			wantErr: `cannot log in to PKCS#11 token "pinniped-test-token": pkcs11: 0xA0: CKR_PIN_INCORRECT`,
+		},
+		{
+			name:    "key does not exist",
+			config:  PKCS11Config{ModulePath: modulePath, TokenLabel: tokenLabel, KeyLabel: "wrong-key", PIN: pin},
+			wantErr: `cannot find PKCS#11 private key "wrong-key"`,
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewPKCS11Signer(tt.config)
+			require.EqualError(t, err, tt.wantErr)
+			require.Nil(t, s)
+		})
+	}
+}
+
+// createSoftHSMKey initializes a new token and generates an ECDSA P-256 key pair in it.
+func createSoftHSMKey(t *testing.T, modulePath, tokenLabel, keyLabel, pin string) *ecdsa.PublicKey {
+	t.Helper()
+
+	const soPIN = "5678"
+
+	ctx := pkcs11.New(modulePath)
+	require.NotNil(t, ctx)
+	require.NoError(t, ctx.Initialize())
+	defer func() {
+		require.NoError(t, ctx.Finalize())
+		ctx.Destroy()
+	}()
+
+	// SoftHSM always has one slot with an uninitialized token.
+	slots, err := ctx.GetSlotList(false)
+	require.NoError(t, err)
+	require.NotEmpty(t, slots)
+	require.NoError(t, ctx.InitToken(slots[0], soPIN, tokenLabel))
+
+	// Initializing the token gives it a new slot ID, so find it again.
+	s := &pkcs11Signer{ctx: ctx, config: PKCS11Config{TokenLabel: tokenLabel, KeyLabel: keyLabel}}
+	slot, err := s.findSlot()
+	require.NoError(t, err)
+
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.CloseSession(session)) }()
+
+	require.NoError(t, ctx.Login(session, pkcs11.CKU_SO, soPIN))
+	require.NoError(t, ctx.InitPIN(session, pin))
+	require.NoError(t, ctx.Logout(session))
+	require.NoError(t, ctx.Login(session, pkcs11.CKU_USER, pin))
+	defer func() { require.NoError(t, ctx.Logout(session)) }()
+
+	publicKeyHandle, _, err := ctx.GenerateKeyPair(session,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_EC_KEY_PAIR_GEN, nil)},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, oidNamedCurveP256),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, keyLabel),
+		},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, keyLabel),
+		},
+	)
+	require.NoError(t, err)
+
+	attrs, err := ctx.GetAttributeValue(session, publicKeyHandle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	require.NoError(t, err)
+	publicKey, err := parseECPublicKey(attrs[0].Value, attrs[1].Value)
+	require.NoError(t, err)
+	return publicKey
+}
@@ -0,0 +1,18 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !cgo
+// +build !cgo
+
+package signer
+
+import "go.pinniped.dev/internal/constable"
+
+// ErrPKCS11Unsupported is returned when the Supervisor was built without cgo, which is needed to load a
+// PKCS#11 module.
+const ErrPKCS11Unsupported = constable.Error("PKCS#11 signers require a build of the Supervisor with cgo enabled")
+
+// NewPKCS11Signer always fails, since loading a PKCS#11 module requires cgo.
+func NewPKCS11Signer(_ PKCS11Config) (ExternalSigner, error) {
+	return nil, ErrPKCS11Unsupported
+}
@@ -0,0 +1,137 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package signer
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"gopkg.in/square/go-jose.v2"
+
+	"go.pinniped.dev/internal/constable"
+	"go.pinniped.dev/internal/plog"
+	pluginv1alpha1 "go.pinniped.dev/pkg/signerplugin/v1alpha1"
+)
+
+const (
+	// PluginAPIVersion is the version of the signer plugin protocol which is spoken by the Supervisor.
+	PluginAPIVersion = "v1alpha1"
+
+	unixEndpointPrefix = "unix://"
+)
+
+// PluginConfig describes how to connect to a signer plugin.
+type PluginConfig struct {
+	// Endpoint is the unix domain socket on which the plugin listens, e.g. unix:///var/run/signer/socket.sock.
+	Endpoint string
+	// Timeout is the maximum duration of each call to the plugin.
+	Timeout time.Duration
+}
+
+// pluginSigner is a crypto.Signer which sends signing requests to a signer plugin over gRPC.
+type pluginSigner struct {
+	client    pluginv1alpha1.SignerServiceClient
+	timeout   time.Duration
+	keyID     string
+	publicKey crypto.PublicKey
+}
+
+var _ crypto.Signer = &pluginSigner{}
+
+// NewPluginSigner connects to a signer plugin, checks that it speaks the same version of the protocol, and returns
+// a Signer for the plugin's key.
+func NewPluginSigner(ctx context.Context, config PluginConfig) (ExternalSigner, error) {
+	if !strings.HasPrefix(config.Endpoint, unixEndpointPrefix) {
+		return nil, fmt.Errorf("signer plugin endpoint %q must start with %q", config.Endpoint, unixEndpointPrefix)
+	}
+	socketPath := strings.TrimPrefix(config.Endpoint, unixEndpointPrefix)
+
+	conn, err := grpc.Dial(
+		socketPath,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to signer plugin %q: %w", config.Endpoint, err)
+	}
+
+	s := &pluginSigner{client: pluginv1alpha1.NewSignerServiceClient(conn), timeout: config.Timeout}
+	if err := s.init(ctx); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("cannot use signer plugin %q: %w", config.Endpoint, err)
+	}
+
+	cs, err := newCryptoSigner(s, jose.ES256, s.keyID)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("cannot use signer plugin %q: %w", config.Endpoint, err)
+	}
+	return &externalSigner{Signer: cs, close: conn.Close}, nil
+}
+
+func (s *pluginSigner) init(ctx context.Context) error {
+	versionCtx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	version, err := s.client.Version(versionCtx, &pluginv1alpha1.VersionRequest{Version: PluginAPIVersion})
+	if err != nil {
+		return fmt.Errorf("cannot get version: %w", err)
+	}
+	if version.Version != PluginAPIVersion {
+		return fmt.Errorf("plugin implements version %q of the protocol instead of %q", version.Version, PluginAPIVersion)
+	}
+	plog.Info("connected to signer plugin",
+		"runtimeName", version.RuntimeName,
+		"runtimeVersion", version.RuntimeVersion,
+	)
+
+	publicKeyCtx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	publicKey, err := s.client.PublicKey(publicKeyCtx, &pluginv1alpha1.PublicKeyRequest{Version: PluginAPIVersion})
+	if err != nil {
+		return fmt.Errorf("cannot get public key: %w", err)
+	}
+	s.publicKey, err = x509.ParsePKIXPublicKey(publicKey.PublicKey)
+	if err != nil {
+		return fmt.Errorf("cannot parse public key: %w", err)
+	}
+	s.keyID = publicKey.KeyId
+	return nil
+}
+
+func (s *pluginSigner) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign implements crypto.Signer. The plugin returns an ASN.1 DER encoded ECDSA signature of the digest.
+func (s *pluginSigner) Sign(_ io.Reader, digest []byte, _ crypto.SignerOpts) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	response, err := s.client.Sign(ctx, &pluginv1alpha1.SignRequest{
+		Version: PluginAPIVersion,
+		KeyId:   s.keyID,
+		Digest:  digest,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("signer plugin cannot sign: %w", err)
+	}
+
+	// Catch a plugin which has started to use a different key, since its signatures would not verify with the
+	// public key which is published in the JWKS.
+	if publicKey, ok := s.publicKey.(*ecdsa.PublicKey); !ok || !ecdsa.VerifyASN1(publicKey, digest, response.Signature) {
+		return nil, constable.Error("signer plugin returned a signature which does not verify with its public key")
+	}
+	return response.Signature, nil
+}
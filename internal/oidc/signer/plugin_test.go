@@ -0,0 +1,185 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package signer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"gopkg.in/square/go-jose.v2"
+
+	pluginv1alpha1 "go.pinniped.dev/pkg/signerplugin/v1alpha1"
+)
+
+// fakePlugin is a signer plugin which signs with an in-memory key.
+type fakePlugin struct {
+	pluginv1alpha1.UnimplementedSignerServiceServer
+
+	version   string
+	publicKey []byte
+	keyID     string
+	signKey   *ecdsa.PrivateKey
+	signErr   error
+
+	mutex        sync.Mutex
+	signRequests []*pluginv1alpha1.SignRequest
+}
+
+func (p *fakePlugin) Version(_ context.Context, _ *pluginv1alpha1.VersionRequest) (*pluginv1alpha1.VersionResponse, error) {
+	return &pluginv1alpha1.VersionResponse{Version: p.version, RuntimeName: "fake", RuntimeVersion: "0.0.1"}, nil
+}
+
+func (p *fakePlugin) PublicKey(_ context.Context, _ *pluginv1alpha1.PublicKeyRequest) (*pluginv1alpha1.PublicKeyResponse, error) {
+	return &pluginv1alpha1.PublicKeyResponse{PublicKey: p.publicKey, KeyId: p.keyID}, nil
+}
+
+func (p *fakePlugin) Sign(_ context.Context, req *pluginv1alpha1.SignRequest) (*pluginv1alpha1.SignResponse, error) {
+	p.mutex.Lock()
+	p.signRequests = append(p.signRequests, req)
+	p.mutex.Unlock()
+
+	if p.signErr != nil {
+		return nil, p.signErr
+	}
+	signature, err := ecdsa.SignASN1(rand.Reader, p.signKey, req.Digest)
+	if err != nil {
+		return nil, err
+	}
+	return &pluginv1alpha1.SignResponse{Signature: signature}, nil
+}
+
+func TestPluginSigner(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ecPublicKeyDER, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	require.NoError(t, err)
+	thumbprintKeyID, err := KeyID(&ecKey.PublicKey)
+	require.NoError(t, err)
+
+	otherECKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rsaPublicKeyDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		plugin        *fakePlugin
+		endpoint      func(socketPath string) string
+		wantKeyID     string
+		wantNewErr    string
+		wantSignErr   string
+		wantSignCalls int
+	}{
+		{
+			name:          "plugin with a key ID",
+			plugin:        &fakePlugin{version: "v1alpha1", publicKey: ecPublicKeyDER, keyID: "some-key-id", signKey: ecKey},
+			wantKeyID:     "some-key-id",
+			wantSignCalls: 1,
+		},
+		{
+			name:          "plugin without a key ID uses the thumbprint",
+			plugin:        &fakePlugin{version: "v1alpha1", publicKey: ecPublicKeyDER, signKey: ecKey},
+			wantKeyID:     thumbprintKeyID,
+			wantSignCalls: 1,
+		},
+		{
+			name:       "endpoint which is not a unix socket",
+			plugin:     &fakePlugin{version: "v1alpha1", publicKey: ecPublicKeyDER, signKey: ecKey},
+			endpoint:   func(_ string) string { return "tcp://127.0.0.1:1234" },
+			wantNewErr: `signer plugin endpoint "tcp://127.0.0.1:1234" must start with "unix://"`,
+		},
+		{
+			name:       "plugin which implements a different version",
+			plugin:     &fakePlugin{version: "v2", publicKey: ecPublicKeyDER, signKey: ecKey},
+			wantNewErr: `cannot use signer plugin "unix://SOCKET": plugin implements version "v2" of the protocol instead of "v1alpha1"`,
+		},
+		{
+			name:       "plugin with an invalid public key",
+			plugin:     &fakePlugin{version: "v1alpha1", publicKey: []byte{}, signKey: ecKey},
+			wantNewErr: `cannot use signer plugin "unix://SOCKET": cannot parse public key: asn1: syntax error: sequence truncated`,
+		},
+		{
+			name:       "plugin with an rsa key",
+			plugin:     &fakePlugin{version: "v1alpha1", publicKey: rsaPublicKeyDER},
+			wantNewErr: `cannot use signer plugin "unix://SOCKET": JWK must be of type ecdsa`,
+		},
+		{
+			name:          "plugin which fails to sign",
+			plugin:        &fakePlugin{version: "v1alpha1", publicKey: ecPublicKeyDER, signErr: errors.New("some sign error")},
+			wantSignErr:   "signer plugin cannot sign: rpc error: code = Unknown desc = some sign error",
+			wantSignCalls: 1,
+		},
+		{
+			name:          "plugin which signs with a different key",
+			plugin:        &fakePlugin{version: "v1alpha1", publicKey: ecPublicKeyDER, signKey: otherECKey},
+			wantSignErr:   "signer plugin returned a signature which does not verify with its public key",
+			wantSignCalls: 1,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			socketPath := filepath.Join(t.TempDir(), "socket.sock")
+			listener, err := net.Listen("unix", socketPath)
+			require.NoError(t, err)
+			server := grpc.NewServer()
+			pluginv1alpha1.RegisterSignerServiceServer(server, tt.plugin)
+			go func() { _ = server.Serve(listener) }()
+			t.Cleanup(server.Stop)
+
+			endpoint := "unix://" + socketPath
+			if tt.endpoint != nil {
+				endpoint = tt.endpoint(socketPath)
+			}
+
+			s, err := NewPluginSigner(context.Background(), PluginConfig{Endpoint: endpoint, Timeout: 10 * time.Second})
+			if tt.wantNewErr != "" {
+				require.EqualError(t, err, replaceSocket(tt.wantNewErr, socketPath))
+				require.Nil(t, s)
+				return
+			}
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, s.Close()) })
+
+			if tt.wantSignErr != "" {
+				_, err := s.SignPayload([]byte("some payload"), jose.ES256)
+				require.EqualError(t, err, tt.wantSignErr)
+			} else {
+				require.Equal(t, tt.wantKeyID, s.Public().KeyID)
+				requireSignsVerifiableJWS(t, s, &ecKey.PublicKey, tt.wantKeyID)
+			}
+
+			tt.plugin.mutex.Lock()
+			defer tt.plugin.mutex.Unlock()
+			require.Len(t, tt.plugin.signRequests, tt.wantSignCalls)
+			for _, req := range tt.plugin.signRequests {
+				require.Equal(t, "v1alpha1", req.Version)
+				require.Equal(t, tt.plugin.keyID, req.KeyId)
+				require.Len(t, req.Digest, 32)
+			}
+		})
+	}
+}
+
+func replaceSocket(s, socketPath string) string {
+	return strings.ReplaceAll(s, "unix://SOCKET", "unix://"+socketPath)
+}
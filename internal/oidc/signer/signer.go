@@ -0,0 +1,188 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package signer provides the signers which sign the tokens issued by the Supervisor's FederationDomains. A signer
+// may use a private key which is held in memory, or a private key which never leaves an external system such as
+// an HSM or a KMS.
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/cryptosigner"
+
+	"go.pinniped.dev/internal/constable"
+)
+
+const (
+	// ErrNotECDSA is returned when a key cannot be used to sign ES256 or ES384 tokens.
+	ErrNotECDSA = constable.Error("JWK must be of type ecdsa")
+	// ErrNotP256 is returned when an ECDSA key does not use the P-256 curve, which is required by ES256.
+	ErrNotP256 = constable.Error("ecdsa key must use the P-256 curve")
+	// ErrNotP384 is returned when an ECDSA key does not use the P-384 curve, which is required by ES384.
+	ErrNotP384 = constable.Error("ecdsa key must use the P-384 curve")
+	// ErrNotRSA is returned when a key cannot be used to sign RS256, RS384 or PS256 tokens.
+	ErrNotRSA = constable.Error("JWK must be of type rsa")
+	// ErrRSAKeyTooSmall is returned when an RSA key is shorter than MinRSAKeySize bits.
+	ErrRSAKeyTooSmall = constable.Error("rsa key must be at least 2048 bits long")
+	// ErrNotEd25519 is returned when a key cannot be used to sign EdDSA tokens.
+	ErrNotEd25519 = constable.Error("JWK must be of type ed25519")
+	// ErrNotSigner is returned when a JWK contains a private key which cannot be used for signing.
+	ErrNotSigner = constable.Error("JWK must contain an rsa, ecdsa or ed25519 private key")
+	// ErrPublicJWK is returned when a JWK which should contain a private key only contains a public key.
+	ErrPublicJWK = constable.Error("JWK must contain a private key")
+)
+
+// MinRSAKeySize is the shortest RSA key, in bits, which may be used to sign tokens.
+const MinRSAKeySize = 2048
+
+// Signer signs tokens with a single private key. It is a jose.OpaqueSigner, so it can be used by go-jose and fosite
+// in place of a private key. The key returned by Public() is the public key which verifies the signatures, along
+// with the key ID and algorithm which identify it in a JWKS.
+type Signer interface {
+	jose.OpaqueSigner
+}
+
+// ExternalSigner is a Signer whose private key is held outside of the Supervisor process. External signers always
+// sign ES256 tokens with an ECDSA P-256 key.
+type ExternalSigner interface {
+	Signer
+	// Close releases the connection to the external system.
+	Close() error
+}
+
+// NewJWKSigner returns a Signer for a private key which is held in memory, e.g. a key which was read from a Secret.
+// The Signer signs with the algorithm of the JWK. When the JWK does not name an algorithm, the algorithm is chosen
+// based on the type of the key, see DefaultAlgorithm.
+func NewJWKSigner(jwk *jose.JSONWebKey) (Signer, error) {
+	if jwk.IsPublic() {
+		return nil, ErrPublicJWK
+	}
+	key, ok := jwk.Key.(crypto.Signer)
+	if !ok {
+		return nil, ErrNotSigner
+	}
+	alg := jose.SignatureAlgorithm(jwk.Algorithm)
+	if alg == "" {
+		alg = DefaultAlgorithm(key.Public())
+	}
+	return newCryptoSigner(key, alg, jwk.KeyID)
+}
+
+// DefaultAlgorithm returns the algorithm which is used for a public key when no algorithm was chosen explicitly,
+// or an empty string when the type of the key is not supported.
+func DefaultAlgorithm(publicKey crypto.PublicKey) jose.SignatureAlgorithm {
+	switch k := publicKey.(type) {
+	case *rsa.PublicKey:
+		return jose.RS256
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P384() {
+			return jose.ES384
+		}
+		return jose.ES256
+	case ed25519.PublicKey:
+		return jose.EdDSA
+	default:
+		return ""
+	}
+}
+
+// CheckKey returns an error when a public key cannot be used to sign tokens with the given algorithm.
+func CheckKey(publicKey crypto.PublicKey, alg jose.SignatureAlgorithm) error {
+	switch alg {
+	case jose.RS256, jose.RS384, jose.PS256:
+		k, ok := publicKey.(*rsa.PublicKey)
+		if !ok {
+			return ErrNotRSA
+		}
+		if k.N.BitLen() < MinRSAKeySize {
+			return ErrRSAKeyTooSmall
+		}
+	case jose.ES256, jose.ES384:
+		k, ok := publicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return ErrNotECDSA
+		}
+		if alg == jose.ES256 && k.Curve != elliptic.P256() {
+			return ErrNotP256
+		}
+		if alg == jose.ES384 && k.Curve != elliptic.P384() {
+			return ErrNotP384
+		}
+	case jose.EdDSA:
+		if _, ok := publicKey.(ed25519.PublicKey); !ok {
+			return ErrNotEd25519
+		}
+	default:
+		return fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	return nil
+}
+
+// KeyID returns the key ID which the Supervisor uses for a public key, which is the base64url encoded SHA-256
+// thumbprint of the key (RFC 7638).
+func KeyID(publicKey crypto.PublicKey) (string, error) {
+	thumbprint, err := (&jose.JSONWebKey{Key: publicKey}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", fmt.Errorf("cannot compute key thumbprint: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(thumbprint), nil
+}
+
+// cryptoSigner adapts a crypto.Signer into a Signer for tokens of a single algorithm.
+type cryptoSigner struct {
+	jose.OpaqueSigner
+	public jose.JSONWebKey
+}
+
+// newCryptoSigner returns a Signer for a crypto.Signer which signs with the given algorithm. When keyID is empty,
+// the key's thumbprint is used.
+func newCryptoSigner(s crypto.Signer, alg jose.SignatureAlgorithm, keyID string) (Signer, error) {
+	publicKey := s.Public()
+	if err := CheckKey(publicKey, alg); err != nil {
+		return nil, err
+	}
+
+	if keyID == "" {
+		var err error
+		if keyID, err = KeyID(publicKey); err != nil {
+			return nil, err
+		}
+	}
+
+	return &cryptoSigner{
+		OpaqueSigner: cryptosigner.Opaque(s),
+		public: jose.JSONWebKey{
+			Key:       publicKey,
+			KeyID:     keyID,
+			Algorithm: string(alg),
+			Use:       "sig",
+		},
+	}, nil
+}
+
+func (s *cryptoSigner) Public() *jose.JSONWebKey {
+	public := s.public
+	return &public
+}
+
+func (s *cryptoSigner) Algs() []jose.SignatureAlgorithm {
+	return []jose.SignatureAlgorithm{jose.SignatureAlgorithm(s.public.Algorithm)}
+}
+
+// externalSigner adds a Close method to a Signer.
+type externalSigner struct {
+	Signer
+	close func() error
+}
+
+func (s *externalSigner) Close() error {
+	return s.close()
+}
@@ -0,0 +1,197 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestNewJWKSigner(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	smallRSAKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	edPublicKey, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	thumbprintKeyID, err := KeyID(&ecKey.PublicKey)
+	require.NoError(t, err)
+	rsaThumbprintKeyID, err := KeyID(&rsaKey.PublicKey)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		jwk           *jose.JSONWebKey
+		wantKeyID     string
+		wantAlg       jose.SignatureAlgorithm
+		wantPublicKey crypto.PublicKey
+		wantErr       string
+	}{
+		{
+			name:          "ecdsa key with a key ID",
+			jwk:           &jose.JSONWebKey{Key: ecKey, KeyID: "some-key-id"},
+			wantKeyID:     "some-key-id",
+			wantAlg:       jose.ES256,
+			wantPublicKey: &ecKey.PublicKey,
+		},
+		{
+			name:          "ecdsa key without a key ID uses the thumbprint",
+			jwk:           &jose.JSONWebKey{Key: ecKey},
+			wantKeyID:     thumbprintKeyID,
+			wantAlg:       jose.ES256,
+			wantPublicKey: &ecKey.PublicKey,
+		},
+		{
+			name:          "ecdsa key with the ES256 algorithm",
+			jwk:           &jose.JSONWebKey{Key: ecKey, KeyID: "some-key-id", Algorithm: "ES256"},
+			wantKeyID:     "some-key-id",
+			wantAlg:       jose.ES256,
+			wantPublicKey: &ecKey.PublicKey,
+		},
+		{
+			name:          "P-384 ecdsa key without an algorithm uses ES384",
+			jwk:           &jose.JSONWebKey{Key: p384Key, KeyID: "some-key-id"},
+			wantKeyID:     "some-key-id",
+			wantAlg:       jose.ES384,
+			wantPublicKey: &p384Key.PublicKey,
+		},
+		{
+			name:          "rsa key without an algorithm uses RS256",
+			jwk:           &jose.JSONWebKey{Key: rsaKey},
+			wantKeyID:     rsaThumbprintKeyID,
+			wantAlg:       jose.RS256,
+			wantPublicKey: &rsaKey.PublicKey,
+		},
+		{
+			name:          "rsa key with the RS384 algorithm",
+			jwk:           &jose.JSONWebKey{Key: rsaKey, KeyID: "some-key-id", Algorithm: "RS384"},
+			wantKeyID:     "some-key-id",
+			wantAlg:       jose.RS384,
+			wantPublicKey: &rsaKey.PublicKey,
+		},
+		{
+			name:          "rsa key with the PS256 algorithm",
+			jwk:           &jose.JSONWebKey{Key: rsaKey, KeyID: "some-key-id", Algorithm: "PS256"},
+			wantKeyID:     "some-key-id",
+			wantAlg:       jose.PS256,
+			wantPublicKey: &rsaKey.PublicKey,
+		},
+		{
+			name:          "ed25519 key without an algorithm uses EdDSA",
+			jwk:           &jose.JSONWebKey{Key: edKey, KeyID: "some-key-id"},
+			wantKeyID:     "some-key-id",
+			wantAlg:       jose.EdDSA,
+			wantPublicKey: edPublicKey,
+		},
+		{
+			name:    "public key",
+			jwk:     &jose.JSONWebKey{Key: &ecKey.PublicKey},
+			wantErr: "JWK must contain a private key",
+		},
+		{
+			name:    "symmetric key",
+			jwk:     &jose.JSONWebKey{Key: []byte("some-secret")},
+			wantErr: "JWK must contain an rsa, ecdsa or ed25519 private key",
+		},
+		{
+			name:    "rsa key with the ES256 algorithm",
+			jwk:     &jose.JSONWebKey{Key: rsaKey, Algorithm: "ES256"},
+			wantErr: "JWK must be of type ecdsa",
+		},
+		{
+			name:    "ecdsa key with the RS256 algorithm",
+			jwk:     &jose.JSONWebKey{Key: ecKey, Algorithm: "RS256"},
+			wantErr: "JWK must be of type rsa",
+		},
+		{
+			name:    "ecdsa key with the EdDSA algorithm",
+			jwk:     &jose.JSONWebKey{Key: ecKey, Algorithm: "EdDSA"},
+			wantErr: "JWK must be of type ed25519",
+		},
+		{
+			name:    "ecdsa key on the wrong curve for ES256",
+			jwk:     &jose.JSONWebKey{Key: p384Key, Algorithm: "ES256"},
+			wantErr: "ecdsa key must use the P-256 curve",
+		},
+		{
+			name:    "ecdsa key on the wrong curve for ES384",
+			jwk:     &jose.JSONWebKey{Key: ecKey, Algorithm: "ES384"},
+			wantErr: "ecdsa key must use the P-384 curve",
+		},
+		{
+			name:    "rsa key which is too small",
+			jwk:     &jose.JSONWebKey{Key: smallRSAKey},
+			wantErr: "rsa key must be at least 2048 bits long",
+		},
+		{
+			name:    "unsupported algorithm",
+			jwk:     &jose.JSONWebKey{Key: rsaKey, Algorithm: "RS512"},
+			wantErr: `unsupported signing algorithm "RS512"`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s, err := NewJWKSigner(tt.jwk)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				require.Nil(t, s)
+				return
+			}
+			require.NoError(t, err)
+
+			require.Equal(t, []jose.SignatureAlgorithm{tt.wantAlg}, s.Algs())
+			require.Equal(t, &jose.JSONWebKey{
+				Key:       tt.wantPublicKey,
+				KeyID:     tt.wantKeyID,
+				Algorithm: string(tt.wantAlg),
+				Use:       "sig",
+			}, s.Public())
+
+			requireSignsVerifiableJWSWithAlgorithm(t, s, tt.wantAlg, tt.wantPublicKey, tt.wantKeyID)
+		})
+	}
+}
+
+// requireSignsVerifiableJWS signs an ES256 JWS using the signer and verifies it with the expected public key.
+func requireSignsVerifiableJWS(t *testing.T, s Signer, publicKey *ecdsa.PublicKey, wantKeyID string) {
+	t.Helper()
+	requireSignsVerifiableJWSWithAlgorithm(t, s, jose.ES256, publicKey, wantKeyID)
+}
+
+// requireSignsVerifiableJWSWithAlgorithm signs a JWS using the signer and verifies it with the expected public key.
+func requireSignsVerifiableJWSWithAlgorithm(t *testing.T, s Signer, alg jose.SignatureAlgorithm, publicKey crypto.PublicKey, wantKeyID string) {
+	t.Helper()
+
+	joseSigner, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: s}, nil)
+	require.NoError(t, err)
+	jws, err := joseSigner.Sign([]byte("some payload"))
+	require.NoError(t, err)
+	compact, err := jws.CompactSerialize()
+	require.NoError(t, err)
+
+	parsed, err := jose.ParseSigned(compact)
+	require.NoError(t, err)
+	require.Len(t, parsed.Signatures, 1)
+	require.Equal(t, wantKeyID, parsed.Signatures[0].Header.KeyID)
+	require.Equal(t, string(alg), parsed.Signatures[0].Header.Algorithm)
+	payload, err := parsed.Verify(&jose.JSONWebKey{Key: publicKey})
+	require.NoError(t, err)
+	require.Equal(t, "some payload", string(payload))
+}
@@ -8,18 +8,27 @@ import (
 	"context"
 	"errors"
 	"net/http"
+	"sort"
+	"time"
 
+	coreosoidc "github.com/coreos/go-oidc/v3/oidc"
 	"github.com/ory/fosite"
 	"github.com/ory/x/errorsx"
 	"golang.org/x/oauth2"
 	"k8s.io/apiserver/pkg/warning"
 
+	supervisoroidc "go.pinniped.dev/generated/latest/apis/supervisor/oidc"
+	"go.pinniped.dev/internal/audit"
 	"go.pinniped.dev/internal/httputil/httperr"
+	"go.pinniped.dev/internal/idtransform"
+	"go.pinniped.dev/internal/metrics"
 	"go.pinniped.dev/internal/oidc"
 	"go.pinniped.dev/internal/oidc/downstreamsession"
 	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/oidc/revocation"
 	"go.pinniped.dev/internal/plog"
 	"go.pinniped.dev/internal/psession"
+	"go.pinniped.dev/internal/tracing"
 )
 
 var (
@@ -35,17 +44,57 @@ var (
 		DescriptionField: "Error during upstream refresh.",
 		CodeField:        http.StatusUnauthorized,
 	}
+
+	errSessionExpired = &fosite.RFC6749Error{
+		ErrorField:       "invalid_grant",
+		DescriptionField: supervisoroidc.SessionExpiredErrorDescription,
+		CodeField:        http.StatusBadRequest,
+	}
+
+	errConcurrentSessionLimitReached = &fosite.RFC6749Error{
+		ErrorField:       "invalid_grant",
+		DescriptionField: "The maximum number of concurrent sessions has been reached.",
+		CodeField:        http.StatusBadRequest,
+	}
 )
 
+// SessionStore finds and deletes the storage of the downstream sessions of a user.
+type SessionStore interface {
+	ListSessionRequestsBySubject(ctx context.Context, subject string) ([]fosite.Requester, error)
+	RevokeSession(ctx context.Context, requestID string) error
+}
+
+// SessionLimits are the limits of the downstream sessions of a FederationDomain. A zero value disables the
+// corresponding limit.
+type SessionLimits struct {
+	// IdleTimeout is how long a session may go without being refreshed before its refreshes are rejected.
+	IdleTimeout time.Duration
+
+	// MaxLength is how long after the login a session's refreshes are rejected.
+	MaxLength time.Duration
+
+	// MaxConcurrentSessions is the maximum number of refreshable sessions of each user. When a new login would
+	// exceed it, then the new login is rejected when RejectNewLoginOverConcurrentSessionLimit is true, or else the
+	// oldest sessions of the user are revoked.
+	MaxConcurrentSessions                    int
+	RejectNewLoginOverConcurrentSessionLimit bool
+}
+
+// NewHandler returns the token endpoint handler, which enforces the given limits on the downstream sessions.
 func NewHandler(
+	issuer string,
 	idpLister oidc.UpstreamIdentityProvidersLister,
+	idTransformsGetter oidc.IdentityTransformsGetter,
 	oauthHelper fosite.OAuth2Provider,
+	sessionStore SessionStore,
+	sessionLimits SessionLimits,
 ) http.Handler {
 	return httperr.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
 		session := psession.NewPinnipedSession()
 		accessRequest, err := oauthHelper.NewAccessRequest(r.Context(), r, session)
 		if err != nil {
 			plog.Info("token request error", oidc.FositeErrorForLog(err)...)
+			recordTokenEvent(r, issuer, accessRequest, err)
 			oauthHelper.WriteAccessError(w, accessRequest, err)
 			return nil
 		}
@@ -56,19 +105,51 @@ func NewHandler(
 			// The session, requested scopes, and requested audience from the original authorize request was retrieved
 			// from the Kube storage layer and added to the accessRequest. Additionally, the audience and scopes may
 			// have already been granted on the accessRequest.
-			err = upstreamRefresh(r.Context(), accessRequest, idpLister)
+			now := time.Now().UTC()
+			err = validateSessionLimits(accessRequest, sessionLimits.IdleTimeout, sessionLimits.MaxLength, now)
+			if err != nil {
+				plog.Info("session limit error", oidc.FositeErrorForLog(err)...)
+				recordTokenEvent(r, issuer, accessRequest, err)
+				oauthHelper.WriteAccessError(w, accessRequest, err)
+				return nil
+			}
+			err = upstreamRefresh(r.Context(), accessRequest, idpLister, idTransformsGetter)
+			audit.RecordRequest(r, oidc.NewAuditEvent(audit.TypeUpstreamRefresh, issuer, accessRequest).Failure(oidc.FositeErrorForAudit(err)))
 			if err != nil {
 				plog.Info("upstream refresh error", oidc.FositeErrorForLog(err)...)
+				recordTokenEvent(r, issuer, accessRequest, err)
 				oauthHelper.WriteAccessError(w, accessRequest, err)
 				return nil
 			}
+			// The updated session is saved along with the new tokens. Sessions which were started by older versions
+			// of Pinniped have no login time, so their first refresh counts as their login from now on.
+			customSessionData := accessRequest.GetSession().(*psession.PinnipedSession).Custom
+			if customSessionData.LoginTime.IsZero() {
+				customSessionData.LoginTime = now
+			}
+			customSessionData.LastRefreshTime = now
 		}
 
-		// When we are in the authorization code flow, check if we have any warnings that previous handlers want us
-		// to send to the client to be printed on the CLI.
-		if accessRequest.GetGrantTypes().ExactOne("authorization_code") {
+		// When we are in the authorization code flow or the device code flow, then this is a new login.
+		var sessionsToRevoke []concurrentSession
+		if accessRequest.GetGrantTypes().ExactOne("authorization_code") || accessRequest.GetGrantTypes().ExactOne(oidc.DeviceCodeGrantType) {
 			storedSession := accessRequest.GetSession().(*psession.PinnipedSession)
 			customSessionData := storedSession.Custom
+			if customSessionData != nil {
+				// Record which FederationDomain the new session belongs to, since the stored sessions of a user
+				// are shared by all FederationDomains.
+				customSessionData.FederationDomainIssuer = issuer
+			}
+
+			sessionsToRevoke, err = findSessionsOverConcurrentSessionLimit(r.Context(), accessRequest, issuer, sessionStore, sessionLimits, time.Now().UTC())
+			if err != nil {
+				plog.Info("concurrent session limit error", oidc.FositeErrorForLog(err)...)
+				recordTokenEvent(r, issuer, accessRequest, err)
+				oauthHelper.WriteAccessError(w, accessRequest, err)
+				return nil
+			}
+
+			// Check if we have any warnings that previous handlers want us to send to the client to be printed on the CLI.
 			if customSessionData != nil {
 				for _, warningText := range customSessionData.Warnings {
 					warning.AddWarning(r.Context(), "", warningText)
@@ -79,17 +160,179 @@ func NewHandler(
 		accessResponse, err := oauthHelper.NewAccessResponse(r.Context(), accessRequest)
 		if err != nil {
 			plog.Info("token response error", oidc.FositeErrorForLog(err)...)
+			recordTokenEvent(r, issuer, accessRequest, err)
 			oauthHelper.WriteAccessError(w, accessRequest, err)
 			return nil
 		}
 
+		// The oldest sessions of the user are only revoked once the new session was successfully created.
+		revokeSessionsOverConcurrentSessionLimit(r.Context(), sessionsToRevoke, sessionStore, idpLister, sessionLimits)
+
+		recordTokenEvent(r, issuer, accessRequest, nil)
 		oauthHelper.WriteAccessResponse(w, accessRequest, accessResponse)
 
 		return nil
 	})
 }
 
-func upstreamRefresh(ctx context.Context, accessRequest fosite.AccessRequester, providerCache oidc.UpstreamIdentityProvidersLister) error {
+// recordTokenEvent records the audit event and the metrics of a request to the token endpoint. Refresh grants are
+// recorded as refresh events, and all other grants, which start a new session or exchange a token of a session, are
+// recorded as token exchange events.
+func recordTokenEvent(r *http.Request, issuer string, accessRequest fosite.AccessRequester, err error) {
+	eventType := audit.TypeTokenExchange
+	grantType := r.PostForm.Get("grant_type")
+	if grantType == "refresh_token" {
+		eventType = audit.TypeRefresh
+	}
+	event := oidc.NewAuditEvent(eventType, issuer, accessRequest).Failure(oidc.FositeErrorForAudit(err))
+	event.GrantType = grantType
+	audit.RecordRequest(r, event)
+	metrics.RecordTokenRequest(grantType, metrics.ResultOf(err))
+}
+
+// concurrentSession is an existing session of a user which counts towards the concurrent session limit.
+type concurrentSession struct {
+	requestID         string
+	loginTime         time.Time
+	customSessionData *psession.CustomSessionData
+}
+
+// findSessionsOverConcurrentSessionLimit is called when an authcode or a device code is redeemed, i.e. when a user
+// starts a new session. When the new session would exceed the maximum number of concurrent sessions of the user, then
+// it either rejects the new login, or returns the oldest sessions of the user which must be revoked to make room for
+// the new session. Only sessions which can be refreshed are limited, since the other sessions end when their
+// short-lived access token expires.
+func findSessionsOverConcurrentSessionLimit(
+	ctx context.Context,
+	accessRequest fosite.AccessRequester,
+	issuer string,
+	sessionStore SessionStore,
+	sessionLimits SessionLimits,
+	now time.Time,
+) ([]concurrentSession, error) {
+	// Fosite only grants the scopes of the original authorize request to the token request when it creates the
+	// response, but the authorize endpoint grants offline_access whenever it was requested.
+	if sessionLimits.MaxConcurrentSessions == 0 || !accessRequest.GetRequestedScopes().Has(coreosoidc.ScopeOfflineAccess) {
+		return nil, nil
+	}
+
+	subject := accessRequest.GetSession().(*psession.PinnipedSession).IDTokenClaims().Subject
+	requests, err := sessionStore.ListSessionRequestsBySubject(ctx, subject)
+	if err != nil {
+		return nil, errorsx.WithStack(fosite.ErrServerError.WithWrap(err).WithDebug(err.Error()))
+	}
+
+	existingSessions := make([]concurrentSession, 0, len(requests))
+	for _, request := range requests {
+		session, ok := request.GetSession().(*psession.PinnipedSession)
+		if !ok || session.Custom == nil {
+			continue
+		}
+		// Sessions which were started by older versions of Pinniped did not record their FederationDomain,
+		// so they count towards the limit of every FederationDomain.
+		if session.Custom.FederationDomainIssuer != "" && session.Custom.FederationDomainIssuer != issuer {
+			continue
+		}
+		loginTime := session.Custom.LoginTime
+		// Sessions which can no longer be refreshed are merely waiting to be garbage collected, so they do not count.
+		if expiresAt := session.GetExpiresAt(fosite.RefreshToken); !expiresAt.IsZero() && now.After(expiresAt) {
+			continue
+		}
+		if validateSessionLimits(request, sessionLimits.IdleTimeout, sessionLimits.MaxLength, now) != nil {
+			continue
+		}
+		existingSessions = append(existingSessions, concurrentSession{
+			requestID:         request.GetID(),
+			loginTime:         loginTime,
+			customSessionData: session.Custom,
+		})
+	}
+
+	numberOfSessionsToRevoke := len(existingSessions) + 1 - sessionLimits.MaxConcurrentSessions
+	if numberOfSessionsToRevoke <= 0 {
+		return nil, nil
+	}
+	if sessionLimits.RejectNewLoginOverConcurrentSessionLimit {
+		return nil, errorsx.WithStack(errConcurrentSessionLimitReached.WithHintf(
+			"End one of the other %d sessions of this user before logging in again.", len(existingSessions)))
+	}
+
+	// Sessions which were started by older versions of Pinniped have no login time, so they are revoked first.
+	sort.SliceStable(existingSessions, func(i, j int) bool {
+		return existingSessions[i].loginTime.Before(existingSessions[j].loginTime)
+	})
+	return existingSessions[:numberOfSessionsToRevoke], nil
+}
+
+// revokeSessionsOverConcurrentSessionLimit revokes the given sessions, including the upstream tokens which those
+// sessions hold. The new session was already created, so failures are only logged. A session which could not be
+// revoked remains usable until it ends on its own.
+func revokeSessionsOverConcurrentSessionLimit(
+	ctx context.Context,
+	sessions []concurrentSession,
+	sessionStore SessionStore,
+	idpLister oidc.UpstreamIdentityProvidersLister,
+	sessionLimits SessionLimits,
+) {
+	for _, existing := range sessions {
+		if err := sessionStore.RevokeSession(ctx, existing.requestID); err != nil {
+			plog.WarningErr("failed to revoke the oldest session of a user to enforce the concurrent session limit", err,
+				"sessionID", existing.requestID, "maxConcurrentSessions", sessionLimits.MaxConcurrentSessions)
+			continue
+		}
+		plog.Info("revoked the oldest session of a user to enforce the concurrent session limit",
+			"sessionID", existing.requestID, "maxConcurrentSessions", sessionLimits.MaxConcurrentSessions)
+
+		// The downstream session is already revoked, so a failure to revoke its upstream tokens is only logged.
+		// The upstream tokens may still expire or be revoked by the upstream provider later.
+		if err := revocation.RevokeUpstreamOIDCTokens(ctx, idpLister, existing.customSessionData); err != nil {
+			plog.WarningErr("failed to revoke upstream token while enforcing the concurrent session limit", err,
+				"providerName", existing.customSessionData.ProviderName, "providerUID", existing.customSessionData.ProviderUID)
+		}
+	}
+}
+
+// validateSessionLimits rejects the refresh of a session which has been idle for longer than sessionIdleTimeout, or
+// which is older than maxSessionLength. It does not modify the session. Sessions which were started by older versions
+// of Pinniped have no login time, so they are treated as if the user logged in now.
+func validateSessionLimits(
+	accessRequest fosite.Requester,
+	sessionIdleTimeout time.Duration,
+	maxSessionLength time.Duration,
+	now time.Time,
+) error {
+	customSessionData := accessRequest.GetSession().(*psession.PinnipedSession).Custom
+	if customSessionData == nil {
+		return errorsx.WithStack(errMissingUpstreamSessionInternalError)
+	}
+	loginTime := customSessionData.LoginTime
+	if loginTime.IsZero() {
+		loginTime = now
+	}
+
+	if maxSessionLength > 0 && now.After(loginTime.Add(maxSessionLength)) {
+		return errorsx.WithStack(errSessionExpired.WithHintf(
+			"It reached the maximum session length of %s.", maxSessionLength))
+	}
+
+	lastActivity := loginTime
+	if customSessionData.LastRefreshTime.After(lastActivity) {
+		lastActivity = customSessionData.LastRefreshTime
+	}
+	if sessionIdleTimeout > 0 && now.After(lastActivity.Add(sessionIdleTimeout)) {
+		return errorsx.WithStack(errSessionExpired.WithHintf(
+			"It was idle for longer than the idle timeout of %s.", sessionIdleTimeout))
+	}
+
+	return nil
+}
+
+func upstreamRefresh(
+	ctx context.Context,
+	accessRequest fosite.AccessRequester,
+	providerCache oidc.UpstreamIdentityProvidersLister,
+	idTransformsGetter oidc.IdentityTransformsGetter,
+) error {
 	session := accessRequest.GetSession().(*psession.PinnipedSession)
 
 	customSessionData := session.Custom
@@ -102,19 +345,27 @@ func upstreamRefresh(ctx context.Context, accessRequest fosite.AccessRequester,
 		return errorsx.WithStack(errMissingUpstreamSessionInternalError)
 	}
 
+	tracing.SetIdentityProvider(ctx, providerName, string(customSessionData.ProviderType))
+	idTransforms := idTransformsGetter.IdentityTransforms(providerName, customSessionData.ProviderType)
+
 	switch customSessionData.ProviderType {
 	case psession.ProviderTypeOIDC:
-		return upstreamOIDCRefresh(ctx, session, providerCache)
+		return upstreamOIDCRefresh(ctx, session, providerCache, idTransforms)
 	case psession.ProviderTypeLDAP:
-		return upstreamLDAPRefresh(ctx, providerCache, session)
+		return upstreamLDAPRefresh(ctx, providerCache, session, idTransforms)
 	case psession.ProviderTypeActiveDirectory:
-		return upstreamLDAPRefresh(ctx, providerCache, session)
+		return upstreamLDAPRefresh(ctx, providerCache, session, idTransforms)
 	default:
 		return errorsx.WithStack(errMissingUpstreamSessionInternalError)
 	}
 }
 
-func upstreamOIDCRefresh(ctx context.Context, session *psession.PinnipedSession, providerCache oidc.UpstreamIdentityProvidersLister) error {
+func upstreamOIDCRefresh(
+	ctx context.Context,
+	session *psession.PinnipedSession,
+	providerCache oidc.UpstreamIdentityProvidersLister,
+	idTransforms *idtransform.TransformationPipeline,
+) error {
 	s := session.Custom
 	if s.OIDC == nil {
 		return errorsx.WithStack(errMissingUpstreamSessionInternalError)
@@ -186,8 +437,10 @@ func upstreamOIDCRefresh(ctx context.Context, session *psession.PinnipedSession,
 			"Upstream refresh error while extracting groups claim.").WithWrap(err).
 			WithDebugf("provider name: %q, provider type: %q", s.ProviderName, s.ProviderType))
 	}
-	if refreshedGroups != nil {
-		session.Fosite.Claims.Extra[oidc.DownstreamGroupsClaim] = refreshedGroups
+
+	err = applyIdentityTransformationsDuringRefresh(session, idTransforms, refreshedGroups)
+	if err != nil {
+		return err
 	}
 
 	// Upstream refresh may or may not return a new refresh token. If we got a new refresh token, then update it in
@@ -225,13 +478,18 @@ func validateIdentityUnchangedSinceInitialLogin(mergedClaims map[string]interfac
 	}
 
 	newUsername, hasUsername := getString(mergedClaims, usernameClaimName)
-	oldUsername := session.Fosite.Claims.Extra[oidc.DownstreamUsernameClaim]
 	// It's possible that a username wasn't returned by the upstream provider during refresh,
 	// but if it is, verify that it hasn't changed.
-	if hasUsername && oldUsername != newUsername {
-		return errorsx.WithStack(errUpstreamRefreshError.WithHintf(
-			"Upstream refresh failed.").WithWrap(errors.New("username in upstream refresh does not match previous value")).
-			WithDebugf("provider name: %q, provider type: %q", s.ProviderName, s.ProviderType))
+	if hasUsername {
+		oldUsername, err := getUpstreamUsernameFromPinnipedSession(session)
+		if err != nil {
+			return err
+		}
+		if oldUsername != newUsername {
+			return errorsx.WithStack(errUpstreamRefreshError.WithHintf(
+				"Upstream refresh failed.").WithWrap(errors.New("username in upstream refresh does not match previous value")).
+				WithDebugf("provider name: %q, provider type: %q", s.ProviderName, s.ProviderType))
+		}
 	}
 
 	newIssuer, hasIssuer := getString(mergedClaims, oidc.IDTokenIssuerClaim)
@@ -269,8 +527,13 @@ func findOIDCProviderByNameAndValidateUID(
 		WithDebugf("provider name: %q, provider type: %q", s.ProviderName, s.ProviderType))
 }
 
-func upstreamLDAPRefresh(ctx context.Context, providerCache oidc.UpstreamIdentityProvidersLister, session *psession.PinnipedSession) error {
-	username, err := getDownstreamUsernameFromPinnipedSession(session)
+func upstreamLDAPRefresh(
+	ctx context.Context,
+	providerCache oidc.UpstreamIdentityProvidersLister,
+	session *psession.PinnipedSession,
+	idTransforms *idtransform.TransformationPipeline,
+) error {
+	username, err := getUpstreamUsernameFromPinnipedSession(session)
 	if err != nil {
 		return err
 	}
@@ -301,7 +564,7 @@ func upstreamLDAPRefresh(ctx context.Context, providerCache oidc.UpstreamIdentit
 		return errorsx.WithStack(errMissingUpstreamSessionInternalError)
 	}
 	// run PerformRefresh
-	err = p.PerformRefresh(ctx, provider.StoredRefreshAttributes{
+	refreshedGroups, err := p.PerformRefresh(ctx, provider.StoredRefreshAttributes{
 		Username:             username,
 		Subject:              subject,
 		DN:                   dn,
@@ -313,6 +576,52 @@ func upstreamLDAPRefresh(ctx context.Context, providerCache oidc.UpstreamIdentit
 			WithDebugf("provider name: %q, provider type: %q", s.ProviderName, s.ProviderType))
 	}
 
+	// The LDAP refresh returns the user's new group memberships, unless the provider is configured to skip refreshing
+	// groups, in which case the refreshed groups are nil and the transformations are applied to the stored groups.
+	return applyIdentityTransformationsDuringRefresh(session, idTransforms, refreshedGroups)
+}
+
+// applyIdentityTransformationsDuringRefresh applies the identity transformations again to the user's upstream identity
+// and updates the downstream groups in the session. The refreshedUpstreamGroups are used when they are not nil,
+// otherwise the upstream groups from the user's session are used. The transformations must not change the user's
+// downstream username, since the username of a session must not change during refresh.
+func applyIdentityTransformationsDuringRefresh(
+	session *psession.PinnipedSession,
+	idTransforms *idtransform.TransformationPipeline,
+	refreshedUpstreamGroups []string,
+) error {
+	s := session.Custom
+
+	upstreamUsername, err := getUpstreamUsernameFromPinnipedSession(session)
+	if err != nil {
+		return err
+	}
+	downstreamUsername, err := getDownstreamUsernameFromPinnipedSession(session)
+	if err != nil {
+		return err
+	}
+
+	upstreamGroups := refreshedUpstreamGroups
+	if upstreamGroups == nil {
+		upstreamGroups = getUpstreamGroupsFromPinnipedSession(session)
+	}
+
+	transformedUsername, transformedGroups, err := downstreamsession.ApplyIdentityTransformations(idTransforms, upstreamUsername, upstreamGroups)
+	if err != nil {
+		return errorsx.WithStack(errUpstreamRefreshError.WithHintf(
+			"Upstream refresh error while applying configured identity transformations: %s.", err.Error()).
+			WithDebugf("provider name: %q, provider type: %q", s.ProviderName, s.ProviderType))
+	}
+	if transformedUsername != downstreamUsername {
+		return errorsx.WithStack(errUpstreamRefreshError.WithHintf(
+			"Upstream refresh failed.").WithWrap(errors.New("username in upstream refresh does not match previous value")).
+			WithDebugf("provider name: %q, provider type: %q", s.ProviderName, s.ProviderType))
+	}
+
+	if refreshedUpstreamGroups != nil {
+		s.UpstreamGroups = refreshedUpstreamGroups
+	}
+	session.Fosite.Claims.Extra[oidc.DownstreamGroupsClaim] = transformedGroups
 	return nil
 }
 
@@ -346,6 +655,30 @@ func findLDAPProviderByNameAndValidateUID(
 		WithDebugf("provider name: %q, provider type: %q", s.ProviderName, s.ProviderType))
 }
 
+// getUpstreamUsernameFromPinnipedSession returns the username from the upstream identity provider. Sessions which
+// were started before the upstream username was stored in the session did not have any identity transformations
+// applied, so their downstream username is the same as their upstream username.
+func getUpstreamUsernameFromPinnipedSession(session *psession.PinnipedSession) (string, error) {
+	if session.Custom.UpstreamUsername != "" {
+		return session.Custom.UpstreamUsername, nil
+	}
+	return getDownstreamUsernameFromPinnipedSession(session)
+}
+
+// getUpstreamGroupsFromPinnipedSession returns the groups from the upstream identity provider which were stored
+// in the session, falling back to the downstream groups for sessions which did not store their upstream groups.
+func getUpstreamGroupsFromPinnipedSession(session *psession.PinnipedSession) []string {
+	if session.Custom.UpstreamGroups != nil {
+		return session.Custom.UpstreamGroups
+	}
+	groups := oidc.DownstreamGroups(session.Fosite.Claims)
+	if groups == nil {
+		// The refreshed session should have an empty groups claim rather than a null one.
+		return []string{}
+	}
+	return groups
+}
+
 func getDownstreamUsernameFromPinnipedSession(session *psession.PinnipedSession) (string, error) {
 	extra := session.Fosite.Claims.Extra
 	if extra == nil {
@@ -18,6 +18,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -32,23 +33,32 @@ import (
 	"golang.org/x/oauth2"
 	"gopkg.in/square/go-jose.v2"
 	josejwt "gopkg.in/square/go-jose.v2/jwt"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
 	v1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	coretesting "k8s.io/client-go/testing"
 
+	configv1alpha1 "go.pinniped.dev/generated/latest/apis/supervisor/config/v1alpha1"
 	"go.pinniped.dev/internal/crud"
 	"go.pinniped.dev/internal/fositestorage/accesstoken"
 	"go.pinniped.dev/internal/fositestorage/authorizationcode"
+	"go.pinniped.dev/internal/fositestorage/devicecode"
 	"go.pinniped.dev/internal/fositestorage/openidconnect"
 	storagepkce "go.pinniped.dev/internal/fositestorage/pkce"
 	"go.pinniped.dev/internal/fositestorage/refreshtoken"
 	"go.pinniped.dev/internal/fositestoragei"
 	"go.pinniped.dev/internal/here"
 	"go.pinniped.dev/internal/httputil/httperr"
+	"go.pinniped.dev/internal/idtransform"
+	"go.pinniped.dev/internal/metrics"
 	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/clientregistry"
 	"go.pinniped.dev/internal/oidc/jwks"
 	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/oidc/signer"
 	"go.pinniped.dev/internal/psession"
 	"go.pinniped.dev/internal/testutil"
 	"go.pinniped.dev/internal/testutil/oidctestutil"
@@ -67,6 +77,13 @@ const (
 
 	hmacSecret = "this needs to be at least 32 characters to meet entropy requirements"
 
+	confidentialClientBasic       = "client.oauth.pinniped.dev-basic"
+	confidentialClientPost        = "client.oauth.pinniped.dev-post"
+	confidentialClientRedirectURI = "https://app.example.com/callback"
+	confidentialClientSecret      = "some-client-secret"
+	// confidentialClientSecretHash is a bcrypt hash of confidentialClientSecret with cost 12.
+	confidentialClientSecretHash = "$2a$12$yHGWWZy/UWGN7V0ETyyP/etrfr1n0GOdWpwJt3HxUqBlar/3Z3.D6"
+
 	authCodeExpirationSeconds    = 10 * 60 // Current, we set our auth code expiration to 10 minutes
 	accessTokenExpirationSeconds = 2 * 60  // Currently, we set our access token expiration to 2 minutes
 	idTokenExpirationSeconds     = 2 * 60  // Currently, we set our ID token expiration to 2 minutes
@@ -141,6 +158,13 @@ var (
 		}
 	`)
 
+	fositeInvalidClientAuthMethodErrorBody = here.Doc(`
+		{
+			"error":             "invalid_client",
+			"error_description": "Client authentication failed (e.g., unknown client, no client authentication included, or unsupported authentication method). The OAuth 2.0 Client supports client authentication method 'client_secret_basic', but method 'client_secret_post' was requested. You must configure the OAuth 2.0 client's 'token_endpoint_auth_method' value to accept 'client_secret_post'."
+		}
+	`)
+
 	fositeInvalidAuthCodeErrorBody = here.Doc(`
 		{
 			"error":             "invalid_grant",
@@ -236,6 +260,7 @@ type expectedUpstreamValidateTokens struct {
 
 type tokenEndpointResponseExpectedValues struct {
 	wantStatus                        int
+	wantClientID                      string // defaults to goodClient
 	wantSuccessBodyFields             []string
 	wantErrorResponseBody             string
 	wantRequestedScopes               []string
@@ -256,6 +281,8 @@ type authcodeExchangeInputs struct {
 	)
 	makeOathHelper    OauthHelperFactoryFunc
 	customSessionData *psession.CustomSessionData
+	idpTransforms     []provider.FederationDomainIdentityProvider
+	sessionLimits     SessionLimits
 	want              tokenEndpointResponseExpectedValues
 }
 
@@ -414,6 +441,83 @@ func TestTokenEndpointAuthcodeExchange(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "confidential client authenticates using client_secret_basic",
+			authcodeExchange: authcodeExchangeInputs{
+				modifyAuthRequest: modifyAuthRequestForConfidentialClient(confidentialClientBasic),
+				modifyTokenRequest: func(r *http.Request, authCode string) {
+					r.Body = happyAuthcodeRequestBody(authCode).WithClientID("").WithRedirectURI(confidentialClientRedirectURI).ReadCloser()
+					r.SetBasicAuth(confidentialClientBasic, confidentialClientSecret)
+				},
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus:            http.StatusOK,
+					wantClientID:          confidentialClientBasic,
+					wantSuccessBodyFields: []string{"id_token", "access_token", "token_type", "scope", "expires_in"}, // no refresh token
+					wantRequestedScopes:   []string{"openid", "profile", "email"},
+					wantGrantedScopes:     []string{"openid"},
+					wantGroups:            goodGroups,
+				},
+			},
+		},
+		{
+			name: "confidential client authenticates using client_secret_post",
+			authcodeExchange: authcodeExchangeInputs{
+				modifyAuthRequest: modifyAuthRequestForConfidentialClient(confidentialClientPost),
+				modifyTokenRequest: func(r *http.Request, authCode string) {
+					r.Body = happyAuthcodeRequestBody(authCode).WithClientID(confidentialClientPost).WithRedirectURI(confidentialClientRedirectURI).
+						with("client_secret", confidentialClientSecret).ReadCloser()
+				},
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus:            http.StatusOK,
+					wantClientID:          confidentialClientPost,
+					wantSuccessBodyFields: []string{"id_token", "access_token", "token_type", "scope", "expires_in"}, // no refresh token
+					wantRequestedScopes:   []string{"openid", "profile", "email"},
+					wantGrantedScopes:     []string{"openid"},
+					wantGroups:            goodGroups,
+				},
+			},
+		},
+		{
+			name: "confidential client uses the wrong client secret",
+			authcodeExchange: authcodeExchangeInputs{
+				modifyAuthRequest: modifyAuthRequestForConfidentialClient(confidentialClientBasic),
+				modifyTokenRequest: func(r *http.Request, authCode string) {
+					r.Body = happyAuthcodeRequestBody(authCode).WithClientID("").WithRedirectURI(confidentialClientRedirectURI).ReadCloser()
+					r.SetBasicAuth(confidentialClientBasic, "wrong-client-secret")
+				},
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus:            http.StatusUnauthorized,
+					wantErrorResponseBody: fositeInvalidClientErrorBody,
+				},
+			},
+		},
+		{
+			name: "confidential client does not authenticate",
+			authcodeExchange: authcodeExchangeInputs{
+				modifyAuthRequest: modifyAuthRequestForConfidentialClient(confidentialClientBasic),
+				modifyTokenRequest: func(r *http.Request, authCode string) {
+					r.Body = happyAuthcodeRequestBody(authCode).WithClientID(confidentialClientBasic).WithRedirectURI(confidentialClientRedirectURI).ReadCloser()
+				},
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus:            http.StatusUnauthorized,
+					wantErrorResponseBody: fositeInvalidClientErrorBody,
+				},
+			},
+		},
+		{
+			name: "confidential client uses an authentication method which it is not configured to use",
+			authcodeExchange: authcodeExchangeInputs{
+				modifyAuthRequest: modifyAuthRequestForConfidentialClient(confidentialClientBasic),
+				modifyTokenRequest: func(r *http.Request, authCode string) {
+					r.Body = happyAuthcodeRequestBody(authCode).WithClientID(confidentialClientBasic).WithRedirectURI(confidentialClientRedirectURI).
+						with("client_secret", confidentialClientSecret).ReadCloser()
+				},
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus:            http.StatusUnauthorized,
+					wantErrorResponseBody: fositeInvalidClientAuthMethodErrorBody,
+				},
+			},
+		},
 		{
 			name: "client id is missing in request",
 			authcodeExchange: authcodeExchangeInputs{
@@ -612,7 +716,7 @@ func TestTokenEndpointWhenAuthcodeIsUsedTwice(t *testing.T) {
 			// Fosite never cleans up OpenID Connect session storage, so it is still there.
 			// Note that customSessionData is only relevant to refresh grant, so we leave it as nil for this
 			// authcode exchange test, even though in practice it would actually be in the session.
-			requireValidOIDCStorage(t, parsedResponseBody, authCode, oauthStore,
+			requireValidOIDCStorage(t, parsedResponseBody, authCode, oauthStore, goodClient,
 				test.authcodeExchange.want.wantRequestedScopes, test.authcodeExchange.want.wantGrantedScopes, test.authcodeExchange.want.wantGroups, nil)
 
 			// Check that the access token and refresh token storage were both deleted, and the number of other storage objects did not change.
@@ -626,6 +730,409 @@ func TestTokenEndpointWhenAuthcodeIsUsedTwice(t *testing.T) {
 	}
 }
 
+func TestTokenEndpointRecordsMetrics(t *testing.T) {
+	// This test must not run in parallel with the other tests, which also record token requests.
+	metrics.Register()
+	wantAuthcodeSuccesses := scrapeTokenRequestsCount(t, "authorization_code", metrics.ResultSuccess) + 1
+	wantRefreshFailures := scrapeTokenRequestsCount(t, "refresh_token", metrics.ResultFailure) + 1
+	wantOtherFailures := scrapeTokenRequestsCount(t, metrics.GrantTypeOther, metrics.ResultFailure) + 1
+
+	subject, _, _, _, _, _ := exchangeAuthcodeForTokens(t, authcodeExchangeInputs{
+		modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+		want: tokenEndpointResponseExpectedValues{
+			wantStatus:            http.StatusOK,
+			wantSuccessBodyFields: []string{"id_token", "refresh_token", "access_token", "token_type", "expires_in", "scope"},
+			wantRequestedScopes:   []string{"openid", "offline_access"},
+			wantGrantedScopes:     []string{"openid", "offline_access"},
+			wantGroups:            goodGroups,
+		},
+	}, oidctestutil.NewUpstreamIDPListerBuilder().Build())
+
+	rsp := postTokenRequest(subject, happyRefreshRequestBody("some-unknown-refresh-token.some-signature"))
+	require.Equal(t, http.StatusBadRequest, rsp.Code)
+	rsp = postTokenRequest(subject, happyRefreshRequestBody("some-refresh-token").WithGrantType("some-unsupported-grant-type"))
+	require.Equal(t, http.StatusBadRequest, rsp.Code)
+
+	require.Equal(t, wantAuthcodeSuccesses, scrapeTokenRequestsCount(t, "authorization_code", metrics.ResultSuccess))
+	require.Equal(t, wantRefreshFailures, scrapeTokenRequestsCount(t, "refresh_token", metrics.ResultFailure))
+	require.Equal(t, wantOtherFailures, scrapeTokenRequestsCount(t, metrics.GrantTypeOther, metrics.ResultFailure))
+}
+
+// scrapeTokenRequestsCount returns the number of token requests with the grant type and result which were counted so
+// far, as served by the metrics handler.
+func scrapeTokenRequestsCount(t *testing.T, grantType string, result string) int {
+	t.Helper()
+
+	rsp := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rsp, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rsp.Code)
+
+	prefix := fmt.Sprintf(`pinniped_supervisor_token_requests_total{grant_type=%q,result=%q} `, grantType, result)
+	for _, line := range strings.Split(rsp.Body.String(), "\n") {
+		if strings.HasPrefix(line, prefix) {
+			count, err := strconv.Atoi(strings.TrimPrefix(line, prefix))
+			require.NoError(t, err)
+			return count
+		}
+	}
+	return 0
+}
+
+func TestTokenEndpointDeviceCodeExchange(t *testing.T) { // tests for grant_type "urn:ietf:params:oauth:grant-type:device_code"
+	const deviceCode = "some-device-code"
+
+	tests := []struct {
+		name                  string
+		status                devicecode.Status // when empty, no device code session is stored
+		expiresIn             time.Duration
+		lastPolledAgo         time.Duration
+		modifyRequestBody     func(b body) body
+		wantStatus            int
+		wantErrorType         string
+		wantSuccessBodyFields []string
+	}{
+		{
+			name:                  "approved session returns tokens",
+			status:                devicecode.StatusApproved,
+			expiresIn:             time.Minute,
+			wantStatus:            http.StatusOK,
+			wantSuccessBodyFields: []string{"id_token", "refresh_token", "access_token", "token_type", "expires_in", "scope"},
+		},
+		{
+			name:          "pending session which was never polled before returns authorization_pending",
+			status:        devicecode.StatusPending,
+			expiresIn:     time.Minute,
+			wantStatus:    http.StatusBadRequest,
+			wantErrorType: "authorization_pending",
+		},
+		{
+			name:          "pending session which was polled long enough ago returns authorization_pending",
+			status:        devicecode.StatusPending,
+			expiresIn:     time.Minute,
+			lastPolledAgo: 10 * time.Second,
+			wantStatus:    http.StatusBadRequest,
+			wantErrorType: "authorization_pending",
+		},
+		{
+			name:          "pending session which was polled too recently returns slow_down",
+			status:        devicecode.StatusPending,
+			expiresIn:     time.Minute,
+			lastPolledAgo: time.Second,
+			wantStatus:    http.StatusBadRequest,
+			wantErrorType: "slow_down",
+		},
+		{
+			name:          "expired session returns expired_token",
+			status:        devicecode.StatusApproved,
+			expiresIn:     -time.Second,
+			wantStatus:    http.StatusBadRequest,
+			wantErrorType: "expired_token",
+		},
+		{
+			name:          "unknown device code returns invalid_grant",
+			wantStatus:    http.StatusBadRequest,
+			wantErrorType: "invalid_grant",
+		},
+		{
+			name:              "missing device code returns invalid_request",
+			status:            devicecode.StatusApproved,
+			expiresIn:         time.Minute,
+			modifyRequestBody: func(b body) body { return b.with("device_code", "") },
+			wantStatus:        http.StatusBadRequest,
+			wantErrorType:     "invalid_request",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			client := fake.NewSimpleClientset()
+			secrets := client.CoreV1().Secrets("some-namespace")
+			oauthStore := oidc.NewKubeStorage(secrets, newClientManager(t), oidc.DefaultOIDCTimeoutsConfiguration())
+			jwtSigningKey, jwkProvider := generateJWTSigningKeyAndJWKSProvider(t, goodIssuer)
+			oauthHelper := oidc.FositeOauth2Helper(oauthStore, goodIssuer, hmacSecretFunc, jwkProvider, oidc.DefaultOIDCTimeoutsConfiguration())
+			subject := NewHandler(goodIssuer, oidctestutil.NewUpstreamIDPListerBuilder().Build(), oidctestutil.NewIdentityTransformsGetter(t, nil), oauthHelper, oauthStore, SessionLimits{})
+
+			if test.status != "" {
+				createDeviceCodeSession(t, oauthStore, deviceCode, test.status, time.Now().Add(test.expiresIn), test.lastPolledAgo)
+			}
+
+			requestBody := happyDeviceCodeRequestBody(deviceCode)
+			if test.modifyRequestBody != nil {
+				requestBody = test.modifyRequestBody(requestBody)
+			}
+			rsp := postTokenRequest(subject, requestBody)
+
+			require.Equal(t, test.wantStatus, rsp.Code)
+			testutil.RequireEqualContentType(t, rsp.Header().Get("Content-Type"), "application/json")
+
+			var parsedResponseBody map[string]interface{}
+			require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &parsedResponseBody))
+
+			if test.wantErrorType != "" {
+				require.Equal(t, test.wantErrorType, parsedResponseBody["error"])
+				return
+			}
+
+			require.ElementsMatch(t, test.wantSuccessBodyFields, getMapKeys(parsedResponseBody))
+			require.Equal(t, "openid offline_access", parsedResponseBody["scope"])
+			requireValidIDToken(t, parsedResponseBody, jwtSigningKey, goodClient, false, false, goodGroups, parsedResponseBody["access_token"].(string))
+
+			// The device code session was deleted, and the access token and refresh token were stored.
+			testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: devicecode.TypeLabelValue}, 0)
+			testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: accesstoken.TypeLabelValue}, 1)
+			testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: refreshtoken.TypeLabelValue}, 1)
+			testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{}, 2)
+
+			// The device code can only be redeemed once.
+			reusedDeviceCodeResponse := postTokenRequest(subject, happyDeviceCodeRequestBody(deviceCode))
+			require.Equal(t, http.StatusBadRequest, reusedDeviceCodeResponse.Code)
+			require.Contains(t, reusedDeviceCodeResponse.Body.String(), `"error":"invalid_grant"`)
+		})
+	}
+}
+
+func TestTokenEndpointDeviceCodeExchangeUpdatesLastPolledAt(t *testing.T) {
+	const deviceCode = "some-device-code"
+
+	client := fake.NewSimpleClientset()
+	secrets := client.CoreV1().Secrets("some-namespace")
+	oauthStore := oidc.NewKubeStorage(secrets, newClientManager(t), oidc.DefaultOIDCTimeoutsConfiguration())
+	_, jwkProvider := generateJWTSigningKeyAndJWKSProvider(t, goodIssuer)
+	oauthHelper := oidc.FositeOauth2Helper(oauthStore, goodIssuer, hmacSecretFunc, jwkProvider, oidc.DefaultOIDCTimeoutsConfiguration())
+	subject := NewHandler(goodIssuer, oidctestutil.NewUpstreamIDPListerBuilder().Build(), oidctestutil.NewIdentityTransformsGetter(t, nil), oauthHelper, oauthStore, SessionLimits{})
+
+	createDeviceCodeSession(t, oauthStore, deviceCode, devicecode.StatusPending, time.Now().Add(time.Minute), 0)
+
+	rsp := postTokenRequest(subject, happyDeviceCodeRequestBody(deviceCode))
+	require.Equal(t, http.StatusBadRequest, rsp.Code)
+	require.Contains(t, rsp.Body.String(), `"error":"authorization_pending"`)
+
+	session, _, err := oauthStore.GetDeviceCodeSession(context.Background(), oidc.DeviceCodeSignature(deviceCode))
+	require.NoError(t, err)
+	testutil.RequireTimeInDelta(t, time.Now(), session.LastPolledAt, timeComparisonFudgeSeconds*time.Second)
+
+	// Polling again right away is too fast.
+	rsp = postTokenRequest(subject, happyDeviceCodeRequestBody(deviceCode))
+	require.Equal(t, http.StatusBadRequest, rsp.Code)
+	require.Contains(t, rsp.Body.String(), `"error":"slow_down"`)
+}
+
+func TestTokenEndpointConcurrentSessionLimit(t *testing.T) {
+	const (
+		upstreamName        = "some-oidc-idp"
+		upstreamResourceUID = "oidc-resource-uid"
+		otherIssuer         = "https://some-other-issuer.com"
+	)
+
+	now := time.Now().UTC()
+
+	existingSession := func(requestID string, issuer string, loginTime time.Time, upstreamRefreshToken string) *fosite.Request {
+		return &fosite.Request{
+			ID:           requestID,
+			RequestedAt:  loginTime,
+			Client:       &clientregistry.Client{DefaultOpenIDConnectClient: fosite.DefaultOpenIDConnectClient{DefaultClient: &fosite.DefaultClient{ID: goodClient}}},
+			GrantedScope: fosite.Arguments{"openid", "offline_access"},
+			Form:         url.Values{},
+			Session: &psession.PinnipedSession{
+				Fosite: &openid.DefaultSession{
+					Claims: &jwt.IDTokenClaims{Subject: goodSubject},
+				},
+				Custom: &psession.CustomSessionData{
+					ProviderName:           upstreamName,
+					ProviderUID:            upstreamResourceUID,
+					ProviderType:           psession.ProviderTypeOIDC,
+					LoginTime:              loginTime,
+					FederationDomainIssuer: issuer,
+					OIDC:                   &psession.OIDCSessionData{UpstreamRefreshToken: upstreamRefreshToken},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name                          string
+		scope                         string
+		sessionLimits                 SessionLimits
+		existingSessions              []*fosite.Request
+		failToCreateSessions          bool
+		wantStatus                    int
+		wantErrorResponseBody         string
+		wantRevokedSessionIDs         []string
+		wantRevokedUpstreamRefreshTok string
+	}{
+		{
+			name:          "the oldest session is revoked when the new login would exceed the limit",
+			scope:         "openid offline_access",
+			sessionLimits: SessionLimits{MaxConcurrentSessions: 2},
+			existingSessions: []*fosite.Request{
+				existingSession("newer-session", goodIssuer, now.Add(-time.Hour), "newer-upstream-refresh-token"),
+				existingSession("oldest-session", goodIssuer, now.Add(-3*time.Hour), "oldest-upstream-refresh-token"),
+			},
+			wantStatus:                    http.StatusOK,
+			wantRevokedSessionIDs:         []string{"oldest-session"},
+			wantRevokedUpstreamRefreshTok: "oldest-upstream-refresh-token",
+		},
+		{
+			name:          "the new login is rejected when configured to reject new logins which would exceed the limit",
+			scope:         "openid offline_access",
+			sessionLimits: SessionLimits{MaxConcurrentSessions: 2, RejectNewLoginOverConcurrentSessionLimit: true},
+			existingSessions: []*fosite.Request{
+				existingSession("newer-session", goodIssuer, now.Add(-time.Hour), "newer-upstream-refresh-token"),
+				existingSession("oldest-session", goodIssuer, now.Add(-3*time.Hour), "oldest-upstream-refresh-token"),
+			},
+			wantStatus: http.StatusBadRequest,
+			wantErrorResponseBody: here.Doc(`
+				{
+					"error":             "invalid_grant",
+					"error_description": "The maximum number of concurrent sessions has been reached. End one of the other 2 sessions of this user before logging in again."
+				}
+			`),
+		},
+		{
+			name:          "sessions of other FederationDomains and sessions which can no longer be refreshed are not counted",
+			scope:         "openid offline_access",
+			sessionLimits: SessionLimits{MaxConcurrentSessions: 1, RejectNewLoginOverConcurrentSessionLimit: true, MaxLength: 8 * time.Hour},
+			existingSessions: []*fosite.Request{
+				existingSession("other-issuer-session", otherIssuer, now.Add(-time.Hour), "other-upstream-refresh-token"),
+				existingSession("expired-session", goodIssuer, now.Add(-9*time.Hour), "expired-upstream-refresh-token"),
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:          "sessions which were started by older versions of Pinniped are counted",
+			scope:         "openid offline_access",
+			sessionLimits: SessionLimits{MaxConcurrentSessions: 2},
+			existingSessions: []*fosite.Request{
+				existingSession("newer-session", goodIssuer, now.Add(-time.Hour), "newer-upstream-refresh-token"),
+				existingSession("older-version-session", "", time.Time{}, "older-version-upstream-refresh-token"),
+			},
+			wantStatus:                    http.StatusOK,
+			wantRevokedSessionIDs:         []string{"older-version-session"},
+			wantRevokedUpstreamRefreshTok: "older-version-upstream-refresh-token",
+		},
+		{
+			name:          "sessions are counted when the new login did not request the openid scope",
+			scope:         "offline_access",
+			sessionLimits: SessionLimits{MaxConcurrentSessions: 1, RejectNewLoginOverConcurrentSessionLimit: true},
+			existingSessions: []*fosite.Request{
+				existingSession("existing-session", goodIssuer, now.Add(-time.Hour), "existing-upstream-refresh-token"),
+			},
+			wantStatus: http.StatusBadRequest,
+			wantErrorResponseBody: here.Doc(`
+				{
+					"error":             "invalid_grant",
+					"error_description": "The maximum number of concurrent sessions has been reached. End one of the other 1 sessions of this user before logging in again."
+				}
+			`),
+		},
+		{
+			name:          "the oldest session is not revoked when the new session could not be created",
+			scope:         "openid offline_access",
+			sessionLimits: SessionLimits{MaxConcurrentSessions: 1},
+			existingSessions: []*fosite.Request{
+				existingSession("existing-session", goodIssuer, now.Add(-time.Hour), "existing-upstream-refresh-token"),
+			},
+			failToCreateSessions: true,
+			wantStatus:           http.StatusInternalServerError,
+		},
+		{
+			name:          "logins which do not get a refresh token are not limited",
+			scope:         "openid",
+			sessionLimits: SessionLimits{MaxConcurrentSessions: 1, RejectNewLoginOverConcurrentSessionLimit: true},
+			existingSessions: []*fosite.Request{
+				existingSession("existing-session", goodIssuer, now.Add(-time.Hour), "existing-upstream-refresh-token"),
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:  "there is no limit by default",
+			scope: "openid offline_access",
+			existingSessions: []*fosite.Request{
+				existingSession("existing-session", goodIssuer, now.Add(-time.Hour), "existing-upstream-refresh-token"),
+			},
+			wantStatus: http.StatusOK,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			client := fake.NewSimpleClientset()
+			secrets := client.CoreV1().Secrets("some-namespace")
+			oauthStore := oidc.NewKubeStorage(secrets, newClientManager(t), oidc.DefaultOIDCTimeoutsConfiguration())
+
+			authRequest := deepCopyRequestForm(happyAuthRequest)
+			authRequest.Form.Set("scope", test.scope)
+			oauthHelper, authCode, _ := makeHappyOauthHelper(t, authRequest, oauthStore, &psession.CustomSessionData{
+				ProviderName: upstreamName,
+				ProviderUID:  upstreamResourceUID,
+				ProviderType: psession.ProviderTypeOIDC,
+				OIDC:         &psession.OIDCSessionData{UpstreamRefreshToken: "new-upstream-refresh-token"},
+			})
+
+			for _, existing := range test.existingSessions {
+				ctx := context.Background()
+				require.NoError(t, oauthStore.CreateRefreshTokenSession(ctx, existing.GetID()+"-refresh-token-signature", existing))
+				require.NoError(t, oauthStore.CreateAccessTokenSession(ctx, existing.GetID()+"-access-token-signature", existing))
+			}
+
+			if test.failToCreateSessions {
+				client.PrependReactor("create", "secrets", func(action coretesting.Action) (bool, runtime.Object, error) {
+					return true, nil, errors.New("some create error")
+				})
+			}
+
+			idps := oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+				oidctestutil.NewTestUpstreamOIDCIdentityProviderBuilder().WithName(upstreamName).WithResourceUID(upstreamResourceUID).Build(),
+			)
+			subject := NewHandler(goodIssuer, idps.Build(), oidctestutil.NewIdentityTransformsGetter(t, nil), oauthHelper, oauthStore, test.sessionLimits)
+
+			rsp := postTokenRequest(subject, happyAuthcodeRequestBody(authCode))
+			require.Equal(t, test.wantStatus, rsp.Code, rsp.Body.String())
+			if test.wantErrorResponseBody != "" {
+				require.JSONEq(t, test.wantErrorResponseBody, rsp.Body.String())
+			}
+
+			for _, existing := range test.existingSessions {
+				_, err := oauthStore.GetSessionRequestByRequestID(context.Background(), existing.GetID())
+				if contains(test.wantRevokedSessionIDs, existing.GetID()) {
+					require.True(t, errors.Is(err, fosite.ErrNotFound), "session %s should have been revoked", existing.GetID())
+					testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{"storage.pinniped.dev/request-id": existing.GetID()}, 0)
+				} else {
+					require.NoError(t, err, "session %s should not have been revoked", existing.GetID())
+				}
+			}
+
+			if test.wantRevokedUpstreamRefreshTok != "" {
+				idps.RequireExactlyOneCallToRevokeToken(t, upstreamName, &oidctestutil.RevokeTokenArgs{
+					Ctx:       context.Background(),
+					Token:     test.wantRevokedUpstreamRefreshTok,
+					TokenType: provider.RefreshTokenType,
+				})
+			} else {
+				idps.RequireExactlyZeroCallsToRevokeToken(t)
+			}
+		})
+	}
+}
+
+func TestValidateSessionLimitsDoesNotModifyTheSession(t *testing.T) {
+	now := time.Now().UTC()
+	request := &fosite.Request{Session: &psession.PinnipedSession{Custom: &psession.CustomSessionData{}}}
+
+	// Sessions which were started by older versions of Pinniped have no login time, so they are treated as if the
+	// user logged in now.
+	require.NoError(t, validateSessionLimits(request, time.Hour, time.Hour, now))
+	require.True(t, request.Session.(*psession.PinnipedSession).Custom.LoginTime.IsZero())
+
+	request.Session.(*psession.PinnipedSession).Custom.LoginTime = now.Add(-2 * time.Hour)
+	require.EqualError(t, validateSessionLimits(request, 0, time.Hour, now), "invalid_grant")
+	require.Equal(t, now.Add(-2*time.Hour), request.Session.(*psession.PinnipedSession).Custom.LoginTime)
+}
+
 func TestTokenEndpointTokenExchange(t *testing.T) { // tests for grant_type "urn:ietf:params:oauth:grant-type:token-exchange"
 	successfulAuthCodeExchange := tokenEndpointResponseExpectedValues{
 		wantStatus:            http.StatusOK,
@@ -666,6 +1173,51 @@ func TestTokenEndpointTokenExchange(t *testing.T) { // tests for grant_type "urn
 			wantStatus:               http.StatusBadRequest,
 			wantResponseBodyContains: "missing audience parameter",
 		},
+		{
+			name:                     "requested audience is the pinniped-cli client",
+			authcodeExchange:         doValidAuthCodeExchange,
+			requestedAudience:        "pinniped-cli",
+			wantStatus:               http.StatusBadRequest,
+			wantResponseBodyContains: `requested audience cannot equal 'pinniped-cli'`,
+		},
+		{
+			name:                     "requested audience is a dynamic client",
+			authcodeExchange:         doValidAuthCodeExchange,
+			requestedAudience:        confidentialClientBasic,
+			wantStatus:               http.StatusBadRequest,
+			wantResponseBodyContains: `requested audience cannot start with 'client.oauth.pinniped.dev-'`,
+		},
+		{
+			name:                     "requested audience contains .pinniped.dev",
+			authcodeExchange:         doValidAuthCodeExchange,
+			requestedAudience:        "some-cluster.pinniped.dev",
+			wantStatus:               http.StatusBadRequest,
+			wantResponseBodyContains: `requested audience cannot contain '.pinniped.dev'`,
+		},
+		{
+			name: "access token was issued to another client",
+			authcodeExchange: authcodeExchangeInputs{
+				modifyAuthRequest: func(authRequest *http.Request) {
+					modifyAuthRequestForConfidentialClient(confidentialClientPost)(authRequest)
+					authRequest.Form.Set("scope", "openid pinniped:request-audience")
+				},
+				modifyTokenRequest: func(r *http.Request, authCode string) {
+					r.Body = happyAuthcodeRequestBody(authCode).WithClientID(confidentialClientPost).WithRedirectURI(confidentialClientRedirectURI).
+						with("client_secret", confidentialClientSecret).ReadCloser()
+				},
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus:            http.StatusOK,
+					wantClientID:          confidentialClientPost,
+					wantSuccessBodyFields: []string{"id_token", "access_token", "token_type", "expires_in", "scope"},
+					wantRequestedScopes:   []string{"openid", "pinniped:request-audience"},
+					wantGrantedScopes:     []string{"openid", "pinniped:request-audience"},
+					wantGroups:            goodGroups,
+				},
+			},
+			requestedAudience:        "some-workload-cluster",
+			wantStatus:               http.StatusBadRequest,
+			wantResponseBodyContains: `The OAuth 2.0 Client ID from this request does not match the one from the authorize request.`,
+		},
 		{
 			name:              "missing subject_token",
 			authcodeExchange:  doValidAuthCodeExchange,
@@ -845,7 +1397,7 @@ func TestTokenEndpointTokenExchange(t *testing.T) { // tests for grant_type "urn
 			require.NoError(t, json.Unmarshal(parsedJWT.UnsafePayloadWithoutVerification(), &tokenClaims))
 
 			// Make sure that these are the only fields in the token.
-			idTokenFields := []string{"sub", "aud", "iss", "jti", "auth_time", "exp", "iat", "rat", "groups", "username"}
+			idTokenFields := []string{"sub", "aud", "iss", "jti", "auth_time", "exp", "iat", "rat", "groups", "username", "sid"}
 			require.ElementsMatch(t, idTokenFields, getMapKeys(tokenClaims))
 
 			// Assert that the returned token has expected claims values.
@@ -952,6 +1504,19 @@ func TestRefreshGrant(t *testing.T) {
 		return sessionData
 	}
 
+	withUpstreamGroups := func(sessionData *psession.CustomSessionData, upstreamGroups []string) *psession.CustomSessionData {
+		sessionData.UpstreamGroups = upstreamGroups
+		return sessionData
+	}
+
+	withSessionTimes := func(sessionData *psession.CustomSessionData, loginTime time.Time, lastRefreshTime time.Time) *psession.CustomSessionData {
+		sessionData.LoginTime = loginTime
+		sessionData.LastRefreshTime = lastRefreshTime
+		return sessionData
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+
 	happyOIDCUpstreamRefreshCall := func() *expectedUpstreamRefresh {
 		return &expectedUpstreamRefresh{
 			performedByUpstreamName: oidcUpstreamName,
@@ -1071,6 +1636,39 @@ func TestRefreshGrant(t *testing.T) {
 			UserDN: ldapUpstreamDN,
 		},
 	}
+	// The upstream username "username" and upstream groups are stored in the session by the authorize endpoint,
+	// and these transforms turn them into the downstream username and groups (goodUsername and goodGroups).
+	ldapUpstreamUsername := "username"
+	ldapCustomSessionDataWithUpstreamIdentity := func() *psession.CustomSessionData {
+		return &psession.CustomSessionData{
+			ProviderUID:      ldapUpstreamResourceUID,
+			ProviderName:     ldapUpstreamName,
+			ProviderType:     ldapUpstreamType,
+			UpstreamUsername: ldapUpstreamUsername,
+			UpstreamGroups:   []string{"upstream-group1", "groups2"},
+			LDAP: &psession.LDAPSessionData{
+				UserDN: ldapUpstreamDN,
+			},
+		}
+	}
+	ldapTransforms := idtransform.NewTransformationPipeline()
+	ldapTransforms.AppendTransformation(idtransform.NewUsernamePrefixTransformation("some-"))
+	ldapTransforms.AppendTransformation(idtransform.NewGroupsMapTransformation(map[string]string{"upstream-group1": "group1"}))
+
+	ldapRejectTransforms := idtransform.NewTransformationPipeline()
+	ldapRejectTransforms.AppendTransformation(idtransform.NewUsernamePrefixTransformation("some-"))
+	ldapRejectPolicy, err := idtransform.NewRejectPolicy("", `^groups2$`, "members of groups2 may not log in")
+	require.NoError(t, err)
+	ldapRejectTransforms.AppendTransformation(ldapRejectPolicy)
+
+	ldapDifferentUsernameTransforms := idtransform.NewTransformationPipeline()
+	ldapDifferentUsernameTransforms.AppendTransformation(idtransform.NewUsernamePrefixTransformation("other-"))
+
+	oidcGroupsTransforms := idtransform.NewTransformationPipeline()
+	oidcGroupsFilter, err := idtransform.NewGroupsFilterTransformation(`^new-group[12]$`, false)
+	require.NoError(t, err)
+	oidcGroupsTransforms.AppendTransformation(oidcGroupsFilter)
+
 	tests := []struct {
 		name                      string
 		idps                      *oidctestutil.UpstreamIDPListerBuilder
@@ -1248,7 +1846,45 @@ func TestRefreshGrant(t *testing.T) {
 					wantGroups:                        []string{"new-group1", "new-group2", "new-group3"},
 					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
 					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithIDAndRefreshTokens(), true),
-					wantCustomSessionDataStored:       upstreamOIDCCustomSessionDataWithNewRefreshToken(oidcUpstreamRefreshedRefreshToken),
+					wantCustomSessionDataStored: withUpstreamGroups(
+						upstreamOIDCCustomSessionDataWithNewRefreshToken(oidcUpstreamRefreshedRefreshToken),
+						[]string{"new-group1", "new-group2", "new-group3"},
+					),
+				},
+			},
+		},
+		{
+			name: "happy path refresh grant when the upstream refresh returns new group memberships and there are identity transforms, it applies the transforms to the new groups",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+				upstreamOIDCIdentityProviderBuilder().WithGroupsClaim("my-groups-claim").WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
+					IDToken: &oidctypes.IDToken{
+						Claims: map[string]interface{}{
+							"sub":             goodUpstreamSubject,
+							"my-groups-claim": []string{"new-group1", "new-group2", "new-group3"}, // refreshed claims includes updated groups
+						},
+					},
+				}).WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).Build()),
+			authcodeExchange: authcodeExchangeInputs{
+				customSessionData: initialUpstreamOIDCRefreshTokenCustomSessionData(),
+				idpTransforms: []provider.FederationDomainIdentityProvider{
+					{Name: oidcUpstreamName, Type: psession.ProviderTypeOIDC, Transforms: oidcGroupsTransforms},
+				},
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				want:              happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(initialUpstreamOIDCRefreshTokenCustomSessionData()),
+			},
+			refreshRequest: refreshRequestInputs{
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus:                        http.StatusOK,
+					wantSuccessBodyFields:             []string{"refresh_token", "access_token", "id_token", "token_type", "expires_in", "scope"},
+					wantRequestedScopes:               []string{"openid", "offline_access"},
+					wantGrantedScopes:                 []string{"openid", "offline_access"},
+					wantGroups:                        []string{"new-group1", "new-group2"},
+					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
+					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithIDAndRefreshTokens(), true),
+					wantCustomSessionDataStored: withUpstreamGroups(
+						upstreamOIDCCustomSessionDataWithNewRefreshToken(oidcUpstreamRefreshedRefreshToken),
+						[]string{"new-group1", "new-group2", "new-group3"},
+					),
 				},
 			},
 		},
@@ -1277,7 +1913,10 @@ func TestRefreshGrant(t *testing.T) {
 					wantGroups:                        []string{"new-group1", "new-group2", "new-group3"},
 					wantUpstreamRefreshCall:           happyOIDCUpstreamRefreshCall(),
 					wantUpstreamOIDCValidateTokenCall: happyUpstreamValidateTokenCall(refreshedUpstreamTokensWithIDAndRefreshTokens(), true),
-					wantCustomSessionDataStored:       upstreamOIDCCustomSessionDataWithNewRefreshToken(oidcUpstreamRefreshedRefreshToken),
+					wantCustomSessionDataStored: withUpstreamGroups(
+						upstreamOIDCCustomSessionDataWithNewRefreshToken(oidcUpstreamRefreshedRefreshToken),
+						[]string{"new-group1", "new-group2", "new-group3"},
+					),
 				},
 			},
 		},
@@ -1729,6 +2368,101 @@ func TestRefreshGrant(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "refresh grant within the idle timeout and the maximum session length records the time of the refresh",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+				upstreamOIDCIdentityProviderBuilder().WithValidatedAndMergedWithUserInfoTokens(&oidctypes.Token{
+					IDToken: &oidctypes.IDToken{
+						Claims: map[string]interface{}{
+							"sub": goodUpstreamSubject,
+						},
+					},
+				}).WithRefreshedTokens(refreshedUpstreamTokensWithIDAndRefreshTokens()).Build()),
+			authcodeExchange: authcodeExchangeInputs{
+				customSessionData: withSessionTimes(initialUpstreamOIDCRefreshTokenCustomSessionData(), now.Add(-2*time.Hour), now.Add(-30*time.Minute)),
+				sessionLimits:     SessionLimits{IdleTimeout: time.Hour, MaxLength: 8 * time.Hour},
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					withSessionTimes(initialUpstreamOIDCRefreshTokenCustomSessionData(), now.Add(-2*time.Hour), now.Add(-30*time.Minute)),
+				),
+			},
+			refreshRequest: refreshRequestInputs{
+				want: happyRefreshTokenResponseForOpenIDAndOfflineAccess(
+					// The time of the last refresh is required to be recent.
+					withSessionTimes(upstreamOIDCCustomSessionDataWithNewRefreshToken(oidcUpstreamRefreshedRefreshToken), now.Add(-2*time.Hour), time.Time{}),
+					refreshedUpstreamTokensWithIDAndRefreshTokens(),
+				),
+			},
+		},
+		{
+			name: "refresh grant after the session was idle for longer than the idle timeout since the last refresh",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
+			authcodeExchange: authcodeExchangeInputs{
+				customSessionData: withSessionTimes(initialUpstreamOIDCRefreshTokenCustomSessionData(), now.Add(-2*time.Hour), now.Add(-90*time.Minute)),
+				sessionLimits:     SessionLimits{IdleTimeout: time.Hour},
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					withSessionTimes(initialUpstreamOIDCRefreshTokenCustomSessionData(), now.Add(-2*time.Hour), now.Add(-90*time.Minute)),
+				),
+			},
+			refreshRequest: refreshRequestInputs{
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus: http.StatusBadRequest,
+					wantErrorResponseBody: here.Doc(`
+						{
+							"error":             "invalid_grant",
+							"error_description": "Your session has expired. It was idle for longer than the idle timeout of 1h0m0s."
+						}
+					`),
+				},
+			},
+		},
+		{
+			name: "refresh grant after the session was idle for longer than the idle timeout since the login",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
+			authcodeExchange: authcodeExchangeInputs{
+				customSessionData: withSessionTimes(initialUpstreamOIDCRefreshTokenCustomSessionData(), now.Add(-2*time.Hour), time.Time{}),
+				sessionLimits:     SessionLimits{IdleTimeout: time.Hour},
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					withSessionTimes(initialUpstreamOIDCRefreshTokenCustomSessionData(), now.Add(-2*time.Hour), time.Time{}),
+				),
+			},
+			refreshRequest: refreshRequestInputs{
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus: http.StatusBadRequest,
+					wantErrorResponseBody: here.Doc(`
+						{
+							"error":             "invalid_grant",
+							"error_description": "Your session has expired. It was idle for longer than the idle timeout of 1h0m0s."
+						}
+					`),
+				},
+			},
+		},
+		{
+			name: "refresh grant after the session reached the maximum session length",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
+			authcodeExchange: authcodeExchangeInputs{
+				customSessionData: withSessionTimes(initialUpstreamOIDCRefreshTokenCustomSessionData(), now.Add(-9*time.Hour), now.Add(-5*time.Minute)),
+				sessionLimits:     SessionLimits{MaxLength: 8 * time.Hour},
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					withSessionTimes(initialUpstreamOIDCRefreshTokenCustomSessionData(), now.Add(-9*time.Hour), now.Add(-5*time.Minute)),
+				),
+			},
+			refreshRequest: refreshRequestInputs{
+				want: tokenEndpointResponseExpectedValues{
+					wantStatus: http.StatusBadRequest,
+					wantErrorResponseBody: here.Doc(`
+						{
+							"error":             "invalid_grant",
+							"error_description": "Your session has expired. It reached the maximum session length of 8h0m0s."
+						}
+					`),
+				},
+			},
+		},
 		{
 			name: "when the provider in the session storage is not found due to its name during the refresh request",
 			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(upstreamOIDCIdentityProviderBuilder().Build()),
@@ -2004,6 +2738,173 @@ func TestRefreshGrant(t *testing.T) {
 				),
 			},
 		},
+		{
+			name: "upstream ldap refresh happy path when the upstream refresh returns new group memberships, it updates groups",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&oidctestutil.TestUpstreamLDAPIdentityProvider{
+				Name:                 ldapUpstreamName,
+				ResourceUID:          ldapUpstreamResourceUID,
+				URL:                  ldapUpstreamURL,
+				PerformRefreshGroups: []string{"new-group1", "new-group2"},
+			}),
+			authcodeExchange: authcodeExchangeInputs{
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				customSessionData: happyLDAPCustomSessionData,
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					happyLDAPCustomSessionData,
+				),
+			},
+			refreshRequest: refreshRequestInputs{
+				want: func() tokenEndpointResponseExpectedValues {
+					sessionData := *happyLDAPCustomSessionData
+					want := happyRefreshTokenResponseForLDAP(withUpstreamGroups(&sessionData, []string{"new-group1", "new-group2"}))
+					want.wantGroups = []string{"new-group1", "new-group2"}
+					return want
+				}(),
+			},
+		},
+		{
+			name: "upstream active directory refresh happy path when the upstream refresh returns new group memberships as an empty list, it updates groups to be empty",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(&oidctestutil.TestUpstreamLDAPIdentityProvider{
+				Name:                 activeDirectoryUpstreamName,
+				ResourceUID:          activeDirectoryUpstreamResourceUID,
+				URL:                  ldapUpstreamURL,
+				PerformRefreshGroups: []string{},
+			}),
+			authcodeExchange: authcodeExchangeInputs{
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				customSessionData: happyActiveDirectoryCustomSessionData,
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					happyActiveDirectoryCustomSessionData,
+				),
+			},
+			refreshRequest: refreshRequestInputs{
+				want: func() tokenEndpointResponseExpectedValues {
+					want := happyRefreshTokenResponseForActiveDirectory(happyActiveDirectoryCustomSessionData)
+					want.wantGroups = []string{} // the user no longer belongs to any groups
+					return want
+				}(),
+			},
+		},
+		{
+			name: "upstream ldap refresh happy path when the upstream refresh returns new group memberships and there are identity transforms, it applies the transforms to the new groups",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&oidctestutil.TestUpstreamLDAPIdentityProvider{
+				Name:                 ldapUpstreamName,
+				ResourceUID:          ldapUpstreamResourceUID,
+				URL:                  ldapUpstreamURL,
+				PerformRefreshGroups: []string{"upstream-group1", "new-group"},
+			}),
+			authcodeExchange: authcodeExchangeInputs{
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				customSessionData: ldapCustomSessionDataWithUpstreamIdentity(),
+				idpTransforms: []provider.FederationDomainIdentityProvider{
+					{Name: ldapUpstreamName, Type: psession.ProviderTypeLDAP, Transforms: ldapTransforms},
+				},
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					ldapCustomSessionDataWithUpstreamIdentity(),
+				),
+			},
+			refreshRequest: refreshRequestInputs{
+				want: func() tokenEndpointResponseExpectedValues {
+					want := happyRefreshTokenResponseForLDAP(withUpstreamGroups(ldapCustomSessionDataWithUpstreamIdentity(), []string{"upstream-group1", "new-group"}))
+					want.wantUpstreamRefreshCall.args.ExpectedUsername = ldapUpstreamUsername
+					want.wantGroups = []string{"group1", "new-group"}
+					return want
+				}(),
+			},
+		},
+		{
+			name: "upstream ldap refresh happy path with identity transforms uses the upstream username and re-applies the transforms",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&oidctestutil.TestUpstreamLDAPIdentityProvider{
+				Name:        ldapUpstreamName,
+				ResourceUID: ldapUpstreamResourceUID,
+				URL:         ldapUpstreamURL,
+			}),
+			authcodeExchange: authcodeExchangeInputs{
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				customSessionData: ldapCustomSessionDataWithUpstreamIdentity(),
+				idpTransforms: []provider.FederationDomainIdentityProvider{
+					{Name: ldapUpstreamName, Type: psession.ProviderTypeLDAP, Transforms: ldapTransforms},
+				},
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					ldapCustomSessionDataWithUpstreamIdentity(),
+				),
+			},
+			refreshRequest: refreshRequestInputs{
+				want: func() tokenEndpointResponseExpectedValues {
+					want := happyRefreshTokenResponseForLDAP(ldapCustomSessionDataWithUpstreamIdentity())
+					want.wantUpstreamRefreshCall.args.ExpectedUsername = ldapUpstreamUsername
+					return want
+				}(),
+			},
+		},
+		{
+			name: "upstream ldap refresh when the identity transforms now reject the user",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&oidctestutil.TestUpstreamLDAPIdentityProvider{
+				Name:        ldapUpstreamName,
+				ResourceUID: ldapUpstreamResourceUID,
+				URL:         ldapUpstreamURL,
+			}),
+			authcodeExchange: authcodeExchangeInputs{
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				customSessionData: ldapCustomSessionDataWithUpstreamIdentity(),
+				idpTransforms: []provider.FederationDomainIdentityProvider{
+					{Name: ldapUpstreamName, Type: psession.ProviderTypeLDAP, Transforms: ldapRejectTransforms},
+				},
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					ldapCustomSessionDataWithUpstreamIdentity(),
+				),
+			},
+			refreshRequest: refreshRequestInputs{
+				want: func() tokenEndpointResponseExpectedValues {
+					want := tokenEndpointResponseExpectedValues{
+						wantUpstreamRefreshCall: happyLDAPUpstreamRefreshCall(),
+						wantStatus:              http.StatusUnauthorized,
+						wantErrorResponseBody: here.Doc(`
+							{
+								"error":             "error",
+								"error_description": "Error during upstream refresh. Upstream refresh error while applying configured identity transformations: configured identity policy rejected this authentication: members of groups2 may not log in."
+							}
+						`),
+					}
+					want.wantUpstreamRefreshCall.args.ExpectedUsername = ldapUpstreamUsername
+					return want
+				}(),
+			},
+		},
+		{
+			name: "upstream ldap refresh when the identity transforms now produce a different username",
+			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&oidctestutil.TestUpstreamLDAPIdentityProvider{
+				Name:        ldapUpstreamName,
+				ResourceUID: ldapUpstreamResourceUID,
+				URL:         ldapUpstreamURL,
+			}),
+			authcodeExchange: authcodeExchangeInputs{
+				modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+				customSessionData: ldapCustomSessionDataWithUpstreamIdentity(),
+				idpTransforms: []provider.FederationDomainIdentityProvider{
+					{Name: ldapUpstreamName, Type: psession.ProviderTypeLDAP, Transforms: ldapDifferentUsernameTransforms},
+				},
+				want: happyAuthcodeExchangeTokenResponseForOpenIDAndOfflineAccess(
+					ldapCustomSessionDataWithUpstreamIdentity(),
+				),
+			},
+			refreshRequest: refreshRequestInputs{
+				want: func() tokenEndpointResponseExpectedValues {
+					want := tokenEndpointResponseExpectedValues{
+						wantUpstreamRefreshCall: happyLDAPUpstreamRefreshCall(),
+						wantStatus:              http.StatusUnauthorized,
+						wantErrorResponseBody: here.Doc(`
+							{
+								"error":             "error",
+								"error_description": "Error during upstream refresh. Upstream refresh failed."
+							}
+						`),
+					}
+					want.wantUpstreamRefreshCall.args.ExpectedUsername = ldapUpstreamUsername
+					return want
+				}(),
+			},
+		},
 		{
 			name: "upstream ldap refresh when the LDAP session data is nil",
 			idps: oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&oidctestutil.TestUpstreamLDAPIdentityProvider{
@@ -2845,7 +3746,7 @@ func exchangeAuthcodeForTokens(t *testing.T, test authcodeExchangeInputs, idps p
 
 	var oauthHelper fosite.OAuth2Provider
 
-	oauthStore = oidc.NewKubeStorage(secrets, oidc.DefaultOIDCTimeoutsConfiguration())
+	oauthStore = oidc.NewKubeStorage(secrets, newClientManager(t), oidc.DefaultOIDCTimeoutsConfiguration())
 	if test.makeOathHelper != nil {
 		oauthHelper, authCode, jwtSigningKey = test.makeOathHelper(t, authRequest, oauthStore, test.customSessionData)
 	} else {
@@ -2857,7 +3758,7 @@ func exchangeAuthcodeForTokens(t *testing.T, test authcodeExchangeInputs, idps p
 		test.modifyStorage(t, oauthStore, authCode)
 	}
 
-	subject = NewHandler(idps, oauthHelper)
+	subject = NewHandler(goodIssuer, idps, oidctestutil.NewIdentityTransformsGetter(t, test.idpTransforms), oauthHelper, oauthStore, test.sessionLimits)
 
 	authorizeEndpointGrantedOpenIDScope := strings.Contains(authRequest.Form.Get("scope"), "openid")
 	expectedNumberOfIDSessionsStored := 0
@@ -2926,11 +3827,16 @@ func requireTokenEndpointBehavior(
 		wantIDToken := contains(test.wantSuccessBodyFields, "id_token")
 		wantRefreshToken := contains(test.wantSuccessBodyFields, "refresh_token")
 
+		wantClientID := test.wantClientID
+		if wantClientID == "" {
+			wantClientID = goodClient
+		}
+
 		requireInvalidAuthCodeStorage(t, authCode, oauthStore, secrets)
-		requireValidAccessTokenStorage(t, parsedResponseBody, oauthStore, test.wantRequestedScopes, test.wantGrantedScopes, test.wantGroups, test.wantCustomSessionDataStored, secrets)
+		requireValidAccessTokenStorage(t, parsedResponseBody, oauthStore, wantClientID, test.wantRequestedScopes, test.wantGrantedScopes, test.wantGroups, test.wantCustomSessionDataStored, secrets)
 		requireInvalidPKCEStorage(t, authCode, oauthStore)
 		// Performing a refresh does not update the OIDC storage, so after a refresh it should still have the old custom session data and old groups from the initial login.
-		requireValidOIDCStorage(t, parsedResponseBody, authCode, oauthStore, test.wantRequestedScopes, test.wantGrantedScopes, oldGroups, oldCustomSessionData)
+		requireValidOIDCStorage(t, parsedResponseBody, authCode, oauthStore, wantClientID, test.wantRequestedScopes, test.wantGrantedScopes, oldGroups, oldCustomSessionData)
 
 		expectedNumberOfRefreshTokenSessionsStored := 0
 		if wantRefreshToken {
@@ -2939,10 +3845,10 @@ func requireTokenEndpointBehavior(
 		expectedNumberOfIDSessionsStored := 0
 		if wantIDToken {
 			expectedNumberOfIDSessionsStored = 1
-			requireValidIDToken(t, parsedResponseBody, jwtSigningKey, wantAtHashClaimInIDToken, wantNonceValueInIDToken, test.wantGroups, parsedResponseBody["access_token"].(string))
+			requireValidIDToken(t, parsedResponseBody, jwtSigningKey, wantClientID, wantAtHashClaimInIDToken, wantNonceValueInIDToken, test.wantGroups, parsedResponseBody["access_token"].(string))
 		}
 		if wantRefreshToken {
-			requireValidRefreshTokenStorage(t, parsedResponseBody, oauthStore, test.wantRequestedScopes, test.wantGrantedScopes, test.wantGroups, test.wantCustomSessionDataStored, secrets)
+			requireValidRefreshTokenStorage(t, parsedResponseBody, oauthStore, wantClientID, test.wantRequestedScopes, test.wantGrantedScopes, test.wantGroups, test.wantCustomSessionDataStored, secrets)
 		}
 
 		testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: authorizationcode.TypeLabelValue}, 1)
@@ -2968,6 +3874,41 @@ func hashAccessToken(accessToken string) string {
 	return base64.RawURLEncoding.EncodeToString(b[:len(b)/2])
 }
 
+// newClientManager returns a client manager which knows about the pinniped-cli client and about two confidential
+// clients, which use client_secret_basic and client_secret_post respectively.
+func newClientManager(t *testing.T) *clientregistry.ClientManager {
+	newOIDCClient := func(name string, authMethod configv1alpha1.TokenEndpointAuthMethod) *configv1alpha1.OIDCClient {
+		return &configv1alpha1.OIDCClient{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "some-namespace"},
+			Spec: configv1alpha1.OIDCClientSpec{
+				AllowedRedirectURIs:     []configv1alpha1.RedirectURI{confidentialClientRedirectURI},
+				AllowedGrantTypes:       []configv1alpha1.GrantType{"authorization_code", "refresh_token", "urn:ietf:params:oauth:grant-type:token-exchange"},
+				AllowedScopes:           []configv1alpha1.Scope{"openid", "offline_access", "profile", "email", "pinniped:request-audience"},
+				ClientSecret:            configv1alpha1.OIDCClientSecret{SecretName: "some-client-secret"},
+				TokenEndpointAuthMethod: authMethod,
+			},
+		}
+	}
+	return oidctestutil.NewClientManager(t, "some-namespace",
+		[]*configv1alpha1.OIDCClient{
+			newOIDCClient(confidentialClientBasic, configv1alpha1.ClientSecretBasic),
+			newOIDCClient(confidentialClientPost, configv1alpha1.ClientSecretPost),
+		},
+		[]*corev1.Secret{{
+			ObjectMeta: metav1.ObjectMeta{Name: "some-client-secret", Namespace: "some-namespace"},
+			Type:       "secrets.pinniped.dev/oidc-client-secret",
+			Data:       map[string][]byte{"clientSecretHash": []byte(confidentialClientSecretHash)},
+		}},
+	)
+}
+
+func modifyAuthRequestForConfidentialClient(clientID string) func(authRequest *http.Request) {
+	return func(authRequest *http.Request) {
+		authRequest.Form.Set("client_id", clientID)
+		authRequest.Form.Set("redirect_uri", confidentialClientRedirectURI)
+	}
+}
+
 type body url.Values
 
 func happyAuthcodeRequestBody(happyAuthCode string) body {
@@ -2989,6 +3930,67 @@ func happyRefreshRequestBody(refreshToken string) body {
 	}
 }
 
+func happyDeviceCodeRequestBody(deviceCode string) body {
+	return map[string][]string{
+		"grant_type":  {oidc.DeviceCodeGrantType},
+		"device_code": {deviceCode},
+		"client_id":   {goodClient},
+	}
+}
+
+func postTokenRequest(subject http.Handler, requestBody body) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/path/shouldn't/matter", requestBody.ReadCloser())
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rsp := httptest.NewRecorder()
+	subject.ServeHTTP(rsp, req)
+	return rsp
+}
+
+// createDeviceCodeSession simulates the device authorization endpoint having already run, and the callback endpoint
+// having already run when the status is approved.
+func createDeviceCodeSession(t *testing.T, oauthStore *oidc.KubeStorage, deviceCode string, status devicecode.Status, expiresAt time.Time, lastPolledAgo time.Duration) {
+	t.Helper()
+
+	ctx := context.Background()
+	client, err := oauthStore.GetClient(ctx, goodClient)
+	require.NoError(t, err)
+
+	request := fosite.NewRequest()
+	request.ID = "some-request-id"
+	request.Client = client
+	request.RequestedScope = fosite.Arguments{"openid", "offline_access"}
+	request.Session = psession.NewPinnipedSession()
+	if status == devicecode.StatusApproved {
+		request.GrantedScope = fosite.Arguments{"openid", "offline_access"}
+		request.Session = &psession.PinnipedSession{
+			Fosite: &openid.DefaultSession{
+				Claims: &jwt.IDTokenClaims{
+					Subject:     goodSubject,
+					RequestedAt: goodRequestedAtTime,
+					AuthTime:    goodAuthTime,
+					Extra: map[string]interface{}{
+						oidc.DownstreamUsernameClaim:  goodUsername,
+						oidc.DownstreamGroupsClaim:    goodGroups,
+						oidc.DownstreamSessionIDClaim: request.ID,
+					},
+				},
+			},
+		}
+	}
+
+	session := &devicecode.Session{
+		Request:   request,
+		Signature: oidc.DeviceCodeSignature(deviceCode),
+		UserCode:  "BCDF-GHJK",
+		Status:    status,
+		ExpiresAt: expiresAt,
+	}
+	if lastPolledAgo != 0 {
+		session.LastPolledAt = time.Now().Add(-lastPolledAgo)
+	}
+	require.NoError(t, oauthStore.CreateDeviceCodeSession(ctx, session))
+}
+
 func (b body) WithGrantType(grantType string) body {
 	return b.with("grant_type", grantType)
 }
@@ -3065,7 +4067,7 @@ type singleUseJWKProvider struct {
 	calls int
 }
 
-func (s *singleUseJWKProvider) GetJWKS(issuerName string) (jwks *jose.JSONWebKeySet, activeJWK *jose.JSONWebKey) {
+func (s *singleUseJWKProvider) GetJWKS(issuerName string) (jwks *jose.JSONWebKeySet, activeSigner signer.Signer) {
 	s.calls++
 	if s.calls > 1 {
 		return nil, nil
@@ -3128,6 +4130,8 @@ func simulateAuthEndpointHavingAlreadyRun(
 	}
 	authRequester, err := oauthHelper.NewAuthorizeRequest(ctx, authRequest)
 	require.NoError(t, err)
+	// Like the authorize and callback endpoints, use the ID of the authorize request as the downstream session ID.
+	session.IDTokenClaims().Extra[oidc.DownstreamSessionIDClaim] = authRequester.GetID()
 	if strings.Contains(authRequest.Form.Get("scope"), "openid") {
 		authRequester.GrantScope("openid")
 	}
@@ -3148,11 +4152,14 @@ func generateJWTSigningKeyAndJWKSProvider(t *testing.T, issuer string) (*ecdsa.P
 	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	require.NoError(t, err)
 
+	activeSigner, err := signer.NewJWKSigner(&jose.JSONWebKey{Key: key})
+	require.NoError(t, err)
+
 	jwksProvider := jwks.NewDynamicJWKSProvider()
 	jwksProvider.SetIssuerToJWKSMap(
 		nil, // public JWKS unused
-		map[string]*jose.JSONWebKey{
-			issuer: {Key: key},
+		map[string]signer.Signer{
+			issuer: activeSigner,
 		},
 	)
 
@@ -3178,6 +4185,7 @@ func requireValidRefreshTokenStorage(
 	t *testing.T,
 	body map[string]interface{},
 	storage fositeoauth2.CoreStorage,
+	wantClientID string,
 	wantRequestedScopes []string,
 	wantGrantedScopes []string,
 	wantGroups []string,
@@ -3200,6 +4208,7 @@ func requireValidRefreshTokenStorage(
 		t,
 		storedRequest,
 		storedRequest.Sanitize([]string{}).GetRequestForm(),
+		wantClientID,
 		wantRequestedScopes,
 		wantGrantedScopes,
 		true,
@@ -3214,6 +4223,7 @@ func requireValidAccessTokenStorage(
 	t *testing.T,
 	body map[string]interface{},
 	storage fositeoauth2.CoreStorage,
+	wantClientID string,
 	wantRequestedScopes []string,
 	wantGrantedScopes []string,
 	wantGroups []string,
@@ -3255,6 +4265,7 @@ func requireValidAccessTokenStorage(
 		t,
 		storedRequest,
 		storedRequest.Sanitize([]string{}).GetRequestForm(),
+		wantClientID,
 		wantRequestedScopes,
 		wantGrantedScopes,
 		true,
@@ -3299,6 +4310,7 @@ func requireValidOIDCStorage(
 	body map[string]interface{},
 	code string,
 	storage openid.OpenIDConnectRequestStorage,
+	wantClientID string,
 	wantRequestedScopes []string,
 	wantGrantedScopes []string,
 	wantGroups []string,
@@ -3322,6 +4334,7 @@ func requireValidOIDCStorage(
 			t,
 			storedRequest,
 			storedRequest.Sanitize([]string{"nonce"}).GetRequestForm(),
+			wantClientID,
 			wantRequestedScopes,
 			wantGrantedScopes,
 			false,
@@ -3338,6 +4351,7 @@ func requireValidStoredRequest(
 	t *testing.T,
 	request fosite.Requester,
 	wantRequestForm url.Values,
+	wantClientID string,
 	wantRequestedScopes []string,
 	wantGrantedScopes []string,
 	wantAccessTokenExpiresAt bool,
@@ -3349,7 +4363,7 @@ func requireValidStoredRequest(
 	// Assert that the getters on the request return what we think they should.
 	require.NotEmpty(t, request.GetID())
 	testutil.RequireTimeInDelta(t, request.GetRequestedAt(), time.Now().UTC(), timeComparisonFudgeSeconds*time.Second)
-	require.Equal(t, goodClient, request.GetClient().GetID())
+	require.Equal(t, wantClientID, request.GetClient().GetID())
 	require.Equal(t, fosite.Arguments(wantRequestedScopes), request.GetRequestedScopes())
 	require.Equal(t, fosite.Arguments(wantGrantedScopes), request.GetGrantedScopes())
 	require.Empty(t, request.GetRequestedAudience())
@@ -3370,6 +4384,7 @@ func requireValidStoredRequest(
 		require.Equal(t, map[string]interface{}{
 			"username": goodUsername,
 			"groups":   toSliceOfInterface(wantGroups),
+			"sid":      request.GetID(),
 		}, claims.Extra)
 
 		// We are in charge of setting these fields. For the purpose of testing, we ensure that the
@@ -3377,11 +4392,12 @@ func requireValidStoredRequest(
 		require.Equal(t, goodRequestedAtTime, claims.RequestedAt)
 		require.Equal(t, goodAuthTime, claims.AuthTime)
 
+		require.Empty(t, claims.Issuer)
+
 		// These fields will all be given good defaults by fosite at runtime and we only need to use them
 		// if we want to override the default behaviors. We currently don't need to override these defaults,
 		// so they do not end up being stored. Fosite sets its defaults at runtime in openid.DefaultStrategy's
 		// GenerateIDToken() method.
-		require.Empty(t, claims.Issuer)
 		require.Empty(t, claims.Audience)
 		require.Empty(t, claims.Nonce)
 		require.Zero(t, claims.ExpiresAt)
@@ -3431,7 +4447,36 @@ func requireValidStoredRequest(
 	require.Empty(t, session.Fosite.Subject)
 
 	// The custom session data was stored as expected.
-	require.Equal(t, wantCustomSessionData, session.Custom)
+	requireCustomSessionDataEqual(t, wantCustomSessionData, session.Custom)
+}
+
+// requireCustomSessionDataEqual compares custom session data. The token endpoint records the current time as the time
+// of the last refresh, and also as the login time of sessions which do not have one yet, so those times are only
+// required to be recent.
+func requireCustomSessionDataEqual(t *testing.T, want *psession.CustomSessionData, actual *psession.CustomSessionData) {
+	t.Helper()
+
+	if want == nil || actual == nil {
+		require.Equal(t, want, actual)
+		return
+	}
+
+	wantCopy := *want
+	want = &wantCopy
+	if !actual.LastRefreshTime.IsZero() && want.LastRefreshTime.IsZero() {
+		testutil.RequireTimeInDelta(t, time.Now().UTC(), actual.LastRefreshTime, timeComparisonFudgeSeconds*time.Second)
+		want.LastRefreshTime = actual.LastRefreshTime
+	}
+	if !actual.LoginTime.IsZero() && want.LoginTime.IsZero() {
+		testutil.RequireTimeInDelta(t, time.Now().UTC(), actual.LoginTime, timeComparisonFudgeSeconds*time.Second)
+		want.LoginTime = actual.LoginTime
+	}
+	// The token endpoint records its issuer in the sessions of new logins.
+	if actual.FederationDomainIssuer != "" && want.FederationDomainIssuer == "" {
+		require.Equal(t, goodIssuer, actual.FederationDomainIssuer)
+		want.FederationDomainIssuer = actual.FederationDomainIssuer
+	}
+	require.Equal(t, want, actual)
 }
 
 func requireGarbageCollectTimeInDelta(t *testing.T, tokenString string, typeLabel string, secrets v1.SecretInterface, wantExpirationTime time.Time, deltaTime time.Duration) {
@@ -3456,6 +4501,7 @@ func requireValidIDToken(
 	t *testing.T,
 	body map[string]interface{},
 	jwtSigningKey *ecdsa.PrivateKey,
+	wantClientID string,
 	wantAtHashClaimInIDToken bool,
 	wantNonceValueInIDToken bool,
 	wantGroupsInIDToken []string,
@@ -3469,7 +4515,7 @@ func requireValidIDToken(
 	require.Truef(t, ok, "wanted id_token to be a string, but got %T", idToken)
 
 	// The go-oidc library will validate the signature and the client claim in the ID token.
-	token := oidctestutil.VerifyECDSAIDToken(t, goodIssuer, goodClient, jwtSigningKey, idTokenString)
+	token := oidctestutil.VerifyECDSAIDToken(t, goodIssuer, wantClientID, jwtSigningKey, idTokenString)
 
 	var claims struct {
 		Subject         string   `json:"sub"`
@@ -3484,12 +4530,13 @@ func requireValidIDToken(
 		AuthTime        int64    `json:"auth_time"`
 		Groups          []string `json:"groups"`
 		Username        string   `json:"username"`
+		SessionID       string   `json:"sid"`
 	}
 
 	// Note that there is a bug in fosite which prevents the `at_hash` claim from appearing in this ID token
 	// during the initial authcode exchange, but does not prevent `at_hash` from appearing in the refreshed ID token.
 	// We can add a workaround for this later.
-	idTokenFields := []string{"sub", "aud", "iss", "jti", "auth_time", "exp", "iat", "rat", "groups", "username"}
+	idTokenFields := []string{"sub", "aud", "iss", "jti", "auth_time", "exp", "iat", "rat", "groups", "username", "sid"}
 	if wantAtHashClaimInIDToken {
 		idTokenFields = append(idTokenFields, "at_hash")
 	}
@@ -3509,9 +4556,10 @@ func requireValidIDToken(
 	require.Equal(t, goodUsername, claims.Username)
 	require.Equal(t, wantGroupsInIDToken, claims.Groups)
 	require.Len(t, claims.Audience, 1)
-	require.Equal(t, goodClient, claims.Audience[0])
+	require.Equal(t, wantClientID, claims.Audience[0])
 	require.Equal(t, goodIssuer, claims.Issuer)
 	require.NotEmpty(t, claims.JTI)
+	require.NotEmpty(t, claims.SessionID)
 
 	if wantNonceValueInIDToken {
 		require.Equal(t, goodNonce, claims.Nonce)
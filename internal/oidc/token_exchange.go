@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package oidc
@@ -6,6 +6,7 @@ package oidc
 import (
 	"context"
 	"net/url"
+	"strings"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/ory/fosite"
@@ -13,12 +14,20 @@ import (
 	"github.com/ory/fosite/handler/oauth2"
 	"github.com/ory/fosite/handler/openid"
 	"github.com/pkg/errors"
+
+	"go.pinniped.dev/internal/oidcclientvalidator"
 )
 
 const (
-	tokenTypeAccessToken       = "urn:ietf:params:oauth:token-type:access_token" //nolint: gosec
-	tokenTypeJWT               = "urn:ietf:params:oauth:token-type:jwt"          //nolint: gosec
-	pinnipedTokenExchangeScope = "pinniped:request-audience"                     //nolint: gosec
+	tokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token" //nolint: gosec
+	tokenTypeJWT         = "urn:ietf:params:oauth:token-type:jwt"          //nolint: gosec
+
+	// RequestAudienceScope is the scope which allows an access token to be used for audiences other than the
+	// client to which it was issued, e.g. to exchange it for a cluster-scoped ID token.
+	RequestAudienceScope = "pinniped:request-audience" //nolint: gosec
+
+	// pinnipedCLIClientID is the client ID of the static client which is used by the Pinniped CLI.
+	pinnipedCLIClientID = "pinniped-cli"
 )
 
 type stsParams struct {
@@ -67,9 +76,15 @@ func (t *TokenExchangeHandler) PopulateTokenEndpointResponse(ctx context.Context
 		return errors.WithStack(err)
 	}
 
+	// Require that the client which is exchanging the access token is the client to which it was issued.
+	if originalRequester.GetClient().GetID() != requester.GetClient().GetID() {
+		// This error message is copied from the similar check in fosite's flow_refresh.go.
+		return errors.WithStack(fosite.ErrInvalidGrant.WithHint("The OAuth 2.0 Client ID from this request does not match the one from the authorize request."))
+	}
+
 	// Require that the incoming access token has the pinniped:request-audience and OpenID scopes.
-	if !originalRequester.GetGrantedScopes().Has(pinnipedTokenExchangeScope) {
-		return errors.WithStack(fosite.ErrAccessDenied.WithHintf("missing the %q scope", pinnipedTokenExchangeScope))
+	if !originalRequester.GetGrantedScopes().Has(RequestAudienceScope) {
+		return errors.WithStack(fosite.ErrAccessDenied.WithHintf("missing the %q scope", RequestAudienceScope))
 	}
 	if !originalRequester.GetGrantedScopes().Has(oidc.ScopeOpenID) {
 		return errors.WithStack(fosite.ErrAccessDenied.WithHintf("missing the %q scope", oidc.ScopeOpenID))
@@ -88,6 +103,8 @@ func (t *TokenExchangeHandler) PopulateTokenEndpointResponse(ctx context.Context
 	return nil
 }
 
+// mintJWT signs the cluster-scoped token with the same signer as the FederationDomain's ID tokens, since
+// idTokenStrategy gets the FederationDomain's active signer from the jwks provider.
 func (t *TokenExchangeHandler) mintJWT(ctx context.Context, requester fosite.Requester, audience string) (string, error) {
 	downscoped := fosite.NewAccessRequest(requester.GetSession())
 	downscoped.Client.(*fosite.DefaultClient).ID = audience
@@ -102,6 +119,16 @@ func (t *TokenExchangeHandler) validateParams(params url.Values) (*stsParams, er
 	if result.requestedAudience == "" {
 		return nil, fosite.ErrInvalidRequest.WithHint("missing audience parameter")
 	}
+	// The audience of the minted token must not be a client of the Supervisor, otherwise one client could mint
+	// ID tokens which look like they were issued to another client.
+	switch {
+	case result.requestedAudience == pinnipedCLIClientID:
+		return nil, fosite.ErrInvalidRequest.WithHintf("requested audience cannot equal %q", pinnipedCLIClientID)
+	case strings.HasPrefix(result.requestedAudience, oidcclientvalidator.ClientIDPrefix):
+		return nil, fosite.ErrInvalidRequest.WithHintf("requested audience cannot start with %q", oidcclientvalidator.ClientIDPrefix)
+	case strings.Contains(result.requestedAudience, ".pinniped.dev"):
+		return nil, fosite.ErrInvalidRequest.WithHint("requested audience cannot contain '.pinniped.dev'")
+	}
 	result.subjectAccessToken = params.Get("subject_token")
 	if result.subjectAccessToken == "" {
 		return nil, fosite.ErrInvalidRequest.WithHint("missing subject_token parameter")
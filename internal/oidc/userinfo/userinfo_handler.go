@@ -0,0 +1,105 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package userinfo provides a handler for the OIDC UserInfo endpoint.
+package userinfo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	coreosoidc "github.com/coreos/go-oidc/v3/oidc"
+	"github.com/ory/fosite"
+
+	"go.pinniped.dev/internal/httputil/securityheader"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/psession"
+)
+
+// NewHandler returns an http.Handler which implements the OIDC UserInfo endpoint
+// (https://openid.net/specs/openid-connect-core-1_0.html#UserInfo). The client authenticates using a downstream
+// access token which was granted the "openid" scope. The response contains the subject, the username and groups of
+// the session, and those upstream ID token claims which are named by passthroughClaims.
+func NewHandler(oauthHelper fosite.OAuth2Provider, passthroughClaims []string) http.Handler {
+	return securityheader.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			http.Error(w, `Method not allowed (try GET or POST)`, http.StatusMethodNotAllowed)
+			return
+		}
+
+		// The access token may be sent using either of the methods from RFC 6750 which are allowed by the spec.
+		accessToken := fosite.AccessTokenFromRequest(r)
+		if accessToken == "" {
+			// RFC 6750 says not to include an error code when the request has no authentication information.
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// This checks the signature of the token, that its session exists in storage, that it is not expired,
+		// and that it was granted the "openid" scope.
+		tokenUse, requester, err := oauthHelper.IntrospectToken(r.Context(), accessToken, fosite.AccessToken, psession.NewPinnipedSession(), coreosoidc.ScopeOpenID)
+		if err == nil && tokenUse != fosite.AccessToken {
+			// Fosite will also accept refresh tokens, but only access tokens may be used here.
+			err = fosite.ErrRequestUnauthorized.WithHint("The token is not an access token.")
+		}
+		if err != nil {
+			plog.Info("userinfo request error", oidc.FositeErrorForLog(err)...)
+			if errors.Is(err, fosite.ErrInvalidScope) {
+				writeBearerError(w, http.StatusForbidden, "insufficient_scope", "The access token was not granted the openid scope.")
+				return
+			}
+			writeBearerError(w, http.StatusUnauthorized, "invalid_token", "The access token is invalid or expired.")
+			return
+		}
+
+		claims, err := userInfoClaims(requester, passthroughClaims)
+		if err != nil {
+			plog.Error("error reading userinfo claims from the downstream session", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(claims); err != nil {
+			plog.Error("error writing userinfo response", err)
+		}
+	}))
+}
+
+// userInfoClaims returns the subject, username, and groups of the downstream session, and those upstream claims of
+// the session which are named by passthroughClaims. Other claims of the session are never returned.
+func userInfoClaims(requester fosite.Requester, passthroughClaims []string) (map[string]interface{}, error) {
+	session, ok := requester.GetSession().(*psession.PinnipedSession)
+	if !ok || session.Fosite == nil || session.Fosite.Claims == nil {
+		return nil, fmt.Errorf("unexpected session type %T", requester.GetSession())
+	}
+
+	claims := map[string]interface{}{}
+	if session.Custom != nil && session.Custom.OIDC != nil {
+		for _, name := range passthroughClaims {
+			if value, ok := session.Custom.OIDC.PassthroughClaims[name]; ok {
+				claims[name] = value
+			}
+		}
+	}
+	if _, ok := session.Fosite.Claims.Extra[oidc.DownstreamUsernameClaim]; ok {
+		claims[oidc.DownstreamUsernameClaim] = oidc.DownstreamUsername(session.Fosite.Claims)
+	}
+	if _, ok := session.Fosite.Claims.Extra[oidc.DownstreamGroupsClaim]; ok {
+		claims[oidc.DownstreamGroupsClaim] = oidc.DownstreamGroups(session.Fosite.Claims)
+	}
+	claims["sub"] = session.Fosite.Claims.Subject
+	return claims, nil
+}
+
+// writeBearerError writes an error response as described by RFC 6750.
+func writeBearerError(w http.ResponseWriter, status int, errorCode string, description string) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error=%q, error_description=%q`, errorCode, description))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": errorCode, "error_description": description})
+}
@@ -0,0 +1,220 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package oidcclientvalidator validates OIDCClient resources. It is shared by the controller which reports the
+// validation results on the status of each OIDCClient and by the client registry which refuses to use invalid clients.
+package oidcclientvalidator
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	coreosoidc "github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/crypto/bcrypt"
+	corev1 "k8s.io/api/core/v1"
+
+	"go.pinniped.dev/generated/latest/apis/supervisor/config/v1alpha1"
+)
+
+const (
+	// ClientIDPrefix is the required prefix for the names of OIDCClients. It prevents dynamic clients from colliding
+	// with the static pinniped-cli client.
+	ClientIDPrefix = "client.oauth.pinniped.dev-"
+
+	// SecretType is the required type of the Secret which holds the client secret of an OIDCClient.
+	SecretType = corev1.SecretType("secrets.pinniped.dev/oidc-client-secret")
+
+	// SecretHashKey is the key of the Secret whose value is the bcrypt hash of the client secret.
+	SecretHashKey = "clientSecretHash"
+
+	// MinimumBcryptCost is the lowest bcrypt cost which is accepted for client secret hashes.
+	MinimumBcryptCost = 12
+
+	authorizationCodeGrantType = "authorization_code"
+	refreshTokenGrantType      = "refresh_token"
+	tokenExchangeGrantType     = "urn:ietf:params:oauth:grant-type:token-exchange" //nolint:gosec // this is not a credential
+	requestAudienceScope       = "pinniped:request-audience"
+
+	typeClientIDValid            = "ClientIDValid"
+	typeAllowedRedirectURIsValid = "AllowedRedirectURIsValid"
+	typeAllowedGrantTypesValid   = "AllowedGrantTypesValid"
+	typeAllowedScopesValid       = "AllowedScopesValid"
+	typeClientSecretValid        = "ClientSecretValid"
+
+	reasonSuccess              = "Success"
+	reasonInvalidClientID      = "InvalidClientID"
+	reasonInvalidRedirectURI   = "InvalidRedirectURI"
+	reasonMissingRequiredValue = "MissingRequiredValue"
+	reasonSecretNotFound       = "SecretNotFound"
+	reasonSecretWrongType      = "SecretWrongType"
+	reasonSecretMissingKeys    = "SecretMissingKeys"
+	reasonSecretInvalidHash    = "SecretInvalidHash"
+)
+
+// Validate validates the OIDCClient and the Secret which it references. The secret may be nil when it was not found.
+// It returns true when the OIDCClient may be used, along with one condition for each aspect which was validated, and
+// the bcrypt hash of the client secret.
+func Validate(oidcClient *v1alpha1.OIDCClient, secret *corev1.Secret) (bool, []*v1alpha1.Condition, []byte) {
+	conditions := []*v1alpha1.Condition{
+		validateClientID(oidcClient),
+		validateRedirectURIs(oidcClient),
+		validateGrantTypes(oidcClient),
+		validateScopes(oidcClient),
+	}
+	secretCondition, hash := validateSecret(oidcClient, secret)
+	conditions = append(conditions, secretCondition)
+
+	for _, c := range conditions {
+		if c.Status != v1alpha1.ConditionTrue {
+			return false, conditions, nil
+		}
+	}
+	return true, conditions, hash
+}
+
+func validateClientID(oidcClient *v1alpha1.OIDCClient) *v1alpha1.Condition {
+	if !strings.HasPrefix(oidcClient.Name, ClientIDPrefix) || len(oidcClient.Name) == len(ClientIDPrefix) {
+		return falseCondition(typeClientIDValid, reasonInvalidClientID,
+			fmt.Sprintf("client ID %q must begin with %q followed by at least one character", oidcClient.Name, ClientIDPrefix))
+	}
+	return trueCondition(typeClientIDValid, fmt.Sprintf("client ID %q is valid", oidcClient.Name))
+}
+
+func validateRedirectURIs(oidcClient *v1alpha1.OIDCClient) *v1alpha1.Condition {
+	for _, redirectURI := range oidcClient.Spec.AllowedRedirectURIs {
+		if err := validateRedirectURI(string(redirectURI)); err != nil {
+			return falseCondition(typeAllowedRedirectURIsValid, reasonInvalidRedirectURI,
+				fmt.Sprintf("redirect URI %q is invalid: %s", redirectURI, err.Error()))
+		}
+	}
+	return trueCondition(typeAllowedRedirectURIsValid, "all redirect URIs are valid")
+}
+
+func validateRedirectURI(redirectURI string) error {
+	parsed, err := url.Parse(redirectURI)
+	if err != nil {
+		return err
+	}
+	if parsed.Fragment != "" {
+		return fmt.Errorf("must not contain a fragment")
+	}
+	switch parsed.Scheme {
+	case "https":
+		if parsed.Hostname() == "" {
+			return fmt.Errorf("must have a host")
+		}
+		return nil
+	case "http":
+		if host := parsed.Hostname(); host != "127.0.0.1" && host != "::1" {
+			return fmt.Errorf("must use the https scheme unless the host is 127.0.0.1 or ::1")
+		}
+		return nil
+	default:
+		return fmt.Errorf("must use the https scheme unless the host is 127.0.0.1 or ::1")
+	}
+}
+
+func validateGrantTypes(oidcClient *v1alpha1.OIDCClient) *v1alpha1.Condition {
+	if !containsGrantType(oidcClient.Spec.AllowedGrantTypes, authorizationCodeGrantType) {
+		return falseCondition(typeAllowedGrantTypesValid, reasonMissingRequiredValue,
+			fmt.Sprintf("%q must always be included in %q", authorizationCodeGrantType, "allowedGrantTypes"))
+	}
+	if containsGrantType(oidcClient.Spec.AllowedGrantTypes, refreshTokenGrantType) &&
+		!containsScope(oidcClient.Spec.AllowedScopes, coreosoidc.ScopeOfflineAccess) {
+		return falseCondition(typeAllowedGrantTypesValid, reasonMissingRequiredValue,
+			fmt.Sprintf("%q must be included in %q when %q is included in %q",
+				coreosoidc.ScopeOfflineAccess, "allowedScopes", refreshTokenGrantType, "allowedGrantTypes"))
+	}
+	if containsGrantType(oidcClient.Spec.AllowedGrantTypes, tokenExchangeGrantType) &&
+		!containsScope(oidcClient.Spec.AllowedScopes, requestAudienceScope) {
+		return falseCondition(typeAllowedGrantTypesValid, reasonMissingRequiredValue,
+			fmt.Sprintf("%q must be included in %q when %q is included in %q",
+				requestAudienceScope, "allowedScopes", tokenExchangeGrantType, "allowedGrantTypes"))
+	}
+	return trueCondition(typeAllowedGrantTypesValid, fmt.Sprintf("%q is valid", "allowedGrantTypes"))
+}
+
+func validateScopes(oidcClient *v1alpha1.OIDCClient) *v1alpha1.Condition {
+	if !containsScope(oidcClient.Spec.AllowedScopes, coreosoidc.ScopeOpenID) {
+		return falseCondition(typeAllowedScopesValid, reasonMissingRequiredValue,
+			fmt.Sprintf("%q must always be included in %q", coreosoidc.ScopeOpenID, "allowedScopes"))
+	}
+	if containsScope(oidcClient.Spec.AllowedScopes, coreosoidc.ScopeOfflineAccess) &&
+		!containsGrantType(oidcClient.Spec.AllowedGrantTypes, refreshTokenGrantType) {
+		return falseCondition(typeAllowedScopesValid, reasonMissingRequiredValue,
+			fmt.Sprintf("%q must be included in %q when %q is included in %q",
+				refreshTokenGrantType, "allowedGrantTypes", coreosoidc.ScopeOfflineAccess, "allowedScopes"))
+	}
+	if containsScope(oidcClient.Spec.AllowedScopes, requestAudienceScope) &&
+		!containsGrantType(oidcClient.Spec.AllowedGrantTypes, tokenExchangeGrantType) {
+		return falseCondition(typeAllowedScopesValid, reasonMissingRequiredValue,
+			fmt.Sprintf("%q must be included in %q when %q is included in %q",
+				tokenExchangeGrantType, "allowedGrantTypes", requestAudienceScope, "allowedScopes"))
+	}
+	return trueCondition(typeAllowedScopesValid, fmt.Sprintf("%q is valid", "allowedScopes"))
+}
+
+func validateSecret(oidcClient *v1alpha1.OIDCClient, secret *corev1.Secret) (*v1alpha1.Condition, []byte) {
+	secretName := oidcClient.Spec.ClientSecret.SecretName
+	if secret == nil {
+		return falseCondition(typeClientSecretValid, reasonSecretNotFound,
+			fmt.Sprintf("referenced Secret %q was not found", secretName)), nil
+	}
+	if secret.Type != SecretType {
+		return falseCondition(typeClientSecretValid, reasonSecretWrongType,
+			fmt.Sprintf("referenced Secret %q has wrong type %q (should be %q)", secretName, secret.Type, SecretType)), nil
+	}
+	hash := secret.Data[SecretHashKey]
+	if len(hash) == 0 {
+		return falseCondition(typeClientSecretValid, reasonSecretMissingKeys,
+			fmt.Sprintf("referenced Secret %q is missing required keys %q", secretName, []string{SecretHashKey})), nil
+	}
+	cost, err := bcrypt.Cost(hash)
+	if err != nil {
+		return falseCondition(typeClientSecretValid, reasonSecretInvalidHash,
+			fmt.Sprintf("referenced Secret %q key %q is not a valid bcrypt hash: %s", secretName, SecretHashKey, err.Error())), nil
+	}
+	if cost < MinimumBcryptCost {
+		return falseCondition(typeClientSecretValid, reasonSecretInvalidHash,
+			fmt.Sprintf("referenced Secret %q key %q has bcrypt cost %d, which is less than the minimum %d",
+				secretName, SecretHashKey, cost, MinimumBcryptCost)), nil
+	}
+	return trueCondition(typeClientSecretValid, "loaded client secret hash"), hash
+}
+
+func containsGrantType(haystack []v1alpha1.GrantType, needle string) bool {
+	for _, v := range haystack {
+		if string(v) == needle {
+			return true
+		}
+	}
+	return false
+}
+
+func containsScope(haystack []v1alpha1.Scope, needle string) bool {
+	for _, v := range haystack {
+		if string(v) == needle {
+			return true
+		}
+	}
+	return false
+}
+
+func trueCondition(conditionType string, message string) *v1alpha1.Condition {
+	return &v1alpha1.Condition{
+		Type:    conditionType,
+		Status:  v1alpha1.ConditionTrue,
+		Reason:  reasonSuccess,
+		Message: message,
+	}
+}
+
+func falseCondition(conditionType string, reason string, message string) *v1alpha1.Condition {
+	return &v1alpha1.Condition{
+		Type:    conditionType,
+		Status:  v1alpha1.ConditionFalse,
+		Reason:  reason,
+		Message: message,
+	}
+}
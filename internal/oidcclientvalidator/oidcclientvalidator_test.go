@@ -0,0 +1,203 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package oidcclientvalidator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"go.pinniped.dev/generated/latest/apis/supervisor/config/v1alpha1"
+)
+
+const (
+	// testClientSecretHash is a bcrypt hash of "some-client-secret" with cost 12.
+	testClientSecretHash = "$2a$12$yHGWWZy/UWGN7V0ETyyP/etrfr1n0GOdWpwJt3HxUqBlar/3Z3.D6"
+
+	// testLowCostClientSecretHash is a bcrypt hash of "some-client-secret" with cost 4.
+	testLowCostClientSecretHash = "$2a$04$D6ny8uuxhXC6YETumUr6bu.RdyDo5c0VvlAzazmHqINQl/HhLCXzq"
+)
+
+func TestValidate(t *testing.T) {
+	validOIDCClient := func() *v1alpha1.OIDCClient {
+		return &v1alpha1.OIDCClient{
+			ObjectMeta: metav1.ObjectMeta{Name: "client.oauth.pinniped.dev-test", Namespace: "some-namespace"},
+			Spec: v1alpha1.OIDCClientSpec{
+				AllowedRedirectURIs: []v1alpha1.RedirectURI{"https://app.example.com/callback", "http://127.0.0.1:1234/callback", "http://[::1]/callback"},
+				AllowedGrantTypes:   []v1alpha1.GrantType{"authorization_code", "refresh_token", "urn:ietf:params:oauth:grant-type:token-exchange"},
+				AllowedScopes:       []v1alpha1.Scope{"openid", "offline_access", "pinniped:request-audience"},
+				ClientSecret:        v1alpha1.OIDCClientSecret{SecretName: "some-secret"},
+			},
+		}
+	}
+	validSecret := func() *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "some-secret", Namespace: "some-namespace"},
+			Type:       "secrets.pinniped.dev/oidc-client-secret",
+			Data:       map[string][]byte{"clientSecretHash": []byte(testClientSecretHash)},
+		}
+	}
+	successConditions := func() map[string]*v1alpha1.Condition {
+		return map[string]*v1alpha1.Condition{
+			"ClientIDValid":            {Type: "ClientIDValid", Status: "True", Reason: "Success", Message: `client ID "client.oauth.pinniped.dev-test" is valid`},
+			"AllowedRedirectURIsValid": {Type: "AllowedRedirectURIsValid", Status: "True", Reason: "Success", Message: "all redirect URIs are valid"},
+			"AllowedGrantTypesValid":   {Type: "AllowedGrantTypesValid", Status: "True", Reason: "Success", Message: `"allowedGrantTypes" is valid`},
+			"AllowedScopesValid":       {Type: "AllowedScopesValid", Status: "True", Reason: "Success", Message: `"allowedScopes" is valid`},
+			"ClientSecretValid":        {Type: "ClientSecretValid", Status: "True", Reason: "Success", Message: "loaded client secret hash"},
+		}
+	}
+
+	tests := []struct {
+		name          string
+		oidcClient    func(c *v1alpha1.OIDCClient)
+		secret        func(s *corev1.Secret)
+		noSecret      bool
+		wantCondition *v1alpha1.Condition // the one condition which is expected to differ from successConditions
+	}{
+		{
+			name: "valid",
+		},
+		{
+			name:       "missing name prefix",
+			oidcClient: func(c *v1alpha1.OIDCClient) { c.Name = "some-client" },
+			wantCondition: &v1alpha1.Condition{Type: "ClientIDValid", Status: "False", Reason: "InvalidClientID",
+				Message: `client ID "some-client" must begin with "client.oauth.pinniped.dev-" followed by at least one character`},
+		},
+		{
+			name:       "only the name prefix",
+			oidcClient: func(c *v1alpha1.OIDCClient) { c.Name = "client.oauth.pinniped.dev-" },
+			wantCondition: &v1alpha1.Condition{Type: "ClientIDValid", Status: "False", Reason: "InvalidClientID",
+				Message: `client ID "client.oauth.pinniped.dev-" must begin with "client.oauth.pinniped.dev-" followed by at least one character`},
+		},
+		{
+			name: "http redirect URI which is not a loopback address",
+			oidcClient: func(c *v1alpha1.OIDCClient) {
+				c.Spec.AllowedRedirectURIs = append(c.Spec.AllowedRedirectURIs, "http://app.example.com/callback")
+			},
+			wantCondition: &v1alpha1.Condition{Type: "AllowedRedirectURIsValid", Status: "False", Reason: "InvalidRedirectURI",
+				Message: `redirect URI "http://app.example.com/callback" is invalid: must use the https scheme unless the host is 127.0.0.1 or ::1`},
+		},
+		{
+			name: "redirect URI with a fragment",
+			oidcClient: func(c *v1alpha1.OIDCClient) {
+				c.Spec.AllowedRedirectURIs = []v1alpha1.RedirectURI{"https://app.example.com/callback#foo"}
+			},
+			wantCondition: &v1alpha1.Condition{Type: "AllowedRedirectURIsValid", Status: "False", Reason: "InvalidRedirectURI",
+				Message: `redirect URI "https://app.example.com/callback#foo" is invalid: must not contain a fragment`},
+		},
+		{
+			name: "missing authorization_code grant type",
+			oidcClient: func(c *v1alpha1.OIDCClient) {
+				c.Spec.AllowedGrantTypes = []v1alpha1.GrantType{"refresh_token", "urn:ietf:params:oauth:grant-type:token-exchange"}
+			},
+			wantCondition: &v1alpha1.Condition{Type: "AllowedGrantTypesValid", Status: "False", Reason: "MissingRequiredValue",
+				Message: `"authorization_code" must always be included in "allowedGrantTypes"`},
+		},
+		{
+			name: "refresh_token grant type without offline_access scope",
+			oidcClient: func(c *v1alpha1.OIDCClient) {
+				c.Spec.AllowedScopes = []v1alpha1.Scope{"openid", "pinniped:request-audience"}
+			},
+			wantCondition: &v1alpha1.Condition{Type: "AllowedGrantTypesValid", Status: "False", Reason: "MissingRequiredValue",
+				Message: `"offline_access" must be included in "allowedScopes" when "refresh_token" is included in "allowedGrantTypes"`},
+		},
+		{
+			name:       "token exchange grant type without request audience scope",
+			oidcClient: func(c *v1alpha1.OIDCClient) { c.Spec.AllowedScopes = []v1alpha1.Scope{"openid", "offline_access"} },
+			wantCondition: &v1alpha1.Condition{Type: "AllowedGrantTypesValid", Status: "False", Reason: "MissingRequiredValue",
+				Message: `"pinniped:request-audience" must be included in "allowedScopes" when "urn:ietf:params:oauth:grant-type:token-exchange" is included in "allowedGrantTypes"`},
+		},
+		{
+			name: "missing openid scope",
+			oidcClient: func(c *v1alpha1.OIDCClient) {
+				c.Spec.AllowedScopes = []v1alpha1.Scope{"offline_access", "pinniped:request-audience"}
+			},
+			wantCondition: &v1alpha1.Condition{Type: "AllowedScopesValid", Status: "False", Reason: "MissingRequiredValue",
+				Message: `"openid" must always be included in "allowedScopes"`},
+		},
+		{
+			name: "offline_access scope without refresh_token grant type",
+			oidcClient: func(c *v1alpha1.OIDCClient) {
+				c.Spec.AllowedGrantTypes = []v1alpha1.GrantType{"authorization_code", "urn:ietf:params:oauth:grant-type:token-exchange"}
+			},
+			wantCondition: &v1alpha1.Condition{Type: "AllowedScopesValid", Status: "False", Reason: "MissingRequiredValue",
+				Message: `"refresh_token" must be included in "allowedGrantTypes" when "offline_access" is included in "allowedScopes"`},
+		},
+		{
+			name: "request audience scope without token exchange grant type",
+			oidcClient: func(c *v1alpha1.OIDCClient) {
+				c.Spec.AllowedGrantTypes = []v1alpha1.GrantType{"authorization_code", "refresh_token"}
+			},
+			wantCondition: &v1alpha1.Condition{Type: "AllowedScopesValid", Status: "False", Reason: "MissingRequiredValue",
+				Message: `"urn:ietf:params:oauth:grant-type:token-exchange" must be included in "allowedGrantTypes" when "pinniped:request-audience" is included in "allowedScopes"`},
+		},
+		{
+			name:     "Secret not found",
+			noSecret: true,
+			wantCondition: &v1alpha1.Condition{Type: "ClientSecretValid", Status: "False", Reason: "SecretNotFound",
+				Message: `referenced Secret "some-secret" was not found`},
+		},
+		{
+			name:   "Secret has wrong type",
+			secret: func(s *corev1.Secret) { s.Type = corev1.SecretTypeOpaque },
+			wantCondition: &v1alpha1.Condition{Type: "ClientSecretValid", Status: "False", Reason: "SecretWrongType",
+				Message: `referenced Secret "some-secret" has wrong type "Opaque" (should be "secrets.pinniped.dev/oidc-client-secret")`},
+		},
+		{
+			name:   "Secret is missing the hash",
+			secret: func(s *corev1.Secret) { s.Data = map[string][]byte{"clientSecret": []byte("some-client-secret")} },
+			wantCondition: &v1alpha1.Condition{Type: "ClientSecretValid", Status: "False", Reason: "SecretMissingKeys",
+				Message: `referenced Secret "some-secret" is missing required keys ["clientSecretHash"]`},
+		},
+		{
+			name:   "Secret hash is not a bcrypt hash",
+			secret: func(s *corev1.Secret) { s.Data["clientSecretHash"] = []byte("some-client-secret") },
+			wantCondition: &v1alpha1.Condition{Type: "ClientSecretValid", Status: "False", Reason: "SecretInvalidHash",
+				Message: `referenced Secret "some-secret" key "clientSecretHash" is not a valid bcrypt hash: crypto/bcrypt: hashedSecret too short to be a bcrypted password`},
+		},
+		{
+			name:   "Secret hash has too low of a cost",
+			secret: func(s *corev1.Secret) { s.Data["clientSecretHash"] = []byte(testLowCostClientSecretHash) },
+			wantCondition: &v1alpha1.Condition{Type: "ClientSecretValid", Status: "False", Reason: "SecretInvalidHash",
+				Message: `referenced Secret "some-secret" key "clientSecretHash" has bcrypt cost 4, which is less than the minimum 12`},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			oidcClient := validOIDCClient()
+			if tt.oidcClient != nil {
+				tt.oidcClient(oidcClient)
+			}
+			secret := validSecret()
+			if tt.secret != nil {
+				tt.secret(secret)
+			}
+			if tt.noSecret {
+				secret = nil
+			}
+
+			wantConditions := successConditions()
+			if tt.wantCondition != nil {
+				wantConditions[tt.wantCondition.Type] = tt.wantCondition
+			}
+
+			valid, conditions, hash := Validate(oidcClient, secret)
+
+			require.Len(t, conditions, len(wantConditions))
+			for _, c := range conditions {
+				require.Equal(t, wantConditions[c.Type], c)
+			}
+			if tt.wantCondition != nil {
+				require.False(t, valid)
+				require.Nil(t, hash)
+			} else {
+				require.True(t, valid)
+				require.Equal(t, []byte(testClientSecretHash), hash)
+			}
+		})
+	}
+}
@@ -47,6 +47,24 @@ type CustomSessionData struct {
 	// These will be RFC 2616-formatted errors with error code 299.
 	Warnings []string `json:"warnings"`
 
+	// The username and groups of the user according to the upstream identity provider, before any identity
+	// transformations were applied. These are used during a downstream refresh to apply the identity
+	// transformations again. May be empty for sessions which were started by older versions of Pinniped.
+	UpstreamUsername string   `json:"upstreamUsername,omitempty"`
+	UpstreamGroups   []string `json:"upstreamGroups,omitempty"`
+
+	// The time at which the user logged in to start this session, and the time at which the session was last
+	// refreshed. These are used during a downstream refresh to enforce the FederationDomain's idle timeout and maximum
+	// session length. They are zero for sessions which were started by older versions of Pinniped, and the time of
+	// the last refresh is zero until the session is first refreshed.
+	LoginTime       time.Time `json:"loginTime"`
+	LastRefreshTime time.Time `json:"lastRefreshTime"`
+
+	// The issuer of the FederationDomain which issued the tokens of this session. The stored sessions of a user
+	// are shared by all FederationDomains, so this is used to enforce the concurrent session limit of each
+	// FederationDomain. It is empty for sessions which were started by older versions of Pinniped.
+	FederationDomainIssuer string `json:"federationDomainIssuer,omitempty"`
+
 	// Only used when ProviderType == "oidc".
 	OIDC *OIDCSessionData `json:"oidc,omitempty"`
 
@@ -86,6 +104,16 @@ type OIDCSessionData struct {
 	// UpstreamIssuer is the "iss" claim from the upstream identity provider from the user's initial login. We store this
 	// so that we can validate that it does not change upon refresh.
 	UpstreamIssuer string `json:"upstreamIssuer"`
+
+	// UpstreamIDToken is the ID token from the upstream identity provider from the user's initial login. It is only
+	// stored when the upstream provider's end session endpoint is used during logout, where it is sent as the
+	// id_token_hint.
+	UpstreamIDToken string `json:"upstreamIDToken,omitempty"`
+
+	// PassthroughClaims are the claims from the upstream ID token of the user's initial login which were named by the
+	// userInfo.passthroughClaims setting of the FederationDomain at that time. They are returned by the UserInfo
+	// endpoint, but are not included in the downstream ID tokens.
+	PassthroughClaims map[string]interface{} `json:"passthroughClaims,omitempty"`
 }
 
 // LDAPSessionData is the additional data needed by Pinniped when the upstream IDP is an LDAP provider.
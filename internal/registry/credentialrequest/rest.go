@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 // Package credentialrequest provides REST functionality for the CredentialRequest resource.
@@ -21,28 +21,52 @@ import (
 	"k8s.io/utils/trace"
 
 	loginapi "go.pinniped.dev/generated/latest/apis/concierge/login"
+	"go.pinniped.dev/internal/audit"
+	"go.pinniped.dev/internal/constable"
 	"go.pinniped.dev/internal/issuer"
+	"go.pinniped.dev/internal/metrics"
+	"go.pinniped.dev/internal/reservednames"
 )
 
 // clientCertificateTTL is the TTL for short-lived client certificates returned by this API.
 const clientCertificateTTL = 5 * time.Minute
 
+const errInvalidUserInfo = constable.Error("token was not authenticated, or the authenticated user cannot be represented by a client certificate")
+
+// The results of the TokenCredentialRequests in the metrics, besides metrics.ResultSuccess.
+const (
+	resultInvalidRequest      = "invalid_request"
+	resultAuthenticationError = "authentication_error"
+	resultUnauthenticated     = "unauthenticated"
+	resultReservedName        = "reserved_name"
+	resultCertIssuerError     = "cert_issuer_error"
+)
+
 type TokenCredentialRequestAuthenticator interface {
 	AuthenticateTokenCredentialRequest(ctx context.Context, req *loginapi.TokenCredentialRequest) (user.Info, error)
 }
 
-func NewREST(authenticator TokenCredentialRequestAuthenticator, issuer issuer.ClientCertIssuer, resource schema.GroupResource) *REST {
+// NewREST returns the REST storage for TokenCredentialRequests. Unless allowReservedUsernamesAndGroups is true,
+// no credential will be issued to a user whose username or groups are reserved by Kubernetes.
+func NewREST(
+	authenticator TokenCredentialRequestAuthenticator,
+	issuer issuer.ClientCertIssuer,
+	resource schema.GroupResource,
+	allowReservedUsernamesAndGroups bool,
+) *REST {
 	return &REST{
-		authenticator:  authenticator,
-		issuer:         issuer,
-		tableConvertor: rest.NewDefaultTableConvertor(resource),
+		authenticator:                   authenticator,
+		issuer:                          issuer,
+		tableConvertor:                  rest.NewDefaultTableConvertor(resource),
+		allowReservedUsernamesAndGroups: allowReservedUsernamesAndGroups,
 	}
 }
 
 type REST struct {
-	authenticator  TokenCredentialRequestAuthenticator
-	issuer         issuer.ClientCertIssuer
-	tableConvertor rest.TableConvertor
+	authenticator                   TokenCredentialRequestAuthenticator
+	issuer                          issuer.ClientCertIssuer
+	tableConvertor                  rest.TableConvertor
+	allowReservedUsernamesAndGroups bool
 }
 
 // Assert that our *REST implements all the optional interfaces that we expect it to implement.
@@ -93,28 +117,46 @@ func (r *REST) Create(ctx context.Context, obj runtime.Object, createValidation
 
 	credentialRequest, err := validateRequest(ctx, obj, createValidation, options, t)
 	if err != nil {
+		audit.Record(ctx, newAuditEvent(obj, nil).Failure(err))
+		metrics.RecordTokenCredentialRequest(resultInvalidRequest)
 		return nil, err
 	}
 
 	userInfo, err := r.authenticator.AuthenticateTokenCredentialRequest(ctx, credentialRequest)
 	if err != nil {
 		traceFailureWithError(t, "token authentication", err)
+		audit.Record(ctx, newAuditEvent(credentialRequest, nil).Failure(err))
+		metrics.RecordTokenCredentialRequest(resultAuthenticationError)
 		return failureResponse(), nil
 	}
 	if ok := isUserInfoValid(userInfo); !ok {
 		traceSuccess(t, userInfo, false)
+		audit.Record(ctx, newAuditEvent(credentialRequest, nil).Failure(errInvalidUserInfo))
+		metrics.RecordTokenCredentialRequest(resultUnauthenticated)
 		return failureResponse(), nil
 	}
+	if !r.allowReservedUsernamesAndGroups {
+		if err := reservednames.Validate(userInfo.GetName(), userInfo.GetGroups()); err != nil {
+			traceFailureWithError(t, "reserved username or group", err)
+			audit.Record(ctx, newAuditEvent(credentialRequest, userInfo).Failure(err))
+			metrics.RecordTokenCredentialRequest(resultReservedName)
+			return failureResponseWithMessage("authentication failed: " + err.Error()), nil
+		}
+	}
 
 	// this timestamp should be returned from IssueClientCertPEM but this is a safe approximation
 	expires := metav1.NewTime(time.Now().UTC().Add(clientCertificateTTL))
 	certPEM, keyPEM, err := r.issuer.IssueClientCertPEM(userInfo.GetName(), userInfo.GetGroups(), clientCertificateTTL)
 	if err != nil {
 		traceFailureWithError(t, "cert issuer", err)
+		audit.Record(ctx, newAuditEvent(credentialRequest, userInfo).Failure(err))
+		metrics.RecordTokenCredentialRequest(resultCertIssuerError)
 		return failureResponse(), nil
 	}
 
 	traceSuccess(t, userInfo, true)
+	audit.Record(ctx, newAuditEvent(credentialRequest, userInfo))
+	metrics.RecordTokenCredentialRequest(metrics.ResultSuccess)
 
 	return &loginapi.TokenCredentialRequest{
 		Status: loginapi.TokenCredentialRequestStatus{
@@ -184,6 +226,20 @@ func isUserInfoValid(userInfo user.Info) bool {
 	}
 }
 
+// newAuditEvent returns the audit event of a TokenCredentialRequest. The userInfo is nil when the token was not
+// authenticated.
+func newAuditEvent(obj runtime.Object, userInfo user.Info) *audit.Event {
+	event := &audit.Event{Type: audit.TypeTokenCredentialRequest}
+	if credentialRequest, ok := obj.(*loginapi.TokenCredentialRequest); ok {
+		event.Authenticator = credentialRequest.Spec.Authenticator.Kind + "/" + credentialRequest.Spec.Authenticator.Name
+	}
+	if userInfo != nil {
+		event.Username = userInfo.GetName()
+		event.Groups = userInfo.GetGroups()
+	}
+	return event
+}
+
 func traceSuccess(t *trace.Trace, userInfo user.Info, authenticated bool) {
 	userID := "<none>"
 	hasExtra := false
@@ -213,7 +269,10 @@ func traceFailureWithError(t *trace.Trace, failureType string, err error) {
 }
 
 func failureResponse() *loginapi.TokenCredentialRequest {
-	m := "authentication failed"
+	return failureResponseWithMessage("authentication failed")
+}
+
+func failureResponseWithMessage(m string) *loginapi.TokenCredentialRequest {
 	return &loginapi.TokenCredentialRequest{
 		Status: loginapi.TokenCredentialRequestStatus{
 			Credential: nil,
@@ -14,6 +14,7 @@ import (
 	"github.com/golang/mock/gomock"
 	"github.com/sclevine/spec"
 	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -25,6 +26,7 @@ import (
 	"k8s.io/utils/pointer"
 
 	loginapi "go.pinniped.dev/generated/latest/apis/concierge/login"
+	"go.pinniped.dev/internal/audit"
 	"go.pinniped.dev/internal/issuer"
 	"go.pinniped.dev/internal/mocks/credentialrequestmocks"
 	"go.pinniped.dev/internal/mocks/issuermocks"
@@ -32,7 +34,7 @@ import (
 )
 
 func TestNew(t *testing.T) {
-	r := NewREST(nil, nil, schema.GroupResource{Group: "bears", Resource: "panda"})
+	r := NewREST(nil, nil, schema.GroupResource{Group: "bears", Resource: "panda"}, false)
 	require.NotNil(t, r)
 	require.False(t, r.NamespaceScoped())
 	require.Equal(t, []string{"pinniped"}, r.Categories())
@@ -67,12 +69,15 @@ func TestCreate(t *testing.T) {
 		var r *require.Assertions
 		var ctrl *gomock.Controller
 		var logger *testutil.TranscriptLogger
+		var auditEvents func() []audit.Event
 
 		it.Before(func() {
 			r = require.New(t)
 			ctrl = gomock.NewController(t)
 			logger = testutil.NewTranscriptLogger(t)
 			klog.SetLogger(logr.New(logger)) // this is unfortunately a global logger, so can't run these tests in parallel :(
+			// The audit log is global too.
+			auditEvents = testutil.RecordAuditEvents(t, audit.ComponentConcierge)
 		})
 
 		it.After(func() {
@@ -97,7 +102,7 @@ func TestCreate(t *testing.T) {
 				5*time.Minute,
 			).Return([]byte("test-cert"), []byte("test-key"), nil)
 
-			storage := NewREST(requestAuthenticator, clientCertIssuer, schema.GroupResource{})
+			storage := NewREST(requestAuthenticator, clientCertIssuer, schema.GroupResource{}, false)
 
 			response, err := callCreate(context.Background(), storage, req)
 
@@ -119,6 +124,12 @@ func TestCreate(t *testing.T) {
 				},
 			})
 			requireOneLogStatement(r, logger, `"success" userID:,hasExtra:false,authenticated:true`)
+			requireOneAuditEvent(r, auditEvents(), audit.Event{
+				Authenticator: "WebhookAuthenticator/some-webhook",
+				Username:      "test-user",
+				Groups:        []string{"test-group-1", "test-group-2"},
+				Outcome:       audit.OutcomeSuccess,
+			})
 		})
 
 		it("CreateFailsWithValidTokenWhenCertIssuerFails", func() {
@@ -136,11 +147,79 @@ func TestCreate(t *testing.T) {
 				IssueClientCertPEM(gomock.Any(), gomock.Any(), gomock.Any()).
 				Return(nil, nil, fmt.Errorf("some certificate authority error"))
 
-			storage := NewREST(requestAuthenticator, clientCertIssuer, schema.GroupResource{})
+			storage := NewREST(requestAuthenticator, clientCertIssuer, schema.GroupResource{}, false)
 
 			response, err := callCreate(context.Background(), storage, req)
 			requireSuccessfulResponseWithAuthenticationFailureMessage(t, err, response)
 			requireOneLogStatement(r, logger, `"failure" failureType:cert issuer,msg:some certificate authority error`)
+			requireOneAuditEvent(r, auditEvents(), audit.Event{
+				Authenticator: "WebhookAuthenticator/some-webhook",
+				Username:      "test-user",
+				Groups:        []string{"test-group-1", "test-group-2"},
+				Outcome:       audit.OutcomeFailure,
+				Reason:        "some certificate authority error",
+			})
+		})
+
+		it("CreateSucceedsWithAnUnauthenticatedStatusWhenWebhookReturnsAReservedUsername", func() {
+			req := validCredentialRequest()
+
+			requestAuthenticator := credentialrequestmocks.NewMockTokenCredentialRequestAuthenticator(ctrl)
+			requestAuthenticator.EXPECT().AuthenticateTokenCredentialRequest(gomock.Any(), req).
+				Return(&user.DefaultInfo{Name: "system:admin", Groups: []string{"test-group-1"}}, nil)
+
+			storage := NewREST(requestAuthenticator, nil, schema.GroupResource{}, false)
+
+			response, err := callCreate(context.Background(), storage, req)
+
+			r.NoError(err)
+			r.Equal(&loginapi.TokenCredentialRequest{
+				Status: loginapi.TokenCredentialRequestStatus{
+					Message: pointer.StringPtr(`authentication failed: username "system:admin" uses the reserved prefix "system:"`),
+				},
+			}, response)
+			requireOneLogStatement(r, logger, `"failure" failureType:reserved username or group,msg:username "system:admin" uses the reserved prefix "system:"`)
+		})
+
+		it("CreateSucceedsWithAnUnauthenticatedStatusWhenWebhookReturnsAReservedGroup", func() {
+			req := validCredentialRequest()
+
+			requestAuthenticator := credentialrequestmocks.NewMockTokenCredentialRequestAuthenticator(ctrl)
+			requestAuthenticator.EXPECT().AuthenticateTokenCredentialRequest(gomock.Any(), req).
+				Return(&user.DefaultInfo{Name: "test-user", Groups: []string{"test-group-1", "system:masters"}}, nil)
+
+			storage := NewREST(requestAuthenticator, nil, schema.GroupResource{}, false)
+
+			response, err := callCreate(context.Background(), storage, req)
+
+			r.NoError(err)
+			r.Equal(&loginapi.TokenCredentialRequest{
+				Status: loginapi.TokenCredentialRequestStatus{
+					Message: pointer.StringPtr(`authentication failed: group "system:masters" uses the reserved prefix "system:"`),
+				},
+			}, response)
+			requireOneLogStatement(r, logger, `"failure" failureType:reserved username or group,msg:group "system:masters" uses the reserved prefix "system:"`)
+		})
+
+		it("CreateSucceedsWithAReservedGroupWhenReservedNamesAreAllowed", func() {
+			req := validCredentialRequest()
+
+			requestAuthenticator := credentialrequestmocks.NewMockTokenCredentialRequestAuthenticator(ctrl)
+			requestAuthenticator.EXPECT().AuthenticateTokenCredentialRequest(gomock.Any(), req).
+				Return(&user.DefaultInfo{Name: "test-user", Groups: []string{"system:masters"}}, nil)
+
+			clientCertIssuer := issuermocks.NewMockClientCertIssuer(ctrl)
+			clientCertIssuer.EXPECT().
+				IssueClientCertPEM("test-user", []string{"system:masters"}, 5*time.Minute).
+				Return([]byte("test-cert"), []byte("test-key"), nil)
+
+			storage := NewREST(requestAuthenticator, clientCertIssuer, schema.GroupResource{}, true)
+
+			response, err := callCreate(context.Background(), storage, req)
+
+			r.NoError(err)
+			r.Equal("test-cert", response.(*loginapi.TokenCredentialRequest).Status.Credential.ClientCertificateData)
+			requireOneLogStatement(r, logger, `"success" userID:,hasExtra:false,authenticated:true`)
 		})
 
 		it("CreateSucceedsWithAnUnauthenticatedStatusWhenGivenATokenAndTheWebhookReturnsNilUser", func() {
@@ -149,7 +228,7 @@ func TestCreate(t *testing.T) {
 			requestAuthenticator := credentialrequestmocks.NewMockTokenCredentialRequestAuthenticator(ctrl)
 			requestAuthenticator.EXPECT().AuthenticateTokenCredentialRequest(gomock.Any(), req).Return(nil, nil)
 
-			storage := NewREST(requestAuthenticator, nil, schema.GroupResource{})
+			storage := NewREST(requestAuthenticator, nil, schema.GroupResource{}, false)
 
 			response, err := callCreate(context.Background(), storage, req)
 
@@ -164,12 +243,17 @@ func TestCreate(t *testing.T) {
 			requestAuthenticator.EXPECT().AuthenticateTokenCredentialRequest(gomock.Any(), req).
 				Return(nil, errors.New("some webhook error"))
 
-			storage := NewREST(requestAuthenticator, nil, schema.GroupResource{})
+			storage := NewREST(requestAuthenticator, nil, schema.GroupResource{}, false)
 
 			response, err := callCreate(context.Background(), storage, req)
 
 			requireSuccessfulResponseWithAuthenticationFailureMessage(t, err, response)
 			requireOneLogStatement(r, logger, `"failure" failureType:token authentication,msg:some webhook error`)
+			requireOneAuditEvent(r, auditEvents(), audit.Event{
+				Authenticator: "WebhookAuthenticator/some-webhook",
+				Outcome:       audit.OutcomeFailure,
+				Reason:        "some webhook error",
+			})
 		})
 
 		it("CreateSucceedsWithAnUnauthenticatedStatusWhenWebhookReturnsAnEmptyUsername", func() {
@@ -179,7 +263,7 @@ func TestCreate(t *testing.T) {
 			requestAuthenticator.EXPECT().AuthenticateTokenCredentialRequest(gomock.Any(), req).
 				Return(&user.DefaultInfo{Name: ""}, nil)
 
-			storage := NewREST(requestAuthenticator, nil, schema.GroupResource{})
+			storage := NewREST(requestAuthenticator, nil, schema.GroupResource{}, false)
 
 			response, err := callCreate(context.Background(), storage, req)
 
@@ -198,7 +282,7 @@ func TestCreate(t *testing.T) {
 					Groups: []string{"test-group-1", "test-group-2"},
 				}, nil)
 
-			storage := NewREST(requestAuthenticator, nil, schema.GroupResource{})
+			storage := NewREST(requestAuthenticator, nil, schema.GroupResource{}, false)
 
 			response, err := callCreate(context.Background(), storage, req)
 
@@ -217,7 +301,7 @@ func TestCreate(t *testing.T) {
 					Extra:  map[string][]string{"test-key": {"test-val-1", "test-val-2"}},
 				}, nil)
 
-			storage := NewREST(requestAuthenticator, nil, schema.GroupResource{})
+			storage := NewREST(requestAuthenticator, nil, schema.GroupResource{}, false)
 
 			response, err := callCreate(context.Background(), storage, req)
 
@@ -227,7 +311,7 @@ func TestCreate(t *testing.T) {
 
 		it("CreateFailsWhenGivenTheWrongInputType", func() {
 			notACredentialRequest := runtime.Unknown{}
-			response, err := NewREST(nil, nil, schema.GroupResource{}).Create(
+			response, err := NewREST(nil, nil, schema.GroupResource{}, false).Create(
 				genericapirequest.NewContext(),
 				&notACredentialRequest,
 				rest.ValidateAllObjectFunc,
@@ -238,7 +322,7 @@ func TestCreate(t *testing.T) {
 		})
 
 		it("CreateFailsWhenTokenValueIsEmptyInRequest", func() {
-			storage := NewREST(nil, nil, schema.GroupResource{})
+			storage := NewREST(nil, nil, schema.GroupResource{}, false)
 			response, err := callCreate(context.Background(), storage, credentialRequest(loginapi.TokenCredentialRequestSpec{
 				Token: "",
 			}))
@@ -249,7 +333,7 @@ func TestCreate(t *testing.T) {
 		})
 
 		it("CreateFailsWhenValidationFails", func() {
-			storage := NewREST(nil, nil, schema.GroupResource{})
+			storage := NewREST(nil, nil, schema.GroupResource{}, false)
 			response, err := storage.Create(
 				context.Background(),
 				validCredentialRequest(),
@@ -269,7 +353,7 @@ func TestCreate(t *testing.T) {
 			requestAuthenticator.EXPECT().AuthenticateTokenCredentialRequest(gomock.Any(), req.DeepCopy()).
 				Return(&user.DefaultInfo{Name: "test-user"}, nil)
 
-			storage := NewREST(requestAuthenticator, successfulIssuer(ctrl), schema.GroupResource{})
+			storage := NewREST(requestAuthenticator, successfulIssuer(ctrl), schema.GroupResource{}, false)
 			response, err := storage.Create(
 				context.Background(),
 				req,
@@ -290,7 +374,7 @@ func TestCreate(t *testing.T) {
 			requestAuthenticator.EXPECT().AuthenticateTokenCredentialRequest(gomock.Any(), req.DeepCopy()).
 				Return(&user.DefaultInfo{Name: "test-user"}, nil)
 
-			storage := NewREST(requestAuthenticator, successfulIssuer(ctrl), schema.GroupResource{})
+			storage := NewREST(requestAuthenticator, successfulIssuer(ctrl), schema.GroupResource{}, false)
 			validationFunctionWasCalled := false
 			var validationFunctionSawTokenValue string
 			response, err := storage.Create(
@@ -310,7 +394,7 @@ func TestCreate(t *testing.T) {
 		})
 
 		it("CreateFailsWhenRequestOptionsDryRunIsNotEmpty", func() {
-			response, err := NewREST(nil, nil, schema.GroupResource{}).Create(
+			response, err := NewREST(nil, nil, schema.GroupResource{}, false).Create(
 				genericapirequest.NewContext(),
 				validCredentialRequest(),
 				rest.ValidateAllObjectFunc,
@@ -324,7 +408,7 @@ func TestCreate(t *testing.T) {
 		})
 
 		it("CreateFailsWhenNamespaceIsNotEmpty", func() {
-			response, err := NewREST(nil, nil, schema.GroupResource{}).Create(
+			response, err := NewREST(nil, nil, schema.GroupResource{}, false).Create(
 				genericapirequest.WithNamespace(genericapirequest.NewContext(), "some-ns"),
 				validCredentialRequest(),
 				rest.ValidateAllObjectFunc,
@@ -343,6 +427,17 @@ func requireOneLogStatement(r *require.Assertions, logger *testutil.TranscriptLo
 	r.Contains(transcript[0].Message, messageContains)
 }
 
+func requireOneAuditEvent(r *require.Assertions, events []audit.Event, want audit.Event) {
+	r.Len(events, 1)
+	r.NotZero(events[0].Time)
+	events[0].Time = time.Time{}
+	want.APIVersion = audit.APIVersion
+	want.Kind = audit.Kind
+	want.Component = audit.ComponentConcierge
+	want.Type = audit.TypeTokenCredentialRequest
+	r.Equal(want, events[0])
+}
+
 func callCreate(ctx context.Context, storage *REST, obj runtime.Object) (runtime.Object, error) {
 	return storage.Create(
 		ctx,
@@ -358,7 +453,10 @@ func validCredentialRequest() *loginapi.TokenCredentialRequest {
 }
 
 func validCredentialRequestWithToken(token string) *loginapi.TokenCredentialRequest {
-	return credentialRequest(loginapi.TokenCredentialRequestSpec{Token: token})
+	return credentialRequest(loginapi.TokenCredentialRequestSpec{
+		Token:         token,
+		Authenticator: corev1.TypedLocalObjectReference{Kind: "WebhookAuthenticator", Name: "some-webhook"},
+	})
 }
 
 func credentialRequest(spec loginapi.TokenCredentialRequestSpec) *loginapi.TokenCredentialRequest {
@@ -0,0 +1,215 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package session provides REST functionality for the Session resource.
+package session
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"github.com/ory/fosite"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/registry/rest"
+
+	sessionapi "go.pinniped.dev/generated/latest/apis/supervisor/session"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/revocation"
+	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/psession"
+)
+
+// SessionStore finds and deletes the storage of downstream sessions.
+type SessionStore interface {
+	ListSessionRequests(ctx context.Context) ([]fosite.Requester, error)
+	GetSessionRequestByRequestID(ctx context.Context, requestID string) (fosite.Requester, error)
+	RevokeSession(ctx context.Context, requestID string) error
+}
+
+func NewREST(sessionStore SessionStore, idpLister oidc.UpstreamIdentityProvidersLister, resource schema.GroupResource) *REST {
+	return &REST{
+		sessionStore:   sessionStore,
+		idpLister:      idpLister,
+		resource:       resource,
+		tableConvertor: rest.NewDefaultTableConvertor(resource),
+	}
+}
+
+type REST struct {
+	sessionStore   SessionStore
+	idpLister      oidc.UpstreamIdentityProvidersLister
+	resource       schema.GroupResource
+	tableConvertor rest.TableConvertor
+}
+
+// Assert that our *REST implements all the optional interfaces that we expect it to implement.
+var _ interface {
+	rest.Getter
+	rest.Lister
+	rest.GracefulDeleter
+	rest.Scoper
+	rest.Storage
+	rest.CategoriesProvider
+} = (*REST)(nil)
+
+func (*REST) New() runtime.Object {
+	return &sessionapi.Session{}
+}
+
+func (*REST) NewList() runtime.Object {
+	return &sessionapi.SessionList{}
+}
+
+func (r *REST) ConvertToTable(ctx context.Context, obj runtime.Object, tableOptions runtime.Object) (*metav1.Table, error) {
+	return r.tableConvertor.ConvertToTable(ctx, obj, tableOptions)
+}
+
+func (*REST) NamespaceScoped() bool {
+	return false
+}
+
+func (*REST) Categories() []string {
+	return []string{"pinniped"}
+}
+
+func (r *REST) List(ctx context.Context, options *metainternalversion.ListOptions) (runtime.Object, error) {
+	requests, err := r.sessionStore.ListSessionRequests(ctx)
+	if err != nil {
+		return nil, apierrors.NewInternalError(err)
+	}
+
+	labelSelector, fieldSelector := labels.Everything(), fields.Everything()
+	if options != nil && options.LabelSelector != nil {
+		labelSelector = options.LabelSelector
+	}
+	if options != nil && options.FieldSelector != nil {
+		fieldSelector = options.FieldSelector
+	}
+
+	list := &sessionapi.SessionList{
+		Items: []sessionapi.Session{}, // avoid sending nil items list
+	}
+	for _, request := range requests {
+		session := toSession(request)
+		if session == nil {
+			continue
+		}
+		if !labelSelector.Matches(labels.Set(session.Labels)) || !fieldSelector.Matches(fieldsOf(session)) {
+			continue
+		}
+		list.Items = append(list.Items, *session)
+	}
+
+	sort.Slice(list.Items, func(i, j int) bool {
+		return list.Items[i].Name < list.Items[j].Name
+	})
+	return list, nil
+}
+
+func (r *REST) Get(ctx context.Context, name string, _ *metav1.GetOptions) (runtime.Object, error) {
+	_, session, err := r.get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// Delete revokes all the tokens of the session, and then revokes the upstream OIDC tokens of the session.
+func (r *REST) Delete(ctx context.Context, name string, deleteValidation rest.ValidateObjectFunc, _ *metav1.DeleteOptions) (runtime.Object, bool, error) {
+	request, session, err := r.get(ctx, name)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if deleteValidation != nil {
+		if err := deleteValidation(ctx, session); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if err := r.sessionStore.RevokeSession(ctx, name); err != nil {
+		return nil, false, apierrors.NewInternalError(err)
+	}
+
+	// The downstream session is already revoked, so a failure to revoke its upstream tokens does not fail the
+	// request. The upstream tokens may still expire or be revoked by the upstream provider later.
+	if customSessionData := request.GetSession().(*psession.PinnipedSession).Custom; customSessionData != nil {
+		if err := revocation.RevokeUpstreamOIDCTokens(ctx, r.idpLister, customSessionData); err != nil {
+			plog.WarningErr("failed to revoke upstream token while deleting a session", err,
+				"sessionID", name, "providerName", customSessionData.ProviderName, "providerUID", customSessionData.ProviderUID)
+		}
+	}
+
+	return session, true, nil
+}
+
+func (r *REST) get(ctx context.Context, name string) (fosite.Requester, *sessionapi.Session, error) {
+	request, err := r.sessionStore.GetSessionRequestByRequestID(ctx, name)
+	if errors.Is(err, fosite.ErrNotFound) {
+		return nil, nil, apierrors.NewNotFound(r.resource, name)
+	}
+	if err != nil {
+		return nil, nil, apierrors.NewInternalError(err)
+	}
+
+	session := toSession(request)
+	if session == nil {
+		return nil, nil, apierrors.NewNotFound(r.resource, name)
+	}
+	return request, session, nil
+}
+
+// toSession converts the stored request of a downstream session to a Session, or returns nil when the stored
+// request does not hold a valid session.
+func toSession(request fosite.Requester) *sessionapi.Session {
+	pinnipedSession, ok := request.GetSession().(*psession.PinnipedSession)
+	if !ok || pinnipedSession.Fosite == nil || pinnipedSession.Fosite.Claims == nil || pinnipedSession.Custom == nil {
+		return nil
+	}
+	claims := pinnipedSession.Fosite.Claims
+	custom := pinnipedSession.Custom
+
+	session := &sessionapi.Session{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: request.GetID(),
+		},
+		Spec: sessionapi.SessionSpec{
+			Subject:  claims.Subject,
+			Username: oidc.DownstreamUsername(claims),
+			Groups:   oidc.DownstreamGroups(claims),
+			IdentityProvider: sessionapi.IdentityProvider{
+				Name: custom.ProviderName,
+				Type: string(custom.ProviderType),
+				UID:  string(custom.ProviderUID),
+			},
+			ClientID: request.GetClient().GetID(),
+			Scopes:   request.GetGrantedScopes(),
+		},
+	}
+	// Sessions which were started by older versions of Pinniped have no login time.
+	if !custom.LoginTime.IsZero() {
+		session.CreationTimestamp = metav1.NewTime(custom.LoginTime)
+		session.Spec.LoginTime = &session.CreationTimestamp
+	}
+	if !custom.LastRefreshTime.IsZero() {
+		lastRefreshTime := metav1.NewTime(custom.LastRefreshTime)
+		session.Spec.LastRefreshTime = &lastRefreshTime
+	}
+	return session
+}
+
+// fieldsOf returns the fields of the Session which may be used in field selectors.
+func fieldsOf(session *sessionapi.Session) fields.Set {
+	return fields.Set{
+		"metadata.name": session.Name,
+		"spec.subject":  session.Spec.Subject,
+		"spec.username": session.Spec.Username,
+	}
+}
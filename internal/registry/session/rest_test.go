@@ -0,0 +1,267 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package session
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/handler/openid"
+	"github.com/ory/fosite/token/jwt"
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/registry/rest"
+	"k8s.io/client-go/kubernetes/fake"
+
+	sessionapi "go.pinniped.dev/generated/latest/apis/supervisor/session"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/clientregistry"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/psession"
+	"go.pinniped.dev/internal/testutil/oidctestutil"
+)
+
+var resource = schema.GroupResource{Group: "session.supervisor.pinniped.dev", Resource: "sessions"}
+
+func TestNew(t *testing.T) {
+	r := NewREST(nil, nil, resource)
+	require.NotNil(t, r)
+	require.False(t, r.NamespaceScoped())
+	require.Equal(t, []string{"pinniped"}, r.Categories())
+	require.IsType(t, &sessionapi.Session{}, r.New())
+	require.IsType(t, &sessionapi.SessionList{}, r.NewList())
+
+	ctx := context.Background()
+
+	// check the simple invariants of our no-op list
+	list, err := r.ConvertToTable(ctx, &sessionapi.SessionList{}, nil)
+	require.NoError(t, err)
+	require.NotNil(t, list)
+	require.Empty(t, list.Rows)
+}
+
+func TestREST(t *testing.T) {
+	loginTime := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	lastRefreshTime := loginTime.Add(time.Hour)
+
+	newRequest := func(requestID, username string, custom *psession.CustomSessionData) *fosite.Request {
+		return &fosite.Request{
+			ID: requestID,
+			Client: &clientregistry.Client{
+				DefaultOpenIDConnectClient: fosite.DefaultOpenIDConnectClient{
+					DefaultClient: &fosite.DefaultClient{ID: "pinniped-cli", Public: true},
+				},
+			},
+			GrantedScope: fosite.Arguments{"openid", "offline_access"},
+			Session: &psession.PinnipedSession{
+				Fosite: &openid.DefaultSession{
+					Claims: &jwt.IDTokenClaims{
+						Subject: "https://upstream.example.com?sub=" + username,
+						Extra: map[string]interface{}{
+							oidc.DownstreamUsernameClaim: username,
+							oidc.DownstreamGroupsClaim:   []string{username + "-group"},
+						},
+					},
+				},
+				Custom: custom,
+			},
+		}
+	}
+
+	oidcSession := newRequest("session-1", "alice", &psession.CustomSessionData{
+		ProviderUID:     "upstream-oidc-provider-uid",
+		ProviderName:    "upstream-oidc-provider-name",
+		ProviderType:    psession.ProviderTypeOIDC,
+		LoginTime:       loginTime,
+		LastRefreshTime: lastRefreshTime,
+		OIDC: &psession.OIDCSessionData{
+			UpstreamRefreshToken: "fake-upstream-refresh-token",
+		},
+	})
+	ldapSession := newRequest("session-2", "bob", &psession.CustomSessionData{
+		ProviderUID:  "upstream-ldap-provider-uid",
+		ProviderName: "upstream-ldap-provider-name",
+		ProviderType: psession.ProviderTypeLDAP,
+		LDAP:         &psession.LDAPSessionData{UserDN: "cn=bob"},
+	})
+
+	wantLoginTime := metav1.NewTime(loginTime)
+	wantLastRefreshTime := metav1.NewTime(lastRefreshTime)
+	wantOIDCSession := sessionapi.Session{
+		ObjectMeta: metav1.ObjectMeta{Name: "session-1", CreationTimestamp: wantLoginTime},
+		Spec: sessionapi.SessionSpec{
+			Subject:  "https://upstream.example.com?sub=alice",
+			Username: "alice",
+			Groups:   []string{"alice-group"},
+			IdentityProvider: sessionapi.IdentityProvider{
+				Name: "upstream-oidc-provider-name",
+				Type: "oidc",
+				UID:  "upstream-oidc-provider-uid",
+			},
+			ClientID:        "pinniped-cli",
+			Scopes:          []string{"openid", "offline_access"},
+			LoginTime:       &wantLoginTime,
+			LastRefreshTime: &wantLastRefreshTime,
+		},
+	}
+	wantLDAPSession := sessionapi.Session{
+		ObjectMeta: metav1.ObjectMeta{Name: "session-2"},
+		Spec: sessionapi.SessionSpec{
+			Subject:  "https://upstream.example.com?sub=bob",
+			Username: "bob",
+			Groups:   []string{"bob-group"},
+			IdentityProvider: sessionapi.IdentityProvider{
+				Name: "upstream-ldap-provider-name",
+				Type: "ldap",
+				UID:  "upstream-ldap-provider-uid",
+			},
+			ClientID: "pinniped-cli",
+			Scopes:   []string{"openid", "offline_access"},
+		},
+	}
+
+	setup := func(t *testing.T) (context.Context, *oidc.KubeStorage, *oidctestutil.UpstreamIDPListerBuilder, *REST) {
+		t.Helper()
+
+		ctx := context.Background()
+		storage := oidc.NewKubeStorage(fake.NewSimpleClientset().CoreV1().Secrets("some-namespace"), nil, oidc.DefaultOIDCTimeoutsConfiguration())
+		// The OIDC session can be refreshed, while the LDAP session only has an access token.
+		require.NoError(t, storage.CreateRefreshTokenSession(ctx, "refresh-token-signature", oidcSession))
+		require.NoError(t, storage.CreateAccessTokenSession(ctx, "access-token-signature-1", oidcSession))
+		require.NoError(t, storage.CreateAccessTokenSession(ctx, "access-token-signature-2", ldapSession))
+
+		idpListerBuilder := oidctestutil.NewUpstreamIDPListerBuilder().WithOIDC(
+			oidctestutil.NewTestUpstreamOIDCIdentityProviderBuilder().
+				WithName("upstream-oidc-provider-name").
+				WithResourceUID("upstream-oidc-provider-uid").
+				Build(),
+		)
+		return ctx, storage, idpListerBuilder, NewREST(storage, idpListerBuilder.Build(), resource)
+	}
+
+	t.Run("list", func(t *testing.T) {
+		tests := []struct {
+			name          string
+			fieldSelector fields.Selector
+			labelSelector labels.Selector
+			want          []sessionapi.Session
+		}{
+			{
+				name: "all sessions",
+				want: []sessionapi.Session{wantOIDCSession, wantLDAPSession},
+			},
+			{
+				name:          "sessions of a subject",
+				fieldSelector: fields.OneTermEqualSelector("spec.subject", "https://upstream.example.com?sub=bob"),
+				want:          []sessionapi.Session{wantLDAPSession},
+			},
+			{
+				name:          "sessions of a username",
+				fieldSelector: fields.OneTermEqualSelector("spec.username", "alice"),
+				want:          []sessionapi.Session{wantOIDCSession},
+			},
+			{
+				name:          "sessions of other usernames",
+				fieldSelector: fields.OneTermNotEqualSelector("spec.username", "alice"),
+				want:          []sessionapi.Session{wantLDAPSession},
+			},
+			{
+				name:          "sessions do not have labels",
+				labelSelector: labels.SelectorFromSet(labels.Set{"some-label": "some-value"}),
+				want:          []sessionapi.Session{},
+			},
+		}
+		for _, tt := range tests {
+			tt := tt
+			t.Run(tt.name, func(t *testing.T) {
+				ctx, _, _, r := setup(t)
+
+				list, err := r.List(ctx, &metainternalversion.ListOptions{FieldSelector: tt.fieldSelector, LabelSelector: tt.labelSelector})
+				require.NoError(t, err)
+				require.Equal(t, &sessionapi.SessionList{Items: tt.want}, list)
+			})
+		}
+	})
+
+	t.Run("get", func(t *testing.T) {
+		ctx, _, _, r := setup(t)
+
+		session, err := r.Get(ctx, "session-1", &metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, &wantOIDCSession, session)
+
+		session, err = r.Get(ctx, "session-2", &metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, &wantLDAPSession, session)
+
+		_, err = r.Get(ctx, "some-other-session", &metav1.GetOptions{})
+		require.True(t, apierrors.IsNotFound(err), "wrong error: %v", err)
+		require.EqualError(t, err, `sessions.session.supervisor.pinniped.dev "some-other-session" not found`)
+	})
+
+	t.Run("delete revokes all tokens of the session and its upstream tokens", func(t *testing.T) {
+		ctx, storage, idpListerBuilder, r := setup(t)
+
+		session, deleted, err := r.Delete(ctx, "session-1", rest.ValidateAllObjectFunc, &metav1.DeleteOptions{})
+		require.NoError(t, err)
+		require.True(t, deleted)
+		require.Equal(t, &wantOIDCSession, session)
+
+		_, err = storage.GetRefreshTokenSession(ctx, "refresh-token-signature", nil)
+		require.True(t, errors.Is(err, fosite.ErrNotFound), "wrong error: %v", err)
+		_, err = storage.GetAccessTokenSession(ctx, "access-token-signature-1", nil)
+		require.True(t, errors.Is(err, fosite.ErrNotFound), "wrong error: %v", err)
+
+		idpListerBuilder.RequireExactlyOneCallToRevokeToken(t,
+			"upstream-oidc-provider-name",
+			&oidctestutil.RevokeTokenArgs{
+				Ctx:       ctx,
+				Token:     "fake-upstream-refresh-token",
+				TokenType: provider.RefreshTokenType,
+			},
+		)
+
+		// the other session is untouched
+		list, err := r.List(ctx, nil)
+		require.NoError(t, err)
+		require.Equal(t, &sessionapi.SessionList{Items: []sessionapi.Session{wantLDAPSession}}, list)
+
+		_, _, err = r.Delete(ctx, "session-1", rest.ValidateAllObjectFunc, &metav1.DeleteOptions{})
+		require.True(t, apierrors.IsNotFound(err), "wrong error: %v", err)
+	})
+
+	t.Run("delete of a session without upstream tokens", func(t *testing.T) {
+		ctx, storage, idpListerBuilder, r := setup(t)
+
+		_, deleted, err := r.Delete(ctx, "session-2", nil, &metav1.DeleteOptions{})
+		require.NoError(t, err)
+		require.True(t, deleted)
+
+		_, err = storage.GetAccessTokenSession(ctx, "access-token-signature-2", nil)
+		require.True(t, errors.Is(err, fosite.ErrNotFound), "wrong error: %v", err)
+		idpListerBuilder.RequireExactlyZeroCallsToRevokeToken(t)
+	})
+
+	t.Run("delete is rejected by the delete validation", func(t *testing.T) {
+		ctx, storage, idpListerBuilder, r := setup(t)
+
+		_, _, err := r.Delete(ctx, "session-1", func(ctx context.Context, obj runtime.Object) error {
+			return errors.New("some validation error")
+		}, &metav1.DeleteOptions{})
+		require.EqualError(t, err, "some validation error")
+
+		_, err = storage.GetRefreshTokenSession(ctx, "refresh-token-signature", nil)
+		require.NoError(t, err)
+		idpListerBuilder.RequireExactlyZeroCallsToRevokeToken(t)
+	})
+}
@@ -0,0 +1,32 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package reservednames detects usernames and group names which are reserved by Kubernetes. Pinniped refuses to
+// issue credentials for such identities by default, since an upstream identity provider should never be able to
+// grant a user an identity like system:admin or membership in a group like system:masters.
+package reservednames
+
+import (
+	"fmt"
+	"strings"
+)
+
+// KubernetesPrefix is the prefix which Kubernetes reserves for its own usernames and groups.
+const KubernetesPrefix = "system:"
+
+// Validate returns an error when the username or any of the groups begin with a reserved prefix.
+func Validate(username string, groups []string) error {
+	if isReserved(username) {
+		return fmt.Errorf("username %q uses the reserved prefix %q", username, KubernetesPrefix)
+	}
+	for _, group := range groups {
+		if isReserved(group) {
+			return fmt.Errorf("group %q uses the reserved prefix %q", group, KubernetesPrefix)
+		}
+	}
+	return nil
+}
+
+func isReserved(name string) bool {
+	return strings.HasPrefix(strings.ToLower(name), KubernetesPrefix)
+}
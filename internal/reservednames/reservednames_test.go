@@ -0,0 +1,57 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package reservednames
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		groups   []string
+		wantErr  string
+	}{
+		{
+			name:     "no reserved names",
+			username: "ryan",
+			groups:   []string{"admins", "developers-system:"},
+		},
+		{
+			name:     "nil groups",
+			username: "ryan",
+		},
+		{
+			name:     "reserved username",
+			username: "system:admin",
+			groups:   []string{"admins"},
+			wantErr:  `username "system:admin" uses the reserved prefix "system:"`,
+		},
+		{
+			name:     "reserved username with different case",
+			username: "System:Admin",
+			wantErr:  `username "System:Admin" uses the reserved prefix "system:"`,
+		},
+		{
+			name:     "reserved group",
+			username: "ryan",
+			groups:   []string{"admins", "system:masters"},
+			wantErr:  `group "system:masters" uses the reserved prefix "system:"`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(tt.username, tt.groups)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package sessionencryption encrypts the downstream sessions which are stored in Secrets, using the session
+// encryption keys of each FederationDomain.
+package sessionencryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"sync"
+
+	"go.pinniped.dev/internal/constable"
+	"go.pinniped.dev/internal/crud"
+)
+
+const (
+	// KeySize is the length, in bytes, of each session encryption key. Sessions are encrypted with AES-256-GCM.
+	KeySize = 32
+
+	// ErrUnknownKey is returned when data was encrypted by a key which is not in the Keyring, e.g. because the key
+	// was deleted after a rotation, or because the keys have not been loaded yet.
+	ErrUnknownKey = constable.Error("unknown session encryption key")
+
+	// ErrCiphertextTooShort is returned when the encrypted data cannot even hold a nonce.
+	ErrCiphertextTooShort = constable.Error("session encryption ciphertext is too short")
+)
+
+// Keys are the session encryption keys of one FederationDomain.
+type Keys struct {
+	// ActiveKeyID is the ID of the key which encrypts new data.
+	ActiveKeyID string
+	// Keys are all the keys of the FederationDomain by key ID, including the active key and the retired keys.
+	Keys map[string][]byte
+}
+
+// Keyring holds the session encryption keys of all FederationDomains. It is thread-safe.
+type Keyring struct {
+	mu            sync.RWMutex
+	issuerToKeys  map[string]*Keys
+	keyIDToIssuer map[string]string
+}
+
+var _ crud.EncryptionKeys = (*Keyring)(nil)
+
+// NewKeyring returns an empty Keyring.
+func NewKeyring() *Keyring {
+	return &Keyring{
+		issuerToKeys:  map[string]*Keys{},
+		keyIDToIssuer: map[string]string{},
+	}
+}
+
+// SetIssuerToKeys replaces the keys of all FederationDomains.
+func (k *Keyring) SetIssuerToKeys(issuerToKeys map[string]*Keys) {
+	keyIDToIssuer := map[string]string{}
+	for issuer, keys := range issuerToKeys {
+		for keyID := range keys.Keys {
+			keyIDToIssuer[keyID] = issuer
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.issuerToKeys = issuerToKeys
+	k.keyIDToIssuer = keyIDToIssuer
+}
+
+// ForIssuer returns a Transformer which encrypts data with the active key of the FederationDomain with the given
+// issuer, and which only decrypts data that was encrypted by one of that FederationDomain's keys. The empty issuer
+// returns a Transformer which cannot encrypt, but which decrypts data that was encrypted by any FederationDomain,
+// for the callers which only read the data of all FederationDomains.
+func (k *Keyring) ForIssuer(issuer string) crud.Transformer {
+	return &transformer{keyring: k, issuer: issuer}
+}
+
+// ForRetiredKey returns a Transformer for the FederationDomain which owns the key with the given ID, but only when
+// that key is not the FederationDomain's active key anymore, so that the data which it encrypted can be
+// re-encrypted with the active key.
+func (k *Keyring) ForRetiredKey(keyID string) (crud.Transformer, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	issuer, ok := k.keyIDToIssuer[keyID]
+	if !ok || k.issuerToKeys[issuer].ActiveKeyID == keyID {
+		return nil, false
+	}
+	return k.ForIssuer(issuer), true
+}
+
+// HasActiveKey returns whether the keys of the FederationDomain with the given issuer are loaded, so that its data
+// can be encrypted.
+func (k *Keyring) HasActiveKey(issuer string) bool {
+	_, _, ok := k.activeKey(issuer)
+	return ok
+}
+
+func (k *Keyring) activeKey(issuer string) (string, []byte, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	keys, ok := k.issuerToKeys[issuer]
+	if !ok {
+		return "", nil, false
+	}
+	key, ok := keys.Keys[keys.ActiveKeyID]
+	return keys.ActiveKeyID, key, ok
+}
+
+// key returns the key with the given ID, and the issuer of the FederationDomain which owns it.
+func (k *Keyring) key(keyID string) (string, []byte, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	issuer, ok := k.keyIDToIssuer[keyID]
+	if !ok {
+		return "", nil, false
+	}
+	return issuer, k.issuerToKeys[issuer].Keys[keyID], true
+}
+
+type transformer struct {
+	keyring *Keyring
+	issuer  string
+}
+
+func (t *transformer) Encrypt(plaintext, associatedData []byte) ([]byte, string, error) {
+	keyID, key, ok := t.keyring.activeKey(t.issuer)
+	if !ok {
+		return nil, "", fmt.Errorf("no session encryption key is available for issuer %q", t.issuer)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", fmt.Errorf("cannot generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, issuerAssociatedData(t.issuer, associatedData)), keyID, nil
+}
+
+func (t *transformer) Decrypt(ciphertext, associatedData []byte, keyID string) ([]byte, error) {
+	issuer, key, ok := t.keyring.key(keyID)
+	// A FederationDomain only decrypts its own data. Any key may only be used by the read-only transformer.
+	if !ok || (t.issuer != "" && issuer != t.issuer) {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, ErrCiphertextTooShort
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, issuerAssociatedData(issuer, associatedData))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt with session encryption key %s: %w", keyID, err)
+	}
+	return plaintext, nil
+}
+
+// issuerAssociatedData adds the issuer of the FederationDomain which encrypts the data to the associated data of the
+// caller, so that the encrypted data cannot be copied to the storage of another FederationDomain. Issuers are URLs,
+// which cannot contain a NUL byte, so the separator keeps the result unambiguous.
+func issuerAssociatedData(issuer string, associatedData []byte) []byte {
+	return append([]byte(issuer+"\x00"), associatedData...)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid session encryption key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
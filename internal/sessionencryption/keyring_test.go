@@ -0,0 +1,120 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package sessionencryption
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyring(t *testing.T) {
+	key1 := bytes.Repeat([]byte("1"), KeySize)
+	key2 := bytes.Repeat([]byte("2"), KeySize)
+	key3 := bytes.Repeat([]byte("3"), KeySize)
+
+	keyring := NewKeyring()
+
+	require.False(t, keyring.HasActiveKey("https://issuer1.example.com"))
+	_, _, err := keyring.ForIssuer("https://issuer1.example.com").Encrypt([]byte("some data"), []byte("some-secret"))
+	require.EqualError(t, err, `no session encryption key is available for issuer "https://issuer1.example.com"`)
+
+	keyring.SetIssuerToKeys(map[string]*Keys{
+		"https://issuer1.example.com": {ActiveKeyID: "key1", Keys: map[string][]byte{"key1": key1}},
+		"https://issuer2.example.com": {ActiveKeyID: "key2", Keys: map[string][]byte{"key2": key2}},
+	})
+
+	require.True(t, keyring.HasActiveKey("https://issuer1.example.com"))
+	require.True(t, keyring.HasActiveKey("https://issuer2.example.com"))
+	require.False(t, keyring.HasActiveKey("https://issuer3.example.com"))
+
+	issuer1 := keyring.ForIssuer("https://issuer1.example.com")
+	ciphertext, keyID, err := issuer1.Encrypt([]byte("some data"), []byte("some-secret"))
+	require.NoError(t, err)
+	require.Equal(t, "key1", keyID)
+	require.NotContains(t, string(ciphertext), "some data")
+
+	// Each encryption uses a new nonce.
+	otherCiphertext, _, err := issuer1.Encrypt([]byte("some data"), []byte("some-secret"))
+	require.NoError(t, err)
+	require.NotEqual(t, ciphertext, otherCiphertext)
+
+	// The FederationDomain which encrypted the data, and the read-only transformer, can decrypt it.
+	for _, issuer := range []string{"https://issuer1.example.com", ""} {
+		plaintext, err := keyring.ForIssuer(issuer).Decrypt(ciphertext, []byte("some-secret"), "key1")
+		require.NoError(t, err)
+		require.Equal(t, "some data", string(plaintext))
+	}
+
+	// Other FederationDomains cannot use the keys of issuer1.
+	issuer2 := keyring.ForIssuer("https://issuer2.example.com")
+	_, err = issuer2.Decrypt(ciphertext, []byte("some-secret"), "key1")
+	require.True(t, errors.Is(err, ErrUnknownKey))
+	require.EqualError(t, err, "unknown session encryption key: key1")
+
+	// The issuer is part of the associated data, so the data which issuer2 encrypted cannot be passed off as
+	// the data of issuer1, even by a transformer which may use the key of issuer2.
+	issuer2Ciphertext, _, err := issuer2.Encrypt([]byte("some data"), []byte("some-secret"))
+	require.NoError(t, err)
+	aead, err := newAEAD(key2)
+	require.NoError(t, err)
+	nonce := issuer2Ciphertext[:aead.NonceSize()]
+	_, err = aead.Open(nil, nonce, issuer2Ciphertext[aead.NonceSize():], issuerAssociatedData("https://issuer1.example.com", []byte("some-secret")))
+	require.EqualError(t, err, "cipher: message authentication failed")
+	_, err = aead.Open(nil, nonce, issuer2Ciphertext[aead.NonceSize():], []byte("some-secret"))
+	require.EqualError(t, err, "cipher: message authentication failed")
+
+	// The associated data must match, so that data cannot be copied to another Secret.
+	_, err = issuer1.Decrypt(ciphertext, []byte("some-other-secret"), "key1")
+	require.EqualError(t, err, "cannot decrypt with session encryption key key1: cipher: message authentication failed")
+
+	_, err = issuer1.Decrypt(ciphertext, []byte("some-secret"), "key2")
+	require.True(t, errors.Is(err, ErrUnknownKey))
+	_, err = keyring.ForIssuer("").Decrypt(ciphertext, []byte("some-secret"), "key2")
+	require.EqualError(t, err, "cannot decrypt with session encryption key key2: cipher: message authentication failed")
+
+	_, err = issuer1.Decrypt(ciphertext, []byte("some-secret"), "key3")
+	require.True(t, errors.Is(err, ErrUnknownKey))
+	require.EqualError(t, err, "unknown session encryption key: key3")
+
+	_, err = issuer1.Decrypt([]byte("short"), []byte("some-secret"), "key1")
+	require.Equal(t, ErrCiphertextTooShort, err)
+
+	// Active keys are not retired.
+	_, ok := keyring.ForRetiredKey("key1")
+	require.False(t, ok)
+	_, ok = keyring.ForRetiredKey("key3")
+	require.False(t, ok)
+
+	// Rotate the keys of issuer1.
+	keyring.SetIssuerToKeys(map[string]*Keys{
+		"https://issuer1.example.com": {ActiveKeyID: "key3", Keys: map[string][]byte{"key1": key1, "key3": key3}},
+		"https://issuer2.example.com": {ActiveKeyID: "key2", Keys: map[string][]byte{"key2": key2}},
+	})
+
+	reencrypter, ok := keyring.ForRetiredKey("key1")
+	require.True(t, ok)
+	plaintext, err := reencrypter.Decrypt(ciphertext, []byte("some-secret"), "key1")
+	require.NoError(t, err)
+	require.Equal(t, "some data", string(plaintext))
+	_, keyID, err = reencrypter.Encrypt(plaintext, []byte("some-secret"))
+	require.NoError(t, err)
+	require.Equal(t, "key3", keyID)
+
+	// Once the retired key is removed, the data which it encrypted cannot be decrypted anymore.
+	keyring.SetIssuerToKeys(map[string]*Keys{
+		"https://issuer1.example.com": {ActiveKeyID: "key3", Keys: map[string][]byte{"key3": key3}},
+	})
+	_, err = issuer1.Decrypt(ciphertext, []byte("some-secret"), "key1")
+	require.True(t, errors.Is(err, ErrUnknownKey))
+	_, ok = keyring.ForRetiredKey("key1")
+	require.False(t, ok)
+
+	// FederationDomains which were removed cannot encrypt anymore.
+	require.False(t, keyring.HasActiveKey("https://issuer2.example.com"))
+	_, _, err = keyring.ForIssuer("https://issuer2.example.com").Encrypt([]byte("some data"), []byte("some-secret"))
+	require.EqualError(t, err, `no session encryption key is available for issuer "https://issuer2.example.com"`)
+}
@@ -0,0 +1,115 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package scheme
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	sessionapi "go.pinniped.dev/generated/latest/apis/supervisor/session"
+	sessionv1alpha1 "go.pinniped.dev/generated/latest/apis/supervisor/session/v1alpha1"
+)
+
+func TestNew(t *testing.T) {
+	// kube's core internal
+	internalGV := schema.GroupVersion{
+		Group:   "",
+		Version: runtime.APIVersionInternal,
+	}
+
+	wantTypes := func(sessionGV schema.GroupVersion) map[schema.GroupVersionKind]reflect.Type {
+		sessionGVInternal := schema.GroupVersion{
+			Group:   sessionGV.Group,
+			Version: runtime.APIVersionInternal,
+		}
+
+		return map[schema.GroupVersionKind]reflect.Type{
+			// all the types that are in the aggregated API group
+
+			sessionGV.WithKind("Session"):     reflect.TypeOf(&sessionv1alpha1.Session{}).Elem(),
+			sessionGV.WithKind("SessionList"): reflect.TypeOf(&sessionv1alpha1.SessionList{}).Elem(),
+
+			sessionGVInternal.WithKind("Session"):     reflect.TypeOf(&sessionapi.Session{}).Elem(),
+			sessionGVInternal.WithKind("SessionList"): reflect.TypeOf(&sessionapi.SessionList{}).Elem(),
+
+			sessionGV.WithKind("CreateOptions"): reflect.TypeOf(&metav1.CreateOptions{}).Elem(),
+			sessionGV.WithKind("DeleteOptions"): reflect.TypeOf(&metav1.DeleteOptions{}).Elem(),
+			sessionGV.WithKind("GetOptions"):    reflect.TypeOf(&metav1.GetOptions{}).Elem(),
+			sessionGV.WithKind("ListOptions"):   reflect.TypeOf(&metav1.ListOptions{}).Elem(),
+			sessionGV.WithKind("PatchOptions"):  reflect.TypeOf(&metav1.PatchOptions{}).Elem(),
+			sessionGV.WithKind("UpdateOptions"): reflect.TypeOf(&metav1.UpdateOptions{}).Elem(),
+			sessionGV.WithKind("WatchEvent"):    reflect.TypeOf(&metav1.WatchEvent{}).Elem(),
+
+			sessionGVInternal.WithKind("WatchEvent"): reflect.TypeOf(&metav1.InternalEvent{}).Elem(),
+
+			// the types below this line do not really matter to us because they are in the core group
+
+			internalGV.WithKind("WatchEvent"): reflect.TypeOf(&metav1.InternalEvent{}).Elem(),
+
+			metav1.Unversioned.WithKind("APIGroup"):        reflect.TypeOf(&metav1.APIGroup{}).Elem(),
+			metav1.Unversioned.WithKind("APIGroupList"):    reflect.TypeOf(&metav1.APIGroupList{}).Elem(),
+			metav1.Unversioned.WithKind("APIResourceList"): reflect.TypeOf(&metav1.APIResourceList{}).Elem(),
+			metav1.Unversioned.WithKind("APIVersions"):     reflect.TypeOf(&metav1.APIVersions{}).Elem(),
+			metav1.Unversioned.WithKind("CreateOptions"):   reflect.TypeOf(&metav1.CreateOptions{}).Elem(),
+			metav1.Unversioned.WithKind("DeleteOptions"):   reflect.TypeOf(&metav1.DeleteOptions{}).Elem(),
+			metav1.Unversioned.WithKind("GetOptions"):      reflect.TypeOf(&metav1.GetOptions{}).Elem(),
+			metav1.Unversioned.WithKind("ListOptions"):     reflect.TypeOf(&metav1.ListOptions{}).Elem(),
+			metav1.Unversioned.WithKind("PatchOptions"):    reflect.TypeOf(&metav1.PatchOptions{}).Elem(),
+			metav1.Unversioned.WithKind("Status"):          reflect.TypeOf(&metav1.Status{}).Elem(),
+			metav1.Unversioned.WithKind("UpdateOptions"):   reflect.TypeOf(&metav1.UpdateOptions{}).Elem(),
+			metav1.Unversioned.WithKind("WatchEvent"):      reflect.TypeOf(&metav1.WatchEvent{}).Elem(),
+		}
+	}
+
+	tests := []struct {
+		name                    string
+		apiGroupSuffix          string
+		wantSessionGroupVersion schema.GroupVersion
+	}{
+		{
+			name:                    "regular api group",
+			apiGroupSuffix:          "pinniped.dev",
+			wantSessionGroupVersion: schema.GroupVersion{Group: "session.supervisor.pinniped.dev", Version: "v1alpha1"},
+		},
+		{
+			name:                    "other api group",
+			apiGroupSuffix:          "walrus.tld",
+			wantSessionGroupVersion: schema.GroupVersion{Group: "session.supervisor.walrus.tld", Version: "v1alpha1"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			scheme, sessionGV := New(tt.apiGroupSuffix)
+			require.Equal(t, wantTypes(tt.wantSessionGroupVersion), scheme.AllKnownTypes())
+			require.Equal(t, tt.wantSessionGroupVersion, sessionGV)
+
+			// sessions can be converted between the external and the internal version
+			external := &sessionv1alpha1.Session{
+				ObjectMeta: metav1.ObjectMeta{Name: "some-session"},
+				Spec:       sessionv1alpha1.SessionSpec{Subject: "some-subject", Groups: []string{"some-group"}},
+			}
+			internal := &sessionapi.Session{}
+			require.NoError(t, scheme.Convert(external, internal, nil))
+			require.Equal(t, "some-session", internal.Name)
+			require.Equal(t, "some-subject", internal.Spec.Subject)
+			require.Equal(t, []string{"some-group"}, internal.Spec.Groups)
+
+			// the field selectors which are supported by the REST storage are allowed
+			for _, label := range []string{"metadata.name", "spec.subject", "spec.username"} {
+				gotLabel, gotValue, err := scheme.ConvertFieldLabel(sessionGV.WithKind("Session"), label, "some-value")
+				require.NoError(t, err)
+				require.Equal(t, label, gotLabel)
+				require.Equal(t, "some-value", gotValue)
+			}
+			_, _, err := scheme.ConvertFieldLabel(sessionGV.WithKind("Session"), "spec.clientID", "some-value")
+			require.EqualError(t, err, "field label not supported: spec.clientID")
+		})
+	}
+}
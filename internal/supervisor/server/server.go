@@ -9,6 +9,7 @@ import (
 	"crypto/rand"
 	"crypto/tls"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
@@ -22,7 +23,13 @@ import (
 	"github.com/joshlf/go-acl"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
 	genericapifilters "k8s.io/apiserver/pkg/endpoints/filters"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	genericoptions "k8s.io/apiserver/pkg/server/options"
+	"k8s.io/apiserver/pkg/storage/value/encrypt/envelope"
 	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/pkg/version"
@@ -30,40 +37,60 @@ import (
 	"k8s.io/component-base/logs"
 	"k8s.io/klog/v2"
 	"k8s.io/klog/v2/klogr"
+	aggregatorclient "k8s.io/kube-aggregator/pkg/client/clientset_generated/clientset"
 	"k8s.io/utils/clock"
 
 	configv1alpha1 "go.pinniped.dev/generated/latest/apis/supervisor/config/v1alpha1"
 	pinnipedclientset "go.pinniped.dev/generated/latest/client/supervisor/clientset/versioned"
 	pinnipedinformers "go.pinniped.dev/generated/latest/client/supervisor/informers/externalversions"
+	"go.pinniped.dev/internal/audit"
 	"go.pinniped.dev/internal/config/supervisor"
+	"go.pinniped.dev/internal/controller/apicerts"
 	"go.pinniped.dev/internal/controller/supervisorconfig"
 	"go.pinniped.dev/internal/controller/supervisorconfig/activedirectoryupstreamwatcher"
 	"go.pinniped.dev/internal/controller/supervisorconfig/generator"
 	"go.pinniped.dev/internal/controller/supervisorconfig/ldapupstreamwatcher"
+	"go.pinniped.dev/internal/controller/supervisorconfig/oidcclientwatcher"
 	"go.pinniped.dev/internal/controller/supervisorconfig/oidcupstreamwatcher"
 	"go.pinniped.dev/internal/controller/supervisorstorage"
 	"go.pinniped.dev/internal/controllerinit"
 	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/crud/sqlstorage"
 	"go.pinniped.dev/internal/crypto/ptls"
 	"go.pinniped.dev/internal/deploymentref"
 	"go.pinniped.dev/internal/downward"
+	"go.pinniped.dev/internal/dynamiccert"
 	"go.pinniped.dev/internal/groupsuffix"
 	"go.pinniped.dev/internal/kubeclient"
 	"go.pinniped.dev/internal/leaderelection"
+	"go.pinniped.dev/internal/metrics"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/clientregistry"
 	"go.pinniped.dev/internal/oidc/jwks"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/oidc/provider/manager"
+	"go.pinniped.dev/internal/oidc/signer"
 	"go.pinniped.dev/internal/plog"
 	"go.pinniped.dev/internal/secret"
+	"go.pinniped.dev/internal/sessionencryption"
+	"go.pinniped.dev/internal/supervisor/apiserver"
+	supervisorscheme "go.pinniped.dev/internal/supervisor/scheme"
+	"go.pinniped.dev/internal/tracing"
 )
 
 const (
 	singletonWorker       = 1
 	defaultResyncInterval = 3 * time.Minute
+
+	// The serving certificate of the aggregated API server uses the same defaults as the one of the Concierge.
+	aggregatedAPIServingCertDuration    = 365 * 24 * time.Hour
+	aggregatedAPIServingCertRenewBefore = 9 * 30 * 24 * time.Hour
 )
 
 func startServer(ctx context.Context, shutdown *sync.WaitGroup, l net.Listener, handler http.Handler) {
 	handler = genericapifilters.WithWarningRecorder(handler)
+	handler = genericapifilters.WithAuditID(handler)  // the audit events of each request are correlated by this ID
 	handler = withBootstrapPaths(handler, "/healthz") // only health checks are allowed for bootstrap connections
 
 	server := http.Server{
@@ -116,18 +143,26 @@ func prepareControllers(
 	cfg *supervisor.Config,
 	issuerManager *manager.Manager,
 	dynamicJWKSProvider jwks.DynamicJWKSProvider,
+	tokenSigner signer.Signer,
+	sqlSessionStorage *sqlstorage.Backend,
+	sessionKeyring *sessionencryption.Keyring,
+	sessionEncryptionKMS envelope.Service,
+	dynamicServingCertProvider dynamiccert.Private,
 	dynamicTLSCertProvider provider.DynamicTLSCertProvider,
 	dynamicUpstreamIDPProvider provider.DynamicUpstreamIDPProvider,
 	secretCache *secret.Cache,
 	supervisorDeployment *appsv1.Deployment,
 	kubeClient kubernetes.Interface,
 	pinnipedClient pinnipedclientset.Interface,
+	aggregatorClient aggregatorclient.Interface,
 	kubeInformers kubeinformers.SharedInformerFactory,
 	pinnipedInformers pinnipedinformers.SharedInformerFactory,
 	leaderElector controllerinit.RunnerWrapper,
 ) controllerinit.RunnerBuilder {
 	federationDomainInformer := pinnipedInformers.Config().V1alpha1().FederationDomains()
 	secretInformer := kubeInformers.Core().V1().Secrets()
+	sessionSupervisorGroupData := groupsuffix.SupervisorAggregatedGroups(*cfg.APIGroupSuffix)
+	serverInstallationNamespace := supervisorDeployment.Namespace
 
 	// Create controller manager.
 	controllerManager := controllerlib.
@@ -135,6 +170,7 @@ func prepareControllers(
 		WithController(
 			supervisorstorage.GarbageCollectorController(
 				dynamicUpstreamIDPProvider,
+				sessionKeyring.ForIssuer(""),
 				clock.RealClock{},
 				kubeClient,
 				secretInformer,
@@ -145,6 +181,7 @@ func prepareControllers(
 		WithController(
 			supervisorconfig.NewFederationDomainWatcherController(
 				issuerManager,
+				tokenSigner != nil,
 				clock.RealClock{},
 				pinnipedClient,
 				federationDomainInformer,
@@ -155,6 +192,8 @@ func prepareControllers(
 		WithController(
 			supervisorconfig.NewJWKSWriterController(
 				cfg.Labels,
+				tokenSigner,
+				clock.RealClock{},
 				kubeClient,
 				pinnipedClient,
 				secretInformer,
@@ -166,12 +205,46 @@ func prepareControllers(
 		WithController(
 			supervisorconfig.NewJWKSObserverController(
 				dynamicJWKSProvider,
+				tokenSigner,
+				secretInformer,
+				federationDomainInformer,
+				controllerlib.WithInformer,
+			),
+			singletonWorker,
+		).
+		WithController(
+			supervisorconfig.NewSessionEncryptionKeysWriterController(
+				cfg.Labels,
+				sessionEncryptionKMS,
+				clock.RealClock{},
+				kubeClient,
+				pinnipedClient,
+				secretInformer,
+				federationDomainInformer,
+				controllerlib.WithInformer,
+			),
+			singletonWorker,
+		).
+		WithController(
+			supervisorconfig.NewSessionEncryptionKeysObserverController(
+				sessionKeyring,
+				sessionEncryptionKMS,
 				secretInformer,
 				federationDomainInformer,
 				controllerlib.WithInformer,
 			),
 			singletonWorker,
 		).
+		WithController(
+			supervisorstorage.ReencryptionController(
+				sessionKeyring,
+				clock.RealClock{},
+				kubeClient,
+				secretInformer,
+				controllerlib.WithInformer,
+			),
+			singletonWorker,
+		).
 		WithController(
 			supervisorconfig.NewTLSCertObserverController(
 				dynamicTLSCertProvider,
@@ -293,7 +366,79 @@ func prepareControllers(
 				secretInformer,
 				controllerlib.WithInformer,
 			),
-			singletonWorker)
+			singletonWorker).
+		WithController(
+			oidcclientwatcher.New(
+				pinnipedClient,
+				pinnipedInformers.Config().V1alpha1().OIDCClients(),
+				secretInformer,
+				clock.RealClock{},
+				klogr.New(),
+				controllerlib.WithInformer,
+			),
+			singletonWorker).
+
+		// API certs controllers are responsible for managing the TLS certificates used to serve the aggregated API.
+		WithController(
+			apicerts.NewCertsManagerController(
+				serverInstallationNamespace,
+				cfg.NamesConfig.APIServingCertificateSecret,
+				cfg.Labels,
+				kubeClient,
+				secretInformer,
+				controllerlib.WithInformer,
+				controllerlib.WithInitialEvent,
+				aggregatedAPIServingCertDuration,
+				"Pinniped Supervisor Aggregation CA",
+				cfg.NamesConfig.APIService,
+			),
+			singletonWorker,
+		).
+		WithController(
+			apicerts.NewAPIServiceUpdaterController(
+				serverInstallationNamespace,
+				cfg.NamesConfig.APIServingCertificateSecret,
+				sessionSupervisorGroupData.APIServiceName(),
+				aggregatorClient,
+				secretInformer,
+				controllerlib.WithInformer,
+			),
+			singletonWorker,
+		).
+		WithController(
+			apicerts.NewCertsObserverController(
+				serverInstallationNamespace,
+				cfg.NamesConfig.APIServingCertificateSecret,
+				dynamicServingCertProvider,
+				secretInformer,
+				controllerlib.WithInformer,
+			),
+			singletonWorker,
+		).
+		WithController(
+			apicerts.NewCertsExpirerController(
+				serverInstallationNamespace,
+				cfg.NamesConfig.APIServingCertificateSecret,
+				kubeClient,
+				secretInformer,
+				controllerlib.WithInformer,
+				aggregatedAPIServingCertRenewBefore,
+				apicerts.TLSCertificateChainSecretKey,
+			),
+			singletonWorker,
+		)
+
+	if sqlSessionStorage != nil {
+		controllerManager.WithController(
+			supervisorstorage.SQLGarbageCollectorController(
+				dynamicUpstreamIDPProvider,
+				clock.RealClock{},
+				sqlSessionStorage,
+				controllerlib.WithInitialEvent,
+			),
+			singletonWorker,
+		)
+	}
 
 	return controllerinit.Prepare(controllerManager.Start, leaderElector, kubeInformers, pinnipedInformers)
 }
@@ -314,6 +459,125 @@ func startControllers(ctx context.Context, shutdown *sync.WaitGroup, buildContro
 	return nil
 }
 
+// newTokenSigner returns the external signer which is configured for the Supervisor, or nil when the
+// FederationDomains should sign tokens with the keys which are stored in their Secrets.
+func newTokenSigner(ctx context.Context, tokenSigner *supervisor.TokenSignerSpec) (signer.ExternalSigner, error) {
+	switch {
+	case tokenSigner == nil:
+		return nil, nil
+	case tokenSigner.PKCS11 != nil:
+		pin, err := ioutil.ReadFile(tokenSigner.PKCS11.PINFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read PKCS#11 PIN file: %w", err)
+		}
+		return signer.NewPKCS11Signer(signer.PKCS11Config{
+			ModulePath: tokenSigner.PKCS11.ModulePath,
+			TokenLabel: tokenSigner.PKCS11.TokenLabel,
+			KeyLabel:   tokenSigner.PKCS11.KeyLabel,
+			PIN:        strings.TrimSpace(string(pin)),
+		})
+	default:
+		return signer.NewPluginSigner(ctx, signer.PluginConfig{
+			Endpoint: tokenSigner.Plugin.Endpoint,
+			Timeout:  time.Duration(*tokenSigner.Plugin.TimeoutSeconds) * time.Second,
+		})
+	}
+}
+
+// newSessionEncryptionKMS returns the KMS plugin which encrypts the session encryption keys of the
+// FederationDomains, or nil when those keys should be stored in their Secrets without further encryption.
+func newSessionEncryptionKMS(sessionEncryption *supervisor.SessionEncryptionSpec) (envelope.Service, error) {
+	if sessionEncryption == nil {
+		return nil, nil
+	}
+	return envelope.NewGRPCService(
+		sessionEncryption.KMS.Endpoint,
+		time.Duration(*sessionEncryption.KMS.TimeoutSeconds)*time.Second,
+	)
+}
+
+// newSQLSessionStorage returns the SQL database which is configured for the downstream sessions, or nil when the
+// sessions should be stored in Secrets.
+func newSQLSessionStorage(ctx context.Context, sessionStorage *supervisor.SessionStorageSpec) (*sqlstorage.Backend, error) {
+	switch {
+	case sessionStorage == nil:
+		return nil, nil
+	case sessionStorage.SQLite != nil:
+		return sqlstorage.Open(ctx, sqlstorage.SQLite, sessionStorage.SQLite.Path)
+	default:
+		connectionString, err := ioutil.ReadFile(sessionStorage.Postgres.ConnectionStringFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read postgres connection string file: %w", err)
+		}
+		return sqlstorage.Open(ctx, sqlstorage.Postgres, strings.TrimSpace(string(connectionString)))
+	}
+}
+
+// Create a configuration for the aggregated API server.
+func getAggregatedAPIServerConfig(
+	dynamicCertProvider dynamiccert.Private,
+	sessionStore *oidc.KubeStorage,
+	upstreamIDPLister oidc.UpstreamIdentityProvidersLister,
+	apiGroupSuffix string,
+	aggregatedAPIServerPort int64,
+	scheme *runtime.Scheme,
+	sessionSupervisorGroupVersion schema.GroupVersion,
+) (*apiserver.Config, error) {
+	codecs := serializer.NewCodecFactory(scheme)
+
+	// this is unused for now but it is a safe value that we could use in the future
+	defaultEtcdPathPrefix := fmt.Sprintf("/pinniped-supervisor-registry/%s", apiGroupSuffix)
+
+	recommendedOptions := genericoptions.NewRecommendedOptions(
+		defaultEtcdPathPrefix,
+		codecs.LegacyCodec(sessionSupervisorGroupVersion),
+	)
+	recommendedOptions.Etcd = nil // turn off etcd storage because the sessions are stored elsewhere
+	recommendedOptions.SecureServing.ServerCert.GeneratedCert = dynamicCertProvider
+
+	// This port is configurable. It should be safe to cast because the config reader already validated it.
+	recommendedOptions.SecureServing.BindPort = int(aggregatedAPIServerPort)
+
+	// secure TLS for connections coming from and going to the Kube API server
+	// this is best effort because not all options provide the right hooks to override TLS config
+	// since our only client is the Kube API server, this uses the most secure TLS config
+	if err := ptls.SecureRecommendedOptions(recommendedOptions, kubeclient.Secure); err != nil {
+		return nil, fmt.Errorf("failed to secure recommended options: %w", err)
+	}
+
+	serverConfig := genericapiserver.NewRecommendedConfig(codecs)
+	// See the Concierge for details. The API server will respond with "the server is currently unable to handle the
+	// request" until the certs controllers have provided a serving cert to dynamicCertProvider.
+	if err := recommendedOptions.ApplyTo(serverConfig); err != nil {
+		return nil, fmt.Errorf("failed to apply recommended options: %w", err)
+	}
+
+	return &apiserver.Config{
+		GenericConfig: serverConfig,
+		ExtraConfig: apiserver.ExtraConfig{
+			SessionStore:                  sessionStore,
+			UpstreamIDPLister:             upstreamIDPLister,
+			Scheme:                        scheme,
+			NegotiatedSerializer:          codecs,
+			SessionSupervisorGroupVersion: sessionSupervisorGroupVersion,
+		},
+	}, nil
+}
+
+// startAggregatedAPIServer runs the aggregated API server until the context is cancelled. The OIDC endpoints keep
+// working when the aggregated API server fails, so the failure is only logged.
+func startAggregatedAPIServer(ctx context.Context, shutdown *sync.WaitGroup, server *apiserver.PinnipedServer) {
+	shutdown.Add(1)
+	go func() {
+		defer shutdown.Done()
+
+		if err := server.GenericAPIServer.PrepareRun().Run(ctx.Done()); err != nil {
+			plog.Error("aggregated API server exited with an error", err)
+		}
+		plog.Debug("aggregated API server exited")
+	}()
+}
+
 //nolint:funlen
 func runSupervisor(podInfo *downward.PodInfo, cfg *supervisor.Config) error {
 	serverInstallationNamespace := podInfo.Namespace
@@ -360,42 +624,153 @@ func runSupervisor(podInfo *downward.PodInfo, cfg *supervisor.Config) error {
 		_, _ = writer.Write([]byte("ok"))
 	}))
 
+	ctx := signalCtx()
+
+	tokenSigner, err := newTokenSigner(ctx, cfg.TokenSigner)
+	if err != nil {
+		return fmt.Errorf("cannot create token signer: %w", err)
+	}
+	if tokenSigner != nil {
+		defer func() {
+			if err := tokenSigner.Close(); err != nil {
+				plog.Error("cannot close token signer", err)
+			}
+		}()
+	}
+
+	closeAuditSinks, err := audit.ConfigureGlobally(audit.ComponentSupervisor, cfg.Audit)
+	if err != nil {
+		return fmt.Errorf("cannot configure audit log: %w", err)
+	}
+	defer closeAuditSinks()
+
+	if cfg.Metrics != nil {
+		// Register the metrics before the controllers and the endpoints start, so that nothing is missed.
+		metrics.Register()
+	}
+
+	flushSpans, err := tracing.ConfigureGlobally(ctx, "pinniped-supervisor", cfg.Tracing)
+	if err != nil {
+		return fmt.Errorf("cannot configure tracing: %w", err)
+	}
+	defer flushSpans()
+
+	sessionEncryptionKMS, err := newSessionEncryptionKMS(cfg.SessionEncryption)
+	if err != nil {
+		return fmt.Errorf("cannot create session encryption KMS: %w", err)
+	}
+	if sessionEncryptionKMS == nil {
+		plog.Warning("session encryption keys are stored without a KMS, so anyone who can read the Secrets in the " +
+			"Supervisor's namespace can decrypt the stored sessions")
+	}
+
+	// The sessions which are stored in Secrets are encrypted with the keys of their FederationDomain, which are
+	// loaded into the keyring by a controller.
+	sessionKeyring := sessionencryption.NewKeyring()
+
+	// writes to session storage are allowed for non-leaders
+	var sessionStorage crud.Backend = crud.NewEncryptedSecretsBackend(
+		clientWithoutLeaderElection.Kubernetes.CoreV1().Secrets(serverInstallationNamespace),
+		sessionKeyring,
+	)
+	sqlSessionStorage, err := newSQLSessionStorage(ctx, cfg.SessionStorage)
+	if err != nil {
+		return fmt.Errorf("cannot open session storage: %w", err)
+	}
+	if sqlSessionStorage != nil {
+		sessionStorage = sqlSessionStorage
+		defer func() {
+			if err := sqlSessionStorage.Close(); err != nil {
+				plog.Error("cannot close session storage", err)
+			}
+		}()
+	}
+
 	dynamicJWKSProvider := jwks.NewDynamicJWKSProvider()
 	dynamicTLSCertProvider := provider.NewDynamicTLSCertProvider()
+	// This cert provider will provide certs to the aggregated API server and will be mutated by a controller to keep
+	// the certs up to date with what is stored in a k8s Secret.
+	dynamicServingCertProvider := dynamiccert.NewServingCert("supervisor-serving-cert")
 	dynamicUpstreamIDPProvider := provider.NewDynamicUpstreamIDPProvider()
 	secretCache := secret.Cache{}
 
+	// The downstream OIDC clients are read from the informer caches, which are started by the controllers.
+	clientManager := clientregistry.NewClientManager(
+		pinnipedInformers.Config().V1alpha1().OIDCClients().Lister().OIDCClients(serverInstallationNamespace),
+		kubeInformers.Core().V1().Secrets().Lister().Secrets(serverInstallationNamespace),
+	)
+
 	// OIDC endpoints will be served by the oidProvidersManager, and any non-OIDC paths will fallback to the healthMux.
 	oidProvidersManager := manager.NewManager(
 		healthMux,
 		dynamicJWKSProvider,
 		dynamicUpstreamIDPProvider,
 		&secretCache,
-		clientWithoutLeaderElection.Kubernetes.CoreV1().Secrets(serverInstallationNamespace), // writes to kube storage are allowed for non-leaders
+		sessionStorage,
+		sessionKeyring,
+		clientManager,
+		cfg.AllowReservedUsernamesAndGroups,
 	)
 
 	buildControllersFunc := prepareControllers(
 		cfg,
 		oidProvidersManager,
 		dynamicJWKSProvider,
+		tokenSigner,
+		sqlSessionStorage,
+		sessionKeyring,
+		sessionEncryptionKMS,
+		dynamicServingCertProvider,
 		dynamicTLSCertProvider,
 		dynamicUpstreamIDPProvider,
 		&secretCache,
 		supervisorDeployment,
 		client.Kubernetes,
 		client.PinnipedSupervisor,
+		client.Aggregation,
 		kubeInformers,
 		pinnipedInformers,
 		leaderElector,
 	)
 
-	ctx := signalCtx()
 	shutdown := &sync.WaitGroup{}
 
 	if err := startControllers(ctx, shutdown, buildControllersFunc); err != nil {
 		return err
 	}
 
+	// The aggregated API lists and deletes the downstream sessions. The session storage lifetimes do not matter
+	// here because the aggregated API never creates any storage.
+	scheme, sessionGV := supervisorscheme.New(*cfg.APIGroupSuffix)
+	aggregatedAPIServerConfig, err := getAggregatedAPIServerConfig(
+		dynamicServingCertProvider,
+		oidc.NewStorage(sessionStorage, clientManager, oidc.DefaultOIDCTimeoutsConfiguration()),
+		dynamicUpstreamIDPProvider,
+		*cfg.APIGroupSuffix,
+		*cfg.AggregatedAPIServerPort,
+		scheme,
+		sessionGV,
+	)
+	if err != nil {
+		return fmt.Errorf("could not configure aggregated API server: %w", err)
+	}
+	aggregatedAPIServer, err := aggregatedAPIServerConfig.Complete().New()
+	if err != nil {
+		return fmt.Errorf("could not create aggregated API server: %w", err)
+	}
+	startAggregatedAPIServer(ctx, shutdown, aggregatedAPIServer)
+
+	if cfg.Metrics != nil {
+		metricsListener, err := net.Listen("tcp", cfg.Metrics.Address)
+		if err != nil {
+			return fmt.Errorf("cannot create metrics listener with address %q: %w", cfg.Metrics.Address, err)
+		}
+
+		defer func() { _ = metricsListener.Close() }()
+		startServer(ctx, shutdown, metricsListener, metrics.Handler())
+		plog.Debug("supervisor metrics listener started", "address", metricsListener.Addr().String())
+	}
+
 	if e := cfg.Endpoints.HTTP; e.Network != supervisor.NetworkDisabled {
 		finishSetupPerms := maybeSetupUnixPerms(e, supervisorPod)
 
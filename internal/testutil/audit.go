@@ -0,0 +1,38 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package testutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/audit"
+)
+
+// RecordAuditEvents records the audit events of the component until the end of the test. The returned func returns
+// the events which were recorded so far. Since the audit log is global, tests which use it must not run in parallel.
+func RecordAuditEvents(t *testing.T, component audit.Component) func() []audit.Event {
+	t.Helper()
+
+	var buf bytes.Buffer
+	t.Cleanup(audit.SetGlobalSinks(component, audit.NewWriterSink(&buf)))
+
+	return func() []audit.Event {
+		t.Helper()
+
+		events := []audit.Event{}
+		scanner := bufio.NewScanner(bytes.NewReader(buf.Bytes()))
+		for scanner.Scan() {
+			var event audit.Event
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+			events = append(events, event)
+		}
+		require.NoError(t, scanner.Err())
+		return events
+	}
+}
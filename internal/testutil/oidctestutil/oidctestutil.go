@@ -19,18 +19,24 @@ import (
 	"github.com/stretchr/testify/require"
 	"golang.org/x/oauth2"
 	"gopkg.in/square/go-jose.v2"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes/fake"
 	v1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
 
+	configv1alpha1 "go.pinniped.dev/generated/latest/apis/supervisor/config/v1alpha1"
+	configv1alpha1listers "go.pinniped.dev/generated/latest/client/supervisor/listers/config/v1alpha1"
 	"go.pinniped.dev/internal/authenticators"
 	"go.pinniped.dev/internal/crud"
 	"go.pinniped.dev/internal/fositestorage/authorizationcode"
 	"go.pinniped.dev/internal/fositestorage/openidconnect"
 	pkce2 "go.pinniped.dev/internal/fositestorage/pkce"
 	"go.pinniped.dev/internal/fositestoragei"
+	"go.pinniped.dev/internal/oidc/clientregistry"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/psession"
 	"go.pinniped.dev/internal/testutil"
@@ -101,6 +107,7 @@ type TestUpstreamLDAPIdentityProvider struct {
 	performRefreshCallCount int
 	performRefreshArgs      []*PerformRefreshArgs
 	PerformRefreshErr       error
+	PerformRefreshGroups    []string
 }
 
 var _ provider.UpstreamLDAPIdentityProviderI = &TestUpstreamLDAPIdentityProvider{}
@@ -121,7 +128,7 @@ func (u *TestUpstreamLDAPIdentityProvider) GetURL() *url.URL {
 	return u.URL
 }
 
-func (u *TestUpstreamLDAPIdentityProvider) PerformRefresh(ctx context.Context, storedRefreshAttributes provider.StoredRefreshAttributes) error {
+func (u *TestUpstreamLDAPIdentityProvider) PerformRefresh(ctx context.Context, storedRefreshAttributes provider.StoredRefreshAttributes) ([]string, error) {
 	if u.performRefreshArgs == nil {
 		u.performRefreshArgs = make([]*PerformRefreshArgs, 0)
 	}
@@ -133,9 +140,9 @@ func (u *TestUpstreamLDAPIdentityProvider) PerformRefresh(ctx context.Context, s
 		ExpectedSubject:  storedRefreshAttributes.Subject,
 	})
 	if u.PerformRefreshErr != nil {
-		return u.PerformRefreshErr
+		return nil, u.PerformRefreshErr
 	}
-	return nil
+	return u.PerformRefreshGroups, nil
 }
 
 func (u *TestUpstreamLDAPIdentityProvider) PerformRefreshCallCount() int {
@@ -156,6 +163,7 @@ type TestUpstreamOIDCIdentityProvider struct {
 	AuthorizationURL         url.URL
 	UserInfoURL              bool
 	RevocationURL            *url.URL
+	EndSessionURL            *url.URL
 	UsernameClaim            string
 	GroupsClaim              string
 	Scopes                   []string
@@ -223,6 +231,10 @@ func (u *TestUpstreamOIDCIdentityProvider) GetRevocationURL() *url.URL {
 	return u.RevocationURL
 }
 
+func (u *TestUpstreamOIDCIdentityProvider) GetEndSessionURL() *url.URL {
+	return u.EndSessionURL
+}
+
 func (u *TestUpstreamOIDCIdentityProvider) GetScopes() []string {
 	return u.Scopes
 }
@@ -607,6 +619,34 @@ func (b *UpstreamIDPListerBuilder) RequireExactlyZeroCallsToRevokeToken(t *testi
 	)
 }
 
+// NewIdentityTransformsGetter returns a FederationDomainIssuer which can be used as an oidc.IdentityTransformsGetter
+// by handler tests. It returns the transforms of the given identity providers, or an empty pipeline for any other
+// identity provider.
+func NewIdentityTransformsGetter(t *testing.T, identityProviders []provider.FederationDomainIdentityProvider) *provider.FederationDomainIssuer {
+	t.Helper()
+	federationDomainIssuer, err := provider.NewFederationDomainIssuer("https://test-issuer.example.com", identityProviders, provider.TokenLifespans{}, nil)
+	require.NoError(t, err)
+	return federationDomainIssuer
+}
+
+// NewClientManager returns a clientregistry.ClientManager for handler tests which knows about the static pinniped-cli
+// client and about the given OIDCClients and their Secrets, which must all be in the given namespace.
+func NewClientManager(t *testing.T, namespace string, oidcClients []*configv1alpha1.OIDCClient, secrets []*corev1.Secret) *clientregistry.ClientManager {
+	t.Helper()
+	oidcClientsIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, oidcClient := range oidcClients {
+		require.NoError(t, oidcClientsIndexer.Add(oidcClient))
+	}
+	secretsIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, secret := range secrets {
+		require.NoError(t, secretsIndexer.Add(secret))
+	}
+	return clientregistry.NewClientManager(
+		configv1alpha1listers.NewOIDCClientLister(oidcClientsIndexer).OIDCClients(namespace),
+		corev1listers.NewSecretLister(secretsIndexer).Secrets(namespace),
+	)
+}
+
 func NewUpstreamIDPListerBuilder() *UpstreamIDPListerBuilder {
 	return &UpstreamIDPListerBuilder{}
 }
@@ -617,6 +657,7 @@ type TestUpstreamOIDCIdentityProviderBuilder struct {
 	clientID                             string
 	scopes                               []string
 	idToken                              map[string]interface{}
+	rawIDToken                           string
 	refreshToken                         *oidctypes.RefreshToken
 	accessToken                          *oidctypes.AccessToken
 	usernameClaim                        string
@@ -625,6 +666,7 @@ type TestUpstreamOIDCIdentityProviderBuilder struct {
 	validatedAndMergedWithUserInfoTokens *oidctypes.Token
 	authorizationURL                     url.URL
 	hasUserInfoURL                       bool
+	endSessionURL                        *url.URL
 	additionalAuthcodeParams             map[string]string
 	allowPasswordGrant                   bool
 	authcodeExchangeErr                  error
@@ -712,6 +754,16 @@ func (u *TestUpstreamOIDCIdentityProviderBuilder) WithAdditionalAuthcodeParams(p
 	return u
 }
 
+func (u *TestUpstreamOIDCIdentityProviderBuilder) WithRawIDToken(token string) *TestUpstreamOIDCIdentityProviderBuilder {
+	u.rawIDToken = token
+	return u
+}
+
+func (u *TestUpstreamOIDCIdentityProviderBuilder) WithEndSessionURL(value *url.URL) *TestUpstreamOIDCIdentityProviderBuilder {
+	u.endSessionURL = value
+	return u
+}
+
 func (u *TestUpstreamOIDCIdentityProviderBuilder) WithRefreshToken(token string) *TestUpstreamOIDCIdentityProviderBuilder {
 	u.refreshToken = &oidctypes.RefreshToken{Token: token}
 	return u
@@ -787,18 +839,19 @@ func (u *TestUpstreamOIDCIdentityProviderBuilder) Build() *TestUpstreamOIDCIdent
 		AllowPasswordGrant:       u.allowPasswordGrant,
 		AuthorizationURL:         u.authorizationURL,
 		UserInfoURL:              u.hasUserInfoURL,
+		EndSessionURL:            u.endSessionURL,
 		AdditionalAuthcodeParams: u.additionalAuthcodeParams,
 		ExchangeAuthcodeAndValidateTokensFunc: func(ctx context.Context, authcode string, pkceCodeVerifier pkce.Code, expectedIDTokenNonce nonce.Nonce) (*oidctypes.Token, error) {
 			if u.authcodeExchangeErr != nil {
 				return nil, u.authcodeExchangeErr
 			}
-			return &oidctypes.Token{IDToken: &oidctypes.IDToken{Claims: u.idToken}, RefreshToken: u.refreshToken, AccessToken: u.accessToken}, nil
+			return &oidctypes.Token{IDToken: &oidctypes.IDToken{Token: u.rawIDToken, Claims: u.idToken}, RefreshToken: u.refreshToken, AccessToken: u.accessToken}, nil
 		},
 		PasswordCredentialsGrantAndValidateTokensFunc: func(ctx context.Context, username, password string) (*oidctypes.Token, error) {
 			if u.passwordGrantErr != nil {
 				return nil, u.passwordGrantErr
 			}
-			return &oidctypes.Token{IDToken: &oidctypes.IDToken{Claims: u.idToken}, RefreshToken: u.refreshToken, AccessToken: u.accessToken}, nil
+			return &oidctypes.Token{IDToken: &oidctypes.IDToken{Token: u.rawIDToken, Claims: u.idToken}, RefreshToken: u.refreshToken, AccessToken: u.accessToken}, nil
 		},
 		PerformRefreshFunc: func(ctx context.Context, refreshToken string) (*oauth2.Token, error) {
 			if u.performRefreshErr != nil {
@@ -829,6 +882,7 @@ func NewTestUpstreamOIDCIdentityProviderBuilder() *TestUpstreamOIDCIdentityProvi
 type ExpectedUpstreamStateParamFormat struct {
 	P string `json:"p"`
 	U string `json:"u"`
+	T string `json:"t"`
 	N string `json:"n"`
 	C string `json:"c"`
 	K string `json:"k"`
@@ -1019,7 +1073,10 @@ func validateAuthcodeStorage(
 	// Check the user's identity, which are put into the downstream ID token's subject, username and groups claims.
 	require.Equal(t, wantDownstreamIDTokenSubject, actualClaims.Subject)
 	require.Equal(t, wantDownstreamIDTokenUsername, actualClaims.Extra["username"])
-	require.Len(t, actualClaims.Extra, 2)
+	require.Len(t, actualClaims.Extra, 3)
+	// The session ID claim is the ID of the stored request, which is also used to label the session's storage.
+	require.Equal(t, storedRequestFromAuthcode.GetID(), actualClaims.Extra["sid"])
+	require.NotEmpty(t, actualClaims.Extra["sid"])
 	actualDownstreamIDTokenGroups := actualClaims.Extra["groups"]
 	require.NotNil(t, actualDownstreamIDTokenGroups)
 	require.ElementsMatch(t, wantDownstreamIDTokenGroups, actualDownstreamIDTokenGroups)
@@ -1048,8 +1105,12 @@ func validateAuthcodeStorage(
 	require.Empty(t, actualClaims.AuthenticationContextClassReference)
 	require.Empty(t, actualClaims.AuthenticationMethodsReferences)
 
-	// Check that the custom Pinniped session data matches.
-	require.Equal(t, wantCustomSessionData, storedSessionFromAuthcode.Custom)
+	// Check that the custom Pinniped session data matches. The login time is recorded when the session is made.
+	require.NotNil(t, storedSessionFromAuthcode.Custom)
+	require.Equal(t, actualClaims.AuthTime, storedSessionFromAuthcode.Custom.LoginTime)
+	wantCustomSessionDataWithLoginTime := *wantCustomSessionData
+	wantCustomSessionDataWithLoginTime.LoginTime = actualClaims.AuthTime
+	require.Equal(t, &wantCustomSessionDataWithLoginTime, storedSessionFromAuthcode.Custom)
 
 	return storedRequestFromAuthcode, storedSessionFromAuthcode
 }
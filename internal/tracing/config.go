@@ -0,0 +1,60 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package tracing
+
+import (
+	"net"
+	"strconv"
+
+	"go.pinniped.dev/internal/constable"
+)
+
+const (
+	maxSamplingRatePerMillion = 1000000
+
+	errInvalidEndpoint     = constable.Error("endpoint must be a host and a port, e.g. otel-collector.observability.svc:4317")
+	errInvalidSamplingRate = constable.Error("samplingRatePerMillion must be between 0 and 1000000")
+	errInsecureWithCA      = constable.Error("caBundleFile must not be set when insecure is true")
+)
+
+// Config configures the export of the traces to an OpenTelemetry collector. It is part of the static configuration of
+// the Supervisor.
+type Config struct {
+	// Endpoint is the host and the port of the OTLP gRPC receiver of the collector.
+	Endpoint string `json:"endpoint"`
+	// Insecure sends the spans to the collector without TLS, e.g. to a collector which runs in the same pod.
+	Insecure bool `json:"insecure,omitempty"`
+	// CABundleFile is the path to a file which contains the PEM-encoded CA bundle which is used to verify the
+	// certificate of the collector. When it is not set, the CA bundle of the host is used.
+	CABundleFile string `json:"caBundleFile,omitempty"`
+	// SamplingRatePerMillion is the number of requests which are traced out of every million. The sampling decision
+	// of the client of a request is ignored, since the endpoints of the Supervisor are public. Defaults to 0, which
+	// does not trace any request.
+	SamplingRatePerMillion *int32 `json:"samplingRatePerMillion,omitempty"`
+}
+
+// Validate returns an error when the config is invalid.
+func (c *Config) Validate() error {
+	_, port, err := net.SplitHostPort(c.Endpoint)
+	if err != nil {
+		return errInvalidEndpoint
+	}
+	if portNumber, err := strconv.ParseUint(port, 10, 16); err != nil || portNumber == 0 {
+		return errInvalidEndpoint
+	}
+	if c.Insecure && c.CABundleFile != "" {
+		return errInsecureWithCA
+	}
+	if rate := c.SamplingRatePerMillion; rate != nil && (*rate < 0 || *rate > maxSamplingRatePerMillion) {
+		return errInvalidSamplingRate
+	}
+	return nil
+}
+
+func (c *Config) samplingRatio() float64 {
+	if c.SamplingRatePerMillion == nil {
+		return 0
+	}
+	return float64(*c.SamplingRatePerMillion) / maxSamplingRatePerMillion
+}
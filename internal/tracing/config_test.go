@@ -0,0 +1,83 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package tracing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	int32Ptr := func(i int32) *int32 { return &i }
+
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr string
+	}{
+		{
+			name:   "endpoint only",
+			config: Config{Endpoint: "otel-collector.observability.svc:4317"},
+		},
+		{
+			name:   "everything",
+			config: Config{Endpoint: "127.0.0.1:4317", CABundleFile: "/some/ca.pem", SamplingRatePerMillion: int32Ptr(1000000)},
+		},
+		{
+			name:   "insecure",
+			config: Config{Endpoint: "localhost:4317", Insecure: true, SamplingRatePerMillion: int32Ptr(0)},
+		},
+		{
+			name:    "no endpoint",
+			config:  Config{},
+			wantErr: "endpoint must be a host and a port, e.g. otel-collector.observability.svc:4317",
+		},
+		{
+			name:    "no port",
+			config:  Config{Endpoint: "otel-collector.observability.svc"},
+			wantErr: "endpoint must be a host and a port, e.g. otel-collector.observability.svc:4317",
+		},
+		{
+			name:    "invalid port",
+			config:  Config{Endpoint: "otel-collector.observability.svc:0"},
+			wantErr: "endpoint must be a host and a port, e.g. otel-collector.observability.svc:4317",
+		},
+		{
+			name:    "insecure with CA bundle",
+			config:  Config{Endpoint: "localhost:4317", Insecure: true, CABundleFile: "/some/ca.pem"},
+			wantErr: "caBundleFile must not be set when insecure is true",
+		},
+		{
+			name:    "negative sampling rate",
+			config:  Config{Endpoint: "localhost:4317", SamplingRatePerMillion: int32Ptr(-1)},
+			wantErr: "samplingRatePerMillion must be between 0 and 1000000",
+		},
+		{
+			name:    "sampling rate too high",
+			config:  Config{Endpoint: "localhost:4317", SamplingRatePerMillion: int32Ptr(1000001)},
+			wantErr: "samplingRatePerMillion must be between 0 and 1000000",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := tt.config.Validate()
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestSamplingRatio(t *testing.T) {
+	require.Equal(t, float64(0), (&Config{}).samplingRatio())
+
+	rate := int32(250000)
+	require.Equal(t, 0.25, (&Config{SamplingRatePerMillion: &rate}).samplingRatio())
+}
@@ -0,0 +1,173 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package tracing traces the login flows of the Supervisor with OpenTelemetry, and exports the spans over OTLP to
+// a collector.
+//
+// The spans are started from the global tracer provider of OpenTelemetry, which does not record anything until
+// ConfigureGlobally was called, so the instrumented code does not need to know whether tracing is enabled.
+package tracing
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpgrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/credentials"
+	"k8s.io/component-base/traces"
+
+	"go.pinniped.dev/internal/constable"
+	"go.pinniped.dev/internal/httputil/roundtripper"
+	"go.pinniped.dev/internal/plog"
+)
+
+const (
+	instrumentationName = "go.pinniped.dev"
+
+	// shutdownTimeout is how long the spans which were not exported yet may take to be flushed when the server stops.
+	shutdownTimeout = 5 * time.Second
+)
+
+// Attributes of the spans which are shared by the instrumented packages.
+const (
+	IdentityProviderNameKey = attribute.Key("pinniped.idp.name")
+	IdentityProviderTypeKey = attribute.Key("pinniped.idp.type")
+)
+
+// ConfigureGlobally creates a tracer provider which exports the spans to the collector of the config, and makes it the
+// global tracer provider. The service name identifies the server in the spans, e.g. "pinniped-supervisor". The
+// returned func flushes the spans which were not exported yet, when the server stops. Nothing is traced when the config
+// is nil.
+func ConfigureGlobally(ctx context.Context, serviceName string, config *Config) (func(), error) {
+	if config == nil {
+		return func() {}, nil
+	}
+
+	options := []otlpgrpc.Option{otlpgrpc.WithEndpoint(config.Endpoint)}
+	if config.Insecure {
+		options = append(options, otlpgrpc.WithInsecure())
+	} else {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if config.CABundleFile != "" {
+			caBundle, err := ioutil.ReadFile(config.CABundleFile)
+			if err != nil {
+				return nil, fmt.Errorf("could not read tracing collector CA bundle: %w", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(caBundle) {
+				return nil, constable.Error("tracing collector CA bundle does not contain any certificate")
+			}
+		}
+		options = append(options, otlpgrpc.WithTLSCredentials(credentials.NewTLS(tlsConfig)))
+	}
+
+	// The exporter connects to the collector in the background, so a collector which is not reachable yet does not
+	// prevent the server from starting.
+	exporter, err := otlp.NewExporter(ctx, otlpgrpc.NewDriver(options...))
+	if err != nil {
+		return nil, fmt.Errorf("could not create tracing exporter: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.samplingRatio()))),
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.ServiceNameKey.String(serviceName))),
+	)
+	restore := SetGlobalTracerProvider(provider)
+	return func() {
+		restore()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := provider.Shutdown(shutdownCtx); err != nil {
+			plog.WarningErr("could not flush the spans", err)
+		}
+	}, nil
+}
+
+// SetGlobalTracerProvider makes the provider the global tracer provider, and sets the global propagators which are
+// used by the Kubernetes libraries. The returned func stops tracing. It is also meant for the tests, which record the
+// spans using an in-memory exporter.
+func SetGlobalTracerProvider(provider trace.TracerProvider) func() {
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(traces.Propagators())
+	return func() {
+		// The default global tracer provider cannot be restored, since it delegates to the first tracer provider which
+		// was set, forever.
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	}
+}
+
+// Start starts a span which is a child of the span of the context, if any. The span must be ended by End.
+func Start(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	// The tracer is looked up each time, because the global tracer provider may change after this package is loaded.
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// End ends the span. When err is not nil, it is recorded on the span, whose status becomes an error.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// SetIdentityProvider adds the name and the type of the upstream identity provider of a request to the span of the
+// context, once the handler of the request knows which one it uses.
+func SetIdentityProvider(ctx context.Context, name, idpType string) {
+	trace.SpanFromContext(ctx).SetAttributes(IdentityProviderNameKey.String(name), IdentityProviderTypeKey.String(idpType))
+}
+
+// InstrumentHandler starts a server span for each request to the handler. The name is the name of the spans, e.g.
+// the path of an endpoint.
+//
+// The endpoints are public, so the trace of the client is not continued when the request has a traceparent header.
+// The span always starts a new trace, which is sampled by the sampler of the tracer provider. Otherwise, any
+// unauthenticated client could make the Supervisor trace its requests.
+// The query of the request is not recorded either, since it contains e.g. authorization codes and ID tokens.
+func InstrumentHandler(name string, handler http.Handler) http.Handler {
+	instrumented := otelhttp.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Serve the original request, with the span in its context and the body which records the bytes read.
+		original := r.Context().Value(originalRequestKey{}).(*http.Request).WithContext(r.Context())
+		original.Body = r.Body
+		handler.ServeHTTP(w, original)
+	}), name,
+		otelhttp.WithTracerProvider(otel.GetTracerProvider()),
+		// otelhttp.WithPublicEndpoint would still let the sampler see the span context of the client, so the
+		// trace context of the request is not extracted at all.
+		otelhttp.WithPropagators(propagation.NewCompositeTextMapPropagator()),
+	)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// otelhttp records the request URI as the http.target attribute of the span.
+		withoutQuery := r.WithContext(context.WithValue(r.Context(), originalRequestKey{}, r))
+		withoutQuery.RequestURI = r.URL.EscapedPath()
+		instrumented.ServeHTTP(w, withoutQuery)
+	})
+}
+
+type originalRequestKey struct{}
+
+// WrapTransport starts a client span for each request of the round tripper, and propagates the trace in the headers
+// of the request, so that the spans of an upstream identity provider which supports OpenTelemetry are correlated.
+// The original round tripper can still be unwrapped, e.g. to find its TLS config.
+func WrapTransport(rt http.RoundTripper) http.RoundTripper {
+	return roundtripper.WrapFunc(rt, otelhttp.NewTransport(rt,
+		otelhttp.WithTracerProvider(otel.GetTracerProvider()),
+		otelhttp.WithPropagators(traces.Propagators()),
+	).RoundTrip)
+}
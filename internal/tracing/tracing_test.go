@@ -0,0 +1,170 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/util/net"
+)
+
+// The tests of this file change the global tracer provider, so they must not run in parallel.
+
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+
+	exporter := tracetest.NewInMemoryExporter()
+	t.Cleanup(SetGlobalTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))))
+	return exporter
+}
+
+func TestStartAndEnd(t *testing.T) {
+	exporter := recordSpans(t)
+
+	ctx, parent := Start(context.Background(), "parent", IdentityProviderNameKey.String("some-idp"))
+	SetIdentityProvider(ctx, "other-idp", "ldap")
+	_, child := Start(ctx, "child")
+	End(child, errors.New("some error"))
+	End(parent, nil)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+
+	require.Equal(t, "child", spans[0].Name)
+	require.Equal(t, parent.SpanContext().SpanID(), spans[0].Parent.SpanID())
+	require.Equal(t, codes.Error, spans[0].StatusCode)
+	require.Equal(t, "some error", spans[0].StatusMessage)
+	require.Len(t, spans[0].MessageEvents, 1)
+
+	require.Equal(t, "parent", spans[1].Name)
+	require.False(t, spans[1].Parent.IsValid())
+	require.Equal(t, codes.Unset, spans[1].StatusCode)
+	require.ElementsMatch(t, spans[1].Attributes, []attribute.KeyValue{
+		IdentityProviderNameKey.String("other-idp"),
+		IdentityProviderTypeKey.String("ldap"),
+	})
+}
+
+func TestInstrumentHandlerAndWrapTransport(t *testing.T) {
+	exporter := recordSpans(t)
+
+	var serverSpan trace.SpanContext
+	var serverRequestURI string
+	server := httptest.NewServer(InstrumentHandler("/some/endpoint", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverSpan = trace.SpanContextFromContext(r.Context())
+		serverRequestURI = r.RequestURI
+		w.WriteHeader(http.StatusNoContent)
+	})))
+	defer server.Close()
+
+	transport := WrapTransport(http.DefaultTransport)
+	require.Same(t, http.DefaultTransport, transport.(net.RoundTripperWrapper).WrappedRoundTripper())
+
+	ctx, parent := Start(context.Background(), "parent")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/some/endpoint?code=some-code&state=some-state", nil)
+	require.NoError(t, err)
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	End(parent, nil)
+
+	// The handler still gets the query of the request.
+	require.Equal(t, "/some/endpoint?code=some-code&state=some-state", serverRequestURI)
+
+	// The trace of the client is not continued by the server, which starts a new trace instead.
+	require.True(t, serverSpan.IsValid())
+	require.NotEqual(t, parent.SpanContext().TraceID(), serverSpan.TraceID())
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 3)
+	var serverSpanSnapshot *sdktrace.SpanSnapshot
+	for _, span := range spans {
+		if span.Name == "/some/endpoint" {
+			serverSpanSnapshot = span
+			continue
+		}
+		require.Equal(t, parent.SpanContext().TraceID(), span.SpanContext.TraceID())
+	}
+	require.NotNil(t, serverSpanSnapshot)
+	require.Equal(t, serverSpan.TraceID(), serverSpanSnapshot.SpanContext.TraceID())
+	require.False(t, serverSpanSnapshot.Parent.IsValid())
+
+	// The query, which contains e.g. authorization codes, is not recorded.
+	require.Contains(t, serverSpanSnapshot.Attributes, semconv.HTTPTargetKey.String("/some/endpoint"))
+	for _, attr := range serverSpanSnapshot.Attributes {
+		require.NotContains(t, attr.Value.Emit(), "some-code")
+	}
+}
+
+func TestInstrumentHandlerIgnoresSamplingDecisionOfClient(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	t.Cleanup(SetGlobalTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.NeverSample())),
+		sdktrace.WithSyncer(exporter),
+	)))
+
+	var serverSpan trace.SpanContext
+	server := httptest.NewServer(InstrumentHandler("/some/endpoint", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverSpan = trace.SpanContextFromContext(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	})))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	require.True(t, serverSpan.IsValid())
+	require.False(t, serverSpan.IsSampled())
+	require.Empty(t, exporter.GetSpans())
+}
+
+func TestNothingIsRecordedWithoutProvider(t *testing.T) {
+	exporter := recordSpans(t)
+	SetGlobalTracerProvider(trace.NewNoopTracerProvider())()
+
+	_, span := Start(context.Background(), "some-span")
+	require.False(t, span.IsRecording())
+	End(span, nil)
+
+	require.Empty(t, exporter.GetSpans())
+}
+
+func TestConfigureGlobally(t *testing.T) {
+	flush, err := ConfigureGlobally(context.Background(), "some-service", nil)
+	require.NoError(t, err)
+	flush()
+
+	_, err = ConfigureGlobally(context.Background(), "some-service", &Config{
+		Endpoint:     "localhost:4317",
+		CABundleFile: filepath.Join(t.TempDir(), "does-not-exist.pem"),
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "could not read tracing collector CA bundle: ")
+
+	// The collector does not need to be reachable. New traces are not sampled by default.
+	flush, err = ConfigureGlobally(context.Background(), "some-service", &Config{Endpoint: "127.0.0.1:1", Insecure: true})
+	require.NoError(t, err)
+	_, span := Start(context.Background(), "some-span")
+	require.False(t, span.IsRecording())
+	End(span, nil)
+	flush()
+}
@@ -0,0 +1,259 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// unhealthyHostBackoff is how long a host which could not be dialed is only used after the healthy hosts.
+	unhealthyHostBackoff = time.Minute
+
+	// srvLookupCacheDuration is how long the hosts which were discovered using DNS SRV records are cached.
+	srvLookupCacheDuration = 5 * time.Minute
+
+	srvService  = "ldap"
+	srvProtocol = "tcp"
+)
+
+// LoadBalancing determines how the connections to an LDAP IDP with multiple hosts are spread across its hosts.
+type LoadBalancing string
+
+const (
+	// Failover always uses the first healthy host, in order.
+	Failover = LoadBalancing("Failover")
+
+	// RoundRobin uses each healthy host in turn.
+	RoundRobin = LoadBalancing("RoundRobin")
+)
+
+// SRVResolver looks up DNS SRV records. It is implemented by net.Resolver.
+type SRVResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+var _ SRVResolver = &net.Resolver{}
+
+// HostError is the error of one of the hosts of an LDAP IDP.
+type HostError struct {
+	Host string
+	Err  error
+}
+
+// HostsError is returned by TestConnection and HostsHealth when some of the hosts of an LDAP IDP could not be
+// validated.
+type HostsError struct {
+	// Errors are the errors of the hosts which could not be validated, in the order of the hosts. The host of the
+	// error of a DNS SRV lookup is the name of the SRV records, e.g. "_ldap._tcp.example.com".
+	Errors []HostError
+
+	// Validated are the hosts which were validated successfully, in order.
+	Validated []string
+}
+
+func (e *HostsError) Error() string {
+	if len(e.Errors) == 1 && len(e.Validated) == 0 {
+		// There is only one host, which already appears in its error.
+		return e.Errors[0].Err.Error()
+	}
+	messages := make([]string, 0, len(e.Errors))
+	for _, hostErr := range e.Errors {
+		messages = append(messages, fmt.Sprintf("%s: %s", hostErr.Host, hostErr.Err.Error()))
+	}
+	return strings.Join(messages, "; ")
+}
+
+// HostPools holds the hostPool of each LDAP IDP, by the resource UID of the IDP. It may be shared by many providers,
+// and it outlives them, since the providers are recreated whenever their configuration is validated again, so that
+// the health of the hosts, the position of the round-robin, and the hosts which were discovered using DNS SRV records
+// are kept when a provider is recreated. It is safe for concurrent use.
+type HostPools struct {
+	mu    sync.Mutex
+	pools map[types.UID]*hostPool
+}
+
+func NewHostPools() *HostPools {
+	return &HostPools{pools: map[types.UID]*hostPool{}}
+}
+
+// get returns the hostPool of the IDP with the resource UID. When the HostPools is nil, a new hostPool is returned,
+// which is only used by one provider.
+func (h *HostPools) get(resourceUID types.UID) *hostPool {
+	if h == nil {
+		return newHostPool()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	pool, ok := h.pools[resourceUID]
+	if !ok {
+		pool = newHostPool()
+		h.pools[resourceUID] = pool
+	}
+	return pool
+}
+
+// hostPool keeps track of the health of the hosts of an LDAP IDP, and of the hosts which were discovered using DNS SRV
+// records, so that a host which cannot be reached is not dialed again before the other hosts for a while.
+type hostPool struct {
+	clock func() time.Time
+
+	mu             sync.Mutex
+	unhealthyUntil map[string]time.Time
+	dialErrors     map[string]error // the error of the most recent dial of each host, when it failed
+	next           int
+
+	srvDomain     string
+	srvTargets    []*net.SRV
+	srvLookupTime time.Time
+}
+
+func newHostPool() *hostPool {
+	return &hostPool{clock: time.Now, unhealthyUntil: map[string]time.Time{}, dialErrors: map[string]error{}}
+}
+
+// Hosts returns all hosts of the provider: Host, then the AdditionalHosts, then the hosts which were discovered using
+// the DNS SRV records of SRVDomain, if any. When the DNS SRV records cannot be looked up, the other hosts are returned
+// with the error.
+func (p *Provider) Hosts(ctx context.Context) ([]string, error) {
+	hosts := make([]string, 0, 1+len(p.c.AdditionalHosts))
+	seen := map[string]bool{}
+	add := func(host string) {
+		if !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+
+	add(p.c.Host)
+	for _, host := range p.c.AdditionalHosts {
+		add(host)
+	}
+	if p.c.SRVDomain == "" {
+		return hosts, nil
+	}
+
+	targets, err := p.lookupSRV(ctx)
+	if err != nil {
+		return hosts, err
+	}
+	for _, target := range targets {
+		host := strings.TrimSuffix(target.Target, ".")
+		// The port of the records is the port of plain LDAP, which is only used with StartTLS.
+		if p.c.ConnectionProtocol == StartTLS {
+			host = net.JoinHostPort(host, strconv.Itoa(int(target.Port)))
+		}
+		add(host)
+	}
+	return hosts, nil
+}
+
+// HostsHealth returns all hosts of the provider, like Hosts, with a *HostsError when the most recent dial of some of
+// them failed, as recorded by every provider of the same IDP. Unlike TestConnection, it does not connect to any host.
+func (p *Provider) HostsHealth(ctx context.Context) ([]string, error) {
+	hostsErr := &HostsError{}
+	hosts, err := p.Hosts(ctx)
+	if err != nil {
+		hostsErr.Errors = append(hostsErr.Errors, HostError{Host: p.srvName(), Err: err})
+	}
+
+	for _, host := range hosts {
+		if dialErr := p.hosts.dialError(host); dialErr != nil {
+			hostsErr.Errors = append(hostsErr.Errors, HostError{Host: host, Err: dialErr})
+			continue
+		}
+		hostsErr.Validated = append(hostsErr.Validated, host)
+	}
+
+	if len(hostsErr.Errors) > 0 {
+		return hosts, hostsErr
+	}
+	return hosts, nil
+}
+
+func (p *Provider) lookupSRV(ctx context.Context) ([]*net.SRV, error) {
+	pool := p.hosts
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	now := pool.clock()
+	// The cached hosts are not used after the SRVDomain of the IDP was changed.
+	if pool.srvTargets != nil && pool.srvDomain == p.c.SRVDomain && now.Sub(pool.srvLookupTime) < srvLookupCacheDuration {
+		return pool.srvTargets, nil
+	}
+
+	resolver := p.c.SRVResolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	// The records are sorted by priority, and randomized by weight.
+	_, targets, err := resolver.LookupSRV(ctx, srvService, srvProtocol, p.c.SRVDomain)
+	if err != nil {
+		return nil, fmt.Errorf("error looking up DNS SRV records: %w", err)
+	}
+	pool.srvDomain = p.c.SRVDomain
+	pool.srvTargets = targets
+	pool.srvLookupTime = now
+	return targets, nil
+}
+
+// srvName returns the name of the DNS SRV records of the provider, e.g. "_ldap._tcp.example.com".
+func (p *Provider) srvName() string {
+	return fmt.Sprintf("_%s._%s.%s", srvService, srvProtocol, p.c.SRVDomain)
+}
+
+// order returns the hosts in the order in which they should be dialed. The healthy hosts come first, starting with the
+// next host when round-robin is used, followed by the hosts which could not be dialed recently.
+func (pool *hostPool) order(hosts []string, loadBalancing LoadBalancing) []string {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	start := 0
+	if loadBalancing == RoundRobin {
+		start = pool.next % len(hosts)
+		pool.next = start + 1
+	}
+
+	now := pool.clock()
+	healthy := make([]string, 0, len(hosts))
+	var unhealthy []string
+	for i := range hosts {
+		host := hosts[(start+i)%len(hosts)]
+		if now.Before(pool.unhealthyUntil[host]) {
+			unhealthy = append(unhealthy, host)
+			continue
+		}
+		healthy = append(healthy, host)
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (pool *hostPool) markHealthy(host string) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	delete(pool.unhealthyUntil, host)
+	delete(pool.dialErrors, host)
+}
+
+func (pool *hostPool) markUnhealthy(host string, err error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.unhealthyUntil[host] = pool.clock().Add(unhealthyHostBackoff)
+	pool.dialErrors[host] = err
+}
+
+func (pool *hostPool) dialError(host string) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return pool.dialErrors[host]
+}
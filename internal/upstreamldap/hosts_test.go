@@ -0,0 +1,316 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/types"
+
+	"go.pinniped.dev/internal/endpointaddr"
+	"go.pinniped.dev/internal/mocks/mockldapconn"
+)
+
+const (
+	testHost2 = "ldap2.example.com:8443"
+	testHost3 = "ldap3.example.com:8443"
+)
+
+type fakeSRVResolver struct {
+	targets []*net.SRV
+	err     error
+	lookups []string
+}
+
+func (r *fakeSRVResolver) LookupSRV(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.lookups = append(r.lookups, "_"+service+"._"+proto+"."+name)
+	return "", r.targets, r.err
+}
+
+// newTestHostsProvider returns a provider whose dialer records the dialed hosts, and fails to dial the unreachable
+// hosts. The bind of the hosts whose bind fails returns an error.
+func newTestHostsProvider(t *testing.T, config ProviderConfig, unreachable, bindFails map[string]bool) (*Provider, *[]string, *time.Time) {
+	t.Helper()
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	var dialed []string
+	var dialedMu sync.Mutex
+	config.Dialer = LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+		dialedMu.Lock()
+		dialed = append(dialed, addr.Endpoint())
+		dialedMu.Unlock()
+		if unreachable[addr.Endpoint()] {
+			return nil, ldap.NewError(ldap.ErrorNetwork, errors.New("some dial error"))
+		}
+		conn := mockldapconn.NewMockConn(ctrl)
+		if bindFails[addr.Endpoint()] {
+			conn.EXPECT().Bind(testBindUsername, testBindPassword).Return(errors.New("some bind error")).AnyTimes()
+		} else {
+			conn.EXPECT().Bind(testBindUsername, testBindPassword).AnyTimes()
+		}
+		conn.EXPECT().Close().AnyTimes()
+		return conn, nil
+	})
+	config.ConnectionProtocol = TLS
+	config.BindUsername = testBindUsername
+	config.BindPassword = testBindPassword
+
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := New(config)
+	p.hosts.clock = func() time.Time { return now }
+	return p, &dialed, &now
+}
+
+func TestDialFailover(t *testing.T) {
+	p, dialed, now := newTestHostsProvider(t,
+		ProviderConfig{Host: testHost, AdditionalHosts: []string{testHost2, testHost3}},
+		map[string]bool{testHost: true}, nil,
+	)
+
+	dialAndClose := func() {
+		t.Helper()
+		conn, err := p.dial(context.Background())
+		require.NoError(t, err)
+		conn.Close()
+	}
+
+	// The first host cannot be reached, so the next one is used.
+	dialAndClose()
+	require.Equal(t, []string{testHost, testHost2}, *dialed)
+
+	// The first host is not dialed again for a while.
+	*dialed = nil
+	dialAndClose()
+	require.Equal(t, []string{testHost2}, *dialed)
+
+	// Then it is dialed first again.
+	*now = now.Add(unhealthyHostBackoff)
+	*dialed = nil
+	dialAndClose()
+	require.Equal(t, []string{testHost, testHost2}, *dialed)
+}
+
+func TestDialRoundRobin(t *testing.T) {
+	p, dialed, _ := newTestHostsProvider(t,
+		ProviderConfig{Host: testHost, AdditionalHosts: []string{testHost2, testHost3}, LoadBalancing: RoundRobin},
+		map[string]bool{testHost2: true}, nil,
+	)
+
+	for i := 0; i < 4; i++ {
+		conn, err := p.dial(context.Background())
+		require.NoError(t, err)
+		conn.Close()
+	}
+
+	// The unreachable host is skipped once it failed.
+	require.Equal(t, []string{testHost, testHost2, testHost3, testHost3, testHost}, *dialed)
+}
+
+func TestDialWhenNoHostCanBeReached(t *testing.T) {
+	p, dialed, _ := newTestHostsProvider(t,
+		ProviderConfig{Host: testHost, AdditionalHosts: []string{testHost2}},
+		map[string]bool{testHost: true, testHost2: true}, nil,
+	)
+
+	conn, err := p.dial(context.Background())
+	require.Nil(t, conn)
+	require.EqualError(t, err, `could not dial any of the 2 hosts, last error: error dialing host "ldap2.example.com:8443": LDAP Result Code 200 "Network Error": some dial error`)
+	require.Equal(t, []string{testHost, testHost2}, *dialed)
+
+	// The unhealthy hosts are still dialed when there is no healthy host.
+	*dialed = nil
+	_, err = p.dial(context.Background())
+	require.Error(t, err)
+	require.Equal(t, []string{testHost, testHost2}, *dialed)
+}
+
+func TestHosts(t *testing.T) {
+	resolver := &fakeSRVResolver{targets: []*net.SRV{
+		{Target: "dc1.example.com.", Port: 389},
+		{Target: "ldap2.example.com.", Port: 8443},
+		{Target: "dc3.example.com.", Port: 3268},
+	}}
+	p, _, now := newTestHostsProvider(t, ProviderConfig{
+		Host:            testHost,
+		AdditionalHosts: []string{testHost2, testHost},
+		SRVDomain:       "example.com",
+		SRVResolver:     resolver,
+	}, nil, nil)
+
+	// The port of the records is only used with StartTLS.
+	hosts, err := p.Hosts(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{testHost, testHost2, "dc1.example.com", "ldap2.example.com", "dc3.example.com"}, hosts)
+
+	p.c.ConnectionProtocol = StartTLS
+	hosts, err = p.Hosts(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{testHost, testHost2, "dc1.example.com:389", "dc3.example.com:3268"}, hosts)
+
+	// The records are cached for a while.
+	require.Equal(t, []string{"_ldap._tcp.example.com"}, resolver.lookups)
+	*now = now.Add(srvLookupCacheDuration)
+	resolver.err = errors.New("some lookup error")
+	hosts, err = p.Hosts(context.Background())
+	require.EqualError(t, err, "error looking up DNS SRV records: some lookup error")
+	require.Equal(t, []string{testHost, testHost2}, hosts)
+	require.Len(t, resolver.lookups, 2)
+}
+
+func TestTestConnectionWithMultipleHosts(t *testing.T) {
+	p, dialed, _ := newTestHostsProvider(t, ProviderConfig{
+		Host:            testHost,
+		AdditionalHosts: []string{testHost2, testHost3},
+		SRVDomain:       "example.com",
+		SRVResolver:     &fakeSRVResolver{err: errors.New("some lookup error")},
+	}, map[string]bool{testHost2: true}, map[string]bool{testHost3: true})
+
+	err := p.TestConnection(context.Background())
+
+	// Every host is validated, concurrently.
+	require.ElementsMatch(t, []string{testHost, testHost2, testHost3}, *dialed)
+	hostsErr := &HostsError{}
+	require.ErrorAs(t, err, &hostsErr)
+	require.Equal(t, []string{testHost}, hostsErr.Validated)
+	require.Len(t, hostsErr.Errors, 3)
+	require.EqualError(t, err, `_ldap._tcp.example.com: error looking up DNS SRV records: some lookup error; `+
+		`ldap2.example.com:8443: error dialing host "ldap2.example.com:8443": LDAP Result Code 200 "Network Error": some dial error; `+
+		`ldap3.example.com:8443: error binding as "cn=some-bind-username,dc=pinniped,dc=dev": some bind error`)
+
+	// The host which could not be dialed is then dialed last.
+	*dialed = nil
+	conn, err := p.dial(context.Background())
+	require.NoError(t, err)
+	conn.Close()
+	require.Equal(t, []string{testHost}, *dialed)
+
+	p.c.AdditionalHosts = nil
+	p.c.SRVDomain = ""
+	require.NoError(t, p.TestConnection(context.Background()))
+}
+
+func TestTestConnectionTestsHostsConcurrently(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	// The first host only answers once the second host was dialed, which never happens when the hosts are tested
+	// one after the other.
+	secondHostDialed := make(chan struct{})
+	p := New(ProviderConfig{
+		Host:               testHost,
+		AdditionalHosts:    []string{testHost2},
+		ConnectionProtocol: TLS,
+		BindUsername:       testBindUsername,
+		BindPassword:       testBindPassword,
+		Dialer: LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+			if addr.Endpoint() == testHost2 {
+				close(secondHostDialed)
+			} else {
+				select {
+				case <-secondHostDialed:
+				case <-ctx.Done():
+					return nil, ldap.NewError(ldap.ErrorNetwork, ctx.Err())
+				}
+			}
+			conn := mockldapconn.NewMockConn(ctrl)
+			conn.EXPECT().Bind(testBindUsername, testBindPassword)
+			conn.EXPECT().Close()
+			return conn, nil
+		}),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, p.TestConnection(ctx))
+}
+
+func TestHostsHealth(t *testing.T) {
+	unreachable := map[string]bool{testHost: true}
+	p, dialed, _ := newTestHostsProvider(t,
+		ProviderConfig{Host: testHost, AdditionalHosts: []string{testHost2, testHost3}},
+		unreachable, nil,
+	)
+
+	// No host was dialed yet, so all of them are assumed to be healthy.
+	hosts, err := p.HostsHealth(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{testHost, testHost2, testHost3}, hosts)
+
+	conn, err := p.dial(context.Background())
+	require.NoError(t, err)
+	conn.Close()
+	*dialed = nil
+
+	// The error of the host which could not be dialed is reported, without dialing any host.
+	hosts, err = p.HostsHealth(context.Background())
+	require.Equal(t, []string{testHost, testHost2, testHost3}, hosts)
+	hostsErr := &HostsError{}
+	require.True(t, errors.As(err, &hostsErr))
+	require.Equal(t, []string{testHost2, testHost3}, hostsErr.Validated)
+	require.EqualError(t, err, `ldap.example.com:8443: error dialing host "ldap.example.com:8443": LDAP Result Code 200 "Network Error": some dial error`)
+	require.Empty(t, *dialed)
+
+	// Once the host can be dialed again, it is healthy again.
+	delete(unreachable, testHost)
+	require.NoError(t, p.TestConnection(context.Background()))
+	_, err = p.HostsHealth(context.Background())
+	require.NoError(t, err)
+}
+
+func TestHostPoolsAreSharedByTheProvidersOfAnIDP(t *testing.T) {
+	hostPools := NewHostPools()
+	resolver := &fakeSRVResolver{targets: []*net.SRV{{Target: "dc1.example.com.", Port: 389}}}
+	config := ProviderConfig{
+		ResourceUID:     "some-resource-uid",
+		Host:            testHost,
+		AdditionalHosts: []string{testHost2},
+		SRVDomain:       "example.com",
+		SRVResolver:     resolver,
+		HostPools:       hostPools,
+	}
+
+	p, _, _ := newTestHostsProvider(t, config, map[string]bool{testHost: true}, nil)
+	_, err := p.Hosts(context.Background())
+	require.NoError(t, err)
+	conn, err := p.dial(context.Background())
+	require.NoError(t, err)
+	conn.Close()
+
+	// A provider which is recreated for the same IDP knows which hosts could not be dialed,
+	// and which hosts were discovered using the DNS SRV records.
+	recreated, dialed, _ := newTestHostsProvider(t, config, map[string]bool{testHost: true}, nil)
+	conn, err = recreated.dial(context.Background())
+	require.NoError(t, err)
+	conn.Close()
+	require.Equal(t, []string{testHost2}, *dialed)
+	hosts, err := recreated.Hosts(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{testHost, testHost2, "dc1.example.com"}, hosts)
+	require.Equal(t, []string{"_ldap._tcp.example.com"}, resolver.lookups)
+
+	// The DNS SRV records are looked up again after the SRVDomain was changed.
+	config.SRVDomain = "other.example.com"
+	changed, _, _ := newTestHostsProvider(t, config, nil, nil)
+	_, err = changed.Hosts(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{"_ldap._tcp.example.com", "_ldap._tcp.other.example.com"}, resolver.lookups)
+
+	// The providers of other IDPs have their own hosts.
+	config.ResourceUID = types.UID("other-resource-uid")
+	other, dialed, _ := newTestHostsProvider(t, config, nil, nil)
+	conn, err = other.dial(context.Background())
+	require.NoError(t, err)
+	conn.Close()
+	require.Equal(t, []string{testHost}, *dialed)
+}
@@ -0,0 +1,91 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// nestedGroupsCacheDuration is how long the groups of which a group is a member are cached.
+	nestedGroupsCacheDuration = 5 * time.Minute
+
+	// nestedGroupsCacheMaxEntries bounds the memory used by a NestedGroupsCache.
+	nestedGroupsCacheMaxEntries = 10000
+)
+
+// ldapGroup is a group which was found by a group search.
+type ldapGroup struct {
+	dn   string
+	name string
+}
+
+// NestedGroupsCache caches the groups of which each group is a member, which were found by the searches for nested
+// groups, so that they are not searched again during each login and refresh of the users who belong to these groups.
+// It may be shared by many providers, and it outlives them, since the providers are recreated whenever their
+// configuration is validated again. It is safe for concurrent use.
+type NestedGroupsCache struct {
+	clock func() time.Time
+
+	mu      sync.Mutex
+	entries map[nestedGroupsCacheKey]nestedGroupsCacheEntry
+}
+
+// nestedGroupsCacheKey identifies the search for the groups of a group. The settings of the group search are part of
+// the key, so that the groups which were found using the previous settings are not used after the settings change.
+type nestedGroupsCacheKey struct {
+	resourceUID        types.UID
+	base               string
+	filter             string
+	groupNameAttribute string
+	groupDN            string
+}
+
+type nestedGroupsCacheEntry struct {
+	groups  []ldapGroup
+	expires time.Time
+}
+
+func NewNestedGroupsCache() *NestedGroupsCache {
+	return &NestedGroupsCache{clock: time.Now, entries: map[nestedGroupsCacheKey]nestedGroupsCacheEntry{}}
+}
+
+func (c *NestedGroupsCache) get(key nestedGroupsCacheKey) ([]ldapGroup, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || !c.clock().Before(entry.expires) {
+		return nil, false
+	}
+	return entry.groups, true
+}
+
+func (c *NestedGroupsCache) put(key nestedGroupsCacheKey, groups []ldapGroup) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock()
+	if len(c.entries) >= nestedGroupsCacheMaxEntries {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= nestedGroupsCacheMaxEntries {
+			// Still full, so do not cache these groups. They will be searched again next time.
+			return
+		}
+	}
+	c.entries[key] = nestedGroupsCacheEntry{groups: groups, expires: now.Add(nestedGroupsCacheDuration)}
+}
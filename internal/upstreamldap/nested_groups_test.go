@@ -0,0 +1,177 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/mocks/mockldapconn"
+)
+
+// newNestedGroupsConn returns a conn whose group searches find the groups of which each member is a direct member,
+// according to memberOf, and which records the DNs of the members whose groups were searched.
+func newNestedGroupsConn(t *testing.T, memberOf map[string][]string, failFor string) (Conn, *[]string) {
+	t.Helper()
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	var searched []string
+	conn := mockldapconn.NewMockConn(ctrl)
+	conn.EXPECT().SearchWithPaging(gomock.Any(), expectedGroupSearchPageSize).AnyTimes().
+		DoAndReturn(func(request *ldap.SearchRequest, _ uint32) (*ldap.SearchResult, error) {
+			require.Equal(t, testGroupSearchBase, request.BaseDN)
+			memberDN := strings.TrimSuffix(strings.TrimPrefix(request.Filter, "(member="), ")")
+			searched = append(searched, memberDN)
+
+			if memberDN == failFor {
+				return nil, errors.New("some group search error")
+			}
+			result := &ldap.SearchResult{}
+			for _, groupDN := range memberOf[memberDN] {
+				result.Entries = append(result.Entries, &ldap.Entry{
+					DN:         groupDN,
+					Attributes: []*ldap.EntryAttribute{ldap.NewEntryAttribute("cn", []string{"name-of-" + groupDN})},
+				})
+			}
+			return result, nil
+		})
+	return conn, &searched
+}
+
+func TestSearchNestedGroups(t *testing.T) {
+	// The user is a member of group1 and group2, which are both members of group3. Group3 is a member of group4 and
+	// of group1, which makes a cycle. Group4 is a member of group5.
+	memberOf := map[string][]string{
+		testUserSearchResultDNValue: {"group1", "group2"},
+		"group1":                    {"group3"},
+		"group2":                    {"group3"},
+		"group3":                    {"group4", "group1"},
+		"group4":                    {"group5"},
+	}
+
+	tests := []struct {
+		name         string
+		maxDepth     int
+		failFor      string
+		wantGroups   []string
+		wantSearched []string
+		wantErr      string
+	}{
+		{
+			name:         "nested groups are not searched by default",
+			maxDepth:     0,
+			wantGroups:   []string{"name-of-group1", "name-of-group2"},
+			wantSearched: []string{testUserSearchResultDNValue},
+		},
+		{
+			name:         "one level of nested groups",
+			maxDepth:     1,
+			wantGroups:   []string{"name-of-group1", "name-of-group2", "name-of-group3"},
+			wantSearched: []string{testUserSearchResultDNValue, "group1", "group2"},
+		},
+		{
+			name:         "two levels of nested groups, where a cycle is not followed",
+			maxDepth:     2,
+			wantGroups:   []string{"name-of-group1", "name-of-group2", "name-of-group3", "name-of-group4"},
+			wantSearched: []string{testUserSearchResultDNValue, "group1", "group2", "group3"},
+		},
+		{
+			name:         "more levels than there are nested groups",
+			maxDepth:     10,
+			wantGroups:   []string{"name-of-group1", "name-of-group2", "name-of-group3", "name-of-group4", "name-of-group5"},
+			wantSearched: []string{testUserSearchResultDNValue, "group1", "group2", "group3", "group4", "group5"},
+		},
+		{
+			name:         "error searching for nested groups",
+			maxDepth:     10,
+			failFor:      "group3",
+			wantSearched: []string{testUserSearchResultDNValue, "group1", "group2", "group3"},
+			wantErr:      `error searching for group memberships for user with DN "some-upstream-user-dn": some group search error`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			conn, searched := newNestedGroupsConn(t, memberOf, tt.failFor)
+			p := New(ProviderConfig{
+				GroupSearch: GroupSearchConfig{
+					Base:                 testGroupSearchBase,
+					GroupNameAttribute:   "cn",
+					NestedGroupsMaxDepth: tt.maxDepth,
+				},
+			})
+
+			groups, err := p.searchGroupsForUserDN(conn, testUserSearchResultDNValue)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				require.Nil(t, groups)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tt.wantGroups, groups)
+			}
+			require.Equal(t, tt.wantSearched, *searched)
+		})
+	}
+}
+
+func TestNestedGroupsCache(t *testing.T) {
+	memberOf := map[string][]string{
+		testUserSearchResultDNValue: {"group1"},
+		"group1":                    {"group2"},
+		"other-user":                {"group1"},
+	}
+	conn, searched := newNestedGroupsConn(t, memberOf, "")
+
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := NewNestedGroupsCache()
+	cache.clock = func() time.Time { return now }
+	config := ProviderConfig{
+		ResourceUID: "some-resource-uid",
+		GroupSearch: GroupSearchConfig{
+			Base:                 testGroupSearchBase,
+			GroupNameAttribute:   "cn",
+			NestedGroupsMaxDepth: 5,
+		},
+		NestedGroupsCache: cache,
+	}
+
+	requireGroups := func(p *Provider, userDN string, wantSearched ...string) {
+		t.Helper()
+		*searched = nil
+		groups, err := p.searchGroupsForUserDN(conn, userDN)
+		require.NoError(t, err)
+		require.Equal(t, []string{"name-of-group1", "name-of-group2"}, groups)
+		require.Equal(t, wantSearched, *searched)
+	}
+
+	requireGroups(New(config), testUserSearchResultDNValue, testUserSearchResultDNValue, "group1", "group2")
+
+	// The direct groups of the users are always searched, but the groups of the groups are cached, even when the
+	// provider is recreated.
+	requireGroups(New(config), testUserSearchResultDNValue, testUserSearchResultDNValue)
+	requireGroups(New(config), "other-user", "other-user")
+
+	// The cache is not used by another provider, nor when the group search changes.
+	otherConfig := config
+	otherConfig.ResourceUID = "other-resource-uid"
+	requireGroups(New(otherConfig), testUserSearchResultDNValue, testUserSearchResultDNValue, "group1", "group2")
+	otherConfig = config
+	otherConfig.GroupSearch.Filter = "member={}"
+	requireGroups(New(otherConfig), testUserSearchResultDNValue, testUserSearchResultDNValue, "group1", "group2")
+
+	// The cached groups expire.
+	now = now.Add(nestedGroupsCacheDuration)
+	requireGroups(New(config), testUserSearchResultDNValue, testUserSearchResultDNValue, "group1", "group2")
+	requireGroups(New(config), testUserSearchResultDNValue, testUserSearchResultDNValue)
+}
@@ -15,9 +15,13 @@ import (
 	"net/url"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-ldap/ldap/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/semconv"
+	oteltrace "go.opentelemetry.io/otel/trace"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apiserver/pkg/authentication/user"
 	"k8s.io/utils/trace"
@@ -25,9 +29,11 @@ import (
 	"go.pinniped.dev/internal/authenticators"
 	"go.pinniped.dev/internal/crypto/ptls"
 	"go.pinniped.dev/internal/endpointaddr"
+	"go.pinniped.dev/internal/metrics"
 	"go.pinniped.dev/internal/oidc/downstreamsession"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/tracing"
 )
 
 const (
@@ -37,6 +43,9 @@ const (
 	groupSearchPageSize                     = uint32(250)
 	defaultLDAPPort                         = uint16(389)
 	defaultLDAPSPort                        = uint16(636)
+
+	ldapSearchBaseKey    = attribute.Key("pinniped.ldap.search.base")
+	ldapSearchEntriesKey = attribute.Key("pinniped.ldap.search.entries")
 )
 
 // Conn abstracts the upstream LDAP communication protocol (mostly for testing).
@@ -85,9 +94,21 @@ type ProviderConfig struct {
 	ResourceUID types.UID
 
 	// Host is the hostname or "hostname:port" of the LDAP server. When the port is not specified,
-	// the default LDAP port will be used.
+	// the default LDAP port will be used. It also identifies the provider in GetURL, even when another
+	// host is used.
 	Host string
 
+	// AdditionalHosts are the hostnames or "hostname:port" of other servers of the same directory, which
+	// are used after Host, in order, when it cannot be reached. Can be nil.
+	AdditionalHosts []string
+
+	// SRVDomain is the domain whose "_ldap._tcp" DNS SRV records are looked up to discover more servers
+	// of the same directory, which are used after the AdditionalHosts. Empty means to skip the lookup.
+	SRVDomain string
+
+	// LoadBalancing determines how the connections are spread across the hosts. Empty means Failover.
+	LoadBalancing LoadBalancing
+
 	// ConnectionProtocol determines how to establish the connection to the server. Either StartTLS or TLS.
 	ConnectionProtocol LDAPConnectionProtocol
 
@@ -109,6 +130,17 @@ type ProviderConfig struct {
 	// Dialer exists to enable testing. When nil, will use a default appropriate for production use.
 	Dialer LDAPDialer
 
+	// SRVResolver exists to enable testing. When nil, will use a default appropriate for production use.
+	SRVResolver SRVResolver
+
+	// NestedGroupsCache caches the groups of which each group is a member when NestedGroupsMaxDepth is set.
+	// Can be nil, in which case the nested groups are searched again during each login and refresh.
+	NestedGroupsCache *NestedGroupsCache
+
+	// HostPools keeps track of the health of the hosts across the providers which are created for this IDP.
+	// Can be nil, in which case the health of the hosts is only known to this provider.
+	HostPools *HostPools
+
 	// UIDAttributeParsingOverrides are mappings between an attribute name and a way to parse it as a UID when
 	// it comes out of LDAP.
 	UIDAttributeParsingOverrides map[string]func(*ldap.Entry) (string, error)
@@ -150,10 +182,20 @@ type GroupSearchConfig struct {
 	// GroupNameAttribute is the attribute in the LDAP group entry from which the group name should be
 	// retrieved. Empty means to use 'cn'.
 	GroupNameAttribute string
+
+	// SkipGroupRefresh means to keep the groups from the initial login when refreshing a session, instead of
+	// searching for the user's groups again.
+	SkipGroupRefresh bool
+
+	// NestedGroupsMaxDepth is the number of levels of nested groups to search above the groups of which the user is a
+	// direct member, using the same Base and Filter, with the DN of each group in place of the DN of the user.
+	// Zero means to only search for the groups of which the user is a direct member.
+	NestedGroupsMaxDepth int
 }
 
 type Provider struct {
-	c ProviderConfig
+	c     ProviderConfig
+	hosts *hostPool
 }
 
 var _ provider.UpstreamLDAPIdentityProviderI = &Provider{}
@@ -162,7 +204,7 @@ var _ authenticators.UserAuthenticator = &Provider{}
 // Create a Provider. The config is not a pointer to ensure that a copy of the config is created,
 // making the resulting Provider use an effectively read-only configuration.
 func New(config ProviderConfig) *Provider {
-	return &Provider{c: config}
+	return &Provider{c: config, hosts: config.HostPools.get(config.ResourceUID)}
 }
 
 // A reader for the config. Returns a copy of the config to keep the underlying config read-only.
@@ -170,87 +212,131 @@ func (p *Provider) GetConfig() ProviderConfig {
 	return p.c
 }
 
-func (p *Provider) PerformRefresh(ctx context.Context, storedRefreshAttributes provider.StoredRefreshAttributes) error {
+func (p *Provider) PerformRefresh(ctx context.Context, storedRefreshAttributes provider.StoredRefreshAttributes) (_ []string, err error) {
+	defer func(start time.Time) { p.observeRequest("refresh", start, metrics.ResultOf(err)) }(time.Now())
 	t := trace.FromContext(ctx).Nest("slow ldap refresh attempt", trace.Field{Key: "providerName", Value: p.GetName()})
 	defer t.LogIfLong(500 * time.Millisecond) // to help users debug slow LDAP searches
 	userDN := storedRefreshAttributes.DN
 
-	searchResult, err := p.performRefresh(ctx, userDN)
+	conn, err := p.dial(ctx)
 	if err != nil {
 		p.traceRefreshFailure(t, err)
-		return err
+		return nil, err
+	}
+	defer conn.Close()
+
+	err = conn.Bind(p.c.BindUsername, p.c.BindPassword)
+	if err != nil {
+		p.traceRefreshFailure(t, err)
+		return nil, fmt.Errorf(`error binding as %q before user search: %w`, p.c.BindUsername, err)
+	}
+
+	searchResult, err := conn.Search(p.refreshUserSearchRequest(userDN))
+	if err != nil {
+		p.traceRefreshFailure(t, err)
+		return nil, fmt.Errorf(`error searching for user %q: %w`, userDN, err)
 	}
 
 	// if any more or less than one entry, error.
 	// we don't need to worry about logging this because we know it's a dn.
 	if len(searchResult.Entries) != 1 {
-		return fmt.Errorf(`searching for user %q resulted in %d search results, but expected 1 result`,
+		return nil, fmt.Errorf(`searching for user %q resulted in %d search results, but expected 1 result`,
 			userDN, len(searchResult.Entries),
 		)
 	}
 
 	userEntry := searchResult.Entries[0]
 	if len(userEntry.DN) == 0 {
-		return fmt.Errorf(`searching for user with original DN %q resulted in search result without DN`, userDN)
+		return nil, fmt.Errorf(`searching for user with original DN %q resulted in search result without DN`, userDN)
 	}
 
 	newUsername, err := p.getSearchResultAttributeValue(p.c.UserSearch.UsernameAttribute, userEntry, userDN)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if newUsername != storedRefreshAttributes.Username {
-		return fmt.Errorf(`searching for user %q returned a different username than the previous value. expected: %q, actual: %q`,
+		return nil, fmt.Errorf(`searching for user %q returned a different username than the previous value. expected: %q, actual: %q`,
 			userDN, storedRefreshAttributes.Username, newUsername,
 		)
 	}
 
 	newUID, err := p.getSearchResultAttributeRawValueEncoded(p.c.UserSearch.UIDAttribute, userEntry, userDN)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	newSubject := downstreamsession.DownstreamLDAPSubject(newUID, *p.GetURL())
 	if newSubject != storedRefreshAttributes.Subject {
-		return fmt.Errorf(`searching for user %q produced a different subject than the previous value. expected: %q, actual: %q`, userDN, storedRefreshAttributes.Subject, newSubject)
+		return nil, fmt.Errorf(`searching for user %q produced a different subject than the previous value. expected: %q, actual: %q`, userDN, storedRefreshAttributes.Subject, newSubject)
 	}
 	for attribute, validateFunc := range p.c.RefreshAttributeChecks {
 		err = validateFunc(userEntry, storedRefreshAttributes)
 		if err != nil {
-			return fmt.Errorf(`validation for attribute %q failed during upstream refresh: %w`, attribute, err)
+			return nil, fmt.Errorf(`validation for attribute %q failed during upstream refresh: %w`, attribute, err)
 		}
 	}
-	// we checked that the user still exists and their information is the same, so just return.
-	return nil
-}
-
-func (p *Provider) performRefresh(ctx context.Context, userDN string) (*ldap.SearchResult, error) {
-	search := p.refreshUserSearchRequest(userDN)
 
-	conn, err := p.dial(ctx)
-	if err != nil {
-		return nil, fmt.Errorf(`error dialing host %q: %w`, p.c.Host, err)
+	// we checked that the user still exists and their information is the same, so now refresh their groups,
+	// unless the groups should be kept from the initial login.
+	if p.c.GroupSearch.SkipGroupRefresh {
+		return nil, nil
 	}
-	defer conn.Close()
+	// Never return nil groups when the groups were refreshed, since nil means that the groups were not refreshed.
+	mappedGroupNames := []string{}
+	if len(p.c.GroupSearch.Base) > 0 {
+		groups, err := p.searchGroupsForUserDN(conn, userEntry.DN)
+		if err != nil {
+			p.traceRefreshFailure(t, err)
+			return nil, err
+		}
+		mappedGroupNames = append(mappedGroupNames, groups...)
+	}
+	sort.Strings(mappedGroupNames)
+	return mappedGroupNames, nil
+}
 
-	err = conn.Bind(p.c.BindUsername, p.c.BindPassword)
+// dial connects to the first host of the LDAP IDP which can be reached. The healthy hosts are dialed first, in order,
+// or in turn when RoundRobin is used. A host which cannot be dialed is only dialed after the healthy hosts for a while.
+func (p *Provider) dial(ctx context.Context) (Conn, error) {
+	hosts, err := p.Hosts(ctx)
 	if err != nil {
-		return nil, fmt.Errorf(`error binding as %q before user search: %w`, p.c.BindUsername, err)
+		// The configured hosts may still be reachable.
+		plog.WarningErr("could not discover LDAP hosts", err, "upstreamName", p.GetName(), "srvName", p.srvName())
 	}
 
-	searchResult, err := conn.Search(search)
-
-	if err != nil {
-		return nil, fmt.Errorf(`error searching for user %q: %w`, userDN, err)
+	var lastErr error
+	for _, host := range p.hosts.order(hosts, p.c.LoadBalancing) {
+		conn, err := p.dialHost(ctx, host)
+		if err == nil {
+			p.hosts.markHealthy(host)
+			return conn, nil
+		}
+		lastErr = fmt.Errorf(`error dialing host %q: %w`, host, err)
+		p.hosts.markUnhealthy(host, lastErr)
+		if ctx.Err() != nil {
+			break
+		}
+		if len(hosts) > 1 {
+			plog.InfoErr("could not dial LDAP host", err, "upstreamName", p.GetName(), "host", host)
+		}
+	}
+	if len(hosts) > 1 {
+		return nil, fmt.Errorf("could not dial any of the %d hosts, last error: %w", len(hosts), lastErr)
 	}
-	return searchResult, nil
+	return nil, lastErr
 }
 
-func (p *Provider) dial(ctx context.Context) (Conn, error) {
-	tlsAddr, err := endpointaddr.Parse(p.c.Host, defaultLDAPSPort)
+// dialHost connects to one host of the LDAP IDP. Each operation of the returned connection is traced as a child of the
+// span of ctx.
+func (p *Provider) dialHost(ctx context.Context, host string) (_ Conn, err error) {
+	dialCtx, span := tracing.Start(ctx, "upstreamldap.dial", p.spanAttributes()...)
+	defer func() { tracing.End(span, err) }()
+
+	tlsAddr, err := endpointaddr.Parse(host, defaultLDAPSPort)
 	if err != nil {
 		return nil, ldap.NewError(ldap.ErrorNetwork, err)
 	}
 
-	startTLSAddr, err := endpointaddr.Parse(p.c.Host, defaultLDAPPort)
+	startTLSAddr, err := endpointaddr.Parse(host, defaultLDAPPort)
 	if err != nil {
 		return nil, ldap.NewError(ldap.ErrorNetwork, err)
 	}
@@ -274,7 +360,53 @@ func (p *Provider) dial(ctx context.Context) (Conn, error) {
 		dialFunc = p.c.Dialer.Dial
 	}
 
-	return dialFunc(ctx, addr)
+	span.SetAttributes(semconv.NetPeerNameKey.String(addr.Host), semconv.NetPeerPortKey.Int(int(addr.Port)))
+	conn, err := dialFunc(dialCtx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &tracingConn{Conn: conn, ctx: ctx, attributes: p.spanAttributes()}, nil
+}
+
+// tracingConn starts a span for each bind and search of a connection to the LDAP server.
+type tracingConn struct {
+	Conn
+	ctx        context.Context
+	attributes []attribute.KeyValue
+}
+
+func (c *tracingConn) Bind(username, password string) error {
+	_, span := tracing.Start(c.ctx, "upstreamldap.bind", c.attributes...)
+	err := c.Conn.Bind(username, password)
+	tracing.End(span, err)
+	return err
+}
+
+func (c *tracingConn) Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	_, span := tracing.Start(c.ctx, "upstreamldap.search", c.searchAttributes(searchRequest)...)
+	searchResult, err := c.Conn.Search(searchRequest)
+	c.endSearch(span, searchResult, err)
+	return searchResult, err
+}
+
+func (c *tracingConn) SearchWithPaging(searchRequest *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
+	_, span := tracing.Start(c.ctx, "upstreamldap.search", c.searchAttributes(searchRequest)...)
+	searchResult, err := c.Conn.SearchWithPaging(searchRequest, pagingSize)
+	c.endSearch(span, searchResult, err)
+	return searchResult, err
+}
+
+// searchAttributes returns the attributes of the span of a search. The filter is not included, since it usually
+// contains the username.
+func (c *tracingConn) searchAttributes(searchRequest *ldap.SearchRequest) []attribute.KeyValue {
+	return append(append([]attribute.KeyValue{}, c.attributes...), ldapSearchBaseKey.String(searchRequest.BaseDN))
+}
+
+func (c *tracingConn) endSearch(span oteltrace.Span, searchResult *ldap.SearchResult, err error) {
+	if searchResult != nil {
+		span.SetAttributes(ldapSearchEntriesKey.Int(len(searchResult.Entries)))
+	}
+	tracing.End(span, err)
 }
 
 // dialTLS is a default implementation of the Dialer, used when Dialer is nil and ConnectionProtocol is TLS.
@@ -360,18 +492,58 @@ func (p *Provider) GetURL() *url.URL {
 }
 
 // TestConnection provides a method for testing the connection and bind settings. It performs a dial and bind
-// and returns any errors that we encountered.
-func (p *Provider) TestConnection(ctx context.Context) error {
-	err := p.validateConfig()
+// with each host and returns any errors that we encountered. When a host could not be validated, the error is a
+// *HostsError.
+func (p *Provider) TestConnection(ctx context.Context) (err error) {
+	err = p.validateConfig()
 	if err != nil {
 		return err
 	}
 
-	conn, err := p.dial(ctx)
+	defer func(start time.Time) { p.observeRequest("test_connection", start, metrics.ResultOf(err)) }(time.Now())
+
+	hostsErr := &HostsError{}
+	hosts, err := p.Hosts(ctx)
+	if err != nil {
+		hostsErr.Errors = append(hostsErr.Errors, HostError{Host: p.srvName(), Err: err})
+	}
+
+	// The hosts are tested concurrently, so that a host which cannot be reached does not use up the time
+	// which is left to test the other hosts.
+	hostErrs := make([]error, len(hosts))
+	var wg sync.WaitGroup
+	for i := range hosts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			hostErrs[i] = p.testConnectionToHost(ctx, hosts[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for i, host := range hosts {
+		if hostErrs[i] != nil {
+			hostsErr.Errors = append(hostsErr.Errors, HostError{Host: host, Err: hostErrs[i]})
+			continue
+		}
+		hostsErr.Validated = append(hostsErr.Validated, host)
+	}
+
+	if len(hostsErr.Errors) > 0 {
+		return hostsErr
+	}
+	return nil
+}
+
+func (p *Provider) testConnectionToHost(ctx context.Context, host string) error {
+	conn, err := p.dialHost(ctx, host)
 	if err != nil {
-		return fmt.Errorf(`error dialing host %q: %w`, p.c.Host, err)
+		err = fmt.Errorf(`error dialing host %q: %w`, host, err)
+		p.hosts.markUnhealthy(host, err)
+		return err
 	}
 	defer conn.Close()
+	p.hosts.markHealthy(host)
 
 	err = conn.Bind(p.c.BindUsername, p.c.BindPassword)
 	if err != nil {
@@ -398,7 +570,14 @@ func (p *Provider) AuthenticateUser(ctx context.Context, username, password stri
 	endUserBindFunc := func(conn Conn, foundUserDN string) error {
 		return conn.Bind(foundUserDN, password)
 	}
-	return p.authenticateUserImpl(ctx, username, endUserBindFunc)
+	start := time.Now()
+	response, authenticated, err := p.authenticateUserImpl(ctx, username, endUserBindFunc)
+	result := metrics.ResultOf(err)
+	if err == nil && !authenticated {
+		result = metrics.ResultRejected
+	}
+	p.observeRequest("authenticate", start, result)
+	return response, authenticated, err
 }
 
 func (p *Provider) authenticateUserImpl(ctx context.Context, username string, bindFunc func(conn Conn, foundUserDN string) error) (*authenticators.Response, bool, error) {
@@ -420,7 +599,7 @@ func (p *Provider) authenticateUserImpl(ctx context.Context, username string, bi
 	conn, err := p.dial(ctx)
 	if err != nil {
 		p.traceAuthFailure(t, err)
-		return nil, false, fmt.Errorf(`error dialing host %q: %w`, p.c.Host, err)
+		return nil, false, err
 	}
 	defer conn.Close()
 
@@ -445,7 +624,87 @@ func (p *Provider) authenticateUserImpl(ctx context.Context, username string, bi
 }
 
 func (p *Provider) searchGroupsForUserDN(conn Conn, userDN string) ([]string, error) {
-	searchResult, err := conn.SearchWithPaging(p.groupSearchRequest(userDN), groupSearchPageSize)
+	groups, err := p.searchGroupsForMemberDN(conn, userDN, userDN)
+	if err != nil {
+		return nil, err
+	}
+	if p.c.GroupSearch.NestedGroupsMaxDepth > 0 {
+		groups, err = p.searchNestedGroups(conn, userDN, groups)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var groupNames []string
+	for _, group := range groups {
+		groupNames = append(groupNames, group.name)
+	}
+	return groupNames, nil
+}
+
+// searchNestedGroups returns the direct groups of the user, followed by the groups of which those groups are members,
+// recursively, up to NestedGroupsMaxDepth levels above the direct groups. Each group is only returned and searched once,
+// so a cycle of groups which are members of each other ends the search of that branch.
+func (p *Provider) searchNestedGroups(conn Conn, userDN string, directGroups []ldapGroup) ([]ldapGroup, error) {
+	allGroups := directGroups
+	seen := make(map[string]bool, len(directGroups))
+	for _, group := range directGroups {
+		seen[group.dn] = true
+	}
+
+	level := directGroups
+	for depth := 1; depth <= p.c.GroupSearch.NestedGroupsMaxDepth && len(level) > 0; depth++ {
+		var nextLevel []ldapGroup
+		for _, group := range level {
+			parentGroups, err := p.searchParentGroups(conn, userDN, group.dn)
+			if err != nil {
+				return nil, err
+			}
+			for _, parentGroup := range parentGroups {
+				if seen[parentGroup.dn] {
+					continue
+				}
+				seen[parentGroup.dn] = true
+				nextLevel = append(nextLevel, parentGroup)
+			}
+		}
+		allGroups = append(allGroups, nextLevel...)
+		level = nextLevel
+	}
+
+	if len(level) > 0 {
+		// The groups of the last level may be members of even more groups, which were not searched.
+		plog.Debug("reached the maximum depth of the nested group search",
+			"upstreamName", p.GetName(), "dn", userDN, "maxDepth", p.c.GroupSearch.NestedGroupsMaxDepth)
+	}
+	return allGroups, nil
+}
+
+// searchParentGroups returns the groups of which the group is a member, using the NestedGroupsCache when possible.
+func (p *Provider) searchParentGroups(conn Conn, userDN string, groupDN string) ([]ldapGroup, error) {
+	key := nestedGroupsCacheKey{
+		resourceUID:        p.c.ResourceUID,
+		base:               p.c.GroupSearch.Base,
+		filter:             p.c.GroupSearch.Filter,
+		groupNameAttribute: p.c.GroupSearch.GroupNameAttribute,
+		groupDN:            groupDN,
+	}
+	if groups, ok := p.c.NestedGroupsCache.get(key); ok {
+		return groups, nil
+	}
+
+	groups, err := p.searchGroupsForMemberDN(conn, groupDN, userDN)
+	if err != nil {
+		return nil, err
+	}
+	p.c.NestedGroupsCache.put(key, groups)
+	return groups, nil
+}
+
+// searchGroupsForMemberDN returns the groups of which the user or the group with the memberDN is a direct member.
+// The errors are about the user whose groups are being searched.
+func (p *Provider) searchGroupsForMemberDN(conn Conn, memberDN string, userDN string) ([]ldapGroup, error) {
+	searchResult, err := conn.SearchWithPaging(p.groupSearchRequest(memberDN), groupSearchPageSize)
 	if err != nil {
 		return nil, fmt.Errorf(`error searching for group memberships for user with DN %q: %w`, userDN, err)
 	}
@@ -455,7 +714,7 @@ func (p *Provider) searchGroupsForUserDN(conn Conn, userDN string) ([]string, er
 		groupAttributeName = distinguishedNameAttributeName
 	}
 
-	var groups []string
+	var groups []ldapGroup
 entries:
 	for _, groupEntry := range searchResult.Entries {
 		if len(groupEntry.DN) == 0 {
@@ -466,7 +725,7 @@ entries:
 			if err != nil {
 				return nil, fmt.Errorf("error finding groups for user %s: %w", userDN, err)
 			}
-			groups = append(groups, overrideGroupName)
+			groups = append(groups, ldapGroup{dn: groupEntry.DN, name: overrideGroupName})
 			continue entries
 		}
 		// if none of the overrides matched, use the default behavior (no mapping)
@@ -474,7 +733,7 @@ entries:
 		if err != nil {
 			return nil, fmt.Errorf(`error searching for group memberships for user with DN %q: %w`, userDN, err)
 		}
-		groups = append(groups, mappedGroupName)
+		groups = append(groups, ldapGroup{dn: groupEntry.DN, name: mappedGroupName})
 	}
 
 	return groups, nil
@@ -488,14 +747,15 @@ func (p *Provider) validateConfig() error {
 	return nil
 }
 
-func (p *Provider) SearchForDefaultNamingContext(ctx context.Context) (string, error) {
+func (p *Provider) SearchForDefaultNamingContext(ctx context.Context) (_ string, err error) {
+	defer func(start time.Time) { p.observeRequest("search_default_naming_context", start, metrics.ResultOf(err)) }(time.Now())
 	t := trace.FromContext(ctx).Nest("slow ldap attempt when searching for default naming context", trace.Field{Key: "providerName", Value: p.GetName()})
 	defer t.LogIfLong(500 * time.Millisecond) // to help users debug slow LDAP searches
 
 	conn, err := p.dial(ctx)
 	if err != nil {
 		p.traceSearchBaseDiscoveryFailure(t, err)
-		return "", fmt.Errorf(`error dialing host %q: %w`, p.c.Host, err)
+		return "", err
 	}
 	defer conn.Close()
 
@@ -778,6 +1038,18 @@ func (p *Provider) getSearchResultAttributeValue(attributeName string, entry *ld
 	return attributeValue, nil
 }
 
+func (p *Provider) spanAttributes() []attribute.KeyValue {
+	return []attribute.KeyValue{
+		tracing.IdentityProviderNameKey.String(p.GetName()),
+		tracing.IdentityProviderTypeKey.String(metrics.UpstreamTypeLDAP),
+	}
+}
+
+// observeRequest observes the duration of an operation with the provider, which started at start.
+func (p *Provider) observeRequest(operation string, start time.Time, result string) {
+	metrics.ObserveUpstreamRequest(metrics.UpstreamTypeLDAP, p.GetName(), operation, start, result)
+}
+
 func (p *Provider) traceAuthFailure(t *trace.Trace, err error) {
 	t.Step("authentication failed",
 		trace.Field{Key: "authenticated", Value: false},
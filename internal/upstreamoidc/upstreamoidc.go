@@ -21,9 +21,11 @@ import (
 	"k8s.io/apimachinery/pkg/util/sets"
 
 	"go.pinniped.dev/internal/httputil/httperr"
+	"go.pinniped.dev/internal/metrics"
 	"go.pinniped.dev/internal/oidc"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/tracing"
 	"go.pinniped.dev/pkg/oidcclient/nonce"
 	"go.pinniped.dev/pkg/oidcclient/oidctypes"
 	"go.pinniped.dev/pkg/oidcclient/pkce"
@@ -44,6 +46,7 @@ type ProviderConfig struct {
 	AllowPasswordGrant       bool
 	AdditionalAuthcodeParams map[string]string
 	RevocationURL            *url.URL // will commonly be nil: many providers do not offer this
+	EndSessionURL            *url.URL // will be nil unless configured and offered by the provider
 	Provider                 interface {
 		Verifier(*coreosoidc.Config) *coreosoidc.IDTokenVerifier
 		Claims(v interface{}) error
@@ -61,6 +64,10 @@ func (p *ProviderConfig) GetRevocationURL() *url.URL {
 	return p.RevocationURL
 }
 
+func (p *ProviderConfig) GetEndSessionURL() *url.URL {
+	return p.EndSessionURL
+}
+
 func (p *ProviderConfig) HasUserInfoURL() bool {
 	providerJSON := &struct {
 		UserInfoURL string `json:"userinfo_endpoint"`
@@ -114,11 +121,13 @@ func (p *ProviderConfig) PasswordCredentialsGrantAndValidateTokens(ctx context.C
 	}
 
 	// Note that this implicitly uses the scopes from p.Config.Scopes.
+	requestCtx, done := p.startRequest(ctx, "password_grant")
 	tok, err := p.Config.PasswordCredentialsToken(
-		coreosoidc.ClientContext(ctx, p.Client),
+		coreosoidc.ClientContext(requestCtx, p.Client),
 		username,
 		password,
 	)
+	done(err)
 	if err != nil {
 		return nil, err
 	}
@@ -130,12 +139,14 @@ func (p *ProviderConfig) PasswordCredentialsGrantAndValidateTokens(ctx context.C
 }
 
 func (p *ProviderConfig) ExchangeAuthcodeAndValidateTokens(ctx context.Context, authcode string, pkceCodeVerifier pkce.Code, expectedIDTokenNonce nonce.Nonce, redirectURI string) (*oidctypes.Token, error) {
+	requestCtx, done := p.startRequest(ctx, "authcode_exchange")
 	tok, err := p.Config.Exchange(
-		coreosoidc.ClientContext(ctx, p.Client),
+		coreosoidc.ClientContext(requestCtx, p.Client),
 		authcode,
 		pkceCodeVerifier.Verifier(),
 		oauth2.SetAuthURLParam("redirect_uri", redirectURI),
 	)
+	done(err)
 	if err != nil {
 		return nil, err
 	}
@@ -144,11 +155,14 @@ func (p *ProviderConfig) ExchangeAuthcodeAndValidateTokens(ctx context.Context,
 }
 
 func (p *ProviderConfig) PerformRefresh(ctx context.Context, refreshToken string) (*oauth2.Token, error) {
+	ctx, done := p.startRequest(ctx, "refresh")
 	// Use the provided HTTP client to benefit from its CA, proxy, and other settings.
 	httpClientContext := coreosoidc.ClientContext(ctx, p.Client)
 	// Create a TokenSource without an access token, so it thinks that a refresh is immediately required.
 	// Then ask it for the tokens to cause it to perform the refresh and return the results.
-	return p.Config.TokenSource(httpClientContext, &oauth2.Token{RefreshToken: refreshToken}).Token()
+	tok, err := p.Config.TokenSource(httpClientContext, &oauth2.Token{RefreshToken: refreshToken}).Token()
+	done(err)
+	return tok, err
 }
 
 // RevokeToken will attempt to revoke the given token, if the provider has a revocation endpoint.
@@ -163,6 +177,7 @@ func (p *ProviderConfig) RevokeToken(ctx context.Context, token string, tokenTyp
 		)
 		return nil
 	}
+	ctx, done := p.startRequest(ctx, "revoke")
 	// First try using client auth in the request params.
 	tryAnotherClientAuthMethod, err := p.tryRevokeToken(ctx, token, tokenType, false)
 	if tryAnotherClientAuthMethod {
@@ -170,6 +185,7 @@ func (p *ProviderConfig) RevokeToken(ctx context.Context, token string, tokenTyp
 		// which isn't useful anymore when retrying.
 		_, err = p.tryRevokeToken(ctx, token, tokenType, true)
 	}
+	done(err)
 	return err
 }
 
@@ -401,13 +417,29 @@ func (p *ProviderConfig) maybeFetchUserInfo(ctx context.Context, tok *oauth2.Tok
 		return nil, nil
 	}
 
-	userInfo, err := p.Provider.UserInfo(coreosoidc.ClientContext(ctx, p.Client), oauth2.StaticTokenSource(tok))
+	requestCtx, done := p.startRequest(ctx, "userinfo")
+	userInfo, err := p.Provider.UserInfo(coreosoidc.ClientContext(requestCtx, p.Client), oauth2.StaticTokenSource(tok))
+	done(err)
 	if err != nil {
 		return nil, httperr.Wrap(http.StatusInternalServerError, "could not get user info", err)
 	}
 	return userInfo, nil
 }
 
+// startRequest starts the span of a request to the provider. The returned func ends the span and observes the duration
+// of the request.
+func (p *ProviderConfig) startRequest(ctx context.Context, operation string) (context.Context, func(err error)) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "upstreamoidc."+operation,
+		tracing.IdentityProviderNameKey.String(p.Name),
+		tracing.IdentityProviderTypeKey.String(metrics.UpstreamTypeOIDC),
+	)
+	return ctx, func(err error) {
+		metrics.ObserveUpstreamRequest(metrics.UpstreamTypeOIDC, p.Name, operation, start, metrics.ResultOf(err))
+		tracing.End(span, err)
+	}
+}
+
 func maybeLogClaims(msg, name string, claims map[string]interface{}) {
 	if plog.Enabled(plog.LevelAll) { // log keys and values at all level
 		data, _ := json.Marshal(claims) // nothing we can do if it fails, but it really never should
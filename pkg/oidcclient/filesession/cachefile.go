@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 // Package cachefile implements the file format for session caches.
@@ -156,3 +156,18 @@ func (c *sessionCache) lookup(key oidcclient.SessionCacheKey) *sessionEntry {
 func (c *sessionCache) insert(entries ...sessionEntry) {
 	c.Sessions = append(c.Sessions, entries...)
 }
+
+// remove the cache entries whose keys match, and return their tokens.
+func (c *sessionCache) remove(match func(oidcclient.SessionCacheKey) bool) []oidctypes.Token {
+	var removed []oidctypes.Token
+	kept := make([]sessionEntry, 0, len(c.Sessions))
+	for _, entry := range c.Sessions {
+		if match(entry.Key) {
+			removed = append(removed, entry.Tokens)
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	c.Sessions = kept
+	return removed
+}
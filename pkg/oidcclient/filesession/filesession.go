@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 // Package filesession implements a simple YAML file-based login.sessionCache.
@@ -113,6 +113,42 @@ func (c *Cache) PutToken(key oidcclient.SessionCacheKey, token *oidctypes.Token)
 	})
 }
 
+// GetTokens returns the tokens of all cached sessions for the given issuer and client ID, regardless of their scopes
+// and redirect URI. It may return nil if no valid matching session is cached.
+func (c *Cache) GetTokens(issuer string, clientID string) []oidctypes.Token {
+	// If the cache file does not exist, exit immediately with no error log
+	if _, err := os.Stat(c.path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	var result []oidctypes.Token
+	c.withCache(func(cache *sessionCache) {
+		for _, entry := range cache.Sessions {
+			if entry.Key.Issuer == issuer && entry.Key.ClientID == clientID {
+				result = append(result, entry.Tokens)
+			}
+		}
+	})
+	return result
+}
+
+// RemoveTokens removes all cached sessions for the given issuer and client ID, regardless of their scopes and
+// redirect URI, and returns their tokens. It does not return an error but may silently fail to update the session cache.
+func (c *Cache) RemoveTokens(issuer string, clientID string) []oidctypes.Token {
+	// If the cache file does not exist, exit immediately with no error log
+	if _, err := os.Stat(c.path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	var removed []oidctypes.Token
+	c.withCache(func(cache *sessionCache) {
+		removed = cache.remove(func(key oidcclient.SessionCacheKey) bool {
+			return key.Issuer == issuer && key.ClientID == clientID
+		})
+	})
+	return removed
+}
+
 // withCache is an internal helper which locks, reads the cache, processes/mutates it with the provided function, then
 // saves it back to the file.
 func (c *Cache) withCache(transact func(*sessionCache)) {
@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package filesession
@@ -497,6 +497,182 @@ func TestPutToken(t *testing.T) {
 	}
 }
 
+func TestGetTokens(t *testing.T) {
+	t.Parallel()
+	now := time.Now().Round(1 * time.Second)
+	entry := func(issuer string, clientID string, scopes []string, idToken string) sessionEntry {
+		return sessionEntry{
+			Key: oidcclient.SessionCacheKey{
+				Issuer:      issuer,
+				ClientID:    clientID,
+				Scopes:      scopes,
+				RedirectURI: "http://localhost:0/callback",
+			},
+			CreationTimestamp: metav1.NewTime(now.Add(-2 * time.Hour)),
+			LastUsedTimestamp: metav1.NewTime(now.Add(-1 * time.Hour)),
+			Tokens: oidctypes.Token{
+				IDToken: &oidctypes.IDToken{
+					Token:  idToken,
+					Expiry: metav1.NewTime(now.Add(1 * time.Hour)),
+				},
+			},
+		}
+	}
+	tests := []struct {
+		name         string
+		makeTestFile func(t *testing.T, tmp string)
+		trylockFunc  func(*testing.T) error
+		want         []oidctypes.Token
+		wantErrors   []string
+		wantTestFile func(t *testing.T, tmp string)
+	}{
+		{
+			name: "not found",
+		},
+		{
+			name:         "file lock error",
+			makeTestFile: func(t *testing.T, tmp string) { require.NoError(t, ioutil.WriteFile(tmp, []byte(""), 0600)) },
+			trylockFunc:  func(t *testing.T) error { return fmt.Errorf("some lock error") },
+			wantErrors:   []string{"could not lock session file: some lock error"},
+		},
+		{
+			name: "returns all entries for the issuer and client ID",
+			makeTestFile: func(t *testing.T, tmp string) {
+				validCache := emptySessionCache()
+				validCache.insert(
+					entry("test-issuer", "test-client-id", []string{"offline_access", "openid"}, "id-token-1"),
+					entry("test-issuer", "other-client-id", []string{"offline_access", "openid"}, "id-token-2"),
+					entry("test-issuer", "test-client-id", []string{"offline_access", "openid", "pinniped:request-audience"}, "id-token-3"),
+					entry("other-issuer", "test-client-id", []string{"offline_access", "openid"}, "id-token-4"),
+				)
+				require.NoError(t, validCache.writeTo(tmp))
+			},
+			want: []oidctypes.Token{
+				entry("", "", nil, "id-token-1").Tokens,
+				entry("", "", nil, "id-token-3").Tokens,
+			},
+			wantTestFile: func(t *testing.T, tmp string) {
+				cache, err := readSessionCache(tmp)
+				require.NoError(t, err)
+				require.Len(t, cache.Sessions, 4)
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tmp := testutil.TempDir(t) + "/sessions.yaml"
+			if tt.makeTestFile != nil {
+				tt.makeTestFile(t, tmp)
+			}
+
+			// Initialize a cache with a reporter that collects errors
+			errors := errorCollector{t: t}
+			c := New(tmp, errors.collect())
+			if tt.trylockFunc != nil {
+				c.trylockFunc = func() error { return tt.trylockFunc(t) }
+			}
+
+			got := c.GetTokens("test-issuer", "test-client-id")
+			require.ElementsMatch(t, tt.want, got)
+			errors.require(tt.wantErrors, "TEMPFILE", tmp)
+			if tt.wantTestFile != nil {
+				tt.wantTestFile(t, tmp)
+			}
+		})
+	}
+}
+
+func TestRemoveTokens(t *testing.T) {
+	t.Parallel()
+	now := time.Now().Round(1 * time.Second)
+	entry := func(issuer string, clientID string, scopes []string, idToken string) sessionEntry {
+		return sessionEntry{
+			Key: oidcclient.SessionCacheKey{
+				Issuer:      issuer,
+				ClientID:    clientID,
+				Scopes:      scopes,
+				RedirectURI: "http://localhost:0/callback",
+			},
+			CreationTimestamp: metav1.NewTime(now.Add(-2 * time.Hour)),
+			LastUsedTimestamp: metav1.NewTime(now.Add(-1 * time.Hour)),
+			Tokens: oidctypes.Token{
+				IDToken: &oidctypes.IDToken{
+					Token:  idToken,
+					Expiry: metav1.NewTime(now.Add(1 * time.Hour)),
+				},
+			},
+		}
+	}
+	tests := []struct {
+		name         string
+		makeTestFile func(t *testing.T, tmp string)
+		trylockFunc  func(*testing.T) error
+		want         []oidctypes.Token
+		wantErrors   []string
+		wantTestFile func(t *testing.T, tmp string)
+	}{
+		{
+			name: "not found",
+		},
+		{
+			name:         "file lock error",
+			makeTestFile: func(t *testing.T, tmp string) { require.NoError(t, ioutil.WriteFile(tmp, []byte(""), 0600)) },
+			trylockFunc:  func(t *testing.T) error { return fmt.Errorf("some lock error") },
+			wantErrors:   []string{"could not lock session file: some lock error"},
+		},
+		{
+			name: "removes all entries for the issuer and client ID",
+			makeTestFile: func(t *testing.T, tmp string) {
+				validCache := emptySessionCache()
+				validCache.insert(
+					entry("test-issuer", "test-client-id", []string{"offline_access", "openid"}, "id-token-1"),
+					entry("test-issuer", "other-client-id", []string{"offline_access", "openid"}, "id-token-2"),
+					entry("test-issuer", "test-client-id", []string{"offline_access", "openid", "pinniped:request-audience"}, "id-token-3"),
+					entry("other-issuer", "test-client-id", []string{"offline_access", "openid"}, "id-token-4"),
+				)
+				require.NoError(t, validCache.writeTo(tmp))
+			},
+			want: []oidctypes.Token{
+				entry("", "", nil, "id-token-1").Tokens,
+				entry("", "", nil, "id-token-3").Tokens,
+			},
+			wantTestFile: func(t *testing.T, tmp string) {
+				cache, err := readSessionCache(tmp)
+				require.NoError(t, err)
+				require.Len(t, cache.Sessions, 2)
+				remaining := []string{cache.Sessions[0].Tokens.IDToken.Token, cache.Sessions[1].Tokens.IDToken.Token}
+				require.ElementsMatch(t, []string{"id-token-2", "id-token-4"}, remaining)
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tmp := testutil.TempDir(t) + "/sessions.yaml"
+			if tt.makeTestFile != nil {
+				tt.makeTestFile(t, tmp)
+			}
+
+			// Initialize a cache with a reporter that collects errors
+			errors := errorCollector{t: t}
+			c := New(tmp, errors.collect())
+			if tt.trylockFunc != nil {
+				c.trylockFunc = func() error { return tt.trylockFunc(t) }
+			}
+
+			got := c.RemoveTokens("test-issuer", "test-client-id")
+			require.ElementsMatch(t, tt.want, got)
+			errors.require(tt.wantErrors, "TEMPFILE", tmp)
+			if tt.wantTestFile != nil {
+				tt.wantTestFile(t, tmp)
+			}
+		})
+	}
+}
+
 type errorCollector struct {
 	t   *testing.T
 	saw []error
@@ -64,6 +64,13 @@ const (
 
 	httpLocationHeaderName = "Location"
 
+	// deviceCodeGrantType is the grant type of the device authorization grant (RFC 8628).
+	deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+	// defaultDevicePollInterval is the polling interval for the device authorization grant, used when the issuer
+	// does not return one. See https://datatracker.ietf.org/doc/html/rfc8628#section-3.2.
+	defaultDevicePollInterval = 5 * time.Second
+
 	debugLogLevel = 4
 )
 
@@ -82,6 +89,7 @@ type handlerState struct {
 	upstreamIdentityProviderName string
 	upstreamIdentityProviderType string
 	cliToSendCredentials         bool
+	useDeviceFlow                bool
 
 	requestedAudience string
 
@@ -111,6 +119,7 @@ type handlerState struct {
 	validateIDToken func(ctx context.Context, provider *oidc.Provider, audience string, token string) (*oidc.IDToken, error)
 	promptForValue  func(ctx context.Context, promptLabel string) (string, error)
 	promptForSecret func(promptLabel string) (string, error)
+	wait            func(ctx context.Context, d time.Duration) error
 
 	callbacks chan callbackResult
 }
@@ -245,6 +254,19 @@ func WithCLISendingCredentials() Option {
 	}
 }
 
+// WithDeviceAuthorization causes the login flow to use the OAuth 2.0 device authorization grant (RFC 8628) instead
+// of a localhost callback listener. The user is asked to visit the issuer's device verification page in a web browser,
+// which may be on another computer, and to enter a code there, while the CLI polls the issuer's token endpoint until
+// the user has logged in. This is only intended to be used when the issuer is a Pinniped Supervisor and the upstream
+// identity provider type is an OIDCIdentityProvider, and it requires an issuer which advertises a
+// device_authorization_endpoint in its OIDC discovery document.
+func WithDeviceAuthorization() Option {
+	return func(h *handlerState) error {
+		h.useDeviceFlow = true
+		return nil
+	}
+}
+
 // WithUpstreamIdentityProvider causes the specified name and type to be sent as custom query parameters to the
 // issuer's authorize endpoint. This is only intended to be used when the issuer is a Pinniped Supervisor, in which
 // case it provides a mechanism to choose among several upstream identity providers.
@@ -291,6 +313,7 @@ func Login(issuer string, clientID string, opts ...Option) (*oidctypes.Token, er
 		},
 		promptForValue:  promptForValue,
 		promptForSecret: promptForSecret,
+		wait:            wait,
 	}
 	for _, opt := range opts {
 		if err := opt(&h); err != nil {
@@ -399,6 +422,9 @@ func (h *handlerState) baseLogin() (*oidctypes.Token, error) {
 	if h.cliToSendCredentials {
 		authFunc = h.cliBasedAuth
 	}
+	if h.useDeviceFlow {
+		authFunc = h.deviceBasedAuth
+	}
 
 	// Perform the authorize request and authcode exchange to get back OIDC tokens.
 	token, err := authFunc(&authorizeOptions)
@@ -601,6 +627,163 @@ func (h *handlerState) webBrowserBasedAuth(authorizeOptions *[]oauth2.AuthCodeOp
 	}
 }
 
+// deviceAuthorizationResponse is the response of the device authorization endpoint.
+// See https://datatracker.ietf.org/doc/html/rfc8628#section-3.2.
+type deviceAuthorizationResponse struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURI string `json:"verification_uri"`
+	ExpiresIn       int64  `json:"expires_in"`
+	Interval        int64  `json:"interval"`
+}
+
+// deviceTokenResponse is the response of the token endpoint for the device code grant, which is either a successful
+// token response or an error response.
+type deviceTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	RefreshToken     string `json:"refresh_token"`
+	IDToken          string `json:"id_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Ask the issuer to start a device authorization, and ask the user to visit the verification page in a web browser,
+// which does not need to be on this computer. Poll the token endpoint until the user has logged in.
+// Return the tokens or an error.
+func (h *handlerState) deviceBasedAuth(_ *[]oauth2.AuthCodeOption) (*oidctypes.Token, error) {
+	var discoveryClaims struct {
+		DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+	}
+	if err := h.provider.Claims(&discoveryClaims); err != nil {
+		return nil, fmt.Errorf("could not decode device_authorization_endpoint in OIDC discovery from %q: %w", h.issuer, err)
+	}
+	if discoveryClaims.DeviceAuthorizationEndpoint == "" {
+		return nil, fmt.Errorf("issuer %q does not support the device authorization grant", h.issuer)
+	}
+
+	deviceAuthorizationParams := url.Values{
+		"client_id": []string{h.clientID},
+		"scope":     []string{strings.Join(h.scopes, " ")},
+	}
+	if h.upstreamIdentityProviderName != "" {
+		deviceAuthorizationParams.Set(supervisoroidc.AuthorizeUpstreamIDPNameParamName, h.upstreamIdentityProviderName)
+		deviceAuthorizationParams.Set(supervisoroidc.AuthorizeUpstreamIDPTypeParamName, h.upstreamIdentityProviderType)
+	}
+
+	var deviceAuthorization deviceAuthorizationResponse
+	var deviceAuthorizationError deviceTokenResponse
+	status, err := h.postForm(discoveryClaims.DeviceAuthorizationEndpoint, deviceAuthorizationParams, &deviceAuthorization, &deviceAuthorizationError)
+	if err != nil {
+		return nil, fmt.Errorf("device authorization request failed: %w", err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("device authorization request failed with code %q: %s", deviceAuthorizationError.Error, deviceAuthorizationError.ErrorDescription)
+	}
+	if deviceAuthorization.DeviceCode == "" || deviceAuthorization.UserCode == "" || deviceAuthorization.VerificationURI == "" {
+		return nil, fmt.Errorf("device authorization response is missing required parameters")
+	}
+
+	_, _ = fmt.Fprintf(os.Stderr, "Log in by visiting this link:\n\n    %s\n\nand entering this code: %s\n\n",
+		deviceAuthorization.VerificationURI, deviceAuthorization.UserCode)
+
+	interval := time.Duration(deviceAuthorization.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultDevicePollInterval
+	}
+
+	tokenParams := url.Values{
+		"grant_type":  []string{deviceCodeGrantType},
+		"device_code": []string{deviceAuthorization.DeviceCode},
+		"client_id":   []string{h.clientID},
+	}
+	for {
+		if err := h.wait(h.ctx, interval); err != nil {
+			return nil, fmt.Errorf("timed out waiting for device login: %w", err)
+		}
+
+		var tokenResponse deviceTokenResponse
+		status, err := h.postForm(h.oauth2Config.Endpoint.TokenURL, tokenParams, &tokenResponse, &tokenResponse)
+		if err != nil {
+			return nil, fmt.Errorf("device token request failed: %w", err)
+		}
+		if status == http.StatusOK {
+			return h.validateDeviceTokenResponse(&tokenResponse)
+		}
+
+		switch tokenResponse.Error {
+		case "authorization_pending":
+			h.logger.V(debugLogLevel).Info("Pinniped: Waiting for device login.")
+		case "slow_down":
+			// See https://datatracker.ietf.org/doc/html/rfc8628#section-3.5.
+			interval += defaultDevicePollInterval
+		default:
+			return nil, fmt.Errorf("login failed with code %q: %s", tokenResponse.Error, tokenResponse.ErrorDescription)
+		}
+	}
+}
+
+func (h *handlerState) validateDeviceTokenResponse(tokenResponse *deviceTokenResponse) (*oidctypes.Token, error) {
+	tok := (&oauth2.Token{
+		AccessToken:  tokenResponse.AccessToken,
+		TokenType:    tokenResponse.TokenType,
+		RefreshToken: tokenResponse.RefreshToken,
+	}).WithExtra(map[string]interface{}{"id_token": tokenResponse.IDToken})
+	if tokenResponse.ExpiresIn > 0 {
+		tok.Expiry = time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second)
+	}
+
+	// There is no nonce in the device authorization grant, so skip the nonce validation (but not other validations).
+	token, err := h.getProvider(h.oauth2Config, h.provider, h.httpClient).ValidateTokenAndMergeWithUserInfo(h.ctx, tok, "", true, false)
+	if err != nil {
+		return nil, fmt.Errorf("error during device code exchange: %w", err)
+	}
+	return token, nil
+}
+
+// postForm makes a form POST request and decodes the JSON response body into either successBody or errorBody,
+// depending on the response status. It returns the response status.
+func (h *handlerState) postForm(endpoint string, params url.Values, successBody interface{}, errorBody interface{}) (int, error) {
+	req, err := http.NewRequestWithContext(h.ctx, http.MethodPost, endpoint, strings.NewReader(params.Encode()))
+	if err != nil {
+		return 0, fmt.Errorf("could not build request: %w", err)
+	}
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("content-type"))
+	if err != nil || mediaType != "application/json" {
+		return 0, fmt.Errorf("unexpected HTTP response status %d", resp.StatusCode)
+	}
+
+	body := errorBody
+	if resp.StatusCode == http.StatusOK {
+		body = successBody
+	}
+	if err := json.NewDecoder(resp.Body).Decode(body); err != nil {
+		return 0, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return resp.StatusCode, nil
+}
+
+// wait returns after the duration has passed, or returns an error when the context is done first.
+func wait(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
 func (h *handlerState) promptForWebLogin(ctx context.Context, authorizeURL string, out io.Writer) func() {
 	_, _ = fmt.Fprintf(out, "Log in by visiting this link:\n\n    %s\n\n", authorizeURL)
 
@@ -817,6 +1000,10 @@ func (h *handlerState) handleRefresh(ctx context.Context, refreshToken *oidctype
 	if err != nil {
 		// Ignore errors during refresh, but return nil which will trigger the full login flow.
 		h.logger.V(debugLogLevel).Info("Pinniped: Refresh failed.", "error", err.Error())
+		// When the Supervisor ended the session, tell the user why they need to log in again.
+		if description, ok := sessionExpiredErrorDescription(err); ok {
+			_, _ = fmt.Fprintf(os.Stderr, "%s Please log in again.\n", description)
+		}
 		return nil, nil
 	}
 
@@ -825,6 +1012,24 @@ func (h *handlerState) handleRefresh(ctx context.Context, refreshToken *oidctype
 	return upstreamOIDCIdentityProvider.ValidateTokenAndMergeWithUserInfo(ctx, refreshed, "", true, false)
 }
 
+// sessionExpiredErrorDescription returns the error_description of a failed refresh when the Supervisor rejected the
+// refresh because the session has expired.
+func sessionExpiredErrorDescription(err error) (string, bool) {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) {
+		return "", false
+	}
+	var body struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if json.Unmarshal(retrieveErr.Body, &body) != nil || body.Error != "invalid_grant" ||
+		!strings.HasPrefix(body.ErrorDescription, supervisoroidc.SessionExpiredErrorDescription) {
+		return "", false
+	}
+	return body.ErrorDescription, true
+}
+
 func (h *handlerState) handleAuthCodeCallback(w http.ResponseWriter, r *http.Request) (err error) {
 	// If we return an error, also report it back over the channel to the main CLI thread.
 	defer func() {
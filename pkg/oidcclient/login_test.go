@@ -2030,6 +2030,46 @@ func TestHandleAuthCodeCallback(t *testing.T) {
 	}
 }
 
+func TestSessionExpiredErrorDescription(t *testing.T) {
+	tests := []struct {
+		name            string
+		err             error
+		wantDescription string
+		wantOK          bool
+	}{
+		{
+			name:            "session expired",
+			err:             fmt.Errorf("wrapped: %w", &oauth2.RetrieveError{Body: []byte(`{"error":"invalid_grant","error_description":"Your session has expired. It reached the maximum session length of 24h0m0s."}`)}),
+			wantDescription: "Your session has expired. It reached the maximum session length of 24h0m0s.",
+			wantOK:          true,
+		},
+		{
+			name: "other invalid_grant error",
+			err:  &oauth2.RetrieveError{Body: []byte(`{"error":"invalid_grant","error_description":"Error during upstream refresh."}`)},
+		},
+		{
+			name: "other error code",
+			err:  &oauth2.RetrieveError{Body: []byte(`{"error":"server_error","error_description":"Your session has expired."}`)},
+		},
+		{
+			name: "body is not JSON",
+			err:  &oauth2.RetrieveError{Body: []byte(`not json`)},
+		},
+		{
+			name: "not a token endpoint error",
+			err:  errors.New("some network error"),
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			description, ok := sessionExpiredErrorDescription(tt.err)
+			require.Equal(t, tt.wantOK, ok)
+			require.Equal(t, tt.wantDescription, description)
+		})
+	}
+}
+
 func mockUpstream(t *testing.T) *mockupstreamoidcidentityprovider.MockUpstreamOIDCIdentityProviderI {
 	t.Helper()
 	ctrl := gomock.NewController(t)
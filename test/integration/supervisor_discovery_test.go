@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package integration
@@ -493,7 +493,12 @@ func requireWellKnownEndpointIsWorking(t *testing.T, supervisorScheme, superviso
       "issuer": "%s",
       "authorization_endpoint": "%s/oauth2/authorize",
       "token_endpoint": "%s/oauth2/token",
-      "token_endpoint_auth_methods_supported": ["client_secret_basic"],
+      "revocation_endpoint": "%s/oauth2/revoke",
+      "end_session_endpoint": "%s/oauth2/logout",
+      "userinfo_endpoint": "%s/oauth2/userinfo",
+      "introspection_endpoint": "%s/oauth2/introspect",
+      "device_authorization_endpoint": "%s/oauth2/device_authorization",
+      "token_endpoint_auth_methods_supported": ["client_secret_basic", "client_secret_post", "none"],
       "jwks_uri": "%s/jwks.json",
       "scopes_supported": ["openid", "offline"],
       "response_types_supported": ["code"],
@@ -503,7 +508,7 @@ func requireWellKnownEndpointIsWorking(t *testing.T, supervisorScheme, superviso
       "subject_types_supported": ["public"],
       "id_token_signing_alg_values_supported": ["ES256"]
     }`)
-	expectedJSON := fmt.Sprintf(expectedResultTemplate, issuerName, issuerName, issuerName, issuerName, issuerName)
+	expectedJSON := fmt.Sprintf(expectedResultTemplate, issuerName, issuerName, issuerName, issuerName, issuerName, issuerName, issuerName, issuerName, issuerName, issuerName)
 
 	require.Equal(t, "application/json", response.Header.Get("content-type"))
 	require.JSONEq(t, expectedJSON, responseBody)
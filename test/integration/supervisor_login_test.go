@@ -1557,7 +1557,7 @@ func testSupervisorLogin(
 		tokenResponse, err := downstreamOAuth2Config.Exchange(oidcHTTPClientContext, authcode, pkceParam.Verifier())
 		require.NoError(t, err)
 
-		expectedIDTokenClaims := []string{"iss", "exp", "sub", "aud", "auth_time", "iat", "jti", "nonce", "rat", "username", "groups"}
+		expectedIDTokenClaims := []string{"iss", "exp", "sub", "aud", "auth_time", "iat", "jti", "nonce", "rat", "username", "groups", "sid"}
 		verifyTokenResponse(t,
 			tokenResponse, discovery, downstreamOAuth2Config, nonceParam,
 			expectedIDTokenClaims, wantDownstreamIDTokenSubjectToMatch, wantDownstreamIDTokenUsernameToMatch(username), wantDownstreamIDTokenGroups)
@@ -1571,7 +1571,7 @@ func testSupervisorLogin(
 		require.NoError(t, err)
 
 		// When refreshing, expect to get an "at_hash" claim, but no "nonce" claim.
-		expectRefreshedIDTokenClaims := []string{"iss", "exp", "sub", "aud", "auth_time", "iat", "jti", "rat", "username", "groups", "at_hash"}
+		expectRefreshedIDTokenClaims := []string{"iss", "exp", "sub", "aud", "auth_time", "iat", "jti", "rat", "username", "groups", "sid", "at_hash"}
 		verifyTokenResponse(t,
 			refreshedTokenResponse, discovery, downstreamOAuth2Config, "",
 			expectRefreshedIDTokenClaims, wantDownstreamIDTokenSubjectToMatch, wantDownstreamIDTokenUsernameToMatch(username), wantDownstreamIDTokenGroups)
@@ -1583,6 +1583,18 @@ func testSupervisorLogin(
 		// token exchange on the refreshed token
 		doTokenExchange(t, &downstreamOAuth2Config, refreshedTokenResponse, httpClient, discovery)
 
+		// The userinfo endpoint should return the same identity as the ID token of the refreshed token.
+		userInfo, err := discovery.UserInfo(oidcHTTPClientContext, oauth2.StaticTokenSource(refreshedTokenResponse))
+		require.NoError(t, err)
+		var userInfoClaims map[string]interface{}
+		require.NoError(t, userInfo.Claims(&userInfoClaims))
+		for claimName := range userInfoClaims {
+			// No passthrough claims are configured on this FederationDomain, so only the identity claims are returned.
+			require.Contains(t, []string{"sub", "username", "groups"}, claimName)
+		}
+		require.Regexp(t, wantDownstreamIDTokenSubjectToMatch, userInfo.Subject)
+		require.Regexp(t, wantDownstreamIDTokenUsernameToMatch(username), userInfoClaims["username"])
+
 		// Now that we have successfully performed a refresh, let's test what happens when an
 		// upstream refresh fails during the next downstream refresh.
 		if breakRefreshSessionData != nil {
@@ -1592,7 +1604,7 @@ func testSupervisorLogin(
 			// First use the latest downstream refresh token to look up the corresponding session in the Supervisor's storage.
 			kubeClient := testlib.NewKubernetesClientset(t)
 			supervisorSecretsClient := kubeClient.CoreV1().Secrets(env.SupervisorNamespace)
-			oauthStore := oidc.NewKubeStorage(supervisorSecretsClient, oidc.DefaultOIDCTimeoutsConfiguration())
+			oauthStore := oidc.NewKubeStorage(supervisorSecretsClient, nil, oidc.DefaultOIDCTimeoutsConfiguration())
 			storedRefreshSession, err := oauthStore.GetRefreshTokenSession(ctx, signatureOfLatestRefreshToken, nil)
 			require.NoError(t, err)
 
@@ -1616,6 +1628,25 @@ func testSupervisorLogin(
 					"[^']+",
 				err.Error(),
 			)
+		} else {
+			// Log out using the end session endpoint, which should end the whole downstream session.
+			var discoveryClaims struct {
+				EndSessionEndpoint string `json:"end_session_endpoint"`
+			}
+			require.NoError(t, discovery.Claims(&discoveryClaims))
+			logoutForm := url.Values{"id_token_hint": {refreshedTokenResponse.Extra("id_token").(string)}}
+			logoutRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, discoveryClaims.EndSessionEndpoint, strings.NewReader(logoutForm.Encode()))
+			require.NoError(t, err)
+			logoutRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			logoutResponse, err := httpClient.Do(logoutRequest)
+			require.NoError(t, err)
+			require.NoError(t, logoutResponse.Body.Close())
+			require.Equal(t, http.StatusOK, logoutResponse.StatusCode)
+
+			// The latest refresh token should not work anymore.
+			_, err = downstreamOAuth2Config.TokenSource(oidcHTTPClientContext, &oauth2.Token{RefreshToken: refreshedTokenResponse.RefreshToken}).Token()
+			require.Error(t, err)
+			require.Contains(t, err.Error(), "oauth2: cannot fetch token: 400 Bad Request")
 		}
 	} else {
 		errorDescription := callback.URL.Query().Get("error_description")
@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package integration
@@ -145,18 +145,31 @@ func ensureValidJWKS(t *testing.T, secret *corev1.Secret) {
 	jwksData, ok := secret.Data["jwks"]
 	require.True(t, ok, "secret is missing jwks")
 
-	// Ensure the secret's JWKS is valid, public, and contains the singing key.
+	// Ensure the secret has a next key, which is published before it becomes the active key.
+	nextJWKData, ok := secret.Data["nextJWK"]
+	require.True(t, ok, "secret is missing next jwk")
+	var nextJWK jose.JSONWebKey
+	require.NoError(t, json.Unmarshal(nextJWKData, &nextJWK))
+	require.True(t, nextJWK.Valid(), "next jwk is invalid")
+	require.False(t, nextJWK.IsPublic(), "next jwk is public")
+	require.NotEqual(t, activeJWK.KeyID, nextJWK.KeyID)
+
+	// Ensure the secret's JWKS is valid, public, and contains the signing key and the next key.
 	var jwks jose.JSONWebKeySet
 	require.NoError(t, json.Unmarshal(jwksData, &jwks))
-	foundActiveJWK := false
+	foundActiveJWK, foundNextJWK := false, false
 	for _, jwk := range jwks.Keys {
 		require.Truef(t, jwk.Valid(), "jwk %s is invalid", jwk.KeyID)
 		require.Truef(t, jwk.IsPublic(), "jwk %s is not public", jwk.KeyID)
-		if jwk.KeyID == activeJWK.KeyID {
+		switch jwk.KeyID {
+		case activeJWK.KeyID:
 			foundActiveJWK = true
+		case nextJWK.KeyID:
+			foundNextJWK = true
 		}
 	}
 	require.True(t, foundActiveJWK, "could not find active JWK in JWKS: %s", jwks)
+	require.True(t, foundNextJWK, "could not find next JWK in JWKS: %s", jwks)
 }
 
 func ensureValidSymmetricSecretOfTypeFunc(secretTypeValue string) func(*testing.T, *corev1.Secret) {
@@ -0,0 +1,107 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/handler/openid"
+	"github.com/ory/fosite/token/jwt"
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/clientregistry"
+	"go.pinniped.dev/internal/psession"
+	"go.pinniped.dev/test/testlib"
+)
+
+// TestSupervisorSessionAPI assumes that the Supervisor stores its sessions in Secrets, which is the default.
+func TestSupervisorSessionAPI(t *testing.T) {
+	env := testlib.IntegrationEnv(t)
+	sessions := testlib.NewSupervisorClientset(t).SessionV1alpha1().Sessions()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	requestID := "integration-test-session-" + testlib.RandHex(t, 8)
+	username := "integration-test-user-" + testlib.RandHex(t, 8)
+	loginTime := time.Now().UTC().Truncate(time.Second)
+
+	// Store a session like the Supervisor does after a login, but for an LDAP provider so that there are no
+	// upstream tokens which would need to be revoked.
+	storage := oidc.NewKubeStorage(testlib.NewKubernetesClientset(t).CoreV1().Secrets(env.SupervisorNamespace), nil, oidc.DefaultOIDCTimeoutsConfiguration())
+	request := &fosite.Request{
+		ID: requestID,
+		Client: &clientregistry.Client{
+			DefaultOpenIDConnectClient: fosite.DefaultOpenIDConnectClient{
+				DefaultClient: &fosite.DefaultClient{ID: "pinniped-cli", Public: true},
+			},
+		},
+		GrantedScope: fosite.Arguments{"openid", "offline_access"},
+		Session: &psession.PinnipedSession{
+			Fosite: &openid.DefaultSession{
+				Claims: &jwt.IDTokenClaims{
+					Subject: "ldaps://ldap.example.com?sub=" + username,
+					Extra: map[string]interface{}{
+						oidc.DownstreamUsernameClaim: username,
+						oidc.DownstreamGroupsClaim:   []string{"some-group"},
+					},
+				},
+			},
+			Custom: &psession.CustomSessionData{
+				ProviderUID:  "some-ldap-provider-uid",
+				ProviderName: "some-ldap-provider",
+				ProviderType: psession.ProviderTypeLDAP,
+				LoginTime:    loginTime,
+				LDAP:         &psession.LDAPSessionData{UserDN: "cn=" + username},
+			},
+		},
+	}
+	refreshTokenSignature := "integration-test-signature-" + testlib.RandHex(t, 8)
+	require.NoError(t, storage.CreateRefreshTokenSession(ctx, refreshTokenSignature, request))
+	t.Cleanup(func() {
+		// the test may have already deleted it
+		_ = storage.RevokeSession(context.Background(), requestID)
+	})
+
+	// The aggregated API may not be ready yet right after the Supervisor was installed.
+	testlib.RequireEventually(t, func(requireEventually *require.Assertions) {
+		sessionList, err := sessions.List(ctx, metav1.ListOptions{
+			FieldSelector: fields.OneTermEqualSelector("spec.username", username).String(),
+		})
+		requireEventually.NoError(err)
+		requireEventually.Len(sessionList.Items, 1)
+		requireEventually.Equal(requestID, sessionList.Items[0].Name)
+	}, time.Minute, time.Second)
+
+	session, err := sessions.Get(ctx, requestID, metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "ldaps://ldap.example.com?sub="+username, session.Spec.Subject)
+	require.Equal(t, username, session.Spec.Username)
+	require.Equal(t, []string{"some-group"}, session.Spec.Groups)
+	require.Equal(t, "some-ldap-provider", session.Spec.IdentityProvider.Name)
+	require.Equal(t, "ldap", session.Spec.IdentityProvider.Type)
+	require.Equal(t, "pinniped-cli", session.Spec.ClientID)
+	require.Equal(t, []string{"openid", "offline_access"}, session.Spec.Scopes)
+	require.NotNil(t, session.Spec.LoginTime)
+	require.True(t, loginTime.Equal(session.Spec.LoginTime.Time))
+	require.Nil(t, session.Spec.LastRefreshTime)
+
+	// Deleting the session deletes its storage.
+	require.NoError(t, sessions.Delete(ctx, requestID, metav1.DeleteOptions{}))
+	_, err = storage.GetRefreshTokenSession(ctx, refreshTokenSignature, nil)
+	require.True(t, errors.Is(err, fosite.ErrNotFound), "wrong error: %v", err)
+
+	_, err = sessions.Get(ctx, requestID, metav1.GetOptions{})
+	require.True(t, apierrors.IsNotFound(err), "wrong error: %v", err)
+	err = sessions.Delete(ctx, requestID, metav1.DeleteOptions{})
+	require.True(t, apierrors.IsNotFound(err), "wrong error: %v", err)
+}
@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package integration
@@ -18,6 +18,7 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
+	"go.pinniped.dev/internal/crud"
 	"go.pinniped.dev/internal/fositestorage/authorizationcode"
 	"go.pinniped.dev/internal/testutil"
 	"go.pinniped.dev/test/testlib"
@@ -45,7 +46,9 @@ func TestAuthorizeCodeStorage(t *testing.T) {
 		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 		defer cancel()
 		err := secrets.Delete(ctx, name, metav1.DeleteOptions{})
-		require.NoError(t, err)
+		if !errors.IsNotFound(err) { // the test may have already deleted it
+			require.NoError(t, err)
+		}
 	})
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
@@ -55,9 +58,13 @@ func TestAuthorizeCodeStorage(t *testing.T) {
 	session := authorizationcode.NewValidEmptyAuthorizeCodeSession()
 	err := json.Unmarshal([]byte(authorizationcode.ExpectedAuthorizeCodeSessionJSONFromFuzzing), session)
 	require.NoError(t, err)
+	// the request ID is used as a label value, so it must be a valid label value, unlike the fuzzed request ID
+	session.Request.ID = "some-request-id"
+	expectedJSON := strings.Replace(authorizationcode.ExpectedAuthorizeCodeSessionJSONFromFuzzing,
+		`"id": "曑x螠Gæ鄋楨",`, `"id": "some-request-id",`, 1)
 
 	sessionStorageLifetime := 5 * time.Minute
-	storage := authorizationcode.New(secrets, time.Now, sessionStorageLifetime)
+	storage := authorizationcode.New(crud.NewSecretsBackend(secrets), time.Now, sessionStorageLifetime)
 
 	// the session for this signature should not exist yet
 	notFoundRequest, err := storage.GetAuthorizeCodeSession(ctx, signature, nil)
@@ -76,7 +83,7 @@ func TestAuthorizeCodeStorage(t *testing.T) {
 	// check that the data stored in Kube matches what we put in
 	initialSecret, err := secrets.Get(ctx, name, metav1.GetOptions{})
 	require.NoError(t, err)
-	require.JSONEq(t, authorizationcode.ExpectedAuthorizeCodeSessionJSONFromFuzzing, string(initialSecret.Data["pinniped-storage-data"]))
+	require.JSONEq(t, expectedJSON, string(initialSecret.Data["pinniped-storage-data"]))
 
 	// check that the Secret got the expected annotations
 	actualGCAfterValue := initialSecret.Annotations["storage.pinniped.dev/garbage-collect-after"]
@@ -86,7 +93,10 @@ func TestAuthorizeCodeStorage(t *testing.T) {
 	testutil.RequireTimeInDelta(t, time.Now().Add(sessionStorageLifetime), parsedActualGCAfterValue, 30*time.Second)
 
 	// check that the Secret got the right labels
-	require.Equal(t, map[string]string{"storage.pinniped.dev/type": "authcode"}, initialSecret.Labels)
+	require.Equal(t, map[string]string{
+		"storage.pinniped.dev/type":       "authcode",
+		"storage.pinniped.dev/request-id": "some-request-id",
+	}, initialSecret.Labels)
 
 	// check that the Secret got the right type
 	require.Equal(t, v1.SecretType("storage.pinniped.dev/authcode"), initialSecret.Type)
@@ -115,7 +125,15 @@ func TestAuthorizeCodeStorage(t *testing.T) {
 	// the data stored in Kube should be exactly the same but it should be marked as used
 	invalidatedSecret, err := secrets.Get(ctx, name, metav1.GetOptions{})
 	require.NoError(t, err)
-	expectedInvalidatedJSON := strings.Replace(authorizationcode.ExpectedAuthorizeCodeSessionJSONFromFuzzing,
-		`"active": true,`, `"active": false,`, 1)
+	expectedInvalidatedJSON := strings.Replace(expectedJSON, `"active": true,`, `"active": false,`, 1)
 	require.JSONEq(t, expectedInvalidatedJSON, string(invalidatedSecret.Data["pinniped-storage-data"]))
+
+	// the labels should be unchanged
+	require.Equal(t, initialSecret.Labels, invalidatedSecret.Labels)
+
+	// the session can be revoked using its request ID
+	err = storage.RevokeAuthorizeCodeSession(ctx, "some-request-id")
+	require.NoError(t, err)
+	_, err = secrets.Get(ctx, name, metav1.GetOptions{})
+	require.True(t, errors.IsNotFound(err))
 }